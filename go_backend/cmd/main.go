@@ -31,6 +31,20 @@ func main() {
 		log.Printf("MinIO初始化失败，但程序继续运行: %v", err)
 	}
 
+	// 预支付缓存存储：默认 MySQL，服务重启后在线支付回调仍能创建订单
+	if config.Config.PrepayStore.Driver == "memory" {
+		model.SetPrepayStore(model.NewMemoryPrepayStore())
+	}
+
+	// 启动后台任务执行器（利润计算、分成结算、飞书通知等异步任务）
+	model.StartJobWorkers(4)
+	// 每日自动下载微信支付账单对账
+	api.ScheduleWechatReconciliation()
+	// 每日作废到期积分
+	model.SchedulePointsExpiry()
+	// 每日标记过期优惠券并生成到期提醒
+	model.ScheduleCouponExpiry()
+
 	// 创建路由引擎
 	router := gin.Default()
 
@@ -90,6 +104,9 @@ func main() {
 			// 常购商品接口
 			miniAppProtectedGroup.GET("/frequent-products", api.GetFrequentProducts)
 
+			// 配送时段接口
+			miniAppProtectedGroup.GET("/delivery-slots", api.GetMiniAppDeliverySlots) // 获取收货地址可预约的配送时段
+
 			// 订单接口
 			miniAppProtectedGroup.POST("/orders", api.CreateOrderFromCart)              // 从当前采购单创建订单（货到付款用）
 			miniAppProtectedGroup.POST("/wechat-pay/prepay-from-checkout", api.WeChatPrepayFromCheckout) // 在线支付预支付（不创建订单，支付成功后在回调创建）
@@ -97,14 +114,28 @@ func main() {
 			miniAppProtectedGroup.POST("/orders/:id/wechat-pay/prepay", api.WeChatPayPrepay) // 微信支付预支付（货到付款订单转为在线支付时用）
 			miniAppProtectedGroup.GET("/orders/:id", api.GetUserOrderDetail)                    // 获取订单详情
 			miniAppProtectedGroup.GET("/orders/:id/wechat-confirm-receive-info", api.GetWechatConfirmReceiveInfo) // 微信确认收货组件参数
+			miniAppProtectedGroup.GET("/orders/:id/tracking", api.GetUserOrderTracking)                           // 订单配送跟踪（配送员位置、前方停靠点数、预计送达时间）
+			miniAppProtectedGroup.GET("/orders/:id/tracking/stream", api.StreamUserOrderTracking)                 // 订单配送跟踪推送（SSE）
 			miniAppProtectedGroup.POST("/orders/:id/cancel", api.CancelUserOrder)               // 取消订单
 
+			// 售后接口
+			miniAppProtectedGroup.POST("/after-sales/upload-image", api.UploadMiniAppAfterSalesImage) // 上传售后凭证图片
+			miniAppProtectedGroup.POST("/after-sales", api.CreateMiniAppAfterSales)                   // 提交售后申请
+			miniAppProtectedGroup.GET("/after-sales", api.GetMiniAppAfterSalesList)                   // 我的售后申请列表
+			miniAppProtectedGroup.GET("/after-sales/:id", api.GetMiniAppAfterSalesDetail)             // 售后申请详情
+			miniAppProtectedGroup.POST("/after-sales/:id/cancel", api.CancelMiniAppAfterSales)        // 撤销售后申请
+
 			// 配送员位置接口（小程序端查看配送员位置）
 			miniAppProtectedGroup.GET("/delivery-employee-location/:code", api.GetEmployeeLocationByCode) // 根据员工码获取配送员位置
 
 			// 优惠券接口
-			miniAppProtectedGroup.GET("/coupons", api.GetUserCoupons)                // 获取用户的优惠券列表
-			miniAppProtectedGroup.GET("/coupons/available", api.GetAvailableCoupons) // 获取可用优惠券
+			miniAppProtectedGroup.GET("/coupons", api.GetUserCoupons)                                             // 获取用户的优惠券列表
+			miniAppProtectedGroup.GET("/coupons/available", api.GetAvailableCoupons)                              // 获取可用优惠券
+			miniAppProtectedGroup.POST("/coupons/redeem", api.RedeemCouponCode)                                   // 兑换码兑换优惠券
+			miniAppProtectedGroup.GET("/coupon-center", api.GetCouponCenter)                                      // 领券中心
+			miniAppProtectedGroup.POST("/coupon-center/:id/claim", api.ClaimCouponCampaign)                       // 领取领券活动的优惠券
+			miniAppProtectedGroup.GET("/coupon-expiry-reminders", api.GetMiniAppCouponExpiryReminders)            // 优惠券到期提醒列表
+			miniAppProtectedGroup.POST("/coupon-expiry-reminders/read", api.MarkMiniAppCouponExpiryRemindersRead) // 到期提醒标记已读（ids为空时全部）
 
 			// 新品需求接口
 			miniAppProtectedGroup.POST("/product-requests", api.CreateProductRequest)  // 创建新品需求
@@ -233,6 +264,12 @@ func main() {
 				protectedGroup.POST("/products", api.CreateProduct)                             // 创建商品
 				protectedGroup.PUT("/products/:id", api.UpdateProduct)                          // 更新商品
 				protectedGroup.PUT("/products/:id/special", api.UpdateProductSpecialStatus)     // 更新商品精选状态
+				protectedGroup.GET("/products/:id/stocks", api.GetProductStocksForAdmin)        // 获取商品各规格库存
+				protectedGroup.PUT("/products/:id/stocks", api.UpdateProductStock)              // 设置商品规格库存
+				protectedGroup.DELETE("/products/:id/stocks", api.DeleteProductStock)           // 关闭商品规格库存跟踪
+				protectedGroup.GET("/stock-movements", api.GetStockMovements)                   // 获取库存变动流水
+				protectedGroup.POST("/stock-adjustments", api.AdjustProductStock)               // 手动调整库存
+				protectedGroup.POST("/stocktakes", api.SubmitStocktake)                         // 提交盘点结果
 				protectedGroup.DELETE("/products/:id", api.DeleteProduct)                       // 删除商品
 				protectedGroup.PUT("/products/sort", api.BatchUpdateProductSort)                // 批量更新商品排序
 				protectedGroup.GET("/special-products", api.GetAllSpecialProductsForAdmin)      // 获取所有精选商品（管理后台）
@@ -286,6 +323,25 @@ func main() {
 				protectedGroup.POST("/coupons/issue", api.IssueCouponToUser)  // 发放优惠券给用户
 				protectedGroup.GET("/coupons/issues", api.GetCouponIssueLogs) // 优惠券发放记录列表
 				protectedGroup.GET("/coupons/usages", api.GetCouponUsageLogs) // 优惠券使用记录列表
+				protectedGroup.GET("/coupons/stats", api.GetCouponStats)      // 优惠券发放/使用/过期统计
+
+				// 领券活动与兑换码
+				protectedGroup.GET("/coupon-campaigns", api.GetCouponCampaigns)                        // 领券活动列表
+				protectedGroup.POST("/coupon-campaigns", api.CreateCouponCampaign)                     // 创建领券活动
+				protectedGroup.PUT("/coupon-campaigns/:id", api.UpdateCouponCampaign)                  // 更新领券活动
+				protectedGroup.DELETE("/coupon-campaigns/:id", api.DeleteCouponCampaign)               // 删除领券活动（已有领取记录的只能停用）
+				protectedGroup.GET("/coupon-code-batches", api.GetCouponCodeBatches)                   // 兑换码批次列表
+				protectedGroup.POST("/coupon-code-batches", api.CreateCouponCodeBatch)                 // 生成兑换码批次
+				protectedGroup.PUT("/coupon-code-batches/:id/status", api.UpdateCouponCodeBatchStatus) // 启用/停用兑换码批次
+				protectedGroup.GET("/coupon-code-batches/:id/codes", api.GetCouponRedeemCodes)         // 批次兑换码及兑换记录
+				protectedGroup.GET("/coupon-code-batches/:id/export", api.ExportCouponRedeemCodes)     // 导出批次兑换码（CSV）
+
+				// 限时促销
+				protectedGroup.GET("/product-promotions", api.GetProductPromotions)                    // 限时促销列表
+				protectedGroup.POST("/product-promotions", api.CreateProductPromotion)                 // 创建限时促销
+				protectedGroup.PUT("/product-promotions/:id", api.UpdateProductPromotion)              // 更新限时促销
+				protectedGroup.PUT("/product-promotions/:id/status", api.UpdateProductPromotionStatus) // 启用/停用限时促销
+				protectedGroup.DELETE("/product-promotions/:id", api.DeleteProductPromotion)           // 删除限时促销（已有订单占用的只能停用）
 
 				// 订单管理
 				protectedGroup.GET("/orders", api.GetAllOrdersForAdmin)                           // 获取所有订单（后台管理）
@@ -296,6 +352,64 @@ func main() {
 				protectedGroup.POST("/orders/:id/manual-refund", api.AdminManualRefund)           // 管理员手动退款（支付回调未同步等异常）
 				protectedGroup.POST("/orders/:id/refund-with-details", api.AdminRefundWithDetails) // 售后退款（指定金额、原因）
 				protectedGroup.POST("/orders/:id/upload-wechat-shipping", api.AdminUploadWechatShipping) // 手动录入微信发货信息（补录）
+				protectedGroup.GET("/orders/:id/status-history", api.GetOrderStatusHistory)       // 获取订单状态流转历史
+				protectedGroup.GET("/orders/:id/shortages", api.GetOrderShortagesForAdmin)        // 获取订单取货缺货记录
+				protectedGroup.POST("/orders/:id/shortages/resolve", api.ResolveOrderShortage)    // 处理挂起的缺货订单（联系客户后）
+
+				// 售后管理
+				protectedGroup.GET("/after-sales", api.GetAfterSalesListForAdmin)                      // 售后申请列表
+				protectedGroup.GET("/after-sales/:id", api.GetAfterSalesDetailForAdmin)                // 售后申请详情
+				protectedGroup.POST("/after-sales/:id/approve", api.ApproveAfterSalesRequest)          // 审核通过（仅退款立即退款）
+				protectedGroup.POST("/after-sales/:id/reject", api.RejectAfterSalesRequest)            // 驳回售后申请
+				protectedGroup.POST("/after-sales/:id/confirm-return", api.ConfirmAfterSalesReturn)    // 确认收到退货并退款
+				protectedGroup.POST("/after-sales/:id/retry-refund", api.RetryAfterSalesRefund)        // 重新发起退款
+				protectedGroup.POST("/after-sales/:id/complete", api.CompleteAfterSalesManually)       // 线下退款后手动完成
+
+				// 支付回调异常（支付成功但未能自动建单）
+				protectedGroup.GET("/prepay-exceptions", api.GetPrepayNotifyExceptions)                 // 支付回调异常列表
+				protectedGroup.POST("/prepay-exceptions/:id/convert", api.ConvertPrepayNotifyException) // 使用下单快照补单
+				protectedGroup.POST("/prepay-exceptions/:id/refund", api.RefundPrepayNotifyException)   // 全额退款
+				protectedGroup.POST("/prepay-exceptions/:id/ignore", api.IgnorePrepayNotifyException)   // 标记已忽略
+
+				// 微信支付对账
+				protectedGroup.POST("/wechat-reconciliation/upload", api.UploadWechatReconciliation)                                // 上传账单文件对账
+				protectedGroup.POST("/wechat-reconciliation/run", api.RunWechatReconciliation)                                      // 下载微信账单对账
+				protectedGroup.GET("/wechat-reconciliation/runs", api.GetWechatReconciliationRuns)                                  // 对账批次列表
+				protectedGroup.GET("/wechat-reconciliation/discrepancies", api.GetWechatReconciliationDiscrepancies)                // 对账差异列表
+				protectedGroup.GET("/wechat-reconciliation/discrepancies/export", api.ExportWechatReconciliationDiscrepancies)      // 导出对账差异
+				protectedGroup.POST("/wechat-reconciliation/discrepancies/:id/resolve", api.ResolveWechatReconciliationDiscrepancy) // 标记差异已处理
+
+				// 积分管理
+				protectedGroup.GET("/points/ledger-check", api.GetPointsLedgerCheck)              // 积分余额与明细一致性检查
+				protectedGroup.POST("/points/expire", api.RunPointsExpiry)                        // 立即作废到期积分
+				protectedGroup.GET("/points/shortfalls", api.GetPointsShortfalls)                 // 积分抵扣差额列表
+				protectedGroup.POST("/points/shortfalls/:id/resolve", api.ResolvePointsShortfall) // 标记积分抵扣差额已处理
+
+				// 配送时段管理
+				protectedGroup.GET("/delivery-slots", api.GetDeliverySlots)           // 配送时段列表
+				protectedGroup.POST("/delivery-slots", api.CreateDeliverySlot)        // 新增配送时段
+				protectedGroup.PUT("/delivery-slots/:id", api.UpdateDeliverySlot)     // 更新配送时段
+				protectedGroup.DELETE("/delivery-slots/:id", api.DeleteDeliverySlot)  // 删除配送时段
+				protectedGroup.GET("/delivery-slots/usage", api.GetDeliverySlotUsage) // 查看某天各时段预约量
+
+				// 配送区域管理
+				protectedGroup.GET("/delivery-zones", api.GetDeliveryZones)            // 配送区域列表
+				protectedGroup.POST("/delivery-zones", api.CreateDeliveryZone)         // 新增配送区域
+				protectedGroup.POST("/delivery-zones/import", api.ImportDeliveryZones) // 导入GeoJSON配送区域
+				protectedGroup.GET("/delivery-zones/check", api.CheckDeliveryZone)     // 查询坐标所在配送区域
+				protectedGroup.PUT("/delivery-zones/:id", api.UpdateDeliveryZone)      // 更新配送区域
+				protectedGroup.DELETE("/delivery-zones/:id", api.DeleteDeliveryZone)   // 删除配送区域
+
+				// 调度路线规划
+				protectedGroup.POST("/dispatch/plans", api.CreateDispatchPlan)              // 生成调度方案
+				protectedGroup.GET("/dispatch/plans", api.GetDispatchPlans)                 // 调度方案列表
+				protectedGroup.GET("/dispatch/plans/:id", api.GetDispatchPlan)              // 调度方案详情
+				protectedGroup.POST("/dispatch/plans/:id/confirm", api.ConfirmDispatchPlan) // 确认方案并派单
+				protectedGroup.POST("/dispatch/plans/:id/discard", api.DiscardDispatchPlan) // 作废调度方案
+
+				// 后台任务管理
+				protectedGroup.GET("/jobs", api.GetJobs)             // 获取后台任务列表
+				protectedGroup.POST("/jobs/:id/retry", api.RetryJob) // 重新执行后台任务
 
 				// 微信订单中心配置
 				protectedGroup.POST("/wechat/order-detail-path", api.AdminUpdateOrderDetailPath) // 配置「小程序购物订单」跳转路径
@@ -304,10 +418,13 @@ func main() {
 				protectedGroup.GET("/delivery-records", api.GetAllDeliveryRecordsForAdmin)                     // 获取所有配送记录（后台管理）
 				protectedGroup.GET("/delivery-records/:id", api.GetDeliveryRecordByIDForAdmin)                 // 获取配送记录详情（后台管理）
 				protectedGroup.GET("/delivery-records/order/:orderId", api.GetDeliveryRecordByOrderIDForAdmin) // 根据订单ID获取配送记录（后台管理）
+				protectedGroup.GET("/delivery-records/suspicious", api.GetSuspiciousDeliveries)                // 可疑配送记录（超出送达围栏，后台管理）
+				protectedGroup.PUT("/delivery-records/:id/review", api.ReviewSuspiciousDelivery)               // 审核可疑配送记录（后台管理）
 
 				// 配送费结算管理
 				protectedGroup.GET("/delivery-income/stats", api.GetDeliveryIncomeStatsForAdmin) // 获取配送员收入统计（管理员）
 				protectedGroup.POST("/delivery-income/settle", api.BatchSettleDeliveryFees)      // 批量结算配送费
+				protectedGroup.GET("/delivery-income/distance", api.GetRiderDistanceStats)       // 按轨迹统计配送员每日行驶里程
 
 				// 销售分成管理（管理员）
 				protectedGroup.GET("/sales-commission/stats", api.AdminGetSalesCommissionStats)                 // 获取销售员的分成统计（可查看所有销售员）
@@ -337,6 +454,15 @@ func main() {
 				// 员工位置管理
 				protectedGroup.GET("/employee-locations", api.GetEmployeeLocations)    // 获取所有员工位置
 				protectedGroup.GET("/employee-locations/:id", api.GetEmployeeLocation) // 获取指定员工位置
+				protectedGroup.GET("/employee-tracks/:code", api.GetRiderTrack)        // 获取配送员轨迹回放（抽稀轨迹、送达停留）
+
+				// 配送员排班与考勤
+				protectedGroup.GET("/rider-duty", api.GetRiderDutyStatuses)                // 获取配送员在岗状态
+				protectedGroup.POST("/rider-duty/:code/clock-out", api.ForceClockOutRider) // 强制配送员下班
+				protectedGroup.GET("/rider-shifts", api.GetRiderShifts)                    // 获取配送员排班
+				protectedGroup.POST("/rider-shifts", api.SaveRiderShifts)                  // 批量排班
+				protectedGroup.DELETE("/rider-shifts/:id", api.DeleteRiderShift)           // 删除排班
+				protectedGroup.GET("/rider-attendance", api.GetRiderAttendances)           // 配送员考勤报表
 
 				// 收款审核管理
 				protectedGroup.GET("/payment-verification", api.GetPaymentVerificationRequests)           // 获取收款审核列表
@@ -428,6 +554,14 @@ func main() {
 				employeeProtectedGroup.GET("/delivery/orders/:id", api.GetDeliveryOrderDetail)                           // 获取订单详情
 				employeeProtectedGroup.GET("/delivery/orders/:id/delivery-fee", api.GetDeliveryFeeCalculationForRider)   // 获取配送费计算结果（配送员）
 				employeeProtectedGroup.PUT("/delivery/orders/:id/accept", api.AcceptDeliveryOrder)                       // 接单
+				employeeProtectedGroup.GET("/delivery/dispatch-offers", api.GetMyDispatchOffers)                         // 获取待响应的派单邀请
+				employeeProtectedGroup.POST("/delivery/dispatch-offers/:id/accept", api.AcceptDispatchOffer)             // 接受派单邀请
+				employeeProtectedGroup.POST("/delivery/dispatch-offers/:id/decline", api.DeclineDispatchOffer)           // 拒绝派单邀请
+				employeeProtectedGroup.GET("/delivery/duty", api.GetMyDutyStatus)                                        // 获取在岗状态、当天考勤和排班
+				employeeProtectedGroup.POST("/delivery/duty/clock-in", api.ClockInRider)                                 // 上班打卡
+				employeeProtectedGroup.POST("/delivery/duty/clock-out", api.ClockOutRider)                               // 下班打卡
+				employeeProtectedGroup.POST("/delivery/duty/break", api.StartRiderBreak)                                 // 开始休息
+				employeeProtectedGroup.POST("/delivery/duty/resume", api.EndRiderBreak)                                  // 结束休息
 				employeeProtectedGroup.PUT("/delivery/orders/:id/start", api.StartDeliveryOrder)                         // 开始配送
 				employeeProtectedGroup.POST("/delivery/orders/:id/complete", api.CompleteDeliveryOrder)                  // 完成配送（支持上传图片）
 				employeeProtectedGroup.PUT("/delivery/orders/:id/complete", api.CompleteDeliveryOrderWithoutImages)     // 完成配送（不上传照片，忘记拍了）
@@ -436,7 +570,7 @@ func main() {
 				employeeProtectedGroup.GET("/delivery/my-orders", api.GetDeliveryOrders)                                 // 获取我的配送订单（通过status参数筛选）
 				employeeProtectedGroup.GET("/delivery/pickup/suppliers", api.GetPickupSuppliers)                         // 获取待取货供应商列表
 				employeeProtectedGroup.GET("/delivery/pickup/suppliers/:supplierId/items", api.GetPickupItemsBySupplier) // 获取供应商的待取货商品
-				employeeProtectedGroup.POST("/delivery/pickup/mark-picked", api.MarkItemsAsPicked)                       // 标记商品已取货
+				employeeProtectedGroup.POST("/delivery/pickup/mark-picked", api.MarkItemsAsPicked)                       // 标记商品已取货（可同时上报缺货）
 				employeeProtectedGroup.POST("/delivery/route/calculate", api.CalculateRoute)                             // 计算路线规划
 				employeeProtectedGroup.GET("/delivery/route/orders", api.GetRouteOrders)                                 // 获取排序后的订单列表
 				employeeProtectedGroup.GET("/delivery/income/stats", api.GetDeliveryIncomeStats)                         // 获取配送员收入统计
@@ -461,6 +595,7 @@ func main() {
 				employeeProtectedGroup.POST("/addresses/reverse-geocode", api.ReverseGeocode)                                    // 逆地理编码（将经纬度转换为地址，用于选点回填）
 				employeeProtectedGroup.POST("/addresses/search-poi", api.SearchPOI)                                              // POI搜索（使用高德地图API搜索地址）
 				employeeProtectedGroup.POST("/sales/orders", api.CreateOrderForCustomer)                                         // 为客户创建订单
+				employeeProtectedGroup.GET("/sales/delivery-slots", api.GetSalesDeliverySlots)                                   // 获取客户地址可预约的配送时段
 				employeeProtectedGroup.GET("/sales/products", api.GetSalesProducts)                                              // 获取商品列表
 				employeeProtectedGroup.GET("/sales/pending-orders", api.GetMyPendingOrders)                                      // 获取待配送订单列表
 				employeeProtectedGroup.GET("/sales/coupons", api.GetAllCoupons)                                                  // 销售员查看优惠券列表
@@ -472,6 +607,9 @@ func main() {
 				employeeProtectedGroup.POST("/sales/orders/:id/sync-to-purchase-list", api.SyncOrderItemsToPurchaseList)         // 将订单商品同步到采购单
 				employeeProtectedGroup.PUT("/sales/orders/:id", api.UpdateOrderForCustomer)                                      // 修改订单
 				employeeProtectedGroup.POST("/sales/orders/:id/cancel", api.CancelSalesOrder)                                    // 取消订单
+				employeeProtectedGroup.POST("/sales/after-sales/upload-image", api.UploadSalesAfterSalesImage)                   // 上传售后凭证图片
+				employeeProtectedGroup.POST("/sales/after-sales", api.CreateSalesAfterSales)                                     // 代客户提交售后申请
+				employeeProtectedGroup.GET("/sales/after-sales", api.GetSalesAfterSalesList)                                     // 名下客户的售后申请列表
 				employeeProtectedGroup.GET("/delivery-employee-location/:code", api.GetEmployeeLocationByCode)                   // 获取配送员位置（员工端）
 
 				// 销售分成相关接口
@@ -0,0 +1,439 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"go_backend/internal/model"
+	"go_backend/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// afterSalesCreateRequest 提交售后申请请求体
+type afterSalesCreateRequest struct {
+	OrderID     int                         `json:"order_id" binding:"required"`
+	Type        string                      `json:"type" binding:"required"` // refund_only / return_refund
+	Reason      string                      `json:"reason" binding:"required"`
+	Description string                      `json:"description"`
+	Images      []string                    `json:"images"`
+	Items       []model.AfterSalesItemInput `json:"items" binding:"required"`
+}
+
+// uploadAfterSalesImage 上传售后凭证图片（小程序和销售员共用）
+func uploadAfterSalesImage(c *gin.Context) {
+	file, headers, err := c.Request.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "请选择要上传的图片: " + err.Error()})
+		return
+	}
+	defer file.Close()
+
+	if headers.Size > 15*1024*1024 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "图片大小不能超过15MB"})
+		return
+	}
+
+	fileURL, err := utils.UploadFile("after-sales", c.Request, "after-sales")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "图片上传失败: " + err.Error()})
+		return
+	}
+	SaveImageIndex(fileURL, "after-sales", headers.Filename, headers.Size, headers.Header.Get("Content-Type"))
+
+	successResponse(c, gin.H{"imageUrl": fileURL}, "图片上传成功")
+}
+
+// UploadMiniAppAfterSalesImage 上传售后凭证图片（小程序）
+func UploadMiniAppAfterSalesImage(c *gin.Context) {
+	if _, ok := getMiniUserFromContext(c); !ok {
+		return
+	}
+	uploadAfterSalesImage(c)
+}
+
+// CreateMiniAppAfterSales 提交售后申请（小程序）
+func CreateMiniAppAfterSales(c *gin.Context) {
+	user, ok := getMiniUserFromContext(c)
+	if !ok {
+		return
+	}
+	var req afterSalesCreateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "参数错误: "+err.Error())
+		return
+	}
+
+	order, err := model.GetOrderByID(req.OrderID)
+	if err != nil {
+		internalErrorResponse(c, "获取订单失败: "+err.Error())
+		return
+	}
+	if order == nil || order.UserID != user.ID {
+		notFoundResponse(c, "订单不存在")
+		return
+	}
+
+	afterSales, err := model.CreateAfterSalesRequest(model.AfterSalesCreateInput{
+		OrderID:       req.OrderID,
+		Type:          req.Type,
+		Reason:        req.Reason,
+		Description:   req.Description,
+		Images:        req.Images,
+		Items:         req.Items,
+		ApplicantType: model.AfterSalesOperatorUser,
+		Applicant:     user.UserCode,
+	})
+	if err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	successResponse(c, afterSales, "售后申请已提交")
+}
+
+// GetMiniAppAfterSalesList 我的售后申请列表（小程序）
+func GetMiniAppAfterSalesList(c *gin.Context) {
+	user, ok := getMiniUserFromContext(c)
+	if !ok {
+		return
+	}
+	filter := model.AfterSalesFilter{
+		UserID: user.ID,
+		Status: c.Query("status"),
+	}
+	list, total, err := model.GetAfterSalesRequests(filter, parseQueryInt(c, "pageNum", 1), parseQueryInt(c, "pageSize", 10))
+	if err != nil {
+		internalErrorResponse(c, "获取售后列表失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{"list": list, "total": total}, "")
+}
+
+// GetMiniAppAfterSalesDetail 售后申请详情（小程序）
+func GetMiniAppAfterSalesDetail(c *gin.Context) {
+	user, ok := getMiniUserFromContext(c)
+	if !ok {
+		return
+	}
+	afterSales, ok := loadAfterSales(c)
+	if !ok {
+		return
+	}
+	if afterSales.UserID != user.ID {
+		notFoundResponse(c, "售后申请不存在")
+		return
+	}
+	successResponse(c, afterSales, "")
+}
+
+// CancelMiniAppAfterSales 撤销售后申请（小程序，仅待审核状态）
+func CancelMiniAppAfterSales(c *gin.Context) {
+	user, ok := getMiniUserFromContext(c)
+	if !ok {
+		return
+	}
+	afterSales, ok := loadAfterSales(c)
+	if !ok {
+		return
+	}
+	if afterSales.UserID != user.ID {
+		notFoundResponse(c, "售后申请不存在")
+		return
+	}
+	if err := model.CancelAfterSales(afterSales.ID, model.AfterSalesOperatorUser, user.UserCode); err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	successResponse(c, nil, "售后申请已撤销")
+}
+
+// UploadSalesAfterSalesImage 上传售后凭证图片（销售员）
+func UploadSalesAfterSalesImage(c *gin.Context) {
+	employee, ok := getEmployeeFromContext(c)
+	if !ok {
+		return
+	}
+	if !employee.IsSales {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "您不是销售员，无权访问此功能"})
+		return
+	}
+	uploadAfterSalesImage(c)
+}
+
+// CreateSalesAfterSales 代客户提交售后申请（销售员，仅限名下客户的订单）
+func CreateSalesAfterSales(c *gin.Context) {
+	employee, ok := getEmployeeFromContext(c)
+	if !ok {
+		return
+	}
+	if !employee.IsSales {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "您不是销售员，无权访问此功能"})
+		return
+	}
+	var req afterSalesCreateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "参数错误: "+err.Error())
+		return
+	}
+
+	order, err := model.GetOrderByID(req.OrderID)
+	if err != nil {
+		internalErrorResponse(c, "获取订单失败: "+err.Error())
+		return
+	}
+	if order == nil {
+		notFoundResponse(c, "订单不存在")
+		return
+	}
+	user, err := model.GetMiniAppUserByID(order.UserID)
+	if err != nil || user == nil || user.SalesCode != employee.EmployeeCode {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "无权为该订单申请售后"})
+		return
+	}
+
+	afterSales, err := model.CreateAfterSalesRequest(model.AfterSalesCreateInput{
+		OrderID:       req.OrderID,
+		Type:          req.Type,
+		Reason:        req.Reason,
+		Description:   req.Description,
+		Images:        req.Images,
+		Items:         req.Items,
+		ApplicantType: model.AfterSalesOperatorEmployee,
+		Applicant:     employee.EmployeeCode,
+	})
+	if err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	successResponse(c, afterSales, "售后申请已提交")
+}
+
+// GetSalesAfterSalesList 名下客户的售后申请列表（销售员）
+func GetSalesAfterSalesList(c *gin.Context) {
+	employee, ok := getEmployeeFromContext(c)
+	if !ok {
+		return
+	}
+	if !employee.IsSales {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "您不是销售员，无权访问此功能"})
+		return
+	}
+	filter := model.AfterSalesFilter{
+		SalesCode: employee.EmployeeCode,
+		Status:    c.Query("status"),
+		Keyword:   strings.TrimSpace(c.Query("keyword")),
+	}
+	list, total, err := model.GetAfterSalesRequests(filter, parseQueryInt(c, "pageNum", 1), parseQueryInt(c, "pageSize", 10))
+	if err != nil {
+		internalErrorResponse(c, "获取售后列表失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{"list": list, "total": total}, "")
+}
+
+// GetAfterSalesListForAdmin 售后申请列表（管理后台）
+func GetAfterSalesListForAdmin(c *gin.Context) {
+	filter := model.AfterSalesFilter{
+		OrderID: parseQueryInt(c, "order_id", 0),
+		Status:  c.Query("status"),
+		Keyword: strings.TrimSpace(c.Query("keyword")),
+	}
+	list, total, err := model.GetAfterSalesRequests(filter, parseQueryInt(c, "pageNum", 1), parseQueryInt(c, "pageSize", 20))
+	if err != nil {
+		internalErrorResponse(c, "获取售后列表失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{"list": list, "total": total}, "")
+}
+
+// GetAfterSalesDetailForAdmin 售后申请详情（管理后台）
+func GetAfterSalesDetailForAdmin(c *gin.Context) {
+	afterSales, ok := loadAfterSales(c)
+	if !ok {
+		return
+	}
+	successResponse(c, afterSales, "")
+}
+
+// ApproveAfterSalesRequest 审核通过售后申请（管理后台）
+// 仅退款：审核通过后立即退款；退货退款：等待确认收到退货后再退款
+func ApproveAfterSalesRequest(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		RefundAmount *float64 `json:"refund_amount"` // 为空时使用系统计算的退款金额
+		Remark       string   `json:"remark"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "参数错误")
+		return
+	}
+
+	operatorName := getAdminOperatorName(c)
+	afterSales, err := model.ApproveAfterSales(id, req.RefundAmount, operatorName, req.Remark)
+	if err != nil {
+		badRequestResponse(c, "审核失败: "+err.Error())
+		return
+	}
+
+	message := "售后申请已通过"
+	if afterSales.Type == model.AfterSalesTypeRefundOnly {
+		offline, err := processAfterSalesRefund(afterSales, operatorName)
+		if err != nil {
+			badRequestResponse(c, "已审核通过，但退款失败: "+err.Error())
+			return
+		}
+		if offline {
+			message = "售后申请已通过，请线下退款后手动完成"
+		}
+		afterSales, _ = model.GetAfterSalesRequestByID(id)
+	}
+	successResponse(c, afterSales, message)
+}
+
+// RejectAfterSalesRequest 驳回售后申请（管理后台）
+func RejectAfterSalesRequest(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Remark string `json:"remark" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "请填写驳回原因")
+		return
+	}
+	if err := model.RejectAfterSales(id, getAdminOperatorName(c), req.Remark); err != nil {
+		badRequestResponse(c, "驳回失败: "+err.Error())
+		return
+	}
+	successResponse(c, nil, "售后申请已驳回")
+}
+
+// ConfirmAfterSalesReturn 确认收到退货并退款（管理后台，仅退货退款）
+func ConfirmAfterSalesReturn(c *gin.Context) {
+	afterSales, ok := loadAfterSales(c)
+	if !ok {
+		return
+	}
+	if afterSales.Type != model.AfterSalesTypeReturnRefund {
+		badRequestResponse(c, "仅退货退款的售后需要确认收货")
+		return
+	}
+	if afterSales.Status != model.AfterSalesApproved {
+		badRequestResponse(c, "售后申请未审核通过")
+		return
+	}
+	offline, err := processAfterSalesRefund(afterSales, getAdminOperatorName(c))
+	if err != nil {
+		badRequestResponse(c, "退款失败: "+err.Error())
+		return
+	}
+	message := "已确认收货并发起退款"
+	if offline {
+		message = "已确认收货，请线下退款后手动完成"
+	}
+	afterSales, _ = model.GetAfterSalesRequestByID(afterSales.ID)
+	successResponse(c, afterSales, message)
+}
+
+// RetryAfterSalesRefund 重新发起售后退款（管理后台，退款失败时使用）
+func RetryAfterSalesRefund(c *gin.Context) {
+	afterSales, ok := loadAfterSales(c)
+	if !ok {
+		return
+	}
+	if afterSales.Status != model.AfterSalesRefundFailed {
+		badRequestResponse(c, "仅退款失败的售后可以重试")
+		return
+	}
+	if _, err := processAfterSalesRefund(afterSales, getAdminOperatorName(c)); err != nil {
+		badRequestResponse(c, "退款失败: "+err.Error())
+		return
+	}
+	afterSales, _ = model.GetAfterSalesRequestByID(afterSales.ID)
+	successResponse(c, afterSales, "已重新发起退款")
+}
+
+// CompleteAfterSalesManually 线下退款后手动完成售后（管理后台）
+func CompleteAfterSalesManually(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Remark string `json:"remark"`
+	}
+	_ = c.ShouldBindJSON(&req)
+	remark := req.Remark
+	if remark == "" {
+		remark = "线下退款，手动完成"
+	}
+	if err := model.CompleteAfterSales(id, model.AfterSalesRefundOffline, model.AfterSalesOperatorAdmin, getAdminOperatorName(c), remark); err != nil {
+		badRequestResponse(c, "完成售后失败: "+err.Error())
+		return
+	}
+	successResponse(c, nil, "售后已完成")
+}
+
+// processAfterSalesRefund 执行售后退款：微信支付的订单原路部分退款，等待退款回调完成售后
+// 其他订单需线下退款，保持待处理直到管理员确认退款后手动完成，此时返回 offline=true
+func processAfterSalesRefund(afterSales *model.AfterSalesRequest, operator string) (offline bool, err error) {
+	if afterSales.RefundAmount < 0.01 {
+		return false, model.CompleteAfterSales(afterSales.ID, model.AfterSalesRefundOffline, model.AfterSalesOperatorAdmin, operator, "无需退款")
+	}
+	order, err := model.GetOrderByID(afterSales.OrderID)
+	if err != nil {
+		return false, err
+	}
+	if order == nil || !order.NeedWechatRefundOnCancel() {
+		return true, model.MarkAfterSalesAwaitingOfflineRefund(afterSales.ID)
+	}
+
+	refundID, err := RequestWechatRefundWithOptions(order, RefundOptions{
+		RefundAmount: afterSales.RefundAmount,
+		Reason:       "售后退款：" + afterSales.Reason,
+	})
+	if err != nil {
+		if markErr := model.MarkAfterSalesRefundFailed(afterSales.ID, model.AfterSalesOperatorAdmin, operator, err.Error()); markErr != nil {
+			log.Printf("[AfterSales] 标记售后 %d 退款失败状态失败: %v", afterSales.ID, markErr)
+		}
+		return false, err
+	}
+	if err := model.MarkAfterSalesRefunding(afterSales.ID, refundID, model.AfterSalesOperatorAdmin, operator); err != nil {
+		return false, err
+	}
+	if err := model.RequestWechatRefundForOrder(order.ID, refundID); err != nil {
+		log.Printf("[AfterSales] 更新订单 %d 退款状态失败: %v", order.ID, err)
+	}
+	return false, nil
+}
+
+// loadAfterSales 按路径参数 id 加载售后申请，不存在时直接返回错误响应
+func loadAfterSales(c *gin.Context) (*model.AfterSalesRequest, bool) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return nil, false
+	}
+	afterSales, err := model.GetAfterSalesRequestByID(id)
+	if err != nil {
+		internalErrorResponse(c, "获取售后申请失败: "+err.Error())
+		return nil, false
+	}
+	if afterSales == nil {
+		notFoundResponse(c, "售后申请不存在")
+		return nil, false
+	}
+	return afterSales, true
+}
+
+// getAdminOperatorName 获取当前管理员用户名
+func getAdminOperatorName(c *gin.Context) string {
+	operator, _ := c.Get("username")
+	operatorName, _ := operator.(string)
+	return operatorName
+}
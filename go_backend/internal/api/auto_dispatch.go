@@ -0,0 +1,506 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go_backend/internal/model"
+	"go_backend/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// autoDispatchMu 串行执行自动派单，避免同一订单被同时推送给多个配送员
+var autoDispatchMu sync.Mutex
+
+func init() {
+	// 在线支付订单支付成功后进入待配送；货到付款订单在创建时入队派单任务
+	model.RegisterOrderStatusHook(model.OrderStatusPendingDelivery, "auto_dispatch", func(order *model.Order, change model.OrderStatusChange) error {
+		return runAutoDispatch(order.ID)
+	})
+	model.RegisterJobHandler(model.JobAutoDispatch, func(payload []byte) error {
+		orderID, err := model.DecodeOrderJobPayload(payload)
+		if err != nil {
+			return err
+		}
+		return runAutoDispatch(orderID)
+	})
+	model.RegisterJobHandler(model.JobDispatchOfferTimeout, runDispatchOfferTimeoutJob)
+}
+
+// dispatchCandidate 参与自动派单评分的配送员
+type dispatchCandidate struct {
+	EmployeeCode string
+	Name         string
+	Latitude     float64
+	Longitude    float64
+	DistanceKm   float64 // 当前位置到收货地址的距离
+	DetourKm     float64 // 插入当前批次路线增加的距离
+	Load         int     // 当前批次未完成订单数
+	AcceptRate   float64 // 最近 30 天派单邀请接受率（平滑后）
+	Score        float64 // 综合得分，越低越优先
+}
+
+func (c dispatchCandidate) detail() string {
+	return fmt.Sprintf("距离%.2f公里，绕行%.2f公里，在途%d单，接受率%.0f%%，得分%.2f",
+		c.DistanceKm, c.DetourKm, c.Load, c.AcceptRate*100, c.Score)
+}
+
+// scoreDispatchCandidates 为订单给在线配送员评分并按得分升序返回
+// 得分 = 距离×距离权重 + 绕行×绕行权重 + 在途单数×负载权重 − 接受率×接受率权重（单位均折算为公里）
+func scoreDispatchCandidates(orderLat, orderLng float64, excluded map[string]bool) ([]dispatchCandidate, error) {
+	riders, _, err := collectDispatchRiders(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	maxBatchOrders := model.GetSystemSettingInt("auto_dispatch_max_batch_orders", 10)
+	target := utils.Coordinate{Lat: orderLat, Lng: orderLng}
+	points := []utils.Coordinate{target}
+	candidates := make([]dispatchCandidate, 0, len(riders))
+	routes := make(map[string][]model.ActiveRouteStop, len(riders))
+	codes := make([]string, 0, len(riders))
+	for _, rider := range riders {
+		if excluded[rider.EmployeeCode] {
+			continue
+		}
+		stops, err := model.GetActiveRouteStops(rider.EmployeeCode)
+		if err != nil {
+			log.Printf("[AutoDispatch] 获取配送员 %s 当前路线失败: %v", rider.EmployeeCode, err)
+			continue
+		}
+		if maxBatchOrders > 0 && len(stops) >= maxBatchOrders {
+			continue
+		}
+		routes[rider.EmployeeCode] = stops
+		codes = append(codes, rider.EmployeeCode)
+		points = append(points, utils.Coordinate{Lat: rider.Latitude, Lng: rider.Longitude})
+		for _, s := range stops {
+			points = append(points, utils.Coordinate{Lat: s.Latitude, Lng: s.Longitude})
+		}
+		candidates = append(candidates, dispatchCandidate{
+			EmployeeCode: rider.EmployeeCode,
+			Name:         rider.Name,
+			Latitude:     rider.Latitude,
+			Longitude:    rider.Longitude,
+			Load:         len(stops),
+		})
+	}
+	if len(candidates) == 0 {
+		return candidates, nil
+	}
+
+	stats, err := model.GetDispatchAcceptanceStats(codes, 30)
+	if err != nil {
+		log.Printf("[AutoDispatch] 获取接单统计失败: %v", err)
+		stats = map[string]model.DispatchAcceptanceStat{}
+	}
+
+	weightDistance := model.GetSystemSettingFloat("auto_dispatch_weight_distance", 1)
+	weightDetour := model.GetSystemSettingFloat("auto_dispatch_weight_detour", 1)
+	weightLoad := model.GetSystemSettingFloat("auto_dispatch_weight_load", 0.5)
+	weightAcceptance := model.GetSystemSettingFloat("auto_dispatch_weight_acceptance", 2)
+
+	matrix := model.BuildDistanceMatrix(points, 0)
+	for i := range candidates {
+		c := &candidates[i]
+		c.DistanceKm = matrix.Distance(c.Latitude, c.Longitude, orderLat, orderLng)
+		c.DetourKm = insertionDetour(matrix, c.Latitude, c.Longitude, routes[c.EmployeeCode], orderLat, orderLng)
+		c.AcceptRate = stats[c.EmployeeCode].Rate()
+		c.Score = c.DistanceKm*weightDistance + c.DetourKm*weightDetour +
+			float64(c.Load)*weightLoad - c.AcceptRate*weightAcceptance
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Score < candidates[j].Score })
+	return candidates, nil
+}
+
+// insertionDetour 把订单插入配送员当前路线（起点为配送员位置）的最小增加距离
+func insertionDetour(matrix *utils.DistanceMatrix, startLat, startLng float64, stops []model.ActiveRouteStop, lat, lng float64) float64 {
+	prevLat, prevLng := startLat, startLng
+	// 追加到路线末尾
+	if len(stops) > 0 {
+		last := stops[len(stops)-1]
+		prevLat, prevLng = last.Latitude, last.Longitude
+	}
+	best := matrix.Distance(prevLat, prevLng, lat, lng)
+
+	prevLat, prevLng = startLat, startLng
+	for _, s := range stops {
+		added := matrix.Distance(prevLat, prevLng, lat, lng) + matrix.Distance(lat, lng, s.Latitude, s.Longitude) -
+			matrix.Distance(prevLat, prevLng, s.Latitude, s.Longitude)
+		if added < best {
+			best = added
+		}
+		prevLat, prevLng = s.Latitude, s.Longitude
+	}
+	if best < 0 {
+		return 0
+	}
+	return best
+}
+
+// runAutoDispatch 为待配送订单派单
+// auto 模式直接派给得分最高的配送员；offer 模式向得分最高且未被邀请过的配送员推送邀请，超时或拒绝后顺延下一位
+func runAutoDispatch(orderID int) error {
+	mode := model.GetAutoDispatchMode()
+	if mode == model.AutoDispatchModeOff {
+		return nil
+	}
+
+	autoDispatchMu.Lock()
+	defer autoDispatchMu.Unlock()
+
+	orderLat, orderLng, reason, err := model.GetDispatchOrderTarget(orderID)
+	if err != nil {
+		return fmt.Errorf("获取订单 %d 失败: %v", orderID, err)
+	}
+	if reason != "" {
+		if _, err := model.CancelPendingDispatchOffers(orderID); err != nil {
+			log.Printf("[AutoDispatch] 作废订单 %d 的派单邀请失败: %v", orderID, err)
+		}
+		log.Printf("[AutoDispatch] 订单 %d 无需派单: %s", orderID, reason)
+		return nil
+	}
+
+	offers, err := model.GetDispatchOffersByOrder(orderID)
+	if err != nil {
+		return fmt.Errorf("获取订单 %d 派单邀请失败: %v", orderID, err)
+	}
+	excluded := make(map[string]bool, len(offers))
+	for _, offer := range offers {
+		if offer.Status == model.DispatchOfferStatusPending && offer.ExpiresAt.After(time.Now()) {
+			// 仍在等待配送员响应
+			return nil
+		}
+		excluded[offer.EmployeeCode] = true
+	}
+	if mode == model.AutoDispatchModeOffer {
+		if maxOffers := model.GetSystemSettingInt("auto_dispatch_max_offers", 5); maxOffers > 0 && len(offers) >= maxOffers {
+			log.Printf("[AutoDispatch] 订单 %d 已推送 %d 次无人接单，等待配送员自行接单", orderID, len(offers))
+			return nil
+		}
+	}
+
+	candidates, err := scoreDispatchCandidates(orderLat, orderLng, excluded)
+	if err != nil {
+		return fmt.Errorf("配送员评分失败: %v", err)
+	}
+	if len(candidates) == 0 {
+		log.Printf("[AutoDispatch] 订单 %d 没有可派单的在线配送员，等待配送员自行接单", orderID)
+		return nil
+	}
+	best := candidates[0]
+
+	if mode == model.AutoDispatchModeAuto {
+		return autoAssignDispatchCandidate(orderID, best)
+	}
+	return offerDispatchCandidate(orderID, best)
+}
+
+// autoAssignDispatchCandidate 直接把订单派给配送员
+func autoAssignDispatchCandidate(orderID int, best dispatchCandidate) error {
+	if err := model.AutoAssignOrderToDeliveryEmployee(orderID, best.EmployeeCode); err != nil {
+		return fmt.Errorf("自动派单失败: %v", err)
+	}
+	remark := "自动派单：" + best.detail()
+	_ = model.CreateDeliveryLog(&model.DeliveryLog{
+		OrderID:              orderID,
+		Action:               model.DeliveryLogActionAccepted,
+		DeliveryEmployeeCode: &best.EmployeeCode,
+		ActionTime:           time.Now(),
+		Remark:               &remark,
+	})
+	log.Printf("[AutoDispatch] 订单 %d 已派给配送员 %s（%s）", orderID, best.EmployeeCode, best.detail())
+
+	locationManager.SendToEmployee(best.EmployeeCode, map[string]interface{}{
+		"type":     "dispatch_assigned",
+		"order_id": orderID,
+	})
+	lat, lng := best.Latitude, best.Longitude
+	go func() {
+		if err := CalculateAndUpdateRoute(best.EmployeeCode, &lat, &lng, true); err != nil {
+			log.Printf("[AutoDispatch] 计算配送员 %s 路线失败: %v", best.EmployeeCode, err)
+		}
+	}()
+	return nil
+}
+
+// offerDispatchCandidate 向配送员推送派单邀请并安排超时检查
+func offerDispatchCandidate(orderID int, best dispatchCandidate) error {
+	timeout := time.Duration(model.GetSystemSettingInt("auto_dispatch_offer_timeout_seconds", 60)) * time.Second
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	offer := &model.DispatchOffer{
+		OrderID:      orderID,
+		EmployeeCode: best.EmployeeCode,
+		Score:        best.Score,
+		Detail:       best.detail(),
+		ExpiresAt:    time.Now().Add(timeout),
+	}
+	if err := model.CreateDispatchOffer(offer); err != nil {
+		return err
+	}
+	remark := fmt.Sprintf("派单邀请 #%d：%s", offer.ID, offer.Detail)
+	_ = model.CreateDeliveryLog(&model.DeliveryLog{
+		OrderID:              orderID,
+		Action:               model.DeliveryLogActionDispatchOffered,
+		DeliveryEmployeeCode: &best.EmployeeCode,
+		ActionTime:           time.Now(),
+		Remark:               &remark,
+	})
+
+	if err := model.EnqueueJob(model.JobDispatchOfferTimeout, model.DispatchOfferJobPayload{OfferID: offer.ID}, model.JobOptions{
+		Delay:          timeout,
+		IdempotencyKey: "dispatch_offer_timeout:" + strconv.Itoa(offer.ID),
+	}); err != nil {
+		log.Printf("[AutoDispatch] 派单邀请 %d 超时任务入队失败: %v", offer.ID, err)
+	}
+
+	sent := locationManager.SendToEmployee(best.EmployeeCode, map[string]interface{}{
+		"type":            "dispatch_offer",
+		"offer":           offer,
+		"distance_km":     best.DistanceKm,
+		"detour_km":       best.DetourKm,
+		"timeout_seconds": int(timeout.Seconds()),
+	})
+	log.Printf("[AutoDispatch] 订单 %d 推送派单邀请 %d 给配送员 %s（%s），已送达: %v",
+		orderID, offer.ID, best.EmployeeCode, offer.Detail, sent)
+	return nil
+}
+
+// runDispatchOfferTimeoutJob 派单邀请超时未响应：标记超时并顺延下一位配送员
+func runDispatchOfferTimeoutJob(payload []byte) error {
+	var p model.DispatchOfferJobPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("解析任务参数失败: %v", err)
+	}
+	offer, err := model.GetDispatchOfferByID(p.OfferID)
+	if err != nil {
+		return err
+	}
+	if offer == nil || offer.Status != model.DispatchOfferStatusPending {
+		return nil
+	}
+	ok, err := model.ResolveDispatchOffer(offer.ID, "", model.DispatchOfferStatusExpired)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	remark := fmt.Sprintf("派单邀请 #%d 超时未响应", offer.ID)
+	_ = model.CreateDeliveryLog(&model.DeliveryLog{
+		OrderID:              offer.OrderID,
+		Action:               model.DeliveryLogActionDispatchExpired,
+		DeliveryEmployeeCode: &offer.EmployeeCode,
+		ActionTime:           time.Now(),
+		Remark:               &remark,
+	})
+	locationManager.SendToEmployee(offer.EmployeeCode, map[string]interface{}{
+		"type":     "dispatch_offer_expired",
+		"offer_id": offer.ID,
+		"order_id": offer.OrderID,
+	})
+	return runAutoDispatch(offer.OrderID)
+}
+
+// acceptDispatchOffer 配送员接受派单邀请；latitude/longitude 为 0 时使用实时位置规划路线
+func acceptDispatchOffer(offerID int, employeeCode string, latitude, longitude float64) error {
+	offer, err := model.GetDispatchOfferByID(offerID)
+	if err != nil {
+		return err
+	}
+	if offer == nil || offer.EmployeeCode != employeeCode {
+		return model.ErrDispatchOfferUnavailable
+	}
+	if canTake, err := model.RiderCanTakeOrders(employeeCode); err != nil {
+		return err
+	} else if !canTake {
+		return model.ErrRiderNotOnDuty
+	}
+	ok, err := model.ResolveDispatchOffer(offerID, employeeCode, model.DispatchOfferStatusAccepted)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return model.ErrDispatchOfferUnavailable
+	}
+
+	if err := model.UpdateOrderStatusWithDeliveryEmployee(offer.OrderID, "pending_pickup", employeeCode); err != nil {
+		// 订单已不可接（被锁定或已被接走），继续为其寻找配送员或结束派单
+		if enqueueErr := model.EnqueueJob(model.JobAutoDispatch, model.OrderJobPayload{OrderID: offer.OrderID}, model.JobOptions{}); enqueueErr != nil {
+			log.Printf("[AutoDispatch] 订单 %d 重新派单任务入队失败: %v", offer.OrderID, enqueueErr)
+		}
+		return fmt.Errorf("接单失败: %v", err)
+	}
+
+	remark := fmt.Sprintf("接受派单邀请 #%d", offerID)
+	_ = model.CreateDeliveryLog(&model.DeliveryLog{
+		OrderID:              offer.OrderID,
+		Action:               model.DeliveryLogActionAccepted,
+		DeliveryEmployeeCode: &employeeCode,
+		ActionTime:           time.Now(),
+		Remark:               &remark,
+	})
+
+	if latitude == 0 && longitude == 0 {
+		if loc := locationManager.GetLocationByEmployeeCode(employeeCode); loc != nil {
+			latitude, longitude = loc.Latitude, loc.Longitude
+		}
+	}
+	go func() {
+		var lat, lng *float64
+		if latitude != 0 || longitude != 0 {
+			lat, lng = &latitude, &longitude
+		}
+		if err := CalculateAndUpdateRoute(employeeCode, lat, lng, true); err != nil {
+			log.Printf("[AutoDispatch] 计算配送员 %s 路线失败: %v", employeeCode, err)
+		}
+	}()
+	return nil
+}
+
+// declineDispatchOffer 配送员拒绝派单邀请，顺延下一位配送员
+func declineDispatchOffer(offerID int, employeeCode, reason string) error {
+	offer, err := model.GetDispatchOfferByID(offerID)
+	if err != nil {
+		return err
+	}
+	if offer == nil || offer.EmployeeCode != employeeCode {
+		return model.ErrDispatchOfferUnavailable
+	}
+	ok, err := model.ResolveDispatchOffer(offerID, employeeCode, model.DispatchOfferStatusDeclined)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return model.ErrDispatchOfferUnavailable
+	}
+
+	remark := fmt.Sprintf("拒绝派单邀请 #%d", offerID)
+	if reason != "" {
+		remark += "：" + reason
+	}
+	_ = model.CreateDeliveryLog(&model.DeliveryLog{
+		OrderID:              offer.OrderID,
+		Action:               model.DeliveryLogActionDispatchDeclined,
+		DeliveryEmployeeCode: &employeeCode,
+		ActionTime:           time.Now(),
+		Remark:               &remark,
+	})
+	return model.EnqueueJob(model.JobAutoDispatch, model.OrderJobPayload{OrderID: offer.OrderID}, model.JobOptions{})
+}
+
+// wsDispatchOfferResult 派单邀请响应结果（WebSocket 回复）
+func wsDispatchOfferResult(msgType string, offerID int, err error) map[string]interface{} {
+	result := map[string]interface{}{
+		"type":     msgType + "_result",
+		"offer_id": offerID,
+		"success":  err == nil,
+	}
+	if err != nil {
+		result["message"] = err.Error()
+	}
+	return result
+}
+
+// requireDeliveryEmployee 获取当前配送员，非配送员时返回 403
+func requireDeliveryEmployee(c *gin.Context) (*model.Employee, bool) {
+	employee, ok := getEmployeeFromContext(c)
+	if !ok {
+		return nil, false
+	}
+	if !employee.IsDelivery {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "您不是配送员，无权访问此功能"})
+		return nil, false
+	}
+	return employee, true
+}
+
+// GetMyDispatchOffers 获取当前配送员待响应的派单邀请（配送员端）
+func GetMyDispatchOffers(c *gin.Context) {
+	employee, ok := requireDeliveryEmployee(c)
+	if !ok {
+		return
+	}
+	offers, err := model.GetPendingDispatchOffersByEmployee(employee.EmployeeCode)
+	if err != nil {
+		internalErrorResponse(c, "获取派单邀请失败: "+err.Error())
+		return
+	}
+	list := make([]gin.H, 0, len(offers))
+	for _, offer := range offers {
+		order, err := model.GetOrderByID(offer.OrderID)
+		if err != nil || order == nil {
+			continue
+		}
+		list = append(list, gin.H{
+			"offer": offer,
+			"order": order,
+		})
+	}
+	successResponse(c, list, "")
+}
+
+// AcceptDispatchOffer 接受派单邀请（配送员端）
+func AcceptDispatchOffer(c *gin.Context) {
+	employee, ok := requireDeliveryEmployee(c)
+	if !ok {
+		return
+	}
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	latitude, _ := strconv.ParseFloat(c.Query("latitude"), 64)
+	longitude, _ := strconv.ParseFloat(c.Query("longitude"), 64)
+
+	if err := acceptDispatchOffer(id, employee.EmployeeCode, latitude, longitude); err != nil {
+		if errors.Is(err, model.ErrDispatchOfferUnavailable) || errors.Is(err, model.ErrRiderNotOnDuty) {
+			badRequestResponse(c, err.Error())
+			return
+		}
+		internalErrorResponse(c, err.Error())
+		return
+	}
+	successResponse(c, nil, "接单成功")
+}
+
+// DeclineDispatchOffer 拒绝派单邀请（配送员端）
+func DeclineDispatchOffer(c *gin.Context) {
+	employee, ok := requireDeliveryEmployee(c)
+	if !ok {
+		return
+	}
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequestResponse(c, "请求参数错误: "+err.Error())
+			return
+		}
+	}
+
+	if err := declineDispatchOffer(id, employee.EmployeeCode, req.Reason); err != nil {
+		if errors.Is(err, model.ErrDispatchOfferUnavailable) {
+			badRequestResponse(c, err.Error())
+			return
+		}
+		internalErrorResponse(c, "拒绝派单失败: "+err.Error())
+		return
+	}
+	successResponse(c, nil, "已拒绝")
+}
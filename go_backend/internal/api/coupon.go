@@ -50,7 +50,7 @@ func GetCouponByID(c *gin.Context) {
 func CreateCoupon(c *gin.Context) {
 	var req struct {
 		Name          string  `json:"name" binding:"required"`
-		Type          string  `json:"type" binding:"required,oneof=delivery_fee amount"`
+		Type          string  `json:"type" binding:"required,oneof=delivery_fee amount percent"`
 		DiscountValue float64 `json:"discount_value" binding:"min=0"`
 		MinAmount     float64 `json:"min_amount" binding:"min=0"`
 		CategoryIDs   []int   `json:"category_ids"`
@@ -59,6 +59,7 @@ func CreateCoupon(c *gin.Context) {
 		ValidFrom     string  `json:"valid_from" binding:"required"`
 		ValidTo       string  `json:"valid_to" binding:"required"`
 		Description   string  `json:"description"`
+		model.CouponRules
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -113,6 +114,12 @@ func CreateCoupon(c *gin.Context) {
 		return
 	}
 
+	// 验证折扣券、适用范围和叠加规则
+	if msg := normalizeCouponRules(req.Type, req.DiscountValue, &req.CouponRules); msg != "" {
+		badRequestResponse(c, msg)
+		return
+	}
+
 	coupon := &model.Coupon{
 		Name:          req.Name,
 		Type:          req.Type,
@@ -124,6 +131,7 @@ func CreateCoupon(c *gin.Context) {
 		ValidFrom:     model.FromTime(validFrom),
 		ValidTo:       model.FromTime(validTo),
 		Description:   req.Description,
+		CouponRules:   req.CouponRules,
 	}
 
 	if coupon.Status == 0 {
@@ -147,7 +155,7 @@ func UpdateCoupon(c *gin.Context) {
 
 	var req struct {
 		Name          string  `json:"name" binding:"required"`
-		Type          string  `json:"type" binding:"required,oneof=delivery_fee amount"`
+		Type          string  `json:"type" binding:"required,oneof=delivery_fee amount percent"`
 		DiscountValue float64 `json:"discount_value" binding:"min=0"`
 		MinAmount     float64 `json:"min_amount" binding:"min=0"`
 		CategoryIDs   []int   `json:"category_ids"`
@@ -156,6 +164,7 @@ func UpdateCoupon(c *gin.Context) {
 		ValidFrom     string  `json:"valid_from" binding:"required"`
 		ValidTo       string  `json:"valid_to" binding:"required"`
 		Description   string  `json:"description"`
+		model.CouponRules
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -210,6 +219,12 @@ func UpdateCoupon(c *gin.Context) {
 		return
 	}
 
+	// 验证折扣券、适用范围和叠加规则
+	if msg := normalizeCouponRules(req.Type, req.DiscountValue, &req.CouponRules); msg != "" {
+		badRequestResponse(c, msg)
+		return
+	}
+
 	// 检查优惠券是否存在
 	existingCoupon, err := model.GetCouponByID(id)
 	if err != nil {
@@ -234,6 +249,7 @@ func UpdateCoupon(c *gin.Context) {
 		ValidTo:       model.FromTime(validTo),
 		Description:   req.Description,
 		UsedCount:     existingCoupon.UsedCount, // 保留已使用数量
+		CouponRules:   req.CouponRules,
 	}
 
 	if err := model.UpdateCoupon(coupon); err != nil {
@@ -244,6 +260,45 @@ func UpdateCoupon(c *gin.Context) {
 	successResponse(c, coupon, "更新成功")
 }
 
+// normalizeCouponRules 校验并整理折扣券、适用范围、限用和叠加规则，返回错误信息（校验通过时为空）
+func normalizeCouponRules(couponType string, discountValue float64, rules *model.CouponRules) string {
+	if couponType == model.CouponTypePercent && (discountValue <= 0 || discountValue >= 100) {
+		return "折扣券的优惠百分比必须大于0且小于100"
+	}
+	if rules.MaxDiscount < 0 {
+		return "最高优惠金额不能为负数"
+	}
+	if rules.MaxDiscount > 0 && couponType != model.CouponTypePercent {
+		return "仅折扣券可设置最高优惠金额"
+	}
+	if rules.PerUserLimit < 0 {
+		return "每人限用次数不能为负数"
+	}
+
+	switch rules.StackMode {
+	case "":
+		rules.StackMode = model.CouponStackDifferentType
+	case model.CouponStackExclusive, model.CouponStackDifferentType, model.CouponStackAny:
+	default:
+		return "叠加规则无效"
+	}
+
+	specKeys := make([]string, 0, len(rules.SpecKeys))
+	for _, key := range rules.SpecKeys {
+		key = strings.TrimSpace(key)
+		parts := strings.SplitN(key, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return "适用规格格式错误，应为 商品ID:规格名"
+		}
+		if productID, err := strconv.Atoi(parts[0]); err != nil || productID <= 0 {
+			return "适用规格格式错误，应为 商品ID:规格名"
+		}
+		specKeys = append(specKeys, key)
+	}
+	rules.SpecKeys = specKeys
+	return ""
+}
+
 // DeleteCoupon 删除优惠券
 func DeleteCoupon(c *gin.Context) {
 	id, ok := parseID(c, "id")
@@ -459,13 +514,13 @@ func IssueCouponToUser(c *gin.Context) {
 	}
 
 	// 记录发放日志（区分管理员 / 员工）
-	operatorType := "admin"
+	operatorType := model.CouponIssueOperatorAdmin
 	operatorID := 0
 	operatorName := ""
 
 	// 如果是员工端调用，该中间件已经把 employee 放到 context 里
 	if emp, ok := getEmployeeFromContext(c); ok {
-		operatorType = "employee"
+		operatorType = model.CouponIssueOperatorEmployee
 		operatorID = emp.ID
 		operatorName = emp.Name
 	}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// couponCampaignRequest 创建/更新领券活动的请求参数
+type couponCampaignRequest struct {
+	Name          string `json:"name" binding:"required"`
+	CouponID      int    `json:"coupon_id" binding:"required"`
+	Description   string `json:"description"`
+	PerUserLimit  int    `json:"per_user_limit" binding:"min=0"`  // 0 表示不限
+	TotalStock    int    `json:"total_stock" binding:"min=0"`     // 0 表示只受优惠券发放总数限制
+	ExpiresInDays int    `json:"expires_in_days" binding:"min=0"` // 0 表示使用优惠券有效期
+	StartAt       string `json:"start_at" binding:"required"`
+	EndAt         string `json:"end_at" binding:"required"`
+	Status        *int   `json:"status"`
+	SortOrder     int    `json:"sort_order"`
+}
+
+// parseCouponTime 解析活动时间，支持 "2006-01-02 15:04:05"、"2006-01-02T15:04:05" 和 "2006-01-02"
+func parseCouponTime(value string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, strings.TrimSpace(value), time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// bindCouponCampaign 解析并校验领券活动参数，失败时已写入响应
+func bindCouponCampaign(c *gin.Context) (*model.CouponCampaign, bool) {
+	var req couponCampaignRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "请求参数错误: "+err.Error())
+		return nil, false
+	}
+
+	startAt, ok := parseCouponTime(req.StartAt)
+	if !ok {
+		badRequestResponse(c, "开始时间格式错误")
+		return nil, false
+	}
+	endAt, ok := parseCouponTime(req.EndAt)
+	if !ok {
+		badRequestResponse(c, "结束时间格式错误")
+		return nil, false
+	}
+	if !endAt.After(startAt) {
+		badRequestResponse(c, "结束时间必须晚于开始时间")
+		return nil, false
+	}
+
+	coupon, err := model.GetCouponByID(req.CouponID)
+	if err != nil {
+		internalErrorResponse(c, "获取优惠券信息失败: "+err.Error())
+		return nil, false
+	}
+	if coupon == nil {
+		badRequestResponse(c, "优惠券不存在")
+		return nil, false
+	}
+	if endAt.After(coupon.ValidTo.ToTime()) {
+		badRequestResponse(c, "活动结束时间不能晚于优惠券有效期结束时间（"+coupon.ValidTo.ToTime().Format("2006-01-02 15:04:05")+"）")
+		return nil, false
+	}
+
+	status := 1
+	if req.Status != nil {
+		status = *req.Status
+	}
+	return &model.CouponCampaign{
+		Name:          strings.TrimSpace(req.Name),
+		CouponID:      req.CouponID,
+		CouponName:    coupon.Name,
+		Description:   strings.TrimSpace(req.Description),
+		PerUserLimit:  req.PerUserLimit,
+		TotalStock:    req.TotalStock,
+		ExpiresInDays: req.ExpiresInDays,
+		StartAt:       startAt,
+		EndAt:         endAt,
+		Status:        status,
+		SortOrder:     req.SortOrder,
+	}, true
+}
+
+// GetCouponCampaigns 领券活动列表（管理后台），参数：status（可选）
+func GetCouponCampaigns(c *gin.Context) {
+	var status *int
+	if v := c.Query("status"); v == "0" || v == "1" {
+		s := int(v[0] - '0')
+		status = &s
+	}
+	list, err := model.GetCouponCampaigns(status)
+	if err != nil {
+		internalErrorResponse(c, "获取领券活动失败: "+err.Error())
+		return
+	}
+	successResponse(c, list, "")
+}
+
+// CreateCouponCampaign 创建领券活动（管理后台）
+func CreateCouponCampaign(c *gin.Context) {
+	campaign, ok := bindCouponCampaign(c)
+	if !ok {
+		return
+	}
+	campaign.CreatedBy = getAdminOperatorName(c)
+	if err := model.CreateCouponCampaign(campaign); err != nil {
+		internalErrorResponse(c, "创建领券活动失败: "+err.Error())
+		return
+	}
+	successResponse(c, campaign, "创建成功")
+}
+
+// UpdateCouponCampaign 更新领券活动（管理后台）
+func UpdateCouponCampaign(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	campaign, ok := bindCouponCampaign(c)
+	if !ok {
+		return
+	}
+	campaign.ID = id
+	if err := model.UpdateCouponCampaign(campaign); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			notFoundResponse(c, "领券活动不存在")
+			return
+		}
+		if errors.Is(err, model.ErrCampaignStockTooSmall) {
+			badRequestResponse(c, err.Error())
+			return
+		}
+		internalErrorResponse(c, "更新领券活动失败: "+err.Error())
+		return
+	}
+	successResponse(c, campaign, "更新成功")
+}
+
+// DeleteCouponCampaign 删除领券活动（管理后台，已有领取记录的只能停用）
+func DeleteCouponCampaign(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	if err := model.DeleteCouponCampaign(id); err != nil {
+		if errors.Is(err, model.ErrCampaignHasClaims) {
+			badRequestResponse(c, err.Error())
+			return
+		}
+		internalErrorResponse(c, "删除领券活动失败: "+err.Error())
+		return
+	}
+	successResponse(c, nil, "删除成功")
+}
+
+// GetCouponCenter 小程序领券中心：进行中的领券活动及当前用户的领取情况
+func GetCouponCenter(c *gin.Context) {
+	user, ok := getMiniUserFromContext(c)
+	if !ok {
+		return
+	}
+	items, err := model.GetCouponCenter(user.ID)
+	if err != nil {
+		internalErrorResponse(c, "获取领券中心失败: "+err.Error())
+		return
+	}
+	successResponse(c, items, "")
+}
+
+// ClaimCouponCampaign 小程序领取领券活动的优惠券
+func ClaimCouponCampaign(c *gin.Context) {
+	user, ok := getMiniUserFromContext(c)
+	if !ok {
+		return
+	}
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+
+	result, err := model.ClaimCouponCampaign(id, user)
+	if err != nil {
+		if isCouponIssueUserError(err) {
+			badRequestResponse(c, err.Error())
+			return
+		}
+		internalErrorResponse(c, "领取优惠券失败: "+err.Error())
+		return
+	}
+	successResponse(c, result, "领取成功")
+}
+
+// isCouponIssueUserError 领券/兑换失败是否为可提示给用户的业务错误
+func isCouponIssueUserError(err error) bool {
+	for _, target := range []error{
+		model.ErrCouponUnavailable, model.ErrCouponNotInValidTime, model.ErrCouponOutOfStock,
+		model.ErrCampaignNotActive, model.ErrCampaignOutOfStock, model.ErrCampaignClaimLimit,
+		model.ErrRedeemCodeInvalid, model.ErrRedeemCodeUsed, model.ErrRedeemCodeExpired, model.ErrRedeemCodeDisabled,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
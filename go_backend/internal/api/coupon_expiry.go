@@ -0,0 +1,173 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// wechatSubscribeUserRefused 用户未订阅或订阅次数已用完，重试无意义
+const wechatSubscribeUserRefused = 43101
+
+func init() {
+	model.RegisterJobHandler(model.JobCouponExpiryPush, runCouponExpiryPushJob)
+}
+
+// runCouponExpiryPushJob 通过小程序订阅消息推送优惠券到期提醒
+func runCouponExpiryPushJob(payload []byte) error {
+	var p model.CouponExpiryPushPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("解析任务参数失败: %v", err)
+	}
+	reminder, err := model.GetCouponExpiryReminderByID(p.ReminderID)
+	if err != nil {
+		return err
+	}
+	if reminder == nil || reminder.PushStatus == model.CouponReminderPushSent {
+		return nil
+	}
+	if reminder.UserCouponStatus != "unused" {
+		return model.UpdateCouponExpiryReminderPush(reminder.ID, model.CouponReminderPushSkipped, "优惠券已使用或已过期")
+	}
+
+	templateID, _ := model.GetSystemSetting("coupon_expiry_subscribe_template_id")
+	templateID = strings.TrimSpace(templateID)
+	if templateID == "" {
+		return model.UpdateCouponExpiryReminderPush(reminder.ID, model.CouponReminderPushSkipped, "")
+	}
+	page, _ := model.GetSystemSetting("coupon_expiry_subscribe_page")
+
+	user, err := model.GetMiniAppUserByID(reminder.UserID)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.UniqueID == "" {
+		return model.UpdateCouponExpiryReminderPush(reminder.ID, model.CouponReminderPushFailed, "用户 openid 为空")
+	}
+
+	errcode, err := sendWechatSubscribeMessage(user.UniqueID, templateID, strings.TrimSpace(page), map[string]string{
+		"thing1": truncateRunes(reminder.CouponName, 20),
+		"time2":  reminder.ExpiresAt.Format("2006-01-02 15:04"),
+		"thing3": "您的优惠券即将到期，请尽快使用",
+	})
+	if err != nil {
+		_ = model.UpdateCouponExpiryReminderPush(reminder.ID, model.CouponReminderPushFailed, err.Error())
+		if errcode == wechatSubscribeUserRefused {
+			return nil
+		}
+		return err
+	}
+	return model.UpdateCouponExpiryReminderPush(reminder.ID, model.CouponReminderPushSent, "")
+}
+
+// sendWechatSubscribeMessage 发送小程序订阅消息，返回微信错误码（请求失败时为 0）
+func sendWechatSubscribeMessage(openid, templateID, page string, fields map[string]string) (int, error) {
+	token, err := getMiniProgramAccessToken()
+	if err != nil {
+		return 0, err
+	}
+	data := make(map[string]map[string]string, len(fields))
+	for k, v := range fields {
+		data[k] = map[string]string{"value": v}
+	}
+	reqBody := map[string]interface{}{
+		"touser":      openid,
+		"template_id": templateID,
+		"data":        data,
+	}
+	if page != "" {
+		reqBody["page"] = page
+	}
+	bodyBytes, _ := json.Marshal(reqBody)
+
+	apiURL := fmt.Sprintf("https://api.weixin.qq.com/cgi-bin/message/subscribe/send?access_token=%s", token)
+	resp, err := http.Post(apiURL, "application/json", bytes.NewReader(bodyBytes))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Errcode int    `json:"errcode"`
+		Errmsg  string `json:"errmsg"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	if result.Errcode != 0 {
+		return result.Errcode, fmt.Errorf("订阅消息发送失败: errcode=%d errmsg=%s", result.Errcode, result.Errmsg)
+	}
+	return 0, nil
+}
+
+// truncateRunes 按字符截断（订阅消息 thing 类型最多 20 个字符）
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n])
+}
+
+// GetCouponStats 优惠券发放/使用/过期统计（管理后台），参数：couponId（可选）
+func GetCouponStats(c *gin.Context) {
+	list, err := model.GetCouponStats(parseQueryInt(c, "couponId", 0))
+	if err != nil {
+		internalErrorResponse(c, "获取优惠券统计失败: "+err.Error())
+		return
+	}
+	successResponse(c, list, "")
+}
+
+// GetMiniAppCouponExpiryReminders 小程序优惠券到期提醒列表
+func GetMiniAppCouponExpiryReminders(c *gin.Context) {
+	user, ok := getMiniUserFromContext(c)
+	if !ok {
+		return
+	}
+	pageNum := parseQueryInt(c, "pageNum", 1)
+	pageSize := parseQueryInt(c, "pageSize", 20)
+	if pageSize > 100 {
+		pageSize = 20
+	}
+	list, total, unread, err := model.GetUserCouponExpiryReminders(user.ID, pageNum, pageSize)
+	if err != nil {
+		internalErrorResponse(c, "获取到期提醒失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"list":     list,
+		"total":    total,
+		"unread":   unread,
+		"pageNum":  pageNum,
+		"pageSize": pageSize,
+	}, "")
+}
+
+// MarkMiniAppCouponExpiryRemindersRead 小程序将到期提醒标记为已读，ids 为空时全部标记
+func MarkMiniAppCouponExpiryRemindersRead(c *gin.Context) {
+	user, ok := getMiniUserFromContext(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		IDs []int `json:"ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		badRequestResponse(c, "请求参数错误: "+err.Error())
+		return
+	}
+	if err := model.MarkCouponExpiryRemindersRead(user.ID, req.IDs); err != nil {
+		internalErrorResponse(c, "标记已读失败: "+err.Error())
+		return
+	}
+	successResponse(c, nil, "")
+}
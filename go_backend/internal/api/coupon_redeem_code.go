@@ -0,0 +1,251 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateCouponCodeBatch 生成一批优惠券兑换码（管理后台）
+func CreateCouponCodeBatch(c *gin.Context) {
+	var req struct {
+		Name           string `json:"name" binding:"required"`
+		CouponID       int    `json:"coupon_id" binding:"required"`
+		Quantity       int    `json:"quantity" binding:"required,min=1"`
+		ExpiresInDays  int    `json:"expires_in_days" binding:"min=0"` // 兑换后有效天数，0 表示使用优惠券有效期
+		RedeemDeadline string `json:"redeem_deadline"`                 // 兑换截止时间，可选
+		Remark         string `json:"remark"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "请求参数错误: "+err.Error())
+		return
+	}
+	if req.Quantity > model.MaxCouponCodeBatchSize {
+		badRequestResponse(c, fmt.Sprintf("单个批次最多生成 %d 个兑换码", model.MaxCouponCodeBatchSize))
+		return
+	}
+
+	coupon, err := model.GetCouponByID(req.CouponID)
+	if err != nil {
+		internalErrorResponse(c, "获取优惠券信息失败: "+err.Error())
+		return
+	}
+	if coupon == nil {
+		badRequestResponse(c, "优惠券不存在")
+		return
+	}
+
+	batch := &model.CouponCodeBatch{
+		Name:          strings.TrimSpace(req.Name),
+		CouponID:      coupon.ID,
+		CouponName:    coupon.Name,
+		Quantity:      req.Quantity,
+		ExpiresInDays: req.ExpiresInDays,
+		Remark:        strings.TrimSpace(req.Remark),
+		CreatedBy:     getAdminOperatorName(c),
+	}
+	if req.RedeemDeadline != "" {
+		deadline, ok := parseCouponTime(req.RedeemDeadline)
+		if !ok {
+			badRequestResponse(c, "兑换截止时间格式错误")
+			return
+		}
+		if len(strings.TrimSpace(req.RedeemDeadline)) == len("2006-01-02") {
+			deadline = deadline.AddDate(0, 0, 1).Add(-1) // 只传日期时截止到当天结束
+		}
+		batch.RedeemDeadline = &deadline
+	}
+
+	if err := model.CreateCouponCodeBatch(batch); err != nil {
+		internalErrorResponse(c, "生成兑换码失败: "+err.Error())
+		return
+	}
+	successResponse(c, batch, fmt.Sprintf("已生成 %d 个兑换码", batch.Quantity))
+}
+
+// GetCouponCodeBatches 兑换码批次列表（管理后台），参数：couponId，pageNum，pageSize
+func GetCouponCodeBatches(c *gin.Context) {
+	pageNum := parseQueryInt(c, "pageNum", 1)
+	pageSize := parseQueryInt(c, "pageSize", 20)
+	if pageSize > 100 {
+		pageSize = 20
+	}
+	list, total, err := model.GetCouponCodeBatches(parseQueryInt(c, "couponId", 0), pageNum, pageSize)
+	if err != nil {
+		internalErrorResponse(c, "获取兑换码批次失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"list":     list,
+		"total":    total,
+		"pageNum":  pageNum,
+		"pageSize": pageSize,
+	}, "")
+}
+
+// UpdateCouponCodeBatchStatus 启用或停用兑换码批次（管理后台）
+func UpdateCouponCodeBatchStatus(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Status *int `json:"status" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "请求参数错误: "+err.Error())
+		return
+	}
+	if *req.Status != 0 && *req.Status != 1 {
+		badRequestResponse(c, "状态只能为 0 或 1")
+		return
+	}
+	if err := model.SetCouponCodeBatchStatus(id, *req.Status); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			notFoundResponse(c, "兑换码批次不存在")
+			return
+		}
+		internalErrorResponse(c, "更新兑换码批次失败: "+err.Error())
+		return
+	}
+	successResponse(c, nil, "更新成功")
+}
+
+// getCouponCodeBatchForRequest 读取路径中的批次，失败时已写入响应
+func getCouponCodeBatchForRequest(c *gin.Context) (*model.CouponCodeBatch, bool) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return nil, false
+	}
+	batch, err := model.GetCouponCodeBatchByID(id)
+	if err != nil {
+		internalErrorResponse(c, "获取兑换码批次失败: "+err.Error())
+		return nil, false
+	}
+	if batch == nil {
+		notFoundResponse(c, "兑换码批次不存在")
+		return nil, false
+	}
+	return batch, true
+}
+
+// redeemCodeStatusFromQuery 兑换码状态筛选参数（unused / redeemed，为空时全部）
+func redeemCodeStatusFromQuery(c *gin.Context) (string, bool) {
+	status := strings.TrimSpace(c.Query("status"))
+	switch status {
+	case "", model.RedeemCodeUnused, model.RedeemCodeRedeemed:
+		return status, true
+	}
+	badRequestResponse(c, "兑换码状态无效")
+	return "", false
+}
+
+// GetCouponRedeemCodes 批次内兑换码及兑换记录（管理后台），参数：status，keyword（兑换码/客户名称/客户编号），pageNum，pageSize
+func GetCouponRedeemCodes(c *gin.Context) {
+	batch, ok := getCouponCodeBatchForRequest(c)
+	if !ok {
+		return
+	}
+	status, ok := redeemCodeStatusFromQuery(c)
+	if !ok {
+		return
+	}
+	pageNum := parseQueryInt(c, "pageNum", 1)
+	pageSize := parseQueryInt(c, "pageSize", 20)
+	if pageSize > 100 {
+		pageSize = 20
+	}
+
+	list, total, err := model.GetCouponRedeemCodes(batch.ID, status, strings.TrimSpace(c.Query("keyword")), pageNum, pageSize)
+	if err != nil {
+		internalErrorResponse(c, "获取兑换码失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"batch":    batch,
+		"list":     list,
+		"total":    total,
+		"pageNum":  pageNum,
+		"pageSize": pageSize,
+	}, "")
+}
+
+// ExportCouponRedeemCodes 导出批次兑换码（CSV，管理后台），参数：status
+func ExportCouponRedeemCodes(c *gin.Context) {
+	batch, ok := getCouponCodeBatchForRequest(c)
+	if !ok {
+		return
+	}
+	status, ok := redeemCodeStatusFromQuery(c)
+	if !ok {
+		return
+	}
+	list, _, err := model.GetCouponRedeemCodes(batch.ID, status, "", 1, 0)
+	if err != nil {
+		internalErrorResponse(c, "导出兑换码失败: "+err.Error())
+		return
+	}
+
+	statusNames := map[string]string{model.RedeemCodeUnused: "未兑换", model.RedeemCodeRedeemed: "已兑换"}
+	couponStatusNames := map[string]string{"unused": "未使用", "used": "已使用", "expired": "已过期"}
+
+	var buf bytes.Buffer
+	buf.WriteString("\ufeff") // Excel 识别 UTF-8
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{"兑换码", "优惠券", "状态", "兑换客户", "客户编号", "兑换时间", "优惠券状态", "使用订单ID"})
+	for _, rc := range list {
+		redeemedAt := ""
+		if rc.RedeemedAt != nil {
+			redeemedAt = rc.RedeemedAt.Format("2006-01-02 15:04:05")
+		}
+		_ = w.Write([]string{
+			rc.Code,
+			batch.CouponName,
+			statusNames[rc.Status],
+			rc.UserName,
+			rc.UserCode,
+			redeemedAt,
+			couponStatusNames[rc.CouponStatus],
+			formatOptionalInt(rc.OrderID),
+		})
+	}
+	w.Flush()
+
+	fileName := fmt.Sprintf("coupon_codes_%d.csv", batch.ID)
+	c.Header("Content-Disposition", "attachment; filename="+fileName)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// RedeemCouponCode 小程序使用兑换码兑换优惠券
+func RedeemCouponCode(c *gin.Context) {
+	user, ok := getMiniUserFromContext(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "请输入兑换码")
+		return
+	}
+
+	result, err := model.RedeemCouponCode(req.Code, user)
+	if err != nil {
+		if isCouponIssueUserError(err) {
+			badRequestResponse(c, err.Error())
+			return
+		}
+		internalErrorResponse(c, "兑换失败: "+err.Error())
+		return
+	}
+	successResponse(c, result, "兑换成功")
+}
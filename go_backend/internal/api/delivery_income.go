@@ -2,7 +2,6 @@ package api
 
 import (
 	"database/sql"
-	"log"
 	"net/http"
 	"time"
 
@@ -329,12 +328,8 @@ func BatchSettleDeliveryFees(c *gin.Context) {
 		for settledOrderRows.Next() {
 			var orderID int
 			if err := settledOrderRows.Scan(&orderID); err == nil {
-				// 异步处理销售分成计算（避免阻塞）
-				go func(id int) {
-					if err := model.ProcessOrderSettlement(id); err != nil {
-						log.Printf("处理订单 %d 的销售分成失败: %v", id, err)
-					}
-				}(orderID)
+				// 销售分成计算作为后台任务处理（避免阻塞）
+				model.EnqueueOrderSettlementJob(orderID)
 			}
 		}
 	}
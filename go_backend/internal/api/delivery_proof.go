@@ -0,0 +1,179 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// completionParam 读取完成配送参数（表单或查询参数）
+func completionParam(c *gin.Context, key string) string {
+	if v := strings.TrimSpace(c.PostForm(key)); v != "" {
+		return v
+	}
+	return strings.TrimSpace(c.Query(key))
+}
+
+func completionFloatParam(c *gin.Context, key string) *float64 {
+	v, err := strconv.ParseFloat(completionParam(c, key), 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// deliveryCompletionProof 完成配送前校验收货确认码并比较送达位置与收货地址，失败时已写入响应
+// 位置参数 latitude/longitude/accuracy 未提供时使用配送员实时位置
+func deliveryCompletionProof(c *gin.Context, order *model.Order, employeeCode string) (model.DeliveryProof, bool) {
+	confirmCodeVerified := false
+	if model.DeliveryConfirmCodeRequired(order) {
+		code := completionParam(c, "confirm_code")
+		if code == "" {
+			badRequestResponse(c, "该订单需要客户提供收货确认码")
+			return model.DeliveryProof{}, false
+		}
+		ok, err := model.VerifyDeliveryConfirmCode(order.ID, code)
+		if errors.Is(err, model.ErrDeliveryConfirmCodeLocked) {
+			badRequestResponse(c, err.Error())
+			return model.DeliveryProof{}, false
+		}
+		if err != nil {
+			internalErrorResponse(c, "校验收货确认码失败: "+err.Error())
+			return model.DeliveryProof{}, false
+		}
+		if !ok {
+			badRequestResponse(c, "收货确认码错误")
+			return model.DeliveryProof{}, false
+		}
+		confirmCodeVerified = true
+	}
+
+	latitude := completionFloatParam(c, "latitude")
+	longitude := completionFloatParam(c, "longitude")
+	accuracy := completionFloatParam(c, "accuracy")
+	if latitude == nil || longitude == nil {
+		if loc := locationManager.GetLocationByEmployeeCode(employeeCode); loc != nil {
+			lat, lng, acc := loc.Latitude, loc.Longitude, loc.Accuracy
+			latitude, longitude, accuracy = &lat, &lng, &acc
+		}
+	}
+
+	proof := model.EvaluateDeliveryProof(order, latitude, longitude, accuracy)
+	proof.ConfirmCodeVerified = confirmCodeVerified
+	if proof.ReviewStatus == model.DeliveryReviewPending {
+		log.Printf("[DeliveryProof] 订单 %d 送达位置异常（%s），已标记待审核", order.ID, deliveryProofRemark(proof))
+	}
+	return proof, true
+}
+
+// deliveryProofRemark 送达位置校验说明，用于配送日志备注
+func deliveryProofRemark(proof model.DeliveryProof) string {
+	switch proof.GeofenceStatus {
+	case model.GeofenceStatusInside:
+		return fmt.Sprintf("送达位置距收货地址%.0f米", *proof.DistanceToAddress)
+	case model.GeofenceStatusOutside:
+		return fmt.Sprintf("送达位置距收货地址%.0f米，超出%.0f米范围，待审核", *proof.DistanceToAddress, proof.RadiusMeters)
+	default:
+		return "无法获取送达位置，待审核"
+	}
+}
+
+// deliveryConfirmCodeForCustomer 小程序展示的收货确认码：需要确认码且订单待取货或配送中时返回（接单时已生成）
+func deliveryConfirmCodeForCustomer(order *model.Order) string {
+	if order.Status != model.OrderStatusPendingPickup && order.Status != model.OrderStatusDelivering {
+		return ""
+	}
+	if !model.DeliveryConfirmCodeRequired(order) {
+		return ""
+	}
+	code, err := model.EnsureDeliveryConfirmCode(order.ID)
+	if err != nil {
+		log.Printf("生成订单 %d 收货确认码失败: %v", order.ID, err)
+		return ""
+	}
+	return code
+}
+
+// GetSuspiciousDeliveries 可疑配送报表：超出围栏或无法判断送达位置的配送记录（管理后台）
+// 参数：review_status（pending/approved/rejected，为空时全部），employee_code，start_date，end_date，pageNum，pageSize
+func GetSuspiciousDeliveries(c *gin.Context) {
+	pageNum := parseQueryInt(c, "pageNum", 1)
+	pageSize := parseQueryInt(c, "pageSize", 10)
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 10
+	}
+
+	filter := model.SuspiciousDeliveryFilter{
+		ReviewStatus: strings.TrimSpace(c.Query("review_status")),
+		EmployeeCode: strings.TrimSpace(c.Query("employee_code")),
+	}
+	switch filter.ReviewStatus {
+	case "", model.DeliveryReviewPending, model.DeliveryReviewApproved, model.DeliveryReviewRejected:
+	default:
+		badRequestResponse(c, "审核状态无效")
+		return
+	}
+	if v := c.Query("start_date"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			badRequestResponse(c, "开始日期格式错误，应为 YYYY-MM-DD")
+			return
+		}
+		filter.StartTime = &t
+	}
+	if v := c.Query("end_date"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			badRequestResponse(c, "结束日期格式错误，应为 YYYY-MM-DD")
+			return
+		}
+		end := t.AddDate(0, 0, 1)
+		filter.EndTime = &end
+	}
+
+	list, total, err := model.GetSuspiciousDeliveries(filter, pageNum, pageSize)
+	if err != nil {
+		internalErrorResponse(c, "获取可疑配送记录失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"list":  list,
+		"total": total,
+	}, "")
+}
+
+// ReviewSuspiciousDelivery 审核可疑配送记录（管理后台）
+func ReviewSuspiciousDelivery(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Approved *bool  `json:"approved" binding:"required"`
+		Remark   string `json:"remark"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "请求参数错误: "+err.Error())
+		return
+	}
+
+	if err := model.ReviewDeliveryRecord(id, *req.Approved, getAdminOperatorName(c), strings.TrimSpace(req.Remark)); err != nil {
+		if errors.Is(err, model.ErrDeliveryReviewNotPending) {
+			badRequestResponse(c, err.Error())
+			return
+		}
+		internalErrorResponse(c, "审核失败: "+err.Error())
+		return
+	}
+	successResponse(c, nil, "审核完成")
+}
@@ -322,6 +322,10 @@ func GetDeliveryRecordByOrderIDForAdmin(c *gin.Context) {
 	if record.DoorplateImageURL != nil {
 		data["doorplate_image_url"] = *record.DoorplateImageURL
 	}
+	// 送达位置校验与审核结果
+	if proof, err := model.GetDeliveryProofByOrderID(orderID); err == nil && proof != nil {
+		data["proof"] = proof
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
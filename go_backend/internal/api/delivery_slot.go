@@ -0,0 +1,174 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newDeliverySlotSelection 由下单请求构造配送时段选择，未选择时返回 nil
+func newDeliverySlotSelection(slotID int, date string) *model.DeliverySlotSelection {
+	if slotID <= 0 {
+		return nil
+	}
+	return &model.DeliverySlotSelection{SlotID: slotID, Date: strings.TrimSpace(date)}
+}
+
+// deliverySlotOptionsResponse 可选配送时段列表响应
+func deliverySlotOptionsResponse(c *gin.Context, address *model.Address, units float64) {
+	options, err := model.GetAvailableDeliverySlots(address, units)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取配送时段失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "获取成功",
+		"data": gin.H{
+			"list":     options,
+			"required": model.IsDeliverySlotRequired(),
+		},
+	})
+}
+
+// deliverySlotUnitsQuery 解析 units 参数（本单配送件数，可为小数），无效时返回 0
+func deliverySlotUnitsQuery(c *gin.Context) float64 {
+	units, err := strconv.ParseFloat(c.Query("units"), 64)
+	if err != nil || units <= 0 {
+		return 0
+	}
+	return units
+}
+
+// GetMiniAppDeliverySlots 获取收货地址可预约的配送时段（小程序结算页）
+// units 为本单配送件数（规格配送计件数 × 数量），不传时按当前采购单计算
+func GetMiniAppDeliverySlots(c *gin.Context) {
+	user, ok := getMiniUserFromContext(c)
+	if !ok {
+		return
+	}
+
+	addressID := parseQueryInt(c, "address_id", 0)
+	if addressID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "请选择收货地址"})
+		return
+	}
+	address, err := model.GetAddressByID(addressID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取地址信息失败: " + err.Error()})
+		return
+	}
+	if address == nil || address.UserID != user.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "收货地址无效"})
+		return
+	}
+
+	units := deliverySlotUnitsQuery(c)
+	if units <= 0 {
+		if items, err := model.GetPurchaseListItemsByUserID(user.ID); err == nil {
+			units = model.TotalDeliveryUnits(items)
+		}
+	}
+	deliverySlotOptionsResponse(c, address, units)
+}
+
+// GetSalesDeliverySlots 获取客户收货地址可预约的配送时段（销售员代客下单）
+func GetSalesDeliverySlots(c *gin.Context) {
+	employee, ok := getEmployeeFromContext(c)
+	if !ok {
+		return
+	}
+
+	if !employee.IsSales {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "您不是销售员，无权访问此功能"})
+		return
+	}
+
+	addressID := parseQueryInt(c, "address_id", 0)
+	if addressID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "请选择收货地址"})
+		return
+	}
+	address, err := model.GetAddressByID(addressID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取地址信息失败: " + err.Error()})
+		return
+	}
+	if address == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "收货地址无效"})
+		return
+	}
+	deliverySlotOptionsResponse(c, address, deliverySlotUnitsQuery(c))
+}
+
+// GetDeliverySlots 获取配送时段配置列表（管理后台）
+func GetDeliverySlots(c *gin.Context) {
+	slots, err := model.ListDeliverySlots(false)
+	if err != nil {
+		internalErrorResponse(c, "获取配送时段失败: "+err.Error())
+		return
+	}
+	successResponse(c, slots, "")
+}
+
+// CreateDeliverySlot 新增配送时段（管理后台）
+func CreateDeliverySlot(c *gin.Context) {
+	var slot model.DeliverySlot
+	if err := c.ShouldBindJSON(&slot); err != nil {
+		badRequestResponse(c, "请求参数错误: "+err.Error())
+		return
+	}
+	if err := model.CreateDeliverySlot(&slot); err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	successResponse(c, slot, "创建成功")
+}
+
+// UpdateDeliverySlot 更新配送时段（管理后台）
+func UpdateDeliverySlot(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var slot model.DeliverySlot
+	if err := c.ShouldBindJSON(&slot); err != nil {
+		badRequestResponse(c, "请求参数错误: "+err.Error())
+		return
+	}
+	slot.ID = id
+	if err := model.UpdateDeliverySlot(&slot); err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	successResponse(c, slot, "更新成功")
+}
+
+// DeleteDeliverySlot 删除配送时段（管理后台，已预约订单保留时段时间）
+func DeleteDeliverySlot(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	if err := model.DeleteDeliverySlot(id); err != nil {
+		internalErrorResponse(c, "删除配送时段失败: "+err.Error())
+		return
+	}
+	successResponse(c, nil, "删除成功")
+}
+
+// GetDeliverySlotUsage 查看某天各配送时段的预约量（管理后台），date 默认今天
+func GetDeliverySlotUsage(c *gin.Context) {
+	date := c.DefaultQuery("date", time.Now().Format("2006-01-02"))
+	list, err := model.GetDeliverySlotUsage(date)
+	if err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	successResponse(c, list, "")
+}
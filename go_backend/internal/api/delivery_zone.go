@@ -0,0 +1,126 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"strconv"
+
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetDeliveryZones 获取配送区域列表（管理后台）
+func GetDeliveryZones(c *gin.Context) {
+	zones, err := model.ListDeliveryZones(false)
+	if err != nil {
+		internalErrorResponse(c, "获取配送区域失败: "+err.Error())
+		return
+	}
+	successResponse(c, zones, "")
+}
+
+// CreateDeliveryZone 新增配送区域（管理后台）
+func CreateDeliveryZone(c *gin.Context) {
+	var zone model.DeliveryZone
+	if err := c.ShouldBindJSON(&zone); err != nil {
+		badRequestResponse(c, "请求参数错误: "+err.Error())
+		return
+	}
+	if err := model.CreateDeliveryZone(&zone); err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	successResponse(c, zone, "创建成功")
+}
+
+// UpdateDeliveryZone 更新配送区域（管理后台）
+func UpdateDeliveryZone(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var zone model.DeliveryZone
+	if err := c.ShouldBindJSON(&zone); err != nil {
+		badRequestResponse(c, "请求参数错误: "+err.Error())
+		return
+	}
+	zone.ID = id
+	if err := model.UpdateDeliveryZone(&zone); err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	successResponse(c, zone, "更新成功")
+}
+
+// DeleteDeliveryZone 删除配送区域（管理后台）
+func DeleteDeliveryZone(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	if err := model.DeleteDeliveryZone(id); err != nil {
+		internalErrorResponse(c, "删除配送区域失败: "+err.Error())
+		return
+	}
+	successResponse(c, nil, "删除成功")
+}
+
+// ImportDeliveryZones 导入 GeoJSON 配送区域（管理后台）
+// 请求体为 GeoJSON，或上传 file 字段；replace=1 时替换全部已有区域
+func ImportDeliveryZones(c *gin.Context) {
+	var raw []byte
+	if file, err := c.FormFile("file"); err == nil {
+		f, err := file.Open()
+		if err != nil {
+			badRequestResponse(c, "读取文件失败: "+err.Error())
+			return
+		}
+		defer f.Close()
+		raw, err = io.ReadAll(f)
+		if err != nil {
+			badRequestResponse(c, "读取文件失败: "+err.Error())
+			return
+		}
+	} else {
+		raw, err = io.ReadAll(c.Request.Body)
+		if err != nil {
+			badRequestResponse(c, "读取请求失败: "+err.Error())
+			return
+		}
+	}
+	if len(raw) == 0 {
+		badRequestResponse(c, "请上传 GeoJSON")
+		return
+	}
+
+	replace := c.Query("replace") == "1" || c.PostForm("replace") == "1"
+	zones, err := model.ImportDeliveryZonesFromGeoJSON(raw, replace)
+	if err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"list":  zones,
+		"total": len(zones),
+	}, "导入成功")
+}
+
+// CheckDeliveryZone 查询坐标所在配送区域（管理后台调试用）
+func CheckDeliveryZone(c *gin.Context) {
+	lat, errLat := strconv.ParseFloat(c.Query("latitude"), 64)
+	lng, errLng := strconv.ParseFloat(c.Query("longitude"), 64)
+	if errLat != nil || errLng != nil {
+		badRequestResponse(c, "请提供正确的经纬度")
+		return
+	}
+	zone, err := model.CheckLocationServiceable(&lat, &lng)
+	if err != nil && !errors.Is(err, model.ErrAddressNotServiceable) {
+		internalErrorResponse(c, "查询配送区域失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"serviceable": err == nil,
+		"zone":        zone,
+	}, "")
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dispatchRiderLocationMaxAge 未连接实时定位时，数据库中最近位置的最长有效时间
+const dispatchRiderLocationMaxAge = 30 * time.Minute
+
+// collectDispatchRiders 获取参与调度的配送员及其位置
+// 未指定员工码时取所有在线（5 分钟内上报位置）的配送员，启用上班打卡要求时只取在岗的
+func collectDispatchRiders(employeeCodes []string) ([]model.DispatchRider, []string, error) {
+	codes := make([]string, 0, len(employeeCodes))
+	for _, code := range employeeCodes {
+		if code = strings.TrimSpace(code); code != "" {
+			codes = append(codes, code)
+		}
+	}
+	if len(codes) == 0 {
+		var onDuty map[string]bool
+		if model.RiderDutyRequired() {
+			var err error
+			if onDuty, err = model.GetOnDutyRiderCodes(); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, loc := range locationManager.GetAllLocations() {
+			if time.Since(loc.UpdatedAt) <= 5*time.Minute && (onDuty == nil || onDuty[loc.EmployeeCode]) {
+				codes = append(codes, loc.EmployeeCode)
+			}
+		}
+	}
+
+	employees, err := model.GetEmployeesByEmployeeCodes(codes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	riders := make([]model.DispatchRider, 0, len(codes))
+	skipped := make([]string, 0)
+	for _, code := range codes {
+		employee := employees[code]
+		if employee == nil || !employee.IsDelivery || !employee.Status {
+			skipped = append(skipped, code+"：不是启用中的配送员")
+			continue
+		}
+		rider := model.DispatchRider{EmployeeCode: code, Name: employee.Name}
+		if loc := locationManager.GetLocationByEmployeeCode(code); loc != nil {
+			rider.Latitude, rider.Longitude = loc.Latitude, loc.Longitude
+		} else if last, err := model.GetLatestEmployeeLocationByCode(code); err == nil && last != nil && time.Since(last.CreatedAt) <= dispatchRiderLocationMaxAge {
+			rider.Latitude, rider.Longitude = last.Latitude, last.Longitude
+		} else {
+			skipped = append(skipped, code+"：没有最近的位置信息")
+			continue
+		}
+		riders = append(riders, rider)
+	}
+	return riders, skipped, nil
+}
+
+// CreateDispatchPlan 为待配送订单生成调度方案（管理后台）
+// 可指定参与的配送员及容量、速度、停留时间，未指定的参数使用系统设置
+func CreateDispatchPlan(c *gin.Context) {
+	var req struct {
+		EmployeeCodes  []string `json:"employee_codes"`
+		Capacity       *float64 `json:"capacity"`
+		SpeedKmh       *float64 `json:"speed_kmh"`
+		ServiceMinutes *float64 `json:"service_minutes"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequestResponse(c, "请求参数错误: "+err.Error())
+			return
+		}
+	}
+
+	opts := model.DefaultDispatchPlanOptions()
+	if req.Capacity != nil && *req.Capacity >= 0 {
+		opts.Capacity = *req.Capacity
+	}
+	if req.SpeedKmh != nil && *req.SpeedKmh > 0 {
+		opts.SpeedKmh = *req.SpeedKmh
+	}
+	if req.ServiceMinutes != nil && *req.ServiceMinutes >= 0 {
+		opts.ServiceMinutes = *req.ServiceMinutes
+	}
+
+	riders, skippedRiders, err := collectDispatchRiders(req.EmployeeCodes)
+	if err != nil {
+		internalErrorResponse(c, "获取配送员失败: "+err.Error())
+		return
+	}
+	if len(riders) == 0 {
+		badRequestResponse(c, "没有可调度的在线配送员")
+		return
+	}
+
+	plan, err := model.BuildDispatchPlan(riders, opts, getAdminOperatorName(c))
+	if err != nil {
+		internalErrorResponse(c, "生成调度方案失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"plan":           plan,
+		"skipped_riders": skippedRiders,
+	}, "生成成功")
+}
+
+// GetDispatchPlans 获取调度方案列表（管理后台）
+func GetDispatchPlans(c *gin.Context) {
+	pageNum := parseQueryInt(c, "pageNum", 1)
+	pageSize := parseQueryInt(c, "pageSize", 10)
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 10
+	}
+
+	plans, total, err := model.GetDispatchPlans(c.Query("status"), pageNum, pageSize)
+	if err != nil {
+		internalErrorResponse(c, "获取调度方案失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"list":  plans,
+		"total": total,
+	}, "")
+}
+
+// GetDispatchPlan 获取调度方案详情（管理后台）
+func GetDispatchPlan(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	plan, err := model.GetDispatchPlanByID(id)
+	if err != nil {
+		internalErrorResponse(c, "获取调度方案失败: "+err.Error())
+		return
+	}
+	if plan == nil {
+		badRequestResponse(c, "调度方案不存在")
+		return
+	}
+	successResponse(c, plan, "")
+}
+
+// ConfirmDispatchPlan 确认调度方案并派单（管理后台）
+func ConfirmDispatchPlan(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	plan, err := model.ConfirmDispatchPlan(id, getAdminOperatorName(c))
+	if err != nil {
+		if errors.Is(err, model.ErrDispatchPlanNotDraft) {
+			badRequestResponse(c, err.Error())
+			return
+		}
+		internalErrorResponse(c, "确认调度方案失败: "+err.Error())
+		return
+	}
+	successResponse(c, plan, "派单完成")
+}
+
+// DiscardDispatchPlan 作废调度方案（管理后台）
+func DiscardDispatchPlan(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	if err := model.DiscardDispatchPlan(id, getAdminOperatorName(c)); err != nil {
+		if errors.Is(err, model.ErrDispatchPlanNotDraft) {
+			badRequestResponse(c, err.Error())
+			return
+		}
+		internalErrorResponse(c, "作废调度方案失败: "+err.Error())
+		return
+	}
+	successResponse(c, nil, "已作废")
+}
@@ -3,18 +3,16 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math"
 	"net/http"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"go_backend/internal/database"
 	"go_backend/internal/model"
-	"go_backend/internal/notify"
 	"go_backend/internal/utils"
 
 	"github.com/gin-gonic/gin"
@@ -35,7 +33,9 @@ func GetDeliveryOrders(c *gin.Context) {
 
 	pageNum := parseQueryInt(c, "pageNum", 1)
 	pageSize := parseQueryInt(c, "pageSize", 10)
-	status := c.Query("status") // 可选：pending_delivery, delivering, delivered
+	status := c.Query("status")              // 可选：pending_delivery, delivering, delivered
+	slotDate := c.Query("slot_date")         // 可选：按预约配送日期筛选 YYYY-MM-DD
+	slotID := parseQueryInt(c, "slot_id", 0) // 可选：按预约配送时段筛选
 
 	if pageNum < 1 {
 		pageNum = 1
@@ -44,6 +44,27 @@ func GetDeliveryOrders(c *gin.Context) {
 		pageSize = 10
 	}
 
+	// 待接订单只对在岗配送员可见
+	if status == "" || status == "pending_delivery" || status == "pending" {
+		canTake, err := model.RiderCanTakeOrders(employee.EmployeeCode)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取在岗状态失败: " + err.Error()})
+			return
+		}
+		if !canTake {
+			c.JSON(http.StatusOK, gin.H{
+				"code": 200,
+				"data": gin.H{
+					"list":    []interface{}{},
+					"total":   0,
+					"on_duty": false,
+				},
+				"message": "当前未在岗，上班打卡后可查看待接订单",
+			})
+			return
+		}
+	}
+
 	// 构建查询条件
 	where := "status IN ('pending_delivery', 'pending')" // 待配送订单
 	args := []interface{}{}
@@ -76,6 +97,21 @@ func GetDeliveryOrders(c *gin.Context) {
 		where += " AND delivery_employee_code IS NULL"
 	}
 
+	// 按预约配送时段筛选
+	if slotDate != "" {
+		day, err := time.ParseInLocation("2006-01-02", slotDate, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "配送日期格式错误"})
+			return
+		}
+		where += " AND delivery_slot_start >= ? AND delivery_slot_start < ?"
+		args = append(args, day, day.AddDate(0, 0, 1))
+	}
+	if slotID > 0 {
+		where += " AND delivery_slot_id = ?"
+		args = append(args, slotID)
+	}
+
 	// 过滤掉已锁定的订单（正在被修改的订单不能接单）
 	// 注意：历史订单（completed状态）不需要过滤锁定状态
 	if status != "completed" {
@@ -115,15 +151,16 @@ func GetDeliveryOrders(c *gin.Context) {
 	}
 
 	// 获取分页数据
-	// 历史订单按创建时间倒序排列，其他订单按创建时间正序排列
-	orderBy := "ORDER BY created_at ASC"
+	// 历史订单按创建时间倒序排列，其他订单先按预约时段结束时间（先到期的在前，未预约的在后），再按创建时间正序排列
+	orderBy := "ORDER BY delivery_slot_end IS NULL, delivery_slot_end ASC, created_at ASC"
 	if status == "completed" {
 		orderBy = "ORDER BY created_at DESC"
 	}
 	query := `
 		SELECT id, order_number, user_id, address_id, status, goods_amount, delivery_fee, points_discount,
 		       coupon_discount, is_urgent, urgent_fee, total_amount, remark, out_of_stock_strategy, trust_receipt,
-		       hide_price, require_phone_contact, expected_delivery_at, weather_info, is_isolated, created_at, updated_at
+		       hide_price, require_phone_contact, expected_delivery_at, weather_info, is_isolated, created_at, updated_at,
+		       delivery_slot_id, delivery_slot_start, delivery_slot_end
 		FROM orders WHERE ` + where + ` ` + orderBy + ` LIMIT ? OFFSET ?`
 	args = append(args, pageSize, offset)
 
@@ -151,6 +188,8 @@ func GetDeliveryOrders(c *gin.Context) {
 		var order model.Order
 		var expectedDelivery sql.NullTime
 		var weatherInfo sql.NullString
+		var deliverySlotID sql.NullInt64
+		var deliverySlotStart, deliverySlotEnd sql.NullTime
 		var isUrgentTinyInt, trustReceiptTinyInt, hidePriceTinyInt, requirePhoneContactTinyInt, isIsolatedTinyInt int
 
 		err := rows.Scan(
@@ -158,6 +197,7 @@ func GetDeliveryOrders(c *gin.Context) {
 			&order.PointsDiscount, &order.CouponDiscount, &isUrgentTinyInt, &order.UrgentFee, &order.TotalAmount, &order.Remark,
 			&order.OutOfStockStrategy, &trustReceiptTinyInt, &hidePriceTinyInt, &requirePhoneContactTinyInt,
 			&expectedDelivery, &weatherInfo, &isIsolatedTinyInt, &order.CreatedAt, &order.UpdatedAt,
+			&deliverySlotID, &deliverySlotStart, &deliverySlotEnd,
 		)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "解析订单数据失败: " + err.Error()})
@@ -263,6 +303,15 @@ func GetDeliveryOrders(c *gin.Context) {
 			"created_at":               order.CreatedAt,
 			"updated_at":               order.UpdatedAt,
 			"delivery_fee_calculation": deliveryFeeMap,
+			"expected_delivery_at":     order.ExpectedDeliveryAt,
+		}
+		// 预约配送时段，未预约时不返回
+		if deliverySlotID.Valid && deliverySlotStart.Valid && deliverySlotEnd.Valid {
+			orderData["delivery_slot"] = map[string]interface{}{
+				"id":       deliverySlotID.Int64,
+				"start_at": deliverySlotStart.Time,
+				"end_at":   deliverySlotEnd.Time,
+			}
 		}
 
 		orders = append(orders, orderData)
@@ -620,6 +669,15 @@ func AcceptDeliveryOrder(c *gin.Context) {
 		return
 	}
 
+	// 只有在岗配送员可以接单
+	if canTake, err := model.RiderCanTakeOrders(employee.EmployeeCode); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取在岗状态失败: " + err.Error()})
+		return
+	} else if !canTake {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "当前未在岗，请先上班打卡或结束休息"})
+		return
+	}
+
 	// 获取配送员当前位置（可选参数，但强烈建议提供）
 	var employeeLat, employeeLng *float64
 	if latStr := c.Query("latitude"); latStr != "" {
@@ -660,16 +718,22 @@ func AcceptDeliveryOrder(c *gin.Context) {
 	}
 	_ = model.CreateDeliveryLog(deliveryLog) // 记录日志失败不影响主流程
 
-	// 异步触发路线规划计算（使用配送员当前位置）
-	// 接单时：重新规划整个批次（isNewOrder = true）
-	go func() {
-		err := CalculateAndUpdateRoute(employee.EmployeeCode, employeeLat, employeeLng, true)
-		if err != nil {
-			fmt.Printf("[AcceptDeliveryOrder] 异步计算路线失败: %v\n", err)
-		} else {
-			fmt.Printf("[AcceptDeliveryOrder] 异步计算路线成功，配送员: %s\n", employee.EmployeeCode)
+	// 配送员自行接单后，作废该订单仍在等待响应的派单邀请
+	if cancelled, err := model.CancelPendingDispatchOffers(id); err != nil {
+		log.Printf("[AcceptDeliveryOrder] 作废订单 %d 的派单邀请失败: %v", id, err)
+	} else {
+		for _, offer := range cancelled {
+			locationManager.SendToEmployee(offer.EmployeeCode, map[string]interface{}{
+				"type":     "dispatch_offer_cancelled",
+				"offer_id": offer.ID,
+				"order_id": id,
+			})
 		}
-	}()
+	}
+
+	// 后台任务触发路线规划计算（使用配送员当前位置）
+	// 接单时：重新规划整个批次（isNewOrder = true）
+	enqueueRouteRecalculation(employee.EmployeeCode, employeeLat, employeeLng, true)
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
@@ -713,8 +777,8 @@ func StartDeliveryOrder(c *gin.Context) {
 		return
 	}
 
-	// 更新订单状态为配送中
-	err = model.UpdateOrderStatus(id, "delivering")
+	// 更新订单状态为配送中（微信发货信息由状态钩子异步录入）
+	err = model.TransitionOrderStatus(id, model.OrderStatusDelivering, model.OrderActor{Type: model.OrderActorEmployee, ID: employee.EmployeeCode}, "开始配送")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "开始配送失败: " + err.Error()})
 		return
@@ -729,37 +793,12 @@ func StartDeliveryOrder(c *gin.Context) {
 	}
 	_ = model.CreateDeliveryLog(deliveryLog) // 记录日志失败不影响主流程
 
-	// 异步录入微信小程序发货信息（用于「小程序购物订单」展示及资金结算）
-	go func(orderID int) {
-		if err := UploadWechatShippingInfo(orderID); err != nil {
-			log.Printf("[StartDeliveryOrder] 微信发货信息录入失败 orderID=%d: %v", orderID, err)
-		}
-	}(id)
-
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
 		"message": "开始配送成功",
 	})
 }
 
-// triggerPaidSettlement 订单变为已收款时触发结算逻辑（与 order_admin 一致）
-func triggerPaidSettlement(orderID int) {
-	time.Sleep(100 * time.Millisecond)
-	o, err := model.GetOrderByID(orderID)
-	if err != nil || o == nil {
-		return
-	}
-	if o.SettlementDate == nil {
-		now := time.Now()
-		_, _ = database.DB.Exec("UPDATE orders SET settlement_date = ? WHERE id = ? AND settlement_date IS NULL", now, orderID)
-		o.SettlementDate = &now
-	}
-	_ = model.ProcessOrderSettlement(orderID)
-	_ = model.ProcessReferralReward(orderID)
-	_ = model.AddPointsForOrder(o.UserID, orderID, o.OrderNumber, o.TotalAmount)
-	// 在线支付订单在支付回调时已发 NotifyOrderPaid，此处不重复发送
-}
-
 // CompleteDeliveryOrder 完成配送（支持上传图片）
 func CompleteDeliveryOrder(c *gin.Context) {
 	employee, ok := getEmployeeFromContext(c)
@@ -802,6 +841,12 @@ func CompleteDeliveryOrder(c *gin.Context) {
 		return
 	}
 
+	// 收货确认码与送达位置校验
+	proof, ok := deliveryCompletionProof(c, order, employee.EmployeeCode)
+	if !ok {
+		return
+	}
+
 	var productImageURL, doorplateImageURL *string
 
 	// 上传货物照片
@@ -850,7 +895,8 @@ func CompleteDeliveryOrder(c *gin.Context) {
 	if order.PaidAt != nil {
 		newStatus = "paid"
 	}
-	_, err = tx.Exec("UPDATE orders SET status = ?, updated_at = NOW() WHERE id = ?", newStatus, id)
+	var change *model.OrderStatusChange
+	change, err = model.TransitionOrderStatusInTx(tx, id, newStatus, model.OrderActor{Type: model.OrderActorEmployee, ID: employee.EmployeeCode}, "配送完成")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "更新订单状态失败: " + err.Error()})
 		return
@@ -876,6 +922,7 @@ func CompleteDeliveryOrder(c *gin.Context) {
 	} else {
 		remark = "配送完成（未上传照片）"
 	}
+	remark += "，" + deliveryProofRemark(proof)
 	deliveryLog := &model.DeliveryLog{
 		OrderID:              id,
 		Action:               model.DeliveryLogActionDeliveringCompleted,
@@ -885,13 +932,7 @@ func CompleteDeliveryOrder(c *gin.Context) {
 	}
 	_ = model.CreateDeliveryLog(deliveryLog) // 记录日志失败不影响主流程
 
-	_, err = tx.Exec(`
-		INSERT INTO delivery_records (
-			order_id, delivery_employee_code, product_image_url, doorplate_image_url, completed_at, created_at, updated_at
-		) VALUES (?, ?, ?, ?, ?, NOW(), NOW())
-	`, deliveryRecord.OrderID, deliveryRecord.DeliveryEmployeeCode,
-		deliveryRecord.ProductImageURL, deliveryRecord.DoorplateImageURL, deliveryRecord.CompletedAt)
-	if err != nil {
+	if err = model.InsertDeliveryRecordInTx(tx, deliveryRecord, proof); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "创建配送记录失败: " + err.Error()})
 		return
 	}
@@ -902,50 +943,17 @@ func CompleteDeliveryOrder(c *gin.Context) {
 		return
 	}
 
-	// 已完成配送兜底：如果是微信支付订单，此时再补录一次微信发货信息
-	go func(orderID int) {
-		if err := UploadWechatShippingInfo(orderID); err != nil {
-			log.Printf("[CompleteDeliveryOrder] 微信发货信息兜底录入失败 orderID=%d: %v", orderID, err)
-		}
-	}(id)
-
-	// 飞书订单送达通知（异步）
-	go func(orderID int) {
-		o, _ := model.GetOrderByID(orderID)
-		if o == nil {
-			return
-		}
-		items, _ := model.GetOrderItemsByOrderID(orderID)
-		u, _ := model.GetMiniAppUserByID(o.UserID)
-		addr, _ := model.GetAddressByID(o.AddressID)
-		if u != nil && addr != nil {
-			notify.NotifyOrderDelivered(o, items, u, addr)
-		}
-	}(id)
-
-	// 在线支付订单送达时自动变已收款：触发结算、推荐奖励、积分（与 order_admin 标记已收款一致）
-	if newStatus == "paid" {
-		go triggerPaidSettlement(order.ID)
-	}
+	// 微信发货信息兜底录入、飞书送达通知，以及在线支付订单送达即已收款时的结算、推荐奖励、积分由状态钩子处理
+	model.AfterOrderStatusChanged(change)
 
-	// 异步检查是否所有订单都已完成，如果是则清空路线记录（开始新的一趟）
-	// 注意：完成配送时不需要重新计算路线，因为订单已完成，路线会自动更新
-	// 这里只检查批次状态，不重新计算路线（因为可能没有位置信息）
-	go func() {
-		// 只检查批次状态，不重新计算路线
-		currentBatchID, err := model.GetCurrentBatchID(employee.EmployeeCode)
-		if err != nil {
-			fmt.Printf("[CompleteDeliveryOrder] 检查批次状态失败: %v\n", err)
-		} else {
-			fmt.Printf("[CompleteDeliveryOrder] 当前批次ID: %s\n", currentBatchID)
-		}
-	}()
+	// 完成配送时不需要重新计算路线，订单完成后批次会在下次接单时自动切换
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
 		"message": "配送完成",
 		"data": gin.H{
 			"delivery_record": deliveryRecord,
+			"proof":           proof,
 		},
 	})
 }
@@ -990,6 +998,11 @@ func CompleteDeliveryOrderWithoutImages(c *gin.Context) {
 		return
 	}
 
+	proof, ok := deliveryCompletionProof(c, order, employee.EmployeeCode)
+	if !ok {
+		return
+	}
+
 	tx, err := database.DB.Begin()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "开启事务失败: " + err.Error()})
@@ -1007,13 +1020,14 @@ func CompleteDeliveryOrderWithoutImages(c *gin.Context) {
 	if order.PaidAt != nil {
 		newStatus = "paid"
 	}
-	_, err = tx.Exec("UPDATE orders SET status = ?, updated_at = NOW() WHERE id = ?", newStatus, id)
+	var change *model.OrderStatusChange
+	change, err = model.TransitionOrderStatusInTx(tx, id, newStatus, model.OrderActor{Type: model.OrderActorEmployee, ID: employee.EmployeeCode}, "配送完成")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "更新订单状态失败: " + err.Error()})
 		return
 	}
 
-	remark := "配送完成（未上传照片）"
+	remark := "配送完成（未上传照片），" + deliveryProofRemark(proof)
 	deliveryLog := &model.DeliveryLog{
 		OrderID:              id,
 		Action:               model.DeliveryLogActionDeliveringCompleted,
@@ -1023,12 +1037,12 @@ func CompleteDeliveryOrderWithoutImages(c *gin.Context) {
 	}
 	_ = model.CreateDeliveryLog(deliveryLog)
 
-	_, err = tx.Exec(`
-		INSERT INTO delivery_records (
-			order_id, delivery_employee_code, product_image_url, doorplate_image_url, completed_at, created_at, updated_at
-		) VALUES (?, ?, NULL, NULL, ?, NOW(), NOW())
-	`, id, employee.EmployeeCode, time.Now())
-	if err != nil {
+	deliveryRecord := &model.DeliveryRecord{
+		OrderID:              id,
+		DeliveryEmployeeCode: employee.EmployeeCode,
+		CompletedAt:          time.Now(),
+	}
+	if err = model.InsertDeliveryRecordInTx(tx, deliveryRecord, proof); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "创建配送记录失败: " + err.Error()})
 		return
 	}
@@ -1038,40 +1052,8 @@ func CompleteDeliveryOrderWithoutImages(c *gin.Context) {
 		return
 	}
 
-	// 已完成配送兜底：如果是微信支付订单，此时再补录一次微信发货信息
-	go func(orderID int) {
-		if err := UploadWechatShippingInfo(orderID); err != nil {
-			log.Printf("[CompleteDeliveryOrderWithoutImages] 微信发货信息兜底录入失败 orderID=%d: %v", orderID, err)
-		}
-	}(id)
-
-	// 飞书订单送达通知（异步）
-	go func(orderID int) {
-		o, _ := model.GetOrderByID(orderID)
-		if o == nil {
-			return
-		}
-		items, _ := model.GetOrderItemsByOrderID(orderID)
-		u, _ := model.GetMiniAppUserByID(o.UserID)
-		addr, _ := model.GetAddressByID(o.AddressID)
-		if u != nil && addr != nil {
-			notify.NotifyOrderDelivered(o, items, u, addr)
-		}
-	}(id)
-
-	// 在线支付订单送达时自动变已收款：触发结算逻辑
-	if newStatus == "paid" {
-		go triggerPaidSettlement(id)
-	}
-
-	go func() {
-		currentBatchID, batchErr := model.GetCurrentBatchID(employee.EmployeeCode)
-		if batchErr != nil {
-			fmt.Printf("[CompleteDeliveryOrderWithoutImages] 检查批次状态失败: %v\n", batchErr)
-		} else {
-			fmt.Printf("[CompleteDeliveryOrderWithoutImages] 当前批次ID: %s\n", currentBatchID)
-		}
-	}()
+	// 微信发货信息兜底录入、飞书送达通知及已收款结算由状态钩子处理
+	model.AfterOrderStatusChanged(change)
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
@@ -1083,6 +1065,7 @@ func CompleteDeliveryOrderWithoutImages(c *gin.Context) {
 				"product_image_url":      nil,
 				"doorplate_image_url":    nil,
 			},
+			"proof": proof,
 		},
 	})
 }
@@ -1171,6 +1154,10 @@ func UpdateOrderAddress(c *gin.Context) {
 
 	// 更新地址
 	err = model.UpdateAddress(req.AddressID, address.UserID, addressData)
+	if errors.Is(err, model.ErrAddressNotServiceable) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "更新地址失败: " + err.Error()})
 		return
@@ -1424,11 +1411,14 @@ func GetPickupSuppliers(c *gin.Context) {
 		supplierIDToIndex[supplier.ID] = i + 1 // +1 因为起点占索引0
 	}
 
-	// 创建优化器并添加位置
+	// 创建优化器并添加位置（使用道路距离）
 	optimizer := utils.NewDeliveryRouteOptimizer()
+	points := make([]utils.Coordinate, 0, len(locations))
 	for _, loc := range locations {
 		optimizer.AddLocation(loc.Name, loc.Lat, loc.Lng)
+		points = append(points, utils.Coordinate{Lat: loc.Lat, Lng: loc.Lng})
 	}
+	optimizer.SetDistanceFunc(model.BuildDistanceMatrix(points, 0).Distance)
 
 	// 执行路线优化（迭代300次）
 	optimizedRoute, _, err := optimizer.OptimizeRoute(startPointName, 300)
@@ -1550,7 +1540,9 @@ func GetPickupItemsBySupplier(c *gin.Context) {
 			oi.image,
 			oi.is_picked,
 			o.order_number,
-			o.id as order_id
+			o.id as order_id,
+			o.out_of_stock_strategy,
+			o.shortage_hold
 		FROM orders o
 		INNER JOIN order_items oi ON o.id = oi.order_id
 		INNER JOIN products p ON oi.product_id = p.id
@@ -1570,14 +1562,14 @@ func GetPickupItemsBySupplier(c *gin.Context) {
 
 	itemsList := make([]map[string]interface{}, 0)
 	for rows.Next() {
-		var itemID, orderID, productID, quantity, isPickedTinyInt int
-		var productName, specName, image, orderNumber string
+		var itemID, orderID, productID, quantity, isPickedTinyInt, shortageHoldTinyInt int
+		var productName, specName, image, orderNumber, outOfStockStrategy string
 		var unitPrice, subtotal float64
 
 		err := rows.Scan(
 			&itemID, &orderID, &productID, &productName, &specName,
 			&quantity, &unitPrice, &subtotal, &image, &isPickedTinyInt,
-			&orderNumber, &orderID,
+			&orderNumber, &orderID, &outOfStockStrategy, &shortageHoldTinyInt,
 		)
 		if err == nil {
 			itemData := map[string]interface{}{
@@ -1592,6 +1584,9 @@ func GetPickupItemsBySupplier(c *gin.Context) {
 				"subtotal":     subtotal,
 				"image":        image,
 				"is_picked":    isPickedTinyInt == 1,
+				// 缺货时按该策略自动处理；shortage_hold 表示订单已挂起等待联系客户
+				"out_of_stock_strategy": outOfStockStrategy,
+				"shortage_hold":         shortageHoldTinyInt == 1,
 			}
 			itemsList = append(itemsList, itemData)
 		}
@@ -1617,23 +1612,42 @@ func MarkItemsAsPicked(c *gin.Context) {
 	}
 
 	var req struct {
-		ItemIDs []int `json:"item_ids" binding:"required"`
+		ItemIDs   []int                  `json:"item_ids"`
+		Shortages []model.ShortageReport `json:"shortages"` // 缺货/部分缺货的商品（按订单缺货策略自动处理）
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "请求参数错误: " + err.Error()})
 		return
 	}
 
-	if len(req.ItemIDs) == 0 {
+	if len(req.ItemIDs) == 0 && len(req.Shortages) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "请至少选择一个商品"})
 		return
 	}
 
+	// 同一商品不能既标记已取货又上报缺货
+	checkIDs := make([]int, 0, len(req.ItemIDs)+len(req.Shortages))
+	seen := make(map[int]struct{}, cap(checkIDs))
+	for _, itemID := range req.ItemIDs {
+		if _, dup := seen[itemID]; !dup {
+			seen[itemID] = struct{}{}
+			checkIDs = append(checkIDs, itemID)
+		}
+	}
+	for _, s := range req.Shortages {
+		if _, dup := seen[s.ItemID]; dup {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "同一商品不能重复提交"})
+			return
+		}
+		seen[s.ItemID] = struct{}{}
+		checkIDs = append(checkIDs, s.ItemID)
+	}
+
 	// 验证这些商品是否属于该配送员的待取货订单
-	placeholders := make([]string, len(req.ItemIDs))
-	args := make([]interface{}, len(req.ItemIDs)+1)
+	placeholders := make([]string, len(checkIDs))
+	args := make([]interface{}, len(checkIDs)+1)
 	args[0] = employee.EmployeeCode
-	for i, itemID := range req.ItemIDs {
+	for i, itemID := range checkIDs {
 		placeholders[i] = "?"
 		args[i+1] = itemID
 	}
@@ -1654,11 +1668,34 @@ func MarkItemsAsPicked(c *gin.Context) {
 		return
 	}
 
-	if count != len(req.ItemIDs) {
+	if count != len(checkIDs) {
 		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "部分商品不属于您的待取货订单"})
 		return
 	}
 
+	// 处理缺货商品（按订单的缺货处理策略）
+	shortageFailures := []string{}
+	if len(req.Shortages) > 0 {
+		failures, err := applyPickupShortages(employee.EmployeeCode, req.Shortages)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "处理缺货失败: " + err.Error()})
+			return
+		}
+		shortageFailures = failures
+	}
+	if len(req.ItemIDs) == 0 {
+		message := "缺货已处理"
+		if len(shortageFailures) > 0 {
+			message = "部分订单缺货处理失败: " + strings.Join(shortageFailures, "；")
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    200,
+			"message": message,
+			"data":    gin.H{"shortage_failures": shortageFailures},
+		})
+		return
+	}
+
 	// 批量更新商品状态为已取货
 	updatePlaceholders := make([]string, len(req.ItemIDs))
 	updateArgs := make([]interface{}, len(req.ItemIDs))
@@ -1678,6 +1715,11 @@ func MarkItemsAsPicked(c *gin.Context) {
 		return
 	}
 
+	// 取货后扣减库存（占用转为实际出库）
+	if err := model.DeductStockForPickedItems(req.ItemIDs, employee.EmployeeCode); err != nil {
+		log.Printf("[MarkItemsAsPicked] 扣减库存失败: %v", err)
+	}
+
 	// 获取这些商品所属的订单ID（去重）
 	orderIDQuery := fmt.Sprintf(`
 		SELECT DISTINCT order_id
@@ -1702,69 +1744,92 @@ func MarkItemsAsPicked(c *gin.Context) {
 
 	// 检查每个订单是否所有商品都已取货，如果是则更新订单状态为 delivering
 	for _, orderID := range orderIDs {
-		// 检查该订单是否所有商品都已取货
-		var totalItems, pickedItems int
-		checkAllPickedQuery := `
-			SELECT 
-				COUNT(*) as total_items,
-				SUM(CASE WHEN is_picked = 1 THEN 1 ELSE 0 END) as picked_items
-			FROM order_items
-			WHERE order_id = ?
-		`
-		err := database.DB.QueryRow(checkAllPickedQuery, orderID).Scan(&totalItems, &pickedItems)
-		if err != nil {
-			continue // 跳过出错的订单
-		}
-
-		// 如果所有商品都已取货，且订单状态为 pending_pickup，则更新为 delivering
-		if totalItems > 0 && totalItems == pickedItems {
-			// 先检查订单状态是否为 pending_pickup
-			var currentStatus string
-			var deliveryEmployeeCode sql.NullString
-			err := database.DB.QueryRow("SELECT status, delivery_employee_code FROM orders WHERE id = ?", orderID).Scan(&currentStatus, &deliveryEmployeeCode)
-			if err == nil && currentStatus == "pending_pickup" {
-				// 更新订单状态为 delivering，同时更新 updated_at
-				_, err = database.DB.Exec("UPDATE orders SET status = 'delivering', updated_at = NOW() WHERE id = ?", orderID)
-				if err != nil {
-					// 记录错误但不影响整体流程
-					fmt.Printf("更新订单 %d 状态失败: %v\n", orderID, err)
-				} else {
-					// 记录配送流程日志：取货完成
-					if deliveryEmployeeCode.Valid {
-						remark := "所有商品已取货，自动转为配送中"
-						deliveryLog := &model.DeliveryLog{
-							OrderID:              orderID,
-							Action:               model.DeliveryLogActionPickupCompleted,
-							DeliveryEmployeeCode: &deliveryEmployeeCode.String,
-							ActionTime:           time.Now(),
-							Remark:               &remark,
-						}
-						_ = model.CreateDeliveryLog(deliveryLog) // 记录日志失败不影响主流程
-					}
+		advanceOrderIfAllPicked(orderID)
+	}
 
-					// 订单状态更新后，更新受影响订单的孤立状态，然后重新计算配送费和利润
-					go func(oid int) {
-						_ = model.CalculateAndStoreOrderProfitWithRetry(oid, 3)
-						// 录入微信小程序发货信息（用于「小程序购物订单」展示及资金结算）
-						if err := UploadWechatShippingInfo(oid); err != nil {
-							log.Printf("[MarkPickup] 微信发货信息录入失败 orderID=%d: %v", oid, err)
-						}
-					}(orderID)
+	message := "标记取货成功"
+	if len(shortageFailures) > 0 {
+		message = "标记取货成功，部分订单缺货处理失败: " + strings.Join(shortageFailures, "；")
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": message,
+		"data":    gin.H{"shortage_failures": shortageFailures},
+	})
+}
 
-					// 注意：非接单场景不触发路线重新计算，序号保持不变
-					// 序号只在接单时（isNewOrder=true）才会改变，其他情况（标记已送达、取货、刷新等）序号永远不变
-					// 因此这里不再调用 CalculateAndUpdateRoute，避免不必要的计算
+// advanceOrderIfAllPicked 订单所有商品都已取货时，将订单从 pending_pickup 转为 delivering
+func advanceOrderIfAllPicked(orderID int) {
+	// 检查该订单是否所有商品都已取货
+	var totalItems, pickedItems int
+	checkAllPickedQuery := `
+		SELECT 
+			COUNT(*) as total_items,
+			SUM(CASE WHEN is_picked = 1 THEN 1 ELSE 0 END) as picked_items
+		FROM order_items
+		WHERE order_id = ?
+	`
+	err := database.DB.QueryRow(checkAllPickedQuery, orderID).Scan(&totalItems, &pickedItems)
+	if err != nil {
+		return // 跳过出错的订单
+	}
+
+	// 如果所有商品都已取货，且订单状态为 pending_pickup，则更新为 delivering
+	if totalItems > 0 && totalItems == pickedItems {
+		// 先检查订单状态是否为 pending_pickup
+		var currentStatus string
+		var deliveryEmployeeCode sql.NullString
+		err := database.DB.QueryRow("SELECT status, delivery_employee_code FROM orders WHERE id = ?", orderID).Scan(&currentStatus, &deliveryEmployeeCode)
+		if err == nil && currentStatus == "pending_pickup" {
+			// 更新订单状态为 delivering（利润重算和微信发货信息录入由状态钩子处理）
+			actor := model.OrderActor{Type: model.OrderActorSystem}
+			if deliveryEmployeeCode.Valid {
+				actor = model.OrderActor{Type: model.OrderActorEmployee, ID: deliveryEmployeeCode.String}
+			}
+			err = model.TransitionOrderStatus(orderID, model.OrderStatusDelivering, actor, "所有商品已取货，自动转为配送中")
+			if err != nil {
+				// 记录错误但不影响整体流程
+				fmt.Printf("更新订单 %d 状态失败: %v\n", orderID, err)
+			} else {
+				// 记录配送流程日志：取货完成
+				if deliveryEmployeeCode.Valid {
+					remark := "所有商品已取货，自动转为配送中"
+					deliveryLog := &model.DeliveryLog{
+						OrderID:              orderID,
+						Action:               model.DeliveryLogActionPickupCompleted,
+						DeliveryEmployeeCode: &deliveryEmployeeCode.String,
+						ActionTime:           time.Now(),
+						Remark:               &remark,
+					}
+					_ = model.CreateDeliveryLog(deliveryLog) // 记录日志失败不影响主流程
 				}
+
+				// 注意：非接单场景不触发路线重新计算，序号保持不变
+				// 序号只在接单时（isNewOrder=true）才会改变，其他情况（标记已送达、取货、刷新等）序号永远不变
+				// 因此这里不再调用 CalculateAndUpdateRoute，避免不必要的计算
 			}
 		}
 	}
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"code":    200,
-		"message": "标记取货成功",
+func init() {
+	model.RegisterJobHandler(model.JobRouteRecalculate, func(payload []byte) error {
+		var p model.RouteJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return fmt.Errorf("解析任务参数失败: %v", err)
+		}
+		return CalculateAndUpdateRoute(p.EmployeeCode, p.Latitude, p.Longitude, p.IsNewOrder)
 	})
 }
 
+// enqueueRouteRecalculation 入队配送员路线规划任务，失败时自动重试
+func enqueueRouteRecalculation(employeeCode string, employeeLat, employeeLng *float64, isNewOrder bool) {
+	payload := model.RouteJobPayload{EmployeeCode: employeeCode, Latitude: employeeLat, Longitude: employeeLng, IsNewOrder: isNewOrder}
+	if err := model.EnqueueJob(model.JobRouteRecalculate, payload, model.JobOptions{}); err != nil {
+		log.Printf("[Route] 配送员 %s 路线规划任务入队失败: %v", employeeCode, err)
+	}
+}
+
 // CalculateAndUpdateRoute 计算并更新配送员的路线排序（使用批次ID区分不同的趟）
 // employeeLat, employeeLng: 配送员当前位置（必须提供，否则返回错误）
 // isNewOrder: 是否为接单触发（true=接单时重新规划整个批次，false=完成订单时只规划剩余订单）
@@ -1925,342 +1990,203 @@ func CalculateAndUpdateRoute(employeeCode string, employeeLat, employeeLng *floa
 	fmt.Printf("[CalculateAndUpdateRoute] 批次 %s: 已完成订单 %d 个，未完成订单 %d 个，是否接单触发: %v\n",
 		currentBatchID, len(completedOrders), len(incompleteOrders), isNewOrder)
 
-	// 如果只有一单未完成，直接设置排序
-	if len(incompleteOrders) == 1 {
-		// 构建所有订单的序列（包括已完成的）
+	// 非接单场景：序号保持不变
+	// 仅剩一单未完成时，已完成订单保持原序号，未完成订单排在最后
+	if !isNewOrder {
+		if len(incompleteOrders) != 1 {
+			fmt.Printf("[CalculateAndUpdateRoute] 非接单场景，序号保持不变，跳过更新\n")
+			return nil
+		}
 		orderSequences := make([]struct {
 			OrderID  int
 			Sequence int
 			Distance *float64
 		}, 0)
-
-		// 如果是接单触发，重新规划整个批次
-		if isNewOrder {
-			// 接单时：已完成订单也需要重新排序
-			// 先添加未完成订单
-			orderSequences = append(orderSequences, struct {
-				OrderID  int
-				Sequence int
-				Distance *float64
-			}{
-				OrderID:  incompleteOrders[0].OrderID,
-				Sequence: 1,
-				Distance: nil,
-			})
-			// 已完成订单按原序号追加
-			for i, completedOrder := range completedOrders {
+		maxSeq := 0
+		for _, completedOrder := range completedOrders {
+			if seq, exists := completedOrderSequences[completedOrder.OrderID]; exists {
 				orderSequences = append(orderSequences, struct {
 					OrderID  int
 					Sequence int
 					Distance *float64
 				}{
 					OrderID:  completedOrder.OrderID,
-					Sequence: 2 + i,
+					Sequence: seq,
 					Distance: nil,
 				})
-			}
-		} else {
-			// 完成订单时：已完成订单保持原序号
-			// 先添加已完成订单（保持原序号）
-			for _, completedOrder := range completedOrders {
-				if seq, exists := completedOrderSequences[completedOrder.OrderID]; exists {
-					orderSequences = append(orderSequences, struct {
-						OrderID  int
-						Sequence int
-						Distance *float64
-					}{
-						OrderID:  completedOrder.OrderID,
-						Sequence: seq,
-						Distance: nil,
-					})
-				}
-			}
-			// 未完成订单放在最后
-			maxSeq := 0
-			for _, seq := range completedOrderSequences {
 				if seq > maxSeq {
 					maxSeq = seq
 				}
 			}
-			orderSequences = append(orderSequences, struct {
-				OrderID  int
-				Sequence int
-				Distance *float64
-			}{
-				OrderID:  incompleteOrders[0].OrderID,
-				Sequence: maxSeq + 1,
-				Distance: nil,
-			})
 		}
-
-		err := model.UpdateRouteSequence(employeeCode, currentBatchID, orderSequences)
-		if err != nil {
+		orderSequences = append(orderSequences, struct {
+			OrderID  int
+			Sequence int
+			Distance *float64
+		}{
+			OrderID:  incompleteOrders[0].OrderID,
+			Sequence: maxSeq + 1,
+			Distance: nil,
+		})
+		if err := model.UpdateRouteSequence(employeeCode, currentBatchID, orderSequences); err != nil {
 			return fmt.Errorf("更新路线排序失败: %w", err)
 		}
 		return nil
 	}
 
-	// 使用配送员当前位置作为起点（已经验证过不为nil）
-	startLat := *employeeLat
-	startLng := *employeeLng
-	fmt.Printf("[CalculateAndUpdateRoute] 使用配送员当前位置作为起点: %.6f, %.6f\n", startLat, startLng)
-
-	// 只对未完成订单进行路线优化
-	// 先按订单ID排序，确保稳定排序（相同距离时按订单ID选择）
-	sort.Slice(incompleteOrders, func(i, j int) bool {
-		return incompleteOrders[i].OrderID < incompleteOrders[j].OrderID
-	})
-
-	// 构建位置列表（起点 + 未完成订单位置）
-	locations := make([]struct {
-		Name string
-		Lat  float64
-		Lng  float64
-	}, 0, len(incompleteOrders)+1)
-
-	// 添加起点（使用特殊名称）- 必须第一个添加，确保索引为0
-	startPointName := fmt.Sprintf("start_%s", employeeCode)
-	locations = append(locations, struct {
-		Name string
-		Lat  float64
-		Lng  float64
-	}{
-		Name: startPointName,
-		Lat:  startLat,
-		Lng:  startLng,
-	})
-	fmt.Printf("[CalculateAndUpdateRoute] 起点已添加: %s (%.6f, %.6f)，索引: 0\n", startPointName, startLat, startLng)
-
-	// 只添加未完成订单位置（已按订单ID排序）
-	for i, order := range incompleteOrders {
-		orderName := fmt.Sprintf("order_%d", order.OrderID)
-		locations = append(locations, struct {
-			Name string
-			Lat  float64
-			Lng  float64
-		}{
-			Name: orderName,
-			Lat:  order.Latitude,
-			Lng:  order.Longitude,
+	// 接单时：按「先取货后送货」重新规划整个批次
+	// 待取货订单中未取的商品所属供应商作为取货点，必须排在该订单送货点之前
+	orderIDs := make([]int, 0, len(incompleteOrders))
+	for _, order := range incompleteOrders {
+		orderIDs = append(orderIDs, order.OrderID)
+	}
+	pickups, pickupIDsByOrder, err := loadRoutePickupStops(orderIDs)
+	if err != nil {
+		// 取货点查询失败时只规划送货点
+		fmt.Printf("[CalculateAndUpdateRoute] 查询取货点失败，仅规划送货点: %v\n", err)
+		pickups, pickupIDsByOrder = nil, nil
+	}
+	deliveries := make([]utils.RouteStop, 0, len(incompleteOrders))
+	for _, order := range incompleteOrders {
+		deliveries = append(deliveries, utils.RouteStop{
+			ID:        strconv.Itoa(order.OrderID),
+			Lat:       order.Latitude,
+			Lng:       order.Longitude,
+			PickupIDs: pickupIDsByOrder[order.OrderID],
 		})
-		// 更新 incompleteOrders 中的索引映射
-		incompleteOrders[i].OrderID = order.OrderID
-	}
-
-	// 检查是否所有未完成订单都是同一个地址（坐标相同）
-	allSameAddress := true
-	if len(incompleteOrders) > 1 {
-		firstLat := incompleteOrders[0].Latitude
-		firstLng := incompleteOrders[0].Longitude
-		for i := 1; i < len(incompleteOrders); i++ {
-			// 使用较小的阈值（约10米）来判断是否为同一地址
-			latDiff := math.Abs(incompleteOrders[i].Latitude - firstLat)
-			lngDiff := math.Abs(incompleteOrders[i].Longitude - firstLng)
-			// 纬度1度约111公里，经度1度约111*cos(纬度)公里
-			// 0.0001度约11米，使用0.00009度（约10米）作为阈值
-			if latDiff > 0.00009 || lngDiff > 0.00009 {
-				allSameAddress = false
-				break
-			}
-		}
 	}
 
-	var optimizedRoute []int
-	var totalDistance float64
-	var optimizer *utils.DeliveryRouteOptimizer
-
-	if allSameAddress && len(incompleteOrders) > 1 {
-		// 如果所有未完成订单都是同一个地址，按订单ID排序（稳定排序）
-		fmt.Printf("[CalculateAndUpdateRoute] 所有未完成订单都是同一地址，使用订单ID排序\n")
-		optimizedRoute = []int{0} // 起点索引为0
-		// 按订单ID顺序添加订单索引（从1开始，因为0是起点）
-		for i := 1; i <= len(incompleteOrders); i++ {
-			optimizedRoute = append(optimizedRoute, i)
-		}
-		totalDistance = 0.0 // 同一地址，距离为0
-	} else {
-		// 创建优化器并添加位置
-		optimizer = utils.NewDeliveryRouteOptimizer()
-		for _, loc := range locations {
-			optimizer.AddLocation(loc.Name, loc.Lat, loc.Lng)
-		}
-
-		// 执行路线优化（迭代300次）
-		optimizedRoute, totalDistance, err = optimizer.OptimizeRoute(startPointName, 300)
-		if err != nil {
-			return fmt.Errorf("路线优化失败: %w", err)
-		}
-	}
-	fmt.Printf("[CalculateAndUpdateRoute] 路线优化完成，总距离: %.2f 公里，路线点数: %d\n", totalDistance, len(optimizedRoute))
-	if len(optimizedRoute) > 0 && optimizer != nil {
-		firstLoc := optimizer.GetLocationByIndex(optimizedRoute[0])
-		if firstLoc != nil {
-			fmt.Printf("[CalculateAndUpdateRoute] 优化路线第一个点: %s (%.6f, %.6f)\n", firstLoc.Name, firstLoc.Lat, firstLoc.Lng)
-		}
-		if len(optimizedRoute) > 1 {
-			secondLoc := optimizer.GetLocationByIndex(optimizedRoute[1])
-			if secondLoc != nil {
-				fmt.Printf("[CalculateAndUpdateRoute] 优化路线第二个点: %s (%.6f, %.6f)\n", secondLoc.Name, secondLoc.Lat, secondLoc.Lng)
-			}
-		}
+	// 使用道路距离矩阵（起点 + 取货点 + 送货点）规划路线和估算到达时间
+	points := []utils.Coordinate{{Lat: *employeeLat, Lng: *employeeLng}}
+	for _, stop := range append(append([]utils.RouteStop(nil), pickups...), deliveries...) {
+		points = append(points, utils.Coordinate{Lat: stop.Lat, Lng: stop.Lng})
 	}
+	opts := model.DefaultDispatchPlanOptions()
+	matrix := model.BuildDistanceMatrix(points, opts.SpeedKmh)
 
-	// 构建未完成订单的排序记录（排除起点，只保留未完成订单）
-	incompleteOrderSequences := make([]struct {
-		OrderID  int
-		Sequence int
-		Distance *float64
-	}, 0)
-
-	sequence := 1
-	startIdx := -1
-
-	if allSameAddress && len(incompleteOrders) > 1 {
-		// 同一地址情况：起点是第一个（索引0），订单按顺序从1开始
-		startIdx = 0
-		for i := 1; i < len(optimizedRoute); i++ {
-			routeIdx := optimizedRoute[i]
-			// 订单索引从1开始，对应 incompleteOrders[i-1]
-			if routeIdx > 0 && routeIdx <= len(incompleteOrders) {
-				orderID := incompleteOrders[routeIdx-1].OrderID
-				incompleteOrderSequences = append(incompleteOrderSequences, struct {
-					OrderID  int
-					Sequence int
-					Distance *float64
-				}{
-					OrderID:  orderID,
-					Sequence: sequence,
-					Distance: nil, // 同一地址，距离为0
-				})
-				sequence++
-			}
-		}
-	} else {
-		// 先找到起点的索引
-		for i, routeIdx := range optimizedRoute {
-			if optimizer == nil {
-				break
-			}
-			loc := optimizer.GetLocationByIndex(routeIdx)
-			if loc != nil && loc.Name == startPointName {
-				startIdx = i
-				fmt.Printf("[CalculateAndUpdateRoute] 起点在优化路线中的索引: %d\n", startIdx)
-				break
-			}
-		}
-
-		if startIdx == -1 {
-			return fmt.Errorf("在优化路线中未找到起点")
-		}
-
-		// 确保起点是第一个点（NearestNeighbor算法应该保证这一点）
-		if startIdx != 0 {
-			fmt.Printf("[CalculateAndUpdateRoute] 警告: 起点不在第一个位置 (索引: %d)，这可能导致路线计算错误\n", startIdx)
-		}
-
-		for i, routeIdx := range optimizedRoute {
-			if optimizer == nil {
-				break
-			}
-			loc := optimizer.GetLocationByIndex(routeIdx)
-			if loc == nil {
-				continue
-			}
-
-			// 跳过起点
-			if loc.Name == startPointName {
-				continue
-			}
-
-			// 解析订单ID
-			var orderID int
-			_, err := fmt.Sscanf(loc.Name, "order_%d", &orderID)
-			if err != nil {
-				continue
-			}
-
-			// 计算距离（从前一个点到当前点的距离）
-			// 如果前一个点是起点，则计算从起点到当前点的距离
-			// 否则计算从前一个订单到当前订单的距离
-			var distance *float64
-			if i > 0 {
-				prevIdx := optimizedRoute[i-1]
-				prevLoc := optimizer.GetLocationByIndex(prevIdx)
-				// 如果前一个点是起点，计算从起点到当前点的距离
-				if prevLoc != nil && prevLoc.Name == startPointName {
-					dist := optimizer.CalculateDistance(prevIdx, routeIdx)
-					distance = &dist
-				} else {
-					// 否则计算从前一个订单到当前订单的距离
-					dist := optimizer.CalculateDistance(prevIdx, routeIdx)
-					distance = &dist
-				}
-			} else if i == startIdx+1 {
-				// 如果当前点是起点后的第一个点，计算从起点到当前点的距离
-				dist := optimizer.CalculateDistance(optimizedRoute[startIdx], routeIdx)
-				distance = &dist
-			}
-
-			incompleteOrderSequences = append(incompleteOrderSequences, struct {
-				OrderID  int
-				Sequence int
-				Distance *float64
-			}{
-				OrderID:  orderID,
-				Sequence: sequence,
-				Distance: distance,
-			})
-			sequence++
-		}
-	}
+	planned, totalDistance := utils.OptimizePickupDeliveryRoute(*employeeLat, *employeeLng, pickups, deliveries, 300, matrix.Distance)
+	fmt.Printf("[CalculateAndUpdateRoute] 路线规划完成，总距离: %.2f 公里，取货点 %d 个，送货点 %d 个\n",
+		totalDistance, len(planned)-len(deliveries), len(deliveries))
 
-	// 合并已完成订单和未完成订单的序号
-	// 根据 isNewOrder 决定已完成订单的序号处理方式
+	// 按行驶时间和停留时间估算每个停靠点的到达时间
+	now := time.Now()
+	prevLat, prevLng := *employeeLat, *employeeLng
 	allOrderSequences := make([]struct {
 		OrderID  int
 		Sequence int
 		Distance *float64
-	}, 0)
-
-	if isNewOrder {
-		// 接单时：重新规划整个批次，已完成订单也需要重新排序
-		// 先添加未完成订单（已优化）
-		allOrderSequences = append(allOrderSequences, incompleteOrderSequences...)
-		// 已完成订单追加在后面
-		nextSeq := len(incompleteOrderSequences) + 1
-		for _, completedOrder := range completedOrders {
+	}, 0, len(orders))
+	stops := make([]model.DeliveryRouteStop, 0, len(planned))
+	for i, p := range planned {
+		now = now.Add(time.Duration(matrix.Duration(prevLat, prevLng, p.Lat, p.Lng) * float64(time.Minute)))
+		prevLat, prevLng = p.Lat, p.Lng
+		eta := now
+		stop := model.DeliveryRouteStop{
+			StopSequence:       i + 1,
+			StopType:           p.Type,
+			Latitude:           p.Lat,
+			Longitude:          p.Lng,
+			DistanceFromPrev:   p.DistanceFromPrev,
+			CumulativeDistance: p.CumulativeDistance,
+			ETA:                &eta,
+		}
+		id, _ := strconv.Atoi(p.ID)
+		if p.Type == utils.RouteStopPickup {
+			stop.SupplierID = &id
+		} else {
+			stop.OrderID = &id
+			distance := p.DistanceFromPrev
 			allOrderSequences = append(allOrderSequences, struct {
 				OrderID  int
 				Sequence int
 				Distance *float64
 			}{
-				OrderID:  completedOrder.OrderID,
-				Sequence: nextSeq,
-				Distance: nil,
+				OrderID:  id,
+				Sequence: len(allOrderSequences) + 1,
+				Distance: &distance,
 			})
-			nextSeq++
 		}
-	} else {
-		// 完成订单时：序号完全保持不变，不进行任何更新
-		// 这是为了确保序号只在接单时才会改变，其他情况（标记已送达、取货等）序号永远不变
-		fmt.Printf("[CalculateAndUpdateRoute] 非接单场景，序号保持不变，跳过更新\n")
-		return nil
+		stops = append(stops, stop)
+		now = now.Add(time.Duration(opts.ServiceMinutes * float64(time.Minute)))
 	}
 
-	// 按序号排序，确保顺序正确
-	sort.Slice(allOrderSequences, func(i, j int) bool {
-		return allOrderSequences[i].Sequence < allOrderSequences[j].Sequence
-	})
+	// 已完成订单追加在后面
+	for _, completedOrder := range completedOrders {
+		allOrderSequences = append(allOrderSequences, struct {
+			OrderID  int
+			Sequence int
+			Distance *float64
+		}{
+			OrderID:  completedOrder.OrderID,
+			Sequence: len(allOrderSequences) + 1,
+			Distance: nil,
+		})
+	}
 
-	// 更新数据库中的排序（仅在接单时执行）
-	err = model.UpdateRouteSequence(employeeCode, currentBatchID, allOrderSequences)
-	if err != nil {
+	if err := model.UpdateRouteSequence(employeeCode, currentBatchID, allOrderSequences); err != nil {
 		return fmt.Errorf("更新路线排序失败: %w", err)
 	}
+	if err := model.SaveRouteStops(employeeCode, currentBatchID, stops); err != nil {
+		return fmt.Errorf("保存路线停靠点失败: %w", err)
+	}
 
 	return nil
 }
 
+// loadRoutePickupStops 查询订单待取商品所属供应商（有坐标的）作为取货点
+// 只有待取货状态且存在未取商品的订单需要取货；返回去重后的取货点和每个订单需要的取货点ID
+func loadRoutePickupStops(orderIDs []int) ([]utils.RouteStop, map[int][]string, error) {
+	pickupIDsByOrder := make(map[int][]string)
+	if len(orderIDs) == 0 {
+		return nil, pickupIDsByOrder, nil
+	}
+
+	placeholders := make([]string, len(orderIDs))
+	args := make([]interface{}, len(orderIDs))
+	for i, id := range orderIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	query := `
+		SELECT DISTINCT o.id, s.id, s.latitude, s.longitude
+		FROM orders o
+		INNER JOIN order_items oi ON o.id = oi.order_id
+		INNER JOIN products p ON oi.product_id = p.id
+		INNER JOIN suppliers s ON p.supplier_id = s.id
+		WHERE o.id IN (` + strings.Join(placeholders, ",") + `)
+		  AND o.status = 'pending_pickup'
+		  AND oi.is_picked = 0
+		  AND s.latitude IS NOT NULL
+		  AND s.longitude IS NOT NULL
+	`
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	pickups := make([]utils.RouteStop, 0)
+	seen := make(map[int]bool)
+	for rows.Next() {
+		var orderID, supplierID int
+		var latitude, longitude float64
+		if err := rows.Scan(&orderID, &supplierID, &latitude, &longitude); err != nil {
+			return nil, nil, err
+		}
+		pickupIDsByOrder[orderID] = append(pickupIDsByOrder[orderID], strconv.Itoa(supplierID))
+		if !seen[supplierID] {
+			seen[supplierID] = true
+			pickups = append(pickups, utils.RouteStop{
+				Type: utils.RouteStopPickup,
+				ID:   strconv.Itoa(supplierID),
+				Lat:  latitude,
+				Lng:  longitude,
+			})
+		}
+	}
+	return pickups, pickupIDsByOrder, rows.Err()
+}
+
 // CalculateRoute 手动触发路线规划计算（API接口）
 func CalculateRoute(c *gin.Context) {
 	employee, ok := getEmployeeFromContext(c)
@@ -2298,14 +2224,7 @@ func CalculateRoute(c *gin.Context) {
 	// 注意：手动触发路线规划不会改变序号
 	// 序号只在接单时（isNewOrder=true）才会改变，手动触发（isNewOrder=false）不会改变序号
 	// 因此这里调用 CalculateAndUpdateRoute 不会产生任何效果，但保留接口以保持兼容性
-	go func() {
-		err := CalculateAndUpdateRoute(employee.EmployeeCode, employeeLat, employeeLng, false)
-		if err != nil {
-			fmt.Printf("[CalculateRoute] 路线规划计算失败: %v\n", err)
-		} else {
-			fmt.Printf("[CalculateRoute] 路线规划计算完成（序号未改变）\n")
-		}
-	}()
+	enqueueRouteRecalculation(employee.EmployeeCode, employeeLat, employeeLng, false)
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
@@ -2443,14 +2362,109 @@ func GetRouteOrders(c *gin.Context) {
 		orderList = append(orderList, orderData)
 	}
 
-	fmt.Printf("[GetRouteOrders] 处理完成，返回 %d 条订单\n", len(orderList))
+	stops := buildRouteStopList(employee.EmployeeCode, currentBatchID, orderList)
+
+	fmt.Printf("[GetRouteOrders] 处理完成，返回 %d 条订单，%d 个停靠点\n", len(orderList), len(stops))
 
 	c.JSON(http.StatusOK, gin.H{
 		"code": 200,
 		"data": gin.H{
 			"list":  orderList,
 			"total": len(orderList),
+			"stops": stops,
 		},
 		"message": "获取成功",
 	})
 }
+
+// buildRouteStopList 生成完整停靠点列表（取货点 + 送货点），并为订单补充停靠点类型、预计到达时间和累计距离
+// 只有已保存的停靠点与当前路线订单一致时才使用；否则（如调度派单后尚未重新规划）按订单顺序生成，不含取货点和到达时间
+func buildRouteStopList(employeeCode, batchID string, orderList []map[string]interface{}) []map[string]interface{} {
+	orderByID := make(map[int]map[string]interface{}, len(orderList))
+	for _, orderData := range orderList {
+		orderData["stop_type"] = utils.RouteStopDelivery
+		orderByID[orderData["id"].(int)] = orderData
+	}
+
+	saved, err := model.GetRouteStops(employeeCode, batchID)
+	if err != nil {
+		fmt.Printf("[GetRouteOrders] 获取停靠点失败: %v\n", err)
+	}
+	deliveryCount := 0
+	for _, stop := range saved {
+		if stop.StopType != utils.RouteStopDelivery {
+			continue
+		}
+		if stop.OrderID == nil || orderByID[*stop.OrderID] == nil {
+			deliveryCount = -1
+			break
+		}
+		deliveryCount++
+	}
+
+	stops := make([]map[string]interface{}, 0, len(saved)+len(orderList))
+	if len(saved) > 0 && deliveryCount == len(orderList) {
+		suppliers := make(map[int]*model.Supplier)
+		for _, stop := range saved {
+			item := map[string]interface{}{
+				"stop_sequence":       stop.StopSequence,
+				"stop_type":           stop.StopType,
+				"latitude":            stop.Latitude,
+				"longitude":           stop.Longitude,
+				"distance_from_prev":  stop.DistanceFromPrev,
+				"cumulative_distance": stop.CumulativeDistance,
+				"eta":                 stop.ETA,
+			}
+			if stop.StopType == utils.RouteStopPickup && stop.SupplierID != nil {
+				supplier, ok := suppliers[*stop.SupplierID]
+				if !ok {
+					supplier, _ = model.GetSupplierByID(database.DB, *stop.SupplierID)
+					suppliers[*stop.SupplierID] = supplier
+				}
+				item["supplier_id"] = *stop.SupplierID
+				if supplier != nil {
+					item["name"] = supplier.Name
+					item["address"] = supplier.Address
+					item["phone"] = supplier.Phone
+				}
+			} else if stop.OrderID != nil {
+				orderData := orderByID[*stop.OrderID]
+				orderData["stop_sequence"] = stop.StopSequence
+				orderData["eta"] = stop.ETA
+				orderData["cumulative_distance"] = stop.CumulativeDistance
+				item["order_id"] = *stop.OrderID
+				item["order_number"] = orderData["order_number"]
+				item["name"] = orderData["name"]
+				item["address"] = orderData["address"]
+				item["status"] = orderData["status"]
+			}
+			stops = append(stops, item)
+		}
+		return stops
+	}
+
+	cumulative := 0.0
+	for i, orderData := range orderList {
+		if distance, ok := orderData["calculated_distance"].(*float64); ok && distance != nil {
+			cumulative += *distance
+		}
+		orderData["stop_sequence"] = i + 1
+		orderData["eta"] = nil
+		orderData["cumulative_distance"] = cumulative
+		stops = append(stops, map[string]interface{}{
+			"stop_sequence":       i + 1,
+			"stop_type":           utils.RouteStopDelivery,
+			"order_id":            orderData["id"],
+			"order_number":        orderData["order_number"],
+			"name":                orderData["name"],
+			"address":             orderData["address"],
+			"status":              orderData["status"],
+			"latitude":            orderData["latitude"],
+			"longitude":           orderData["longitude"],
+			"distance_from_prev":  orderData["calculated_distance"],
+			"cumulative_distance": cumulative,
+			"eta":                 nil,
+		})
+	}
+	return stops
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,7 +13,6 @@ import (
 
 	"go_backend/internal/database"
 	"go_backend/internal/model"
-	"go_backend/internal/notify"
 	"go_backend/internal/utils"
 
 	"github.com/gin-gonic/gin"
@@ -824,6 +824,7 @@ func SyncOrderItemsToPurchaseList(c *gin.Context) {
 					WholesalePrice: spec.WholesalePrice,
 					RetailPrice:    spec.RetailPrice,
 					DeliveryCount:  spec.DeliveryCount, // 配送计件数
+					PriceTiers:     spec.PriceTiers,    // 批发阶梯价
 				}
 				found = true
 				break
@@ -1033,6 +1034,12 @@ func UpdateOrderForCustomer(c *gin.Context) {
 		userType = "retail"
 	}
 
+	// 重新计算限时促销（不计入本订单已占用的促销数量，修改时会先释放）
+	if err := model.ApplyProductPromotions(order.UserID, userType, items, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "计算促销价格失败: " + err.Error()})
+		return
+	}
+
 	// 构建改价映射表（采购单项ID -> 改价后的单价），用于配送费计算
 	priceOverrideMap := make(map[int]float64)
 	priceModMap := make(map[int]model.PriceModificationInfo)
@@ -1047,58 +1054,27 @@ func UpdateOrderForCustomer(c *gin.Context) {
 	}
 
 	// 计算配送费（使用改价后的价格）
-	summary, err := model.CalculateDeliveryFee(items, userType, priceOverrideMap)
+	summary, err := model.CalculateDeliveryFeeForAddress(items, userType, address, priceOverrideMap)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "计算配送费失败: " + err.Error()})
 		return
 	}
 
-	// 计算订单金额（使用配送费计算中的TotalAmount，已应用改价）
-	orderAmount := summary.TotalAmount
-	categoryIDSet := make(map[int]struct{})
-	productIDs := make([]int, 0, len(items))
-	for _, item := range items {
-		productIDs = append(productIDs, item.ProductID)
-	}
-
-	categoryInfo, err := model.FetchProductCategoryInfo(productIDs)
-	if err == nil {
-		for _, info := range categoryInfo {
-			if info.CategoryID > 0 {
-				categoryIDSet[info.CategoryID] = struct{}{}
-			}
-			if info.ParentID > 0 {
-				categoryIDSet[info.ParentID] = struct{}{}
-			}
-		}
-	}
-	categoryIDs := make([]int, 0, len(categoryIDSet))
-	for id := range categoryIDSet {
-		categoryIDs = append(categoryIDs, id)
-	}
-
-	// 获取可用优惠券并计算折扣
+	// 获取可用优惠券并计算折扣（按改价后的商品明细计算适用范围）
 	couponDiscount := 0.0
-	var selectedCoupon *model.AvailableCouponInfo
+	var couponCombination model.BestCouponCombination
 	if req.CouponID > 0 {
-		availableCoupons, err := model.GetAvailableCouponsForPurchaseList(
-			order.UserID,
-			orderAmount,
-			categoryIDs,
-			summary.DeliveryFee,
-			summary.IsFreeShipping,
-		)
+		couponItems, err := model.BuildCouponOrderItems(items, userType, priceOverrideMap)
 		if err == nil {
-			for i := range availableCoupons {
-				if availableCoupons[i].UserCouponID == req.CouponID && availableCoupons[i].IsAvailable {
-					selectedCoupon = &availableCoupons[i]
-					if selectedCoupon.Type == "delivery_fee" {
-						couponDiscount = summary.DeliveryFee
-					} else if selectedCoupon.Type == "amount" {
-						couponDiscount = selectedCoupon.DiscountValue
-					}
-					break
-				}
+			availableCoupons, err := model.GetAvailableCouponsForPurchaseList(
+				order.UserID,
+				couponItems,
+				summary.DeliveryFee,
+				summary.IsFreeShipping,
+			)
+			if err == nil {
+				couponCombination = model.CalculateCouponCombinationForUserCoupons(availableCoupons, couponItems, summary.DeliveryFee, summary.IsFreeShipping, []int{req.CouponID})
+				couponDiscount = couponCombination.TotalDiscount
 			}
 		}
 	}
@@ -1167,6 +1143,16 @@ func UpdateOrderForCustomer(c *gin.Context) {
 		return
 	}
 
+	// 释放旧订单商品的库存占用（新商品插入后重新占用）
+	if err = model.ReleaseOrderStockInTx(tx, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "释放库存失败: " + err.Error()})
+		return
+	}
+	if err = model.ReleaseOrderPromotionsInTx(tx, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "释放促销占用失败: " + err.Error()})
+		return
+	}
+
 	// 删除旧的订单商品
 	_, err = tx.Exec("DELETE FROM order_items WHERE order_id = ?", id)
 	if err != nil {
@@ -1188,32 +1174,19 @@ func UpdateOrderForCustomer(c *gin.Context) {
 	defer itemStmt.Close()
 
 	hasPriceModification := false
+	newOrderItems := make([]model.OrderItem, 0, len(items))
+	var promotionUses []model.PromotionUse
 	for _, it := range items {
 		// 计算原始价格
-		var originalPrice float64
-		if userType == "wholesale" {
-			originalPrice = it.SpecSnapshot.WholesalePrice
-			if originalPrice <= 0 {
-				originalPrice = it.SpecSnapshot.RetailPrice
-			}
-		} else {
-			originalPrice = it.SpecSnapshot.RetailPrice
-			if originalPrice <= 0 {
-				originalPrice = it.SpecSnapshot.WholesalePrice
-			}
-		}
-		if originalPrice <= 0 {
-			originalPrice = it.SpecSnapshot.Cost
-		}
-		if originalPrice < 0 {
-			originalPrice = 0
-		}
+		originalPrice := model.ItemUnitPrice(it, userType)
 
 		// 检查是否有改价
 		var price float64
 		var isPriceModified bool
 		var priceModReason *string
 		if mod, hasMod := priceModMap[it.ID]; hasMod {
+			// 改价商品不再按限时促销价计价
+			model.ClearItemPromotion(&it.SpecSnapshot)
 			price = mod.UnitPrice
 			if price < 0 {
 				price = 0
@@ -1232,6 +1205,9 @@ func UpdateOrderForCustomer(c *gin.Context) {
 		}
 
 		subtotal := price * float64(it.Quantity)
+		if promoPrice, promoSubtotal, ok := model.ItemPromotionPricing(it, userType); ok && !isPriceModified {
+			price, subtotal = promoPrice, promoSubtotal
+		}
 
 		// 准备插入数据
 		var originalPricePtr *float64
@@ -1246,7 +1222,7 @@ func UpdateOrderForCustomer(c *gin.Context) {
 			return
 		}
 
-		_, err = itemStmt.Exec(
+		itemRes, err := itemStmt.Exec(
 			id,
 			it.ProductID,
 			it.ProductName,
@@ -1264,6 +1240,38 @@ func UpdateOrderForCustomer(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "插入订单商品失败: " + err.Error()})
 			return
 		}
+		itemID, _ := itemRes.LastInsertId()
+		newOrderItems = append(newOrderItems, model.OrderItem{
+			ID:          int(itemID),
+			OrderID:     id,
+			ProductID:   it.ProductID,
+			ProductName: it.ProductName,
+			SpecName:    it.SpecName,
+			Quantity:    it.Quantity,
+		})
+		if use, ok := model.ItemPromotionUse(it, int(itemID)); ok {
+			promotionUses = append(promotionUses, use)
+		}
+	}
+
+	// 为新的订单商品占用库存
+	if err = model.ReserveOrderItemsStockInTx(tx, id, newOrderItems, true); err != nil {
+		var stockErr *model.InsufficientStockError
+		if errors.As(err, &stockErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": stockErr.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "占用库存失败: " + err.Error()})
+		return
+	}
+	if err = model.ReservePromotionsInTx(tx, order.UserID, id, promotionUses, true); err != nil {
+		var promoErr *model.PromotionChangedError
+		if errors.As(err, &promoErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": promoErr.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "占用促销数量失败: " + err.Error()})
+		return
 	}
 
 	// 如果订单包含改价商品，更新订单表的has_price_modification字段
@@ -1287,8 +1295,8 @@ func UpdateOrderForCustomer(c *gin.Context) {
 
 	// 如果使用了新的优惠券，标记为已使用
 	// 使用 user_coupon_id 精确更新，避免用户有多张相同优惠券时误更新
-	if selectedCoupon != nil && req.CouponID > 0 {
-		if err := model.UseCouponByUserCouponID(req.CouponID, id); err != nil {
+	if len(couponCombination.Coupons) > 0 {
+		if err := model.UseCouponByUserCouponID(req.CouponID, id, couponCombination.SavedByUserCouponID()[req.CouponID]); err != nil {
 			// 记录错误但不影响订单修改
 			log.Printf("[UpdateOrderForCustomer] 标记优惠券为已使用失败 (userCouponID=%d, orderID=%d): %v", req.CouponID, id, err)
 		} else {
@@ -1324,10 +1332,7 @@ func UpdateOrderForCustomer(c *gin.Context) {
 	}
 
 	// 异步重新计算配送费和利润
-	go func() {
-		_ = model.UpdateOrderDeliveryInfo(id)
-		_ = model.CalculateAndStoreOrderProfitWithRetry(id, 3)
-	}()
+	model.EnqueueOrderProfitJob(id, true)
 
 	// 获取更新后的订单信息
 	updatedOrder, err := model.GetOrderByID(id)
@@ -1417,32 +1422,13 @@ func CancelSalesOrder(c *gin.Context) {
 		}
 	}
 
-	// 更新订单状态为已取消
-	err = model.UpdateOrderStatus(id, "cancelled")
+	// 更新订单状态为已取消（分成清理和飞书通知由状态钩子处理）
+	err = model.TransitionOrderStatus(id, model.OrderStatusCancelled, model.OrderActor{Type: model.OrderActorEmployee, ID: employee.EmployeeCode}, "销售员取消")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "取消订单失败: " + err.Error()})
 		return
 	}
 
-	// 清理该订单的分成记录（特别是新客订单记录）
-	// 异步处理，避免阻塞
-	go func(orderID int) {
-		if err := model.CancelOrderCommissions(orderID); err != nil {
-			log.Printf("取消订单 %d 的分成记录失败: %v", orderID, err)
-		} else {
-			log.Printf("订单 %d 的分成记录已清理", orderID)
-		}
-	}(id)
-
-	// 飞书订单取消通知（异步）
-	go func(o *model.Order) {
-		u, _ := model.GetMiniAppUserByID(o.UserID)
-		addr, _ := model.GetAddressByID(o.AddressID)
-		if u != nil && addr != nil {
-			notify.NotifyOrderCancelled(o, u, addr, "销售员取消")
-		}
-	}(order)
-
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
 		"message": "订单已取消",
@@ -1609,6 +1595,10 @@ func CreateSalesCustomerAddress(c *gin.Context) {
 	}
 
 	newAddr, err := model.CreateAddress(userID, addressData)
+	if errors.Is(err, model.ErrAddressNotServiceable) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "新增地址失败: " + err.Error()})
 		return
@@ -1703,6 +1693,10 @@ func UpdateSalesCustomerAddress(c *gin.Context) {
 	addressData["is_default"] = req.IsDefault
 
 	if err := model.UpdateAddress(addrID, addr.UserID, addressData); err != nil {
+		if errors.Is(err, model.ErrAddressNotServiceable) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "更新地址失败: " + err.Error()})
 		return
 	}
@@ -2103,8 +2097,14 @@ func GetSalesCustomerPurchaseList(c *gin.Context) {
 		userType = "retail"
 	}
 
-	// 计算配送费
-	summary, err := model.CalculateDeliveryFee(items, userType)
+	// 计算配送费（传入收货地址时按地址所在配送区域计算）
+	var address *model.Address
+	if addressID := parseQueryInt(c, "address_id", 0); addressID > 0 {
+		if addr, err := model.GetAddressByID(addressID); err == nil && addr != nil && addr.UserID == userID {
+			address = addr
+		}
+	}
+	summary, err := model.CalculateDeliveryFeeForAddress(items, userType, address)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "计算配送费失败: " + err.Error()})
 		return
@@ -2119,13 +2119,19 @@ func GetSalesCustomerPurchaseList(c *gin.Context) {
 		}
 	}
 
+	pointsRedemption, err := model.QuotePointsRedemption(userID, summary.TotalAmount, 0, 0)
+	if err != nil {
+		log.Printf("[GetSalesCustomerPurchaseList] 计算积分抵扣失败: %v", err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"code": 200,
 		"data": gin.H{
-			"items":      items,
-			"summary":    summary,
-			"backup":     userPurchaseListBackup, // 返回备份，前端必须保存并在创建订单时传入
-			"urgent_fee": urgentFee,              // 返回加急费用供前端显示
+			"items":             items,
+			"summary":           summary,
+			"backup":            userPurchaseListBackup, // 返回备份，前端必须保存并在创建订单时传入
+			"urgent_fee":        urgentFee,              // 返回加急费用供前端显示
+			"points_redemption": pointsRedemption,       // 客户积分抵扣规则及可用积分（未计入优惠券）
 		},
 		"message": "获取成功",
 	})
@@ -2353,6 +2359,7 @@ func AddSalesCustomerPurchaseItem(c *gin.Context) {
 				WholesalePrice: spec.WholesalePrice,
 				RetailPrice:    spec.RetailPrice,
 				DeliveryCount:  spec.DeliveryCount, // 配送计件数
+				PriceTiers:     spec.PriceTiers,    // 批发阶梯价
 			}
 			found = true
 			break
@@ -2440,6 +2447,7 @@ func CreateOrderForCustomer(c *gin.Context) {
 		ItemIDs             []int                    `json:"item_ids"`              // 采购单项ID列表，为空则使用全部
 		Remark              string                   `json:"remark"`                // 订单备注
 		CouponID            int                      `json:"coupon_id"`             // 用户优惠券ID（user_coupon_id），可选
+		UsePoints           int                      `json:"use_points"`            // 使用客户积分抵扣的积分数量，可选
 		OutOfStockStrategy  string                   `json:"out_of_stock_strategy"` // 缺货处理：cancel_item / ship_available / contact_me
 		TrustReceipt        bool                     `json:"trust_receipt"`         // 信任签收
 		HidePrice           bool                     `json:"hide_price"`            // 是否隐藏价格
@@ -2447,6 +2455,8 @@ func CreateOrderForCustomer(c *gin.Context) {
 		IsUrgent            bool                     `json:"is_urgent"`             // 是否加急订单
 		PurchaseListBackup  []model.PurchaseListItem `json:"purchase_list_backup"`  // 用户原来的采购单备份（从GetSalesCustomerPurchaseList获取，必须传入）
 		PriceModifications  []PriceModification      `json:"price_modifications"`   // 改价信息列表（可选）
+		DeliverySlotID      int                      `json:"delivery_slot_id"`      // 预约配送时段ID，可选
+		DeliveryDate        string                   `json:"delivery_date"`         // 预约配送日期 YYYY-MM-DD
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -2556,65 +2566,49 @@ func CreateOrderForCustomer(c *gin.Context) {
 	}
 
 	// 计算配送费（使用改价后的价格）
-	summary, err := model.CalculateDeliveryFee(items, userType, priceOverrideMap)
+	summary, err := model.CalculateDeliveryFeeForAddress(items, userType, address, priceOverrideMap)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "计算配送费失败: " + err.Error()})
 		return
 	}
 
-	// 计算订单金额和分类信息用于优惠券筛选
+	// 计算订单金额用于积分抵扣校验
 	// 注意：如果商品有改价，使用改价后的价格；否则使用原始价格
 	orderAmount := summary.TotalAmount // 使用配送费计算中的TotalAmount（已应用改价）
-	categoryIDSet := make(map[int]struct{})
-	productIDs := make([]int, 0, len(items))
-	for _, item := range items {
-		productIDs = append(productIDs, item.ProductID)
-	}
 
-	categoryInfo, err := model.FetchProductCategoryInfo(productIDs)
-	if err == nil {
-		for _, info := range categoryInfo {
-			if info.CategoryID > 0 {
-				categoryIDSet[info.CategoryID] = struct{}{}
-			}
-			if info.ParentID > 0 {
-				categoryIDSet[info.ParentID] = struct{}{}
-			}
-		}
-	}
-	categoryIDs := make([]int, 0, len(categoryIDSet))
-	for id := range categoryIDSet {
-		categoryIDs = append(categoryIDs, id)
-	}
-
-	// 获取可用优惠券并计算折扣
+	// 获取可用优惠券并计算折扣（按改价后的商品明细计算适用范围）
 	couponDiscount := 0.0
-	var selectedCoupon *model.AvailableCouponInfo
+	var couponCombination model.BestCouponCombination
 	if req.CouponID > 0 {
-		availableCoupons, err := model.GetAvailableCouponsForPurchaseList(
-			req.UserID,
-			orderAmount,
-			categoryIDs,
-			summary.DeliveryFee,
-			summary.IsFreeShipping,
-		)
+		couponItems, err := model.BuildCouponOrderItems(items, userType, priceOverrideMap)
 		if err == nil {
-			// 查找指定的优惠券
-			for i := range availableCoupons {
-				if availableCoupons[i].UserCouponID == req.CouponID && availableCoupons[i].IsAvailable {
-					selectedCoupon = &availableCoupons[i]
-					// 计算折扣金额
-					if selectedCoupon.Type == "delivery_fee" {
-						couponDiscount = summary.DeliveryFee
-					} else if selectedCoupon.Type == "amount" {
-						couponDiscount = selectedCoupon.DiscountValue
-					}
-					break
-				}
+			availableCoupons, err := model.GetAvailableCouponsForPurchaseList(
+				req.UserID,
+				couponItems,
+				summary.DeliveryFee,
+				summary.IsFreeShipping,
+			)
+			if err == nil {
+				couponCombination = model.CalculateCouponCombinationForUserCoupons(availableCoupons, couponItems, summary.DeliveryFee, summary.IsFreeShipping, []int{req.CouponID})
+				couponDiscount = couponCombination.TotalDiscount
 			}
 		}
 	}
 
+	// 校验积分抵扣（使用客户本人的积分）
+	pointsDiscount, err := model.ValidatePointsRedemption(req.UserID, orderAmount, couponDiscount, req.UsePoints)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+
+	// 校验预约配送时段
+	deliverySlot := newDeliverySlotSelection(req.DeliverySlotID, req.DeliveryDate)
+	if _, err := model.ValidateDeliverySlotSelection(deliverySlot, address, model.TotalDeliveryUnits(items)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+
 	// 处理缺货策略，默认为 contact_me
 	outOfStockStrategy := req.OutOfStockStrategy
 	if outOfStockStrategy == "" {
@@ -2639,27 +2633,34 @@ func CreateOrderForCustomer(c *gin.Context) {
 		TrustReceipt:        req.TrustReceipt,
 		HidePrice:           req.HidePrice,
 		RequirePhoneContact: req.RequirePhoneContact,
-		PointsDiscount:      0,
+		PointsDiscount:      pointsDiscount,
+		PointsUsed:          req.UsePoints,
 		CouponDiscount:      couponDiscount,
 		IsUrgent:            req.IsUrgent,
 		UrgentFee:           urgentFee,
 		PriceModifications:  priceModMap,
-		DeliveryFeeCouponID: 0,
-		AmountCouponID:      0,
-	}
-
-	// 设置优惠券ID（在事务内处理）
-	if selectedCoupon != nil && req.CouponID > 0 {
-		if selectedCoupon.Type == "delivery_fee" {
-			options.DeliveryFeeCouponID = req.CouponID
-		} else if selectedCoupon.Type == "amount" {
-			options.AmountCouponID = req.CouponID
-		}
+		UserCouponIDs:       couponCombination.UserCouponIDs(), // 在事务内核销
+		CouponSavings:       couponCombination.SavedByUserCouponID(),
+		DeliverySlot:        deliverySlot,
 	}
 
 	// 创建订单（注意：CreateOrderFromPurchaseList 不再清空采购单）
 	order, orderItems, err := model.CreateOrderFromPurchaseList(req.UserID, req.AddressID, items, summary, options, userType)
 	if err != nil {
+		var stockErr *model.InsufficientStockError
+		if errors.As(err, &stockErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": stockErr.Error()})
+			return
+		}
+		var promoErr *model.PromotionChangedError
+		if errors.As(err, &promoErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": promoErr.Error()})
+			return
+		}
+		if errors.Is(err, model.ErrInsufficientPoints) || errors.Is(err, model.ErrDeliverySlotFull) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "创建订单失败: " + err.Error()})
 		return
 	}
@@ -2709,23 +2710,10 @@ func CreateOrderForCustomer(c *gin.Context) {
 
 	// 优惠券已在事务内处理，无需再次处理
 
-	// 创建订单成功后，立即计算订单的配送费、利润等信息
-	// 这样在跳转到订单详情页时，销售分成预览才能正确显示
-	go func() {
-		// 异步计算，不阻塞订单创建响应
-		_ = model.UpdateOrderDeliveryInfo(order.ID)
-		_ = model.CalculateAndStoreOrderProfitWithRetry(order.ID, 3)
-		log.Printf("[CreateOrderForCustomer] 已触发订单利润和配送费计算 (orderID=%d)", order.ID)
-	}()
-
-	// 飞书新订单通知（异步）
-	go func(o *model.Order, items []model.OrderItem) {
-		u, _ := model.GetMiniAppUserByID(o.UserID)
-		addr, _ := model.GetAddressByID(o.AddressID)
-		if u != nil && addr != nil {
-			notify.NotifyOrderNew(o, items, u, addr, true) // 销售员代下单
-		}
-	}(order, orderItems)
+	// 订单的配送费、利润等信息已在创建订单时作为后台任务入队，详情页销售分成预览未算好时会同步计算
+
+	// 飞书新订单通知（后台任务）
+	enqueueFeishuOrderNew(order.ID, true) // 销售员代下单
 
 	c.JSON(http.StatusOK, gin.H{
 		"code": 200,
@@ -153,6 +153,17 @@ func parseQueryIntWithExplicitZero(c *gin.Context, key string) (value int, expli
 	return v, (v == 0)
 }
 
+// parseQueryIntList 解析逗号分隔的正整数列表参数（如 coupon_ids=1,2,3），忽略无效值
+func parseQueryIntList(c *gin.Context, key string) []int {
+	values := make([]int, 0)
+	for _, s := range strings.Split(c.Query(key), ",") {
+		if v, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && v > 0 {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
 // GetCarousels 获取轮播图列表
 func GetCarousels(c *gin.Context) {
 	// 从数据库获取启用状态的轮播图
@@ -978,6 +989,17 @@ func GetSpecialProducts(c *gin.Context) {
 		}
 	}
 
+	// 进行中及24小时内开始的限时促销，供小程序展示倒计时
+	productIDs := make([]int, 0, len(specialProducts))
+	for _, p := range specialProducts {
+		productIDs = append(productIDs, p.ID)
+	}
+	promotionMap, err := model.GetPromotionCountdowns(productIDs, 24*time.Hour)
+	if err != nil {
+		log.Printf("查询限时促销失败: %v", err)
+		promotionMap = map[int][]model.PromotionCountdown{}
+	}
+
 	// 转换结果为 map，附加 uom_base_unit_id 字段
 	resultList := make([]map[string]interface{}, 0, len(specialProducts))
 	for _, p := range specialProducts {
@@ -1003,6 +1025,11 @@ func GetSpecialProducts(c *gin.Context) {
 				item["uom_base_unit_id"] = *baseID
 			}
 		}
+		if promotions, ok := promotionMap[p.ID]; ok {
+			item["promotions"] = promotions
+		} else {
+			item["promotions"] = []model.PromotionCountdown{}
+		}
 
 		resultList = append(resultList, item)
 	}
@@ -1376,6 +1403,12 @@ func BatchUpdateSpecialProductSort(c *gin.Context) {
 	successResponse(c, nil, "更新排序成功")
 }
 
+// specPriceTierView 商品详情中单个规格的阶梯价区间
+type specPriceTierView struct {
+	SpecName string                 `json:"spec_name"`
+	Tiers    []model.PriceTierRange `json:"tiers"`
+}
+
 // GetProductDetail 获取商品详情
 func GetProductDetail(c *gin.Context) {
 	id, ok := parseID(c, "id")
@@ -1423,14 +1456,23 @@ func GetProductDetail(c *gin.Context) {
 		Specifications []struct {
 			Name string `json:"name"`
 		} `json:"specifications"`
-		Specs     []model.Spec `json:"specs"`   // 完整规格信息，包含名称、描述、价格和原价
-		Stock     int          `json:"stock"`   // 库存（默认值）
-		Sales     int          `json:"sales"`   // 销量（默认值）
-		Details   string       `json:"details"` // 详细描述（默认值）
-		CreatedAt time.Time    `json:"created_at"`
-		UpdatedAt time.Time    `json:"updated_at"`
+		Specs        []model.Spec        `json:"specs"`         // 完整规格信息，包含名称、描述、价格和原价
+		Stock        int                 `json:"stock"`         // 可售库存（已开启库存跟踪的规格合计）
+		StockTracked bool                `json:"stock_tracked"` // 是否有规格开启了库存跟踪，未开启视为不限库存
+		SpecStocks   []specStockView     `json:"spec_stocks"`   // 各规格库存
+		PriceTiers   []specPriceTierView `json:"price_tiers"`   // 各规格批发阶梯价区间（仅批发客户适用）
+		Sales        int                 `json:"sales"`         // 销量（默认值）
+		Details      string              `json:"details"`       // 详细描述（默认值）
+		CreatedAt    time.Time           `json:"created_at"`
+		UpdatedAt    time.Time           `json:"updated_at"`
 	}{}
 
+	specStocks, err := buildSpecStockViews(product)
+	if err != nil {
+		log.Printf("获取商品库存失败: %v", err)
+		specStocks = []specStockView{}
+	}
+
 	// 填充数据
 	responseData.ID = product.ID
 	responseData.Name = product.Name
@@ -1444,7 +1486,19 @@ func GetProductDetail(c *gin.Context) {
 	responseData.Images = product.Images
 	responseData.Specifications = specifications
 	responseData.Specs = product.Specs         // 完整的规格信息，包含名称、描述、价格和原价
-	responseData.Stock = 100                   // 可以后续从数据库获取真实库存
+	responseData.SpecStocks = specStocks
+	responseData.PriceTiers = make([]specPriceTierView, 0)
+	for _, spec := range product.Specs {
+		if ranges := model.BuildSpecPriceTierRanges(spec); len(ranges) > 0 {
+			responseData.PriceTiers = append(responseData.PriceTiers, specPriceTierView{SpecName: spec.Name, Tiers: ranges})
+		}
+	}
+	for _, stock := range specStocks {
+		if stock.Tracked {
+			responseData.StockTracked = true
+			responseData.Stock += stock.AvailableQuantity
+		}
+	}
 	responseData.Sales = 50                    // 可以后续从数据库获取真实销量
 	responseData.Details = product.Description // 使用描述作为详情
 	responseData.CreatedAt = product.CreatedAt
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"strings"
+
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetJobs 获取后台任务列表（管理后台），可按类型、状态筛选
+func GetJobs(c *gin.Context) {
+	pageNum := parseQueryInt(c, "pageNum", 1)
+	pageSize := parseQueryInt(c, "pageSize", 20)
+	filter := model.JobFilter{
+		Type:   strings.TrimSpace(c.Query("type")),
+		Status: strings.TrimSpace(c.Query("status")),
+	}
+
+	list, total, err := model.GetJobs(filter, pageNum, pageSize)
+	if err != nil {
+		internalErrorResponse(c, "获取后台任务失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"list":  list,
+		"total": total,
+	}, "")
+}
+
+// RetryJob 重新执行后台任务（管理后台），用于重试耗尽进入死信的任务
+func RetryJob(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	if err := model.RetryJob(int64(id)); err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	successResponse(c, nil, "任务已重新加入队列")
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -567,6 +568,10 @@ func UpdateAdminAddress(c *gin.Context) {
 
 	// 更新地址
 	err = model.UpdateAddress(id, address.UserID, addressData)
+	if errors.Is(err, model.ErrAddressNotServiceable) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "更新地址失败: " + err.Error()})
 		return
@@ -1078,6 +1083,10 @@ func UpdateMiniAppUserProfile(c *gin.Context) {
 	if req.AddressID == nil || *req.AddressID == 0 {
 		// 新增地址
 		address, err = model.CreateAddress(user.ID, addressData)
+		if errors.Is(err, model.ErrAddressNotServiceable) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "创建地址失败: " + err.Error()})
 			return
@@ -1085,6 +1094,10 @@ func UpdateMiniAppUserProfile(c *gin.Context) {
 	} else {
 		// 更新地址
 		err = model.UpdateAddress(*req.AddressID, user.ID, addressData)
+		if errors.Is(err, model.ErrAddressNotServiceable) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "更新地址失败: " + err.Error()})
 			return
@@ -1747,6 +1760,13 @@ func UpdateMiniAppUserPhone(c *gin.Context) {
 	})
 }
 
+// geocodeAddressResponse 地址解析结果及配送区域校验
+type geocodeAddressResponse struct {
+	*utils.GeocodeResult
+	Serviceable bool                     `json:"serviceable"`    // 是否在配送范围内（未配置配送区域时总是可配送）
+	Zone        *model.DeliveryZoneBrief `json:"zone,omitempty"` // 所在配送区域
+}
+
 // GeocodeAddress 地址解析接口（将地址文本转换为经纬度）
 func GeocodeAddress(c *gin.Context) {
 	type geocodeRequest struct {
@@ -1781,10 +1801,20 @@ func GeocodeAddress(c *gin.Context) {
 		return
 	}
 
+	// 附带配送区域校验结果，前端可在保存地址前提示不在配送范围
+	zone, zoneErr := model.CheckLocationServiceable(&result.Latitude, &result.Longitude)
+	if zoneErr != nil && !errors.Is(zoneErr, model.ErrAddressNotServiceable) {
+		log.Printf("[GeocodeAddress] 校验配送区域失败: %v", zoneErr)
+		zoneErr = nil
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
 		"message": "地址解析成功",
-		"data":    result,
+		"data": geocodeAddressResponse{
+			GeocodeResult: result,
+			Serviceable:   zoneErr == nil,
+			Zone:          zone.Brief(),
+		},
 	})
 }
 
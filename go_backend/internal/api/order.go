@@ -2,6 +2,7 @@ package api
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,7 +12,6 @@ import (
 
 	"go_backend/internal/database"
 	"go_backend/internal/model"
-	"go_backend/internal/notify"
 
 	"github.com/gin-gonic/gin"
 )
@@ -27,12 +27,16 @@ type CreateOrderRequest struct {
 	HidePrice           bool    `json:"hide_price"`            // 是否隐藏价格
 	RequirePhoneContact bool    `json:"require_phone_contact"` // 配送时是否电话联系
 	ExpectedDeliveryAt  *string `json:"expected_delivery_at"`  // 预留，暂不解析
-	PointsDiscount      float64 `json:"points_discount"`       // 预留：积分抵扣金额
+	PointsDiscount      float64 `json:"points_discount"`       // 已废弃：积分抵扣金额由后端根据 use_points 计算
+	UsePoints           int     `json:"use_points"`            // 使用积分抵扣的积分数量
 	CouponDiscount      float64 `json:"coupon_discount"`       // 预留：优惠券抵扣金额（当前已在购物车+确认页计算）
 	DeliveryCouponID    int     `json:"delivery_coupon_id"`    // 指定免配送费券
 	AmountCouponID      int     `json:"amount_coupon_id"`      // 指定金额券
+	CouponIDs           []int   `json:"coupon_ids"`            // 指定使用的全部优惠券（可叠加多张，传入时忽略上面两个字段）
 	IsUrgent            bool    `json:"is_urgent"`             // 是否加急订单
 	PaymentMethod       string  `json:"payment_method"`         // 支付方式: online-在线支付, cod-货到付款（不传或空默认 cod，兼容老版本）
+	DeliverySlotID      int     `json:"delivery_slot_id"`      // 预约配送时段ID
+	DeliveryDate        string  `json:"delivery_date"`         // 预约配送日期 YYYY-MM-DD
 }
 
 // CreateOrderFromCart 从当前采购单创建订单
@@ -115,60 +119,22 @@ func CreateOrderFromCart(c *gin.Context) {
 	}
 
 	// 计算配送费和金额汇总
-	summary, err := model.CalculateDeliveryFee(items, userType)
+	summary, err := model.CalculateDeliveryFeeForAddress(items, userType, address)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "计算配送费失败: " + err.Error()})
 		return
 	}
 
-	// 计算订单金额和分类信息用于优惠券筛选
-	orderAmount := 0.0
-	categoryIDSet := make(map[int]struct{})
-	productIDs := make([]int, 0, len(items))
-	for _, item := range items {
-		// 根据用户类型计算商品金额
-		var price float64
-		if userType == "wholesale" {
-			price = item.SpecSnapshot.WholesalePrice
-			if price <= 0 {
-				price = item.SpecSnapshot.RetailPrice
-			}
-		} else {
-			price = item.SpecSnapshot.RetailPrice
-			if price <= 0 {
-				price = item.SpecSnapshot.WholesalePrice
-			}
-		}
-		if price <= 0 {
-			price = item.SpecSnapshot.Cost
-		}
-		if price < 0 {
-			price = 0
-		}
-		orderAmount += price * float64(item.Quantity)
-		productIDs = append(productIDs, item.ProductID)
-	}
-
-	categoryInfo, err := model.FetchProductCategoryInfo(productIDs)
-	if err == nil {
-		for _, info := range categoryInfo {
-			if info.CategoryID > 0 {
-				categoryIDSet[info.CategoryID] = struct{}{}
-			}
-			if info.ParentID > 0 {
-				categoryIDSet[info.ParentID] = struct{}{}
-			}
-		}
-	}
-	categoryIDs := make([]int, 0, len(categoryIDSet))
-	for id := range categoryIDSet {
-		categoryIDs = append(categoryIDs, id)
+	// 按商品明细计算优惠券适用范围和优惠金额
+	couponItems, err := model.BuildCouponOrderItems(items, userType, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "计算优惠券失败: " + err.Error()})
+		return
 	}
 
 	availableCoupons, err := model.GetAvailableCouponsForPurchaseList(
 		user.ID,
-		orderAmount,
-		categoryIDs,
+		couponItems,
 		summary.DeliveryFee,
 		summary.IsFreeShipping,
 	)
@@ -176,14 +142,25 @@ func CreateOrderFromCart(c *gin.Context) {
 		availableCoupons = []model.AvailableCouponInfo{}
 	}
 
-	appliedCombination := model.CalculateCouponCombinationWithSelection(
-		availableCoupons,
-		orderAmount,
-		summary.DeliveryFee,
-		summary.IsFreeShipping,
-		req.DeliveryCouponID,
-		req.AmountCouponID,
-	)
+	var appliedCombination model.BestCouponCombination
+	if len(req.CouponIDs) > 0 {
+		appliedCombination = model.CalculateCouponCombinationForUserCoupons(
+			availableCoupons,
+			couponItems,
+			summary.DeliveryFee,
+			summary.IsFreeShipping,
+			req.CouponIDs,
+		)
+	} else {
+		appliedCombination = model.CalculateCouponCombinationWithSelection(
+			availableCoupons,
+			couponItems,
+			summary.DeliveryFee,
+			summary.IsFreeShipping,
+			req.DeliveryCouponID,
+			req.AmountCouponID,
+		)
+	}
 
 	// 获取加急费用（从系统设置）
 	urgentFee := 0.0
@@ -196,6 +173,20 @@ func CreateOrderFromCart(c *gin.Context) {
 		}
 	}
 
+	// 校验积分抵扣（按系统设置的抵扣比例和上限计算抵扣金额）
+	pointsDiscount, err := model.ValidatePointsRedemption(user.ID, summary.TotalAmount, appliedCombination.TotalDiscount, req.UsePoints)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+
+	// 校验预约配送时段（截单时间、服务区域和容量）
+	deliverySlot := newDeliverySlotSelection(req.DeliverySlotID, req.DeliveryDate)
+	if _, err := model.ValidateDeliverySlotSelection(deliverySlot, address, model.TotalDeliveryUnits(items)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+
 	// 支付方式：不传或非 online/cod 时默认为货到付款，兼容老版本
 	paymentMethod := strings.TrimSpace(req.PaymentMethod)
 	if paymentMethod != "online" && paymentMethod != "cod" {
@@ -209,25 +200,33 @@ func CreateOrderFromCart(c *gin.Context) {
 		TrustReceipt:        req.TrustReceipt,
 		HidePrice:           req.HidePrice,
 		RequirePhoneContact: req.RequirePhoneContact,
-		PointsDiscount:      req.PointsDiscount,
+		PointsDiscount:      pointsDiscount,
+		PointsUsed:          req.UsePoints,
 		CouponDiscount:      appliedCombination.TotalDiscount,
 		IsUrgent:            req.IsUrgent,
 		UrgentFee:           urgentFee,
-		DeliveryFeeCouponID: 0,
-		AmountCouponID:      0,
+		UserCouponIDs:       appliedCombination.UserCouponIDs(), // 在事务内核销
+		CouponSavings:       appliedCombination.SavedByUserCouponID(),
 		PaymentMethod:       paymentMethod,
-	}
-
-	// 设置优惠券ID（在事务内处理）
-	if appliedCombination.DeliveryFeeCoupon != nil && appliedCombination.DeliveryFeeCoupon.UserCouponID > 0 {
-		options.DeliveryFeeCouponID = appliedCombination.DeliveryFeeCoupon.UserCouponID
-	}
-	if appliedCombination.AmountCoupon != nil && appliedCombination.AmountCoupon.UserCouponID > 0 {
-		options.AmountCouponID = appliedCombination.AmountCoupon.UserCouponID
+		DeliverySlot:        deliverySlot,
 	}
 
 	order, orderItems, err := model.CreateOrderFromPurchaseList(user.ID, req.AddressID, items, summary, options, userType)
 	if err != nil {
+		var stockErr *model.InsufficientStockError
+		if errors.As(err, &stockErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": stockErr.Error()})
+			return
+		}
+		var promoErr *model.PromotionChangedError
+		if errors.As(err, &promoErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": promoErr.Error()})
+			return
+		}
+		if errors.Is(err, model.ErrInsufficientPoints) || errors.Is(err, model.ErrDeliverySlotFull) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "创建订单失败: " + err.Error()})
 		return
 	}
@@ -235,13 +234,8 @@ func CreateOrderFromCart(c *gin.Context) {
 	// 记录下单来源：小程序用户自助下单
 	go model.SetOrderSource(order.ID, "mini_app")
 
-	// 飞书新订单通知（异步，不阻塞）
-	go func(o *model.Order, items []model.OrderItem, u *model.MiniAppUser) {
-		addr, _ := model.GetAddressByID(o.AddressID)
-		if addr != nil {
-			notify.NotifyOrderNew(o, items, u, addr, false) // 用户自助下单
-		}
-	}(order, orderItems, user)
+	// 飞书新订单通知（后台任务，不阻塞）
+	enqueueFeishuOrderNew(order.ID, false) // 用户自助下单
 
 	// 优惠券已在事务内处理，无需再次处理
 
@@ -462,6 +456,22 @@ func GetUserOrders(c *gin.Context) {
 	})
 }
 
+// miniUserCanViewOrder 小程序用户是否可以查看订单：订单创建者，或订单创建者绑定的销售员
+func miniUserCanViewOrder(user *model.MiniAppUser, order *model.Order) bool {
+	if order.UserID == user.ID {
+		return true
+	}
+	if !user.IsSalesEmployee || user.SalesEmployeeID == nil {
+		return false
+	}
+	// 销售员需要验证该订单是否属于其负责的客户
+	orderUser, err := model.GetMiniAppUserByID(order.UserID)
+	if err != nil || orderUser == nil {
+		return false
+	}
+	return orderUser.SalesEmployeeID != nil && *orderUser.SalesEmployeeID == *user.SalesEmployeeID
+}
+
 // GetUserOrderDetail 获取订单详情（小程序）
 // 支持订单ID（数字）或订单编号：从「小程序购物订单」跳转时微信用 out_trade_no 替换 ${商品订单号}，即 order_number
 func GetUserOrderDetail(c *gin.Context) {
@@ -494,24 +504,7 @@ func GetUserOrderDetail(c *gin.Context) {
 	}
 
 	// 验证订单归属：允许订单创建者或销售员查看
-	isOrderOwner := order.UserID == user.ID
-	isSalesEmployee := user.IsSalesEmployee && user.SalesEmployeeID != nil
-
-	// 如果是销售员，需要验证该订单是否属于该销售员负责的客户
-	if !isOrderOwner && isSalesEmployee {
-		// 获取订单创建者信息
-		orderUser, err := model.GetMiniAppUserByID(order.UserID)
-		if err != nil || orderUser == nil {
-			c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "无权访问此订单"})
-			return
-		}
-		// 检查订单创建者是否绑定了该销售员
-		if orderUser.SalesEmployeeID == nil || *orderUser.SalesEmployeeID != *user.SalesEmployeeID {
-			c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "无权访问此订单"})
-			return
-		}
-	} else if !isOrderOwner && !isSalesEmployee {
-		// 既不是订单创建者，也不是销售员
+	if !miniUserCanViewOrder(user, order) {
 		c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "无权访问此订单"})
 		return
 	}
@@ -585,15 +578,22 @@ func GetUserOrderDetail(c *gin.Context) {
 		paymentDeadlineAt = deadline.Format("2006-01-02T15:04:05")
 	}
 
+	// 高金额订单的收货确认码（仅下单用户可见，送达时告知配送员）
+	deliveryConfirmCode := ""
+	if order.UserID == user.ID {
+		deliveryConfirmCode = deliveryConfirmCodeForCustomer(order)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"code": 200,
 		"data": gin.H{
-			"order":               order,
-			"order_items":         items,
-			"address":             addressData,
-			"sales_employee":      salesEmployeeData,
-			"delivery_employee":   deliveryEmployeeData,
-			"payment_deadline_at": paymentDeadlineAt,
+			"order":                 order,
+			"order_items":           items,
+			"address":               addressData,
+			"sales_employee":        salesEmployeeData,
+			"delivery_employee":     deliveryEmployeeData,
+			"payment_deadline_at":   paymentDeadlineAt,
+			"delivery_confirm_code": deliveryConfirmCode,
 		},
 		"message": "获取成功",
 	})
@@ -713,31 +713,13 @@ func CancelUserOrder(c *gin.Context) {
 		}
 	}
 
-	// 更新订单状态为已取消
-	err = model.UpdateOrderStatus(id, "cancelled")
+	// 更新订单状态为已取消（分成清理和飞书通知由状态钩子处理）
+	err = model.TransitionOrderStatus(id, model.OrderStatusCancelled, model.OrderActor{Type: model.OrderActorUser, ID: strconv.Itoa(user.ID)}, "用户取消")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "取消订单失败: " + err.Error()})
 		return
 	}
 
-	// 清理该订单的分成记录（特别是新客订单记录）
-	// 异步处理，避免阻塞
-	go func(orderID int) {
-		if err := model.CancelOrderCommissions(orderID); err != nil {
-			log.Printf("取消订单 %d 的分成记录失败: %v", orderID, err)
-		} else {
-			log.Printf("订单 %d 的分成记录已清理", orderID)
-		}
-	}(id)
-
-	// 飞书订单取消通知（异步）
-	go func(o *model.Order, u *model.MiniAppUser) {
-		addr, _ := model.GetAddressByID(o.AddressID)
-		if addr != nil {
-			notify.NotifyOrderCancelled(o, u, addr, "用户取消")
-		}
-	}(order, user)
-
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
 		"message": "订单已取消",
@@ -12,7 +12,6 @@ import (
 
 	"go_backend/internal/database"
 	"go_backend/internal/model"
-	"go_backend/internal/notify"
 
 	"github.com/gin-gonic/gin"
 )
@@ -273,9 +272,7 @@ func GetAllOrdersForAdmin(c *gin.Context) {
 					orderData["net_profit"] = netProfitVal
 
 					// 异步存储计算结果，下次查询时可以直接使用
-					go func() {
-						_ = model.CalculateAndStoreOrderProfitWithRetry(order.ID, 3)
-					}()
+					model.EnqueueOrderProfitJob(order.ID, false)
 				}
 			}
 		}
@@ -502,9 +499,7 @@ func GetOrderByIDForAdmin(c *gin.Context) {
 				netProfit = orderProfit - result.TotalPlatformCost
 
 				// 异步存储计算结果，下次查询时可以直接使用
-				go func() {
-					_ = model.CalculateAndStoreOrderProfitWithRetry(id, 3)
-				}()
+				model.EnqueueOrderProfitJob(id, false)
 			}
 		}
 	}
@@ -650,6 +645,7 @@ func UpdateOrderStatus(c *gin.Context) {
 
 	var req struct {
 		Status string `json:"status" binding:"required"`
+		Reason string `json:"reason"` // 变更原因（可选）
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "请求参数错误: " + err.Error()})
@@ -682,7 +678,7 @@ func UpdateOrderStatus(c *gin.Context) {
 	}
 
 	// 验证状态流转是否合法
-	if !isValidStatusTransition(order.Status, req.Status) {
+	if !model.CanTransitionOrderStatus(order.Status, req.Status) {
 		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "状态流转不合法"})
 		return
 	}
@@ -694,139 +690,25 @@ func UpdateOrderStatus(c *gin.Context) {
 		effectiveStatus = "paid"
 	}
 
-	// 更新订单状态
-	err = model.UpdateOrderStatus(id, effectiveStatus)
+	// 更新订单状态（分成清理、结算、积分、推荐奖励和飞书通知由状态钩子处理）
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		reason = "管理员修改状态"
+	}
+	operator, _ := c.Get("username")
+	operatorName, _ := operator.(string)
+	err = model.TransitionOrderStatus(id, effectiveStatus, model.OrderActor{Type: model.OrderActorAdmin, ID: operatorName}, reason)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "更新订单状态失败: " + err.Error()})
 		return
 	}
 
-	// 如果订单状态变为 cancelled（已取消），清理该订单的分成记录
-	// 特别是新客订单记录，这样其他订单就可以重新计算新客激励了
-	if effectiveStatus == "cancelled" {
-		// 异步处理，避免阻塞
-		go func(orderID int) {
-			if err := model.CancelOrderCommissions(orderID); err != nil {
-				log.Printf("取消订单 %d 的分成记录失败: %v", orderID, err)
-			} else {
-				log.Printf("订单 %d 的分成记录已清理", orderID)
-			}
-		}(id)
-		// 飞书订单取消通知（异步）
-		go func(o *model.Order) {
-			u, _ := model.GetMiniAppUserByID(o.UserID)
-			addr, _ := model.GetAddressByID(o.AddressID)
-			if u != nil && addr != nil {
-				notify.NotifyOrderCancelled(o, u, addr, "管理员取消")
-			}
-		}(order)
-	}
-
-	// 如果订单状态变为 paid（已收款），需要计算销售分成和处理推荐奖励
-	if effectiveStatus == "paid" {
-		// 异步处理销售分成计算和推荐奖励（避免阻塞）
-		go func(orderID int) {
-			// 等待一下，确保订单状态和结算日期已更新
-			time.Sleep(100 * time.Millisecond)
-
-			// 重新获取订单信息，检查是否有结算日期
-			order, err := model.GetOrderByID(orderID)
-			if err != nil {
-				log.Printf("获取订单 %d 信息失败: %v", orderID, err)
-				return
-			}
-			if order == nil {
-				log.Printf("订单 %d 不存在", orderID)
-				return
-			}
-
-			// 如果订单有结算日期，计算销售分成
-			// 如果没有结算日期，设置结算日期为当前时间
-			if order.SettlementDate == nil {
-				now := time.Now()
-				_, err = database.DB.Exec("UPDATE orders SET settlement_date = ? WHERE id = ?", now, orderID)
-				if err != nil {
-					log.Printf("设置订单 %d 结算日期失败: %v", orderID, err)
-					return
-				}
-				// 更新订单对象的结算日期
-				order.SettlementDate = &now
-			}
-
-			// 计算销售分成
-			if err := model.ProcessOrderSettlement(orderID); err != nil {
-				log.Printf("处理订单 %d 的销售分成失败: %v", orderID, err)
-			} else {
-				log.Printf("订单 %d 的销售分成计算成功", orderID)
-			}
-
-			// 处理推荐奖励（订单完成付款后发放奖励给老用户）
-			if err := model.ProcessReferralReward(orderID); err != nil {
-				log.Printf("处理订单 %d 的推荐奖励失败: %v", orderID, err)
-			} else {
-				log.Printf("订单 %d 的推荐奖励处理完成", orderID)
-			}
-
-			// 处理订单积分奖励（订单完成付款后发放积分）
-			// 积分规则：每消费1元奖励1积分，四舍五入
-			if err := model.AddPointsForOrder(order.UserID, orderID, order.OrderNumber, order.TotalAmount); err != nil {
-				log.Printf("处理订单 %d 的积分奖励失败: %v", orderID, err)
-			} else {
-				log.Printf("订单 %d 的积分奖励处理完成", orderID)
-			}
-
-			// 飞书订单收款通知（异步）
-			items, _ := model.GetOrderItemsByOrderID(orderID)
-			u, _ := model.GetMiniAppUserByID(order.UserID)
-			if u != nil {
-				notify.NotifyOrderPaid(order, items, u, "")
-			}
-		}(id)
-	}
-
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
 		"message": "更新成功",
 	})
 }
 
-// isValidStatusTransition 验证状态流转是否合法
-// 流程：pending_delivery -> pending_pickup -> delivering -> delivered -> paid
-// 可以取消：pending_delivery, pending_pickup, delivering -> cancelled
-// 兼容旧状态：pending 视为 pending_delivery
-func isValidStatusTransition(currentStatus, newStatus string) bool {
-	// 将旧状态 pending 转换为新状态 pending_delivery
-	if currentStatus == "pending" {
-		currentStatus = "pending_delivery"
-	}
-
-	// 允许的状态流转（pending_payment 在线支付待支付，支付成功后变为 pending_delivery）
-	transitions := map[string][]string{
-		"pending_payment":  {"pending_delivery", "cancelled"}, // 待支付：可手动标记已支付进入配送，或取消
-		"pending_delivery": {"pending_pickup", "cancelled"},
-		"pending_pickup":   {"delivering", "cancelled"},
-		"delivering":       {"delivered"}, // 配送中不能取消
-		"delivered":        {"paid"},
-		"shipped":          {"paid"}, // 兼容旧状态 shipped -> paid
-		"paid":             {},       // 已收款是最终状态，不能再流转
-		"completed":        {},       // 兼容旧状态 completed，不能再流转
-		"cancelled":        {},       // 已取消是最终状态，不能再流转
-	}
-
-	allowed, exists := transitions[currentStatus]
-	if !exists {
-		return false
-	}
-
-	for _, status := range allowed {
-		if status == newStatus {
-			return true
-		}
-	}
-
-	return false
-}
-
 // AdminManualRefund 管理员手动退款（用于支付回调未同步等异常场景）
 // POST /api/admin/orders/:id/manual-refund
 func AdminManualRefund(c *gin.Context) {
@@ -868,29 +750,15 @@ func AdminManualRefund(c *gin.Context) {
 		log.Printf("[AdminManualRefund] 更新订单退款状态失败: %v", err)
 	}
 
-	// 更新订单状态为已取消
-	if err := model.UpdateOrderStatus(id, "cancelled"); err != nil {
+	// 更新订单状态为已取消（分成清理和飞书通知由状态钩子处理）
+	operator, _ := c.Get("username")
+	operatorName, _ := operator.(string)
+	if err := model.ForceCancelOrder(id, model.OrderActor{Type: model.OrderActorAdmin, ID: operatorName}, "管理员手动退款"); err != nil {
 		log.Printf("[AdminManualRefund] 更新订单状态失败: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "退款已受理，但更新订单状态失败"})
 		return
 	}
 
-	// 清理分成记录
-	go func(orderID int) {
-		if err := model.CancelOrderCommissions(orderID); err != nil {
-			log.Printf("手动退款-取消订单 %d 的分成记录失败: %v", orderID, err)
-		}
-	}(id)
-
-	// 飞书订单取消通知（异步）
-	go func(o *model.Order) {
-		u, _ := model.GetMiniAppUserByID(o.UserID)
-		addr, _ := model.GetAddressByID(o.AddressID)
-		if u != nil && addr != nil {
-			notify.NotifyOrderCancelled(o, u, addr, "管理员手动退款")
-		}
-	}(order)
-
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
 		"message": "退款已受理，预计1-3工作日到账。订单已取消。",
@@ -944,12 +812,22 @@ func AdminRefundWithDetails(c *gin.Context) {
 		return
 	}
 
+	// 剩余可退金额 = 原支付总额 - 已发起的退款（缺货差价、售后退款等）
+	refundable, err := model.GetOrderRefundableAmount(order)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "查询可退金额失败: " + err.Error()})
+		return
+	}
+	if refundable < 0.01 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "订单已全额退款"})
+		return
+	}
 	refundAmount := req.RefundAmount
 	if refundAmount <= 0 {
-		refundAmount = order.TotalAmount
+		refundAmount = refundable
 	}
-	if refundAmount > order.TotalAmount {
-		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": fmt.Sprintf("退款金额不能超过订单实付金额 ¥%.2f", order.TotalAmount)})
+	if refundAmount > refundable+0.001 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": fmt.Sprintf("退款金额不能超过订单剩余可退金额 ¥%.2f", refundable)})
 		return
 	}
 
@@ -976,28 +854,16 @@ func AdminRefundWithDetails(c *gin.Context) {
 	}
 
 	// 全额退款且勾选了取消订单时，更新状态为已取消
-	if req.CancelOrder && refundAmount >= order.TotalAmount-0.01 {
-		if err := model.UpdateOrderStatus(id, "cancelled"); err != nil {
+	if req.CancelOrder && refundAmount >= refundable-0.01 {
+		operator, _ := c.Get("username")
+		operatorName, _ := operator.(string)
+		if err := model.ForceCancelOrder(id, model.OrderActor{Type: model.OrderActorAdmin, ID: operatorName}, "售后退款: "+reason); err != nil {
 			log.Printf("[AdminRefundWithDetails] 更新订单状态失败: %v", err)
-		} else {
-			go func(orderID int) {
-				if err := model.CancelOrderCommissions(orderID); err != nil {
-					log.Printf("售后退款-取消订单 %d 的分成记录失败: %v", orderID, err)
-				}
-			}(id)
-			// 飞书订单取消通知（异步）
-			go func(o *model.Order) {
-				u, _ := model.GetMiniAppUserByID(o.UserID)
-				addr, _ := model.GetAddressByID(o.AddressID)
-				if u != nil && addr != nil {
-					notify.NotifyOrderCancelled(o, u, addr, "售后退款: "+reason)
-				}
-			}(order)
 		}
 	}
 
 	msg := "退款已受理，预计1-3工作日到账"
-	if req.CancelOrder && refundAmount >= order.TotalAmount-0.01 {
+	if req.CancelOrder && refundAmount >= refundable-0.01 {
 		msg += "。订单已取消。"
 	}
 	msg += "。"
@@ -1327,3 +1193,17 @@ func calculateSalesCommissionPreview(order *model.Order, deliveryFeeResult *mode
 		"calculation_month":     calculationMonth,
 	}
 }
+
+// GetOrderStatusHistory 获取订单状态流转历史（管理后台）
+func GetOrderStatusHistory(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	list, err := model.GetOrderStatusHistory(id)
+	if err != nil {
+		internalErrorResponse(c, "获取订单状态历史失败: "+err.Error())
+		return
+	}
+	successResponse(c, list, "")
+}
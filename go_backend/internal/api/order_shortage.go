@@ -0,0 +1,215 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+
+	"go_backend/internal/database"
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	model.RegisterJobHandler(model.JobShortageRefund, runShortageRefundJob)
+}
+
+// applyPickupShortages 处理配送员取货时上报的缺货（按订单分组，分别应用各订单的缺货处理策略）
+// 先校验全部商品和订单，校验失败时不处理任何订单；各订单独立提交，单个订单失败不影响其他订单，失败原因按订单返回
+func applyPickupShortages(employeeCode string, shortages []model.ShortageReport) ([]string, error) {
+	placeholders := make([]string, len(shortages))
+	args := make([]interface{}, len(shortages))
+	for i, s := range shortages {
+		placeholders[i] = "?"
+		args[i] = s.ItemID
+	}
+	rows, err := database.DB.Query(fmt.Sprintf(`
+		SELECT id, order_id FROM order_items WHERE id IN (%s)
+	`, strings.Join(placeholders, ",")), args...)
+	if err != nil {
+		return nil, err
+	}
+	itemOrder := make(map[int]int, len(shortages))
+	for rows.Next() {
+		var itemID, orderID int
+		if err := rows.Scan(&itemID, &orderID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		itemOrder[itemID] = orderID
+	}
+	rows.Close()
+
+	grouped := make(map[int][]model.ShortageReport)
+	orderIDs := make([]int, 0)
+	for _, s := range shortages {
+		orderID, ok := itemOrder[s.ItemID]
+		if !ok {
+			return nil, fmt.Errorf("订单商品 %d 不存在", s.ItemID)
+		}
+		if _, ok := grouped[orderID]; !ok {
+			orderIDs = append(orderIDs, orderID)
+		}
+		grouped[orderID] = append(grouped[orderID], s)
+	}
+
+	orders := make(map[int]*model.Order, len(orderIDs))
+	for _, orderID := range orderIDs {
+		order, err := model.GetOrderByID(orderID)
+		if err != nil {
+			return nil, err
+		}
+		if order == nil {
+			return nil, fmt.Errorf("订单不存在")
+		}
+		orders[orderID] = order
+	}
+
+	failures := make([]string, 0)
+	for _, orderID := range orderIDs {
+		order := orders[orderID]
+		result, err := model.ReportOrderShortages(orderID, grouped[orderID], employeeCode)
+		if err != nil {
+			log.Printf("[Shortage] 订单 %d 上报缺货失败: %v", orderID, err)
+			failures = append(failures, fmt.Sprintf("订单 %s：%v", order.OrderNumber, err))
+			continue
+		}
+		log.Printf("[Shortage] 订单 %d 上报缺货 %d 项，策略=%s，挂起=%v，金额 %.2f -> %.2f",
+			orderID, len(result.Shortages), result.Strategy, result.Held, result.OldTotalAmount, result.NewTotalAmount)
+		afterShortageApplied(order, result, employeeCode)
+	}
+	return failures, nil
+}
+
+// afterShortageApplied 缺货处理后的后续动作：扣减部分发货商品库存、重算配送费/利润/分成、飞书通知
+// 退还差价由缺货事务内入队的退款任务完成
+// order 为处理前的订单快照
+func afterShortageApplied(order *model.Order, result *model.ShortageResult, deliveryEmployeeCode string) {
+	if result.Held {
+		enqueueFeishuOrderShortage(order.ID, result)
+		return
+	}
+
+	if len(result.PickedItemIDs) > 0 {
+		if err := model.DeductStockForPickedItems(result.PickedItemIDs, deliveryEmployeeCode); err != nil {
+			log.Printf("[Shortage] 订单 %d 扣减部分发货商品库存失败: %v", order.ID, err)
+		}
+	}
+
+	// 整单缺货：订单已在缺货事务内取消（退款任务同时入队）
+	if result.RemainingItems == 0 {
+		model.AfterOrderStatusChanged(result.StatusChange)
+		return
+	}
+
+	// 重新计算配送员配送费和订单利润（后台任务，失败自动重试）
+	model.EnqueueOrderRecalculationJob(order.ID)
+
+	enqueueFeishuOrderShortage(order.ID, result)
+
+	advanceOrderIfAllPicked(order.ID)
+}
+
+// runShortageRefundJob 缺货退款任务：按缺货记录生成固定的商户退款单号，重试时不会重复退款
+func runShortageRefundJob(payload []byte) error {
+	var p model.ShortageRefundJobPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("解析任务参数失败: %v", err)
+	}
+	order, err := model.GetOrderByID(p.OrderID)
+	if err != nil {
+		return err
+	}
+	if order == nil {
+		return nil
+	}
+	outRefundNo := fmt.Sprintf("%s_refund_shortage_%d", order.OrderNumber, p.ShortageID)
+	exists, err := model.WechatRefundExists(outRefundNo)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	// 缺货退款入队后用户可能已取消订单并全额退款，只退还剩余可退部分
+	refundable, err := model.GetOrderRefundableAmount(order)
+	if err != nil {
+		return err
+	}
+	amount := math.Min(p.Amount, refundable)
+	if amount < 0.01 {
+		log.Printf("[Shortage] 订单 %d 已无可退金额，跳过缺货退款 %.2f 元", order.ID, p.Amount)
+		return nil
+	}
+	refundID, err := RequestWechatRefundWithOptions(order, RefundOptions{
+		RefundAmount: amount,
+		Reason:       p.Reason,
+		OutRefundNo:  outRefundNo,
+	})
+	if err != nil {
+		return fmt.Errorf("订单 %d 缺货退款 %.2f 元失败: %v", order.ID, amount, err)
+	}
+	if err := model.RequestWechatRefundForOrder(order.ID, refundID); err != nil {
+		log.Printf("[Shortage] 更新订单 %d 退款状态失败: %v", order.ID, err)
+	}
+	return nil
+}
+
+// GetOrderShortagesForAdmin 获取订单缺货记录（管理后台）
+func GetOrderShortagesForAdmin(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	list, err := model.GetOrderShortages(id)
+	if err != nil {
+		internalErrorResponse(c, "获取缺货记录失败: "+err.Error())
+		return
+	}
+	successResponse(c, list, "")
+}
+
+// ResolveOrderShortage 处理挂起的缺货订单（管理后台，联系客户后选择取消缺货商品或有货先发）
+func ResolveOrderShortage(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Strategy string `json:"strategy" binding:"required"` // cancel_item / ship_available
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "参数错误")
+		return
+	}
+
+	order, err := model.GetOrderByID(id)
+	if err != nil {
+		internalErrorResponse(c, "获取订单失败: "+err.Error())
+		return
+	}
+	if order == nil {
+		notFoundResponse(c, "订单不存在")
+		return
+	}
+
+	operator, _ := c.Get("username")
+	operatorName, _ := operator.(string)
+	result, err := model.ResolveOrderShortages(id, req.Strategy, operatorName)
+	if err != nil {
+		badRequestResponse(c, "处理缺货失败: "+err.Error())
+		return
+	}
+
+	deliveryEmployeeCode := ""
+	if order.DeliveryEmployeeCode != nil {
+		deliveryEmployeeCode = *order.DeliveryEmployeeCode
+	}
+	afterShortageApplied(order, result, deliveryEmployeeCode)
+
+	successResponse(c, result, "缺货已处理")
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"go_backend/internal/model"
+	"go_backend/internal/notify"
+)
+
+// 订单状态钩子：飞书通知和微信发货信息录入（结算、积分、推荐奖励、分成清理等在 model 中注册）
+// 每个钩子作为独立的后台任务执行，失败只重试自身，避免重复发送其他通知
+func init() {
+	model.RegisterOrderStatusHook(model.OrderStatusDelivering, "wechat_shipping", uploadShippingOnStatusChange)
+	model.RegisterOrderStatusHook(model.OrderStatusDelivered, "wechat_shipping", uploadShippingOnStatusChange)
+	model.RegisterOrderStatusHook(model.OrderStatusDelivered, "notify_delivered", notifyOrderDelivered)
+	model.RegisterOrderStatusHook(model.OrderStatusPaid, "wechat_shipping", func(order *model.Order, change model.OrderStatusChange) error {
+		// 在线支付订单送达即已收款，按送达处理
+		if change.From != model.OrderStatusDelivering {
+			return nil
+		}
+		return uploadShippingOnStatusChange(order, change)
+	})
+	model.RegisterOrderStatusHook(model.OrderStatusPaid, "notify_delivered", func(order *model.Order, change model.OrderStatusChange) error {
+		if change.From != model.OrderStatusDelivering {
+			return nil
+		}
+		return notifyOrderDelivered(order, change)
+	})
+	model.RegisterOrderStatusHook(model.OrderStatusPaid, "notify_paid", notifyOrderPaidOffline)
+	model.RegisterOrderStatusHook(model.OrderStatusCancelled, "notify_cancelled", notifyOrderCancelled)
+
+	model.RegisterJobHandler(model.JobWechatShippingUpload, func(payload []byte) error {
+		orderID, err := model.DecodeOrderJobPayload(payload)
+		if err != nil {
+			return err
+		}
+		return UploadWechatShippingInfo(orderID)
+	})
+	model.RegisterJobHandler(model.JobFeishuOrderNew, runFeishuOrderNewJob)
+	model.RegisterJobHandler(model.JobFeishuOrderPaid, runFeishuOrderPaidJob)
+	model.RegisterJobHandler(model.JobFeishuOrderShortage, runFeishuOrderShortageJob)
+}
+
+// uploadShippingOnStatusChange 录入微信小程序发货信息（用于「小程序购物订单」展示及资金结算）
+func uploadShippingOnStatusChange(order *model.Order, change model.OrderStatusChange) error {
+	if err := UploadWechatShippingInfo(order.ID); err != nil {
+		return fmt.Errorf("微信发货信息录入失败 orderID=%d status=%s: %v", order.ID, change.To, err)
+	}
+	return nil
+}
+
+// notifyOrderDelivered 订单送达：发送飞书送达通知
+func notifyOrderDelivered(order *model.Order, change model.OrderStatusChange) error {
+	items, _ := model.GetOrderItemsByOrderID(order.ID)
+	u, _ := model.GetMiniAppUserByID(order.UserID)
+	addr, _ := model.GetAddressByID(order.AddressID)
+	if u == nil || addr == nil {
+		return nil
+	}
+	return notify.NotifyOrderDelivered(order, items, u, addr)
+}
+
+// notifyOrderPaidOffline 线下收款发送飞书收款通知
+// 在线支付订单在支付回调时已发 NotifyOrderPaid，此处不重复发送
+func notifyOrderPaidOffline(order *model.Order, change model.OrderStatusChange) error {
+	if order.PaidAt != nil {
+		return nil
+	}
+	items, _ := model.GetOrderItemsByOrderID(order.ID)
+	u, _ := model.GetMiniAppUserByID(order.UserID)
+	if u == nil {
+		return nil
+	}
+	return notify.NotifyOrderPaid(order, items, u, "")
+}
+
+// notifyOrderCancelled 订单取消：发送飞书取消通知
+func notifyOrderCancelled(order *model.Order, change model.OrderStatusChange) error {
+	u, _ := model.GetMiniAppUserByID(order.UserID)
+	addr, _ := model.GetAddressByID(order.AddressID)
+	if u == nil || addr == nil {
+		return nil
+	}
+	return notify.NotifyOrderCancelled(order, u, addr, change.Reason)
+}
+
+// feishuOrderNewPayload 新订单飞书通知任务参数
+type feishuOrderNewPayload struct {
+	OrderID      int  `json:"order_id"`
+	IsSalesOrder bool `json:"is_sales_order"`
+}
+
+// feishuOrderPaidPayload 在线支付收款飞书通知任务参数
+type feishuOrderPaidPayload struct {
+	OrderID       int    `json:"order_id"`
+	TransactionID string `json:"transaction_id"`
+}
+
+// feishuOrderShortagePayload 取货缺货飞书通知任务参数
+type feishuOrderShortagePayload struct {
+	OrderID int                   `json:"order_id"`
+	Result  *model.ShortageResult `json:"result"`
+}
+
+// enqueueFeishuOrderNew 入队新订单飞书通知
+func enqueueFeishuOrderNew(orderID int, isSalesOrder bool) {
+	key := fmt.Sprintf("%s:%d", model.JobFeishuOrderNew, orderID)
+	payload := feishuOrderNewPayload{OrderID: orderID, IsSalesOrder: isSalesOrder}
+	if err := model.EnqueueJob(model.JobFeishuOrderNew, payload, model.JobOptions{IdempotencyKey: key}); err != nil {
+		log.Printf("[Job] 订单 %d 新订单通知入队失败: %v", orderID, err)
+	}
+}
+
+// enqueueFeishuOrderPaid 入队在线支付收款飞书通知
+func enqueueFeishuOrderPaid(orderID int, transactionID string) {
+	key := fmt.Sprintf("%s:%d", model.JobFeishuOrderPaid, orderID)
+	payload := feishuOrderPaidPayload{OrderID: orderID, TransactionID: transactionID}
+	if err := model.EnqueueJob(model.JobFeishuOrderPaid, payload, model.JobOptions{IdempotencyKey: key}); err != nil {
+		log.Printf("[Job] 订单 %d 收款通知入队失败: %v", orderID, err)
+	}
+}
+
+// enqueueFeishuOrderShortage 入队取货缺货飞书通知（同一订单可能多次上报缺货，不做幂等）
+func enqueueFeishuOrderShortage(orderID int, result *model.ShortageResult) {
+	payload := feishuOrderShortagePayload{OrderID: orderID, Result: result}
+	if err := model.EnqueueJob(model.JobFeishuOrderShortage, payload, model.JobOptions{}); err != nil {
+		log.Printf("[Job] 订单 %d 缺货通知入队失败: %v", orderID, err)
+	}
+}
+
+func runFeishuOrderNewJob(payload []byte) error {
+	var p feishuOrderNewPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("解析任务参数失败: %v", err)
+	}
+	order, err := model.GetOrderByID(p.OrderID)
+	if err != nil || order == nil {
+		return fmt.Errorf("订单 %d 不存在", p.OrderID)
+	}
+	items, _ := model.GetOrderItemsByOrderID(order.ID)
+	u, _ := model.GetMiniAppUserByID(order.UserID)
+	addr, _ := model.GetAddressByID(order.AddressID)
+	if u == nil || addr == nil {
+		return nil
+	}
+	return notify.NotifyOrderNew(order, items, u, addr, p.IsSalesOrder)
+}
+
+func runFeishuOrderPaidJob(payload []byte) error {
+	var p feishuOrderPaidPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("解析任务参数失败: %v", err)
+	}
+	order, err := model.GetOrderByID(p.OrderID)
+	if err != nil || order == nil {
+		return fmt.Errorf("订单 %d 不存在", p.OrderID)
+	}
+	items, _ := model.GetOrderItemsByOrderID(order.ID)
+	u, _ := model.GetMiniAppUserByID(order.UserID)
+	if u == nil {
+		return nil
+	}
+	return notify.NotifyOrderPaid(order, items, u, p.TransactionID)
+}
+
+func runFeishuOrderShortageJob(payload []byte) error {
+	var p feishuOrderShortagePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("解析任务参数失败: %v", err)
+	}
+	if p.Result == nil {
+		return nil
+	}
+	order, err := model.GetOrderByID(p.OrderID)
+	if err != nil || order == nil {
+		return fmt.Errorf("订单 %d 不存在", p.OrderID)
+	}
+	u, _ := model.GetMiniAppUserByID(order.UserID)
+	if u == nil {
+		return nil
+	}
+	return notify.NotifyOrderShortage(order, u, p.Result)
+}
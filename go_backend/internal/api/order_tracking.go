@@ -0,0 +1,239 @@
+package api
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go_backend/internal/model"
+	"go_backend/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// trackingRefreshInterval 订单跟踪推送中重新计算预计送达时间的间隔
+const trackingRefreshInterval = 30 * time.Second
+
+// loadTrackableOrder 获取当前小程序用户可查看的订单，失败时已写入响应
+func loadTrackableOrder(c *gin.Context) (*model.Order, bool) {
+	user, ok := getMiniUserFromContext(c)
+	if !ok {
+		return nil, false
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "订单ID格式错误"})
+		return nil, false
+	}
+	order, err := model.GetOrderByID(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取订单失败: " + err.Error()})
+		return nil, false
+	}
+	if order == nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "message": "订单不存在"})
+		return nil, false
+	}
+	if !miniUserCanViewOrder(user, order) {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "无权访问此订单"})
+		return nil, false
+	}
+	return order, true
+}
+
+// orderTrackingRider 订单配送员及其位置
+func orderTrackingRider(employeeCode string) gin.H {
+	rider := gin.H{"employee_code": employeeCode}
+	if employee, err := model.GetEmployeeByEmployeeCode(employeeCode); err == nil && employee != nil {
+		rider["name"] = employee.Name
+		rider["phone"] = employee.Phone
+	}
+	if loc := locationManager.GetLocationByEmployeeCode(employeeCode); loc != nil {
+		rider["latitude"] = loc.Latitude
+		rider["longitude"] = loc.Longitude
+		rider["updated_at"] = loc.UpdatedAt
+		rider["is_realtime"] = true
+	} else if last, err := model.GetLatestEmployeeLocationByCode(employeeCode); err == nil && last != nil {
+		rider["latitude"] = last.Latitude
+		rider["longitude"] = last.Longitude
+		rider["updated_at"] = last.CreatedAt
+		rider["is_realtime"] = false
+	}
+	return rider
+}
+
+// buildOrderTracking 订单配送跟踪信息
+// 仅在订单配送中时返回配送员位置；前方停靠点数来自当前批次的路线顺序（不返回其他客户的位置），
+// 预计送达时间按配送员当前位置经前方停靠点到收货地址的剩余路线计算，按订单节流
+func buildOrderTracking(order *model.Order) gin.H {
+	data := gin.H{
+		"order_id":           order.ID,
+		"status":             order.Status,
+		"tracking_available": false,
+	}
+	if order.Status != model.OrderStatusDelivering || order.DeliveryEmployeeCode == nil || *order.DeliveryEmployeeCode == "" {
+		data["message"] = "订单配送中时才能查看配送员位置"
+		return data
+	}
+	employeeCode := *order.DeliveryEmployeeCode
+	rider := orderTrackingRider(employeeCode)
+	data["tracking_available"] = true
+	data["rider"] = rider
+
+	// 前方停靠点：当前批次中排在本订单之前且尚未送达的订单
+	stops, err := model.GetActiveRouteStops(employeeCode)
+	if err != nil {
+		log.Printf("[OrderTracking] 获取配送员 %s 路线失败: %v", employeeCode, err)
+		stops = nil
+	}
+	ahead := make([]model.ActiveRouteStop, 0)
+	for i, s := range stops {
+		if s.OrderID == order.ID {
+			ahead = stops[:i]
+			break
+		}
+	}
+	data["stops_before"] = len(ahead)
+
+	riderLat, okLat := rider["latitude"].(float64)
+	riderLng, okLng := rider["longitude"].(float64)
+	address, _ := model.GetAddressByID(order.AddressID)
+	if !okLat || !okLng || address == nil || address.Latitude == nil || address.Longitude == nil {
+		return data
+	}
+
+	eta := orderTrackingETA(order.ID, utils.Coordinate{Lat: riderLat, Lng: riderLng}, ahead,
+		utils.Coordinate{Lat: *address.Latitude, Lng: *address.Longitude})
+	minutes := time.Until(eta.arriveAt).Minutes()
+	if minutes < 0 {
+		minutes = 0
+	}
+	data["remaining_distance_km"] = eta.distanceKm
+	data["eta_minutes"] = int(minutes + 0.5)
+	data["eta"] = eta.arriveAt
+	return data
+}
+
+// trackingETA 一次预计送达时间计算结果
+type trackingETA struct {
+	computedAt  time.Time
+	stopsBefore int
+	distanceKm  float64
+	arriveAt    time.Time
+}
+
+// trackingETACache 按订单缓存预计送达时间：同一订单的多个连接和频繁刷新共用一次计算，
+// 每个订单最多每 trackingRefreshInterval 请求一次距离服务
+var trackingETACache = struct {
+	sync.Mutex
+	entries map[int]trackingETA
+}{entries: make(map[int]trackingETA)}
+
+// orderTrackingETA 获取订单预计送达时间，缓存过期或前方停靠点数变化（已送达一单）时重新计算
+// 只有配送员到第一个停靠点的路段随位置变化，停靠点之间的路段坐标固定，由距离缓存命中
+func orderTrackingETA(orderID int, rider utils.Coordinate, ahead []model.ActiveRouteStop, dest utils.Coordinate) trackingETA {
+	now := time.Now()
+	trackingETACache.Lock()
+	cached, ok := trackingETACache.entries[orderID]
+	trackingETACache.Unlock()
+	if ok && cached.stopsBefore == len(ahead) && now.Sub(cached.computedAt) < trackingRefreshInterval {
+		return cached
+	}
+
+	points := []utils.Coordinate{rider}
+	for _, s := range ahead {
+		points = append(points, utils.Coordinate{Lat: s.Latitude, Lng: s.Longitude})
+	}
+	points = append(points, dest)
+	distance, minutes := 0.0, 0.0
+	for _, leg := range model.RouteLegs(points, 0) {
+		distance += leg.DistanceKm
+		minutes += leg.DurationMinutes
+	}
+	// 前方每个停靠点的停留时间
+	minutes += float64(len(ahead)) * model.GetSystemSettingFloat("dispatch_service_minutes", 5)
+
+	eta := trackingETA{
+		computedAt:  now,
+		stopsBefore: len(ahead),
+		distanceKm:  distance,
+		arriveAt:    now.Add(time.Duration(minutes * float64(time.Minute))),
+	}
+	trackingETACache.Lock()
+	// 顺带清理已结束配送的订单
+	for id, e := range trackingETACache.entries {
+		if now.Sub(e.computedAt) > 10*trackingRefreshInterval {
+			delete(trackingETACache.entries, id)
+		}
+	}
+	trackingETACache.entries[orderID] = eta
+	trackingETACache.Unlock()
+	return eta
+}
+
+// GetUserOrderTracking 获取订单配送跟踪信息（小程序端）
+func GetUserOrderTracking(c *gin.Context) {
+	order, ok := loadTrackableOrder(c)
+	if !ok {
+		return
+	}
+	successResponse(c, buildOrderTracking(order), "")
+}
+
+// StreamUserOrderTracking 订单配送跟踪推送（小程序端，SSE）
+// 配送员上报位置时推送 location 事件，每 30 秒及首次连接时推送完整的 tracking 事件；订单不再配送中时推送最后一次 tracking 后结束
+func StreamUserOrderTracking(c *gin.Context) {
+	order, ok := loadTrackableOrder(c)
+	if !ok {
+		return
+	}
+	if order.Status != model.OrderStatusDelivering || order.DeliveryEmployeeCode == nil || *order.DeliveryEmployeeCode == "" {
+		badRequestResponse(c, "订单配送中时才能查看配送员位置")
+		return
+	}
+	employeeCode := *order.DeliveryEmployeeCode
+
+	locations, unwatch := locationManager.WatchEmployeeLocation(employeeCode)
+	defer unwatch()
+	ticker := time.NewTicker(trackingRefreshInterval)
+	defer ticker.Stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	// sendTracking 推送完整跟踪信息，订单已不在配送中时返回 false
+	sendTracking := func() bool {
+		latest, err := model.GetOrderByID(order.ID)
+		if err != nil || latest == nil {
+			return false
+		}
+		data := buildOrderTracking(latest)
+		c.SSEvent("tracking", data)
+		return data["tracking_available"] == true
+	}
+	if !sendTracking() {
+		return
+	}
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case loc := <-locations:
+			c.SSEvent("location", gin.H{
+				"latitude":   loc.Latitude,
+				"longitude":  loc.Longitude,
+				"updated_at": loc.UpdatedAt,
+			})
+			return true
+		case <-ticker.C:
+			return sendTracking()
+		}
+	})
+}
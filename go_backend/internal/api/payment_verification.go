@@ -1,14 +1,10 @@
 package api
 
 import (
-	"log"
 	"net/http"
 	"strconv"
-	"time"
 
-	"go_backend/internal/database"
 	"go_backend/internal/model"
-	"go_backend/internal/notify"
 
 	"github.com/gin-gonic/gin"
 )
@@ -165,63 +161,8 @@ func ReviewPaymentVerificationRequest(c *gin.Context) {
 
 	message := "已拒绝"
 	if approved {
+		// 销售分成、推荐奖励、积分和飞书收款通知由订单状态钩子处理
 		message = "审核通过，订单已标记为已收款"
-
-		// 获取订单ID，用于计算销售分成
-		verificationReq, err := model.GetPaymentVerificationRequestByID(req.RequestID)
-		if err == nil && verificationReq != nil {
-			orderID := verificationReq.OrderID
-			// 异步处理销售分成计算和推荐奖励（避免阻塞）
-			go func(orderID int) {
-				// 等待一下，确保订单状态和结算日期已更新
-				time.Sleep(100 * time.Millisecond)
-
-				// 重新获取订单信息，检查是否有结算日期
-				order, err := model.GetOrderByID(orderID)
-				if err != nil {
-					log.Printf("获取订单 %d 信息失败: %v", orderID, err)
-					return
-				}
-				if order == nil {
-					log.Printf("订单 %d 不存在", orderID)
-					return
-				}
-
-				// 如果订单有结算日期，计算销售分成
-				// 如果没有结算日期，设置结算日期为当前时间
-				if order.SettlementDate == nil {
-					now := time.Now()
-					_, err = database.DB.Exec("UPDATE orders SET settlement_date = ? WHERE id = ?", now, orderID)
-					if err != nil {
-						log.Printf("设置订单 %d 结算日期失败: %v", orderID, err)
-						return
-					}
-					// 更新订单对象的结算日期
-					order.SettlementDate = &now
-				}
-
-				// 计算销售分成
-				if err := model.ProcessOrderSettlement(orderID); err != nil {
-					log.Printf("处理订单 %d 的销售分成失败: %v", orderID, err)
-				} else {
-					log.Printf("订单 %d 的销售分成计算成功", orderID)
-				}
-
-				// 处理推荐奖励（订单完成付款后发放奖励给老用户）
-				if err := model.ProcessReferralReward(orderID); err != nil {
-					log.Printf("处理订单 %d 的推荐奖励失败: %v", orderID, err)
-				} else {
-					log.Printf("订单 %d 的推荐奖励处理完成", orderID)
-				}
-
-				// 飞书订单收款通知（货到付款审核通过）
-				items, _ := model.GetOrderItemsByOrderID(orderID)
-				u, _ := model.GetMiniAppUserByID(order.UserID)
-				if u != nil {
-					notify.NotifyOrderPaid(order, items, u, "")
-				}
-			}(orderID)
-		}
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -3,6 +3,7 @@ package api
 import (
 	"net/http"
 	"strconv"
+	"strings"
 
 	"go_backend/internal/model"
 
@@ -46,6 +47,12 @@ func GetPointsLogs(c *gin.Context) {
 		return
 	}
 
+	// 最近一批即将过期的积分，查询失败不影响明细
+	expiring, err := model.GetUserExpiringPoints(userID)
+	if err != nil {
+		expiring = nil
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
 		"message": "获取成功",
@@ -54,7 +61,69 @@ func GetPointsLogs(c *gin.Context) {
 			"total":     total,
 			"page_num":  pageNum,
 			"page_size": pageSize,
+			"expiring":  expiring, // 最近一批即将过期的积分
 		},
 	})
 }
 
+// GetPointsLedgerCheck 积分一致性检查：按积分明细和积分批次重算余额，列出不一致的用户（管理后台）
+func GetPointsLedgerCheck(c *gin.Context) {
+	pageNum := parseQueryInt(c, "pageNum", 1)
+	pageSize := parseQueryInt(c, "pageSize", 20)
+	list, total, err := model.GetPointsLedgerDiscrepancies(pageNum, pageSize)
+	if err != nil {
+		internalErrorResponse(c, "积分一致性检查失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"list":  list,
+		"total": total,
+	}, "")
+}
+
+// RunPointsExpiry 立即作废已到期的积分（管理后台，每日任务会自动执行）
+func RunPointsExpiry(c *gin.Context) {
+	n, err := model.ExpirePoints()
+	if err != nil {
+		internalErrorResponse(c, "处理到期积分失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{"users": n}, "处理完成")
+}
+
+// GetPointsShortfalls 积分抵扣差额列表（管理后台）：已付款订单抵扣积分超过用户余额、少扣的积分
+func GetPointsShortfalls(c *gin.Context) {
+	pageNum := parseQueryInt(c, "pageNum", 1)
+	pageSize := parseQueryInt(c, "pageSize", 20)
+	status := strings.TrimSpace(c.Query("status"))
+
+	list, total, err := model.GetPointsShortfalls(status, pageNum, pageSize)
+	if err != nil {
+		internalErrorResponse(c, "获取积分抵扣差额失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"list":  list,
+		"total": total,
+	}, "")
+}
+
+// ResolvePointsShortfall 标记积分抵扣差额已处理（已追扣、补差或确认豁免，管理后台）
+func ResolvePointsShortfall(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Remark string `json:"remark" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "请填写处理说明")
+		return
+	}
+	if err := model.ResolvePointsShortfall(id, getAdminOperatorName(c), req.Remark); err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	successResponse(c, nil, "已标记为已处理")
+}
@@ -4,36 +4,23 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
-	"sync"
 	"time"
 
 	"go_backend/internal/model"
 )
 
-// prepayCacheEntry 预支付缓存条目（带过期时间）
-type prepayCacheEntry struct {
-	Data      *model.CachedPrepayEntry
-	CreatedAt time.Time
-}
-
-var (
-	prepayCache     = make(map[string]*prepayCacheEntry)
-	prepayCacheLock sync.RWMutex
-	prepayCacheTTL  = 30 * time.Minute
-)
+// prepayCacheTTL 预支付缓存有效期；过期的快照仍保留一段时间，期间到达的支付回调照常建单
+var prepayCacheTTL = 30 * time.Minute
 
 func init() {
 	go func() {
 		ticker := time.NewTicker(5 * time.Minute)
 		for range ticker.C {
-			prepayCacheLock.Lock()
-			now := time.Now()
-			for k, v := range prepayCache {
-				if v != nil && now.Sub(v.CreatedAt) > prepayCacheTTL {
-					delete(prepayCache, k)
-				}
+			if n, err := model.GetPrepayStore().SweepExpired(); err != nil {
+				log.Printf("[PrepayCache] 清理过期缓存失败: %v", err)
+			} else if n > 0 {
+				log.Printf("[PrepayCache] 已清理 %d 条过期缓存", n)
 			}
-			prepayCacheLock.Unlock()
 		}
 	}()
 }
@@ -48,26 +35,10 @@ func GenerateOutTradeNo() string {
 }
 
 // SetPrepayCache 写入预支付缓存
-func SetPrepayCache(outTradeNo string, data *model.CachedPrepayEntry) {
-	prepayCacheLock.Lock()
-	defer prepayCacheLock.Unlock()
-	prepayCache[outTradeNo] = &prepayCacheEntry{Data: data, CreatedAt: time.Now()}
-}
-
-// GetPrepayCache 读取并删除预支付缓存（支付成功后一次性消费）
-func GetPrepayCache(outTradeNo string) (*model.CachedPrepayEntry, error) {
-	prepayCacheLock.Lock()
-	defer prepayCacheLock.Unlock()
-	entry, ok := prepayCache[outTradeNo]
-	if !ok || entry == nil {
-		return nil, fmt.Errorf("预支付缓存不存在或已过期")
-	}
-	if time.Since(entry.CreatedAt) > prepayCacheTTL {
-		delete(prepayCache, outTradeNo)
-		return nil, fmt.Errorf("预支付缓存已过期")
-	}
-	delete(prepayCache, outTradeNo)
-	return entry.Data, nil
+func SetPrepayCache(outTradeNo string, data *model.CachedPrepayEntry) error {
+	err := model.GetPrepayStore().Save(outTradeNo, data, prepayCacheTTL)
+	logPrepayCache("写入缓存失败", outTradeNo, err)
+	return err
 }
 
 func logPrepayCache(prefix string, outTradeNo string, err error) {
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"log"
+	"strings"
+
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetPrepayNotifyExceptions 支付回调异常列表（管理后台）：支付成功但预支付缓存缺失或建单失败的记录
+func GetPrepayNotifyExceptions(c *gin.Context) {
+	pageNum := parseQueryInt(c, "pageNum", 1)
+	pageSize := parseQueryInt(c, "pageSize", 20)
+	status := strings.TrimSpace(c.Query("status"))
+
+	list, total, err := model.GetPrepayNotifyExceptions(status, pageNum, pageSize)
+	if err != nil {
+		internalErrorResponse(c, "获取支付回调异常失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"list":  list,
+		"total": total,
+	}, "")
+}
+
+// ConvertPrepayNotifyException 使用保留的下单快照补建订单（管理后台）
+func ConvertPrepayNotifyException(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Remark string `json:"remark"`
+	}
+	_ = c.ShouldBindJSON(&req)
+
+	e, err := model.GetPrepayNotifyExceptionByID(id)
+	if err != nil {
+		internalErrorResponse(c, "获取异常记录失败: "+err.Error())
+		return
+	}
+	if e == nil {
+		notFoundResponse(c, "异常记录不存在")
+		return
+	}
+	entry, _ := model.GetPrepayStore().Peek(e.OutTradeNo)
+
+	order, err := model.ConvertPrepayNotifyException(id, getAdminOperatorName(c), req.Remark)
+	if err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	if entry != nil {
+		ClearPurchaseListByItemIDs(entry.UserID, entry.ItemIDs)
+	}
+	enqueueFeishuOrderPaid(order.ID, e.TransactionID)
+	successResponse(c, order, "补单成功")
+}
+
+// RefundPrepayNotifyException 对无法补单的支付发起全额退款（管理后台）
+func RefundPrepayNotifyException(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+		Remark string `json:"remark"`
+	}
+	_ = c.ShouldBindJSON(&req)
+
+	e, err := model.GetPrepayNotifyExceptionByID(id)
+	if err != nil {
+		internalErrorResponse(c, "获取异常记录失败: "+err.Error())
+		return
+	}
+	if e == nil {
+		notFoundResponse(c, "异常记录不存在")
+		return
+	}
+	if e.Status != model.PrepayExceptionPending {
+		badRequestResponse(c, "该记录已处理")
+		return
+	}
+	if e.Amount <= 0 {
+		badRequestResponse(c, "支付金额异常，无法退款")
+		return
+	}
+	if existing, _ := model.GetOrderByOrderNumber(e.OutTradeNo); existing != nil {
+		badRequestResponse(c, "该支付已生成订单，请在订单中处理退款")
+		return
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = "订单创建失败，全额退款"
+	}
+	// 尚未生成订单，按支付单号和金额构造退款参数
+	refundID, err := RequestWechatRefundWithOptions(&model.Order{OrderNumber: e.OutTradeNo, TotalAmount: e.Amount}, RefundOptions{Reason: reason})
+	if err != nil {
+		internalErrorResponse(c, "发起退款失败: "+err.Error())
+		return
+	}
+	if err := model.MarkPrepayNotifyExceptionRefunded(id, refundID, getAdminOperatorName(c), req.Remark); err != nil {
+		log.Printf("[PrepayException] 退款已发起但更新记录失败 id=%d refund_id=%s: %v", id, refundID, err)
+		internalErrorResponse(c, "退款已发起，但更新记录失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{"refund_id": refundID}, "退款已发起")
+}
+
+// IgnorePrepayNotifyException 标记支付回调异常已忽略（如已线下处理，管理后台）
+func IgnorePrepayNotifyException(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Remark string `json:"remark" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "请填写处理说明")
+		return
+	}
+	if err := model.IgnorePrepayNotifyException(id, getAdminOperatorName(c), req.Remark); err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	successResponse(c, nil, "已标记为忽略")
+}
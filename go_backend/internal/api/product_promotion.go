@@ -0,0 +1,232 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// productPromotionRequest 创建/更新限时促销请求
+type productPromotionRequest struct {
+	Name          string  `json:"name" binding:"required"`
+	ProductID     int     `json:"product_id" binding:"required"`
+	SpecName      string  `json:"spec_name" binding:"required"`
+	UserType      string  `json:"user_type"` // all / wholesale / retail，默认 all
+	PromoPrice    float64 `json:"promo_price" binding:"required"`
+	StartAt       string  `json:"start_at" binding:"required"`
+	EndAt         string  `json:"end_at" binding:"required"`
+	PerUserLimit  int     `json:"per_user_limit" binding:"min=0"`
+	TotalQuantity int     `json:"total_quantity" binding:"min=0"`
+	Status        *int    `json:"status"`
+}
+
+// bindProductPromotion 校验请求并转换为促销，失败时已写入响应
+func bindProductPromotion(c *gin.Context) (*model.ProductPromotion, bool) {
+	var req productPromotionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "请求参数错误: "+err.Error())
+		return nil, false
+	}
+
+	userType := strings.TrimSpace(req.UserType)
+	if userType == "" {
+		userType = model.PromotionUserTypeAll
+	}
+	switch userType {
+	case model.PromotionUserTypeAll, model.PromotionUserTypeWholesale, model.PromotionUserTypeRetail:
+	default:
+		badRequestResponse(c, "适用客户类型无效")
+		return nil, false
+	}
+	if req.PromoPrice <= 0 {
+		badRequestResponse(c, "促销价必须大于0")
+		return nil, false
+	}
+	startAt, ok := parseCouponTime(req.StartAt)
+	if !ok {
+		badRequestResponse(c, "开始时间格式错误")
+		return nil, false
+	}
+	endAt, ok := parseCouponTime(req.EndAt)
+	if !ok {
+		badRequestResponse(c, "结束时间格式错误")
+		return nil, false
+	}
+	if !endAt.After(startAt) {
+		badRequestResponse(c, "结束时间必须晚于开始时间")
+		return nil, false
+	}
+	status := 1
+	if req.Status != nil {
+		if *req.Status != 0 && *req.Status != 1 {
+			badRequestResponse(c, "状态只能为 0 或 1")
+			return nil, false
+		}
+		status = *req.Status
+	}
+
+	product, err := model.GetProductByID(req.ProductID)
+	if err != nil {
+		internalErrorResponse(c, "获取商品信息失败: "+err.Error())
+		return nil, false
+	}
+	if product == nil {
+		badRequestResponse(c, "商品不存在")
+		return nil, false
+	}
+	specName := strings.TrimSpace(req.SpecName)
+	specFound := false
+	for _, spec := range product.Specs {
+		if spec.Name == specName {
+			specFound = true
+			break
+		}
+	}
+	if !specFound {
+		badRequestResponse(c, "商品规格不存在")
+		return nil, false
+	}
+
+	return &model.ProductPromotion{
+		Name:          strings.TrimSpace(req.Name),
+		ProductID:     product.ID,
+		ProductName:   product.Name,
+		SpecName:      specName,
+		UserType:      userType,
+		PromoPrice:    req.PromoPrice,
+		StartAt:       startAt,
+		EndAt:         endAt,
+		PerUserLimit:  req.PerUserLimit,
+		TotalQuantity: req.TotalQuantity,
+		Status:        status,
+	}, true
+}
+
+// isProductPromotionUserError 促销校验类错误，返回 400
+func isProductPromotionUserError(err error) bool {
+	return errors.Is(err, model.ErrPromotionOverlap) ||
+		errors.Is(err, model.ErrPromotionHasSales) ||
+		errors.Is(err, model.ErrPromotionQuantityTooLow)
+}
+
+// GetProductPromotions 限时促销列表（管理后台），参数：productId，state（active/upcoming/ended/disabled），keyword，pageNum，pageSize
+func GetProductPromotions(c *gin.Context) {
+	pageNum := parseQueryInt(c, "pageNum", 1)
+	pageSize := parseQueryInt(c, "pageSize", 20)
+	if pageSize > 100 {
+		pageSize = 20
+	}
+	filter := model.PromotionFilter{
+		ProductID: parseQueryInt(c, "productId", 0),
+		State:     strings.TrimSpace(c.Query("state")),
+		Keyword:   strings.TrimSpace(c.Query("keyword")),
+	}
+	list, total, err := model.GetProductPromotions(filter, pageNum, pageSize)
+	if err != nil {
+		internalErrorResponse(c, "获取促销列表失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"list":     list,
+		"total":    total,
+		"pageNum":  pageNum,
+		"pageSize": pageSize,
+	}, "")
+}
+
+// CreateProductPromotion 创建限时促销（管理后台）
+func CreateProductPromotion(c *gin.Context) {
+	promotion, ok := bindProductPromotion(c)
+	if !ok {
+		return
+	}
+	promotion.CreatedBy = getAdminOperatorName(c)
+	if err := model.CreateProductPromotion(promotion); err != nil {
+		if isProductPromotionUserError(err) {
+			badRequestResponse(c, err.Error())
+			return
+		}
+		internalErrorResponse(c, "创建促销失败: "+err.Error())
+		return
+	}
+	successResponse(c, promotion, "创建成功")
+}
+
+// UpdateProductPromotion 更新限时促销（管理后台）
+func UpdateProductPromotion(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	promotion, ok := bindProductPromotion(c)
+	if !ok {
+		return
+	}
+	promotion.ID = id
+	if err := model.UpdateProductPromotion(promotion); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			notFoundResponse(c, "促销不存在")
+			return
+		}
+		if isProductPromotionUserError(err) {
+			badRequestResponse(c, err.Error())
+			return
+		}
+		internalErrorResponse(c, "更新促销失败: "+err.Error())
+		return
+	}
+	successResponse(c, promotion, "更新成功")
+}
+
+// UpdateProductPromotionStatus 启用或停用限时促销（管理后台）
+func UpdateProductPromotionStatus(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Status *int `json:"status" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "请求参数错误: "+err.Error())
+		return
+	}
+	if *req.Status != 0 && *req.Status != 1 {
+		badRequestResponse(c, "状态只能为 0 或 1")
+		return
+	}
+	if err := model.SetProductPromotionStatus(id, *req.Status); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			notFoundResponse(c, "促销不存在")
+			return
+		}
+		if isProductPromotionUserError(err) {
+			badRequestResponse(c, err.Error())
+			return
+		}
+		internalErrorResponse(c, "更新促销状态失败: "+err.Error())
+		return
+	}
+	successResponse(c, nil, "更新成功")
+}
+
+// DeleteProductPromotion 删除限时促销（管理后台，已有订单占用的只能停用）
+func DeleteProductPromotion(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	if err := model.DeleteProductPromotion(id); err != nil {
+		if isProductPromotionUserError(err) {
+			badRequestResponse(c, err.Error())
+			return
+		}
+		internalErrorResponse(c, "删除促销失败: "+err.Error())
+		return
+	}
+	successResponse(c, nil, "删除成功")
+}
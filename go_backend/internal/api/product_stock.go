@@ -0,0 +1,218 @@
+package api
+
+import (
+	"log"
+	"strings"
+
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// specStockView 规格库存展示（包含未开启库存跟踪的规格）
+type specStockView struct {
+	SpecName          string `json:"spec_name"`
+	Tracked           bool   `json:"tracked"` // 是否开启库存跟踪，未开启视为不限库存
+	Quantity          int    `json:"quantity"`
+	ReservedQuantity  int    `json:"reserved_quantity"`
+	AvailableQuantity int    `json:"available_quantity"`
+}
+
+// buildSpecStockViews 按商品规格顺序组装库存信息
+func buildSpecStockViews(product *model.Product) ([]specStockView, error) {
+	stockMap, err := model.GetProductStockMap(product.ID)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]specStockView, 0, len(product.Specs))
+	for _, spec := range product.Specs {
+		view := specStockView{SpecName: spec.Name}
+		if stock, ok := stockMap[spec.Name]; ok {
+			view.Tracked = true
+			view.Quantity = stock.Quantity
+			view.ReservedQuantity = stock.ReservedQuantity
+			view.AvailableQuantity = stock.AvailableQuantity
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// GetProductStocksForAdmin 获取商品各规格库存（管理后台）
+func GetProductStocksForAdmin(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+
+	product, err := model.GetProductByID(id)
+	if err != nil {
+		internalErrorResponse(c, "获取商品失败: "+err.Error())
+		return
+	}
+	if product == nil {
+		notFoundResponse(c, "商品不存在")
+		return
+	}
+
+	views, err := buildSpecStockViews(product)
+	if err != nil {
+		log.Printf("获取商品库存失败: %v", err)
+		internalErrorResponse(c, "获取商品库存失败: "+err.Error())
+		return
+	}
+	successResponse(c, views, "")
+}
+
+// UpdateProductStock 设置商品规格库存（管理后台），首次设置即开启该规格的库存跟踪
+func UpdateProductStock(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+
+	var req struct {
+		SpecName string `json:"spec_name" binding:"required"`
+		Quantity int    `json:"quantity"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "参数错误")
+		return
+	}
+	req.SpecName = strings.TrimSpace(req.SpecName)
+	if req.Quantity < 0 {
+		badRequestResponse(c, "库存数量不能为负数")
+		return
+	}
+
+	operator, _ := c.Get("username")
+	operatorName, _ := operator.(string)
+	if err := model.SetProductSpecStock(id, req.SpecName, req.Quantity, operatorName); err != nil {
+		badRequestResponse(c, "设置库存失败: "+err.Error())
+		return
+	}
+
+	stock, err := model.GetProductStock(id, req.SpecName)
+	if err != nil {
+		internalErrorResponse(c, "获取库存失败: "+err.Error())
+		return
+	}
+	successResponse(c, stock, "设置成功")
+}
+
+// DeleteProductStock 关闭商品规格库存跟踪（管理后台），该规格恢复为不限库存
+func DeleteProductStock(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+
+	specName := strings.TrimSpace(c.Query("spec_name"))
+	if specName == "" {
+		badRequestResponse(c, "请提供规格名称")
+		return
+	}
+
+	stock, err := model.GetProductStock(id, specName)
+	if err != nil {
+		internalErrorResponse(c, "获取库存失败: "+err.Error())
+		return
+	}
+	if stock == nil {
+		notFoundResponse(c, "该规格未开启库存跟踪")
+		return
+	}
+	if stock.ReservedQuantity > 0 {
+		badRequestResponse(c, "该规格仍有未取货订单占用库存，暂不能关闭库存跟踪")
+		return
+	}
+
+	operator, _ := c.Get("username")
+	operatorName, _ := operator.(string)
+	if err := model.DeleteProductSpecStock(id, specName, operatorName); err != nil {
+		internalErrorResponse(c, "关闭库存跟踪失败: "+err.Error())
+		return
+	}
+	successResponse(c, nil, "已关闭库存跟踪")
+}
+
+// GetStockMovements 获取库存变动流水（管理后台）
+func GetStockMovements(c *gin.Context) {
+	pageNum := parseQueryInt(c, "pageNum", 1)
+	pageSize := parseQueryInt(c, "pageSize", 20)
+	filter := model.StockMovementFilter{
+		ProductID: parseQueryInt(c, "product_id", 0),
+		SpecName:  strings.TrimSpace(c.Query("spec_name")),
+		Type:      strings.TrimSpace(c.Query("type")),
+		OrderID:   parseQueryInt(c, "order_id", 0),
+		BatchNo:   strings.TrimSpace(c.Query("batch_no")),
+		StartDate: strings.TrimSpace(c.Query("start_date")),
+		EndDate:   strings.TrimSpace(c.Query("end_date")),
+	}
+
+	list, total, err := model.GetStockMovements(filter, pageNum, pageSize)
+	if err != nil {
+		internalErrorResponse(c, "获取库存流水失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"list":  list,
+		"total": total,
+	}, "")
+}
+
+// AdjustProductStock 手动调整库存（管理后台），正数入库、负数出库，须填写原因
+func AdjustProductStock(c *gin.Context) {
+	var req struct {
+		ProductID      int    `json:"product_id" binding:"required"`
+		SpecName       string `json:"spec_name" binding:"required"`
+		ChangeQuantity int    `json:"change_quantity" binding:"required"`
+		Reason         string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "参数错误")
+		return
+	}
+	req.SpecName = strings.TrimSpace(req.SpecName)
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		badRequestResponse(c, "请填写调整原因")
+		return
+	}
+
+	operator, _ := c.Get("username")
+	operatorName, _ := operator.(string)
+	stock, err := model.AdjustProductStock(req.ProductID, req.SpecName, req.ChangeQuantity, req.Reason, operatorName)
+	if err != nil {
+		badRequestResponse(c, "调整库存失败: "+err.Error())
+		return
+	}
+	successResponse(c, stock, "调整成功")
+}
+
+// SubmitStocktake 提交盘点结果（管理后台），按实盘数量重置库存并返回差异
+func SubmitStocktake(c *gin.Context) {
+	var req struct {
+		Items  []model.StocktakeItem `json:"items" binding:"required"`
+		Reason string                `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "参数错误")
+		return
+	}
+	for i := range req.Items {
+		req.Items[i].SpecName = strings.TrimSpace(req.Items[i].SpecName)
+	}
+
+	operator, _ := c.Get("username")
+	operatorName, _ := operator.(string)
+	batchNo, results, err := model.SubmitStocktake(req.Items, req.Reason, operatorName)
+	if err != nil {
+		badRequestResponse(c, "提交盘点失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"batch_no": batchNo,
+		"items":    results,
+	}, "盘点完成")
+}
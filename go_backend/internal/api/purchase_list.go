@@ -1,6 +1,7 @@
 package api
 
 import (
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -106,6 +107,7 @@ func AddPurchaseListItem(c *gin.Context) {
 		WholesalePrice: matchedSpec.WholesalePrice,
 		RetailPrice:    matchedSpec.RetailPrice,
 		DeliveryCount:  matchedSpec.DeliveryCount, // 配送计件数
+		PriceTiers:     matchedSpec.PriceTiers,    // 批发阶梯价
 	}
 
 	// 记录下单时的单位类别和单位ID快照，便于后续统计
@@ -170,6 +172,8 @@ func GetPurchaseListSummary(c *gin.Context) {
 	itemIDsFilter := make(map[int]struct{})
 	deliveryCouponID, explicitNoDelivery := parseQueryIntWithExplicitZero(c, "delivery_coupon_id")
 	amountCouponID, explicitNoAmount := parseQueryIntWithExplicitZero(c, "amount_coupon_id")
+	couponIDs := parseQueryIntList(c, "coupon_ids")
+	usePoints := parseQueryInt(c, "use_points", 0)
 	if itemIDsParam != "" {
 		for _, idStr := range strings.Split(itemIDsParam, ",") {
 			idStr = strings.TrimSpace(idStr)
@@ -216,66 +220,31 @@ func GetPurchaseListSummary(c *gin.Context) {
 		userType = "retail"
 	}
 
-	summary, err := model.CalculateDeliveryFee(items, userType)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "计算配送费失败: " + err.Error()})
-		return
-	}
-
-	// 计算订单金额和获取商品分类ID
-	orderAmount := 0.0
-	categoryIDSet := make(map[int]struct{})
-	productIDs := make([]int, 0)
-
-	for _, item := range items {
-		// 根据用户类型计算商品金额
-		var price float64
-		if userType == "wholesale" {
-			price = item.SpecSnapshot.WholesalePrice
-		if price <= 0 {
-				price = item.SpecSnapshot.RetailPrice
-			}
-		} else {
-			price = item.SpecSnapshot.RetailPrice
-			if price <= 0 {
-				price = item.SpecSnapshot.WholesalePrice
-			}
-		}
-		if price <= 0 {
-			price = item.SpecSnapshot.Cost
-		}
-		if price < 0 {
-			price = 0
+	// 传入收货地址时按地址所在配送区域计算配送费
+	var address *model.Address
+	if addressID := parseQueryInt(c, "address_id", 0); addressID > 0 {
+		if addr, err := model.GetAddressByID(addressID); err == nil && addr != nil && addr.UserID == user.ID {
+			address = addr
 		}
-		orderAmount += price * float64(item.Quantity)
-
-		// 收集商品ID用于查询分类
-		productIDs = append(productIDs, item.ProductID)
 	}
 
-	// 获取商品分类信息
-	categoryInfo, err := model.FetchProductCategoryInfo(productIDs)
-	if err == nil {
-		for _, info := range categoryInfo {
-			if info.CategoryID > 0 {
-				categoryIDSet[info.CategoryID] = struct{}{}
-			}
-			if info.ParentID > 0 {
-				categoryIDSet[info.ParentID] = struct{}{}
-			}
-		}
+	summary, err := model.CalculateDeliveryFeeForAddress(items, userType, address)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "计算配送费失败: " + err.Error()})
+		return
 	}
 
-	categoryIDs := make([]int, 0, len(categoryIDSet))
-	for id := range categoryIDSet {
-		categoryIDs = append(categoryIDs, id)
+	// 按商品明细计算优惠券适用范围和优惠金额
+	couponItems, err := model.BuildCouponOrderItems(items, userType, nil)
+	if err != nil {
+		log.Printf("[GetPurchaseListSummary] 生成优惠券计算明细失败: %v", err)
+		couponItems = []model.CouponOrderItem{}
 	}
 
 	// 获取可用优惠券和最佳组合
 	availableCoupons, err := model.GetAvailableCouponsForPurchaseList(
 		user.ID,
-		orderAmount,
-		categoryIDs,
+		couponItems,
 		summary.DeliveryFee,
 		summary.IsFreeShipping,
 	)
@@ -286,21 +255,33 @@ func GetPurchaseListSummary(c *gin.Context) {
 
 	bestCombination := model.CalculateBestCouponCombination(
 		availableCoupons,
-		orderAmount,
+		couponItems,
 		summary.DeliveryFee,
 		summary.IsFreeShipping,
 	)
 
-	appliedCombination := model.CalculateCouponCombinationWithExplicitSelection(
-		availableCoupons,
-		orderAmount,
-		summary.DeliveryFee,
-		summary.IsFreeShipping,
-		deliveryCouponID,
-		amountCouponID,
-		explicitNoDelivery,
-		explicitNoAmount,
-	)
+	// coupon_ids 指定使用的全部优惠券（可叠加多张），否则按免配送费券/商品券分别指定
+	var appliedCombination model.BestCouponCombination
+	if len(couponIDs) > 0 {
+		appliedCombination = model.CalculateCouponCombinationForUserCoupons(
+			availableCoupons,
+			couponItems,
+			summary.DeliveryFee,
+			summary.IsFreeShipping,
+			couponIDs,
+		)
+	} else {
+		appliedCombination = model.CalculateCouponCombinationWithExplicitSelection(
+			availableCoupons,
+			couponItems,
+			summary.DeliveryFee,
+			summary.IsFreeShipping,
+			deliveryCouponID,
+			amountCouponID,
+			explicitNoDelivery,
+			explicitNoAmount,
+		)
+	}
 
 	// 获取加急费用（从系统设置）
 	urgentFeeStr, _ := model.GetSystemSetting("order_urgent_fee")
@@ -311,13 +292,20 @@ func GetPurchaseListSummary(c *gin.Context) {
 		}
 	}
 
+	// 积分抵扣信息（use_points 超过本单上限时按上限展示）
+	pointsRedemption, err := model.QuotePointsRedemption(user.ID, summary.TotalAmount, appliedCombination.TotalDiscount, usePoints)
+	if err != nil {
+		log.Printf("[GetPurchaseListSummary] 计算积分抵扣失败: %v", err)
+	}
+
 	result := gin.H{
 		"items":               items,
 		"summary":             summary,
 		"available_coupons":   availableCoupons,
 		"best_combination":    bestCombination,
 		"applied_combination": appliedCombination,
-		"urgent_fee":          urgentFee, // 返回加急费用供前端显示
+		"urgent_fee":          urgentFee,        // 返回加急费用供前端显示
+		"points_redemption":   pointsRedemption, // 积分抵扣规则及本单可用积分
 	}
 
 	c.JSON(http.StatusOK, gin.H{"code": 200, "data": result, "message": "获取成功"})
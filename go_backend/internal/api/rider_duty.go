@@ -0,0 +1,375 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// riderShiftMaxDays 单次排班或考勤查询最长天数
+const riderShiftMaxDays = 62
+
+// respondRiderDutyChange 返回在岗状态变更结果，成功时同步到位置管理器并广播给管理后台
+func respondRiderDutyChange(c *gin.Context, employeeCode string, change *model.RiderDutyChange, err error, message string) {
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrRiderAlreadyOnDuty), errors.Is(err, model.ErrRiderNotOnDuty),
+			errors.Is(err, model.ErrRiderNotWorking), errors.Is(err, model.ErrRiderNotOnBreak),
+			errors.Is(err, model.ErrRiderHasActiveOrders):
+			badRequestResponse(c, err.Error())
+		default:
+			internalErrorResponse(c, "更新在岗状态失败: "+err.Error())
+		}
+		return
+	}
+	locationManager.SetDutyStatus(employeeCode, change.Status)
+	successResponse(c, change, message)
+}
+
+// GetMyDutyStatus 获取当前配送员在岗状态、当天考勤和排班（配送员端）
+func GetMyDutyStatus(c *gin.Context) {
+	employee, ok := requireDeliveryEmployee(c)
+	if !ok {
+		return
+	}
+	status, err := model.GetRiderDutyStatus(employee.EmployeeCode)
+	if err != nil {
+		internalErrorResponse(c, "获取在岗状态失败: "+err.Error())
+		return
+	}
+
+	var attendance *model.RiderAttendance
+	if status.AttendanceID != nil {
+		if attendance, err = model.GetRiderAttendanceByID(*status.AttendanceID); err != nil {
+			internalErrorResponse(c, "获取考勤记录失败: "+err.Error())
+			return
+		}
+	}
+	today := time.Now()
+	day := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.Local)
+	shifts, err := model.GetRiderShifts(day, day.AddDate(0, 0, 1), employee.EmployeeCode)
+	if err != nil {
+		internalErrorResponse(c, "获取排班失败: "+err.Error())
+		return
+	}
+	var shift *model.RiderShift
+	if len(shifts) > 0 {
+		shift = &shifts[0]
+	}
+
+	successResponse(c, gin.H{
+		"status":        status.Status,
+		"changed_at":    status.ChangedAt,
+		"duty_required": model.RiderDutyRequired(),
+		"attendance":    attendance,
+		"today_shift":   shift,
+	}, "")
+}
+
+// ClockInRider 上班打卡（配送员端）
+func ClockInRider(c *gin.Context) {
+	employee, ok := requireDeliveryEmployee(c)
+	if !ok {
+		return
+	}
+	change, err := model.ClockInRider(employee.EmployeeCode)
+	respondRiderDutyChange(c, employee.EmployeeCode, change, err, "上班打卡成功")
+}
+
+// ClockOutRider 下班打卡，有未完成的配送订单时不允许下班（配送员端）
+func ClockOutRider(c *gin.Context) {
+	employee, ok := requireDeliveryEmployee(c)
+	if !ok {
+		return
+	}
+	change, err := model.ClockOutRider(employee.EmployeeCode, false)
+	respondRiderDutyChange(c, employee.EmployeeCode, change, err, "下班打卡成功")
+}
+
+// StartRiderBreak 开始休息，休息期间不接新单（配送员端）
+func StartRiderBreak(c *gin.Context) {
+	employee, ok := requireDeliveryEmployee(c)
+	if !ok {
+		return
+	}
+	change, err := model.StartRiderBreak(employee.EmployeeCode)
+	respondRiderDutyChange(c, employee.EmployeeCode, change, err, "已开始休息")
+}
+
+// EndRiderBreak 结束休息（配送员端）
+func EndRiderBreak(c *gin.Context) {
+	employee, ok := requireDeliveryEmployee(c)
+	if !ok {
+		return
+	}
+	change, err := model.EndRiderBreak(employee.EmployeeCode)
+	respondRiderDutyChange(c, employee.EmployeeCode, change, err, "已结束休息")
+}
+
+// GetRiderDutyStatuses 获取所有配送员的在岗状态和在线情况（管理后台）
+func GetRiderDutyStatuses(c *gin.Context) {
+	statuses, err := model.GetAllRiderDutyStatuses()
+	if err != nil {
+		internalErrorResponse(c, "获取在岗状态失败: "+err.Error())
+		return
+	}
+	list := make([]gin.H, 0, len(statuses))
+	for _, s := range statuses {
+		list = append(list, gin.H{
+			"employee_code": s.EmployeeCode,
+			"employee_name": s.EmployeeName,
+			"status":        s.Status,
+			"changed_at":    s.ChangedAt,
+			"online":        locationManager.GetLocationByEmployeeCode(s.EmployeeCode) != nil,
+		})
+	}
+	successResponse(c, list, "")
+}
+
+// ForceClockOutRider 强制配送员下班（管理后台，不检查未完成订单）
+func ForceClockOutRider(c *gin.Context) {
+	employeeCode := strings.TrimSpace(c.Param("code"))
+	if employeeCode == "" {
+		badRequestResponse(c, "员工码不能为空")
+		return
+	}
+	change, err := model.ClockOutRider(employeeCode, true)
+	respondRiderDutyChange(c, employeeCode, change, err, "已强制下班")
+}
+
+// parseRiderDateRange 解析 start_date、end_date（含当天），默认本周一起 7 天
+func parseRiderDateRange(c *gin.Context) (time.Time, time.Time, bool) {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	start := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	end := start.AddDate(0, 0, 6)
+	if v := c.Query("start_date"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			badRequestResponse(c, "开始日期格式错误，应为 YYYY-MM-DD")
+			return start, end, false
+		}
+		start = t
+	}
+	if v := c.Query("end_date"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			badRequestResponse(c, "结束日期格式错误，应为 YYYY-MM-DD")
+			return start, end, false
+		}
+		end = t
+	}
+	if end.Before(start) {
+		badRequestResponse(c, "结束日期不能早于开始日期")
+		return start, end, false
+	}
+	if end.Sub(start) >= riderShiftMaxDays*24*time.Hour {
+		badRequestResponse(c, "日期范围不能超过62天")
+		return start, end, false
+	}
+	return start, end, true
+}
+
+// GetRiderShifts 获取排班列表（管理后台）
+// 参数：start_date、end_date（默认本周），employee_code（可选）
+func GetRiderShifts(c *gin.Context) {
+	start, end, ok := parseRiderDateRange(c)
+	if !ok {
+		return
+	}
+	shifts, err := model.GetRiderShifts(start, end.AddDate(0, 0, 1), strings.TrimSpace(c.Query("employee_code")))
+	if err != nil {
+		internalErrorResponse(c, "获取排班失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"start_date": start.Format("2006-01-02"),
+		"end_date":   end.Format("2006-01-02"),
+		"list":       shifts,
+	}, "")
+}
+
+// SaveRiderShifts 批量排班（管理后台）
+// 为选中的配送员在日期范围内（可按星期筛选）设置同一班次，已有排班时覆盖
+func SaveRiderShifts(c *gin.Context) {
+	var req struct {
+		EmployeeCodes []string `json:"employee_codes" binding:"required"`
+		StartDate     string   `json:"start_date" binding:"required"`
+		EndDate       string   `json:"end_date" binding:"required"`
+		Weekdays      []int    `json:"weekdays"`                      // 0-6，0 为周日，为空时每天
+		StartTime     string   `json:"start_time" binding:"required"` // 班次开始时间 HH:mm
+		EndTime       string   `json:"end_time" binding:"required"`   // 班次结束时间 HH:mm，不晚于开始时间时为次日
+		Remark        string   `json:"remark"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "请求参数错误: "+err.Error())
+		return
+	}
+
+	start, err := time.ParseInLocation("2006-01-02", req.StartDate, time.Local)
+	if err != nil {
+		badRequestResponse(c, "开始日期格式错误，应为 YYYY-MM-DD")
+		return
+	}
+	end, err := time.ParseInLocation("2006-01-02", req.EndDate, time.Local)
+	if err != nil {
+		badRequestResponse(c, "结束日期格式错误，应为 YYYY-MM-DD")
+		return
+	}
+	if end.Before(start) {
+		badRequestResponse(c, "结束日期不能早于开始日期")
+		return
+	}
+	if end.Sub(start) >= riderShiftMaxDays*24*time.Hour {
+		badRequestResponse(c, "排班日期范围不能超过62天")
+		return
+	}
+
+	weekdays := make(map[time.Weekday]bool)
+	for _, w := range req.Weekdays {
+		if w < 0 || w > 6 {
+			badRequestResponse(c, "星期参数无效")
+			return
+		}
+		weekdays[time.Weekday(w)] = true
+	}
+	dates := make([]time.Time, 0)
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		if len(weekdays) == 0 || weekdays[d.Weekday()] {
+			dates = append(dates, d)
+		}
+	}
+	if len(dates) == 0 {
+		badRequestResponse(c, "所选日期范围内没有符合条件的日期")
+		return
+	}
+
+	codes := make([]string, 0, len(req.EmployeeCodes))
+	for _, code := range req.EmployeeCodes {
+		if code = strings.TrimSpace(code); code != "" {
+			codes = append(codes, code)
+		}
+	}
+	if len(codes) == 0 {
+		badRequestResponse(c, "请选择配送员")
+		return
+	}
+	employees, err := model.GetEmployeesByEmployeeCodes(codes)
+	if err != nil {
+		internalErrorResponse(c, "获取配送员失败: "+err.Error())
+		return
+	}
+	for _, code := range codes {
+		if e := employees[code]; e == nil || !e.IsDelivery {
+			badRequestResponse(c, "员工 "+code+" 不是配送员")
+			return
+		}
+	}
+
+	count, err := model.SaveRiderShifts(codes, dates, strings.TrimSpace(req.StartTime), strings.TrimSpace(req.EndTime),
+		strings.TrimSpace(req.Remark), getAdminOperatorName(c))
+	if err != nil {
+		internalErrorResponse(c, "保存排班失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{"count": count}, "排班已保存")
+}
+
+// DeleteRiderShift 删除排班（管理后台）
+func DeleteRiderShift(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	found, err := model.DeleteRiderShift(id)
+	if err != nil {
+		internalErrorResponse(c, "删除排班失败: "+err.Error())
+		return
+	}
+	if !found {
+		badRequestResponse(c, "排班不存在")
+		return
+	}
+	successResponse(c, nil, "删除成功")
+}
+
+// GetRiderAttendances 考勤报表（管理后台）
+// 参数：start_date、end_date（默认本周），employee_code（可选）
+// 返回考勤记录、已结束但未打卡的排班（缺勤）以及按配送员汇总
+func GetRiderAttendances(c *gin.Context) {
+	start, end, ok := parseRiderDateRange(c)
+	if !ok {
+		return
+	}
+	employeeCode := strings.TrimSpace(c.Query("employee_code"))
+	records, err := model.GetRiderAttendances(start, end.AddDate(0, 0, 1), employeeCode)
+	if err != nil {
+		internalErrorResponse(c, "获取考勤记录失败: "+err.Error())
+		return
+	}
+	shifts, err := model.GetRiderShifts(start, end.AddDate(0, 0, 1), employeeCode)
+	if err != nil {
+		internalErrorResponse(c, "获取排班失败: "+err.Error())
+		return
+	}
+
+	type riderAttendanceSummary struct {
+		EmployeeCode      string  `json:"employee_code"`
+		EmployeeName      string  `json:"employee_name"`
+		AttendanceDays    int     `json:"attendance_days"`
+		WorkedMinutes     float64 `json:"worked_minutes"`
+		BreakMinutes      float64 `json:"break_minutes"`
+		LateTimes         int     `json:"late_times"`
+		EarlyLeaveTimes   int     `json:"early_leave_times"`
+		AbsentDays        int     `json:"absent_days"`
+		ScheduledShiftNum int     `json:"scheduled_shift_num"`
+	}
+	summaries := make([]*riderAttendanceSummary, 0)
+	index := make(map[string]*riderAttendanceSummary)
+	summaryOf := func(code, name string) *riderAttendanceSummary {
+		s, ok := index[code]
+		if !ok {
+			s = &riderAttendanceSummary{EmployeeCode: code, EmployeeName: name}
+			index[code] = s
+			summaries = append(summaries, s)
+		}
+		return s
+	}
+
+	attended := make(map[string]bool)
+	for _, r := range records {
+		attended[r.EmployeeCode+"|"+r.WorkDate] = true
+		s := summaryOf(r.EmployeeCode, r.EmployeeName)
+		s.AttendanceDays++
+		s.WorkedMinutes += r.WorkedMinutes
+		s.BreakMinutes += r.BreakMinutes
+		if r.LateMinutes > 0 {
+			s.LateTimes++
+		}
+		if r.EarlyLeaveMinutes > 0 {
+			s.EarlyLeaveTimes++
+		}
+	}
+	now := time.Now()
+	absences := make([]model.RiderShift, 0)
+	for _, shift := range shifts {
+		s := summaryOf(shift.EmployeeCode, shift.EmployeeName)
+		s.ScheduledShiftNum++
+		if !attended[shift.EmployeeCode+"|"+shift.ShiftDate] && shift.EndTime.Before(now) {
+			s.AbsentDays++
+			absences = append(absences, shift)
+		}
+	}
+
+	successResponse(c, gin.H{
+		"start_date": start.Format("2006-01-02"),
+		"end_date":   end.Format("2006-01-02"),
+		"list":       records,
+		"absences":   absences,
+		"summary":    summaries,
+	}, "")
+}
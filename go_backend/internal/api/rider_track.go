@@ -0,0 +1,171 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"go_backend/internal/model"
+	"go_backend/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 轨迹查询限制
+const (
+	riderTrackMaxRange         = 7 * 24 * time.Hour // 单次轨迹查询最长时间范围
+	riderTrackDefaultTolerance = 10.0               // 默认轨迹抽稀容差（米）
+	riderTrackStopRadius       = 150.0              // 判断到达收货地址的半径（米）
+	riderDistanceMaxDays       = 62                 // 里程统计最长天数
+)
+
+// parseTrackTime 解析轨迹查询时间，支持 "2006-01-02 15:04:05"、"2006-01-02T15:04:05" 和 "2006-01-02"
+func parseTrackTime(value string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, strings.TrimSpace(value), time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// GetRiderTrack 获取配送员时间范围内的轨迹回放数据（管理后台）
+// 参数：start、end（默认当天），tolerance 抽稀容差（米，0 为不抽稀）
+// 返回抽稀后的轨迹、行驶里程，以及该时间段内送达订单的到达/离开时间和停留时长
+func GetRiderTrack(c *gin.Context) {
+	employeeCode := strings.TrimSpace(c.Param("code"))
+	if employeeCode == "" {
+		badRequestResponse(c, "员工码不能为空")
+		return
+	}
+
+	now := time.Now()
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	end := start.AddDate(0, 0, 1)
+	if v := c.Query("start"); v != "" {
+		t, ok := parseTrackTime(v)
+		if !ok {
+			badRequestResponse(c, "开始时间格式错误")
+			return
+		}
+		start = t
+	}
+	if v := c.Query("end"); v != "" {
+		t, ok := parseTrackTime(v)
+		if !ok {
+			badRequestResponse(c, "结束时间格式错误")
+			return
+		}
+		end = t
+		if len(strings.TrimSpace(v)) == len("2006-01-02") {
+			// 只传日期时包含当天
+			end = end.AddDate(0, 0, 1)
+		}
+	}
+	if !end.After(start) {
+		badRequestResponse(c, "结束时间必须晚于开始时间")
+		return
+	}
+	if end.Sub(start) > riderTrackMaxRange {
+		badRequestResponse(c, "查询时间范围不能超过7天")
+		return
+	}
+
+	tolerance := riderTrackDefaultTolerance
+	if v := c.Query("tolerance"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t < 0 {
+			badRequestResponse(c, "抽稀容差格式错误")
+			return
+		}
+		tolerance = t
+	}
+
+	points, err := model.GetEmployeeTrackPoints(employeeCode, start, end)
+	if err != nil {
+		internalErrorResponse(c, "获取轨迹失败: "+err.Error())
+		return
+	}
+	stops, err := model.GetDeliveredOrdersInWindow(employeeCode, start, end)
+	if err != nil {
+		internalErrorResponse(c, "获取送达订单失败: "+err.Error())
+		return
+	}
+	model.MatchDeliveredStops(points, stops, riderTrackStopRadius)
+
+	track := utils.SimplifyTrack(points, tolerance)
+	successResponse(c, gin.H{
+		"employee_code":   employeeCode,
+		"start":           start,
+		"end":             end,
+		"point_count":     len(points),
+		"track":           track,
+		"distance_km":     model.TrackDistanceKm(points),
+		"delivered_stops": stops,
+	}, "")
+}
+
+// GetRiderDistanceStats 按轨迹统计配送员每日行驶里程（管理后台，配合配送费收入统计用于核算）
+// 参数：start_date、end_date（默认最近7天，含当天），employee_code（可选）
+func GetRiderDistanceStats(c *gin.Context) {
+	today := time.Now()
+	endDate := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.Local)
+	startDate := endDate.AddDate(0, 0, -6)
+	if v := c.Query("start_date"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			badRequestResponse(c, "开始日期格式错误，应为 YYYY-MM-DD")
+			return
+		}
+		startDate = t
+	}
+	if v := c.Query("end_date"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			badRequestResponse(c, "结束日期格式错误，应为 YYYY-MM-DD")
+			return
+		}
+		endDate = t
+	}
+	if endDate.Before(startDate) {
+		badRequestResponse(c, "结束日期不能早于开始日期")
+		return
+	}
+	if endDate.Sub(startDate) >= riderDistanceMaxDays*24*time.Hour {
+		badRequestResponse(c, "统计日期范围不能超过62天")
+		return
+	}
+
+	daily, err := model.GetRiderDailyDistances(startDate, endDate.AddDate(0, 0, 1), strings.TrimSpace(c.Query("employee_code")))
+	if err != nil {
+		internalErrorResponse(c, "统计行驶里程失败: "+err.Error())
+		return
+	}
+
+	// 按配送员汇总
+	type riderDistanceTotal struct {
+		EmployeeCode string  `json:"employee_code"`
+		EmployeeName string  `json:"employee_name"`
+		DistanceKm   float64 `json:"distance_km"`
+		Days         int     `json:"days"`
+	}
+	totals := make([]*riderDistanceTotal, 0)
+	index := make(map[string]*riderDistanceTotal)
+	for _, d := range daily {
+		total, ok := index[d.EmployeeCode]
+		if !ok {
+			total = &riderDistanceTotal{EmployeeCode: d.EmployeeCode, EmployeeName: d.EmployeeName}
+			index[d.EmployeeCode] = total
+			totals = append(totals, total)
+		}
+		total.DistanceKm += d.DistanceKm
+		total.Days++
+	}
+
+	successResponse(c, gin.H{
+		"start_date": startDate.Format("2006-01-02"),
+		"end_date":   endDate.Format("2006-01-02"),
+		"daily":      daily,
+		"totals":     totals,
+	}, "")
+}
@@ -195,6 +195,36 @@ func getSettingDescription(key string) string {
 		"map_tencent_key":              "腾讯地图API Key",
 		"order_urgent_fee":             "加急订单费用（元）",
 		"order_pending_payment_timeout": "待支付订单超时自动取消时间（分钟）",
+		"points_redeem_rate":           "积分抵扣比例（多少积分抵扣1元，0为关闭）",
+		"points_redeem_max_percent":    "积分最多抵扣商品金额的百分比（%）",
+		"points_redeem_min_order":      "商品金额满多少元可使用积分抵扣（元）",
+		"points_expire_years":          "积分有效期（获得当年起第N年年末过期，0为永不过期）",
+		"coupon_expiry_remind_days":    "优惠券到期前N天生成到期提醒（0为关闭提醒）",
+		"coupon_expiry_subscribe_template_id": "优惠券到期提醒订阅消息模板ID（为空则只在小程序内提醒）",
+		"coupon_expiry_subscribe_page": "优惠券到期提醒订阅消息跳转页面",
+		"delivery_slot_required":       "下单是否必须选择配送时段（1为必须，0为可选）",
+		"delivery_slot_days":           "配送时段可预约天数（含当天）",
+		"dispatch_vehicle_capacity":    "调度规划每个配送员的容量（配送计件数，0为不限）",
+		"dispatch_avg_speed_kmh":       "调度规划配送员平均速度（公里/小时）",
+		"dispatch_service_minutes":     "调度规划每个停靠点停留时间（分钟）",
+		"dispatch_late_penalty_km":     "调度规划每迟到1分钟折算的距离（公里）",
+		"dispatch_balance_weight":      "调度规划均衡权重（每多分配一单折算的距离，公里）",
+		"distance_provider":            "距离计算方式（haversine-直线距离，amap-高德驾车距离）",
+		"distance_cache_days":          "道路距离缓存有效期（天）",
+		"delivery_geofence_radius_meters": "完成配送位置与收货地址的允许距离（米），超出时标记待审核",
+		"delivery_confirm_code_min_amount": "订单金额达到该值时送达需客户确认码（元，0为关闭）",
+		"delivery_confirm_code_max_attempts": "收货确认码连续输错该次数后锁定",
+		"delivery_confirm_code_lock_minutes": "收货确认码输错次数过多时的锁定时长（分钟）",
+		"auto_dispatch_mode":           "自动派单模式（off-关闭，offer-逐个推送派单邀请，auto-直接派单）",
+		"auto_dispatch_offer_timeout_seconds": "派单邀请响应超时时间（秒）",
+		"auto_dispatch_max_offers":     "每个订单最多推送派单邀请次数（0为不限）",
+		"auto_dispatch_max_batch_orders": "配送员在途订单达到该数量时不再派单（0为不限）",
+		"auto_dispatch_weight_distance": "自动派单距离权重（每公里）",
+		"auto_dispatch_weight_detour":  "自动派单绕行权重（每公里）",
+		"auto_dispatch_weight_load":    "自动派单负载权重（每个在途订单折算的距离，公里）",
+		"auto_dispatch_weight_acceptance": "自动派单接受率权重（接受率100%折算的距离，公里）",
+		"rider_duty_required":          "配送员是否需上班打卡后才能查看待接订单和接单（1为需要，0为不需要）",
+		"rider_late_grace_minutes":     "配送员上班打卡迟到宽限时间（分钟）",
 		"delivery_base_fee":            "基础配送费（元）",
 		"delivery_isolated_distance":   "孤立订单判断距离（公里）",
 		"delivery_isolated_subsidy":    "孤立订单补贴（元）",
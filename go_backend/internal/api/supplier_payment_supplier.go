@@ -164,6 +164,12 @@ func GetSupplierPendingItems(c *gin.Context) {
 		return
 	}
 
+	returnedQty, err := model.GetUnpaidReturnedQuantities(supplierID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "查询售后退货数量失败: " + err.Error()})
+		return
+	}
+
 	// 构建时间范围
 	var startDate, endDate time.Time
 	if startDateStr != "" {
@@ -271,6 +277,12 @@ func GetSupplierPendingItems(c *gin.Context) {
 				continue
 			}
 
+			// 付款前已售后退货的数量不再向供应商付款
+			quantity -= returnedQty[orderItemID]
+			if quantity <= 0 {
+				continue
+			}
+
 			// 计算成本价
 			costPrice := 0.0
 			if productSpecsJSON.Valid && productSpecsJSON.String != "" {
@@ -371,6 +383,12 @@ func GetSupplierPaymentStats(c *gin.Context) {
 		return
 	}
 
+	returnedQty, err := model.GetUnpaidReturnedQuantities(supplierID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "查询售后退货数量失败: " + err.Error()})
+		return
+	}
+
 	// 计算已付款总额
 	paidAmountQuery := `
 		SELECT COALESCE(SUM(payment_amount), 0)
@@ -436,6 +454,12 @@ func GetSupplierPaymentStats(c *gin.Context) {
 			continue
 		}
 
+		// 付款前已售后退货的数量不再向供应商付款
+		quantity -= returnedQty[orderItemID]
+		if quantity <= 0 {
+			continue
+		}
+
 		// 计算成本价
 		costPrice := 0.0
 		if productSpecsJSON.Valid && productSpecsJSON.String != "" {
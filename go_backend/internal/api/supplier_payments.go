@@ -91,6 +91,11 @@ func GetSupplierPaymentsStats(c *gin.Context) {
 			continue
 		}
 
+		returnedQty, err := model.GetUnpaidReturnedQuantities(supplierID)
+		if err != nil {
+			continue
+		}
+
 		// 查询已付款总金额（从付款记录表，统计列表显示全部时间的已付款金额）
 		var paidAmount float64
 		paidAmountQuery := `
@@ -162,6 +167,14 @@ func GetSupplierPaymentsStats(c *gin.Context) {
 					continue
 				}
 
+				// 付款前已售后退货的数量不再向供应商付款
+				if !paidItems[orderItemID] {
+					quantity -= returnedQty[orderItemID]
+					if quantity <= 0 {
+						continue
+					}
+				}
+
 				// 计算成本价
 				costPrice := 0.0
 				if productSpecsJSON.Valid && productSpecsJSON.String != "" {
@@ -377,6 +390,15 @@ func GetSupplierPaymentDetail(c *gin.Context) {
 		return
 	}
 
+	returnedQty, err := model.GetUnpaidReturnedQuantities(supplierID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "查询售后退货数量失败: " + err.Error(),
+		})
+		return
+	}
+
 	// 过滤订单（根据状态和商品明细）
 	filteredOrderIDs := []int{}
 	for _, orderID := range allOrderIDs {
@@ -414,6 +436,14 @@ func GetSupplierPaymentDetail(c *gin.Context) {
 				continue
 			}
 
+			// 付款前已售后退货的数量不再向供应商付款
+			if !paidItems[orderItemID] {
+				quantity -= returnedQty[orderItemID]
+				if quantity <= 0 {
+					continue
+				}
+			}
+
 			// 计算成本价
 			costPrice := 0.0
 			if productSpecsJSON.Valid && productSpecsJSON.String != "" {
@@ -529,6 +559,14 @@ func GetSupplierPaymentDetail(c *gin.Context) {
 				continue
 			}
 
+			// 付款前已售后退货的数量不再向供应商付款
+			if !paidItems[orderItemID] {
+				quantity -= returnedQty[orderItemID]
+				if quantity <= 0 {
+					continue
+				}
+			}
+
 			// 计算成本价
 			costPrice := 0.0
 			if productSpecsJSON.Valid && productSpecsJSON.String != "" {
@@ -719,6 +757,16 @@ func CreateSupplierPayment(c *gin.Context) {
 			badRequestResponse(c, fmt.Sprintf("订单商品 %d 已付款，不能重复付款", item.OrderItemID))
 			return
 		}
+		// 付款前已售后退货的数量冲减应付款
+		payableQty, err := model.GetOrderItemPayableQuantity(item.OrderItemID)
+		if err != nil {
+			internalErrorResponse(c, "检查售后退货数量失败: "+err.Error())
+			return
+		}
+		if item.Quantity > payableQty {
+			badRequestResponse(c, fmt.Sprintf("订单商品 %d 已售后退货，应付数量为 %d", item.OrderItemID, payableQty))
+			return
+		}
 	}
 
 	// 创建付款记录
@@ -909,6 +957,12 @@ func AdminGetSupplierDailyPayments(c *gin.Context) {
 		return
 	}
 
+	returnedQty, err := model.GetUnpaidReturnedQuantities(supplierIDPtr)
+	if err != nil {
+		internalErrorResponse(c, "查询售后退货数量失败: "+err.Error())
+		return
+	}
+
 	// 查询该供应商所有已取货的订单商品，按订单创建日期统计
 	query := `
 		SELECT 
@@ -959,6 +1013,14 @@ func AdminGetSupplierDailyPayments(c *gin.Context) {
 			continue
 		}
 
+		// 付款前已售后退货的数量不再向供应商付款
+		if !paidItems[orderItemID] {
+			quantity -= returnedQty[orderItemID]
+			if quantity <= 0 {
+				continue
+			}
+		}
+
 		// 计算成本价
 		costPrice := 0.0
 		if productSpecsJSON.Valid && productSpecsJSON.String != "" {
@@ -1051,6 +1113,12 @@ func AdminGetSupplierDailyPaymentDetail(c *gin.Context) {
 		return
 	}
 
+	returnedQty, err := model.GetUnpaidReturnedQuantities(supplierIDPtr)
+	if err != nil {
+		internalErrorResponse(c, "查询售后退货数量失败: "+err.Error())
+		return
+	}
+
 	// 查询该供应商在指定日期的所有已取货商品
 	query := `
 		SELECT 
@@ -1092,6 +1160,14 @@ func AdminGetSupplierDailyPaymentDetail(c *gin.Context) {
 			continue
 		}
 
+		// 付款前已售后退货的数量不再向供应商付款
+		if !paidItems[orderItemID] {
+			quantity -= returnedQty[orderItemID]
+			if quantity <= 0 {
+				continue
+			}
+		}
+
 		// 计算成本价
 		costPrice := 0.0
 		if productSpecsJSON.Valid && productSpecsJSON.String != "" {
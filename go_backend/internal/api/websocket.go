@@ -31,6 +31,7 @@ type EmployeeLocation struct {
 	Latitude     float64   `json:"latitude"`
 	Longitude    float64   `json:"longitude"`
 	Accuracy     float64   `json:"accuracy"` // 精度（米）
+	DutyStatus   string    `json:"duty_status,omitempty"` // 在岗状态：on_duty/on_break/off_duty
 	UpdatedAt    time.Time `json:"updated_at"`
 }
 
@@ -38,12 +39,24 @@ type EmployeeLocation struct {
 type LocationManager struct {
 	locations map[int]*EmployeeLocation // key: employee_id
 	clients   map[*websocket.Conn]bool  // 管理后台WebSocket客户端
+	senders   map[string]employeeSender  // 在线配送员的消息发送通道，key: employee_code
+	watchers  map[string]map[chan EmployeeLocation]bool // 按员工码订阅位置更新（小程序订单跟踪），key: employee_code
+	duty      map[string]string         // 配送员在岗状态，key: employee_code
 	mu        sync.RWMutex
 }
 
+// employeeSender 配送员WebSocket连接及其并发安全的JSON写入函数
+type employeeSender struct {
+	conn      *websocket.Conn
+	writeJSON func(v interface{}) error
+}
+
 var locationManager = &LocationManager{
 	locations: make(map[int]*EmployeeLocation),
 	clients:   make(map[*websocket.Conn]bool),
+	senders:   make(map[string]employeeSender),
+	watchers:  make(map[string]map[chan EmployeeLocation]bool),
+	duty:      make(map[string]string),
 }
 
 // UpdateLocation 更新员工位置（配送员端调用）
@@ -59,6 +72,7 @@ func (lm *LocationManager) UpdateLocation(employeeID int, employeeCode, name, ph
 		Latitude:     latitude,
 		Longitude:    longitude,
 		Accuracy:     accuracy,
+		DutyStatus:   lm.duty[employeeCode],
 		UpdatedAt:    time.Now(),
 	}
 
@@ -84,6 +98,18 @@ func (lm *LocationManager) broadcastLocation(location *EmployeeLocation) {
 		return
 	}
 
+	// 通知订阅该配送员位置的订单跟踪连接（不阻塞，订阅方未及时读取时只保留最新位置）
+	for ch := range lm.watchers[location.EmployeeCode] {
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- *location:
+		default:
+		}
+	}
+
 	for client := range lm.clients {
 		err := client.WriteMessage(websocket.TextMessage, message)
 		if err != nil {
@@ -94,6 +120,40 @@ func (lm *LocationManager) broadcastLocation(location *EmployeeLocation) {
 	}
 }
 
+// SetDutyStatus 更新配送员在岗状态，状态变化时广播给管理后台客户端
+func (lm *LocationManager) SetDutyStatus(employeeCode, status string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	if lm.duty[employeeCode] == status {
+		return
+	}
+	lm.duty[employeeCode] = status
+	for _, loc := range lm.locations {
+		if loc.EmployeeCode == employeeCode {
+			loc.DutyStatus = status
+		}
+	}
+
+	message, err := json.Marshal(map[string]interface{}{
+		"type":          "duty_status_update",
+		"employee_code": employeeCode,
+		"duty_status":   status,
+		"updated_at":    time.Now(),
+	})
+	if err != nil {
+		log.Printf("序列化在岗状态失败: %v", err)
+		return
+	}
+	for client := range lm.clients {
+		if err := client.WriteMessage(websocket.TextMessage, message); err != nil {
+			log.Printf("发送在岗状态失败: %v", err)
+			delete(lm.clients, client)
+			client.Close()
+		}
+	}
+}
+
 // GetAllLocations 获取所有员工位置（包括离线员工的最后位置）
 func (lm *LocationManager) GetAllLocations() []*EmployeeLocation {
 	lm.mu.RLock()
@@ -170,6 +230,57 @@ func (lm *LocationManager) AddClient(conn *websocket.Conn) {
 	}
 }
 
+// RegisterEmployeeSender 登记配送员连接，用于向其推送派单邀请等消息（同一员工重复连接时以最新连接为准）
+func (lm *LocationManager) RegisterEmployeeSender(employeeCode string, conn *websocket.Conn, writeJSON func(v interface{}) error) {
+	lm.mu.Lock()
+	lm.senders[employeeCode] = employeeSender{conn: conn, writeJSON: writeJSON}
+	lm.mu.Unlock()
+}
+
+// UnregisterEmployeeSender 配送员连接断开时移除（只移除仍是该连接的登记）
+func (lm *LocationManager) UnregisterEmployeeSender(employeeCode string, conn *websocket.Conn) {
+	lm.mu.Lock()
+	if sender, ok := lm.senders[employeeCode]; ok && sender.conn == conn {
+		delete(lm.senders, employeeCode)
+	}
+	lm.mu.Unlock()
+}
+
+// SendToEmployee 向在线配送员推送消息，返回是否已发送
+func (lm *LocationManager) SendToEmployee(employeeCode string, v interface{}) bool {
+	lm.mu.RLock()
+	sender, ok := lm.senders[employeeCode]
+	lm.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if err := sender.writeJSON(v); err != nil {
+		log.Printf("推送消息给配送员 %s 失败: %v", employeeCode, err)
+		return false
+	}
+	return true
+}
+
+// WatchEmployeeLocation 订阅配送员位置更新，返回接收通道和取消订阅函数
+func (lm *LocationManager) WatchEmployeeLocation(employeeCode string) (<-chan EmployeeLocation, func()) {
+	ch := make(chan EmployeeLocation, 1)
+	lm.mu.Lock()
+	if lm.watchers[employeeCode] == nil {
+		lm.watchers[employeeCode] = make(map[chan EmployeeLocation]bool)
+	}
+	lm.watchers[employeeCode][ch] = true
+	lm.mu.Unlock()
+
+	return ch, func() {
+		lm.mu.Lock()
+		delete(lm.watchers[employeeCode], ch)
+		if len(lm.watchers[employeeCode]) == 0 {
+			delete(lm.watchers, employeeCode)
+		}
+		lm.mu.Unlock()
+	}
+}
+
 // RemoveClient 移除管理后台WebSocket客户端
 func (lm *LocationManager) RemoveClient(conn *websocket.Conn) {
 	lm.mu.Lock()
@@ -254,6 +365,15 @@ func HandleEmployeeWebSocket(c *gin.Context) {
 		return conn.WriteJSON(v)
 	}
 
+	// 登记连接，用于接收派单邀请
+	locationManager.RegisterEmployeeSender(employee.EmployeeCode, conn, writeJSON)
+	defer locationManager.UnregisterEmployeeSender(employee.EmployeeCode, conn)
+
+	// 同步在岗状态，位置广播中带上状态
+	if dutyStatus, err := model.GetRiderDutyStatus(employee.EmployeeCode); err == nil {
+		locationManager.SetDutyStatus(employee.EmployeeCode, dutyStatus.Status)
+	}
+
 	// 启动心跳发送goroutine
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
@@ -357,6 +477,22 @@ func HandleEmployeeWebSocket(c *gin.Context) {
 					log.Printf("发送pong失败 (配送员 %d): %v", empID, err)
 					break
 				}
+			} else if msgType == "dispatch_accept" || msgType == "dispatch_decline" {
+				// 响应派单邀请
+				offerID, _ := msg["offer_id"].(float64)
+				var result map[string]interface{}
+				if msgType == "dispatch_accept" {
+					latitude, _ := msg["latitude"].(float64)
+					longitude, _ := msg["longitude"].(float64)
+					result = wsDispatchOfferResult(msgType, int(offerID), acceptDispatchOffer(int(offerID), employee.EmployeeCode, latitude, longitude))
+				} else {
+					reason, _ := msg["reason"].(string)
+					result = wsDispatchOfferResult(msgType, int(offerID), declineDispatchOffer(int(offerID), employee.EmployeeCode, reason))
+				}
+				if err := writeJSON(result); err != nil {
+					log.Printf("发送派单响应结果失败 (配送员 %d): %v", empID, err)
+					break
+				}
 			} else {
 				log.Printf("收到未知类型的消息 (配送员 %d): %v", empID, msg)
 			}
@@ -11,7 +11,6 @@ import (
 	"unicode/utf8"
 
 	"go_backend/internal/model"
-	feishunotify "go_backend/internal/notify"
 
 	"github.com/gin-gonic/gin"
 	"github.com/wechatpay-apiv3/wechatpay-go/core"
@@ -299,31 +298,76 @@ func WeChatPayNotify(c *gin.Context) {
 	order, err := model.GetOrderByOrderNumber(outTradeNo)
 	if err != nil || order == nil {
 		// 可能是 prepay-from-checkout 流程：订单尚未创建，从缓存创建
-		cacheEntry, cacheErr := GetPrepayCache(outTradeNo)
-		if cacheErr != nil || cacheEntry == nil {
-			// 缓存不存在或过期：用户已付款但无法创建订单，必须返回 FAIL 让微信重试，避免误报成功
-			log.Printf("[WeChatPayNotify] 严重：订单不存在且预支付缓存无效(已过期或不存在)，用户可能已扣款。out_trade_no=%s transaction_id=%s err=%v", outTradeNo, transactionID, cacheErr)
-			c.JSON(http.StatusInternalServerError, gin.H{"code": "FAIL", "message": "预支付缓存已过期，请稍后重试或联系客服补单"})
+		exception := &model.PrepayNotifyException{
+			OutTradeNo:    outTradeNo,
+			TransactionID: transactionID,
+		}
+		if transaction.Amount != nil && transaction.Amount.Total != nil {
+			exception.Amount = float64(*transaction.Amount.Total) / 100
+		}
+		if transaction.Payer != nil && transaction.Payer.Openid != nil {
+			exception.PayerOpenID = *transaction.Payer.Openid
+		}
+
+		// 从缓存创建订单（直接为已支付状态）；快照在建单事务内消费，失败回滚后微信重试可再次建单
+		// 用户已付款，超过 prepayCacheTTL 的快照仍在保留期内，照常建单
+		var cacheEntry *model.CachedPrepayEntry
+		var cacheErr error
+		order, cacheEntry, cacheErr = model.CreateOrderFromPrepaySnapshot(outTradeNo, transactionID, true)
+		if cacheErr == model.ErrPrepayConsumed {
+			// 并发回调在快照行锁上排队，前一个提交后订单已存在，直接返回成功
+			if existing, _ := model.GetOrderByOrderNumber(outTradeNo); existing != nil {
+				c.JSON(http.StatusOK, gin.H{"code": "SUCCESS", "message": "成功"})
+				return
+			}
+			// 快照已消费却没有订单（建单中断），记录异常由后台补单或退款，不再让微信无限重试
+			log.Printf("[WeChatPayNotify] 严重：预支付缓存已消费但订单不存在，用户已扣款。out_trade_no=%s transaction_id=%s", outTradeNo, transactionID)
+			exception.Reason = model.PrepayExceptionConsumedNoOrder
+			msg := cacheErr.Error()
+			exception.ErrorMessage = &msg
+			if err := model.RecordPrepayNotifyException(exception); err != nil {
+				log.Printf("[WeChatPayNotify] 记录支付回调异常失败: out_trade_no=%s err=%v", outTradeNo, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"code": "FAIL", "message": "订单处理中"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"code": "SUCCESS", "message": "成功"})
 			return
 		}
-		// 从缓存创建订单（直接为已支付状态）
-		order, _, err = model.CreateOrderFromCachedPrepay(outTradeNo, transactionID, cacheEntry)
-		if err != nil {
-			log.Printf("[WeChatPayNotify] 从缓存创建订单失败: out_trade_no=%s err=%v", outTradeNo, err)
+		if cacheErr == model.ErrPrepayNotFound {
+			// 快照不存在（已超过保留期被清理）：用户已付款但无法自动创建订单，记录异常由后台退款
+			log.Printf("[WeChatPayNotify] 严重：订单不存在且预支付缓存不存在，用户已扣款。out_trade_no=%s transaction_id=%s err=%v", outTradeNo, transactionID, cacheErr)
+			exception.Reason = model.PrepayExceptionCacheMissing
+			msg := cacheErr.Error()
+			exception.ErrorMessage = &msg
+			if err := model.RecordPrepayNotifyException(exception); err != nil {
+				// 记录失败时返回 FAIL 让微信重试，避免丢失该笔支付
+				log.Printf("[WeChatPayNotify] 记录支付回调异常失败: out_trade_no=%s err=%v", outTradeNo, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"code": "FAIL", "message": "预支付缓存已过期，请稍后重试或联系客服补单"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"code": "SUCCESS", "message": "成功"})
+			return
+		}
+		if cacheErr != nil {
+			// 建单事务已回滚、快照仍为待支付，返回 FAIL 让微信重试；同时记录异常，重试耗尽后可在后台人工处理
+			log.Printf("[WeChatPayNotify] 从缓存创建订单失败: out_trade_no=%s err=%v", outTradeNo, cacheErr)
+			msg := cacheErr.Error()
+			exception.Reason = model.PrepayExceptionOrderFailed
+			exception.ErrorMessage = &msg
+			if recErr := model.RecordPrepayNotifyException(exception); recErr != nil {
+				log.Printf("[WeChatPayNotify] 记录支付回调异常失败: out_trade_no=%s err=%v", outTradeNo, recErr)
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"code": "FAIL", "message": "创建订单失败"})
 			return
 		}
+		if err := model.ResolvePrepayNotifyExceptionByOrder(outTradeNo, order.ID); err != nil {
+			log.Printf("[WeChatPayNotify] 关闭支付回调异常失败: out_trade_no=%s err=%v", outTradeNo, err)
+		}
 		// 清空采购单
 		ClearPurchaseListByItemIDs(cacheEntry.UserID, cacheEntry.ItemIDs)
 		log.Printf("[WeChatPayNotify] 从缓存创建订单成功: orderID=%d out_trade_no=%s", order.ID, outTradeNo)
 		// 飞书订单收款通知（预支付下单即支付成功）
-		go func(o *model.Order, txID string) {
-			items, _ := model.GetOrderItemsByOrderID(o.ID)
-			u, _ := model.GetMiniAppUserByID(o.UserID)
-			if u != nil {
-				feishunotify.NotifyOrderPaid(o, items, u, txID)
-			}
-		}(order, transactionID)
+		enqueueFeishuOrderPaid(order.ID, transactionID)
 		c.JSON(http.StatusOK, gin.H{"code": "SUCCESS", "message": "成功"})
 		return
 	}
@@ -343,26 +387,15 @@ func WeChatPayNotify(c *gin.Context) {
 	}
 
 	// 飞书订单收款通知
-	go func(orderID int, txID string) {
-		o, _ := model.GetOrderByID(orderID)
-		if o == nil {
-			return
-		}
-		items, _ := model.GetOrderItemsByOrderID(orderID)
-		u, _ := model.GetMiniAppUserByID(o.UserID)
-		if u != nil {
-			feishunotify.NotifyOrderPaid(o, items, u, txID)
-		}
-	}(order.ID, transactionID)
+	enqueueFeishuOrderPaid(order.ID, transactionID)
 
-	// 已送达后用户在小程序补付：延时自动补录微信发货信息
+	// 已送达后用户在小程序补付：延时自动补录微信发货信息，失败由后台任务重试
 	if prevStatus == "delivered" || prevStatus == "shipped" || prevStatus == "completed" {
-		go func(oid int) {
-			time.Sleep(30 * time.Second)
-			if err := UploadWechatShippingInfo(oid); err != nil {
-				log.Printf("[WeChatPayNotify] 已送达订单补录微信发货失败 orderID=%d: %v（可稍后由后台补录）", oid, err)
-			}
-		}(order.ID)
+		key := fmt.Sprintf("%s:%d", model.JobWechatShippingUpload, order.ID)
+		opts := model.JobOptions{IdempotencyKey: key, Delay: 30 * time.Second}
+		if err := model.EnqueueJob(model.JobWechatShippingUpload, model.OrderJobPayload{OrderID: order.ID}, opts); err != nil {
+			log.Printf("[WeChatPayNotify] 已送达订单补录微信发货任务入队失败 orderID=%d: %v（可稍后由后台补录）", order.ID, err)
+		}
 	}
 
 	c.JSON(http.StatusOK, gin.H{"code": "SUCCESS", "message": "成功"})
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
@@ -77,62 +78,57 @@ func WeChatPrepayFromCheckout(c *gin.Context) {
 		}
 	}
 
+	// 发起支付前预检查库存（支付回调创建订单时不再拦截，避免已付款订单创建失败）
+	if err := model.CheckPurchaseItemsStock(items); err != nil {
+		var stockErr *model.InsufficientStockError
+		if errors.As(err, &stockErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": stockErr.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "校验库存失败"})
+		return
+	}
+
 	userType := user.UserType
 	if userType == "" || userType == "unknown" {
 		userType = "retail"
 	}
 
-	summary, err := model.CalculateDeliveryFee(items, userType)
+	summary, err := model.CalculateDeliveryFeeForAddress(items, userType, address)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "计算配送费失败"})
 		return
 	}
 
-	orderAmount := 0.0
-	categoryIDSet := make(map[int]struct{})
-	productIDs := make([]int, 0, len(items))
-	for _, item := range items {
-		var price float64
-		if userType == "wholesale" {
-			price = item.SpecSnapshot.WholesalePrice
-			if price <= 0 {
-				price = item.SpecSnapshot.RetailPrice
-			}
-		} else {
-			price = item.SpecSnapshot.RetailPrice
-			if price <= 0 {
-				price = item.SpecSnapshot.WholesalePrice
-			}
-		}
-		if price <= 0 {
-			price = item.SpecSnapshot.Cost
-		}
-		if price < 0 {
-			price = 0
-		}
-		orderAmount += price * float64(item.Quantity)
-		productIDs = append(productIDs, item.ProductID)
+	couponItems, err := model.BuildCouponOrderItems(items, userType, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "计算优惠券失败: " + err.Error()})
+		return
 	}
-
-	categoryInfo, _ := model.FetchProductCategoryInfo(productIDs)
-	for _, info := range categoryInfo {
-		if info.CategoryID > 0 {
-			categoryIDSet[info.CategoryID] = struct{}{}
-		}
-		if info.ParentID > 0 {
-			categoryIDSet[info.ParentID] = struct{}{}
-		}
+	availableCoupons, _ := model.GetAvailableCouponsForPurchaseList(user.ID, couponItems, summary.DeliveryFee, summary.IsFreeShipping)
+	var appliedCombination model.BestCouponCombination
+	if len(req.CouponIDs) > 0 {
+		appliedCombination = model.CalculateCouponCombinationForUserCoupons(
+			availableCoupons, couponItems, summary.DeliveryFee, summary.IsFreeShipping, req.CouponIDs,
+		)
+	} else {
+		appliedCombination = model.CalculateCouponCombinationWithSelection(
+			availableCoupons, couponItems, summary.DeliveryFee, summary.IsFreeShipping,
+			req.DeliveryCouponID, req.AmountCouponID,
+		)
 	}
-	categoryIDs := make([]int, 0, len(categoryIDSet))
-	for id := range categoryIDSet {
-		categoryIDs = append(categoryIDs, id)
+
+	pointsDiscount, err := model.ValidatePointsRedemption(user.ID, summary.TotalAmount, appliedCombination.TotalDiscount, req.UsePoints)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
 	}
 
-	availableCoupons, _ := model.GetAvailableCouponsForPurchaseList(user.ID, orderAmount, categoryIDs, summary.DeliveryFee, summary.IsFreeShipping)
-	appliedCombination := model.CalculateCouponCombinationWithSelection(
-		availableCoupons, orderAmount, summary.DeliveryFee, summary.IsFreeShipping,
-		req.DeliveryCouponID, req.AmountCouponID,
-	)
+	deliverySlot := newDeliverySlotSelection(req.DeliverySlotID, req.DeliveryDate)
+	if _, err := model.ValidateDeliverySlotSelection(deliverySlot, address, model.TotalDeliveryUnits(items)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
 
 	urgentFee := 0.0
 	if req.IsUrgent {
@@ -149,19 +145,15 @@ func WeChatPrepayFromCheckout(c *gin.Context) {
 		TrustReceipt:        req.TrustReceipt,
 		HidePrice:           req.HidePrice,
 		RequirePhoneContact: req.RequirePhoneContact,
-		PointsDiscount:      req.PointsDiscount,
+		PointsDiscount:      pointsDiscount,
+		PointsUsed:          req.UsePoints,
 		CouponDiscount:      appliedCombination.TotalDiscount,
 		IsUrgent:            req.IsUrgent,
 		UrgentFee:           urgentFee,
-		DeliveryFeeCouponID: 0,
-		AmountCouponID:      0,
+		UserCouponIDs:       appliedCombination.UserCouponIDs(),
+		CouponSavings:       appliedCombination.SavedByUserCouponID(),
 		PaymentMethod:       "online",
-	}
-	if appliedCombination.DeliveryFeeCoupon != nil && appliedCombination.DeliveryFeeCoupon.UserCouponID > 0 {
-		options.DeliveryFeeCouponID = appliedCombination.DeliveryFeeCoupon.UserCouponID
-	}
-	if appliedCombination.AmountCoupon != nil && appliedCombination.AmountCoupon.UserCouponID > 0 {
-		options.AmountCouponID = appliedCombination.AmountCoupon.UserCouponID
+		DeliverySlot:        deliverySlot,
 	}
 
 	goodsAmount := summary.TotalAmount
@@ -169,11 +161,7 @@ func WeChatPrepayFromCheckout(c *gin.Context) {
 	if summary.IsFreeShipping {
 		deliveryFee = 0
 	}
-	pointsDiscount := options.PointsDiscount
 	couponDiscount := options.CouponDiscount
-	if pointsDiscount < 0 {
-		pointsDiscount = 0
-	}
 	if couponDiscount < 0 {
 		couponDiscount = 0
 	}
@@ -199,7 +187,10 @@ func WeChatPrepayFromCheckout(c *gin.Context) {
 		Options:   options,
 		ItemIDs:   req.ItemIDs,
 	}
-	SetPrepayCache(outTradeNo, cacheEntry)
+	if err := SetPrepayCache(outTradeNo, cacheEntry); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "创建预支付失败，请稍后重试"})
+		return
+	}
 	log.Printf("[WeChatPrepayFromCheckout] 预支付缓存已写入 out_trade_no=%s", outTradeNo)
 
 	cfg, err := getWechatPayConfig()
@@ -0,0 +1,359 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go_backend/internal/model"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wechatpay-apiv3/wechatpay-go/core"
+	"github.com/wechatpay-apiv3/wechatpay-go/core/option"
+	"github.com/wechatpay-apiv3/wechatpay-go/utils"
+)
+
+// wechatReconcileHour 每日自动对账时间（微信次日 9 点后生成前一日账单）
+const wechatReconcileHour = 10
+
+// wechatReconciliationPayload 自动对账任务参数
+type wechatReconciliationPayload struct {
+	BillDate string `json:"bill_date"`
+}
+
+func init() {
+	model.RegisterJobHandler(model.JobWechatReconciliation, runWechatReconciliationJob)
+	// 下载和逐笔核对全日账单耗时较长，放宽超时回收时长，避免执行中被回收后重复对账
+	model.SetJobStaleTimeout(model.JobWechatReconciliation, 30*time.Minute)
+}
+
+// ScheduleWechatReconciliation 启动时安排前一日账单的自动对账，之后每日由任务自行安排下一日
+func ScheduleWechatReconciliation() {
+	enqueueWechatReconciliation(time.Now().AddDate(0, 0, -1).Format("2006-01-02"))
+}
+
+// enqueueWechatReconciliation 安排指定账单日的对账任务，在账单日次日 10 点执行
+func enqueueWechatReconciliation(billDate string) {
+	day, err := time.ParseInLocation("2006-01-02", billDate, time.Local)
+	if err != nil {
+		return
+	}
+	runAt := day.AddDate(0, 0, 1).Add(wechatReconcileHour * time.Hour)
+	delay := time.Until(runAt)
+	if delay < 0 {
+		delay = 0
+	}
+	key := fmt.Sprintf("%s:%s", model.JobWechatReconciliation, billDate)
+	opts := model.JobOptions{IdempotencyKey: key, Delay: delay}
+	if err := model.EnqueueJob(model.JobWechatReconciliation, wechatReconciliationPayload{BillDate: billDate}, opts); err != nil {
+		log.Printf("[WechatReconcile] 安排 %s 对账任务失败: %v", billDate, err)
+	}
+}
+
+func runWechatReconciliationJob(payload []byte) error {
+	var p wechatReconciliationPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("解析任务参数失败: %v", err)
+	}
+	day, err := time.ParseInLocation("2006-01-02", p.BillDate, time.Local)
+	if err != nil {
+		return fmt.Errorf("账单日期格式不正确: %s", p.BillDate)
+	}
+	// 先安排下一日，保证本次失败或未配置微信支付时每日任务不中断
+	enqueueWechatReconciliation(day.AddDate(0, 0, 1).Format("2006-01-02"))
+
+	if _, err := getWechatPayConfig(); err != nil {
+		log.Printf("[WechatReconcile] 未配置微信支付，跳过 %s 对账", p.BillDate)
+		return nil
+	}
+	run, err := reconcileDownloadedWechatBill(p.BillDate, "system")
+	if err != nil {
+		return err
+	}
+	log.Printf("[WechatReconcile] %s 自动对账完成：支付 %d 笔，退款 %d 笔，差异 %d 笔", run.BillDate, run.TradeCount, run.RefundCount, run.DiscrepancyCount)
+	return nil
+}
+
+// reconcileDownloadedWechatBill 从微信下载指定日期的全部交易账单（含退款）并对账
+func reconcileDownloadedWechatBill(billDate, operator string) (*model.WechatReconciliationRun, error) {
+	data, err := downloadWechatTradeBill(billDate)
+	if err != nil {
+		return nil, err
+	}
+	var rows []model.WechatBillRow
+	if len(data) > 0 {
+		if rows, err = model.ParseWechatBill(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+	return model.ReconcileWechatBill(model.WechatReconcileInput{
+		BillDate: billDate,
+		Source:   model.ReconcileSourceDownload,
+		FileName: fmt.Sprintf("tradebill_%s_ALL.csv", billDate),
+		Operator: operator,
+		Rows:     rows,
+	})
+}
+
+// downloadWechatTradeBill 下载微信支付交易账单（bill_type=ALL，含支付和退款）；当日无交易时返回空
+func downloadWechatTradeBill(billDate string) ([]byte, error) {
+	cfg, err := getWechatPayConfig()
+	if err != nil {
+		return nil, err
+	}
+	mchPrivateKey, err := utils.LoadPrivateKey(cfg.PrivateKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("加载商户私钥失败: %w", err)
+	}
+
+	ctx := context.Background()
+	var clientOpts []core.ClientOption
+	if cfg.PublicKeyID != "" && cfg.PublicKeyPEM != "" {
+		wechatPubKey, err := utils.LoadPublicKey(cfg.PublicKeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("加载微信支付公钥失败: %w", err)
+		}
+		clientOpts = []core.ClientOption{
+			option.WithWechatPayPublicKeyAuthCipher(cfg.MchID, cfg.SerialNo, mchPrivateKey, cfg.PublicKeyID, wechatPubKey),
+		}
+	} else {
+		clientOpts = []core.ClientOption{
+			option.WithWechatPayAutoAuthCipher(cfg.MchID, cfg.SerialNo, mchPrivateKey, cfg.APIv3Key),
+		}
+	}
+	client, err := core.NewClient(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("初始化微信支付客户端失败: %w", err)
+	}
+
+	// 第一步：申请账单，获取下载地址
+	billURL := "https://api.mch.weixin.qq.com/v3/bill/tradebill?bill_type=ALL&bill_date=" + url.QueryEscape(billDate)
+	result, err := client.Get(ctx, billURL)
+	if err != nil {
+		if core.IsAPIError(err, "NO_STATEMENT_EXIST") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("申请交易账单失败: %w", err)
+	}
+	defer result.Response.Body.Close()
+	var bill struct {
+		DownloadURL string `json:"download_url"`
+	}
+	if err := json.NewDecoder(result.Response.Body).Decode(&bill); err != nil || bill.DownloadURL == "" {
+		return nil, fmt.Errorf("解析账单下载地址失败: %v", err)
+	}
+
+	// 第二步：下载账单文件，应答不带签名，需跳过验签
+	downloadClient, err := core.NewClient(ctx,
+		option.WithMerchantCredential(cfg.MchID, cfg.SerialNo, mchPrivateKey),
+		option.WithoutValidator(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("初始化账单下载客户端失败: %w", err)
+	}
+	fileResult, err := downloadClient.Get(ctx, bill.DownloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("下载交易账单失败: %w", err)
+	}
+	defer fileResult.Response.Body.Close()
+	return io.ReadAll(fileResult.Response.Body)
+}
+
+// UploadWechatReconciliation 上传微信账单文件对账（管理后台）
+// 表单字段：bill_date（YYYY-MM-DD）、trade_file（交易账单 CSV）、refund_file（可选，退款账单 CSV）
+func UploadWechatReconciliation(c *gin.Context) {
+	billDate := strings.TrimSpace(c.PostForm("bill_date"))
+	if billDate == "" {
+		badRequestResponse(c, "请填写账单日期")
+		return
+	}
+
+	var rows []model.WechatBillRow
+	var fileNames []string
+	for _, field := range []string{"trade_file", "refund_file"} {
+		file, header, err := c.Request.FormFile(field)
+		if err != nil {
+			if field == "trade_file" {
+				badRequestResponse(c, "请上传交易账单文件")
+				return
+			}
+			continue
+		}
+		parsed, err := model.ParseWechatBill(file)
+		file.Close()
+		if err != nil {
+			badRequestResponse(c, header.Filename+": "+err.Error())
+			return
+		}
+		rows = append(rows, parsed...)
+		fileNames = append(fileNames, header.Filename)
+	}
+
+	run, err := model.ReconcileWechatBill(model.WechatReconcileInput{
+		BillDate: billDate,
+		Source:   model.ReconcileSourceUpload,
+		FileName: strings.Join(fileNames, ","),
+		Operator: getAdminOperatorName(c),
+		Rows:     rows,
+	})
+	if err != nil {
+		internalErrorResponse(c, "对账失败: "+err.Error())
+		return
+	}
+	successResponse(c, run, "对账完成")
+}
+
+// RunWechatReconciliation 从微信下载指定日期账单并对账（管理后台）
+func RunWechatReconciliation(c *gin.Context) {
+	var req struct {
+		BillDate string `json:"bill_date" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "请填写账单日期")
+		return
+	}
+	run, err := reconcileDownloadedWechatBill(req.BillDate, getAdminOperatorName(c))
+	if err != nil {
+		internalErrorResponse(c, "对账失败: "+err.Error())
+		return
+	}
+	successResponse(c, run, "对账完成")
+}
+
+// GetWechatReconciliationRuns 对账批次列表（管理后台）
+func GetWechatReconciliationRuns(c *gin.Context) {
+	pageNum := parseQueryInt(c, "pageNum", 1)
+	pageSize := parseQueryInt(c, "pageSize", 20)
+	list, total, err := model.GetWechatReconciliationRuns(pageNum, pageSize)
+	if err != nil {
+		internalErrorResponse(c, "获取对账记录失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"list":  list,
+		"total": total,
+	}, "")
+}
+
+// GetWechatReconciliationDiscrepancies 对账差异列表（管理后台），可按批次、账单日期、类型、状态筛选
+func GetWechatReconciliationDiscrepancies(c *gin.Context) {
+	pageNum := parseQueryInt(c, "pageNum", 1)
+	pageSize := parseQueryInt(c, "pageSize", 20)
+	list, total, err := model.GetWechatReconciliationDiscrepancies(wechatDiscrepancyFilterFromQuery(c), pageNum, pageSize)
+	if err != nil {
+		internalErrorResponse(c, "获取对账差异失败: "+err.Error())
+		return
+	}
+	successResponse(c, gin.H{
+		"list":  list,
+		"total": total,
+	}, "")
+}
+
+// ExportWechatReconciliationDiscrepancies 导出对账差异（CSV，管理后台），筛选条件同列表
+func ExportWechatReconciliationDiscrepancies(c *gin.Context) {
+	list, _, err := model.GetWechatReconciliationDiscrepancies(wechatDiscrepancyFilterFromQuery(c), 1, 0)
+	if err != nil {
+		internalErrorResponse(c, "导出对账差异失败: "+err.Error())
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\ufeff") // Excel 识别 UTF-8
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{"账单日期", "差异类型", "商户订单号", "微信支付单号", "微信退款单号", "订单ID", "账单金额", "系统金额", "差异说明", "处理状态", "处理人", "处理备注"})
+	for _, d := range list {
+		_ = w.Write([]string{
+			d.BillDate,
+			wechatDiscrepancyTypeName(d.Type),
+			d.OutTradeNo,
+			d.TransactionID,
+			d.RefundID,
+			formatOptionalInt(d.OrderID),
+			formatOptionalAmount(d.BillAmount),
+			formatOptionalAmount(d.SystemAmount),
+			d.Detail,
+			d.Status,
+			derefString(d.ResolvedBy),
+			derefString(d.Remark),
+		})
+	}
+	w.Flush()
+
+	fileName := fmt.Sprintf("wechat_reconciliation_%s.csv", time.Now().Format("20060102150405"))
+	c.Header("Content-Disposition", "attachment; filename="+fileName)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// ResolveWechatReconciliationDiscrepancy 标记对账差异已处理（管理后台）
+func ResolveWechatReconciliationDiscrepancy(c *gin.Context) {
+	id, ok := parseID(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Remark string `json:"remark" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		badRequestResponse(c, "请填写处理说明")
+		return
+	}
+	if err := model.ResolveWechatReconciliationDiscrepancy(id, getAdminOperatorName(c), req.Remark); err != nil {
+		badRequestResponse(c, err.Error())
+		return
+	}
+	successResponse(c, nil, "已标记为已处理")
+}
+
+func wechatDiscrepancyFilterFromQuery(c *gin.Context) model.WechatDiscrepancyFilter {
+	return model.WechatDiscrepancyFilter{
+		RunID:    parseQueryInt(c, "run_id", 0),
+		BillDate: strings.TrimSpace(c.Query("bill_date")),
+		Type:     strings.TrimSpace(c.Query("type")),
+		Status:   strings.TrimSpace(c.Query("status")),
+	}
+}
+
+func wechatDiscrepancyTypeName(t string) string {
+	switch t {
+	case model.ReconcilePaidNoOrder:
+		return "有支付无订单"
+	case model.ReconcileOrderMissing:
+		return "订单已支付账单缺失"
+	case model.ReconcileAmountMismatch:
+		return "金额不一致"
+	case model.ReconcileRefundMismatch:
+		return "退款不一致"
+	default:
+		return t
+	}
+}
+
+func formatOptionalInt(v *int) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d", *v)
+}
+
+func formatOptionalAmount(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%.2f", *v)
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
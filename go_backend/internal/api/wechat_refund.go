@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"fmt"
+	"log"
 	"math"
 	"time"
 
@@ -14,7 +15,7 @@ import (
 	"github.com/wechatpay-apiv3/wechatpay-go/utils"
 )
 
-// RequestWechatRefund 对已支付订单发起微信退款（取消时调用）
+// RequestWechatRefund 对已支付订单发起微信退款（取消时调用），退还原支付总额中尚未退款的部分
 // reason 可选，为空时使用默认原因
 // 返回 (refundID, error)
 func RequestWechatRefund(order *model.Order, reason string) (string, error) {
@@ -51,15 +52,24 @@ func RequestWechatRefund(order *model.Order, reason string) (string, error) {
 		return "", fmt.Errorf("初始化微信支付客户端失败: %w", err)
 	}
 
+	// 商户退款单号：订单号_refund，保证幂等
+	outRefundNo := order.OrderNumber + "_refund"
+
+	// 微信要求订单总额为原支付金额；退款金额扣除此前的缺货/售后部分退款（重试时不计本退款单）
+	refunded, err := model.GetWechatRefundedAmount(order.OrderNumber, outRefundNo)
+	if err != nil {
+		return "", fmt.Errorf("查询已退款金额失败: %w", err)
+	}
 	// 金额转分，避免浮点精度问题
-	amountFen := int64(math.Round(order.TotalAmount * 100))
+	totalFen := int64(math.Round(order.PaidTotal() * 100))
+	if totalFen < 1 {
+		totalFen = 1
+	}
+	amountFen := totalFen - int64(math.Round(refunded*100))
 	if amountFen < 1 {
-		amountFen = 1
+		return "", fmt.Errorf("订单已全额退款")
 	}
 
-	// 商户退款单号：订单号_refund，保证幂等
-	outRefundNo := order.OrderNumber + "_refund"
-
 	svc := refunddomestic.RefundsApiService{Client: client}
 	req := refunddomestic.CreateRequest{
 		OutTradeNo:  core.String(order.OrderNumber),
@@ -67,7 +77,7 @@ func RequestWechatRefund(order *model.Order, reason string) (string, error) {
 		Reason:      core.String(reason),
 		Amount: &refunddomestic.AmountReq{
 			Refund:   core.Int64(amountFen),
-			Total:    core.Int64(amountFen),
+			Total:    core.Int64(totalFen),
 			Currency: core.String("CNY"),
 		},
 	}
@@ -87,6 +97,7 @@ func RequestWechatRefund(order *model.Order, reason string) (string, error) {
 	if resp != nil && resp.RefundId != nil {
 		refundID = *resp.RefundId
 	}
+	recordWechatRefund(order.OrderNumber, outRefundNo, refundID, float64(amountFen)/100, reason)
 	return refundID, nil
 }
 
@@ -94,21 +105,26 @@ func RequestWechatRefund(order *model.Order, reason string) (string, error) {
 type RefundOptions struct {
 	RefundAmount float64 // 退款金额（元），0 表示全额
 	Reason       string  // 退款原因描述
+	OutRefundNo  string  // 商户退款单号，为空时按时间生成（重试需幂等时指定）
 }
 
 // RequestWechatRefundWithOptions 售后退款：支持指定金额和自定义原因
-// 用于部分退款、售后补偿等场景
+// 用于部分退款、售后补偿等场景；订单总额按原支付金额（含缺货调减部分）提交，退款金额不超过剩余可退金额
 func RequestWechatRefundWithOptions(order *model.Order, opts RefundOptions) (string, error) {
 	reason := opts.Reason
 	if reason == "" {
 		reason = "售后退款"
 	}
+	refundable, err := model.GetOrderRefundableAmount(order)
+	if err != nil {
+		return "", fmt.Errorf("查询可退金额失败: %w", err)
+	}
 	refundAmount := opts.RefundAmount
 	if refundAmount <= 0 {
-		refundAmount = order.TotalAmount
+		refundAmount = refundable
 	}
-	if refundAmount > order.TotalAmount {
-		return "", fmt.Errorf("退款金额不能超过订单实付金额 %.2f 元", order.TotalAmount)
+	if refundAmount > refundable+0.001 {
+		return "", fmt.Errorf("退款金额不能超过订单剩余可退金额 %.2f 元", refundable)
 	}
 
 	cfg, err := getWechatPayConfig()
@@ -141,7 +157,7 @@ func RequestWechatRefundWithOptions(order *model.Order, opts RefundOptions) (str
 		return "", fmt.Errorf("初始化微信支付客户端失败: %w", err)
 	}
 
-	totalFen := int64(math.Round(order.TotalAmount * 100))
+	totalFen := int64(math.Round(order.PaidTotal() * 100))
 	if totalFen < 1 {
 		totalFen = 1
 	}
@@ -151,7 +167,10 @@ func RequestWechatRefundWithOptions(order *model.Order, opts RefundOptions) (str
 	}
 
 	// 售后退款使用唯一单号，支持同一订单多次部分退款
-	outRefundNo := fmt.Sprintf("%s_refund_aftersale_%d", order.OrderNumber, time.Now().UnixNano()/1e6)
+	outRefundNo := opts.OutRefundNo
+	if outRefundNo == "" {
+		outRefundNo = fmt.Sprintf("%s_refund_aftersale_%d", order.OrderNumber, time.Now().UnixNano()/1e6)
+	}
 
 	svc := refunddomestic.RefundsApiService{Client: client}
 	req := refunddomestic.CreateRequest{
@@ -179,5 +198,20 @@ func RequestWechatRefundWithOptions(order *model.Order, opts RefundOptions) (str
 	if resp != nil && resp.RefundId != nil {
 		refundID = *resp.RefundId
 	}
+	recordWechatRefund(order.OrderNumber, outRefundNo, refundID, float64(refundFen)/100, reason)
 	return refundID, nil
 }
+
+// recordWechatRefund 记录已受理的微信退款，用于退款账单对账；记录失败不影响退款本身
+func recordWechatRefund(outTradeNo, outRefundNo, refundID string, amount float64, reason string) {
+	err := model.RecordWechatRefund(&model.WechatRefundRecord{
+		OutTradeNo:  outTradeNo,
+		OutRefundNo: outRefundNo,
+		RefundID:    refundID,
+		Amount:      amount,
+		Reason:      reason,
+	})
+	if err != nil {
+		log.Printf("[WechatRefund] 记录退款失败 out_refund_no=%s refund_id=%s: %v", outRefundNo, refundID, err)
+	}
+}
@@ -95,6 +95,11 @@ func WeChatRefundNotify(c *gin.Context) {
 		return
 	}
 
+	// 更新退款记录状态（含尚未生成订单的支付异常退款）
+	if err := model.UpdateWechatRefundStatus(res.RefundID, res.RefundStatus); err != nil {
+		log.Printf("[WeChatRefundNotify] 更新退款记录失败: refund_id=%s err=%v", res.RefundID, err)
+	}
+
 	order, err := model.GetOrderByOrderNumber(outTradeNo)
 	if err != nil || order == nil {
 		log.Printf("[WeChatRefundNotify] 订单不存在: out_trade_no=%s", outTradeNo)
@@ -110,12 +115,19 @@ func WeChatRefundNotify(c *gin.Context) {
 		} else {
 			log.Printf("[WeChatRefundNotify] 退款成功: orderID=%d out_trade_no=%s refund_id=%s", order.ID, outTradeNo, res.RefundID)
 		}
+		// 售后退款：完成对应的售后申请
+		if err := model.CompleteAfterSalesByWechatRefundID(res.RefundID); err != nil {
+			log.Printf("[WeChatRefundNotify] 完成售后失败: refund_id=%s err=%v", res.RefundID, err)
+		}
 	case "CLOSED", "ABNORMAL":
 		if err := model.MarkOrderRefundFailed(order.ID); err != nil {
 			log.Printf("[WeChatRefundNotify] 更新退款失败状态失败: orderID=%d err=%v", order.ID, err)
 		} else {
 			log.Printf("[WeChatRefundNotify] 退款失败/关闭: orderID=%d out_trade_no=%s status=%s", order.ID, outTradeNo, res.RefundStatus)
 		}
+		if err := model.FailAfterSalesByWechatRefundID(res.RefundID, res.RefundStatus); err != nil {
+			log.Printf("[WeChatRefundNotify] 更新售后退款失败状态失败: refund_id=%s err=%v", res.RefundID, err)
+		}
 	default:
 		log.Printf("[WeChatRefundNotify] 未知退款状态: %s out_trade_no=%s", res.RefundStatus, outTradeNo)
 	}
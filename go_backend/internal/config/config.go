@@ -42,6 +42,9 @@ var Config = struct {
 		EmployeeLocationURL string `json:"employee_location_url"` // 配送员位置上报WebSocket URL
 		AdminLocationURL    string `json:"admin_location_url"`    // 管理后台位置查看WebSocket URL
 	} `json:"websocket"`
+	PrepayStore struct {
+		Driver string `json:"driver"` // 预支付缓存存储：mysql（默认，重启不丢失）或 memory（仅本地开发）
+	} `json:"prepay_store"`
 }{}
 
 // InitConfig 初始化配置
@@ -80,4 +83,6 @@ func InitConfig() {
 	Config.WebSocket.EmployeeLocationURL = "/api/mini/employee/location/ws"
 	// 管理后台位置查看WebSocket URL（相对路径，会自动拼接服务器地址）
 	Config.WebSocket.AdminLocationURL = "/api/mini/admin/employee-locations/ws"
+	// 预支付缓存存储（mysql 或 memory）
+	Config.PrepayStore.Driver = "mysql"
 }
@@ -757,12 +757,21 @@ func InitDB() error {
 		CREATE TABLE IF NOT EXISTS coupons (
 		    id INT PRIMARY KEY AUTO_INCREMENT,
 		    name VARCHAR(100) NOT NULL COMMENT '优惠券名称',
-		    type ENUM('delivery_fee','amount') NOT NULL COMMENT '类型：delivery_fee-配送费券，amount-金额券',
-		    discount_value DECIMAL(10,2) NOT NULL DEFAULT 0 COMMENT '优惠值：配送费券为0（全免），金额券为具体金额',
+		    type ENUM('delivery_fee','amount','percent') NOT NULL COMMENT '类型：delivery_fee-配送费券，amount-金额券，percent-折扣券',
+		    discount_value DECIMAL(10,2) NOT NULL DEFAULT 0 COMMENT '优惠值：配送费券为0（全免），金额券为具体金额，折扣券为优惠百分比',
+		    max_discount DECIMAL(10,2) NOT NULL DEFAULT 0 COMMENT '折扣券最高优惠金额，0表示不限',
 		    min_amount DECIMAL(10,2) NOT NULL DEFAULT 0 COMMENT '最低使用金额，0表示无门槛',
 		    category_ids TEXT DEFAULT NULL COMMENT '适用分类ID（JSON数组），空表示全品类',
+		    product_ids TEXT DEFAULT NULL COMMENT '适用商品ID（JSON数组），空表示不限',
+		    spec_keys TEXT DEFAULT NULL COMMENT '适用规格（JSON数组，格式为 商品ID:规格名），空表示不限',
+		    supplier_ids TEXT DEFAULT NULL COMMENT '适用供应商ID（JSON数组），空表示不限',
+		    exclude_product_ids TEXT DEFAULT NULL COMMENT '排除商品ID（JSON数组）',
+		    exclude_category_ids TEXT DEFAULT NULL COMMENT '排除分类ID（JSON数组）',
+		    per_user_limit INT NOT NULL DEFAULT 0 COMMENT '每个用户最多使用次数，0表示不限',
+		    stack_mode VARCHAR(20) NOT NULL DEFAULT 'different_type' COMMENT '叠加规则：exclusive-不可叠加，different_type-可与其他类型叠加，any-可任意叠加',
 		    total_count INT NOT NULL DEFAULT 0 COMMENT '发放总数，0表示不限制',
 		    used_count INT NOT NULL DEFAULT 0 COMMENT '已使用数量',
+		    expired_count INT NOT NULL DEFAULT 0 COMMENT '已过期数量（每日过期任务统计）',
 		    status TINYINT DEFAULT 1 COMMENT '状态：1-启用，0-禁用',
 		    valid_from DATETIME NOT NULL COMMENT '有效期开始时间',
 		    valid_to DATETIME NOT NULL COMMENT '有效期结束时间',
@@ -779,6 +788,40 @@ func InitDB() error {
 			return
 		}
 
+		// 检查 coupons 表的折扣券、适用范围、限用和叠加规则字段
+		var couponMaxDiscountExists int
+		checkCouponMaxDiscountQuery := `SELECT COUNT(*) FROM information_schema.COLUMNS 
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'coupons' AND COLUMN_NAME = 'max_discount'`
+		if err := DB.QueryRow(checkCouponMaxDiscountQuery).Scan(&couponMaxDiscountExists); err == nil && couponMaxDiscountExists == 0 {
+			if _, err = DB.Exec(`ALTER TABLE coupons
+				MODIFY COLUMN type ENUM('delivery_fee','amount','percent') NOT NULL COMMENT '类型：delivery_fee-配送费券，amount-金额券，percent-折扣券',
+				MODIFY COLUMN discount_value DECIMAL(10,2) NOT NULL DEFAULT 0 COMMENT '优惠值：配送费券为0（全免），金额券为具体金额，折扣券为优惠百分比',
+				ADD COLUMN max_discount DECIMAL(10,2) NOT NULL DEFAULT 0 COMMENT '折扣券最高优惠金额，0表示不限' AFTER discount_value,
+				ADD COLUMN product_ids TEXT DEFAULT NULL COMMENT '适用商品ID（JSON数组），空表示不限' AFTER category_ids,
+				ADD COLUMN spec_keys TEXT DEFAULT NULL COMMENT '适用规格（JSON数组，格式为 商品ID:规格名），空表示不限' AFTER product_ids,
+				ADD COLUMN supplier_ids TEXT DEFAULT NULL COMMENT '适用供应商ID（JSON数组），空表示不限' AFTER spec_keys,
+				ADD COLUMN exclude_product_ids TEXT DEFAULT NULL COMMENT '排除商品ID（JSON数组）' AFTER supplier_ids,
+				ADD COLUMN exclude_category_ids TEXT DEFAULT NULL COMMENT '排除分类ID（JSON数组）' AFTER exclude_product_ids,
+				ADD COLUMN per_user_limit INT NOT NULL DEFAULT 0 COMMENT '每个用户最多使用次数，0表示不限' AFTER exclude_category_ids,
+				ADD COLUMN stack_mode VARCHAR(20) NOT NULL DEFAULT 'different_type' COMMENT '叠加规则：exclusive-不可叠加，different_type-可与其他类型叠加，any-可任意叠加' AFTER per_user_limit`); err != nil {
+				log.Printf("添加优惠券规则字段失败: %v", err)
+			} else {
+				log.Println("已添加max_discount/product_ids/spec_keys/supplier_ids/exclude_product_ids/exclude_category_ids/per_user_limit/stack_mode字段到coupons表")
+			}
+		}
+
+		// 检查 coupons 表的 expired_count 字段
+		var couponExpiredCountExists int
+		checkCouponExpiredCountQuery := `SELECT COUNT(*) FROM information_schema.COLUMNS 
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'coupons' AND COLUMN_NAME = 'expired_count'`
+		if err := DB.QueryRow(checkCouponExpiredCountQuery).Scan(&couponExpiredCountExists); err == nil && couponExpiredCountExists == 0 {
+			if _, err = DB.Exec(`ALTER TABLE coupons ADD COLUMN expired_count INT NOT NULL DEFAULT 0 COMMENT '已过期数量（每日过期任务统计）' AFTER used_count`); err != nil {
+				log.Printf("添加expired_count字段失败: %v", err)
+			} else {
+				log.Println("已添加expired_count字段到coupons表")
+			}
+		}
+
 		// 创建用户优惠券关联表
 		createUserCouponsTableSQL := `
 		CREATE TABLE IF NOT EXISTS user_coupons (
@@ -789,6 +832,7 @@ func InitDB() error {
 		    used_at DATETIME DEFAULT NULL COMMENT '使用时间',
 		    order_id INT DEFAULT NULL COMMENT '订单ID（使用时的订单）',
 		    expires_at DATETIME DEFAULT NULL COMMENT '有效期（发放时设置，过期后无法使用）',
+		    saved_amount DECIMAL(10,2) DEFAULT NULL COMMENT '核销时该券实际优惠金额（多券叠加时按券拆分）',
 		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 		    KEY idx_user_id (user_id),
@@ -812,7 +856,7 @@ func InitDB() error {
 		    coupon_name VARCHAR(255) NOT NULL COMMENT '优惠券名称快照',
 		    quantity INT NOT NULL DEFAULT 1 COMMENT '发放数量',
 		    reason VARCHAR(255) NOT NULL COMMENT '发放原因',
-		    operator_type VARCHAR(20) NOT NULL COMMENT '操作人类型：admin/employee',
+		    operator_type VARCHAR(20) NOT NULL COMMENT '操作人类型：admin/employee/self_service（客户领券或兑换）',
 		    operator_id INT NOT NULL COMMENT '操作人ID',
 		    operator_name VARCHAR(100) NOT NULL COMMENT '操作人名称',
 		    expires_at DATETIME DEFAULT NULL COMMENT '到期时间',
@@ -828,6 +872,123 @@ func InitDB() error {
 			return
 		}
 
+		// 创建领券活动表（小程序领券中心）
+		createCouponCampaignsTableSQL := `
+		CREATE TABLE IF NOT EXISTS coupon_campaigns (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    name VARCHAR(100) NOT NULL COMMENT '活动名称',
+		    coupon_id INT NOT NULL COMMENT '领取的优惠券ID',
+		    description VARCHAR(500) NOT NULL DEFAULT '' COMMENT '活动说明',
+		    per_user_limit INT NOT NULL DEFAULT 1 COMMENT '每个用户最多领取次数',
+		    total_stock INT NOT NULL DEFAULT 0 COMMENT '活动可领取总数，0表示只受优惠券发放总数限制',
+		    claimed_count INT NOT NULL DEFAULT 0 COMMENT '已领取数量',
+		    expires_in_days INT NOT NULL DEFAULT 0 COMMENT '领取后有效天数，0表示使用优惠券有效期',
+		    start_at DATETIME NOT NULL COMMENT '领取开始时间',
+		    end_at DATETIME NOT NULL COMMENT '领取结束时间',
+		    status TINYINT NOT NULL DEFAULT 1 COMMENT '状态：1-启用，0-停用',
+		    sort_order INT NOT NULL DEFAULT 0 COMMENT '排序，越小越靠前',
+		    created_by VARCHAR(100) NOT NULL DEFAULT '' COMMENT '创建人',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    KEY idx_coupon_id (coupon_id),
+		    KEY idx_status_time (status, start_at, end_at)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='领券活动表';
+		`
+
+		if _, err = DB.Exec(createCouponCampaignsTableSQL); err != nil {
+			log.Printf("创建coupon_campaigns表失败: %v", err)
+			return
+		}
+
+		// 创建领券记录表
+		createCouponCampaignClaimsTableSQL := `
+		CREATE TABLE IF NOT EXISTS coupon_campaign_claims (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    campaign_id INT NOT NULL COMMENT '领券活动ID',
+		    user_id INT NOT NULL COMMENT '用户ID',
+		    user_coupon_id INT NOT NULL COMMENT '领取得到的用户优惠券ID',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '领取时间',
+		    KEY idx_campaign_user (campaign_id, user_id),
+		    KEY idx_user_id (user_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='领券记录表';
+		`
+
+		if _, err = DB.Exec(createCouponCampaignClaimsTableSQL); err != nil {
+			log.Printf("创建coupon_campaign_claims表失败: %v", err)
+			return
+		}
+
+		// 创建兑换码批次表
+		createCouponCodeBatchesTableSQL := `
+		CREATE TABLE IF NOT EXISTS coupon_code_batches (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    name VARCHAR(100) NOT NULL COMMENT '批次名称',
+		    coupon_id INT NOT NULL COMMENT '兑换的优惠券ID',
+		    quantity INT NOT NULL DEFAULT 0 COMMENT '生成的兑换码数量',
+		    redeemed_count INT NOT NULL DEFAULT 0 COMMENT '已兑换数量',
+		    expires_in_days INT NOT NULL DEFAULT 0 COMMENT '兑换后有效天数，0表示使用优惠券有效期',
+		    redeem_deadline DATETIME DEFAULT NULL COMMENT '兑换截止时间，为空表示不限',
+		    status TINYINT NOT NULL DEFAULT 1 COMMENT '状态：1-启用，0-停用',
+		    remark VARCHAR(255) NOT NULL DEFAULT '' COMMENT '备注（投放渠道等）',
+		    created_by VARCHAR(100) NOT NULL DEFAULT '' COMMENT '创建人',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    KEY idx_coupon_id (coupon_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='优惠券兑换码批次表';
+		`
+
+		if _, err = DB.Exec(createCouponCodeBatchesTableSQL); err != nil {
+			log.Printf("创建coupon_code_batches表失败: %v", err)
+			return
+		}
+
+		// 创建兑换码表（一码一次）
+		createCouponRedeemCodesTableSQL := `
+		CREATE TABLE IF NOT EXISTS coupon_redeem_codes (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    batch_id INT NOT NULL COMMENT '批次ID',
+		    code VARCHAR(32) NOT NULL COMMENT '兑换码',
+		    status VARCHAR(20) NOT NULL DEFAULT 'unused' COMMENT '状态：unused-未兑换，redeemed-已兑换',
+		    user_id INT DEFAULT NULL COMMENT '兑换用户ID',
+		    user_coupon_id INT DEFAULT NULL COMMENT '兑换得到的用户优惠券ID',
+		    redeemed_at DATETIME DEFAULT NULL COMMENT '兑换时间',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    UNIQUE KEY uk_code (code),
+		    KEY idx_batch_status (batch_id, status),
+		    KEY idx_user_id (user_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='优惠券兑换码表';
+		`
+
+		if _, err = DB.Exec(createCouponRedeemCodesTableSQL); err != nil {
+			log.Printf("创建coupon_redeem_codes表失败: %v", err)
+			return
+		}
+
+		// 创建优惠券到期提醒表（每张用户优惠券只提醒一次）
+		createCouponExpiryRemindersTableSQL := `
+		CREATE TABLE IF NOT EXISTS coupon_expiry_reminders (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    user_id INT NOT NULL COMMENT '用户ID',
+		    user_coupon_id INT NOT NULL COMMENT '用户优惠券ID',
+		    coupon_id INT NOT NULL COMMENT '优惠券ID',
+		    coupon_name VARCHAR(100) NOT NULL COMMENT '优惠券名称快照',
+		    expires_at DATETIME NOT NULL COMMENT '优惠券到期时间',
+		    push_status VARCHAR(20) NOT NULL DEFAULT 'pending' COMMENT '订阅消息推送状态：pending-待推送，sent-已推送，failed-推送失败，skipped-未配置不推送',
+		    push_error VARCHAR(255) NOT NULL DEFAULT '' COMMENT '推送失败原因',
+		    pushed_at DATETIME DEFAULT NULL COMMENT '推送时间',
+		    is_read TINYINT(1) NOT NULL DEFAULT 0 COMMENT '小程序是否已读',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '提醒生成时间',
+		    UNIQUE KEY uk_user_coupon_id (user_coupon_id),
+		    KEY idx_user_created (user_id, created_at),
+		    KEY idx_push_status (push_status)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='优惠券到期提醒表';
+		`
+
+		if _, err = DB.Exec(createCouponExpiryRemindersTableSQL); err != nil {
+			log.Printf("创建coupon_expiry_reminders表失败: %v", err)
+			return
+		}
+
 		// 创建订单主表
 		createOrdersTableSQL := `
 		CREATE TABLE IF NOT EXISTS orders (
@@ -1188,6 +1349,102 @@ func InitDB() error {
 			}
 		}
 
+		// 检查 orders 表的 shortage_hold / shortage_amount 字段（取货缺货处理）
+		var shortageHoldExists int
+		checkShortageHoldQuery := `SELECT COUNT(*) FROM information_schema.COLUMNS 
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'orders' AND COLUMN_NAME = 'shortage_hold'`
+		if err := DB.QueryRow(checkShortageHoldQuery).Scan(&shortageHoldExists); err == nil && shortageHoldExists == 0 {
+			if _, err = DB.Exec(`ALTER TABLE orders 
+				ADD COLUMN shortage_hold TINYINT(1) NOT NULL DEFAULT 0 COMMENT '是否因缺货挂起待联系客户' AFTER out_of_stock_strategy,
+				ADD COLUMN shortage_amount DECIMAL(10,2) NOT NULL DEFAULT 0.00 COMMENT '因缺货调减的订单金额（累计）' AFTER shortage_hold`); err != nil {
+				log.Printf("添加shortage_hold/shortage_amount字段失败: %v", err)
+			} else {
+				log.Println("已添加shortage_hold/shortage_amount字段到orders表")
+			}
+		}
+
+		// 检查 orders 表的售后退款字段
+		var afterSalesRefundExists int
+		checkAfterSalesRefundQuery := `SELECT COUNT(*) FROM information_schema.COLUMNS 
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'orders' AND COLUMN_NAME = 'after_sales_refund_amount'`
+		if err := DB.QueryRow(checkAfterSalesRefundQuery).Scan(&afterSalesRefundExists); err == nil && afterSalesRefundExists == 0 {
+			if _, err = DB.Exec(`ALTER TABLE orders 
+				ADD COLUMN after_sales_refund_amount DECIMAL(10,2) NOT NULL DEFAULT 0.00 COMMENT '售后已退款金额（累计）' AFTER shortage_amount,
+				ADD COLUMN after_sales_returned_cost DECIMAL(10,2) NOT NULL DEFAULT 0.00 COMMENT '售后退货商品成本（累计）' AFTER after_sales_refund_amount`); err != nil {
+				log.Printf("添加after_sales_refund_amount/after_sales_returned_cost字段失败: %v", err)
+			} else {
+				log.Println("已添加after_sales_refund_amount/after_sales_returned_cost字段到orders表")
+			}
+		}
+
+		// 检查 orders 表的 points_used 字段（积分抵扣）
+		var pointsUsedExists int
+		checkPointsUsedQuery := `SELECT COUNT(*) FROM information_schema.COLUMNS 
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'orders' AND COLUMN_NAME = 'points_used'`
+		if err := DB.QueryRow(checkPointsUsedQuery).Scan(&pointsUsedExists); err == nil && pointsUsedExists == 0 {
+			if _, err = DB.Exec(`ALTER TABLE orders ADD COLUMN points_used INT NOT NULL DEFAULT 0 COMMENT '积分抵扣使用的积分数量' AFTER points_discount`); err != nil {
+				log.Printf("添加points_used字段失败: %v", err)
+			} else {
+				log.Println("已添加points_used字段到orders表")
+			}
+		}
+
+		// 检查 orders 表的 delivery_slot_id 等字段（预约配送时段）
+		var deliverySlotIDExists int
+		checkDeliverySlotIDQuery := `SELECT COUNT(*) FROM information_schema.COLUMNS 
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'orders' AND COLUMN_NAME = 'delivery_slot_id'`
+		if err := DB.QueryRow(checkDeliverySlotIDQuery).Scan(&deliverySlotIDExists); err == nil && deliverySlotIDExists == 0 {
+			if _, err = DB.Exec(`ALTER TABLE orders 
+				ADD COLUMN delivery_slot_id INT NULL COMMENT '预约配送时段ID' AFTER expected_delivery_at,
+				ADD COLUMN delivery_slot_start DATETIME NULL COMMENT '预约配送时段开始时间' AFTER delivery_slot_id,
+				ADD COLUMN delivery_slot_end DATETIME NULL COMMENT '预约配送时段结束时间' AFTER delivery_slot_start,
+				ADD COLUMN delivery_units DECIMAL(10,2) NOT NULL DEFAULT 0 COMMENT '占用时段容量的配送件数（规格配送计件数×数量）' AFTER delivery_slot_end,
+				ADD INDEX idx_delivery_slot (delivery_slot_id, delivery_slot_start),
+				ADD INDEX idx_delivery_slot_end (delivery_slot_end)`); err != nil {
+				log.Printf("添加delivery_slot_id等字段失败: %v", err)
+			} else {
+				log.Println("已添加delivery_slot_id/delivery_slot_start/delivery_slot_end/delivery_units字段到orders表")
+			}
+		}
+
+		// delivery_units 按规格配送计件数累计，可能为小数，旧表为 INT 时改为 DECIMAL
+		var deliveryUnitsType string
+		checkDeliveryUnitsTypeQuery := `SELECT DATA_TYPE FROM information_schema.COLUMNS 
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'orders' AND COLUMN_NAME = 'delivery_units'`
+		if err := DB.QueryRow(checkDeliveryUnitsTypeQuery).Scan(&deliveryUnitsType); err == nil && deliveryUnitsType == "int" {
+			if _, err = DB.Exec(`ALTER TABLE orders MODIFY COLUMN delivery_units DECIMAL(10,2) NOT NULL DEFAULT 0 COMMENT '占用时段容量的配送件数（规格配送计件数×数量）'`); err != nil {
+				log.Printf("修改delivery_units字段类型失败: %v", err)
+			} else {
+				log.Println("已将orders表delivery_units字段改为DECIMAL")
+			}
+		}
+
+		// 检查 orders 表的 delivery_confirm_code 字段（高金额订单收货确认码）
+		var deliveryConfirmCodeExists int
+		checkDeliveryConfirmCodeQuery := `SELECT COUNT(*) FROM information_schema.COLUMNS 
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'orders' AND COLUMN_NAME = 'delivery_confirm_code'`
+		if err := DB.QueryRow(checkDeliveryConfirmCodeQuery).Scan(&deliveryConfirmCodeExists); err == nil && deliveryConfirmCodeExists == 0 {
+			if _, err = DB.Exec(`ALTER TABLE orders ADD COLUMN delivery_confirm_code VARCHAR(10) NULL COMMENT '收货确认码（高金额订单送达时由客户提供给配送员）' AFTER delivery_units`); err != nil {
+				log.Printf("添加delivery_confirm_code字段失败: %v", err)
+			} else {
+				log.Println("已添加delivery_confirm_code字段到orders表")
+			}
+		}
+
+		// 检查 orders 表的 delivery_confirm_attempts/delivery_confirm_locked_until 字段（确认码错误次数和锁定时间）
+		var deliveryConfirmAttemptsExists int
+		checkDeliveryConfirmAttemptsQuery := `SELECT COUNT(*) FROM information_schema.COLUMNS 
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'orders' AND COLUMN_NAME = 'delivery_confirm_attempts'`
+		if err := DB.QueryRow(checkDeliveryConfirmAttemptsQuery).Scan(&deliveryConfirmAttemptsExists); err == nil && deliveryConfirmAttemptsExists == 0 {
+			if _, err = DB.Exec(`ALTER TABLE orders
+				ADD COLUMN delivery_confirm_attempts INT NOT NULL DEFAULT 0 COMMENT '收货确认码连续错误次数' AFTER delivery_confirm_code,
+				ADD COLUMN delivery_confirm_locked_until DATETIME NULL COMMENT '收货确认码错误次数过多时锁定至该时间' AFTER delivery_confirm_attempts`); err != nil {
+				log.Printf("添加delivery_confirm_attempts/delivery_confirm_locked_until字段失败: %v", err)
+			} else {
+				log.Println("已添加delivery_confirm_attempts/delivery_confirm_locked_until字段到orders表")
+			}
+		}
+
 		// 检查并添加索引
 		// 检查 idx_is_urgent 索引
 		var idxIsUrgentExists int
@@ -1248,6 +1505,29 @@ func InitDB() error {
 			log.Println("配送记录表初始化成功")
 		}
 
+		// 检查 delivery_records 表的送达位置校验字段（电子围栏）
+		var completionLatitudeExists int
+		checkCompletionLatitudeQuery := `SELECT COUNT(*) FROM information_schema.COLUMNS 
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'delivery_records' AND COLUMN_NAME = 'completion_latitude'`
+		if err := DB.QueryRow(checkCompletionLatitudeQuery).Scan(&completionLatitudeExists); err == nil && completionLatitudeExists == 0 {
+			if _, err = DB.Exec(`ALTER TABLE delivery_records 
+				ADD COLUMN completion_latitude DECIMAL(10,8) NULL COMMENT '完成配送时配送员纬度' AFTER completed_at,
+				ADD COLUMN completion_longitude DECIMAL(11,8) NULL COMMENT '完成配送时配送员经度' AFTER completion_latitude,
+				ADD COLUMN completion_accuracy DECIMAL(10,2) NULL COMMENT '定位精度（米）' AFTER completion_longitude,
+				ADD COLUMN distance_to_address DECIMAL(10,1) NULL COMMENT '完成位置与收货地址的距离（米）' AFTER completion_accuracy,
+				ADD COLUMN geofence_status VARCHAR(20) NOT NULL DEFAULT 'unknown' COMMENT 'inside-围栏内, outside-围栏外, unknown-无法判断' AFTER distance_to_address,
+				ADD COLUMN confirm_code_verified TINYINT(1) NOT NULL DEFAULT 0 COMMENT '是否已校验客户收货确认码' AFTER geofence_status,
+				ADD COLUMN review_status VARCHAR(20) NOT NULL DEFAULT 'none' COMMENT 'none-无需审核, pending-待审核, approved-审核通过, rejected-审核不通过' AFTER confirm_code_verified,
+				ADD COLUMN review_remark VARCHAR(500) NULL COMMENT '审核备注' AFTER review_status,
+				ADD COLUMN reviewed_by VARCHAR(50) NULL COMMENT '审核人' AFTER review_remark,
+				ADD COLUMN reviewed_at DATETIME NULL COMMENT '审核时间' AFTER reviewed_by,
+				ADD INDEX idx_review_status (review_status)`); err != nil {
+				log.Printf("添加delivery_records送达位置字段失败: %v", err)
+			} else {
+				log.Println("已添加delivery_records送达位置校验字段")
+			}
+		}
+
 		// 创建配送流程日志表（记录配送的整个流程：创建、接单、取货、配送、完成）
 		createDeliveryLogsTableSQL := `
 		CREATE TABLE IF NOT EXISTS delivery_logs (
@@ -1343,6 +1623,139 @@ func InitDB() error {
 			log.Println("delivery_route_orders 表的 batch_id 字段已存在，跳过添加")
 		}
 
+		// 创建配送路线停靠点表（先取货后送货的完整路线，含供应商取货点）
+		createDeliveryRouteStopsTableSQL := `
+		CREATE TABLE IF NOT EXISTS delivery_route_stops (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    delivery_employee_code VARCHAR(10) NOT NULL COMMENT '配送员员工码',
+		    batch_id VARCHAR(50) NOT NULL COMMENT '批次ID',
+		    stop_sequence INT NOT NULL COMMENT '停靠顺序（从1开始）',
+		    stop_type VARCHAR(20) NOT NULL COMMENT '停靠点类型：pickup-取货, delivery-送货',
+		    order_id INT NULL COMMENT '送货点订单ID',
+		    supplier_id INT NULL COMMENT '取货点供应商ID',
+		    latitude DECIMAL(10,7) NOT NULL COMMENT '纬度',
+		    longitude DECIMAL(10,7) NOT NULL COMMENT '经度',
+		    distance_from_prev DECIMAL(10,2) NOT NULL DEFAULT 0 COMMENT '距上一个停靠点（公里）',
+		    cumulative_distance DECIMAL(10,2) NOT NULL DEFAULT 0 COMMENT '累计距离（公里）',
+		    eta DATETIME NULL COMMENT '预计到达时间',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    KEY idx_batch_sequence (delivery_employee_code, batch_id, stop_sequence)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='配送路线停靠点表';
+		`
+		if _, err = DB.Exec(createDeliveryRouteStopsTableSQL); err != nil {
+			log.Printf("创建delivery_route_stops表失败: %v", err)
+		} else {
+			log.Println("配送路线停靠点表初始化成功")
+		}
+
+		// 创建道路距离缓存表（按坐标点对缓存距离服务结果）
+		createDistanceMatrixCacheTableSQL := `
+		CREATE TABLE IF NOT EXISTS distance_matrix_cache (
+		    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+		    provider VARCHAR(32) NOT NULL COMMENT '距离服务',
+		    origin VARCHAR(32) NOT NULL COMMENT '起点（纬度,经度，保留5位小数）',
+		    destination VARCHAR(32) NOT NULL COMMENT '终点（纬度,经度，保留5位小数）',
+		    distance_km DECIMAL(10,3) NOT NULL COMMENT '距离（公里）',
+		    duration_minutes DECIMAL(10,2) NOT NULL COMMENT '行驶时间（分钟）',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    UNIQUE KEY uk_provider_pair (provider, origin, destination)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='道路距离缓存表';
+		`
+		if _, err = DB.Exec(createDistanceMatrixCacheTableSQL); err != nil {
+			log.Printf("创建distance_matrix_cache表失败: %v", err)
+		} else {
+			log.Println("道路距离缓存表初始化成功")
+		}
+
+		// 创建派单邀请表（自动派单推送给配送员的邀请及响应）
+		createDispatchOffersTableSQL := `
+		CREATE TABLE IF NOT EXISTS dispatch_offers (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    order_id INT NOT NULL COMMENT '订单ID',
+		    employee_code VARCHAR(50) NOT NULL COMMENT '配送员员工码',
+		    score DECIMAL(10,3) NOT NULL DEFAULT 0 COMMENT '综合得分（越低越优先）',
+		    detail VARCHAR(255) NULL COMMENT '得分明细',
+		    status VARCHAR(20) NOT NULL DEFAULT 'pending' COMMENT 'pending-待响应, accepted-已接受, declined-已拒绝, expired-已超时, cancelled-已作废',
+		    expires_at DATETIME NOT NULL COMMENT '响应截止时间',
+		    responded_at DATETIME NULL COMMENT '响应时间',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    KEY idx_order_id (order_id),
+		    KEY idx_employee_status (employee_code, status),
+		    KEY idx_created_at (created_at)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='派单邀请表';
+		`
+		if _, err = DB.Exec(createDispatchOffersTableSQL); err != nil {
+			log.Printf("创建dispatch_offers表失败: %v", err)
+		} else {
+			log.Println("派单邀请表初始化成功")
+		}
+
+		// 创建配送员排班表（管理后台按天排班，每人每天一个班次）
+		createRiderShiftsTableSQL := `
+		CREATE TABLE IF NOT EXISTS rider_shifts (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    employee_code VARCHAR(50) NOT NULL COMMENT '配送员员工码',
+		    shift_date DATE NOT NULL COMMENT '排班日期',
+		    start_time DATETIME NOT NULL COMMENT '班次开始时间',
+		    end_time DATETIME NOT NULL COMMENT '班次结束时间（跨夜班次为次日）',
+		    remark VARCHAR(255) NULL COMMENT '备注',
+		    created_by VARCHAR(100) NULL COMMENT '排班人',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    UNIQUE KEY uk_employee_date (employee_code, shift_date),
+		    KEY idx_shift_date (shift_date)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='配送员排班表';
+		`
+		if _, err = DB.Exec(createRiderShiftsTableSQL); err != nil {
+			log.Printf("创建rider_shifts表失败: %v", err)
+		} else {
+			log.Println("配送员排班表初始化成功")
+		}
+
+		// 创建配送员考勤表（每人每天一条，多次上下班累计在岗时长）
+		createRiderAttendanceTableSQL := `
+		CREATE TABLE IF NOT EXISTS rider_attendance (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    employee_code VARCHAR(50) NOT NULL COMMENT '配送员员工码',
+		    work_date DATE NOT NULL COMMENT '考勤日期（首次上班打卡日期）',
+		    shift_id INT NULL COMMENT '对应排班ID',
+		    clock_in_at DATETIME NOT NULL COMMENT '首次上班打卡时间',
+		    clock_out_at DATETIME NULL COMMENT '最后下班打卡时间（在岗时为空）',
+		    session_started_at DATETIME NULL COMMENT '当前在岗时段开始时间（下班后为空）',
+		    break_started_at DATETIME NULL COMMENT '当前休息开始时间（未休息时为空）',
+		    on_duty_seconds INT NOT NULL DEFAULT 0 COMMENT '已结束时段累计在岗秒数（含休息）',
+		    break_seconds INT NOT NULL DEFAULT 0 COMMENT '累计休息秒数',
+		    late_minutes INT NOT NULL DEFAULT 0 COMMENT '迟到分钟数',
+		    early_leave_minutes INT NOT NULL DEFAULT 0 COMMENT '早退分钟数',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    UNIQUE KEY uk_employee_date (employee_code, work_date),
+		    KEY idx_work_date (work_date)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='配送员考勤表';
+		`
+		if _, err = DB.Exec(createRiderAttendanceTableSQL); err != nil {
+			log.Printf("创建rider_attendance表失败: %v", err)
+		} else {
+			log.Println("配送员考勤表初始化成功")
+		}
+
+		// 创建配送员在岗状态表（当前上班/休息/下班状态）
+		createRiderDutyStatusTableSQL := `
+		CREATE TABLE IF NOT EXISTS rider_duty_status (
+		    employee_code VARCHAR(50) PRIMARY KEY COMMENT '配送员员工码',
+		    status VARCHAR(20) NOT NULL DEFAULT 'off_duty' COMMENT 'on_duty-在岗, on_break-休息中, off_duty-下班',
+		    attendance_id INT NULL COMMENT '当前考勤记录ID',
+		    changed_at DATETIME NOT NULL COMMENT '状态变更时间',
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='配送员在岗状态表';
+		`
+		if _, err = DB.Exec(createRiderDutyStatusTableSQL); err != nil {
+			log.Printf("创建rider_duty_status表失败: %v", err)
+		} else {
+			log.Println("配送员在岗状态表初始化成功")
+		}
+
 		// 初始化默认系统设置
 		initSystemSettings := []struct {
 			key         string
@@ -1353,6 +1766,44 @@ func InitDB() error {
 			{"map_tencent_key", "", "腾讯地图API Key"},
 			{"order_urgent_fee", "0", "加急订单费用（元）"},
 			{"order_pending_payment_timeout", "15", "待支付订单超时自动取消时间（分钟）"},
+			// 积分抵扣配置
+			{"points_redeem_rate", "100", "积分抵扣比例（多少积分抵扣1元，0为关闭积分抵扣）"},
+			{"points_redeem_max_percent", "50", "积分最多抵扣商品金额的百分比（%）"},
+			{"points_redeem_min_order", "0", "商品金额满多少元可使用积分抵扣（元）"},
+			{"points_expire_years", "1", "积分有效期（获得当年起第N年年末过期，1为次年年末，0为永不过期）"},
+			// 优惠券到期提醒配置
+			{"coupon_expiry_remind_days", "3", "优惠券到期前N天生成到期提醒（0为关闭提醒）"},
+			{"coupon_expiry_subscribe_template_id", "", "优惠券到期提醒订阅消息模板ID（为空则只在小程序内提醒，模板字段：thing1-优惠券名称，time2-到期时间，thing3-温馨提示）"},
+			{"coupon_expiry_subscribe_page", "pages/coupons/coupons", "优惠券到期提醒订阅消息跳转页面"},
+			// 配送时段配置
+			{"delivery_slot_required", "0", "下单是否必须选择配送时段（1为必须，0为可选）"},
+			{"delivery_slot_days", "3", "配送时段可预约天数（含当天）"},
+			// 调度路线规划配置
+			{"dispatch_vehicle_capacity", "30", "调度规划每个配送员的容量（配送计件数，0为不限）"},
+			{"dispatch_avg_speed_kmh", "25", "调度规划配送员平均速度（公里/小时）"},
+			{"dispatch_service_minutes", "5", "调度规划每个停靠点停留时间（分钟）"},
+			{"dispatch_late_penalty_km", "0.5", "调度规划每迟到1分钟折算的距离（公里）"},
+			{"dispatch_balance_weight", "0.5", "调度规划均衡权重（每多分配一单折算的距离，公里）"},
+			// 道路距离配置
+			{"distance_provider", "haversine", "距离计算方式（haversine-直线距离，amap-高德驾车距离）"},
+			{"distance_cache_days", "30", "道路距离缓存有效期（天）"},
+			// 送达校验配置
+			{"delivery_geofence_radius_meters", "300", "完成配送位置与收货地址的允许距离（米），超出时标记待审核"},
+			{"delivery_confirm_code_min_amount", "0", "订单金额达到该值时送达需客户确认码（元，0为关闭）"},
+			{"delivery_confirm_code_max_attempts", "5", "收货确认码连续输错该次数后锁定"},
+			{"delivery_confirm_code_lock_minutes", "30", "收货确认码输错次数过多时的锁定时长（分钟）"},
+			// 自动派单配置
+			{"auto_dispatch_mode", "off", "自动派单模式（off-关闭，offer-逐个推送派单邀请，auto-直接派单）"},
+			{"auto_dispatch_offer_timeout_seconds", "60", "派单邀请响应超时时间（秒）"},
+			{"auto_dispatch_max_offers", "5", "每个订单最多推送派单邀请次数（0为不限）"},
+			{"auto_dispatch_max_batch_orders", "10", "配送员在途订单达到该数量时不再派单（0为不限）"},
+			{"auto_dispatch_weight_distance", "1", "自动派单距离权重（每公里）"},
+			{"auto_dispatch_weight_detour", "1", "自动派单绕行权重（每公里）"},
+			{"auto_dispatch_weight_load", "0.5", "自动派单负载权重（每个在途订单折算的距离，公里）"},
+			{"auto_dispatch_weight_acceptance", "2", "自动派单接受率权重（接受率100%折算的距离，公里）"},
+			// 配送员考勤配置
+			{"rider_duty_required", "1", "配送员是否需上班打卡后才能查看待接订单和接单（1为需要，0为不需要）"},
+			{"rider_late_grace_minutes", "5", "配送员上班打卡迟到宽限时间（分钟）"},
 			// 配送费计算配置
 			{"delivery_base_fee", "4.0", "基础配送费（元）"},
 			{"delivery_isolated_distance", "8.0", "孤立订单判断距离（公里）"},
@@ -1446,6 +1897,18 @@ func InitDB() error {
 			}
 		}
 
+		// 检查并添加 saved_amount 字段（按券记录实际优惠金额，用于优惠券 ROI 统计）
+		var savedAmountExists int
+		checkSavedAmountSQL := `SELECT COUNT(*) FROM information_schema.COLUMNS 
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'user_coupons' AND COLUMN_NAME = 'saved_amount'`
+		if err := DB.QueryRow(checkSavedAmountSQL).Scan(&savedAmountExists); err == nil && savedAmountExists == 0 {
+			if _, err = DB.Exec(`ALTER TABLE user_coupons ADD COLUMN saved_amount DECIMAL(10,2) DEFAULT NULL COMMENT '核销时该券实际优惠金额（多券叠加时按券拆分）' AFTER expires_at`); err != nil {
+				log.Printf("添加saved_amount字段失败: %v", err)
+			} else {
+				log.Println("成功添加saved_amount字段")
+			}
+		}
+
 		// 检查并删除唯一键约束 uk_user_coupon（因为现在支持一个用户拥有多张相同的优惠券）
 		var constraintExists int
 		checkConstraintSQL := `
@@ -1489,6 +1952,17 @@ func InitDB() error {
 			log.Println("配送员位置历史表初始化成功")
 		}
 
+		// 轨迹回放和里程统计按员工码+时间范围查询
+		var trackIndexExists int
+		err = DB.QueryRow("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = 'employee_location_history' AND index_name = 'idx_employee_code_created'").Scan(&trackIndexExists)
+		if err == nil && trackIndexExists == 0 {
+			if _, err = DB.Exec("CREATE INDEX idx_employee_code_created ON employee_location_history(employee_code, created_at)"); err != nil {
+				log.Printf("创建employee_location_history轨迹索引失败: %v", err)
+			} else {
+				log.Println("已创建employee_location_history轨迹索引")
+			}
+		}
+
 		// 创建销售分成配置表
 		createSalesCommissionConfigTableSQL := `
 		CREATE TABLE IF NOT EXISTS sales_commission_config (
@@ -2024,6 +2498,20 @@ func InitDB() error {
 			log.Println("供应商付款明细表初始化成功")
 		}
 
+		// 检查 supplier_payment_items 表的售后退货冲减字段
+		var spiReturnedExists int
+		checkSpiReturnedQuery := `SELECT COUNT(*) FROM information_schema.COLUMNS 
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'supplier_payment_items' AND COLUMN_NAME = 'returned_quantity'`
+		if err := DB.QueryRow(checkSpiReturnedQuery).Scan(&spiReturnedExists); err == nil && spiReturnedExists == 0 {
+			if _, err = DB.Exec(`ALTER TABLE supplier_payment_items 
+				ADD COLUMN returned_quantity INT NOT NULL DEFAULT 0 COMMENT '售后退货数量（已付款后发生，需供应商退回）' AFTER subtotal,
+				ADD COLUMN returned_amount DECIMAL(10,2) NOT NULL DEFAULT 0.00 COMMENT '售后退货冲减金额' AFTER returned_quantity`); err != nil {
+				log.Printf("添加returned_quantity/returned_amount字段失败: %v", err)
+			} else {
+				log.Println("已添加returned_quantity/returned_amount字段到supplier_payment_items表")
+			}
+		}
+
 		// 创建价格反馈表
 		createPriceFeedbackTableSQL := `
 		CREATE TABLE IF NOT EXISTS price_feedback (
@@ -2176,6 +2664,613 @@ func InitDB() error {
 			}
 		}
 
+		// 创建商品规格库存表（没有库存记录的规格视为不限库存，兼容老商品）
+		createProductStocksTableSQL := `
+		CREATE TABLE IF NOT EXISTS product_stocks (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    product_id INT NOT NULL COMMENT '商品ID',
+		    spec_name VARCHAR(100) NOT NULL DEFAULT '' COMMENT '规格名称（对应 products.specs 中的 name）',
+		    supplier_id INT DEFAULT NULL COMMENT '供应商ID（冗余自商品，便于按供应商查看库存）',
+		    quantity INT NOT NULL DEFAULT 0 COMMENT '实际库存数量',
+		    reserved_quantity INT NOT NULL DEFAULT 0 COMMENT '已被未取货订单占用的数量',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    UNIQUE KEY uk_product_spec (product_id, spec_name),
+		    KEY idx_supplier_id (supplier_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='商品规格库存表';
+		`
+		if _, err = DB.Exec(createProductStocksTableSQL); err != nil {
+			log.Printf("创建product_stocks表失败: %v", err)
+		} else {
+			log.Println("商品规格库存表初始化成功")
+		}
+
+		// 创建库存占用表（下单占用、取消释放、取货扣减）
+		createStockReservationsTableSQL := `
+		CREATE TABLE IF NOT EXISTS stock_reservations (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    order_id INT NOT NULL COMMENT '订单ID',
+		    order_item_id INT NOT NULL COMMENT '订单明细ID',
+		    product_id INT NOT NULL COMMENT '商品ID',
+		    spec_name VARCHAR(100) NOT NULL DEFAULT '' COMMENT '规格名称',
+		    quantity INT NOT NULL COMMENT '占用数量',
+		    status VARCHAR(20) NOT NULL DEFAULT 'reserved' COMMENT '状态：reserved-占用中，released-已释放，deducted-已取货扣减',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    KEY idx_order_status (order_id, status),
+		    KEY idx_order_item_id (order_item_id),
+		    KEY idx_product_spec (product_id, spec_name)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='订单库存占用表';
+		`
+		if _, err = DB.Exec(createStockReservationsTableSQL); err != nil {
+			log.Printf("创建stock_reservations表失败: %v", err)
+		} else {
+			log.Println("订单库存占用表初始化成功")
+		}
+
+		// 创建限时促销表（按商品规格和客户类型设置促销价）
+		createProductPromotionsTableSQL := `
+		CREATE TABLE IF NOT EXISTS product_promotions (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    name VARCHAR(100) NOT NULL COMMENT '促销名称',
+		    product_id INT NOT NULL COMMENT '商品ID',
+		    spec_name VARCHAR(100) NOT NULL DEFAULT '' COMMENT '规格名称（对应 products.specs 中的 name）',
+		    user_type VARCHAR(20) NOT NULL DEFAULT 'all' COMMENT '适用客户类型：all-全部，wholesale-批发客户，retail-零售客户',
+		    promo_price DECIMAL(10,2) NOT NULL COMMENT '促销单价',
+		    start_at DATETIME NOT NULL COMMENT '开始时间',
+		    end_at DATETIME NOT NULL COMMENT '结束时间',
+		    per_user_limit INT NOT NULL DEFAULT 0 COMMENT '每个客户限购数量，0表示不限（超出部分按原价）',
+		    total_quantity INT NOT NULL DEFAULT 0 COMMENT '促销总数量，0表示不限',
+		    sold_quantity INT NOT NULL DEFAULT 0 COMMENT '已售促销数量（未取消订单占用）',
+		    status TINYINT NOT NULL DEFAULT 1 COMMENT '状态：1-启用，0-停用',
+		    created_by VARCHAR(100) NOT NULL DEFAULT '' COMMENT '创建人',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    KEY idx_product_spec (product_id, spec_name),
+		    KEY idx_status_time (status, start_at, end_at)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='限时促销表';
+		`
+		if _, err = DB.Exec(createProductPromotionsTableSQL); err != nil {
+			log.Printf("创建product_promotions表失败: %v", err)
+		} else {
+			log.Println("限时促销表初始化成功")
+		}
+
+		// 创建促销占用表（下单占用促销数量，取消订单释放）
+		createProductPromotionUsagesTableSQL := `
+		CREATE TABLE IF NOT EXISTS product_promotion_usages (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    promotion_id INT NOT NULL COMMENT '促销ID',
+		    user_id INT NOT NULL COMMENT '客户ID',
+		    order_id INT NOT NULL COMMENT '订单ID',
+		    order_item_id INT NOT NULL COMMENT '订单明细ID',
+		    quantity INT NOT NULL COMMENT '按促销价购买的数量',
+		    status VARCHAR(20) NOT NULL DEFAULT 'reserved' COMMENT '状态：reserved-占用中，released-已释放（订单取消或修改）',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    KEY idx_promotion_user (promotion_id, user_id, status),
+		    KEY idx_order_status (order_id, status)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='促销占用表';
+		`
+		if _, err = DB.Exec(createProductPromotionUsagesTableSQL); err != nil {
+			log.Printf("创建product_promotion_usages表失败: %v", err)
+		} else {
+			log.Println("促销占用表初始化成功")
+		}
+
+		// 创建库存变动流水表
+		createStockMovementsTableSQL := `
+		CREATE TABLE IF NOT EXISTS stock_movements (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    product_id INT NOT NULL COMMENT '商品ID',
+		    spec_name VARCHAR(100) NOT NULL DEFAULT '' COMMENT '规格名称',
+		    type VARCHAR(30) NOT NULL COMMENT '变动类型：order_reserve-下单占用，order_release-取消释放，pickup-取货出库，manual_adjust-手动调整，stocktake-盘点修正，return-退货入库，untrack-关闭库存跟踪',
+		    quantity_change INT NOT NULL DEFAULT 0 COMMENT '实际库存变动',
+		    reserved_change INT NOT NULL DEFAULT 0 COMMENT '占用数量变动',
+		    quantity_after INT NOT NULL DEFAULT 0 COMMENT '变动后实际库存',
+		    reserved_after INT NOT NULL DEFAULT 0 COMMENT '变动后占用数量',
+		    order_id INT NULL COMMENT '关联订单ID',
+		    operator_type VARCHAR(20) NOT NULL DEFAULT 'system' COMMENT '操作人类型：system/admin/employee',
+		    operator VARCHAR(100) NOT NULL DEFAULT '' COMMENT '操作人（管理员用户名/员工码）',
+		    reason VARCHAR(255) NOT NULL DEFAULT '' COMMENT '变动原因',
+		    batch_no VARCHAR(50) NULL COMMENT '盘点批次号',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    KEY idx_product_spec (product_id, spec_name),
+		    KEY idx_type (type),
+		    KEY idx_order_id (order_id),
+		    KEY idx_batch_no (batch_no),
+		    KEY idx_created_at (created_at)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='库存变动流水表';
+		`
+		if _, err = DB.Exec(createStockMovementsTableSQL); err != nil {
+			log.Printf("创建stock_movements表失败: %v", err)
+		} else {
+			log.Println("库存变动流水表初始化成功")
+		}
+
+		// 创建订单缺货记录表
+		createOrderItemShortagesTableSQL := `
+		CREATE TABLE IF NOT EXISTS order_item_shortages (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    order_id INT NOT NULL COMMENT '订单ID',
+		    order_item_id INT NOT NULL COMMENT '订单明细ID（明细被取消删除后仍保留）',
+		    product_id INT NOT NULL COMMENT '商品ID',
+		    product_name VARCHAR(255) NOT NULL DEFAULT '' COMMENT '商品名称',
+		    spec_name VARCHAR(100) NOT NULL DEFAULT '' COMMENT '规格名称',
+		    unit_price DECIMAL(10,2) NOT NULL DEFAULT 0.00 COMMENT '成交单价',
+		    original_quantity INT NOT NULL COMMENT '原数量',
+		    available_quantity INT NOT NULL COMMENT '取货时可供数量',
+		    shipped_quantity INT NOT NULL DEFAULT 0 COMMENT '最终发货数量',
+		    reduced_amount DECIMAL(10,2) NOT NULL DEFAULT 0.00 COMMENT '调减金额',
+		    strategy VARCHAR(20) NOT NULL COMMENT '缺货处理策略：cancel_item/ship_available/contact_me',
+		    status VARCHAR(20) NOT NULL DEFAULT 'pending' COMMENT '状态：pending-待联系客户，applied-已处理',
+		    reported_by VARCHAR(20) NOT NULL DEFAULT '' COMMENT '上报配送员员工码',
+		    resolved_by VARCHAR(100) NULL COMMENT '处理人',
+		    resolved_at DATETIME NULL COMMENT '处理时间',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    KEY idx_order_status (order_id, status),
+		    KEY idx_order_item_id (order_item_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='订单取货缺货记录表';
+		`
+		if _, err = DB.Exec(createOrderItemShortagesTableSQL); err != nil {
+			log.Printf("创建order_item_shortages表失败: %v", err)
+		} else {
+			log.Println("订单缺货记录表初始化成功")
+		}
+
+		// 创建售后申请表
+		createAfterSalesRequestsTableSQL := `
+		CREATE TABLE IF NOT EXISTS after_sales_requests (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    request_no VARCHAR(32) NOT NULL COMMENT '售后单号',
+		    order_id INT NOT NULL COMMENT '订单ID',
+		    user_id INT NOT NULL COMMENT '客户ID',
+		    type VARCHAR(20) NOT NULL COMMENT '售后类型：refund_only-仅退款，return_refund-退货退款',
+		    reason VARCHAR(100) NOT NULL COMMENT '售后原因',
+		    description VARCHAR(500) NOT NULL DEFAULT '' COMMENT '问题描述',
+		    images TEXT NULL COMMENT '凭证图片（JSON数组）',
+		    status VARCHAR(20) NOT NULL DEFAULT 'pending' COMMENT '状态：pending/approved/rejected/cancelled/refunding/refund_failed/completed',
+		    applicant_type VARCHAR(20) NOT NULL COMMENT '申请人类型：user/employee',
+		    applicant VARCHAR(50) NOT NULL COMMENT '申请人（用户ID/员工码）',
+		    goods_amount DECIMAL(10,2) NOT NULL DEFAULT 0.00 COMMENT '售后商品金额（单价×数量）',
+		    discount_share DECIMAL(10,2) NOT NULL DEFAULT 0.00 COMMENT '分摊的优惠券/积分抵扣',
+		    refund_amount DECIMAL(10,2) NOT NULL DEFAULT 0.00 COMMENT '退款金额',
+		    refund_method VARCHAR(20) NULL COMMENT '退款方式：wechat-原路退回，offline-线下退款',
+		    wechat_refund_id VARCHAR(64) NULL COMMENT '微信退款单号',
+		    points_reversed INT NOT NULL DEFAULT 0 COMMENT '扣回的订单奖励积分',
+		    points_refunded INT NOT NULL DEFAULT 0 COMMENT '退回的下单抵扣积分',
+		    reviewer VARCHAR(100) NULL COMMENT '审核人',
+		    review_remark VARCHAR(500) NULL COMMENT '审核备注',
+		    reviewed_at DATETIME NULL COMMENT '审核时间',
+		    completed_at DATETIME NULL COMMENT '完成时间',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    UNIQUE KEY uk_request_no (request_no),
+		    KEY idx_order_id (order_id),
+		    KEY idx_user_id (user_id),
+		    KEY idx_status (status),
+		    KEY idx_wechat_refund_id (wechat_refund_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='售后申请表';
+		`
+		if _, err = DB.Exec(createAfterSalesRequestsTableSQL); err != nil {
+			log.Printf("创建after_sales_requests表失败: %v", err)
+		} else {
+			log.Println("售后申请表初始化成功")
+		}
+
+		// 创建售后商品明细表
+		createAfterSalesItemsTableSQL := `
+		CREATE TABLE IF NOT EXISTS after_sales_items (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    request_id INT NOT NULL COMMENT '售后申请ID',
+		    order_item_id INT NOT NULL COMMENT '订单明细ID',
+		    product_id INT NOT NULL COMMENT '商品ID',
+		    product_name VARCHAR(255) NOT NULL DEFAULT '' COMMENT '商品名称',
+		    spec_name VARCHAR(100) NOT NULL DEFAULT '' COMMENT '规格名称',
+		    unit_price DECIMAL(10,2) NOT NULL DEFAULT 0.00 COMMENT '成交单价',
+		    cost_price DECIMAL(10,2) NOT NULL DEFAULT 0.00 COMMENT '成本价（下单时快照）',
+		    quantity INT NOT NULL COMMENT '售后数量',
+		    refund_amount DECIMAL(10,2) NOT NULL DEFAULT 0.00 COMMENT '该商品分摊的退款金额',
+		    supplier_credit_amount DECIMAL(10,2) NOT NULL DEFAULT 0.00 COMMENT '需供应商退回/冲减的成本金额',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    KEY idx_request_id (request_id),
+		    KEY idx_order_item_id (order_item_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='售后商品明细表';
+		`
+		if _, err = DB.Exec(createAfterSalesItemsTableSQL); err != nil {
+			log.Printf("创建after_sales_items表失败: %v", err)
+		} else {
+			log.Println("售后商品明细表初始化成功")
+		}
+
+		// 创建售后状态流转日志表
+		createAfterSalesLogsTableSQL := `
+		CREATE TABLE IF NOT EXISTS after_sales_logs (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    request_id INT NOT NULL COMMENT '售后申请ID',
+		    from_status VARCHAR(20) NOT NULL DEFAULT '' COMMENT '原状态（创建时为空）',
+		    to_status VARCHAR(20) NOT NULL COMMENT '新状态',
+		    operator_type VARCHAR(20) NOT NULL COMMENT '操作人类型：user/employee/admin/system',
+		    operator VARCHAR(100) NOT NULL DEFAULT '' COMMENT '操作人',
+		    remark VARCHAR(500) NOT NULL DEFAULT '' COMMENT '备注',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    KEY idx_request_id (request_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='售后状态流转日志表';
+		`
+		if _, err = DB.Exec(createAfterSalesLogsTableSQL); err != nil {
+			log.Printf("创建after_sales_logs表失败: %v", err)
+		} else {
+			log.Println("售后状态流转日志表初始化成功")
+		}
+
+		// 创建订单状态流转历史表
+		createOrderStatusHistoryTableSQL := `
+		CREATE TABLE IF NOT EXISTS order_status_history (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    order_id INT NOT NULL COMMENT '订单ID',
+		    from_status VARCHAR(20) NOT NULL DEFAULT '' COMMENT '原状态',
+		    to_status VARCHAR(20) NOT NULL COMMENT '新状态',
+		    actor_type VARCHAR(20) NOT NULL COMMENT '操作人类型：system/admin/employee/user/wechat_pay',
+		    actor_id VARCHAR(100) NOT NULL DEFAULT '' COMMENT '操作人标识（管理员用户名/员工码/用户ID等）',
+		    reason VARCHAR(500) NOT NULL DEFAULT '' COMMENT '变更原因',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    KEY idx_order_id (order_id),
+		    KEY idx_to_status (to_status),
+		    KEY idx_created_at (created_at)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='订单状态流转历史表';
+		`
+		if _, err = DB.Exec(createOrderStatusHistoryTableSQL); err != nil {
+			log.Printf("创建order_status_history表失败: %v", err)
+		} else {
+			log.Println("订单状态流转历史表初始化成功")
+		}
+
+		// 创建后台任务队列表
+		createBackgroundJobsTableSQL := `
+		CREATE TABLE IF NOT EXISTS background_jobs (
+		    id BIGINT PRIMARY KEY AUTO_INCREMENT,
+		    type VARCHAR(50) NOT NULL COMMENT '任务类型',
+		    payload TEXT NOT NULL COMMENT '任务参数（JSON）',
+		    idempotency_key VARCHAR(191) NULL COMMENT '幂等键（相同键只入队一次）',
+		    status VARCHAR(20) NOT NULL DEFAULT 'pending' COMMENT '状态：pending-待执行，running-执行中，succeeded-成功，dead-重试耗尽',
+		    attempts INT NOT NULL DEFAULT 0 COMMENT '已执行次数',
+		    max_attempts INT NOT NULL DEFAULT 8 COMMENT '最大执行次数',
+		    run_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '最早执行时间',
+		    last_error TEXT NULL COMMENT '最近一次失败原因',
+		    locked_by VARCHAR(191) NULL COMMENT '执行者标识（主机名-进程号-协程序号-时间戳）',
+		    locked_at DATETIME NULL COMMENT '开始执行时间',
+		    finished_at DATETIME NULL COMMENT '完成时间',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    UNIQUE KEY uk_idempotency_key (idempotency_key),
+		    KEY idx_status_run_at (status, run_at),
+		    KEY idx_type (type),
+		    KEY idx_locked_by (locked_by)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='后台任务队列表';
+		`
+		if _, err = DB.Exec(createBackgroundJobsTableSQL); err != nil {
+			log.Printf("创建background_jobs表失败: %v", err)
+		} else {
+			log.Println("后台任务队列表初始化成功")
+		}
+
+		// 检查 background_jobs.locked_by 长度（主机名较长时领取标识超过 64 字符）
+		var lockedByLength int
+		checkLockedByLengthQuery := `SELECT COALESCE(CHARACTER_MAXIMUM_LENGTH, 0) FROM information_schema.COLUMNS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'background_jobs' AND COLUMN_NAME = 'locked_by'`
+		if err := DB.QueryRow(checkLockedByLengthQuery).Scan(&lockedByLength); err == nil && lockedByLength > 0 && lockedByLength < 191 {
+			if _, err = DB.Exec(`ALTER TABLE background_jobs MODIFY COLUMN locked_by VARCHAR(191) NULL COMMENT '执行者标识（主机名-进程号-协程序号-时间戳）'`); err != nil {
+				log.Printf("扩展background_jobs.locked_by字段长度失败: %v", err)
+			} else {
+				log.Println("已将background_jobs.locked_by字段扩展为VARCHAR(191)")
+			}
+		}
+
+		// 创建预支付缓存表（在线支付下单前的购物快照，支付回调时据此创建订单）
+		createPrepayCacheEntriesTableSQL := `
+		CREATE TABLE IF NOT EXISTS prepay_cache_entries (
+		    out_trade_no VARCHAR(64) PRIMARY KEY COMMENT '商户订单号（即支付成功后的订单号）',
+		    user_id INT NOT NULL COMMENT '用户ID',
+		    payload MEDIUMTEXT NOT NULL COMMENT '下单快照（JSON）',
+		    status VARCHAR(20) NOT NULL DEFAULT 'pending' COMMENT '状态：pending-待支付，consumed-已创建订单',
+		    expires_at DATETIME NOT NULL COMMENT '过期时间',
+		    consumed_at DATETIME NULL COMMENT '消费时间',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    KEY idx_user_id (user_id),
+		    KEY idx_expires_at (expires_at)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='微信预支付缓存表';
+		`
+		if _, err = DB.Exec(createPrepayCacheEntriesTableSQL); err != nil {
+			log.Printf("创建prepay_cache_entries表失败: %v", err)
+		} else {
+			log.Println("预支付缓存表初始化成功")
+		}
+
+		// 创建支付回调异常表（支付成功但预支付缓存缺失或建单失败，需人工补单或退款）
+		createPrepayNotifyExceptionsTableSQL := `
+		CREATE TABLE IF NOT EXISTS prepay_notify_exceptions (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    out_trade_no VARCHAR(64) NOT NULL COMMENT '商户订单号',
+		    transaction_id VARCHAR(64) NOT NULL DEFAULT '' COMMENT '微信支付单号',
+		    amount DECIMAL(10,2) NOT NULL DEFAULT 0 COMMENT '支付金额（元）',
+		    payer_openid VARCHAR(128) NOT NULL DEFAULT '' COMMENT '付款用户openid',
+		    reason VARCHAR(30) NOT NULL COMMENT '异常原因：cache_missing-缓存缺失，cache_expired-缓存过期，order_failed-建单失败，consumed_no_order-快照已消费但无订单',
+		    error_message TEXT NULL COMMENT '错误详情',
+		    status VARCHAR(20) NOT NULL DEFAULT 'pending' COMMENT '处理状态：pending-待处理，converted-已补单，refunded-已退款，ignored-已忽略',
+		    order_id INT NULL COMMENT '补单生成的订单ID',
+		    refund_id VARCHAR(64) NULL COMMENT '微信退款单号',
+		    handled_by VARCHAR(50) NULL COMMENT '处理人',
+		    handled_at DATETIME NULL COMMENT '处理时间',
+		    remark VARCHAR(255) NULL COMMENT '处理备注',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    UNIQUE KEY uk_out_trade_no (out_trade_no),
+		    KEY idx_status (status)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='支付回调异常表';
+		`
+		if _, err = DB.Exec(createPrepayNotifyExceptionsTableSQL); err != nil {
+			log.Printf("创建prepay_notify_exceptions表失败: %v", err)
+		} else {
+			log.Println("支付回调异常表初始化成功")
+		}
+
+		// 创建微信退款记录表（每次发起的微信退款，用于退款账单对账）
+		createWechatRefundsTableSQL := `
+		CREATE TABLE IF NOT EXISTS wechat_refunds (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    out_trade_no VARCHAR(64) NOT NULL COMMENT '商户订单号',
+		    out_refund_no VARCHAR(64) NOT NULL COMMENT '商户退款单号',
+		    refund_id VARCHAR(64) NOT NULL DEFAULT '' COMMENT '微信退款单号',
+		    amount DECIMAL(10,2) NOT NULL COMMENT '退款金额（元）',
+		    reason VARCHAR(255) NOT NULL DEFAULT '' COMMENT '退款原因',
+		    status VARCHAR(20) NOT NULL DEFAULT 'processing' COMMENT '状态：processing-处理中，success-成功，closed-关闭，abnormal-异常',
+		    succeeded_at DATETIME NULL COMMENT '退款成功时间',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    UNIQUE KEY uk_out_refund_no (out_refund_no),
+		    KEY idx_refund_id (refund_id),
+		    KEY idx_out_trade_no (out_trade_no)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='微信退款记录表';
+		`
+		if _, err = DB.Exec(createWechatRefundsTableSQL); err != nil {
+			log.Printf("创建wechat_refunds表失败: %v", err)
+		} else {
+			log.Println("微信退款记录表初始化成功")
+		}
+
+		// 创建微信支付对账批次表
+		createWechatReconciliationRunsTableSQL := `
+		CREATE TABLE IF NOT EXISTS wechat_reconciliation_runs (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    bill_date DATE NOT NULL COMMENT '账单日期',
+		    source VARCHAR(20) NOT NULL COMMENT '账单来源：upload-上传文件，download-微信下载',
+		    file_name VARCHAR(255) NOT NULL DEFAULT '' COMMENT '账单文件名',
+		    trade_count INT NOT NULL DEFAULT 0 COMMENT '账单支付笔数',
+		    trade_amount DECIMAL(12,2) NOT NULL DEFAULT 0 COMMENT '账单支付金额',
+		    refund_count INT NOT NULL DEFAULT 0 COMMENT '账单退款笔数',
+		    refund_amount DECIMAL(12,2) NOT NULL DEFAULT 0 COMMENT '账单退款金额',
+		    matched_count INT NOT NULL DEFAULT 0 COMMENT '核对一致笔数',
+		    discrepancy_count INT NOT NULL DEFAULT 0 COMMENT '差异笔数',
+		    operator VARCHAR(50) NOT NULL DEFAULT '' COMMENT '操作人（自动对账为 system）',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    KEY idx_bill_date (bill_date)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='微信支付对账批次表';
+		`
+		if _, err = DB.Exec(createWechatReconciliationRunsTableSQL); err != nil {
+			log.Printf("创建wechat_reconciliation_runs表失败: %v", err)
+		} else {
+			log.Println("微信支付对账批次表初始化成功")
+		}
+
+		// 创建微信支付对账差异表
+		createWechatReconciliationDiscrepanciesTableSQL := `
+		CREATE TABLE IF NOT EXISTS wechat_reconciliation_discrepancies (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    run_id INT NOT NULL COMMENT '对账批次ID',
+		    bill_date DATE NOT NULL COMMENT '账单日期',
+		    type VARCHAR(30) NOT NULL COMMENT '差异类型：paid_no_order-有支付无订单，order_missing-订单已支付账单无记录，amount_mismatch-金额不一致，refund_mismatch-退款不一致',
+		    out_trade_no VARCHAR(64) NOT NULL DEFAULT '' COMMENT '商户订单号',
+		    transaction_id VARCHAR(64) NOT NULL DEFAULT '' COMMENT '微信支付单号',
+		    refund_id VARCHAR(64) NOT NULL DEFAULT '' COMMENT '微信退款单号',
+		    order_id INT NULL COMMENT '订单ID',
+		    bill_amount DECIMAL(10,2) NULL COMMENT '账单金额',
+		    system_amount DECIMAL(10,2) NULL COMMENT '系统金额',
+		    detail VARCHAR(500) NOT NULL DEFAULT '' COMMENT '差异说明',
+		    status VARCHAR(20) NOT NULL DEFAULT 'open' COMMENT '处理状态：open-待处理，resolved-已处理',
+		    resolved_by VARCHAR(50) NULL COMMENT '处理人',
+		    resolved_at DATETIME NULL COMMENT '处理时间',
+		    remark VARCHAR(255) NULL COMMENT '处理备注',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    KEY idx_run_id (run_id),
+		    KEY idx_bill_date (bill_date),
+		    KEY idx_type_status (type, status)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='微信支付对账差异表';
+		`
+		if _, err = DB.Exec(createWechatReconciliationDiscrepanciesTableSQL); err != nil {
+			log.Printf("创建wechat_reconciliation_discrepancies表失败: %v", err)
+		} else {
+			log.Println("微信支付对账差异表初始化成功")
+		}
+
+		// 创建积分批次表（按获得批次记录到期时间，消费时先到期先用）
+		createPointsLotsTableSQL := `
+		CREATE TABLE IF NOT EXISTS points_lots (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    user_id INT NOT NULL COMMENT '用户ID',
+		    source_log_id INT NULL COMMENT '来源积分明细ID（历史余额迁移为空）',
+		    points INT NOT NULL COMMENT '获得积分',
+		    remaining INT NOT NULL COMMENT '剩余可用积分',
+		    earned_at DATETIME NOT NULL COMMENT '获得时间',
+		    expires_at DATETIME NULL COMMENT '到期时间（为空表示永不过期）',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    KEY idx_user_expires (user_id, expires_at),
+		    KEY idx_expires_remaining (expires_at, remaining),
+		    KEY idx_source_log_id (source_log_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='积分批次表';
+		`
+		if _, err = DB.Exec(createPointsLotsTableSQL); err != nil {
+			log.Printf("创建points_lots表失败: %v", err)
+		} else {
+			log.Println("积分批次表初始化成功")
+			// 已有积分余额但没有批次的用户，将当前余额迁移为一个批次，按积分有效期设置到期（0 为永不过期）
+			var expireYears int
+			if err := DB.QueryRow(`SELECT CAST(setting_value AS SIGNED) FROM system_settings WHERE setting_key = 'points_expire_years'`).Scan(&expireYears); err != nil {
+				expireYears = 1
+			}
+			var migratedExpiresAt interface{}
+			if expireYears > 0 {
+				migratedExpiresAt = time.Date(time.Now().Year()+expireYears, 12, 31, 23, 59, 59, 0, time.Local)
+			}
+			if res, err := DB.Exec(`
+				INSERT INTO points_lots (user_id, source_log_id, points, remaining, earned_at, expires_at, created_at, updated_at)
+				SELECT u.id, NULL, u.points, u.points, NOW(), ?, NOW(), NOW()
+				FROM mini_app_users u
+				WHERE u.points > 0 AND NOT EXISTS (SELECT 1 FROM points_lots l WHERE l.user_id = u.id)
+			`, migratedExpiresAt); err != nil {
+				log.Printf("迁移历史积分余额到积分批次失败: %v", err)
+			} else if n, _ := res.RowsAffected(); n > 0 {
+				log.Printf("已将 %d 位用户的历史积分余额迁移为积分批次", n)
+			}
+		}
+
+		// 创建积分批次消耗记录表（扣减积分时记录消耗了哪些批次，退回时恢复原批次并保留原到期时间）
+		createPointsLotUsagesTableSQL := `
+		CREATE TABLE IF NOT EXISTS points_lot_usages (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    log_id INT NOT NULL COMMENT '扣减积分明细ID',
+		    lot_id INT NOT NULL COMMENT '积分批次ID',
+		    points INT NOT NULL COMMENT '从该批次扣减的积分',
+		    restored INT NOT NULL DEFAULT 0 COMMENT '已退回该批次的积分',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    KEY idx_log_id (log_id),
+		    KEY idx_lot_id (lot_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='积分批次消耗记录表';
+		`
+		if _, err = DB.Exec(createPointsLotUsagesTableSQL); err != nil {
+			log.Printf("创建points_lot_usages表失败: %v", err)
+		} else {
+			log.Println("积分批次消耗记录表初始化成功")
+		}
+
+		// 创建积分抵扣差额表（已付款订单抵扣积分超过余额时只扣减余额，差额待人工处理）
+		createPointsShortfallsTableSQL := `
+		CREATE TABLE IF NOT EXISTS points_shortfalls (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    order_id INT NOT NULL COMMENT '订单ID',
+		    order_number VARCHAR(50) NOT NULL DEFAULT '' COMMENT '订单号',
+		    user_id INT NOT NULL COMMENT '用户ID',
+		    points_requested INT NOT NULL COMMENT '下单时使用的积分',
+		    points_deducted INT NOT NULL COMMENT '实际扣减的积分',
+		    shortfall_points INT NOT NULL COMMENT '少扣的积分',
+		    shortfall_amount DECIMAL(10,2) NOT NULL DEFAULT 0 COMMENT '少扣积分对应的抵扣金额（元）',
+		    status VARCHAR(20) NOT NULL DEFAULT 'pending' COMMENT '处理状态：pending-待处理，resolved-已处理',
+		    handled_by VARCHAR(50) NULL COMMENT '处理人',
+		    handled_at DATETIME NULL COMMENT '处理时间',
+		    remark VARCHAR(255) NULL COMMENT '处理备注',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    UNIQUE KEY uk_order_id (order_id),
+		    KEY idx_user_id (user_id),
+		    KEY idx_status (status)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='积分抵扣差额表';
+		`
+		if _, err = DB.Exec(createPointsShortfallsTableSQL); err != nil {
+			log.Printf("创建points_shortfalls表失败: %v", err)
+		} else {
+			log.Println("积分抵扣差额表初始化成功")
+		}
+
+		// 创建配送时段表（按星期、截单时间和容量限制预约配送）
+		createDeliverySlotsTableSQL := `
+		CREATE TABLE IF NOT EXISTS delivery_slots (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    name VARCHAR(50) NOT NULL COMMENT '时段名称',
+		    weekdays VARCHAR(20) NOT NULL DEFAULT '' COMMENT '适用星期，逗号分隔（0=周日），为空表示每天',
+		    start_time TIME NOT NULL COMMENT '开始时间',
+		    end_time TIME NOT NULL COMMENT '结束时间',
+		    cutoff_minutes INT NOT NULL DEFAULT 0 COMMENT '截单时间（时段开始前多少分钟）',
+		    max_orders INT NOT NULL DEFAULT 0 COMMENT '最多订单数（0为不限）',
+		    max_units INT NOT NULL DEFAULT 0 COMMENT '最多配送件数（0为不限）',
+		    zone_ids VARCHAR(500) NOT NULL DEFAULT '' COMMENT '适用配送区域ID，逗号分隔，为空表示不限',
+		    is_active TINYINT(1) NOT NULL DEFAULT 1 COMMENT '是否启用',
+		    sort INT NOT NULL DEFAULT 0 COMMENT '排序',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    KEY idx_is_active (is_active)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='配送时段表';
+		`
+		if _, err = DB.Exec(createDeliverySlotsTableSQL); err != nil {
+			log.Printf("创建delivery_slots表失败: %v", err)
+		} else {
+			log.Println("配送时段表初始化成功")
+		}
+
+		// 检查 delivery_slots 表的 zone_ids 字段（按配送区域限定时段，替代按地址关键字匹配）
+		var deliverySlotZoneIDsExists int
+		checkDeliverySlotZoneIDsQuery := `SELECT COUNT(*) FROM information_schema.COLUMNS 
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'delivery_slots' AND COLUMN_NAME = 'zone_ids'`
+		if err := DB.QueryRow(checkDeliverySlotZoneIDsQuery).Scan(&deliverySlotZoneIDsExists); err == nil && deliverySlotZoneIDsExists == 0 {
+			if _, err = DB.Exec(`ALTER TABLE delivery_slots ADD COLUMN zone_ids VARCHAR(500) NOT NULL DEFAULT '' COMMENT '适用配送区域ID，逗号分隔，为空表示不限' AFTER max_units`); err != nil {
+				log.Printf("添加zone_ids字段失败: %v", err)
+			} else {
+				log.Println("已添加zone_ids字段到delivery_slots表")
+			}
+		}
+
+		// 创建配送区域表（多边形范围，可覆盖配送费和配送员补贴）
+		createDeliveryZonesTableSQL := `
+		CREATE TABLE IF NOT EXISTS delivery_zones (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    name VARCHAR(100) NOT NULL COMMENT '区域名称',
+		    polygons LONGTEXT NOT NULL COMMENT '区域多边形（GeoJSON MultiPolygon 坐标，[经度, 纬度]）',
+		    base_fee DECIMAL(10,2) NULL COMMENT '区域基础配送费（为空使用全局设置）',
+		    free_shipping_threshold DECIMAL(10,2) NULL COMMENT '区域免配送费门槛（为空使用全局设置）',
+		    rider_base_fee DECIMAL(10,2) NULL COMMENT '配送员基础配送费（为空使用系统设置）',
+		    rider_isolated_subsidy DECIMAL(10,2) NULL COMMENT '配送员孤立订单补贴（为空使用系统设置）',
+		    priority INT NOT NULL DEFAULT 0 COMMENT '优先级（区域重叠时高者生效）',
+		    is_active TINYINT(1) NOT NULL DEFAULT 1 COMMENT '是否启用',
+		    remark VARCHAR(255) NULL COMMENT '备注',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    KEY idx_active_priority (is_active, priority)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='配送区域表';
+		`
+		if _, err = DB.Exec(createDeliveryZonesTableSQL); err != nil {
+			log.Printf("创建delivery_zones表失败: %v", err)
+		} else {
+			log.Println("配送区域表初始化成功")
+		}
+
+		// 创建调度方案表（多配送员路线规划，管理员确认后派单）
+		createDispatchPlansTableSQL := `
+		CREATE TABLE IF NOT EXISTS dispatch_plans (
+		    id INT PRIMARY KEY AUTO_INCREMENT,
+		    status VARCHAR(20) NOT NULL DEFAULT 'draft' COMMENT '状态：draft-待确认, confirmed-已派单, discarded-已作废',
+		    options TEXT NULL COMMENT '规划参数（JSON）',
+		    routes LONGTEXT NULL COMMENT '各配送员路线（JSON）',
+		    unassigned LONGTEXT NULL COMMENT '未分配订单及原因（JSON）',
+		    result LONGTEXT NULL COMMENT '确认派单结果（JSON）',
+		    order_count INT NOT NULL DEFAULT 0 COMMENT '已分配订单数',
+		    total_distance DECIMAL(10,2) NOT NULL DEFAULT 0 COMMENT '总距离（公里）',
+		    late_stops INT NOT NULL DEFAULT 0 COMMENT '预计迟到订单数',
+		    created_by VARCHAR(100) NOT NULL DEFAULT '' COMMENT '生成人',
+		    confirmed_by VARCHAR(100) NULL COMMENT '确认/作废人',
+		    confirmed_at DATETIME NULL COMMENT '确认时间',
+		    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		    KEY idx_status (status)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COMMENT='调度方案表';
+		`
+		if _, err = DB.Exec(createDispatchPlansTableSQL); err != nil {
+			log.Printf("创建dispatch_plans表失败: %v", err)
+		} else {
+			log.Println("调度方案表初始化成功")
+		}
+
 		log.Println("所有表创建成功")
 	})
 
@@ -30,21 +30,6 @@ type Address struct {
 
 // CreateAddress 创建地址
 func CreateAddress(userID int, addressData map[string]interface{}) (*Address, error) {
-	// 如果设置为默认地址，先取消其他地址的默认状态
-	isDefault := false
-	if defaultVal, ok := addressData["is_default"].(bool); ok && defaultVal {
-		isDefault = true
-		// 取消该用户其他地址的默认状态
-		_, err := database.DB.Exec(`
-			UPDATE mini_app_addresses 
-			SET is_default = 0 
-			WHERE user_id = ?
-		`, userID)
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	// 插入新地址（不再包含sales_code，销售员绑定到用户）
 	query := `
 		INSERT INTO mini_app_addresses (user_id, name, contact, phone, address, avatar, latitude, longitude, store_type, is_default, created_at, updated_at)
@@ -75,6 +60,33 @@ func CreateAddress(userID int, addressData map[string]interface{}) (*Address, er
 		}
 	}
 
+	// 校验地址是否在配送区域内（没有经纬度时无法判断，不阻止保存）
+	var latPtr, lngPtr *float64
+	if lat, ok := latitude.(float64); ok {
+		latPtr = &lat
+	}
+	if lng, ok := longitude.(float64); ok {
+		lngPtr = &lng
+	}
+	if _, err := CheckLocationServiceable(latPtr, lngPtr); err != nil {
+		return nil, err
+	}
+
+	// 如果设置为默认地址，先取消其他地址的默认状态
+	isDefault := false
+	if defaultVal, ok := addressData["is_default"].(bool); ok && defaultVal {
+		isDefault = true
+		// 取消该用户其他地址的默认状态
+		_, err := database.DB.Exec(`
+			UPDATE mini_app_addresses 
+			SET is_default = 0 
+			WHERE user_id = ?
+		`, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	result, err := database.DB.Exec(query,
 		userID,
 		addressData["name"],
@@ -288,19 +300,6 @@ func GetDefaultAddressByUserID(userID int) (*Address, error) {
 
 // UpdateAddress 更新地址
 func UpdateAddress(id int, userID int, addressData map[string]interface{}) error {
-	// 如果设置为默认地址，先取消其他地址的默认状态
-	if defaultVal, ok := addressData["is_default"].(bool); ok && defaultVal {
-		// 取消该用户其他地址的默认状态
-		_, err := database.DB.Exec(`
-			UPDATE mini_app_addresses 
-			SET is_default = 0 
-			WHERE user_id = ? AND id != ?
-		`, userID, id)
-		if err != nil {
-			return err
-		}
-	}
-
 	// 构建更新SQL
 	updates := []string{}
 	args := []interface{}{}
@@ -330,20 +329,20 @@ func UpdateAddress(id int, userID int, addressData map[string]interface{}) error
 		args = append(args, storeType)
 	}
 	// 不再更新sales_code，销售员绑定到用户而不是地址
-	var hasLatitude, hasLongitude bool
+	var latPtr, lngPtr *float64
 	if latitude, ok := addressData["latitude"].(float64); ok {
-		hasLatitude = true
+		latPtr = &latitude
 		updates = append(updates, "latitude = ?")
 		args = append(args, latitude)
 	}
 	if longitude, ok := addressData["longitude"].(float64); ok {
-		hasLongitude = true
+		lngPtr = &longitude
 		updates = append(updates, "longitude = ?")
 		args = append(args, longitude)
 	}
 
 	// 如果经纬度为空，尝试自动解析地址（兜底逻辑）
-	if !hasLatitude && !hasLongitude {
+	if latPtr == nil && lngPtr == nil {
 		if addressStr, ok := addressData["address"].(string); ok && strings.TrimSpace(addressStr) != "" {
 			// 获取地图API Key
 			amapKey, _ := GetSystemSetting("map_amap_key")
@@ -351,6 +350,8 @@ func UpdateAddress(id int, userID int, addressData map[string]interface{}) error
 
 			geocodeResult, err := utils.GeocodeAddress(strings.TrimSpace(addressStr), amapKey, tencentKey)
 			if err == nil && geocodeResult.Success {
+				latPtr = &geocodeResult.Latitude
+				lngPtr = &geocodeResult.Longitude
 				updates = append(updates, "latitude = ?")
 				args = append(args, geocodeResult.Latitude)
 				updates = append(updates, "longitude = ?")
@@ -359,6 +360,40 @@ func UpdateAddress(id int, userID int, addressData map[string]interface{}) error
 			// 如果解析失败，不阻止保存，但记录日志
 		}
 	}
+
+	// 坐标有变化时校验是否在配送区域内（只传了经度或纬度时用原地址补全另一项）
+	if latPtr != nil || lngPtr != nil {
+		if latPtr == nil || lngPtr == nil {
+			existing, err := GetAddressByID(id)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				if latPtr == nil {
+					latPtr = existing.Latitude
+				}
+				if lngPtr == nil {
+					lngPtr = existing.Longitude
+				}
+			}
+		}
+		if _, err := CheckLocationServiceable(latPtr, lngPtr); err != nil {
+			return err
+		}
+	}
+
+	// 如果设置为默认地址，先取消其他地址的默认状态
+	if defaultVal, ok := addressData["is_default"].(bool); ok && defaultVal {
+		// 取消该用户其他地址的默认状态
+		_, err := database.DB.Exec(`
+			UPDATE mini_app_addresses 
+			SET is_default = 0 
+			WHERE user_id = ? AND id != ?
+		`, userID, id)
+		if err != nil {
+			return err
+		}
+	}
 	if isDefault, ok := addressData["is_default"].(bool); ok {
 		var defaultValue int
 		if isDefault {
@@ -0,0 +1,859 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 售后类型
+const (
+	AfterSalesTypeRefundOnly   = "refund_only"   // 仅退款
+	AfterSalesTypeReturnRefund = "return_refund" // 退货退款
+)
+
+// 售后状态
+const (
+	AfterSalesPending      = "pending"       // 待审核
+	AfterSalesApproved     = "approved"      // 已同意（退货退款等待收货）
+	AfterSalesRejected     = "rejected"      // 已驳回
+	AfterSalesCancelled    = "cancelled"     // 已撤销
+	AfterSalesRefunding    = "refunding"     // 退款中
+	AfterSalesRefundFailed = "refund_failed" // 退款失败
+	AfterSalesCompleted    = "completed"     // 已完成
+)
+
+// 售后操作人类型
+const (
+	AfterSalesOperatorUser     = "user"
+	AfterSalesOperatorEmployee = "employee"
+	AfterSalesOperatorAdmin    = "admin"
+	AfterSalesOperatorSystem   = "system"
+)
+
+// 退款方式
+const (
+	AfterSalesRefundWechat  = "wechat"  // 微信原路退回
+	AfterSalesRefundOffline = "offline" // 线下退款（货到付款现金等）
+)
+
+// afterSalesTransitions 售后状态机：当前状态 -> 允许流转到的状态
+var afterSalesTransitions = map[string][]string{
+	AfterSalesPending:      {AfterSalesApproved, AfterSalesRejected, AfterSalesCancelled},
+	AfterSalesApproved:     {AfterSalesRefunding, AfterSalesRefundFailed, AfterSalesCompleted},
+	AfterSalesRefunding:    {AfterSalesCompleted, AfterSalesRefundFailed},
+	AfterSalesRefundFailed: {AfterSalesRefunding, AfterSalesCompleted},
+}
+
+// afterSalesEligibleOrderStatuses 可申请售后的订单状态（已送达）
+var afterSalesEligibleOrderStatuses = map[string]bool{
+	"delivered": true,
+	"paid":      true,
+	"shipped":   true,
+	"completed": true,
+}
+
+func init() {
+	RegisterJobHandler(JobAfterSalesCompleted, runAfterSalesCompletedJob)
+}
+
+// CanAfterSalesTransition 判断售后状态是否允许流转
+func CanAfterSalesTransition(from, to string) bool {
+	for _, s := range afterSalesTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// AfterSalesRequest 售后申请
+type AfterSalesRequest struct {
+	ID             int              `json:"id"`
+	RequestNo      string           `json:"request_no"`
+	OrderID        int              `json:"order_id"`
+	OrderNumber    string           `json:"order_number,omitempty"`
+	UserID         int              `json:"user_id"`
+	Type           string           `json:"type"`
+	Reason         string           `json:"reason"`
+	Description    string           `json:"description"`
+	Images         []string         `json:"images"`
+	Status         string           `json:"status"`
+	ApplicantType  string           `json:"applicant_type"`
+	Applicant      string           `json:"applicant"`
+	GoodsAmount    float64          `json:"goods_amount"`
+	DiscountShare  float64          `json:"discount_share"`
+	RefundAmount   float64          `json:"refund_amount"`
+	RefundMethod   *string          `json:"refund_method,omitempty"`
+	WechatRefundID *string          `json:"wechat_refund_id,omitempty"`
+	PointsReversed int              `json:"points_reversed"`
+	Reviewer       *string          `json:"reviewer,omitempty"`
+	ReviewRemark   *string          `json:"review_remark,omitempty"`
+	ReviewedAt     *time.Time       `json:"reviewed_at,omitempty"`
+	CompletedAt    *time.Time       `json:"completed_at,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+	Items          []AfterSalesItem `json:"items,omitempty"`
+	Logs           []AfterSalesLog  `json:"logs,omitempty"`
+}
+
+// AfterSalesItem 售后商品明细
+type AfterSalesItem struct {
+	ID                   int     `json:"id"`
+	RequestID            int     `json:"request_id"`
+	OrderItemID          int     `json:"order_item_id"`
+	ProductID            int     `json:"product_id"`
+	ProductName          string  `json:"product_name"`
+	SpecName             string  `json:"spec_name"`
+	UnitPrice            float64 `json:"unit_price"`
+	CostPrice            float64 `json:"cost_price"`
+	Quantity             int     `json:"quantity"`
+	RefundAmount         float64 `json:"refund_amount"`
+	SupplierCreditAmount float64 `json:"supplier_credit_amount"`
+}
+
+// AfterSalesLog 售后状态流转日志
+type AfterSalesLog struct {
+	ID           int       `json:"id"`
+	RequestID    int       `json:"request_id"`
+	FromStatus   string    `json:"from_status"`
+	ToStatus     string    `json:"to_status"`
+	OperatorType string    `json:"operator_type"`
+	Operator     string    `json:"operator"`
+	Remark       string    `json:"remark"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AfterSalesItemInput 申请售后的商品
+type AfterSalesItemInput struct {
+	OrderItemID int `json:"order_item_id"`
+	Quantity    int `json:"quantity"`
+}
+
+// AfterSalesCreateInput 创建售后申请参数
+type AfterSalesCreateInput struct {
+	OrderID       int
+	Type          string
+	Reason        string
+	Description   string
+	Images        []string
+	Items         []AfterSalesItemInput
+	ApplicantType string
+	Applicant     string
+}
+
+// AfterSalesFilter 售后列表查询条件
+type AfterSalesFilter struct {
+	UserID    int
+	SalesCode string // 销售员：只看名下客户
+	OrderID   int
+	Status    string
+	Keyword   string // 售后单号/订单号
+}
+
+// CreateAfterSalesRequest 创建售后申请（按订单明细和数量，退款金额按成交单价并分摊优惠券/积分抵扣计算）
+func CreateAfterSalesRequest(input AfterSalesCreateInput) (*AfterSalesRequest, error) {
+	if input.Type != AfterSalesTypeRefundOnly && input.Type != AfterSalesTypeReturnRefund {
+		return nil, fmt.Errorf("售后类型无效")
+	}
+	input.Reason = strings.TrimSpace(input.Reason)
+	if input.Reason == "" {
+		return nil, fmt.Errorf("请选择售后原因")
+	}
+	if len(input.Items) == 0 {
+		return nil, fmt.Errorf("请选择售后商品")
+	}
+
+	order, err := GetOrderByID(input.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		return nil, fmt.Errorf("订单不存在")
+	}
+	if !afterSalesEligibleOrderStatuses[order.Status] {
+		return nil, fmt.Errorf("订单送达后才能申请售后")
+	}
+
+	orderItems, err := GetOrderItemsByOrderID(order.ID)
+	if err != nil {
+		return nil, err
+	}
+	itemMap := make(map[int]OrderItem, len(orderItems))
+	for _, it := range orderItems {
+		itemMap[it.ID] = it
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 锁定订单，避免同一订单并发申请超出可售后数量
+	if _, err := tx.Exec(`SELECT id FROM orders WHERE id = ? FOR UPDATE`, order.ID); err != nil {
+		return nil, err
+	}
+	requested, err := getAfterSalesRequestedQuantitiesInTx(tx, order.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]AfterSalesItem, 0, len(input.Items))
+	seen := make(map[int]bool, len(input.Items))
+	goodsAmount := 0.0
+	for _, in := range input.Items {
+		oi, ok := itemMap[in.OrderItemID]
+		if !ok {
+			return nil, fmt.Errorf("订单商品 %d 不存在", in.OrderItemID)
+		}
+		if seen[in.OrderItemID] {
+			return nil, fmt.Errorf("商品 %s 重复提交", oi.ProductName)
+		}
+		seen[in.OrderItemID] = true
+		remaining := oi.Quantity - requested[oi.ID]
+		if in.Quantity <= 0 || in.Quantity > remaining {
+			return nil, fmt.Errorf("%s 可申请售后数量为 %d", oi.ProductName, remaining)
+		}
+		costPrice := 0.0
+		if oi.SpecSnapshot != nil {
+			costPrice = oi.SpecSnapshot.Cost
+		}
+		line := roundMoney(oi.UnitPrice * float64(in.Quantity))
+		goodsAmount += line
+		items = append(items, AfterSalesItem{
+			OrderItemID:  oi.ID,
+			ProductID:    oi.ProductID,
+			ProductName:  oi.ProductName,
+			SpecName:     oi.SpecName,
+			UnitPrice:    oi.UnitPrice,
+			CostPrice:    costPrice,
+			Quantity:     in.Quantity,
+			RefundAmount: line,
+		})
+	}
+	goodsAmount = roundMoney(goodsAmount)
+
+	// 优惠券和积分抵扣按商品金额占比分摊
+	discountShare := 0.0
+	orderDiscount := order.CouponDiscount + order.PointsDiscount
+	if orderDiscount > 0 && order.GoodsAmount > 0 {
+		discountShare = roundMoney(orderDiscount * goodsAmount / order.GoodsAmount)
+		if discountShare > goodsAmount {
+			discountShare = goodsAmount
+		}
+		allocated := 0.0
+		for i := range items {
+			share := roundMoney(discountShare * items[i].RefundAmount / goodsAmount)
+			if i == len(items)-1 {
+				share = roundMoney(discountShare - allocated)
+			}
+			allocated += share
+			items[i].RefundAmount = roundMoney(items[i].RefundAmount - share)
+		}
+	}
+	refundAmount := roundMoney(goodsAmount - discountShare)
+
+	imagesJSON, _ := json.Marshal(input.Images)
+	requestNo := generateAfterSalesNo(order.ID)
+	res, err := tx.Exec(`
+		INSERT INTO after_sales_requests (
+			request_no, order_id, user_id, type, reason, description, images, status,
+			applicant_type, applicant, goods_amount, discount_share, refund_amount, created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())
+	`, requestNo, order.ID, order.UserID, input.Type, input.Reason, strings.TrimSpace(input.Description), string(imagesJSON),
+		AfterSalesPending, input.ApplicantType, input.Applicant, goodsAmount, discountShare, refundAmount)
+	if err != nil {
+		return nil, fmt.Errorf("创建售后申请失败: %v", err)
+	}
+	requestID64, _ := res.LastInsertId()
+	requestID := int(requestID64)
+
+	for i := range items {
+		items[i].RequestID = requestID
+		itemRes, err := tx.Exec(`
+			INSERT INTO after_sales_items (
+				request_id, order_item_id, product_id, product_name, spec_name, unit_price, cost_price, quantity, refund_amount, created_at
+			) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())
+		`, requestID, items[i].OrderItemID, items[i].ProductID, items[i].ProductName, items[i].SpecName,
+			items[i].UnitPrice, items[i].CostPrice, items[i].Quantity, items[i].RefundAmount)
+		if err != nil {
+			return nil, fmt.Errorf("保存售后商品失败: %v", err)
+		}
+		itemID, _ := itemRes.LastInsertId()
+		items[i].ID = int(itemID)
+	}
+
+	if err := insertAfterSalesLogInTx(tx, requestID, "", AfterSalesPending, input.ApplicantType, input.Applicant, "提交售后申请"); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetAfterSalesRequestByID(requestID)
+}
+
+// getAfterSalesRequestedQuantitiesInTx 统计订单各明细已申请（未驳回/撤销）的售后数量
+func getAfterSalesRequestedQuantitiesInTx(tx *sql.Tx, orderID int) (map[int]int, error) {
+	rows, err := tx.Query(`
+		SELECT ai.order_item_id, COALESCE(SUM(ai.quantity), 0)
+		FROM after_sales_items ai
+		INNER JOIN after_sales_requests ar ON ai.request_id = ar.id
+		WHERE ar.order_id = ? AND ar.status NOT IN (?, ?)
+		GROUP BY ai.order_item_id
+	`, orderID, AfterSalesRejected, AfterSalesCancelled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int]int)
+	for rows.Next() {
+		var itemID, qty int
+		if err := rows.Scan(&itemID, &qty); err != nil {
+			return nil, err
+		}
+		result[itemID] = qty
+	}
+	return result, rows.Err()
+}
+
+// GetAfterSalesRequestByID 获取售后申请详情（含商品明细和流转日志）
+func GetAfterSalesRequestByID(id int) (*AfterSalesRequest, error) {
+	list, _, err := queryAfterSalesRequests("ar.id = ?", []interface{}{id}, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	req := &list[0]
+	if req.Items, err = GetAfterSalesItems(id); err != nil {
+		return nil, err
+	}
+	if req.Logs, err = GetAfterSalesLogs(id); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// GetAfterSalesRequests 获取售后申请列表（分页）
+func GetAfterSalesRequests(filter AfterSalesFilter, pageNum, pageSize int) ([]AfterSalesRequest, int, error) {
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+	where := "1=1"
+	args := []interface{}{}
+	if filter.UserID > 0 {
+		where += " AND ar.user_id = ?"
+		args = append(args, filter.UserID)
+	}
+	if filter.SalesCode != "" {
+		where += " AND ar.user_id IN (SELECT id FROM mini_app_users WHERE sales_code = ?)"
+		args = append(args, filter.SalesCode)
+	}
+	if filter.OrderID > 0 {
+		where += " AND ar.order_id = ?"
+		args = append(args, filter.OrderID)
+	}
+	if filter.Status != "" {
+		where += " AND ar.status = ?"
+		args = append(args, filter.Status)
+	}
+	if filter.Keyword != "" {
+		where += " AND (ar.request_no LIKE ? OR o.order_number LIKE ?)"
+		kw := "%" + filter.Keyword + "%"
+		args = append(args, kw, kw)
+	}
+	return queryAfterSalesRequests(where, args, pageSize, (pageNum-1)*pageSize)
+}
+
+func queryAfterSalesRequests(where string, args []interface{}, limit, offset int) ([]AfterSalesRequest, int, error) {
+	var total int
+	if err := database.DB.QueryRow(`
+		SELECT COUNT(*) FROM after_sales_requests ar LEFT JOIN orders o ON ar.order_id = o.id WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT ar.id, ar.request_no, ar.order_id, COALESCE(o.order_number, ''), ar.user_id, ar.type, ar.reason, ar.description,
+		       ar.images, ar.status, ar.applicant_type, ar.applicant, ar.goods_amount, ar.discount_share, ar.refund_amount,
+		       ar.refund_method, ar.wechat_refund_id, ar.points_reversed, ar.reviewer, ar.review_remark, ar.reviewed_at,
+		       ar.completed_at, ar.created_at, ar.updated_at
+		FROM after_sales_requests ar
+		LEFT JOIN orders o ON ar.order_id = o.id
+		WHERE ` + where + ` ORDER BY ar.id DESC LIMIT ? OFFSET ?`
+	rows, err := database.DB.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	list := make([]AfterSalesRequest, 0)
+	for rows.Next() {
+		var r AfterSalesRequest
+		var images, refundMethod, wechatRefundID, reviewer, reviewRemark sql.NullString
+		var reviewedAt, completedAt sql.NullTime
+		if err := rows.Scan(&r.ID, &r.RequestNo, &r.OrderID, &r.OrderNumber, &r.UserID, &r.Type, &r.Reason, &r.Description,
+			&images, &r.Status, &r.ApplicantType, &r.Applicant, &r.GoodsAmount, &r.DiscountShare, &r.RefundAmount,
+			&refundMethod, &wechatRefundID, &r.PointsReversed, &reviewer, &reviewRemark, &reviewedAt,
+			&completedAt, &r.CreatedAt, &r.UpdatedAt); err != nil {
+			return nil, 0, err
+		}
+		r.Images = []string{}
+		if images.Valid && images.String != "" {
+			_ = json.Unmarshal([]byte(images.String), &r.Images)
+		}
+		if refundMethod.Valid {
+			r.RefundMethod = &refundMethod.String
+		}
+		if wechatRefundID.Valid {
+			r.WechatRefundID = &wechatRefundID.String
+		}
+		if reviewer.Valid {
+			r.Reviewer = &reviewer.String
+		}
+		if reviewRemark.Valid {
+			r.ReviewRemark = &reviewRemark.String
+		}
+		if reviewedAt.Valid {
+			t := reviewedAt.Time
+			r.ReviewedAt = &t
+		}
+		if completedAt.Valid {
+			t := completedAt.Time
+			r.CompletedAt = &t
+		}
+		list = append(list, r)
+	}
+	return list, total, rows.Err()
+}
+
+// GetAfterSalesItems 获取售后商品明细
+func GetAfterSalesItems(requestID int) ([]AfterSalesItem, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, request_id, order_item_id, product_id, product_name, spec_name, unit_price, cost_price, quantity,
+		       refund_amount, supplier_credit_amount
+		FROM after_sales_items WHERE request_id = ? ORDER BY id
+	`, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]AfterSalesItem, 0)
+	for rows.Next() {
+		var it AfterSalesItem
+		if err := rows.Scan(&it.ID, &it.RequestID, &it.OrderItemID, &it.ProductID, &it.ProductName, &it.SpecName,
+			&it.UnitPrice, &it.CostPrice, &it.Quantity, &it.RefundAmount, &it.SupplierCreditAmount); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// GetAfterSalesLogs 获取售后状态流转日志
+func GetAfterSalesLogs(requestID int) ([]AfterSalesLog, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, request_id, from_status, to_status, operator_type, operator, remark, created_at
+		FROM after_sales_logs WHERE request_id = ? ORDER BY id
+	`, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logs := make([]AfterSalesLog, 0)
+	for rows.Next() {
+		var l AfterSalesLog
+		if err := rows.Scan(&l.ID, &l.RequestID, &l.FromStatus, &l.ToStatus, &l.OperatorType, &l.Operator, &l.Remark, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	return logs, rows.Err()
+}
+
+// ApproveAfterSales 审核通过售后申请，refundAmount 为空时使用系统计算的退款金额
+// 退款金额不能超过订单剩余可退金额：原支付总额扣除已发起的微信退款（含缺货、取消和售后退款），
+// 再扣除尚未体现在微信退款记录中的其他售后（线下退款、处理中或退款失败）
+func ApproveAfterSales(id int, refundAmount *float64, reviewer, remark string) (*AfterSalesRequest, error) {
+	req, err := GetAfterSalesRequestByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if req == nil {
+		return nil, fmt.Errorf("售后申请不存在")
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 锁定订单，避免同一订单的多个售后并发审核超出可退金额
+	if _, err := tx.Exec(`SELECT id FROM orders WHERE id = ? FOR UPDATE`, req.OrderID); err != nil {
+		return nil, err
+	}
+	order, err := GetOrderByID(req.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		return nil, fmt.Errorf("订单不存在")
+	}
+
+	if _, err := transitionAfterSalesInTx(tx, id, AfterSalesApproved, AfterSalesOperatorAdmin, reviewer, remark); err != nil {
+		return nil, err
+	}
+
+	refundable, err := GetOrderRefundableAmount(order)
+	if err != nil {
+		return nil, err
+	}
+	// 其他售后中未对应有效微信退款记录的部分（线下退款、已审核待退款、退款失败待重试）
+	var otherRefunds float64
+	if err := tx.QueryRow(`
+		SELECT COALESCE(SUM(ar.refund_amount), 0) FROM after_sales_requests ar
+		WHERE ar.order_id = ? AND ar.id != ? AND ar.status IN (?, ?, ?, ?)
+		  AND NOT EXISTS (
+		    SELECT 1 FROM wechat_refunds wr WHERE wr.refund_id = ar.wechat_refund_id AND wr.status NOT IN (?, ?)
+		  )
+	`, req.OrderID, id, AfterSalesApproved, AfterSalesRefunding, AfterSalesRefundFailed, AfterSalesCompleted,
+		WechatRefundClosed, WechatRefundAbnormal).Scan(&otherRefunds); err != nil {
+		return nil, err
+	}
+	refundable = roundMoney(refundable - otherRefunds)
+	if refundable < 0 {
+		refundable = 0
+	}
+
+	amount := req.RefundAmount
+	if refundAmount != nil {
+		amount = roundMoney(*refundAmount)
+	}
+	if amount < 0 {
+		return nil, fmt.Errorf("退款金额不能为负数")
+	}
+	if amount > refundable {
+		if refundAmount != nil {
+			return nil, fmt.Errorf("退款金额不能超过订单剩余可退金额 %.2f 元", refundable)
+		}
+		amount = refundable
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE after_sales_requests
+		SET refund_amount = ?, reviewer = ?, review_remark = ?, reviewed_at = NOW(), updated_at = NOW()
+		WHERE id = ?
+	`, amount, reviewer, remark, id); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetAfterSalesRequestByID(id)
+}
+
+// RejectAfterSales 驳回售后申请
+func RejectAfterSales(id int, reviewer, remark string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := transitionAfterSalesInTx(tx, id, AfterSalesRejected, AfterSalesOperatorAdmin, reviewer, remark); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		UPDATE after_sales_requests SET reviewer = ?, review_remark = ?, reviewed_at = NOW(), updated_at = NOW() WHERE id = ?
+	`, reviewer, remark, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CancelAfterSales 申请人撤销售后申请（仅待审核状态）
+func CancelAfterSales(id int, operatorType, operator string) error {
+	return updateAfterSalesStatus(id, AfterSalesCancelled, operatorType, operator, "申请人撤销")
+}
+
+// MarkAfterSalesRefunding 已发起微信退款，等待退款结果
+func MarkAfterSalesRefunding(id int, wechatRefundID, operatorType, operator string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := transitionAfterSalesInTx(tx, id, AfterSalesRefunding, operatorType, operator, "已发起微信退款"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		UPDATE after_sales_requests SET refund_method = ?, wechat_refund_id = ?, updated_at = NOW() WHERE id = ?
+	`, AfterSalesRefundWechat, wechatRefundID, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MarkAfterSalesAwaitingOfflineRefund 非微信支付订单需线下退款：记录退款方式，保持已同意状态等待管理员确认后手动完成
+func MarkAfterSalesAwaitingOfflineRefund(id int) error {
+	_, err := database.DB.Exec(`
+		UPDATE after_sales_requests SET refund_method = ?, updated_at = NOW() WHERE id = ?
+	`, AfterSalesRefundOffline, id)
+	return err
+}
+
+// MarkAfterSalesRefundFailed 退款失败（可重试）
+func MarkAfterSalesRefundFailed(id int, operatorType, operator, remark string) error {
+	return updateAfterSalesStatus(id, AfterSalesRefundFailed, operatorType, operator, remark)
+}
+
+func updateAfterSalesStatus(id int, to, operatorType, operator, remark string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := transitionAfterSalesInTx(tx, id, to, operatorType, operator, remark); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CompleteAfterSales 售后完成：累计订单退款金额，退货退款的商品入库并冲减供应商付款，随后扣回订单奖励积分、重算销售分成
+func CompleteAfterSales(id int, refundMethod, operatorType, operator, remark string) error {
+	req, err := GetAfterSalesRequestByID(id)
+	if err != nil {
+		return err
+	}
+	if req == nil {
+		return fmt.Errorf("售后申请不存在")
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := transitionAfterSalesInTx(tx, id, AfterSalesCompleted, operatorType, operator, remark); err != nil {
+		return err
+	}
+
+	returnedCost := 0.0
+	if req.Type == AfterSalesTypeReturnRefund {
+		for _, it := range req.Items {
+			if err := ReturnStockInTx(tx, req.OrderID, it.ProductID, it.SpecName, it.Quantity, StockOperatorSystem, req.RequestNo, "售后退货入库"); err != nil {
+				return err
+			}
+			if _, err := AddSupplierPaymentItemReturnInTx(tx, it.OrderItemID, it.Quantity); err != nil {
+				return fmt.Errorf("冲减供应商付款失败: %v", err)
+			}
+			credit := roundMoney(it.CostPrice * float64(it.Quantity))
+			returnedCost += credit
+			if _, err := tx.Exec(`UPDATE after_sales_items SET supplier_credit_amount = ? WHERE id = ?`, credit, it.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE orders
+		SET after_sales_refund_amount = after_sales_refund_amount + ?, after_sales_returned_cost = after_sales_returned_cost + ?, updated_at = NOW()
+		WHERE id = ?
+	`, req.RefundAmount, roundMoney(returnedCost), req.OrderID); err != nil {
+		return fmt.Errorf("更新订单售后金额失败: %v", err)
+	}
+	if _, err := tx.Exec(`
+		UPDATE after_sales_requests
+		SET refund_method = COALESCE(refund_method, ?), completed_at = NOW(), updated_at = NOW()
+		WHERE id = ?
+	`, refundMethod, id); err != nil {
+		return err
+	}
+	// 积分和分成调整与售后完成同一事务入队，失败自动重试，每个售后单只入队一次
+	key := fmt.Sprintf("%s:%d", JobAfterSalesCompleted, id)
+	if err := EnqueueJobInTx(tx, JobAfterSalesCompleted, AfterSalesJobPayload{RequestID: id}, JobOptions{IdempotencyKey: key}); err != nil {
+		return fmt.Errorf("售后后续处理任务入队失败: %v", err)
+	}
+	return tx.Commit()
+}
+
+// runAfterSalesCompletedJob 售后完成后续处理：扣回订单奖励积分、退回抵扣积分、重算销售分成，各步骤可重复执行
+func runAfterSalesCompletedJob(payload []byte) error {
+	var p AfterSalesJobPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("解析任务参数失败: %v", err)
+	}
+	req, err := GetAfterSalesRequestByID(p.RequestID)
+	if err != nil {
+		return err
+	}
+	if req == nil {
+		return nil
+	}
+	if err := reverseAfterSalesPoints(req); err != nil {
+		return fmt.Errorf("售后 %d 扣回积分失败: %v", req.ID, err)
+	}
+	if err := refundAfterSalesRedeemedPoints(req); err != nil {
+		return fmt.Errorf("售后 %d 退回抵扣积分失败: %v", req.ID, err)
+	}
+	return refreshAfterSalesCommission(req.OrderID)
+}
+
+// CompleteAfterSalesByWechatRefundID 微信退款成功回调：完成对应的售后申请（非售后退款时忽略）
+func CompleteAfterSalesByWechatRefundID(wechatRefundID string) error {
+	id, err := getAfterSalesIDByWechatRefundID(wechatRefundID)
+	if err != nil || id == 0 {
+		return err
+	}
+	return CompleteAfterSales(id, AfterSalesRefundWechat, AfterSalesOperatorSystem, "", "微信退款成功")
+}
+
+// FailAfterSalesByWechatRefundID 微信退款失败回调：标记售后退款失败（非售后退款时忽略）
+func FailAfterSalesByWechatRefundID(wechatRefundID, refundStatus string) error {
+	id, err := getAfterSalesIDByWechatRefundID(wechatRefundID)
+	if err != nil || id == 0 {
+		return err
+	}
+	return MarkAfterSalesRefundFailed(id, AfterSalesOperatorSystem, "", "微信退款失败："+refundStatus)
+}
+
+func getAfterSalesIDByWechatRefundID(wechatRefundID string) (int, error) {
+	if wechatRefundID == "" {
+		return 0, nil
+	}
+	var id int
+	err := database.DB.QueryRow(`
+		SELECT id FROM after_sales_requests WHERE wechat_refund_id = ? AND status = ? LIMIT 1
+	`, wechatRefundID, AfterSalesRefunding).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// reverseAfterSalesPoints 扣回售后退款对应的订单奖励积分（每退1元扣1积分，不超过用户当前积分）
+// 与售后单的 points_reversed 标记同一事务提交，任务重试时不会重复扣回
+func reverseAfterSalesPoints(req *AfterSalesRequest) error {
+	var rewarded int
+	if err := database.DB.QueryRow(`
+		SELECT COUNT(*) FROM points_logs WHERE user_id = ? AND type = 'order_reward' AND related_type = 'order' AND related_id = ?
+	`, req.UserID, req.OrderID).Scan(&rewarded); err != nil {
+		return err
+	}
+	points := int(math.Round(req.RefundAmount))
+	if rewarded == 0 || points <= 0 {
+		return nil
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var reversed int
+	if err := tx.QueryRow(`SELECT points_reversed FROM after_sales_requests WHERE id = ? FOR UPDATE`, req.ID).Scan(&reversed); err != nil {
+		return err
+	}
+	if reversed > 0 {
+		return nil
+	}
+	var balance int
+	if err := tx.QueryRow(`SELECT COALESCE(points, 0) FROM mini_app_users WHERE id = ? FOR UPDATE`, req.UserID).Scan(&balance); err != nil {
+		return fmt.Errorf("查询用户 %d 积分失败: %v", req.UserID, err)
+	}
+	if points > balance {
+		points = balance
+	}
+	if points <= 0 {
+		return nil
+	}
+
+	desc := fmt.Sprintf("售后退款扣回积分（售后单号：%s，退款金额：%.2f元）", req.RequestNo, req.RefundAmount)
+	if _, err := applyPointsChangeInTx(tx, req.UserID, -points, "after_sales_deduct", req.ID, "after_sales", desc); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE after_sales_requests SET points_reversed = ? WHERE id = ?`, points, req.ID); err != nil {
+		return fmt.Errorf("更新售后扣回积分记录失败: %v", err)
+	}
+	return tx.Commit()
+}
+
+// refreshAfterSalesCommission 售后完成后重算订单销售分成（已结算给销售员的分成不自动调整）
+func refreshAfterSalesCommission(orderID int) error {
+	var total, settled int
+	if err := database.DB.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(is_settled), 0) FROM sales_commissions WHERE order_id = ?
+	`, orderID).Scan(&total, &settled); err != nil {
+		return fmt.Errorf("查询订单 %d 分成记录失败: %v", orderID, err)
+	}
+	if total == 0 {
+		return nil
+	}
+	if settled > 0 {
+		log.Printf("[AfterSales] 订单 %d 的销售分成已结算，需人工调整", orderID)
+		return nil
+	}
+	return ProcessOrderSettlement(orderID)
+}
+
+// transitionAfterSalesInTx 在事务内按状态机流转售后状态并记录日志，返回原状态
+func transitionAfterSalesInTx(tx *sql.Tx, id int, to, operatorType, operator, remark string) (string, error) {
+	var from string
+	err := tx.QueryRow(`SELECT status FROM after_sales_requests WHERE id = ? FOR UPDATE`, id).Scan(&from)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("售后申请不存在")
+	}
+	if err != nil {
+		return "", err
+	}
+	if !CanAfterSalesTransition(from, to) {
+		return "", fmt.Errorf("售后状态不允许从 %s 变更为 %s", from, to)
+	}
+	if _, err := tx.Exec(`UPDATE after_sales_requests SET status = ?, updated_at = NOW() WHERE id = ?`, to, id); err != nil {
+		return "", err
+	}
+	if err := insertAfterSalesLogInTx(tx, id, from, to, operatorType, operator, remark); err != nil {
+		return "", err
+	}
+	return from, nil
+}
+
+func insertAfterSalesLogInTx(tx *sql.Tx, requestID int, from, to, operatorType, operator, remark string) error {
+	_, err := tx.Exec(`
+		INSERT INTO after_sales_logs (request_id, from_status, to_status, operator_type, operator, remark, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, NOW())
+	`, requestID, from, to, operatorType, operator, remark)
+	if err != nil {
+		return fmt.Errorf("记录售后日志失败: %v", err)
+	}
+	return nil
+}
+
+// generateAfterSalesNo 生成售后单号：AS + YYYYMMDDHHmmss + 订单ID后4位 + 2位随机数
+func generateAfterSalesNo(orderID int) string {
+	return fmt.Sprintf("AS%s%04d%02d", time.Now().Format("20060102150405"), orderID%10000, rand.Intn(100))
+}
+
+func roundMoney(v float64) float64 {
+	return math.Round(v*100) / 100
+}
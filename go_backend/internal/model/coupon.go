@@ -56,11 +56,25 @@ func FromTime(t time.Time) LocalTime {
 	return LocalTime(t)
 }
 
+// 优惠券类型
+const (
+	CouponTypeDeliveryFee = "delivery_fee" // 免配送费券
+	CouponTypeAmount      = "amount"       // 金额券（满减）
+	CouponTypePercent     = "percent"      // 折扣券（discount_value 为优惠百分比）
+)
+
+// 优惠券叠加规则
+const (
+	CouponStackExclusive     = "exclusive"      // 不可与任何优惠券叠加
+	CouponStackDifferentType = "different_type" // 可与其他类型的优惠券叠加（默认）
+	CouponStackAny           = "any"            // 可与任何可叠加的优惠券叠加，包括同类型
+)
+
 // Coupon 优惠券模型
 type Coupon struct {
 	ID            int       `json:"id"`
 	Name          string    `json:"name"`
-	Type          string    `json:"type"` // delivery_fee 或 amount
+	Type          string    `json:"type"` // delivery_fee、amount 或 percent
 	DiscountValue float64   `json:"discount_value"`
 	MinAmount     float64   `json:"min_amount"`
 	CategoryIDs   []int     `json:"category_ids"`
@@ -72,6 +86,121 @@ type Coupon struct {
 	Description   string    `json:"description"`
 	CreatedAt     time.Time `json:"created_at"`
 	UpdatedAt     time.Time `json:"updated_at"`
+	CouponRules
+}
+
+// CouponRules 优惠券的折扣上限、适用范围、排除范围、限用和叠加规则
+type CouponRules struct {
+	MaxDiscount        float64  `json:"max_discount"`         // 折扣券最高优惠金额，0 表示不限
+	ProductIDs         []int    `json:"product_ids"`          // 适用商品，为空不限
+	SpecKeys           []string `json:"spec_keys"`            // 适用规格（商品ID:规格名），为空不限
+	SupplierIDs        []int    `json:"supplier_ids"`         // 适用供应商，为空不限
+	ExcludeProductIDs  []int    `json:"exclude_product_ids"`  // 排除商品
+	ExcludeCategoryIDs []int    `json:"exclude_category_ids"` // 排除分类
+	PerUserLimit       int      `json:"per_user_limit"`       // 每个用户最多使用次数，0 表示不限
+	StackMode          string   `json:"stack_mode"`           // exclusive / different_type / any
+}
+
+// CouponSpecKey 规格范围的键（商品ID:规格名）
+func CouponSpecKey(productID int, specName string) string {
+	return fmt.Sprintf("%d:%s", productID, specName)
+}
+
+// couponRuleColumns 优惠券规则字段，alias 为表别名（可为空）
+func couponRuleColumns(alias string) string {
+	prefix := ""
+	if alias != "" {
+		prefix = alias + "."
+	}
+	columns := []string{"max_discount", "product_ids", "spec_keys", "supplier_ids", "exclude_product_ids", "exclude_category_ids", "per_user_limit", "stack_mode"}
+	for i, col := range columns {
+		columns[i] = prefix + col
+	}
+	return strings.Join(columns, ", ")
+}
+
+// couponRuleScanner 扫描 couponRuleColumns 对应的字段（LEFT JOIN 时可能为 NULL）
+type couponRuleScanner struct {
+	maxDiscount        sql.NullFloat64
+	productIDs         sql.NullString
+	specKeys           sql.NullString
+	supplierIDs        sql.NullString
+	excludeProductIDs  sql.NullString
+	excludeCategoryIDs sql.NullString
+	perUserLimit       sql.NullInt64
+	stackMode          sql.NullString
+}
+
+func (s *couponRuleScanner) dest() []interface{} {
+	return []interface{}{&s.maxDiscount, &s.productIDs, &s.specKeys, &s.supplierIDs, &s.excludeProductIDs, &s.excludeCategoryIDs, &s.perUserLimit, &s.stackMode}
+}
+
+func (s *couponRuleScanner) rules() CouponRules {
+	rules := CouponRules{
+		MaxDiscount:        s.maxDiscount.Float64,
+		ProductIDs:         parseCouponIDList(s.productIDs),
+		SupplierIDs:        parseCouponIDList(s.supplierIDs),
+		ExcludeProductIDs:  parseCouponIDList(s.excludeProductIDs),
+		ExcludeCategoryIDs: parseCouponIDList(s.excludeCategoryIDs),
+		PerUserLimit:       int(s.perUserLimit.Int64),
+		StackMode:          s.stackMode.String,
+		SpecKeys:           []string{},
+	}
+	if s.specKeys.Valid && s.specKeys.String != "" {
+		if err := json.Unmarshal([]byte(s.specKeys.String), &rules.SpecKeys); err != nil {
+			rules.SpecKeys = []string{}
+		}
+	}
+	if rules.StackMode == "" {
+		rules.StackMode = CouponStackDifferentType
+	}
+	return rules
+}
+
+func parseCouponIDList(v sql.NullString) []int {
+	ids := []int{}
+	if v.Valid && v.String != "" {
+		if err := json.Unmarshal([]byte(v.String), &ids); err != nil {
+			return []int{}
+		}
+	}
+	return ids
+}
+
+// couponRuleArgs 规则字段的写入参数，顺序与 couponRuleColumns 一致
+func couponRuleArgs(rules CouponRules) []interface{} {
+	jsonText := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	stackMode := rules.StackMode
+	if stackMode == "" {
+		stackMode = CouponStackDifferentType
+	}
+	return []interface{}{
+		rules.MaxDiscount,
+		jsonText(nonNilInts(rules.ProductIDs)),
+		jsonText(nonNilStrings(rules.SpecKeys)),
+		jsonText(nonNilInts(rules.SupplierIDs)),
+		jsonText(nonNilInts(rules.ExcludeProductIDs)),
+		jsonText(nonNilInts(rules.ExcludeCategoryIDs)),
+		rules.PerUserLimit,
+		stackMode,
+	}
+}
+
+func nonNilInts(v []int) []int {
+	if v == nil {
+		return []int{}
+	}
+	return v
+}
+
+func nonNilStrings(v []string) []string {
+	if v == nil {
+		return []string{}
+	}
+	return v
 }
 
 // UserCoupon 用户优惠券关联
@@ -98,22 +227,37 @@ type CouponIssueLog struct {
 	CouponName   string     `json:"coupon_name"`          // 优惠券名称快照
 	Quantity     int        `json:"quantity"`             // 发放数量
 	Reason       string     `json:"reason"`               // 发放原因
-	OperatorType string     `json:"operator_type"`        // admin / employee
+	OperatorType string     `json:"operator_type"`        // admin / employee / self_service
 	OperatorID   int        `json:"operator_id"`          // 操作人ID
 	OperatorName string     `json:"operator_name"`        // 操作人名称
 	CreatedAt    time.Time  `json:"created_at"`           // 发放时间
 	ExpiresAt    *time.Time `json:"expires_at,omitempty"` // 到期时间（如有）
 }
 
+// 优惠券发放记录的操作人类型
+const (
+	CouponIssueOperatorAdmin       = "admin"
+	CouponIssueOperatorEmployee    = "employee"
+	CouponIssueOperatorSelfService = "self_service" // 客户在领券中心领取或使用兑换码兑换，操作人为客户本人
+)
+
 // CreateCouponIssueLog 创建一条优惠券发放记录
 func CreateCouponIssueLog(log *CouponIssueLog) error {
+	return insertCouponIssueLog(database.DB, log)
+}
+
+type couponIssueLogExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertCouponIssueLog(db couponIssueLogExecer, log *CouponIssueLog) error {
 	query := `
 		INSERT INTO coupon_issue_logs
 			(user_id, coupon_id, coupon_name, quantity, reason, operator_type, operator_id, operator_name, expires_at, created_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())
 	`
 
-	_, err := database.DB.Exec(
+	_, err := db.Exec(
 		query,
 		log.UserID,
 		log.CouponID,
@@ -357,6 +501,7 @@ func GetAllCoupons() ([]CouponWithStats, error) {
 	var coupons []CouponWithStats
 	query := `
 		SELECT c.id, c.name, c.type, c.discount_value, c.min_amount, c.category_ids, c.total_count, c.used_count, c.status, c.valid_from, c.valid_to, c.description, c.created_at, c.updated_at,
+		       ` + couponRuleColumns("c") + `,
 		       COALESCE(COUNT(DISTINCT uc.id), 0) as issued_count,
 		       COALESCE(SUM(CASE WHEN uc.status = 'used' THEN 1 ELSE 0 END), 0) as actual_used_count
 		FROM coupons c
@@ -375,9 +520,14 @@ func GetAllCoupons() ([]CouponWithStats, error) {
 		var categoryIDsJSON sql.NullString
 		var validFrom, validTo time.Time
 		var actualUsedCount int
-		if err := rows.Scan(&coupon.ID, &coupon.Name, &coupon.Type, &coupon.DiscountValue, &coupon.MinAmount, &categoryIDsJSON, &coupon.TotalCount, &coupon.UsedCount, &coupon.Status, &validFrom, &validTo, &coupon.Description, &coupon.CreatedAt, &coupon.UpdatedAt, &coupon.IssuedCount, &actualUsedCount); err != nil {
+		var ruleScanner couponRuleScanner
+		dest := []interface{}{&coupon.ID, &coupon.Name, &coupon.Type, &coupon.DiscountValue, &coupon.MinAmount, &categoryIDsJSON, &coupon.TotalCount, &coupon.UsedCount, &coupon.Status, &validFrom, &validTo, &coupon.Description, &coupon.CreatedAt, &coupon.UpdatedAt}
+		dest = append(dest, ruleScanner.dest()...)
+		dest = append(dest, &coupon.IssuedCount, &actualUsedCount)
+		if err := rows.Scan(dest...); err != nil {
 			return nil, err
 		}
+		coupon.CouponRules = ruleScanner.rules()
 
 		// 使用实际统计的已使用数量
 		coupon.UsedCount = actualUsedCount
@@ -413,14 +563,17 @@ func GetCouponByID(id int) (*Coupon, error) {
 	var coupon Coupon
 	var categoryIDsJSON sql.NullString
 	var validFrom, validTo time.Time
-	query := "SELECT id, name, type, discount_value, min_amount, category_ids, total_count, used_count, status, valid_from, valid_to, description, created_at, updated_at FROM coupons WHERE id = ?"
-	err := database.DB.QueryRow(query, id).Scan(&coupon.ID, &coupon.Name, &coupon.Type, &coupon.DiscountValue, &coupon.MinAmount, &categoryIDsJSON, &coupon.TotalCount, &coupon.UsedCount, &coupon.Status, &validFrom, &validTo, &coupon.Description, &coupon.CreatedAt, &coupon.UpdatedAt)
+	var ruleScanner couponRuleScanner
+	query := "SELECT id, name, type, discount_value, min_amount, category_ids, total_count, used_count, status, valid_from, valid_to, description, created_at, updated_at, " + couponRuleColumns("") + " FROM coupons WHERE id = ?"
+	dest := []interface{}{&coupon.ID, &coupon.Name, &coupon.Type, &coupon.DiscountValue, &coupon.MinAmount, &categoryIDsJSON, &coupon.TotalCount, &coupon.UsedCount, &coupon.Status, &validFrom, &validTo, &coupon.Description, &coupon.CreatedAt, &coupon.UpdatedAt}
+	err := database.DB.QueryRow(query, id).Scan(append(dest, ruleScanner.dest()...)...)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
+	coupon.CouponRules = ruleScanner.rules()
 
 	coupon.ValidFrom = LocalTime(validFrom)
 	coupon.ValidTo = LocalTime(validTo)
@@ -444,8 +597,9 @@ func CreateCoupon(coupon *Coupon) error {
 		return err
 	}
 
-	query := "INSERT INTO coupons (name, type, discount_value, min_amount, category_ids, total_count, used_count, status, valid_from, valid_to, description, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?, NOW(), NOW())"
-	result, err := database.DB.Exec(query, coupon.Name, coupon.Type, coupon.DiscountValue, coupon.MinAmount, string(categoryIDsJSON), coupon.TotalCount, coupon.Status, coupon.ValidFrom.ToTime(), coupon.ValidTo.ToTime(), coupon.Description)
+	query := "INSERT INTO coupons (name, type, discount_value, min_amount, category_ids, total_count, used_count, status, valid_from, valid_to, description, " + couponRuleColumns("") + ", created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())"
+	args := []interface{}{coupon.Name, coupon.Type, coupon.DiscountValue, coupon.MinAmount, string(categoryIDsJSON), coupon.TotalCount, coupon.Status, coupon.ValidFrom.ToTime(), coupon.ValidTo.ToTime(), coupon.Description}
+	result, err := database.DB.Exec(query, append(args, couponRuleArgs(coupon.CouponRules)...)...)
 	if err != nil {
 		return err
 	}
@@ -465,8 +619,11 @@ func UpdateCoupon(coupon *Coupon) error {
 		return err
 	}
 
-	query := "UPDATE coupons SET name = ?, type = ?, discount_value = ?, min_amount = ?, category_ids = ?, total_count = ?, status = ?, valid_from = ?, valid_to = ?, description = ?, updated_at = NOW() WHERE id = ?"
-	_, err = database.DB.Exec(query, coupon.Name, coupon.Type, coupon.DiscountValue, coupon.MinAmount, string(categoryIDsJSON), coupon.TotalCount, coupon.Status, coupon.ValidFrom.ToTime(), coupon.ValidTo.ToTime(), coupon.Description, coupon.ID)
+	query := "UPDATE coupons SET name = ?, type = ?, discount_value = ?, min_amount = ?, category_ids = ?, total_count = ?, status = ?, valid_from = ?, valid_to = ?, description = ?, " +
+		"max_discount = ?, product_ids = ?, spec_keys = ?, supplier_ids = ?, exclude_product_ids = ?, exclude_category_ids = ?, per_user_limit = ?, stack_mode = ?, updated_at = NOW() WHERE id = ?"
+	args := []interface{}{coupon.Name, coupon.Type, coupon.DiscountValue, coupon.MinAmount, string(categoryIDsJSON), coupon.TotalCount, coupon.Status, coupon.ValidFrom.ToTime(), coupon.ValidTo.ToTime(), coupon.Description}
+	args = append(args, couponRuleArgs(coupon.CouponRules)...)
+	_, err = database.DB.Exec(query, append(args, coupon.ID)...)
 	return err
 }
 
@@ -481,7 +638,8 @@ func DeleteCoupon(id int) error {
 func GetAvailableCouponsForUser(userID int, orderAmount float64, categoryIDs []int) ([]Coupon, error) {
 	now := time.Now()
 	query := `
-		SELECT c.id, c.name, c.type, c.discount_value, c.min_amount, c.category_ids, c.total_count, c.used_count, c.status, c.valid_from, c.valid_to, c.description, c.created_at, c.updated_at
+		SELECT c.id, c.name, c.type, c.discount_value, c.min_amount, c.category_ids, c.total_count, c.used_count, c.status, c.valid_from, c.valid_to, c.description, c.created_at, c.updated_at,
+		       ` + couponRuleColumns("c") + `
 		FROM coupons c
 		WHERE c.status = 1
 		  AND c.valid_from <= ?
@@ -505,9 +663,12 @@ func GetAvailableCouponsForUser(userID int, orderAmount float64, categoryIDs []i
 		var coupon Coupon
 		var categoryIDsJSON sql.NullString
 		var validFrom, validTo time.Time
-		if err := rows.Scan(&coupon.ID, &coupon.Name, &coupon.Type, &coupon.DiscountValue, &coupon.MinAmount, &categoryIDsJSON, &coupon.TotalCount, &coupon.UsedCount, &coupon.Status, &validFrom, &validTo, &coupon.Description, &coupon.CreatedAt, &coupon.UpdatedAt); err != nil {
+		var ruleScanner couponRuleScanner
+		dest := []interface{}{&coupon.ID, &coupon.Name, &coupon.Type, &coupon.DiscountValue, &coupon.MinAmount, &categoryIDsJSON, &coupon.TotalCount, &coupon.UsedCount, &coupon.Status, &validFrom, &validTo, &coupon.Description, &coupon.CreatedAt, &coupon.UpdatedAt}
+		if err := rows.Scan(append(dest, ruleScanner.dest()...)...); err != nil {
 			return nil, err
 		}
+		coupon.CouponRules = ruleScanner.rules()
 
 		// 确保时间使用本地时区
 		coupon.ValidFrom = LocalTime(validFrom.In(time.Local))
@@ -552,7 +713,8 @@ func GetAvailableCouponsForUser(userID int, orderAmount float64, categoryIDs []i
 func GetUserCoupons(userID int) ([]UserCoupon, error) {
 	query := `
 		SELECT uc.id, uc.user_id, uc.coupon_id, uc.status, uc.used_at, uc.order_id, uc.expires_at, uc.created_at, uc.updated_at,
-		       c.id, c.name, c.type, c.discount_value, c.min_amount, c.category_ids, c.total_count, c.used_count, c.status, c.valid_from, c.valid_to, c.description, c.created_at, c.updated_at
+		       c.id, c.name, c.type, c.discount_value, c.min_amount, c.category_ids, c.total_count, c.used_count, c.status, c.valid_from, c.valid_to, c.description, c.created_at, c.updated_at,
+		       ` + couponRuleColumns("c") + `
 		FROM user_coupons uc
 		LEFT JOIN coupons c ON uc.coupon_id = c.id
 		WHERE uc.user_id = ?
@@ -574,13 +736,16 @@ func GetUserCoupons(userID int) ([]UserCoupon, error) {
 		var coupon Coupon
 
 		var validFrom, validTo time.Time
-		err := rows.Scan(
+		var ruleScanner couponRuleScanner
+		dest := []interface{}{
 			&uc.ID, &uc.UserID, &uc.CouponID, &uc.Status, &usedAt, &orderID, &expiresAt, &uc.CreatedAt, &uc.UpdatedAt,
 			&coupon.ID, &coupon.Name, &coupon.Type, &coupon.DiscountValue, &coupon.MinAmount, &categoryIDsJSON, &coupon.TotalCount, &coupon.UsedCount, &coupon.Status, &validFrom, &validTo, &coupon.Description, &coupon.CreatedAt, &coupon.UpdatedAt,
-		)
+		}
+		err := rows.Scan(append(dest, ruleScanner.dest()...)...)
 		if err == nil {
 			coupon.ValidFrom = LocalTime(validFrom)
 			coupon.ValidTo = LocalTime(validTo)
+			coupon.CouponRules = ruleScanner.rules()
 		}
 		if err != nil {
 			return nil, err
@@ -711,7 +876,8 @@ func UseCoupon(userID, couponID, orderID int) error {
 }
 
 // UseCouponByUserCouponIDInTx 在事务内使用优惠券（通过用户优惠券ID，更精确）
-func UseCouponByUserCouponIDInTx(tx *sql.Tx, userCouponID, orderID int) error {
+// saved 为该券在订单中的实际优惠金额，用于按券统计优惠券效果
+func UseCouponByUserCouponIDInTx(tx *sql.Tx, userCouponID, orderID int, saved float64) error {
 	// 获取用户优惠券信息
 	var userID, couponID int
 	var status string
@@ -744,7 +910,7 @@ func UseCouponByUserCouponIDInTx(tx *sql.Tx, userCouponID, orderID int) error {
 	// 检查优惠券模板是否可用
 	var coupon Coupon
 	var validFrom, validTo time.Time
-	err = tx.QueryRow("SELECT id, used_count, total_count, valid_from, valid_to FROM coupons WHERE id = ? AND status = 1", couponID).Scan(&coupon.ID, &coupon.UsedCount, &coupon.TotalCount, &validFrom, &validTo)
+	err = tx.QueryRow("SELECT id, used_count, total_count, valid_from, valid_to, per_user_limit FROM coupons WHERE id = ? AND status = 1 FOR UPDATE", couponID).Scan(&coupon.ID, &coupon.UsedCount, &coupon.TotalCount, &validFrom, &validTo, &coupon.PerUserLimit)
 	if err != nil {
 		return fmt.Errorf("优惠券不存在或已禁用")
 	}
@@ -758,12 +924,23 @@ func UseCouponByUserCouponIDInTx(tx *sql.Tx, userCouponID, orderID int) error {
 		return fmt.Errorf("优惠券已用完")
 	}
 
+	// 检查每人限用次数
+	if coupon.PerUserLimit > 0 {
+		var userUsedCount int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM user_coupons WHERE user_id = ? AND coupon_id = ? AND status = 'used'", userID, couponID).Scan(&userUsedCount); err != nil {
+			return fmt.Errorf("统计优惠券使用次数失败: %w", err)
+		}
+		if userUsedCount >= coupon.PerUserLimit {
+			return fmt.Errorf("该优惠券每人限用%d次", coupon.PerUserLimit)
+		}
+	}
+
 	// 更新用户优惠券记录（使用 user_coupon_id 精确更新）
 	_, err = tx.Exec(`
 		UPDATE user_coupons 
-		SET status = 'used', used_at = NOW(), order_id = ?, updated_at = NOW() 
+		SET status = 'used', used_at = NOW(), order_id = ?, saved_amount = ?, updated_at = NOW() 
 		WHERE id = ?
-	`, orderID, userCouponID)
+	`, orderID, roundMoney(saved), userCouponID)
 	if err != nil {
 		return err
 	}
@@ -779,20 +956,39 @@ func UseCouponByUserCouponIDInTx(tx *sql.Tx, userCouponID, orderID int) error {
 
 // UseCouponByUserCouponID 使用优惠券（通过用户优惠券ID，更精确）
 // 注意：此函数会创建新事务，如果需要在订单创建事务内处理，请使用 UseCouponByUserCouponIDInTx
-func UseCouponByUserCouponID(userCouponID, orderID int) error {
+func UseCouponByUserCouponID(userCouponID, orderID int, saved float64) error {
 	tx, err := database.DB.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	if err := UseCouponByUserCouponIDInTx(tx, userCouponID, orderID); err != nil {
+	if err := UseCouponByUserCouponIDInTx(tx, userCouponID, orderID, saved); err != nil {
 		return err
 	}
 
 	return tx.Commit()
 }
 
+// GetUserCouponUsedCounts 用户各优惠券模板的已使用次数（key 为优惠券ID）
+func GetUserCouponUsedCounts(userID int) (map[int]int, error) {
+	rows, err := database.DB.Query("SELECT coupon_id, COUNT(*) FROM user_coupons WHERE user_id = ? AND status = 'used' GROUP BY coupon_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int]int)
+	for rows.Next() {
+		var couponID, count int
+		if err := rows.Scan(&couponID, &count); err != nil {
+			return nil, err
+		}
+		counts[couponID] = count
+	}
+	return counts, rows.Err()
+}
+
 // IssueCouponToUser 发放优惠券给用户（管理员操作，支持数量和有效期）
 func IssueCouponToUser(userID, couponID, quantity int, expiresAt *time.Time) error {
 	if quantity <= 0 {
@@ -2,42 +2,279 @@ package model
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
+
+	"go_backend/internal/database"
 )
 
+// maxCouponCombinationCandidates 自动组合时参与搜索的优惠券数量上限（按单独使用的优惠金额取前 N 张）
+const maxCouponCombinationCandidates = 10
+
 // AvailableCouponInfo 可用优惠券信息
 type AvailableCouponInfo struct {
-	UserCouponID  int     `json:"user_coupon_id"`
-	CouponID      int     `json:"coupon_id"`
-	Name          string  `json:"name"`
-	Type          string  `json:"type"` // delivery_fee 或 amount
-	DiscountValue float64 `json:"discount_value"`
-	MinAmount     float64 `json:"min_amount"`
-	CategoryIDs   []int   `json:"category_ids"`
-	IsAvailable   bool    `json:"is_available"`     // 是否满足使用条件
-	Reason        string  `json:"reason,omitempty"` // 不可用原因
-	ExpiresAt     *string `json:"expires_at,omitempty"` // 用户优惠券的过期日期（优先使用，如果有）
-	ValidTo       *string `json:"valid_to,omitempty"`   // 优惠券模板的有效期（仅在 expires_at 为空时使用）
+	UserCouponID      int     `json:"user_coupon_id"`
+	CouponID          int     `json:"coupon_id"`
+	Name              string  `json:"name"`
+	Type              string  `json:"type"` // delivery_fee、amount 或 percent
+	DiscountValue     float64 `json:"discount_value"`
+	MinAmount         float64 `json:"min_amount"`
+	CategoryIDs       []int   `json:"category_ids"`
+	IsAvailable       bool    `json:"is_available"`          // 是否满足使用条件
+	Reason            string  `json:"reason,omitempty"`      // 不可用原因
+	Explanation       string  `json:"explanation,omitempty"` // 可用时的优惠说明
+	EligibleAmount    float64 `json:"eligible_amount"`       // 适用范围内的商品金额
+	EstimatedDiscount float64 `json:"estimated_discount"`    // 单独使用时的优惠金额
+	ExpiresAt         *string `json:"expires_at,omitempty"`  // 用户优惠券的过期日期（优先使用，如果有）
+	ValidTo           *string `json:"valid_to,omitempty"`    // 优惠券模板的有效期（仅在 expires_at 为空时使用）
+	CouponRules
+}
+
+// AppliedCoupon 组合中使用的优惠券及其实际优惠金额
+type AppliedCoupon struct {
+	AvailableCouponInfo
+	Saved float64 `json:"saved"` // 叠加计算后该券实际优惠的金额
+}
+
+// CouponSkipNote 可用但未选入组合的优惠券及原因
+type CouponSkipNote struct {
+	UserCouponID int    `json:"user_coupon_id"`
+	Name         string `json:"name"`
+	Reason       string `json:"reason"`
 }
 
 // BestCouponCombination 最佳优惠券组合
 type BestCouponCombination struct {
 	DeliveryFeeCoupon *AvailableCouponInfo `json:"delivery_fee_coupon,omitempty"` // 选中的免配送费券
-	AmountCoupon      *AvailableCouponInfo `json:"amount_coupon,omitempty"`       // 选中的金额券
+	AmountCoupon      *AvailableCouponInfo `json:"amount_coupon,omitempty"`       // 选中的第一张商品优惠券（金额券或折扣券）
+	Coupons           []AppliedCoupon      `json:"coupons"`                       // 组合中的全部优惠券
+	Skipped           []CouponSkipNote     `json:"skipped"`                       // 可用但未使用的优惠券及原因
 	TotalDiscount     float64              `json:"total_discount"`                // 总优惠金额
 	DeliveryFeeSaved  float64              `json:"delivery_fee_saved"`            // 节省的配送费
-	AmountSaved       float64              `json:"amount_saved"`                  // 节省的金额
+	AmountSaved       float64              `json:"amount_saved"`                  // 节省的商品金额
+}
+
+// UserCouponIDs 组合中全部用户优惠券ID（下单时核销）
+func (b BestCouponCombination) UserCouponIDs() []int {
+	ids := make([]int, 0, len(b.Coupons))
+	for _, c := range b.Coupons {
+		ids = append(ids, c.UserCouponID)
+	}
+	return ids
+}
+
+// SavedByUserCouponID 组合中每张用户优惠券的实际优惠金额（key 为用户优惠券ID，下单时按券记录）
+func (b BestCouponCombination) SavedByUserCouponID() map[int]float64 {
+	saved := make(map[int]float64, len(b.Coupons))
+	for _, c := range b.Coupons {
+		saved[c.UserCouponID] = c.Saved
+	}
+	return saved
+}
+
+// CouponOrderItem 参与优惠券计算的订单商品
+type CouponOrderItem struct {
+	ProductID   int     `json:"product_id"`
+	SpecName    string  `json:"spec_name"`
+	SupplierID  int     `json:"supplier_id"`
+	CategoryIDs []int   `json:"category_ids"` // 商品分类及其上级分类
+	Amount      float64 `json:"amount"`
+}
+
+// BuildCouponOrderItems 由采购单商品生成优惠券计算明细
+// priceOverrides: 可选的价格覆盖映射（采购单项ID -> 改价后的单价），用于销售员改价场景
+func BuildCouponOrderItems(items []PurchaseListItem, userType string, priceOverrides map[int]float64) ([]CouponOrderItem, error) {
+	productIDs := uniqueProductIDs(items)
+	categoryInfo, err := fetchProductCategoryInfo(productIDs)
+	if err != nil {
+		return nil, err
+	}
+	supplierIDs, err := fetchProductSupplierIDs(productIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]CouponOrderItem, 0, len(items))
+	for _, item := range items {
+		amount := calculateItemAmount(item, userType)
+		if overridePrice, ok := priceOverrides[item.ID]; ok && overridePrice >= 0 {
+			amount = overridePrice * float64(item.Quantity)
+		}
+		categoryIDs := []int{}
+		if info, ok := categoryInfo[item.ProductID]; ok {
+			if info.CategoryID > 0 {
+				categoryIDs = append(categoryIDs, info.CategoryID)
+			}
+			if info.ParentID > 0 {
+				categoryIDs = append(categoryIDs, info.ParentID)
+			}
+		}
+		result = append(result, CouponOrderItem{
+			ProductID:   item.ProductID,
+			SpecName:    item.SpecName,
+			SupplierID:  supplierIDs[item.ProductID],
+			CategoryIDs: categoryIDs,
+			Amount:      amount,
+		})
+	}
+	return result, nil
+}
+
+func fetchProductSupplierIDs(productIDs []int) (map[int]int, error) {
+	result := make(map[int]int)
+	if len(productIDs) == 0 {
+		return result, nil
+	}
+
+	placeholders := make([]string, len(productIDs))
+	args := make([]interface{}, len(productIDs))
+	for i, id := range productIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	rows, err := database.DB.Query(
+		"SELECT id, COALESCE(supplier_id, 0) FROM products WHERE id IN ("+strings.Join(placeholders, ",")+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var productID, supplierID int
+		if err := rows.Scan(&productID, &supplierID); err != nil {
+			return nil, err
+		}
+		result[productID] = supplierID
+	}
+	return result, rows.Err()
 }
 
-// GetAvailableCouponsForPurchaseList 获取采购单可用的优惠券列表
-func GetAvailableCouponsForPurchaseList(userID int, orderAmount float64, categoryIDs []int, deliveryFee float64, isFreeShipping bool) ([]AvailableCouponInfo, error) {
+// couponOrderAmount 订单商品总金额
+func couponOrderAmount(items []CouponOrderItem) float64 {
+	total := 0.0
+	for _, item := range items {
+		total += item.Amount
+	}
+	return total
+}
+
+// isGoodsCoupon 是否为抵扣商品金额的优惠券（金额券或折扣券）
+func (info *AvailableCouponInfo) isGoodsCoupon() bool {
+	return info.Type == CouponTypeAmount || info.Type == CouponTypePercent
+}
+
+// hasScope 是否限定了适用范围或排除范围
+func (info *AvailableCouponInfo) hasScope() bool {
+	return len(info.CategoryIDs) > 0 || len(info.ProductIDs) > 0 || len(info.SpecKeys) > 0 ||
+		len(info.SupplierIDs) > 0 || len(info.ExcludeProductIDs) > 0 || len(info.ExcludeCategoryIDs) > 0
+}
+
+// appliesTo 商品是否在优惠券适用范围内（先判断排除范围，再判断商品、规格、供应商、分类限制）
+func (info *AvailableCouponInfo) appliesTo(item CouponOrderItem) bool {
+	if containsInt(info.ExcludeProductIDs, item.ProductID) || intersectsInts(info.ExcludeCategoryIDs, item.CategoryIDs) {
+		return false
+	}
+	if len(info.ProductIDs) > 0 && !containsInt(info.ProductIDs, item.ProductID) {
+		return false
+	}
+	if len(info.SpecKeys) > 0 && !containsString(info.SpecKeys, CouponSpecKey(item.ProductID, item.SpecName)) {
+		return false
+	}
+	if len(info.SupplierIDs) > 0 && !containsInt(info.SupplierIDs, item.SupplierID) {
+		return false
+	}
+	if len(info.CategoryIDs) > 0 && !intersectsInts(info.CategoryIDs, item.CategoryIDs) {
+		return false
+	}
+	return true
+}
+
+// eligibleAmount 适用范围内的商品金额及商品数
+func (info *AvailableCouponInfo) eligibleAmount(items []CouponOrderItem) (float64, int) {
+	amount := 0.0
+	count := 0
+	for _, item := range items {
+		if info.appliesTo(item) {
+			amount += item.Amount
+			count++
+		}
+	}
+	return amount, count
+}
+
+// scopeReason 订单中没有适用商品时的原因
+func (info *AvailableCouponInfo) scopeReason() string {
+	switch {
+	case len(info.ProductIDs) > 0 || len(info.SpecKeys) > 0:
+		return "订单中不包含适用商品"
+	case len(info.SupplierIDs) > 0:
+		return "订单中不包含适用供应商的商品"
+	case len(info.CategoryIDs) > 0:
+		return "订单中不包含适用分类的商品"
+	default:
+		return "订单中的商品均不参与此优惠券"
+	}
+}
+
+// goodsDiscount 对 base 金额可优惠的金额：金额券不超过 base，折扣券按百分比计算并受最高优惠限制
+func (info *AvailableCouponInfo) goodsDiscount(base float64) float64 {
+	if base <= 0 {
+		return 0
+	}
+	discount := 0.0
+	switch info.Type {
+	case CouponTypeAmount:
+		discount = info.DiscountValue
+	case CouponTypePercent:
+		discount = base * info.DiscountValue / 100
+		if info.MaxDiscount > 0 && discount > info.MaxDiscount {
+			discount = info.MaxDiscount
+		}
+	}
+	if discount > base {
+		discount = base
+	}
+	return roundMoney(discount)
+}
+
+// explain 可用优惠券的优惠说明
+func (info *AvailableCouponInfo) explain(deliveryFee float64) string {
+	scope := "订单商品"
+	if info.hasScope() {
+		scope = "适用商品"
+	}
+	switch info.Type {
+	case CouponTypeDeliveryFee:
+		return fmt.Sprintf("免配送费，本单可省¥%.2f", deliveryFee)
+	case CouponTypePercent:
+		text := fmt.Sprintf("%s¥%.2f享%g%%优惠", scope, info.EligibleAmount, info.DiscountValue)
+		if info.MaxDiscount > 0 {
+			text += fmt.Sprintf("（最高¥%.2f）", info.MaxDiscount)
+		}
+		return text + fmt.Sprintf("，本单可省¥%.2f", info.EstimatedDiscount)
+	default:
+		return fmt.Sprintf("%s¥%.2f立减¥%.2f", scope, info.EligibleAmount, info.EstimatedDiscount)
+	}
+}
+
+// GetAvailableCouponsForPurchaseList 获取采购单可用的优惠券列表，每张券给出可用说明或不可用原因
+func GetAvailableCouponsForPurchaseList(userID int, items []CouponOrderItem, deliveryFee float64, isFreeShipping bool) ([]AvailableCouponInfo, error) {
 	// 获取用户所有未使用的优惠券
 	userCoupons, err := GetUserCoupons(userID)
 	if err != nil {
 		return nil, err
 	}
+	usedCounts, err := GetUserCouponUsedCounts(userID)
+	if err != nil {
+		return nil, err
+	}
 
 	now := time.Now()
+	orderAmount := couponOrderAmount(items)
 	var availableCoupons []AvailableCouponInfo
 
 	for _, uc := range userCoupons {
@@ -100,127 +337,264 @@ func GetAvailableCouponsForPurchaseList(userID int, orderAmount float64, categor
 			IsAvailable:   false,
 			ExpiresAt:     expiresAtStr,
 			ValidTo:       validToStr,
+			CouponRules:   coupon.CouponRules,
 		}
-
-		// 检查金额门槛
-		if coupon.MinAmount > 0 && orderAmount < coupon.MinAmount {
-			info.Reason = fmt.Sprintf("订单金额需满¥%.2f", coupon.MinAmount)
-			availableCoupons = append(availableCoupons, info)
-			continue
+		info.Reason = evaluateCouponForOrder(&info, items, orderAmount, deliveryFee, isFreeShipping, usedCounts[coupon.ID])
+		if info.Reason == "" {
+			info.IsAvailable = true
+			info.Explanation = info.explain(deliveryFee)
 		}
+		availableCoupons = append(availableCoupons, info)
+	}
 
-		// 检查分类限制
-		if len(coupon.CategoryIDs) > 0 {
-			hasMatchingCategory := false
-			for _, orderCatID := range categoryIDs {
-				for _, couponCatID := range coupon.CategoryIDs {
-					if orderCatID == couponCatID {
-						hasMatchingCategory = true
-						break
-					}
-				}
-				if hasMatchingCategory {
-					break
-				}
-			}
-			if !hasMatchingCategory {
-				info.Reason = "订单中不包含适用分类的商品"
-				availableCoupons = append(availableCoupons, info)
-				continue
-			}
+	return availableCoupons, nil
+}
+
+// evaluateCouponForOrder 计算适用金额和单独使用时的优惠，返回不可用原因（可用时为空）
+func evaluateCouponForOrder(info *AvailableCouponInfo, items []CouponOrderItem, orderAmount, deliveryFee float64, isFreeShipping bool, userUsedCount int) string {
+	if info.PerUserLimit > 0 && userUsedCount >= info.PerUserLimit {
+		return fmt.Sprintf("每人限用%d次，您已使用%d次", info.PerUserLimit, userUsedCount)
+	}
+	if len(items) == 0 {
+		return "订单中没有商品"
+	}
+
+	eligible, count := info.eligibleAmount(items)
+	info.EligibleAmount = roundMoney(eligible)
+	if count == 0 {
+		return info.scopeReason()
+	}
+
+	// 检查金额门槛（有适用范围时按适用商品金额计算）
+	if info.MinAmount > 0 && eligible < info.MinAmount {
+		if info.hasScope() && eligible < orderAmount {
+			return fmt.Sprintf("适用商品金额需满¥%.2f，还差¥%.2f", info.MinAmount, info.MinAmount-eligible)
 		}
+		return fmt.Sprintf("订单金额需满¥%.2f，还差¥%.2f", info.MinAmount, info.MinAmount-eligible)
+	}
 
+	switch info.Type {
+	case CouponTypeDeliveryFee:
 		// 对于免配送费券，如果已经免配送费，则不需要使用
-		if coupon.Type == "delivery_fee" && isFreeShipping {
-			info.Reason = "订单已满足免配送费条件"
-			availableCoupons = append(availableCoupons, info)
-			continue
+		if isFreeShipping {
+			return "订单已满足免配送费条件"
 		}
-
-		// 可用
-		info.IsAvailable = true
-		availableCoupons = append(availableCoupons, info)
+		info.EstimatedDiscount = roundMoney(deliveryFee)
+	case CouponTypeAmount, CouponTypePercent:
+		info.EstimatedDiscount = info.goodsDiscount(eligible)
+	default:
+		return "不支持的优惠券类型"
 	}
+	return ""
+}
 
-	return availableCoupons, nil
+// couponSelection 优惠券组合的选择条件
+type couponSelection struct {
+	pinned     []int // 用户指定的用户优惠券ID，优先放入组合
+	exact      bool  // 只使用指定的优惠券，不自动补充
+	noDelivery bool  // 不自动选择免配送费券
+	noGoods    bool  // 不自动选择商品优惠券
 }
 
-// CalculateBestCouponCombination 计算最佳优惠券组合
-func CalculateBestCouponCombination(availableCoupons []AvailableCouponInfo, orderAmount float64, deliveryFee float64, isFreeShipping bool) BestCouponCombination {
-	return calculateCouponCombinationEx(availableCoupons, orderAmount, deliveryFee, isFreeShipping, 0, 0, false, false)
+// CalculateBestCouponCombination 计算最佳优惠券组合（在可叠加的组合中选择总优惠最大的）
+func CalculateBestCouponCombination(availableCoupons []AvailableCouponInfo, items []CouponOrderItem, deliveryFee float64, isFreeShipping bool) BestCouponCombination {
+	return selectCouponCombination(availableCoupons, items, deliveryFee, isFreeShipping, couponSelection{})
 }
 
 // CalculateCouponCombinationWithSelection 根据指定的优惠券ID优先组合，若无效则回退到最佳组合
-func CalculateCouponCombinationWithSelection(availableCoupons []AvailableCouponInfo, orderAmount float64, deliveryFee float64, isFreeShipping bool, deliveryCouponID int, amountCouponID int) BestCouponCombination {
-	return calculateCouponCombinationEx(availableCoupons, orderAmount, deliveryFee, isFreeShipping, deliveryCouponID, amountCouponID, false, false)
+func CalculateCouponCombinationWithSelection(availableCoupons []AvailableCouponInfo, items []CouponOrderItem, deliveryFee float64, isFreeShipping bool, deliveryCouponID int, amountCouponID int) BestCouponCombination {
+	return CalculateCouponCombinationWithExplicitSelection(availableCoupons, items, deliveryFee, isFreeShipping, deliveryCouponID, amountCouponID, false, false)
 }
 
 // CalculateCouponCombinationWithExplicitSelection 支持显式「不使用」：当 explicitNoDeliveryCoupon/explicitNoAmountCoupon 为 true 且对应 ID 为 0 时，不自动选择
-func CalculateCouponCombinationWithExplicitSelection(availableCoupons []AvailableCouponInfo, orderAmount float64, deliveryFee float64, isFreeShipping bool, deliveryCouponID int, amountCouponID int, explicitNoDeliveryCoupon bool, explicitNoAmountCoupon bool) BestCouponCombination {
-	return calculateCouponCombinationEx(availableCoupons, orderAmount, deliveryFee, isFreeShipping, deliveryCouponID, amountCouponID, explicitNoDeliveryCoupon, explicitNoAmountCoupon)
+func CalculateCouponCombinationWithExplicitSelection(availableCoupons []AvailableCouponInfo, items []CouponOrderItem, deliveryFee float64, isFreeShipping bool, deliveryCouponID int, amountCouponID int, explicitNoDeliveryCoupon bool, explicitNoAmountCoupon bool) BestCouponCombination {
+	return selectCouponCombination(availableCoupons, items, deliveryFee, isFreeShipping, couponSelection{
+		pinned:     []int{deliveryCouponID, amountCouponID},
+		noDelivery: explicitNoDeliveryCoupon && deliveryCouponID == 0,
+		noGoods:    explicitNoAmountCoupon && amountCouponID == 0,
+	})
 }
 
-func calculateCouponCombinationEx(availableCoupons []AvailableCouponInfo, orderAmount float64, deliveryFee float64, isFreeShipping bool, deliveryCouponID int, amountCouponID int, explicitNoDeliveryCoupon bool, explicitNoAmountCoupon bool) BestCouponCombination {
-	result := BestCouponCombination{}
+// CalculateCouponCombinationForUserCoupons 只使用指定的优惠券，不能叠加的券记入 Skipped
+func CalculateCouponCombinationForUserCoupons(availableCoupons []AvailableCouponInfo, items []CouponOrderItem, deliveryFee float64, isFreeShipping bool, userCouponIDs []int) BestCouponCombination {
+	return selectCouponCombination(availableCoupons, items, deliveryFee, isFreeShipping, couponSelection{
+		pinned: userCouponIDs,
+		exact:  true,
+	})
+}
 
-	// 分离免配送费券和金额券
-	var deliveryFeeCoupons []AvailableCouponInfo
-	var amountCoupons []AvailableCouponInfo
+func selectCouponCombination(availableCoupons []AvailableCouponInfo, items []CouponOrderItem, deliveryFee float64, isFreeShipping bool, sel couponSelection) BestCouponCombination {
+	skipped := make(map[int]string)
 
-	for _, coupon := range availableCoupons {
-		if !coupon.IsAvailable {
+	// 先放入用户指定的优惠券
+	chosen := []AvailableCouponInfo{}
+	for _, id := range sel.pinned {
+		coupon := findCouponByID(availableCoupons, id)
+		if coupon == nil || containsCoupon(chosen, id) {
 			continue
 		}
-		if coupon.Type == "delivery_fee" {
-			deliveryFeeCoupons = append(deliveryFeeCoupons, coupon)
-		} else if coupon.Type == "amount" {
-			amountCoupons = append(amountCoupons, coupon)
+		if reason := couponStackConflict(chosen, coupon); reason != "" {
+			skipped[id] = reason
+			continue
 		}
+		chosen = append(chosen, *coupon)
 	}
 
-	// 如果用户指定了免配送费券，优先使用
-	if deliveryCouponID > 0 && !isFreeShipping {
-		if coupon := findCouponByID(deliveryFeeCoupons, deliveryCouponID); coupon != nil {
-			result.DeliveryFeeCoupon = coupon
-			result.DeliveryFeeSaved = deliveryFee
+	// 指定的券未覆盖的类型自动补充：同一优惠券模板只取最早过期的一张
+	autoDelivery := !sel.exact && !sel.noDelivery
+	autoGoods := !sel.exact && !sel.noGoods
+	for _, c := range chosen {
+		if c.isGoodsCoupon() {
+			autoGoods = false
+		} else {
+			autoDelivery = false
 		}
 	}
-
-	// 如果用户指定了金额券，优先使用
-	if amountCouponID > 0 {
-		if coupon := findCouponByID(amountCoupons, amountCouponID); coupon != nil && coupon.MinAmount <= orderAmount {
-			result.AmountCoupon = coupon
-			result.AmountSaved = coupon.DiscountValue
+	var pool []AvailableCouponInfo
+	seenTemplates := make(map[int]int)
+	for _, c := range chosen {
+		seenTemplates[c.CouponID] = -1
+	}
+	for _, c := range availableCoupons {
+		if !c.IsAvailable || (c.isGoodsCoupon() && !autoGoods) || (!c.isGoodsCoupon() && !autoDelivery) {
+			continue
 		}
+		if idx, ok := seenTemplates[c.CouponID]; ok {
+			if idx >= 0 && couponExpiresBefore(c, pool[idx]) {
+				pool[idx] = c
+			}
+			continue
+		}
+		seenTemplates[c.CouponID] = len(pool)
+		pool = append(pool, c)
+	}
+	sort.SliceStable(pool, func(i, j int) bool {
+		return pool[i].EstimatedDiscount > pool[j].EstimatedDiscount
+	})
+	if len(pool) > maxCouponCombinationCandidates {
+		pool = pool[:maxCouponCombinationCandidates]
 	}
 
-	// 如果用户未指定或指定无效，则回退到默认策略（显式选择「不使用」时不回退）
-	if result.DeliveryFeeCoupon == nil && !isFreeShipping && len(deliveryFeeCoupons) > 0 && !(explicitNoDeliveryCoupon && deliveryCouponID == 0) {
-		result.DeliveryFeeCoupon = &deliveryFeeCoupons[0]
-		result.DeliveryFeeSaved = deliveryFee
+	// 穷举可叠加的组合，总优惠相同时选择张数更少的
+	best := chosen
+	bestTotal := applyCouponCombination(chosen, items, deliveryFee, isFreeShipping).TotalDiscount
+	var search func(i int, current []AvailableCouponInfo)
+	search = func(i int, current []AvailableCouponInfo) {
+		if i == len(pool) {
+			total := applyCouponCombination(current, items, deliveryFee, isFreeShipping).TotalDiscount
+			if total > bestTotal+0.001 || (total > bestTotal-0.001 && len(current) < len(best)) {
+				best = append([]AvailableCouponInfo(nil), current...)
+				bestTotal = total
+			}
+			return
+		}
+		if couponStackConflict(current, &pool[i]) == "" {
+			search(i+1, append(current[:len(current):len(current)], pool[i]))
+		}
+		search(i+1, current)
 	}
+	search(0, chosen)
 
-	if result.AmountCoupon == nil && len(amountCoupons) > 0 && !(explicitNoAmountCoupon && amountCouponID == 0) {
-		var bestAmountCoupon *AvailableCouponInfo
-		maxDiscount := 0.0
+	result := applyCouponCombination(best, items, deliveryFee, isFreeShipping)
 
-		for i := range amountCoupons {
-			coupon := &amountCoupons[i]
-			if coupon.MinAmount <= orderAmount {
-				if coupon.DiscountValue > maxDiscount {
-					maxDiscount = coupon.DiscountValue
-					bestAmountCoupon = coupon
-				}
+	// 说明可用但未使用的优惠券
+	for _, c := range availableCoupons {
+		if !c.IsAvailable || containsCoupon(best, c.UserCouponID) {
+			continue
+		}
+		reason, ok := skipped[c.UserCouponID]
+		if !ok {
+			reason = couponStackConflict(best, &c)
+		}
+		if reason == "" {
+			if sel.exact || (c.isGoodsCoupon() && !autoGoods) || (!c.isGoodsCoupon() && !autoDelivery) {
+				reason = "未选择使用"
+			} else {
+				reason = "当前组合优惠更多"
 			}
 		}
+		result.Skipped = append(result.Skipped, CouponSkipNote{
+			UserCouponID: c.UserCouponID,
+			Name:         c.Name,
+			Reason:       reason,
+		})
+	}
+	return result
+}
 
-		if bestAmountCoupon != nil {
-			result.AmountCoupon = bestAmountCoupon
-			result.AmountSaved = bestAmountCoupon.DiscountValue
+// couponStackConflict 优惠券与已选优惠券不能叠加的原因，可以叠加时返回空
+func couponStackConflict(chosen []AvailableCouponInfo, coupon *AvailableCouponInfo) string {
+	for _, c := range chosen {
+		switch {
+		case c.CouponID == coupon.CouponID:
+			return "同一优惠券每单限用一张"
+		case coupon.StackMode == CouponStackExclusive:
+			return fmt.Sprintf("不可与「%s」叠加使用", c.Name)
+		case c.StackMode == CouponStackExclusive:
+			return fmt.Sprintf("「%s」不可与其他优惠券叠加使用", c.Name)
+		case coupon.Type == CouponTypeDeliveryFee && c.Type == CouponTypeDeliveryFee:
+			return "每单限用一张免配送费券"
+		case coupon.Type == c.Type && (coupon.StackMode != CouponStackAny || c.StackMode != CouponStackAny):
+			return fmt.Sprintf("不可与同类型的「%s」叠加使用", c.Name)
 		}
 	}
+	return ""
+}
+
+// applyCouponCombination 计算组合的实际优惠：先扣金额券再按折扣券计算，每张券只作用于其适用商品扣减后的剩余金额
+func applyCouponCombination(coupons []AvailableCouponInfo, items []CouponOrderItem, deliveryFee float64, isFreeShipping bool) BestCouponCombination {
+	result := BestCouponCombination{
+		Coupons: []AppliedCoupon{},
+		Skipped: []CouponSkipNote{},
+	}
+
+	ordered := append([]AvailableCouponInfo(nil), coupons...)
+	typeOrder := map[string]int{CouponTypeDeliveryFee: 0, CouponTypeAmount: 1, CouponTypePercent: 2}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return typeOrder[ordered[i].Type] < typeOrder[ordered[j].Type]
+	})
+
+	remaining := make([]float64, len(items))
+	for i, item := range items {
+		remaining[i] = item.Amount
+	}
+
+	for i := range ordered {
+		coupon := &ordered[i]
+		saved := 0.0
+		if coupon.isGoodsCoupon() {
+			base := 0.0
+			for j, item := range items {
+				if coupon.appliesTo(item) {
+					base += remaining[j]
+				}
+			}
+			saved = coupon.goodsDiscount(base)
+			if base > 0 {
+				ratio := saved / base
+				for j, item := range items {
+					if coupon.appliesTo(item) {
+						remaining[j] -= remaining[j] * ratio
+					}
+				}
+			}
+			result.AmountSaved += saved
+			if result.AmountCoupon == nil {
+				result.AmountCoupon = coupon
+			}
+		} else {
+			if !isFreeShipping {
+				saved = roundMoney(deliveryFee)
+			}
+			result.DeliveryFeeSaved += saved
+			result.DeliveryFeeCoupon = coupon
+		}
+		result.Coupons = append(result.Coupons, AppliedCoupon{AvailableCouponInfo: *coupon, Saved: saved})
+	}
 
-	result.TotalDiscount = result.DeliveryFeeSaved + result.AmountSaved
+	result.AmountSaved = roundMoney(result.AmountSaved)
+	result.DeliveryFeeSaved = roundMoney(result.DeliveryFeeSaved)
+	result.TotalDiscount = roundMoney(result.DeliveryFeeSaved + result.AmountSaved)
 	return result
 }
 
@@ -235,3 +609,53 @@ func findCouponByID(coupons []AvailableCouponInfo, userCouponID int) *AvailableC
 	}
 	return nil
 }
+
+func containsCoupon(coupons []AvailableCouponInfo, userCouponID int) bool {
+	for _, c := range coupons {
+		if c.UserCouponID == userCouponID {
+			return true
+		}
+	}
+	return false
+}
+
+// couponExpiresBefore a 是否比 b 更早过期（同一模板多张时优先使用快过期的）
+func couponExpiresBefore(a, b AvailableCouponInfo) bool {
+	expiry := func(c AvailableCouponInfo) string {
+		if c.ExpiresAt != nil {
+			return *c.ExpiresAt
+		}
+		if c.ValidTo != nil {
+			return *c.ValidTo
+		}
+		return ""
+	}
+	return expiry(a) < expiry(b)
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func intersectsInts(a, b []int) bool {
+	for _, x := range a {
+		if containsInt(b, x) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
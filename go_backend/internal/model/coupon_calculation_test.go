@@ -0,0 +1,257 @@
+package model
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// testCoupon 构造测试用的优惠券，用户优惠券ID与模板ID相同
+func testCoupon(id int, typ string, value float64, stackMode string) AvailableCouponInfo {
+	return AvailableCouponInfo{
+		UserCouponID:  id,
+		CouponID:      id,
+		Name:          typ,
+		Type:          typ,
+		DiscountValue: value,
+		CouponRules:   CouponRules{StackMode: stackMode},
+	}
+}
+
+// evaluateTestCoupons 按订单计算每张券的可用状态和单独使用时的优惠
+func evaluateTestCoupons(coupons []AvailableCouponInfo, items []CouponOrderItem, deliveryFee float64, isFreeShipping bool) []AvailableCouponInfo {
+	result := make([]AvailableCouponInfo, len(coupons))
+	for i, c := range coupons {
+		c.Reason = evaluateCouponForOrder(&c, items, couponOrderAmount(items), deliveryFee, isFreeShipping, 0)
+		c.IsAvailable = c.Reason == ""
+		result[i] = c
+	}
+	return result
+}
+
+func TestSelectCouponCombination(t *testing.T) {
+	items := []CouponOrderItem{{ProductID: 1, Amount: 100}}
+	tests := []struct {
+		name        string
+		coupons     []AvailableCouponInfo
+		items       []CouponOrderItem
+		sel         couponSelection
+		wantIDs     []int
+		wantTotal   float64
+		wantSkipped []int
+	}{
+		{
+			name: "不可叠加券优惠更多时单独使用",
+			coupons: []AvailableCouponInfo{
+				testCoupon(1, CouponTypeAmount, 20, CouponStackExclusive),
+				testCoupon(2, CouponTypeAmount, 10, CouponStackDifferentType),
+				testCoupon(3, CouponTypeDeliveryFee, 0, CouponStackDifferentType),
+			},
+			wantIDs:     []int{1},
+			wantTotal:   20,
+			wantSkipped: []int{2, 3},
+		},
+		{
+			name: "可叠加的组合优惠更多时不使用不可叠加券",
+			coupons: []AvailableCouponInfo{
+				testCoupon(1, CouponTypeAmount, 12, CouponStackExclusive),
+				testCoupon(2, CouponTypeAmount, 10, CouponStackDifferentType),
+				testCoupon(3, CouponTypeDeliveryFee, 0, CouponStackDifferentType),
+			},
+			wantIDs:     []int{3, 2},
+			wantTotal:   15,
+			wantSkipped: []int{1},
+		},
+		{
+			name: "均为 any 的同类型券可以叠加",
+			coupons: []AvailableCouponInfo{
+				testCoupon(1, CouponTypeAmount, 10, CouponStackAny),
+				testCoupon(2, CouponTypeAmount, 5, CouponStackAny),
+			},
+			wantIDs:   []int{1, 2},
+			wantTotal: 15,
+		},
+		{
+			name: "同类型券只要有一张不是 any 就不能叠加",
+			coupons: []AvailableCouponInfo{
+				testCoupon(1, CouponTypeAmount, 10, CouponStackAny),
+				testCoupon(2, CouponTypeAmount, 5, CouponStackDifferentType),
+			},
+			wantIDs:     []int{1},
+			wantTotal:   10,
+			wantSkipped: []int{2},
+		},
+		{
+			name: "每单限用一张免配送费券，即使均为 any",
+			coupons: []AvailableCouponInfo{
+				testCoupon(1, CouponTypeDeliveryFee, 0, CouponStackAny),
+				testCoupon(2, CouponTypeDeliveryFee, 0, CouponStackAny),
+			},
+			wantIDs:     []int{1},
+			wantTotal:   5,
+			wantSkipped: []int{2},
+		},
+		{
+			name: "总优惠相同时选择张数更少的组合",
+			coupons: []AvailableCouponInfo{
+				testCoupon(1, CouponTypeAmount, 8, CouponStackAny),
+				testCoupon(2, CouponTypeAmount, 10, CouponStackAny),
+			},
+			items:       []CouponOrderItem{{ProductID: 1, Amount: 10}},
+			wantIDs:     []int{2},
+			wantTotal:   10,
+			wantSkipped: []int{1},
+		},
+		{
+			name: "指定不可叠加券时不自动补充其他券",
+			coupons: []AvailableCouponInfo{
+				testCoupon(1, CouponTypeAmount, 5, CouponStackExclusive),
+				testCoupon(2, CouponTypeAmount, 10, CouponStackDifferentType),
+				testCoupon(3, CouponTypeDeliveryFee, 0, CouponStackDifferentType),
+			},
+			sel:         couponSelection{pinned: []int{1}},
+			wantIDs:     []int{1},
+			wantTotal:   5,
+			wantSkipped: []int{2, 3},
+		},
+		{
+			name: "只使用指定的券时冲突的券记入未使用",
+			coupons: []AvailableCouponInfo{
+				testCoupon(1, CouponTypeAmount, 10, CouponStackDifferentType),
+				testCoupon(2, CouponTypeAmount, 5, CouponStackDifferentType),
+				testCoupon(3, CouponTypeDeliveryFee, 0, CouponStackDifferentType),
+			},
+			sel:         couponSelection{pinned: []int{1, 2}, exact: true},
+			wantIDs:     []int{1},
+			wantTotal:   10,
+			wantSkipped: []int{2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orderItems := tt.items
+			if orderItems == nil {
+				orderItems = items
+			}
+			coupons := evaluateTestCoupons(tt.coupons, orderItems, 5, false)
+			got := selectCouponCombination(coupons, orderItems, 5, false, tt.sel)
+
+			gotIDs := []int{}
+			for _, c := range got.Coupons {
+				gotIDs = append(gotIDs, c.UserCouponID)
+			}
+			if !reflect.DeepEqual(gotIDs, tt.wantIDs) {
+				t.Errorf("组合 = %v, 期望 %v", gotIDs, tt.wantIDs)
+			}
+			if math.Abs(got.TotalDiscount-tt.wantTotal) > 0.001 {
+				t.Errorf("总优惠 = %.2f, 期望 %.2f", got.TotalDiscount, tt.wantTotal)
+			}
+			var gotSkipped []int
+			for _, s := range got.Skipped {
+				if s.Reason == "" {
+					t.Errorf("未使用的券 %d 缺少原因", s.UserCouponID)
+				}
+				gotSkipped = append(gotSkipped, s.UserCouponID)
+			}
+			if !reflect.DeepEqual(gotSkipped, tt.wantSkipped) {
+				t.Errorf("未使用 = %v, 期望 %v", gotSkipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestApplyCouponCombination(t *testing.T) {
+	items := []CouponOrderItem{
+		{ProductID: 1, CategoryIDs: []int{1}, Amount: 60},
+		{ProductID: 2, CategoryIDs: []int{2}, Amount: 40},
+	}
+	capped := testCoupon(3, CouponTypePercent, 50, CouponStackDifferentType)
+	capped.MaxDiscount = 15
+	scoped := testCoupon(4, CouponTypeAmount, 30, CouponStackDifferentType)
+	scoped.CategoryIDs = []int{1}
+
+	tests := []struct {
+		name           string
+		coupons        []AvailableCouponInfo
+		isFreeShipping bool
+		wantIDs        []int
+		wantSaved      []float64
+		wantAmount     float64
+		wantDelivery   float64
+	}{
+		{
+			name: "先扣金额券再按剩余金额计算折扣券，免配送费券排在最前",
+			coupons: []AvailableCouponInfo{
+				testCoupon(1, CouponTypePercent, 10, CouponStackAny),
+				testCoupon(2, CouponTypeAmount, 20, CouponStackAny),
+				testCoupon(5, CouponTypeDeliveryFee, 0, CouponStackAny),
+			},
+			wantIDs:      []int{5, 2, 1},
+			wantSaved:    []float64{5, 20, 8},
+			wantAmount:   28,
+			wantDelivery: 5,
+		},
+		{
+			name: "折扣券受最高优惠限制",
+			coupons: []AvailableCouponInfo{
+				capped,
+			},
+			wantIDs:    []int{3},
+			wantSaved:  []float64{15},
+			wantAmount: 15,
+		},
+		{
+			name: "限定分类的金额券只扣减适用商品，折扣券按扣减后的剩余金额计算",
+			coupons: []AvailableCouponInfo{
+				testCoupon(1, CouponTypePercent, 10, CouponStackDifferentType),
+				scoped,
+			},
+			wantIDs:    []int{4, 1},
+			wantSaved:  []float64{30, 7},
+			wantAmount: 37,
+		},
+		{
+			name: "金额券优惠不超过剩余金额",
+			coupons: []AvailableCouponInfo{
+				testCoupon(1, CouponTypeAmount, 80, CouponStackAny),
+				testCoupon(2, CouponTypeAmount, 50, CouponStackAny),
+			},
+			wantIDs:    []int{1, 2},
+			wantSaved:  []float64{80, 20},
+			wantAmount: 100,
+		},
+		{
+			name: "已免配送费时免配送费券不再优惠",
+			coupons: []AvailableCouponInfo{
+				testCoupon(5, CouponTypeDeliveryFee, 0, CouponStackDifferentType),
+			},
+			isFreeShipping: true,
+			wantIDs:        []int{5},
+			wantSaved:      []float64{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := applyCouponCombination(tt.coupons, items, 5, tt.isFreeShipping)
+
+			gotIDs := []int{}
+			gotSaved := []float64{}
+			for _, c := range got.Coupons {
+				gotIDs = append(gotIDs, c.UserCouponID)
+				gotSaved = append(gotSaved, c.Saved)
+			}
+			if !reflect.DeepEqual(gotIDs, tt.wantIDs) {
+				t.Errorf("计算顺序 = %v, 期望 %v", gotIDs, tt.wantIDs)
+			}
+			if !reflect.DeepEqual(gotSaved, tt.wantSaved) {
+				t.Errorf("每张券优惠 = %v, 期望 %v", gotSaved, tt.wantSaved)
+			}
+			if got.AmountSaved != tt.wantAmount || got.DeliveryFeeSaved != tt.wantDelivery {
+				t.Errorf("商品优惠 = %.2f, 配送费优惠 = %.2f, 期望 %.2f, %.2f", got.AmountSaved, got.DeliveryFeeSaved, tt.wantAmount, tt.wantDelivery)
+			}
+			if want := roundMoney(tt.wantAmount + tt.wantDelivery); got.TotalDiscount != want {
+				t.Errorf("总优惠 = %.2f, 期望 %.2f", got.TotalDiscount, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,372 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+var (
+	ErrCouponUnavailable     = errors.New("优惠券不存在或已停用")
+	ErrCouponNotInValidTime  = errors.New("优惠券不在有效期内")
+	ErrCouponOutOfStock      = errors.New("优惠券已发完")
+	ErrCampaignNotActive     = errors.New("活动未开始或已结束")
+	ErrCampaignOutOfStock    = errors.New("活动优惠券已领完")
+	ErrCampaignClaimLimit    = errors.New("已达到每人领取上限")
+	ErrCampaignHasClaims     = errors.New("活动已有用户领取，不能删除，可改为停用")
+	ErrCampaignStockTooSmall = errors.New("活动可领取总数不能小于已领取数量")
+)
+
+// CouponCampaign 领券活动（小程序领券中心）
+type CouponCampaign struct {
+	ID            int       `json:"id"`
+	Name          string    `json:"name"`
+	CouponID      int       `json:"coupon_id"`
+	CouponName    string    `json:"coupon_name"`
+	Description   string    `json:"description"`
+	PerUserLimit  int       `json:"per_user_limit"`  // 每人最多领取次数
+	TotalStock    int       `json:"total_stock"`     // 活动可领取总数，0 表示只受优惠券发放总数限制
+	ClaimedCount  int       `json:"claimed_count"`   // 已领取数量
+	ExpiresInDays int       `json:"expires_in_days"` // 领取后有效天数，0 表示使用优惠券有效期
+	StartAt       time.Time `json:"start_at"`
+	EndAt         time.Time `json:"end_at"`
+	Status        int       `json:"status"` // 1-启用，0-停用
+	SortOrder     int       `json:"sort_order"`
+	CreatedBy     string    `json:"created_by"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// CouponCenterItem 领券中心展示的活动及当前用户的领取情况
+type CouponCenterItem struct {
+	CouponCampaign
+	Coupon         *Coupon `json:"coupon"`
+	UserClaimed    int     `json:"user_claimed"`    // 当前用户已领取次数
+	RemainingStock *int    `json:"remaining_stock"` // 剩余可领取数量，为空表示不限
+	CanClaim       bool    `json:"can_claim"`
+	Reason         string  `json:"reason,omitempty"` // 不能领取的原因
+}
+
+// CouponClaimResult 领取或兑换得到的优惠券
+type CouponClaimResult struct {
+	UserCouponID int        `json:"user_coupon_id"`
+	CouponID     int        `json:"coupon_id"`
+	CouponName   string     `json:"coupon_name"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+}
+
+// issueCouponInTx 在事务内向用户发放一张优惠券：锁定优惠券行后按 total_count 校验已发放数量，保证并发领取不超发
+// expiresInDays > 0 时按领取时间计算过期时间（不晚于优惠券有效期结束时间）
+func issueCouponInTx(tx *sql.Tx, userID, couponID, expiresInDays int) (*CouponClaimResult, error) {
+	var name string
+	var totalCount int
+	var validFrom, validTo time.Time
+	err := tx.QueryRow(
+		"SELECT name, total_count, valid_from, valid_to FROM coupons WHERE id = ? AND status = 1 FOR UPDATE",
+		couponID,
+	).Scan(&name, &totalCount, &validFrom, &validTo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCouponUnavailable
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if now.Before(validFrom) || now.After(validTo) {
+		return nil, ErrCouponNotInValidTime
+	}
+
+	if totalCount > 0 {
+		var issuedCount int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM user_coupons WHERE coupon_id = ?", couponID).Scan(&issuedCount); err != nil {
+			return nil, fmt.Errorf("统计已发放数量失败: %w", err)
+		}
+		if issuedCount >= totalCount {
+			return nil, ErrCouponOutOfStock
+		}
+	}
+
+	var expiresAt *time.Time
+	if expiresInDays > 0 {
+		t := now.AddDate(0, 0, expiresInDays)
+		if t.After(validTo) {
+			t = validTo
+		}
+		expiresAt = &t
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO user_coupons (user_id, coupon_id, status, expires_at, created_at, updated_at)
+		VALUES (?, ?, 'unused', ?, NOW(), NOW())
+	`, userID, couponID, expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("发放优惠券失败: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &CouponClaimResult{
+		UserCouponID: int(id),
+		CouponID:     couponID,
+		CouponName:   name,
+		ExpiresAt:    expiresAt,
+	}, nil
+}
+
+const couponCampaignColumns = `cc.id, cc.name, cc.coupon_id, COALESCE(c.name, ''), cc.description, cc.per_user_limit, cc.total_stock,
+	cc.claimed_count, cc.expires_in_days, cc.start_at, cc.end_at, cc.status, cc.sort_order, cc.created_by, cc.created_at, cc.updated_at`
+
+func scanCouponCampaign(scanner interface{ Scan(...interface{}) error }) (*CouponCampaign, error) {
+	var cc CouponCampaign
+	if err := scanner.Scan(
+		&cc.ID, &cc.Name, &cc.CouponID, &cc.CouponName, &cc.Description, &cc.PerUserLimit, &cc.TotalStock,
+		&cc.ClaimedCount, &cc.ExpiresInDays, &cc.StartAt, &cc.EndAt, &cc.Status, &cc.SortOrder, &cc.CreatedBy, &cc.CreatedAt, &cc.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+	return &cc, nil
+}
+
+// GetCouponCampaigns 领券活动列表（管理后台），status 为 nil 时返回全部
+func GetCouponCampaigns(status *int) ([]CouponCampaign, error) {
+	query := "SELECT " + couponCampaignColumns + " FROM coupon_campaigns cc LEFT JOIN coupons c ON c.id = cc.coupon_id"
+	args := []interface{}{}
+	if status != nil {
+		query += " WHERE cc.status = ?"
+		args = append(args, *status)
+	}
+	query += " ORDER BY cc.sort_order ASC, cc.id DESC"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]CouponCampaign, 0)
+	for rows.Next() {
+		cc, err := scanCouponCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *cc)
+	}
+	return list, rows.Err()
+}
+
+// GetCouponCampaignByID 根据ID获取领券活动
+func GetCouponCampaignByID(id int) (*CouponCampaign, error) {
+	row := database.DB.QueryRow("SELECT "+couponCampaignColumns+" FROM coupon_campaigns cc LEFT JOIN coupons c ON c.id = cc.coupon_id WHERE cc.id = ?", id)
+	cc, err := scanCouponCampaign(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return cc, err
+}
+
+// CreateCouponCampaign 创建领券活动
+func CreateCouponCampaign(cc *CouponCampaign) error {
+	res, err := database.DB.Exec(`
+		INSERT INTO coupon_campaigns (name, coupon_id, description, per_user_limit, total_stock, expires_in_days, start_at, end_at, status, sort_order, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, cc.Name, cc.CouponID, cc.Description, cc.PerUserLimit, cc.TotalStock, cc.ExpiresInDays, cc.StartAt, cc.EndAt, cc.Status, cc.SortOrder, cc.CreatedBy)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	cc.ID = int(id)
+	return nil
+}
+
+// UpdateCouponCampaign 更新领券活动（已领取数量不变，可领取总数不能小于已领取数量）
+func UpdateCouponCampaign(cc *CouponCampaign) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var claimedCount int
+	if err := tx.QueryRow("SELECT claimed_count FROM coupon_campaigns WHERE id = ? FOR UPDATE", cc.ID).Scan(&claimedCount); err != nil {
+		return err
+	}
+	if cc.TotalStock > 0 && cc.TotalStock < claimedCount {
+		return ErrCampaignStockTooSmall
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE coupon_campaigns
+		SET name = ?, coupon_id = ?, description = ?, per_user_limit = ?, total_stock = ?, expires_in_days = ?,
+		    start_at = ?, end_at = ?, status = ?, sort_order = ?, updated_at = NOW()
+		WHERE id = ?
+	`, cc.Name, cc.CouponID, cc.Description, cc.PerUserLimit, cc.TotalStock, cc.ExpiresInDays,
+		cc.StartAt, cc.EndAt, cc.Status, cc.SortOrder, cc.ID); err != nil {
+		return err
+	}
+	cc.ClaimedCount = claimedCount
+	return tx.Commit()
+}
+
+// DeleteCouponCampaign 删除没有领取记录的领券活动
+func DeleteCouponCampaign(id int) error {
+	res, err := database.DB.Exec("DELETE FROM coupon_campaigns WHERE id = ? AND claimed_count = 0", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrCampaignHasClaims
+	}
+	return nil
+}
+
+// GetCouponCenter 领券中心：进行中的活动及用户领取情况
+func GetCouponCenter(userID int) ([]CouponCenterItem, error) {
+	now := time.Now()
+	rows, err := database.DB.Query(
+		"SELECT "+couponCampaignColumns+" FROM coupon_campaigns cc JOIN coupons c ON c.id = cc.coupon_id AND c.status = 1"+
+			" WHERE cc.status = 1 AND cc.start_at <= ? AND cc.end_at >= ? ORDER BY cc.sort_order ASC, cc.id DESC",
+		now, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	campaigns := make([]CouponCampaign, 0)
+	for rows.Next() {
+		cc, err := scanCouponCampaign(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		campaigns = append(campaigns, *cc)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	claimed := make(map[int]int)
+	claimRows, err := database.DB.Query("SELECT campaign_id, COUNT(*) FROM coupon_campaign_claims WHERE user_id = ? GROUP BY campaign_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	for claimRows.Next() {
+		var campaignID, count int
+		if err := claimRows.Scan(&campaignID, &count); err != nil {
+			claimRows.Close()
+			return nil, err
+		}
+		claimed[campaignID] = count
+	}
+	claimRows.Close()
+
+	items := make([]CouponCenterItem, 0, len(campaigns))
+	for _, cc := range campaigns {
+		coupon, err := GetCouponByID(cc.CouponID)
+		if err != nil {
+			return nil, err
+		}
+		if coupon == nil || now.After(coupon.ValidTo.ToTime()) {
+			continue
+		}
+
+		item := CouponCenterItem{CouponCampaign: cc, Coupon: coupon, UserClaimed: claimed[cc.ID]}
+		if cc.TotalStock > 0 {
+			remaining := cc.TotalStock - cc.ClaimedCount
+			if remaining < 0 {
+				remaining = 0
+			}
+			item.RemainingStock = &remaining
+		}
+		switch {
+		case cc.PerUserLimit > 0 && item.UserClaimed >= cc.PerUserLimit:
+			item.Reason = "已领取"
+		case item.RemainingStock != nil && *item.RemainingStock == 0:
+			item.Reason = "已领完"
+		case now.Before(coupon.ValidFrom.ToTime()):
+			item.Reason = "优惠券尚未生效"
+		default:
+			item.CanClaim = true
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// ClaimCouponCampaign 用户在领券中心领取优惠券
+// 锁定活动行保证每人限领和活动库存的并发安全，优惠券发放总数在 issueCouponInTx 中锁定校验
+func ClaimCouponCampaign(campaignID int, user *MiniAppUser) (*CouponClaimResult, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var name string
+	var couponID, perUserLimit, totalStock, claimedCount, expiresInDays, status int
+	var startAt, endAt time.Time
+	err = tx.QueryRow(`
+		SELECT name, coupon_id, per_user_limit, total_stock, claimed_count, expires_in_days, start_at, end_at, status
+		FROM coupon_campaigns WHERE id = ? FOR UPDATE
+	`, campaignID).Scan(&name, &couponID, &perUserLimit, &totalStock, &claimedCount, &expiresInDays, &startAt, &endAt, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCampaignNotActive
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if status != 1 || now.Before(startAt) || now.After(endAt) {
+		return nil, ErrCampaignNotActive
+	}
+	if totalStock > 0 && claimedCount >= totalStock {
+		return nil, ErrCampaignOutOfStock
+	}
+	if perUserLimit > 0 {
+		var userClaimed int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM coupon_campaign_claims WHERE campaign_id = ? AND user_id = ?", campaignID, user.ID).Scan(&userClaimed); err != nil {
+			return nil, err
+		}
+		if userClaimed >= perUserLimit {
+			return nil, ErrCampaignClaimLimit
+		}
+	}
+
+	result, err := issueCouponInTx(tx, user.ID, couponID, expiresInDays)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("INSERT INTO coupon_campaign_claims (campaign_id, user_id, user_coupon_id) VALUES (?, ?, ?)", campaignID, user.ID, result.UserCouponID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE coupon_campaigns SET claimed_count = claimed_count + 1 WHERE id = ?", campaignID); err != nil {
+		return nil, err
+	}
+	if err := insertCouponIssueLog(tx, &CouponIssueLog{
+		UserID:       user.ID,
+		CouponID:     couponID,
+		CouponName:   result.CouponName,
+		Quantity:     1,
+		Reason:       "领券中心：" + name,
+		OperatorType: CouponIssueOperatorSelfService,
+		OperatorID:   user.ID,
+		OperatorName: user.Name,
+		ExpiresAt:    result.ExpiresAt,
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,387 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// couponExpiryHour 每日优惠券过期任务执行时间（同时生成到期提醒，避免夜间推送）
+const couponExpiryHour = 9
+
+// 优惠券到期提醒推送状态
+const (
+	CouponReminderPushPending = "pending" // 待推送
+	CouponReminderPushSent    = "sent"    // 已推送
+	CouponReminderPushFailed  = "failed"  // 推送失败
+	CouponReminderPushSkipped = "skipped" // 未配置订阅消息，只在小程序内提醒
+)
+
+// couponEffectiveExpiresAt 用户优惠券实际到期时间：发放时设置的有效期优先，否则为优惠券有效期结束时间
+const couponEffectiveExpiresAt = "COALESCE(uc.expires_at, c.valid_to)"
+
+// CouponExpiryReminder 优惠券到期提醒
+type CouponExpiryReminder struct {
+	ID               int        `json:"id"`
+	UserID           int        `json:"user_id"`
+	UserCouponID     int        `json:"user_coupon_id"`
+	CouponID         int        `json:"coupon_id"`
+	CouponName       string     `json:"coupon_name"`
+	CouponType       string     `json:"coupon_type,omitempty"`
+	DiscountValue    float64    `json:"discount_value"`
+	MinAmount        float64    `json:"min_amount"`
+	UserCouponStatus string     `json:"user_coupon_status"` // 当前优惠券状态：unused / used / expired
+	ExpiresAt        time.Time  `json:"expires_at"`
+	PushStatus       string     `json:"push_status"`
+	PushError        string     `json:"push_error,omitempty"`
+	PushedAt         *time.Time `json:"pushed_at,omitempty"`
+	IsRead           bool       `json:"is_read"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// CouponStats 优惠券发放与使用统计（用于评估投放效果）
+type CouponStats struct {
+	CouponID        int     `json:"coupon_id"`
+	Name            string  `json:"name"`
+	Type            string  `json:"type"`
+	DiscountValue   float64 `json:"discount_value"`
+	Status          int     `json:"status"`
+	TotalCount      int     `json:"total_count"`       // 发放总数上限，0表示不限
+	IssuedCount     int     `json:"issued_count"`      // 已发放
+	UnusedCount     int     `json:"unused_count"`      // 未使用（含已到期但尚未被过期任务处理的）
+	UsedCount       int     `json:"used_count"`        // 已使用
+	ExpiredCount    int     `json:"expired_count"`     // 已过期
+	UsageRate       float64 `json:"usage_rate"`        // 使用率（%）：已使用 / 已发放
+	ExpiryRate      float64 `json:"expiry_rate"`       // 过期率（%）：已过期 / 已发放
+	OrderCount      int     `json:"order_count"`       // 使用该券的有效订单数（不含已取消）
+	OrderAmount     float64 `json:"order_amount"`      // 上述订单实付金额合计
+	CouponDiscount  float64 `json:"coupon_discount"`   // 该券自身的抵扣合计（多券叠加的订单只计该券的优惠金额）
+	AvgOrderAmount  float64 `json:"avg_order_amount"`  // 平均订单实付金额
+	DiscountPerUsed float64 `json:"discount_per_used"` // 每单平均抵扣
+}
+
+func init() {
+	RegisterJobHandler(JobCouponExpiry, runCouponExpiryJob)
+}
+
+// couponExpiryPayload 优惠券过期任务参数
+type couponExpiryPayload struct {
+	Date string `json:"date"`
+}
+
+// CouponExpiryPushPayload 优惠券到期提醒推送任务参数
+type CouponExpiryPushPayload struct {
+	ReminderID int `json:"reminder_id"`
+}
+
+// ScheduleCouponExpiry 安排当日的优惠券过期任务，之后每日由任务自行安排下一日
+func ScheduleCouponExpiry() {
+	enqueueCouponExpiry(time.Now().Format("2006-01-02"))
+}
+
+func enqueueCouponExpiry(date string) {
+	day, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		return
+	}
+	delay := time.Until(day.Add(couponExpiryHour * time.Hour))
+	if delay < 0 {
+		delay = 0
+	}
+	opts := JobOptions{IdempotencyKey: fmt.Sprintf("%s:%s", JobCouponExpiry, date), Delay: delay}
+	if err := EnqueueJob(JobCouponExpiry, couponExpiryPayload{Date: date}, opts); err != nil {
+		log.Printf("[CouponExpiry] 安排 %s 优惠券过期任务失败: %v", date, err)
+	}
+}
+
+func runCouponExpiryJob(payload []byte) error {
+	var p couponExpiryPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("解析任务参数失败: %v", err)
+	}
+	day, err := time.ParseInLocation("2006-01-02", p.Date, time.Local)
+	if err != nil {
+		return fmt.Errorf("日期格式不正确: %s", p.Date)
+	}
+	enqueueCouponExpiry(day.AddDate(0, 0, 1).Format("2006-01-02"))
+
+	expired, err := ExpireUserCoupons()
+	if err != nil {
+		return err
+	}
+	created, err := GenerateCouponExpiryReminders(GetSystemSettingInt("coupon_expiry_remind_days", 3))
+	if err != nil {
+		return err
+	}
+	if err := dispatchPendingCouponExpiryReminders(); err != nil {
+		return err
+	}
+	if expired > 0 || created > 0 {
+		log.Printf("[CouponExpiry] %s 已标记 %d 张过期优惠券，生成 %d 条到期提醒", p.Date, expired, created)
+	}
+	return nil
+}
+
+// ExpireUserCoupons 将已到期的未使用优惠券标记为已过期，并刷新各优惠券的过期数量
+func ExpireUserCoupons() (int64, error) {
+	result, err := database.DB.Exec(`
+		UPDATE user_coupons uc
+		JOIN coupons c ON c.id = uc.coupon_id
+		SET uc.status = 'expired', uc.updated_at = NOW()
+		WHERE uc.status = 'unused' AND ` + couponEffectiveExpiresAt + ` < NOW()
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("标记过期优惠券失败: %v", err)
+	}
+	n, _ := result.RowsAffected()
+
+	// 按实际记录重算，读取时惰性过期的优惠券也一并计入
+	if _, err := database.DB.Exec(`
+		UPDATE coupons c
+		LEFT JOIN (
+			SELECT coupon_id, COUNT(*) AS cnt FROM user_coupons WHERE status = 'expired' GROUP BY coupon_id
+		) e ON e.coupon_id = c.id
+		SET c.expired_count = COALESCE(e.cnt, 0)
+		WHERE c.expired_count <> COALESCE(e.cnt, 0)
+	`); err != nil {
+		return n, fmt.Errorf("更新优惠券过期数量失败: %v", err)
+	}
+	return n, nil
+}
+
+// GenerateCouponExpiryReminders 为 days 天内到期的未使用优惠券生成到期提醒（每张只提醒一次），返回新生成数量
+func GenerateCouponExpiryReminders(days int) (int64, error) {
+	if days <= 0 {
+		return 0, nil
+	}
+	result, err := database.DB.Exec(`
+		INSERT IGNORE INTO coupon_expiry_reminders (user_id, user_coupon_id, coupon_id, coupon_name, expires_at, push_status, created_at)
+		SELECT uc.user_id, uc.id, c.id, c.name, `+couponEffectiveExpiresAt+`, ?, NOW()
+		FROM user_coupons uc
+		JOIN coupons c ON c.id = uc.coupon_id
+		WHERE uc.status = 'unused' AND c.status = 1
+		  AND `+couponEffectiveExpiresAt+` > NOW()
+		  AND `+couponEffectiveExpiresAt+` <= DATE_ADD(NOW(), INTERVAL ? DAY)
+	`, CouponReminderPushPending, days)
+	if err != nil {
+		return 0, fmt.Errorf("生成优惠券到期提醒失败: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	return n, nil
+}
+
+// dispatchPendingCouponExpiryReminders 配置了订阅消息模板时逐条入队推送，否则标记为不推送
+func dispatchPendingCouponExpiryReminders() error {
+	templateID, _ := GetSystemSetting("coupon_expiry_subscribe_template_id")
+	if strings.TrimSpace(templateID) == "" {
+		_, err := database.DB.Exec(`UPDATE coupon_expiry_reminders SET push_status = ? WHERE push_status = ?`,
+			CouponReminderPushSkipped, CouponReminderPushPending)
+		return err
+	}
+
+	rows, err := database.DB.Query(`SELECT id FROM coupon_expiry_reminders WHERE push_status = ? AND expires_at > NOW()`, CouponReminderPushPending)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		opts := JobOptions{IdempotencyKey: fmt.Sprintf("%s:%d", JobCouponExpiryPush, id), MaxAttempts: 3}
+		if err := EnqueueJob(JobCouponExpiryPush, CouponExpiryPushPayload{ReminderID: id}, opts); err != nil {
+			log.Printf("[CouponExpiry] 到期提醒 %d 推送任务入队失败: %v", id, err)
+		}
+	}
+	return nil
+}
+
+const couponExpiryReminderColumns = `
+	r.id, r.user_id, r.user_coupon_id, r.coupon_id, r.coupon_name,
+	COALESCE(c.type, ''), COALESCE(c.discount_value, 0), COALESCE(c.min_amount, 0), COALESCE(uc.status, ''),
+	r.expires_at, r.push_status, r.push_error, r.pushed_at, r.is_read, r.created_at`
+
+func scanCouponExpiryReminder(s interface{ Scan(...interface{}) error }) (*CouponExpiryReminder, error) {
+	var r CouponExpiryReminder
+	var pushedAt sql.NullTime
+	if err := s.Scan(&r.ID, &r.UserID, &r.UserCouponID, &r.CouponID, &r.CouponName,
+		&r.CouponType, &r.DiscountValue, &r.MinAmount, &r.UserCouponStatus,
+		&r.ExpiresAt, &r.PushStatus, &r.PushError, &pushedAt, &r.IsRead, &r.CreatedAt); err != nil {
+		return nil, err
+	}
+	r.PushedAt = nullTimePtr(pushedAt)
+	return &r, nil
+}
+
+// GetCouponExpiryReminderByID 获取到期提醒，不存在时返回 nil
+func GetCouponExpiryReminderByID(id int) (*CouponExpiryReminder, error) {
+	row := database.DB.QueryRow(`
+		SELECT `+couponExpiryReminderColumns+`
+		FROM coupon_expiry_reminders r
+		LEFT JOIN coupons c ON c.id = r.coupon_id
+		LEFT JOIN user_coupons uc ON uc.id = r.user_coupon_id
+		WHERE r.id = ?
+	`, id)
+	r, err := scanCouponExpiryReminder(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+// UpdateCouponExpiryReminderPush 记录到期提醒的订阅消息推送结果
+func UpdateCouponExpiryReminderPush(id int, status, pushError string) error {
+	if len(pushError) > 255 {
+		pushError = pushError[:255]
+	}
+	var pushedAt interface{}
+	if status == CouponReminderPushSent {
+		pushedAt = time.Now()
+	}
+	_, err := database.DB.Exec(`
+		UPDATE coupon_expiry_reminders SET push_status = ?, push_error = ?, pushed_at = ? WHERE id = ?
+	`, status, pushError, pushedAt, id)
+	return err
+}
+
+// GetUserCouponExpiryReminders 小程序用户的到期提醒列表（分页），同时返回未读数量
+func GetUserCouponExpiryReminders(userID, pageNum, pageSize int) ([]CouponExpiryReminder, int, int, error) {
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+	var total, unread int
+	if err := database.DB.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(is_read = 0), 0) FROM coupon_expiry_reminders WHERE user_id = ?
+	`, userID).Scan(&total, &unread); err != nil {
+		return nil, 0, 0, err
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT `+couponExpiryReminderColumns+`
+		FROM coupon_expiry_reminders r
+		LEFT JOIN coupons c ON c.id = r.coupon_id
+		LEFT JOIN user_coupons uc ON uc.id = r.user_coupon_id
+		WHERE r.user_id = ?
+		ORDER BY r.created_at DESC, r.id DESC
+		LIMIT ? OFFSET ?
+	`, userID, pageSize, (pageNum-1)*pageSize)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	list := make([]CouponExpiryReminder, 0)
+	for rows.Next() {
+		r, err := scanCouponExpiryReminder(rows)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		list = append(list, *r)
+	}
+	return list, total, unread, rows.Err()
+}
+
+// MarkCouponExpiryRemindersRead 将用户的到期提醒标记为已读，ids 为空时全部标记
+func MarkCouponExpiryRemindersRead(userID int, ids []int) error {
+	query := `UPDATE coupon_expiry_reminders SET is_read = 1 WHERE user_id = ? AND is_read = 0`
+	args := []interface{}{userID}
+	if len(ids) > 0 {
+		placeholders := make([]string, len(ids))
+		for i, id := range ids {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+		query += " AND id IN (" + strings.Join(placeholders, ",") + ")"
+	}
+	_, err := database.DB.Exec(query, args...)
+	return err
+}
+
+// GetCouponStats 按优惠券统计发放、使用、过期数量及使用订单金额，couponID 为 0 时统计全部
+func GetCouponStats(couponID int) ([]CouponStats, error) {
+	where := "1=1"
+	args := []interface{}{}
+	if couponID > 0 {
+		where = "c.id = ?"
+		args = append(args, couponID)
+	}
+
+	// 未使用但已到期的优惠券按已过期统计，不依赖过期任务是否已执行
+	// 抵扣金额按核销时记录的单券优惠金额统计；未记录的历史数据按订单内用券张数平均分摊
+	rows, err := database.DB.Query(`
+		SELECT c.id, c.name, c.type, c.discount_value, COALESCE(c.status, 0), c.total_count,
+		       COALESCE(s.issued, 0), COALESCE(s.unused, 0), COALESCE(s.used, 0), COALESCE(s.expired, 0),
+		       COALESCE(o.order_count, 0), COALESCE(o.order_amount, 0), COALESCE(o.coupon_discount, 0)
+		FROM coupons c
+		LEFT JOIN (
+			SELECT uc.coupon_id,
+			       COUNT(*) AS issued,
+			       SUM(uc.status = 'unused' AND `+couponEffectiveExpiresAt+` >= NOW()) AS unused,
+			       SUM(uc.status = 'used') AS used,
+			       SUM(uc.status = 'expired' OR (uc.status = 'unused' AND `+couponEffectiveExpiresAt+` < NOW())) AS expired
+			FROM user_coupons uc
+			JOIN coupons c ON c.id = uc.coupon_id
+			GROUP BY uc.coupon_id
+		) s ON s.coupon_id = c.id
+		LEFT JOIN (
+			SELECT t.coupon_id, COUNT(*) AS order_count, SUM(o.total_amount) AS order_amount,
+			       SUM(CASE WHEN t.unrecorded = 0 THEN t.saved ELSE o.coupon_discount * t.used / oc.used END) AS coupon_discount
+			FROM (
+				SELECT coupon_id, order_id, COUNT(*) AS used, SUM(saved_amount) AS saved, SUM(saved_amount IS NULL) AS unrecorded
+				FROM user_coupons WHERE status = 'used' AND order_id IS NOT NULL
+				GROUP BY coupon_id, order_id
+			) t
+			JOIN (
+				SELECT order_id, COUNT(*) AS used FROM user_coupons
+				WHERE status = 'used' AND order_id IS NOT NULL
+				GROUP BY order_id
+			) oc ON oc.order_id = t.order_id
+			JOIN orders o ON o.id = t.order_id AND o.status <> ?
+			GROUP BY t.coupon_id
+		) o ON o.coupon_id = c.id
+		WHERE `+where+`
+		ORDER BY c.id DESC
+	`, append([]interface{}{OrderStatusCancelled}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]CouponStats, 0)
+	for rows.Next() {
+		var s CouponStats
+		if err := rows.Scan(&s.CouponID, &s.Name, &s.Type, &s.DiscountValue, &s.Status, &s.TotalCount,
+			&s.IssuedCount, &s.UnusedCount, &s.UsedCount, &s.ExpiredCount,
+			&s.OrderCount, &s.OrderAmount, &s.CouponDiscount); err != nil {
+			return nil, err
+		}
+		if s.IssuedCount > 0 {
+			s.UsageRate = roundMoney(float64(s.UsedCount) * 100 / float64(s.IssuedCount))
+			s.ExpiryRate = roundMoney(float64(s.ExpiredCount) * 100 / float64(s.IssuedCount))
+		}
+		if s.OrderCount > 0 {
+			s.AvgOrderAmount = roundMoney(s.OrderAmount / float64(s.OrderCount))
+			s.DiscountPerUsed = roundMoney(s.CouponDiscount / float64(s.OrderCount))
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
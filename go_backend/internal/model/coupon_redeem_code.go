@@ -0,0 +1,364 @@
+package model
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 兑换码字符集（去掉易混淆的 0/O/1/I）及长度
+const (
+	redeemCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	redeemCodeLength   = 12
+	// MaxCouponCodeBatchSize 单个批次最多生成的兑换码数量
+	MaxCouponCodeBatchSize = 10000
+)
+
+// 兑换码状态
+const (
+	RedeemCodeUnused   = "unused"
+	RedeemCodeRedeemed = "redeemed"
+)
+
+var (
+	ErrRedeemCodeInvalid  = errors.New("兑换码无效")
+	ErrRedeemCodeUsed     = errors.New("兑换码已被使用")
+	ErrRedeemCodeExpired  = errors.New("兑换码已过期")
+	ErrRedeemCodeDisabled = errors.New("兑换码已停用")
+)
+
+// CouponCodeBatch 兑换码批次
+type CouponCodeBatch struct {
+	ID             int        `json:"id"`
+	Name           string     `json:"name"`
+	CouponID       int        `json:"coupon_id"`
+	CouponName     string     `json:"coupon_name"`
+	Quantity       int        `json:"quantity"`
+	RedeemedCount  int        `json:"redeemed_count"`
+	UsedCount      int        `json:"used_count"`      // 兑换得到的优惠券中已在订单中使用的数量
+	ExpiresInDays  int        `json:"expires_in_days"` // 兑换后有效天数，0 表示使用优惠券有效期
+	RedeemDeadline *time.Time `json:"redeem_deadline,omitempty"`
+	Status         int        `json:"status"` // 1-启用，0-停用
+	Remark         string     `json:"remark"`
+	CreatedBy      string     `json:"created_by"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// CouponRedeemCode 兑换码及兑换情况
+type CouponRedeemCode struct {
+	ID           int        `json:"id"`
+	BatchID      int        `json:"batch_id"`
+	Code         string     `json:"code"`
+	Status       string     `json:"status"` // unused / redeemed
+	UserID       *int       `json:"user_id,omitempty"`
+	UserName     string     `json:"user_name,omitempty"`
+	UserCode     string     `json:"user_code,omitempty"`
+	UserCouponID *int       `json:"user_coupon_id,omitempty"`
+	CouponStatus string     `json:"coupon_status,omitempty"` // 兑换得到的优惠券状态：unused / used / expired
+	OrderID      *int       `json:"order_id,omitempty"`      // 使用该优惠券的订单
+	RedeemedAt   *time.Time `json:"redeemed_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// NormalizeRedeemCode 统一兑换码格式：去掉空格和连字符并转为大写
+func NormalizeRedeemCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+func generateRedeemCode() (string, error) {
+	max := big.NewInt(int64(len(redeemCodeAlphabet)))
+	b := make([]byte, redeemCodeLength)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = redeemCodeAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// CreateCouponCodeBatch 创建兑换码批次并生成 batch.Quantity 个一次性兑换码
+func CreateCouponCodeBatch(batch *CouponCodeBatch) error {
+	if batch.Quantity <= 0 || batch.Quantity > MaxCouponCodeBatchSize {
+		return fmt.Errorf("兑换码数量必须在1到%d之间", MaxCouponCodeBatchSize)
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO coupon_code_batches (name, coupon_id, quantity, expires_in_days, redeem_deadline, status, remark, created_by)
+		VALUES (?, ?, ?, ?, ?, 1, ?, ?)
+	`, batch.Name, batch.CouponID, batch.Quantity, batch.ExpiresInDays, batch.RedeemDeadline, batch.Remark, batch.CreatedBy)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	batch.ID = int(id)
+	batch.Status = 1
+
+	// 分批插入，与已有兑换码重复的由 INSERT IGNORE 跳过后补足
+	const chunkSize = 500
+	generated := 0
+	for attempts := 0; generated < batch.Quantity; attempts++ {
+		if attempts > batch.Quantity/chunkSize+10 {
+			return fmt.Errorf("生成兑换码失败：重复次数过多")
+		}
+		n := batch.Quantity - generated
+		if n > chunkSize {
+			n = chunkSize
+		}
+		placeholders := make([]string, 0, n)
+		args := make([]interface{}, 0, n*2)
+		for i := 0; i < n; i++ {
+			code, err := generateRedeemCode()
+			if err != nil {
+				return err
+			}
+			placeholders = append(placeholders, "(?, ?)")
+			args = append(args, batch.ID, code)
+		}
+		res, err := tx.Exec("INSERT IGNORE INTO coupon_redeem_codes (batch_id, code) VALUES "+strings.Join(placeholders, ","), args...)
+		if err != nil {
+			return fmt.Errorf("生成兑换码失败: %w", err)
+		}
+		inserted, _ := res.RowsAffected()
+		generated += int(inserted)
+	}
+
+	return tx.Commit()
+}
+
+const couponCodeBatchColumns = `b.id, b.name, b.coupon_id, COALESCE(c.name, ''), b.quantity, b.redeemed_count,
+	(SELECT COUNT(*) FROM coupon_redeem_codes rc JOIN user_coupons uc ON uc.id = rc.user_coupon_id WHERE rc.batch_id = b.id AND uc.status = 'used'),
+	b.expires_in_days, b.redeem_deadline, b.status, b.remark, b.created_by, b.created_at, b.updated_at`
+
+func scanCouponCodeBatch(scanner interface{ Scan(...interface{}) error }) (*CouponCodeBatch, error) {
+	var b CouponCodeBatch
+	var deadline sql.NullTime
+	if err := scanner.Scan(
+		&b.ID, &b.Name, &b.CouponID, &b.CouponName, &b.Quantity, &b.RedeemedCount, &b.UsedCount,
+		&b.ExpiresInDays, &deadline, &b.Status, &b.Remark, &b.CreatedBy, &b.CreatedAt, &b.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+	b.RedeemDeadline = nullTimePtr(deadline)
+	return &b, nil
+}
+
+// GetCouponCodeBatches 兑换码批次列表（分页，可按优惠券筛选）
+func GetCouponCodeBatches(couponID, pageNum, pageSize int) ([]CouponCodeBatch, int, error) {
+	where := "1=1"
+	args := []interface{}{}
+	if couponID > 0 {
+		where += " AND b.coupon_id = ?"
+		args = append(args, couponID)
+	}
+
+	var total int
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM coupon_code_batches b WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := "SELECT " + couponCodeBatchColumns + " FROM coupon_code_batches b LEFT JOIN coupons c ON c.id = b.coupon_id WHERE " + where +
+		" ORDER BY b.id DESC LIMIT ? OFFSET ?"
+	args = append(args, pageSize, (pageNum-1)*pageSize)
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	list := make([]CouponCodeBatch, 0)
+	for rows.Next() {
+		b, err := scanCouponCodeBatch(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		list = append(list, *b)
+	}
+	return list, total, rows.Err()
+}
+
+// GetCouponCodeBatchByID 根据ID获取兑换码批次
+func GetCouponCodeBatchByID(id int) (*CouponCodeBatch, error) {
+	row := database.DB.QueryRow("SELECT "+couponCodeBatchColumns+" FROM coupon_code_batches b LEFT JOIN coupons c ON c.id = b.coupon_id WHERE b.id = ?", id)
+	b, err := scanCouponCodeBatch(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return b, err
+}
+
+// SetCouponCodeBatchStatus 启用或停用兑换码批次（停用后该批次未兑换的码不能再兑换）
+func SetCouponCodeBatchStatus(id, status int) error {
+	res, err := database.DB.Exec("UPDATE coupon_code_batches SET status = ?, updated_at = NOW() WHERE id = ?", status, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists int
+		if err := database.DB.QueryRow("SELECT COUNT(*) FROM coupon_code_batches WHERE id = ?", id).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return sql.ErrNoRows
+		}
+	}
+	return nil
+}
+
+// GetCouponRedeemCodes 批次内的兑换码及兑换情况，status 为空时返回全部；pageSize 为 0 时不分页（用于导出）
+func GetCouponRedeemCodes(batchID int, status, keyword string, pageNum, pageSize int) ([]CouponRedeemCode, int, error) {
+	where := "rc.batch_id = ?"
+	args := []interface{}{batchID}
+	if status != "" {
+		where += " AND rc.status = ?"
+		args = append(args, status)
+	}
+	if keyword != "" {
+		kw := "%" + keyword + "%"
+		where += " AND (rc.code LIKE ? OR u.name LIKE ? OR u.user_code LIKE ?)"
+		args = append(args, kw, kw, kw)
+	}
+
+	var total int
+	if err := database.DB.QueryRow(
+		"SELECT COUNT(*) FROM coupon_redeem_codes rc LEFT JOIN mini_app_users u ON u.id = rc.user_id WHERE "+where, args...,
+	).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT rc.id, rc.batch_id, rc.code, rc.status, rc.user_id, COALESCE(u.name, ''), COALESCE(u.user_code, ''),
+		       rc.user_coupon_id, COALESCE(uc.status, ''), uc.order_id, rc.redeemed_at, rc.created_at
+		FROM coupon_redeem_codes rc
+		LEFT JOIN mini_app_users u ON u.id = rc.user_id
+		LEFT JOIN user_coupons uc ON uc.id = rc.user_coupon_id
+		WHERE ` + where + `
+		ORDER BY rc.id ASC`
+	if pageSize > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, pageSize, (pageNum-1)*pageSize)
+	}
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	list := make([]CouponRedeemCode, 0)
+	for rows.Next() {
+		var rc CouponRedeemCode
+		var userID, userCouponID, orderID sql.NullInt64
+		var redeemedAt sql.NullTime
+		if err := rows.Scan(
+			&rc.ID, &rc.BatchID, &rc.Code, &rc.Status, &userID, &rc.UserName, &rc.UserCode,
+			&userCouponID, &rc.CouponStatus, &orderID, &redeemedAt, &rc.CreatedAt,
+		); err != nil {
+			return nil, 0, err
+		}
+		rc.UserID = nullIntPtr(userID)
+		rc.UserCouponID = nullIntPtr(userCouponID)
+		rc.OrderID = nullIntPtr(orderID)
+		rc.RedeemedAt = nullTimePtr(redeemedAt)
+		list = append(list, rc)
+	}
+	return list, total, rows.Err()
+}
+
+// RedeemCouponCode 用户使用兑换码兑换优惠券，兑换码锁定后一次性核销
+func RedeemCouponCode(code string, user *MiniAppUser) (*CouponClaimResult, error) {
+	code = NormalizeRedeemCode(code)
+	if code == "" {
+		return nil, ErrRedeemCodeInvalid
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var codeID, batchID, couponID, expiresInDays, batchStatus int
+	var status, batchName string
+	var deadline sql.NullTime
+	err = tx.QueryRow(`
+		SELECT rc.id, rc.status, b.id, b.name, b.coupon_id, b.expires_in_days, b.redeem_deadline, b.status
+		FROM coupon_redeem_codes rc
+		JOIN coupon_code_batches b ON b.id = rc.batch_id
+		WHERE rc.code = ?
+		FOR UPDATE
+	`, code).Scan(&codeID, &status, &batchID, &batchName, &couponID, &expiresInDays, &deadline, &batchStatus)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRedeemCodeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if status == RedeemCodeRedeemed {
+		return nil, ErrRedeemCodeUsed
+	}
+	if batchStatus != 1 {
+		return nil, ErrRedeemCodeDisabled
+	}
+	if deadline.Valid && time.Now().After(deadline.Time) {
+		return nil, ErrRedeemCodeExpired
+	}
+
+	result, err := issueCouponInTx(tx, user.ID, couponID, expiresInDays)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`
+		UPDATE coupon_redeem_codes SET status = ?, user_id = ?, user_coupon_id = ?, redeemed_at = NOW()
+		WHERE id = ?
+	`, RedeemCodeRedeemed, user.ID, result.UserCouponID, codeID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE coupon_code_batches SET redeemed_count = redeemed_count + 1 WHERE id = ?", batchID); err != nil {
+		return nil, err
+	}
+	if err := insertCouponIssueLog(tx, &CouponIssueLog{
+		UserID:       user.ID,
+		CouponID:     couponID,
+		CouponName:   result.CouponName,
+		Quantity:     1,
+		Reason:       fmt.Sprintf("兑换码：%s（%s）", code, batchName),
+		OperatorType: CouponIssueOperatorSelfService,
+		OperatorID:   user.ID,
+		OperatorName: user.Name,
+		ExpiresAt:    result.ExpiresAt,
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func nullIntPtr(v sql.NullInt64) *int {
+	if !v.Valid {
+		return nil
+	}
+	n := int(v.Int64)
+	return &n
+}
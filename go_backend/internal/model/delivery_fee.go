@@ -60,6 +60,8 @@ type DeliveryFeeSummary struct {
 	IneligibleQuantity    int                       `json:"ineligible_quantity"`
 	TotalQuantity         int                       `json:"total_quantity"`
 	BlockedItemIDs        []int                     `json:"blocked_item_ids"`
+	PromoSavedAmount      float64                   `json:"promo_saved_amount"` // 限时促销节省金额（已计入商品金额）
+	Zone                  *DeliveryZoneBrief        `json:"zone,omitempty"` // 收货地址所在配送区域（按地址计算时返回）
 }
 
 // GetDeliveryFeeSetting 获取当前配送费设置
@@ -255,6 +257,20 @@ func DeleteDeliveryFeeExclusion(id int) error {
 // userType: "wholesale" 表示批发客户，使用批发价；"retail" 或其他值表示零售客户，使用零售价
 // priceOverrides: 可选的价格覆盖映射（采购单项ID -> 改价后的单价），用于销售员改价场景
 func CalculateDeliveryFee(items []PurchaseListItem, userType string, priceOverrides ...map[int]float64) (*DeliveryFeeSummary, error) {
+	return calculateDeliveryFee(items, userType, nil, priceOverrides...)
+}
+
+// CalculateDeliveryFeeForAddress 按收货地址所在配送区域计算配送费（区域设置了基础配送费/免配送费门槛时覆盖全局设置）
+// address 为空或不在任何区域内时与 CalculateDeliveryFee 相同
+func CalculateDeliveryFeeForAddress(items []PurchaseListItem, userType string, address *Address, priceOverrides ...map[int]float64) (*DeliveryFeeSummary, error) {
+	zone, err := FindDeliveryZoneForAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	return calculateDeliveryFee(items, userType, zone, priceOverrides...)
+}
+
+func calculateDeliveryFee(items []PurchaseListItem, userType string, zone *DeliveryZone, priceOverrides ...map[int]float64) (*DeliveryFeeSummary, error) {
 	var priceOverrideMap map[int]float64
 	if len(priceOverrides) > 0 && priceOverrides[0] != nil {
 		priceOverrideMap = priceOverrides[0]
@@ -274,6 +290,15 @@ func CalculateDeliveryFee(items []PurchaseListItem, userType string, priceOverri
 	}
 	summary.BaseFee = setting.BaseFee
 	summary.FreeShippingThreshold = setting.FreeShippingThreshold
+	if zone != nil {
+		summary.Zone = zone.Brief()
+		if zone.BaseFee != nil {
+			summary.BaseFee = *zone.BaseFee
+		}
+		if zone.FreeShippingThreshold != nil {
+			summary.FreeShippingThreshold = *zone.FreeShippingThreshold
+		}
+	}
 
 	if len(items) == 0 {
 		summary.DeliveryFee = summary.BaseFee
@@ -313,14 +338,11 @@ func CalculateDeliveryFee(items []PurchaseListItem, userType string, priceOverri
 		summary.TotalQuantity += item.Quantity
 		// 如果有关键价格覆盖，使用覆盖价格；否则使用原始价格
 		var amount float64
-		if priceOverrideMap != nil {
-			if overridePrice, hasOverride := priceOverrideMap[item.ID]; hasOverride && overridePrice >= 0 {
-				amount = overridePrice * float64(item.Quantity)
-			} else {
-				amount = calculateItemAmount(item, userType)
-			}
+		if overridePrice, hasOverride := priceOverrideMap[item.ID]; hasOverride && overridePrice >= 0 {
+			amount = overridePrice * float64(item.Quantity)
 		} else {
 			amount = calculateItemAmount(item, userType)
+			summary.PromoSavedAmount += itemPromoSavedAmount(item, userType)
 		}
 		summary.TotalAmount += amount
 
@@ -558,30 +580,40 @@ func aggregateCategoryQuantities(items []PurchaseListItem, infoMap map[int]produ
 }
 
 // calculateItemAmount 根据用户类型计算商品金额
-// userType: "wholesale" 表示批发客户，使用批发价；"retail" 或其他值表示零售客户，使用零售价
+// userType: "wholesale" 表示批发客户，使用批发价（达到阶梯数量时按阶梯价）；"retail" 或其他值表示零售客户，使用零售价
 func calculateItemAmount(item PurchaseListItem, userType string) float64 {
+	price := specUnitPrice(item.SpecSnapshot, userType, item.Quantity)
+	// 限时促销：促销数量内按促销价，其余按原价
+	if promoQty := itemPromoQuantity(item); promoQty > 0 {
+		return item.SpecSnapshot.PromoPrice*float64(promoQty) + price*float64(item.Quantity-promoQty)
+	}
+	return price * float64(item.Quantity)
+}
+
+// specBaseUnitPrice 根据用户类型取规格原价（不含促销）
+func specBaseUnitPrice(snapshot PurchaseSpecSnapshot, userType string) float64 {
 	var price float64
 	// 批发客户优先使用批发价，零售客户优先使用零售价
 	if userType == "wholesale" {
-		price = item.SpecSnapshot.WholesalePrice
+		price = snapshot.WholesalePrice
 	if price <= 0 {
-			price = item.SpecSnapshot.RetailPrice
+			price = snapshot.RetailPrice
 		}
 	} else {
 		// 零售客户或其他类型，优先使用零售价
-		price = item.SpecSnapshot.RetailPrice
+		price = snapshot.RetailPrice
 		if price <= 0 {
-			price = item.SpecSnapshot.WholesalePrice
+			price = snapshot.WholesalePrice
 		}
 	}
 	// 如果都没有，使用成本价
 	if price <= 0 {
-		price = item.SpecSnapshot.Cost
+		price = snapshot.Cost
 	}
 	if price < 0 {
 		price = 0
 	}
-	return price * float64(item.Quantity)
+	return price
 }
 
 func pickDeliveryRule(productID int, info productCategoryInfo, productRules, categoryRules map[int]*DeliveryFeeExclusion) *DeliveryFeeExclusion {
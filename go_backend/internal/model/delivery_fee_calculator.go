@@ -31,7 +31,9 @@ type DeliveryFeeCalculationResult struct {
 type DeliveryFeeCalculator struct {
 	orderID              int
 	order                 *Order
-	deliveryEmployeeCode *string // 可选：用于判断孤立时考虑该配送员的批次订单
+	deliveryEmployeeCode *string       // 可选：用于判断孤立时考虑该配送员的批次订单
+	zone                 *DeliveryZone // 订单地址所在配送区域（懒加载）
+	zoneLoaded           bool
 }
 
 // NewDeliveryFeeCalculator 创建配送费计算器
@@ -72,6 +74,9 @@ func NewDeliveryFeeCalculatorForEmployee(orderID int, deliveryEmployeeCode strin
 func (c *DeliveryFeeCalculator) Calculate(isAdminView bool) (*DeliveryFeeCalculationResult, error) {
 	// 1. 基础配送费
 	baseFee := c.getConfigFloat("delivery_base_fee", 4.0)
+	if zone := c.deliveryZone(); zone != nil && zone.RiderBaseFee != nil {
+		baseFee = *zone.RiderBaseFee
+	}
 	baseFee = math.Max(0, baseFee)
 
 	// 2. 孤立订单补贴
@@ -123,6 +128,9 @@ func (c *DeliveryFeeCalculator) Calculate(isAdminView bool) (*DeliveryFeeCalcula
 // calculateIsolatedFee 计算孤立订单补贴
 func (c *DeliveryFeeCalculator) calculateIsolatedFee() float64 {
 	isolatedSubsidy := c.getConfigFloat("delivery_isolated_subsidy", 3.0)
+	if zone := c.deliveryZone(); zone != nil && zone.RiderIsolatedSubsidy != nil {
+		isolatedSubsidy = *zone.RiderIsolatedSubsidy
+	}
 
 	// 如果指定了配送员代码，必须基于该配送员的批次订单实时计算，忽略已存储的值
 	// 因为不同配送员看到的孤立状态可能不同
@@ -184,7 +192,8 @@ func (c *DeliveryFeeCalculator) getNearbyOrders(lat, lng, distance float64) ([]*
 			}
 			
 			query := fmt.Sprintf(`
-				SELECT o.id, o.order_number, o.user_id, o.address_id, o.status, o.created_at, o.delivery_employee_code
+				SELECT o.id, o.order_number, o.user_id, o.address_id, o.status, o.created_at, o.delivery_employee_code,
+				       a.latitude, a.longitude
 				FROM orders o
 				JOIN mini_app_addresses a ON o.address_id = a.id
 				WHERE o.id IN (%s)
@@ -195,37 +204,8 @@ func (c *DeliveryFeeCalculator) getNearbyOrders(lat, lng, distance float64) ([]*
 			`, strings.Join(placeholders, ","))
 			
 			args = append(args, c.orderID)
-			rows, err := database.DB.Query(query, args...)
-			if err == nil {
-				defer rows.Close()
-				for rows.Next() {
-					var order Order
-					var addressID int
-					var deliveryEmployeeCode sql.NullString
-					err := rows.Scan(&order.ID, &order.OrderNumber, &order.UserID, &addressID, &order.Status, &order.CreatedAt, &deliveryEmployeeCode)
-					if err != nil {
-						continue
-					}
-					
-					if deliveryEmployeeCode.Valid {
-						code := deliveryEmployeeCode.String
-						order.DeliveryEmployeeCode = &code
-					}
-
-					// 获取地址经纬度
-					var addrLat, addrLng sql.NullFloat64
-					err = database.DB.QueryRow("SELECT latitude, longitude FROM mini_app_addresses WHERE id = ?", addressID).
-						Scan(&addrLat, &addrLng)
-					if err != nil || !addrLat.Valid || !addrLng.Valid {
-						continue
-					}
-
-					// 计算距离
-					dist := utils.CalculateDistance(lat, lng, addrLat.Float64, addrLng.Float64)
-					if dist <= distance {
-						orders = append(orders, &order)
-					}
-				}
+			if batchOrders, err := queryOrdersWithinRoadDistance(query, args, lat, lng, distance); err == nil {
+				orders = batchOrders
 			}
 		}
 		
@@ -233,7 +213,8 @@ func (c *DeliveryFeeCalculator) getNearbyOrders(lat, lng, distance float64) ([]*
 		if len(orders) == 0 {
 			// 查询未接单的订单
 			query := `
-				SELECT o.id, o.order_number, o.user_id, o.address_id, o.status, o.created_at, o.delivery_employee_code
+				SELECT o.id, o.order_number, o.user_id, o.address_id, o.status, o.created_at, o.delivery_employee_code,
+				       a.latitude, a.longitude
 				FROM orders o
 				JOIN mini_app_addresses a ON o.address_id = a.id
 				WHERE o.status IN ('pending', 'pending_delivery')
@@ -241,43 +222,15 @@ func (c *DeliveryFeeCalculator) getNearbyOrders(lat, lng, distance float64) ([]*
 				  AND a.latitude IS NOT NULL
 				  AND a.longitude IS NOT NULL
 			`
-			rows, err := database.DB.Query(query, c.orderID)
-			if err == nil {
-				defer rows.Close()
-				for rows.Next() {
-					var order Order
-					var addressID int
-					var deliveryEmployeeCode sql.NullString
-					err := rows.Scan(&order.ID, &order.OrderNumber, &order.UserID, &addressID, &order.Status, &order.CreatedAt, &deliveryEmployeeCode)
-					if err != nil {
-						continue
-					}
-					
-					if deliveryEmployeeCode.Valid {
-						code := deliveryEmployeeCode.String
-						order.DeliveryEmployeeCode = &code
-					}
-
-					// 获取地址经纬度
-					var addrLat, addrLng sql.NullFloat64
-					err = database.DB.QueryRow("SELECT latitude, longitude FROM mini_app_addresses WHERE id = ?", addressID).
-						Scan(&addrLat, &addrLng)
-					if err != nil || !addrLat.Valid || !addrLng.Valid {
-						continue
-					}
-
-					// 计算距离
-					dist := utils.CalculateDistance(lat, lng, addrLat.Float64, addrLng.Float64)
-					if dist <= distance {
-						orders = append(orders, &order)
-					}
-				}
+			if pendingOrders, err := queryOrdersWithinRoadDistance(query, []interface{}{c.orderID}, lat, lng, distance); err == nil {
+				orders = pendingOrders
 			}
 		}
 	} else {
 		// 没有指定配送员，只查询未接单的订单
 		query := `
-			SELECT o.id, o.order_number, o.user_id, o.address_id, o.status, o.created_at, o.delivery_employee_code
+			SELECT o.id, o.order_number, o.user_id, o.address_id, o.status, o.created_at, o.delivery_employee_code,
+			       a.latitude, a.longitude
 			FROM orders o
 			JOIN mini_app_addresses a ON o.address_id = a.id
 			WHERE o.status IN ('pending', 'pending_delivery')
@@ -285,45 +238,69 @@ func (c *DeliveryFeeCalculator) getNearbyOrders(lat, lng, distance float64) ([]*
 			  AND a.latitude IS NOT NULL
 			  AND a.longitude IS NOT NULL
 		`
-		rows, err := database.DB.Query(query, c.orderID)
-		if err != nil {
-			return nil, err
-		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var order Order
-			var addressID int
-			var deliveryEmployeeCode sql.NullString
-			err := rows.Scan(&order.ID, &order.OrderNumber, &order.UserID, &addressID, &order.Status, &order.CreatedAt, &deliveryEmployeeCode)
-			if err != nil {
-				continue
-			}
-			
-			if deliveryEmployeeCode.Valid {
-				code := deliveryEmployeeCode.String
-				order.DeliveryEmployeeCode = &code
-			}
+		return queryOrdersWithinRoadDistance(query, []interface{}{c.orderID}, lat, lng, distance)
+	}
 
-			// 获取地址经纬度
-			var addrLat, addrLng sql.NullFloat64
-			err = database.DB.QueryRow("SELECT latitude, longitude FROM mini_app_addresses WHERE id = ?", addressID).
-				Scan(&addrLat, &addrLng)
-			if err != nil || !addrLat.Valid || !addrLng.Valid {
-				continue
-			}
+	return orders, nil
+}
 
-			// 计算距离
-			dist := utils.CalculateDistance(lat, lng, addrLat.Float64, addrLng.Float64)
-			if dist <= distance {
-				orders = append(orders, &order)
-			}
+// queryOrdersWithinRoadDistance 查询候选订单（最后两列为收货地址经纬度），关闭游标后一次性按道路距离筛选邻近订单
+func queryOrdersWithinRoadDistance(query string, args []interface{}, lat, lng, distance float64) ([]*Order, error) {
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []*Order
+	var points []utils.Coordinate
+	for rows.Next() {
+		var order Order
+		var deliveryEmployeeCode sql.NullString
+		var point utils.Coordinate
+		err := rows.Scan(&order.ID, &order.OrderNumber, &order.UserID, &order.AddressID, &order.Status, &order.CreatedAt, &deliveryEmployeeCode,
+			&point.Lat, &point.Lng)
+		if err != nil {
+			continue
+		}
+		if deliveryEmployeeCode.Valid {
+			code := deliveryEmployeeCode.String
+			order.DeliveryEmployeeCode = &code
 		}
+		candidates = append(candidates, &order)
+		points = append(points, point)
 	}
+	rows.Close()
 
+	// 按道路距离判断是否相邻
+	var orders []*Order
+	for i, ok := range withinRoadDistance(lat, lng, points, distance) {
+		if ok {
+			orders = append(orders, candidates[i])
+		}
+	}
 	return orders, nil
 }
 
+// queryOrderPoints 查询订单ID及收货地址经纬度（查询需返回 id, latitude, longitude），读取完毕后关闭游标
+func queryOrderPoints(query string, args ...interface{}) ([]int, []utils.Coordinate, error) {
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	var points []utils.Coordinate
+	for rows.Next() {
+		var id int
+		var point utils.Coordinate
+		if err := rows.Scan(&id, &point.Lat, &point.Lng); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+		points = append(points, point)
+	}
+	return ids, points, rows.Err()
+}
+
 // filterNearbyOrders 过滤邻近订单
 func (c *DeliveryFeeCalculator) filterNearbyOrders(orders []*Order) []*Order {
 	var validOrders []*Order
@@ -583,6 +560,25 @@ func (c *DeliveryFeeCalculator) calculateOrderProfit() float64 {
 	return math.Max(0, profit)
 }
 
+// deliveryZone 订单收货地址所在配送区域（区域可覆盖配送员基础配送费和孤立补贴），查询失败视为不在区域内
+func (c *DeliveryFeeCalculator) deliveryZone() *DeliveryZone {
+	if c.zoneLoaded {
+		return c.zone
+	}
+	c.zoneLoaded = true
+	address, err := GetAddressByID(c.order.AddressID)
+	if err != nil || address == nil {
+		return nil
+	}
+	zone, err := FindDeliveryZoneForAddress(address)
+	if err != nil {
+		log.Printf("[DeliveryFeeCalculator] 查询订单 %d 配送区域失败: %v", c.orderID, err)
+		return nil
+	}
+	c.zone = zone
+	return zone
+}
+
 // getConfigFloat 获取配置值（浮点数）
 func (c *DeliveryFeeCalculator) getConfigFloat(key string, defaultValue float64) float64 {
 	valueStr, err := GetSystemSetting(key)
@@ -657,19 +653,13 @@ func UpdateOrderDeliveryInfo(orderID int) error {
 				  AND a.latitude IS NOT NULL
 				  AND a.longitude IS NOT NULL
 			`
-			reverseRows, err := database.DB.Query(reverseQuery, orderID)
+			otherOrderIDs, otherPoints, err := queryOrderPoints(reverseQuery, orderID)
 			if err == nil {
-				defer reverseRows.Close()
-				for reverseRows.Next() {
-					var otherOrderID int
-					var otherLat, otherLng sql.NullFloat64
-					if err := reverseRows.Scan(&otherOrderID, &otherLat, &otherLng); err == nil && otherLat.Valid && otherLng.Valid {
-						// 计算距离
-						dist := utils.CalculateDistance(*address.Latitude, *address.Longitude, otherLat.Float64, otherLng.Float64)
-						if dist <= isolatedDistance {
-							// 这个订单以当前订单为相邻订单，需要重新计算孤立状态
-							affectedOrderIDsMap[otherOrderID] = true
-						}
+				// 按道路距离判断是否相邻
+				for i, ok := range withinRoadDistance(*address.Latitude, *address.Longitude, otherPoints, isolatedDistance) {
+					if ok {
+						// 这个订单以当前订单为相邻订单，需要重新计算孤立状态
+						affectedOrderIDsMap[otherOrderIDs[i]] = true
 					}
 				}
 			}
@@ -811,21 +801,16 @@ func updateAffectedOrdersIsolatedStatus(orderID int) error {
 		  AND a.latitude IS NOT NULL
 		  AND a.longitude IS NOT NULL
 	`
-	rows, err := database.DB.Query(query, orderID)
+	otherOrderIDs, otherPoints, err := queryOrderPoints(query, orderID)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
 
 	var affectedOrderIDs []int
-	for rows.Next() {
-		var otherOrderID int
-		var otherLat, otherLng sql.NullFloat64
-		if err := rows.Scan(&otherOrderID, &otherLat, &otherLng); err == nil && otherLat.Valid && otherLng.Valid {
-			dist := utils.CalculateDistance(*address.Latitude, *address.Longitude, otherLat.Float64, otherLng.Float64)
-			if dist <= isolatedDistance {
-				affectedOrderIDs = append(affectedOrderIDs, otherOrderID)
-			}
+	// 按道路距离判断是否相邻
+	for i, ok := range withinRoadDistance(*address.Latitude, *address.Longitude, otherPoints, isolatedDistance) {
+		if ok {
+			affectedOrderIDs = append(affectedOrderIDs, otherOrderIDs[i])
 		}
 	}
 
@@ -981,6 +966,16 @@ func CalculateRiderDeliveryFeePreview(items []PurchaseListItem, addressID int, i
 			baseFee = math.Max(0, val)
 		}
 	}
+	// 收货地址所在配送区域可覆盖配送员基础配送费和孤立补贴
+	var zone *DeliveryZone
+	if addressID > 0 {
+		if address, err := GetAddressByID(addressID); err == nil && address != nil {
+			zone, _ = FindDeliveryZoneForAddress(address)
+		}
+	}
+	if zone != nil && zone.RiderBaseFee != nil {
+		baseFee = math.Max(0, *zone.RiderBaseFee)
+	}
 	result["base_fee"] = baseFee
 
 	// 2. 商品件数补贴
@@ -1084,6 +1079,9 @@ func CalculateRiderDeliveryFeePreview(items []PurchaseListItem, addressID int, i
 				isolatedSubsidy = val
 			}
 		}
+		if zone != nil && zone.RiderIsolatedSubsidy != nil {
+			isolatedSubsidy = *zone.RiderIsolatedSubsidy
+		}
 
 		isolatedDistanceStr, _ := GetSystemSetting("delivery_isolated_distance")
 		isolatedDistance := 8.0
@@ -1097,8 +1095,8 @@ func CalculateRiderDeliveryFeePreview(items []PurchaseListItem, addressID int, i
 		address, err := GetAddressByID(addressID)
 		if err == nil && address != nil && address.Latitude != nil && address.Longitude != nil {
 			// 查询附近未接单的订单（只查询pending和pending_delivery）
-			rows, err := database.DB.Query(`
-				SELECT a.latitude, a.longitude
+			_, points, err := queryOrderPoints(`
+				SELECT o.id, a.latitude, a.longitude
 				FROM orders o
 				JOIN mini_app_addresses a ON o.address_id = a.id
 				WHERE o.status IN ('pending', 'pending_delivery')
@@ -1106,16 +1104,12 @@ func CalculateRiderDeliveryFeePreview(items []PurchaseListItem, addressID int, i
 				  AND a.longitude IS NOT NULL
 			`)
 			if err == nil {
-				defer rows.Close()
 				hasNearby := false
-				for rows.Next() {
-					var lat, lng sql.NullFloat64
-					if err := rows.Scan(&lat, &lng); err == nil && lat.Valid && lng.Valid {
-						dist := utils.CalculateDistance(*address.Latitude, *address.Longitude, lat.Float64, lng.Float64)
-						if dist <= isolatedDistance {
-							hasNearby = true
-							break
-						}
+				// 按道路距离判断是否相邻
+				for _, ok := range withinRoadDistance(*address.Latitude, *address.Longitude, points, isolatedDistance) {
+					if ok {
+						hasNearby = true
+						break
 					}
 				}
 				if !hasNearby {
@@ -1191,26 +1185,8 @@ func CalculateRiderDeliveryFeePreview(items []PurchaseListItem, addressID int, i
 	goodsAmount := 0.0
 	totalCost := 0.0
 	for _, item := range items {
-		// 根据用户类型计算商品金额
-		var price float64
-		if userType == "wholesale" {
-			price = item.SpecSnapshot.WholesalePrice
-			if price <= 0 {
-				price = item.SpecSnapshot.RetailPrice
-			}
-		} else {
-			price = item.SpecSnapshot.RetailPrice
-			if price <= 0 {
-				price = item.SpecSnapshot.WholesalePrice
-			}
-		}
-		if price <= 0 {
-			price = item.SpecSnapshot.Cost
-		}
-		if price < 0 {
-			price = 0
-		}
-		goodsAmount += price * float64(item.Quantity)
+		// 根据用户类型计算商品金额（含阶梯价和限时促销）
+		goodsAmount += calculateItemAmount(item, userType)
 
 		// 计算成本
 		cost := item.SpecSnapshot.Cost
@@ -15,6 +15,9 @@ const (
 	DeliveryLogActionPickupCompleted = "pickup_completed"  // 取货完成
 	DeliveryLogActionDeliveringStarted = "delivering_started" // 开始配送
 	DeliveryLogActionDeliveringCompleted = "delivering_completed" // 配送完成
+	DeliveryLogActionDispatchOffered      = "dispatch_offered"      // 推送派单邀请
+	DeliveryLogActionDispatchDeclined     = "dispatch_declined"     // 拒绝派单邀请
+	DeliveryLogActionDispatchExpired      = "dispatch_expired"      // 派单邀请超时
 )
 
 // DeliveryLog 配送流程日志
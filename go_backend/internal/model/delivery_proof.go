@@ -0,0 +1,335 @@
+package model
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"go_backend/internal/database"
+	"go_backend/internal/utils"
+)
+
+// 送达位置校验结果
+const (
+	GeofenceStatusInside  = "inside"  // 在收货地址围栏内
+	GeofenceStatusOutside = "outside" // 超出围栏
+	GeofenceStatusUnknown = "unknown" // 缺少配送员位置或收货地址坐标
+)
+
+// 送达审核状态
+const (
+	DeliveryReviewNone     = "none"     // 无需审核
+	DeliveryReviewPending  = "pending"  // 待审核
+	DeliveryReviewApproved = "approved" // 审核通过
+	DeliveryReviewRejected = "rejected" // 审核不通过
+)
+
+// ErrDeliveryReviewNotPending 配送记录不是待审核状态
+var ErrDeliveryReviewNotPending = errors.New("配送记录不是待审核状态")
+
+// DeliveryProof 完成配送时的位置校验和收货确认结果
+type DeliveryProof struct {
+	Latitude            *float64 `json:"latitude"`
+	Longitude           *float64 `json:"longitude"`
+	Accuracy            *float64 `json:"accuracy"`
+	DistanceToAddress   *float64 `json:"distance_to_address"` // 与收货地址的距离（米）
+	RadiusMeters        float64  `json:"radius_meters"`
+	GeofenceStatus      string   `json:"geofence_status"`
+	ConfirmCodeVerified bool     `json:"confirm_code_verified"`
+	ReviewStatus        string   `json:"review_status"`
+}
+
+// EvaluateDeliveryProof 比较配送员完成位置与收货地址，超出半径或无法判断时标记待审核
+func EvaluateDeliveryProof(order *Order, latitude, longitude, accuracy *float64) DeliveryProof {
+	proof := DeliveryProof{
+		Latitude:       latitude,
+		Longitude:      longitude,
+		Accuracy:       accuracy,
+		RadiusMeters:   GetSystemSettingFloat("delivery_geofence_radius_meters", 300),
+		GeofenceStatus: GeofenceStatusUnknown,
+		ReviewStatus:   DeliveryReviewPending,
+	}
+	if latitude == nil || longitude == nil {
+		return proof
+	}
+	address, err := GetAddressByID(order.AddressID)
+	if err != nil || address == nil || address.Latitude == nil || address.Longitude == nil {
+		return proof
+	}
+
+	distance := utils.CalculateDistance(*latitude, *longitude, *address.Latitude, *address.Longitude) * 1000
+	proof.DistanceToAddress = &distance
+	if distance <= proof.RadiusMeters {
+		proof.GeofenceStatus = GeofenceStatusInside
+		proof.ReviewStatus = DeliveryReviewNone
+	} else {
+		proof.GeofenceStatus = GeofenceStatusOutside
+	}
+	return proof
+}
+
+// InsertDeliveryRecordInTx 在完成配送事务中写入配送记录（含送达位置校验结果）
+func InsertDeliveryRecordInTx(tx *sql.Tx, record *DeliveryRecord, proof DeliveryProof) error {
+	result, err := tx.Exec(`
+		INSERT INTO delivery_records (
+			order_id, delivery_employee_code, product_image_url, doorplate_image_url, completed_at,
+			completion_latitude, completion_longitude, completion_accuracy, distance_to_address,
+			geofence_status, confirm_code_verified, review_status, created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())
+	`, record.OrderID, record.DeliveryEmployeeCode, record.ProductImageURL, record.DoorplateImageURL, record.CompletedAt,
+		proof.Latitude, proof.Longitude, proof.Accuracy, proof.DistanceToAddress,
+		proof.GeofenceStatus, proof.ConfirmCodeVerified, proof.ReviewStatus)
+	if err != nil {
+		return err
+	}
+	if id, err := result.LastInsertId(); err == nil {
+		record.ID = int(id)
+	}
+	return nil
+}
+
+// DeliveryConfirmCodeRequired 订单送达是否需要客户收货确认码
+func DeliveryConfirmCodeRequired(order *Order) bool {
+	minAmount := GetSystemSettingFloat("delivery_confirm_code_min_amount", 0)
+	return minAmount > 0 && order.TotalAmount >= minAmount
+}
+
+// deliveryConfirmCodeExecer 可在数据库连接或事务上执行的写操作
+type deliveryConfirmCodeExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// generateDeliveryConfirmCode 订单没有收货确认码时生成 4 位数字码
+func generateDeliveryConfirmCode(db deliveryConfirmCodeExecer, orderID int) error {
+	n, err := rand.Int(rand.Reader, big.NewInt(10000))
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		"UPDATE orders SET delivery_confirm_code = ? WHERE id = ? AND (delivery_confirm_code IS NULL OR delivery_confirm_code = '')",
+		fmt.Sprintf("%04d", n.Int64()), orderID,
+	)
+	return err
+}
+
+// EnsureDeliveryConfirmCode 获取订单收货确认码，没有时生成（兼容上线前已进入待取货的订单）
+// 新订单在进入待取货时已生成确认码
+func EnsureDeliveryConfirmCode(orderID int) (string, error) {
+	if err := generateDeliveryConfirmCode(database.DB, orderID); err != nil {
+		return "", err
+	}
+	var code string
+	err := database.DB.QueryRow("SELECT COALESCE(delivery_confirm_code, '') FROM orders WHERE id = ?", orderID).Scan(&code)
+	return code, err
+}
+
+// ErrDeliveryConfirmCodeLocked 收货确认码错误次数过多，暂时锁定
+var ErrDeliveryConfirmCodeLocked = errors.New("收货确认码错误次数过多，请稍后再试")
+
+// VerifyDeliveryConfirmCode 校验客户提供的收货确认码
+// 连续输错达到 delivery_confirm_code_max_attempts 次后锁定 delivery_confirm_code_lock_minutes 分钟，锁定期间返回 ErrDeliveryConfirmCodeLocked
+func VerifyDeliveryConfirmCode(orderID int, code string) (bool, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var stored sql.NullString
+	var attempts int
+	var lockedUntil sql.NullTime
+	if err := tx.QueryRow(`
+		SELECT delivery_confirm_code, delivery_confirm_attempts, delivery_confirm_locked_until
+		FROM orders WHERE id = ? FOR UPDATE
+	`, orderID).Scan(&stored, &attempts, &lockedUntil); err != nil {
+		return false, err
+	}
+	if lockedUntil.Valid && time.Now().Before(lockedUntil.Time) {
+		return false, ErrDeliveryConfirmCodeLocked
+	}
+
+	if stored.Valid && stored.String != "" && stored.String == strings.TrimSpace(code) {
+		if _, err := tx.Exec(`UPDATE orders SET delivery_confirm_attempts = 0, delivery_confirm_locked_until = NULL WHERE id = ?`, orderID); err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+
+	attempts++
+	maxAttempts := GetSystemSettingInt("delivery_confirm_code_max_attempts", 5)
+	var lockErr error
+	if maxAttempts > 0 && attempts >= maxAttempts {
+		lockMinutes := GetSystemSettingInt("delivery_confirm_code_lock_minutes", 30)
+		if _, err := tx.Exec(`
+			UPDATE orders SET delivery_confirm_attempts = 0, delivery_confirm_locked_until = DATE_ADD(NOW(), INTERVAL ? MINUTE) WHERE id = ?
+		`, lockMinutes, orderID); err != nil {
+			return false, err
+		}
+		lockErr = ErrDeliveryConfirmCodeLocked
+	} else if _, err := tx.Exec(`UPDATE orders SET delivery_confirm_attempts = ? WHERE id = ?`, attempts, orderID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return false, lockErr
+}
+
+// GetDeliveryProofByOrderID 获取订单配送记录中的送达校验结果
+func GetDeliveryProofByOrderID(orderID int) (*DeliveryProof, error) {
+	var proof DeliveryProof
+	var lat, lng, accuracy, distance sql.NullFloat64
+	err := database.DB.QueryRow(`
+		SELECT completion_latitude, completion_longitude, completion_accuracy, distance_to_address,
+		       geofence_status, confirm_code_verified, review_status
+		FROM delivery_records WHERE order_id = ?
+	`, orderID).Scan(&lat, &lng, &accuracy, &distance, &proof.GeofenceStatus, &proof.ConfirmCodeVerified, &proof.ReviewStatus)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	proof.Latitude = nullFloatPtr(lat)
+	proof.Longitude = nullFloatPtr(lng)
+	proof.Accuracy = nullFloatPtr(accuracy)
+	proof.DistanceToAddress = nullFloatPtr(distance)
+	proof.RadiusMeters = GetSystemSettingFloat("delivery_geofence_radius_meters", 300)
+	return &proof, nil
+}
+
+// SuspiciousDelivery 需审核的配送记录（超出围栏或无法判断送达位置）
+type SuspiciousDelivery struct {
+	RecordID             int           `json:"record_id"`
+	OrderID              int           `json:"order_id"`
+	OrderNumber          string        `json:"order_number"`
+	TotalAmount          float64       `json:"total_amount"`
+	DeliveryEmployeeCode string        `json:"delivery_employee_code"`
+	DeliveryEmployeeName string        `json:"delivery_employee_name"`
+	AddressName          string        `json:"address_name"`
+	Address              string        `json:"address"`
+	AddressLatitude      *float64      `json:"address_latitude"`
+	AddressLongitude     *float64      `json:"address_longitude"`
+	CompletedAt          time.Time     `json:"completed_at"`
+	ProductImageURL      *string       `json:"product_image_url"`
+	DoorplateImageURL    *string       `json:"doorplate_image_url"`
+	Proof                DeliveryProof `json:"proof"`
+	ReviewRemark         *string       `json:"review_remark"`
+	ReviewedBy           *string       `json:"reviewed_by"`
+	ReviewedAt           *time.Time    `json:"reviewed_at"`
+}
+
+// SuspiciousDeliveryFilter 可疑配送查询条件
+type SuspiciousDeliveryFilter struct {
+	ReviewStatus string // 为空时查询所有需审核过的记录（待审核、通过、不通过）
+	EmployeeCode string
+	StartTime    *time.Time
+	EndTime      *time.Time
+}
+
+// GetSuspiciousDeliveries 分页获取需审核的配送记录，按完成时间倒序
+func GetSuspiciousDeliveries(filter SuspiciousDeliveryFilter, pageNum, pageSize int) ([]SuspiciousDelivery, int, error) {
+	where := "dr.review_status <> ?"
+	args := []interface{}{DeliveryReviewNone}
+	if filter.ReviewStatus != "" {
+		where += " AND dr.review_status = ?"
+		args = append(args, filter.ReviewStatus)
+	}
+	if filter.EmployeeCode != "" {
+		where += " AND dr.delivery_employee_code = ?"
+		args = append(args, filter.EmployeeCode)
+	}
+	if filter.StartTime != nil {
+		where += " AND dr.completed_at >= ?"
+		args = append(args, *filter.StartTime)
+	}
+	if filter.EndTime != nil {
+		where += " AND dr.completed_at < ?"
+		args = append(args, *filter.EndTime)
+	}
+
+	var total int
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM delivery_records dr WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	radius := GetSystemSettingFloat("delivery_geofence_radius_meters", 300)
+	rows, err := database.DB.Query(`
+		SELECT dr.id, dr.order_id, o.order_number, o.total_amount, dr.delivery_employee_code, COALESCE(e.name, ''),
+		       COALESCE(a.name, ''), COALESCE(a.address, ''), a.latitude, a.longitude,
+		       dr.completed_at, dr.product_image_url, dr.doorplate_image_url,
+		       dr.completion_latitude, dr.completion_longitude, dr.completion_accuracy, dr.distance_to_address,
+		       dr.geofence_status, dr.confirm_code_verified, dr.review_status, dr.review_remark, dr.reviewed_by, dr.reviewed_at
+		FROM delivery_records dr
+		INNER JOIN orders o ON o.id = dr.order_id
+		LEFT JOIN employees e ON e.employee_code = dr.delivery_employee_code
+		LEFT JOIN mini_app_addresses a ON a.id = o.address_id
+		WHERE `+where+`
+		ORDER BY dr.completed_at DESC
+		LIMIT ? OFFSET ?
+	`, append(args, pageSize, (pageNum-1)*pageSize)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	list := make([]SuspiciousDelivery, 0)
+	for rows.Next() {
+		var d SuspiciousDelivery
+		var addrLat, addrLng, lat, lng, accuracy, distance sql.NullFloat64
+		var productImage, doorplateImage, remark, reviewedBy sql.NullString
+		var reviewedAt sql.NullTime
+		if err := rows.Scan(&d.RecordID, &d.OrderID, &d.OrderNumber, &d.TotalAmount, &d.DeliveryEmployeeCode, &d.DeliveryEmployeeName,
+			&d.AddressName, &d.Address, &addrLat, &addrLng,
+			&d.CompletedAt, &productImage, &doorplateImage,
+			&lat, &lng, &accuracy, &distance,
+			&d.Proof.GeofenceStatus, &d.Proof.ConfirmCodeVerified, &d.Proof.ReviewStatus, &remark, &reviewedBy, &reviewedAt); err != nil {
+			return nil, 0, err
+		}
+		d.AddressLatitude, d.AddressLongitude = nullFloatPtr(addrLat), nullFloatPtr(addrLng)
+		d.Proof.Latitude, d.Proof.Longitude = nullFloatPtr(lat), nullFloatPtr(lng)
+		d.Proof.Accuracy, d.Proof.DistanceToAddress = nullFloatPtr(accuracy), nullFloatPtr(distance)
+		d.Proof.RadiusMeters = radius
+		if productImage.Valid {
+			d.ProductImageURL = &productImage.String
+		}
+		if doorplateImage.Valid {
+			d.DoorplateImageURL = &doorplateImage.String
+		}
+		if remark.Valid {
+			d.ReviewRemark = &remark.String
+		}
+		if reviewedBy.Valid {
+			d.ReviewedBy = &reviewedBy.String
+		}
+		if reviewedAt.Valid {
+			d.ReviewedAt = &reviewedAt.Time
+		}
+		list = append(list, d)
+	}
+	return list, total, rows.Err()
+}
+
+// ReviewDeliveryRecord 审核待审核的配送记录
+func ReviewDeliveryRecord(recordID int, approved bool, operator, remark string) error {
+	status := DeliveryReviewRejected
+	if approved {
+		status = DeliveryReviewApproved
+	}
+	result, err := database.DB.Exec(`
+		UPDATE delivery_records
+		SET review_status = ?, review_remark = ?, reviewed_by = ?, reviewed_at = NOW(), updated_at = NOW()
+		WHERE id = ? AND review_status = ?
+	`, status, remark, operator, recordID, DeliveryReviewPending)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrDeliveryReviewNotPending
+	}
+	return nil
+}
@@ -20,6 +20,22 @@ type DeliveryRouteOrder struct {
 	UpdatedAt            string   `json:"updated_at"`
 }
 
+// DeliveryRouteStop 配送路线停靠点（含供应商取货点和客户送货点）
+type DeliveryRouteStop struct {
+	ID                   int        `json:"id"`
+	DeliveryEmployeeCode string     `json:"delivery_employee_code"`
+	BatchID              string     `json:"batch_id"`
+	StopSequence         int        `json:"stop_sequence"`
+	StopType             string     `json:"stop_type"`             // pickup-取货, delivery-送货
+	OrderID              *int       `json:"order_id,omitempty"`    // 送货点对应订单
+	SupplierID           *int       `json:"supplier_id,omitempty"` // 取货点对应供应商
+	Latitude             float64    `json:"latitude"`
+	Longitude            float64    `json:"longitude"`
+	DistanceFromPrev     float64    `json:"distance_from_prev"`  // 距上一个停靠点（公里）
+	CumulativeDistance   float64    `json:"cumulative_distance"` // 从出发点累计距离（公里）
+	ETA                  *time.Time `json:"eta"`                 // 规划时预计到达时间
+}
+
 // UpdateRouteSequence 更新或插入配送员的订单排序（使用批次ID）
 func UpdateRouteSequence(employeeCode string, batchID string, orderSequences []struct {
 	OrderID  int
@@ -339,3 +355,81 @@ func GetOrderIDsByEmployee(employeeCode string) ([]int, error) {
 
 	return orderIDs, nil
 }
+
+// SaveRouteStops 保存配送员某批次的取送货停靠点（整体替换）
+func SaveRouteStops(employeeCode string, batchID string, stops []DeliveryRouteStop) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("开始事务失败: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`
+		DELETE FROM delivery_route_stops
+		WHERE delivery_employee_code = ? AND batch_id = ?
+	`, employeeCode, batchID); err != nil {
+		return fmt.Errorf("删除旧停靠点记录失败: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO delivery_route_stops
+		(delivery_employee_code, batch_id, stop_sequence, stop_type, order_id, supplier_id,
+		 latitude, longitude, distance_from_prev, cumulative_distance, eta)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("准备插入语句失败: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, stop := range stops {
+		if _, err = stmt.Exec(employeeCode, batchID, stop.StopSequence, stop.StopType, stop.OrderID, stop.SupplierID,
+			stop.Latitude, stop.Longitude, stop.DistanceFromPrev, stop.CumulativeDistance, stop.ETA); err != nil {
+			return fmt.Errorf("插入停靠点记录失败: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %w", err)
+	}
+	return nil
+}
+
+// GetRouteStops 获取配送员某批次的取送货停靠点（按停靠顺序）
+func GetRouteStops(employeeCode string, batchID string) ([]DeliveryRouteStop, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, delivery_employee_code, batch_id, stop_sequence, stop_type, order_id, supplier_id,
+		       latitude, longitude, distance_from_prev, cumulative_distance, eta
+		FROM delivery_route_stops
+		WHERE delivery_employee_code = ? AND batch_id = ?
+		ORDER BY stop_sequence ASC
+	`, employeeCode, batchID)
+	if err != nil {
+		return nil, fmt.Errorf("查询停靠点失败: %w", err)
+	}
+	defer rows.Close()
+
+	stops := make([]DeliveryRouteStop, 0)
+	for rows.Next() {
+		var stop DeliveryRouteStop
+		var orderID, supplierID sql.NullInt64
+		var eta sql.NullTime
+		if err := rows.Scan(&stop.ID, &stop.DeliveryEmployeeCode, &stop.BatchID, &stop.StopSequence, &stop.StopType,
+			&orderID, &supplierID, &stop.Latitude, &stop.Longitude, &stop.DistanceFromPrev, &stop.CumulativeDistance, &eta); err != nil {
+			return nil, fmt.Errorf("扫描停靠点失败: %w", err)
+		}
+		if orderID.Valid {
+			id := int(orderID.Int64)
+			stop.OrderID = &id
+		}
+		if supplierID.Valid {
+			id := int(supplierID.Int64)
+			stop.SupplierID = &id
+		}
+		if eta.Valid {
+			stop.ETA = &eta.Time
+		}
+		stops = append(stops, stop)
+	}
+	return stops, rows.Err()
+}
@@ -0,0 +1,551 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// ErrDeliverySlotFull 配送时段已约满
+var ErrDeliverySlotFull = errors.New("所选配送时段已约满，请选择其他时段")
+
+// DeliverySlot 配送时段（管理后台配置）
+type DeliverySlot struct {
+	ID            int       `json:"id"`
+	Name          string    `json:"name"`           // 时段名称，如「上午」
+	Weekdays      []int     `json:"weekdays"`       // 适用星期（0=周日 ... 6=周六），为空表示每天
+	StartTime     string    `json:"start_time"`     // 开始时间 HH:MM
+	EndTime       string    `json:"end_time"`       // 结束时间 HH:MM
+	CutoffMinutes int       `json:"cutoff_minutes"` // 截单时间：时段开始前多少分钟停止预约
+	MaxOrders     int       `json:"max_orders"`     // 每个时段最多订单数，0 表示不限
+	MaxUnits      int       `json:"max_units"`      // 每个时段最多配送件数（按规格配送计件数累计），0 表示不限
+	ZoneIDs       []int     `json:"zone_ids"`       // 适用配送区域ID（按收货地址所在区域匹配），为空表示不限区域
+	IsActive      bool      `json:"is_active"`
+	Sort          int       `json:"sort"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// DeliverySlotSelection 下单时选择的配送时段
+type DeliverySlotSelection struct {
+	SlotID int    `json:"slot_id"`
+	Date   string `json:"date"` // 配送日期 YYYY-MM-DD
+}
+
+// DeliverySlotOption 某一天的可选配送时段
+type DeliverySlotOption struct {
+	SlotID          int       `json:"slot_id"`
+	Name            string    `json:"name"`
+	Date            string    `json:"date"`
+	StartAt         time.Time `json:"start_at"`
+	EndAt           time.Time `json:"end_at"`
+	CutoffAt        time.Time `json:"cutoff_at"`
+	OrderCount      int       `json:"order_count"`
+	UnitCount       float64   `json:"unit_count"`
+	RemainingOrders *int      `json:"remaining_orders,omitempty"` // 为空表示不限
+	RemainingUnits  *float64  `json:"remaining_units,omitempty"`  // 为空表示不限
+	Available       bool      `json:"available"`
+	Reason          string    `json:"reason,omitempty"`
+}
+
+// DeliverySlotUsage 时段预约情况（管理后台）
+type DeliverySlotUsage struct {
+	DeliverySlotOption
+	MaxOrders int `json:"max_orders"`
+	MaxUnits  int `json:"max_units"`
+}
+
+// IsDeliverySlotRequired 下单是否必须选择配送时段（系统设置）
+func IsDeliverySlotRequired() bool {
+	return GetSystemSettingInt("delivery_slot_required", 0) == 1
+}
+
+// deliverySlotBookingDays 可预约天数（含今天）
+func deliverySlotBookingDays() int {
+	days := GetSystemSettingInt("delivery_slot_days", 3)
+	if days <= 0 {
+		days = 1
+	}
+	return days
+}
+
+// ListDeliverySlots 获取配送时段列表
+func ListDeliverySlots(activeOnly bool) ([]DeliverySlot, error) {
+	query := `
+		SELECT id, name, weekdays, start_time, end_time, cutoff_minutes, max_orders, max_units, zone_ids, is_active, sort, created_at, updated_at
+		FROM delivery_slots`
+	if activeOnly {
+		query += ` WHERE is_active = 1`
+	}
+	query += ` ORDER BY sort ASC, start_time ASC, id ASC`
+	rows, err := database.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	slots := make([]DeliverySlot, 0)
+	for rows.Next() {
+		s, err := scanDeliverySlot(rows)
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, *s)
+	}
+	return slots, rows.Err()
+}
+
+// GetDeliverySlotByID 获取配送时段，不存在返回 nil
+func GetDeliverySlotByID(id int) (*DeliverySlot, error) {
+	row := database.DB.QueryRow(`
+		SELECT id, name, weekdays, start_time, end_time, cutoff_minutes, max_orders, max_units, zone_ids, is_active, sort, created_at, updated_at
+		FROM delivery_slots WHERE id = ?
+	`, id)
+	s, err := scanDeliverySlot(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return s, err
+}
+
+type deliverySlotScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDeliverySlot(row deliverySlotScanner) (*DeliverySlot, error) {
+	var s DeliverySlot
+	var weekdays, zoneIDs string
+	var isActive int
+	if err := row.Scan(&s.ID, &s.Name, &weekdays, &s.StartTime, &s.EndTime, &s.CutoffMinutes, &s.MaxOrders, &s.MaxUnits,
+		&zoneIDs, &isActive, &s.Sort, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		return nil, err
+	}
+	s.StartTime = trimClockSeconds(s.StartTime)
+	s.EndTime = trimClockSeconds(s.EndTime)
+	s.IsActive = isActive == 1
+	s.Weekdays = make([]int, 0)
+	for _, part := range strings.Split(weekdays, ",") {
+		if d, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			s.Weekdays = append(s.Weekdays, d)
+		}
+	}
+	s.ZoneIDs = splitZoneIDs(zoneIDs)
+	return &s, nil
+}
+
+// CreateDeliverySlot 创建配送时段
+func CreateDeliverySlot(s *DeliverySlot) error {
+	if err := normalizeDeliverySlot(s); err != nil {
+		return err
+	}
+	res, err := database.DB.Exec(`
+		INSERT INTO delivery_slots (name, weekdays, start_time, end_time, cutoff_minutes, max_orders, max_units, zone_ids, is_active, sort, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())
+	`, s.Name, joinWeekdays(s.Weekdays), s.StartTime, s.EndTime, s.CutoffMinutes, s.MaxOrders, s.MaxUnits,
+		joinZoneIDs(s.ZoneIDs), boolToTinyInt(s.IsActive), s.Sort)
+	if err != nil {
+		return err
+	}
+	id, _ := res.LastInsertId()
+	s.ID = int(id)
+	return nil
+}
+
+// UpdateDeliverySlot 更新配送时段（已预约的订单保留下单时的时段时间）
+func UpdateDeliverySlot(s *DeliverySlot) error {
+	if err := normalizeDeliverySlot(s); err != nil {
+		return err
+	}
+	res, err := database.DB.Exec(`
+		UPDATE delivery_slots
+		SET name = ?, weekdays = ?, start_time = ?, end_time = ?, cutoff_minutes = ?, max_orders = ?, max_units = ?,
+		    zone_ids = ?, is_active = ?, sort = ?, updated_at = NOW()
+		WHERE id = ?
+	`, s.Name, joinWeekdays(s.Weekdays), s.StartTime, s.EndTime, s.CutoffMinutes, s.MaxOrders, s.MaxUnits,
+		joinZoneIDs(s.ZoneIDs), boolToTinyInt(s.IsActive), s.Sort, s.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if existing, err := GetDeliverySlotByID(s.ID); err == nil && existing == nil {
+			return fmt.Errorf("配送时段不存在")
+		}
+	}
+	return nil
+}
+
+// DeleteDeliverySlot 删除配送时段
+func DeleteDeliverySlot(id int) error {
+	_, err := database.DB.Exec(`DELETE FROM delivery_slots WHERE id = ?`, id)
+	return err
+}
+
+func normalizeDeliverySlot(s *DeliverySlot) error {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return fmt.Errorf("请填写时段名称")
+	}
+	start, err := parseClock(s.StartTime)
+	if err != nil {
+		return fmt.Errorf("开始时间格式不正确，应为 HH:MM")
+	}
+	end, err := parseClock(s.EndTime)
+	if err != nil {
+		return fmt.Errorf("结束时间格式不正确，应为 HH:MM")
+	}
+	if end <= start {
+		return fmt.Errorf("结束时间必须晚于开始时间")
+	}
+	s.StartTime = formatClock(start)
+	s.EndTime = formatClock(end)
+	for _, d := range s.Weekdays {
+		if d < 0 || d > 6 {
+			return fmt.Errorf("星期取值应为 0-6（0 为周日）")
+		}
+	}
+	if s.CutoffMinutes < 0 || s.MaxOrders < 0 || s.MaxUnits < 0 {
+		return fmt.Errorf("截单时间和容量不能为负数")
+	}
+	for _, zoneID := range s.ZoneIDs {
+		zone, err := GetDeliveryZoneByID(zoneID)
+		if err != nil {
+			return fmt.Errorf("查询配送区域失败: %v", err)
+		}
+		if zone == nil {
+			return fmt.Errorf("配送区域 %d 不存在", zoneID)
+		}
+	}
+	s.ZoneIDs = splitZoneIDs(joinZoneIDs(s.ZoneIDs))
+	return nil
+}
+
+// GetAvailableDeliverySlots 获取收货地址可预约的配送时段（从今天起若干天），units 为本单配送件数
+func GetAvailableDeliverySlots(address *Address, units float64) ([]DeliverySlotOption, error) {
+	slots, err := ListDeliverySlots(true)
+	if err != nil {
+		return nil, err
+	}
+	zoneID, err := deliverySlotZoneID(address)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	options := make([]DeliverySlotOption, 0)
+	for i := 0; i < deliverySlotBookingDays(); i++ {
+		day := today.AddDate(0, 0, i)
+		for j := range slots {
+			slot := &slots[j]
+			if !slot.appliesOn(day) || !slot.appliesToZone(zoneID) {
+				continue
+			}
+			opt, err := buildDeliverySlotOption(database.DB, slot, day, units, now)
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, *opt)
+		}
+	}
+	return options, nil
+}
+
+// ValidateDeliverySlotSelection 下单前校验所选配送时段；未选择且不要求选择时返回 nil
+func ValidateDeliverySlotSelection(sel *DeliverySlotSelection, address *Address, units float64) (*DeliverySlotOption, error) {
+	if sel == nil || sel.SlotID <= 0 {
+		if IsDeliverySlotRequired() {
+			return nil, fmt.Errorf("请选择配送时段")
+		}
+		return nil, nil
+	}
+	slot, err := GetDeliverySlotByID(sel.SlotID)
+	if err != nil {
+		return nil, err
+	}
+	if slot == nil || !slot.IsActive {
+		return nil, fmt.Errorf("配送时段不存在或已停用")
+	}
+	day, err := time.ParseInLocation("2006-01-02", sel.Date, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("配送日期格式不正确")
+	}
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if day.Before(today) || !day.Before(today.AddDate(0, 0, deliverySlotBookingDays())) {
+		return nil, fmt.Errorf("配送日期不在可预约范围内")
+	}
+	if !slot.appliesOn(day) {
+		return nil, fmt.Errorf("所选日期没有该配送时段")
+	}
+	zoneID, err := deliverySlotZoneID(address)
+	if err != nil {
+		return nil, err
+	}
+	if !slot.appliesToZone(zoneID) {
+		return nil, fmt.Errorf("收货地址不在该配送时段的服务区域内")
+	}
+	opt, err := buildDeliverySlotOption(database.DB, slot, day, units, now)
+	if err != nil {
+		return nil, err
+	}
+	if !opt.Available {
+		return nil, errors.New(opt.Reason)
+	}
+	return opt, nil
+}
+
+// ReserveDeliverySlotInTx 在下单事务内占用配送时段容量并记录到订单
+// strict 为 false 时（已付款订单）时段已满或已停用也照常记录，不让订单创建失败
+func ReserveDeliverySlotInTx(tx *sql.Tx, orderID int, sel *DeliverySlotSelection, units float64, strict bool) error {
+	if sel == nil || sel.SlotID <= 0 {
+		return nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", sel.Date, time.Local)
+	if err != nil {
+		return fmt.Errorf("配送日期格式不正确")
+	}
+
+	// 锁定时段，串行化同一时段的并发预约
+	slot, err := scanDeliverySlot(tx.QueryRow(`
+		SELECT id, name, weekdays, start_time, end_time, cutoff_minutes, max_orders, max_units, zone_ids, is_active, sort, created_at, updated_at
+		FROM delivery_slots WHERE id = ? FOR UPDATE
+	`, sel.SlotID))
+	if err == sql.ErrNoRows {
+		if strict {
+			return fmt.Errorf("配送时段不存在或已停用")
+		}
+		log.Printf("[DeliverySlot] 订单 %d 选择的配送时段 %d 已删除，不记录时段", orderID, sel.SlotID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("查询配送时段失败: %v", err)
+	}
+
+	opt, err := buildDeliverySlotOption(tx, slot, day, units, time.Now())
+	if err != nil {
+		return err
+	}
+	if !opt.Available {
+		if strict {
+			if slot.isFull(opt, units) {
+				return ErrDeliverySlotFull
+			}
+			return errors.New(opt.Reason)
+		}
+		log.Printf("[DeliverySlot] 订单 %d 已付款，配送时段 %s %s 不可预约（%s），仍按所选时段记录", orderID, sel.Date, slot.Name, opt.Reason)
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE orders
+		SET delivery_slot_id = ?, delivery_slot_start = ?, delivery_slot_end = ?, delivery_units = ?, expected_delivery_at = ?
+		WHERE id = ?
+	`, slot.ID, opt.StartAt, opt.EndAt, units, opt.EndAt, orderID); err != nil {
+		return fmt.Errorf("记录订单配送时段失败: %v", err)
+	}
+	return nil
+}
+
+// GetDeliverySlotUsage 查询指定日期各时段的预约情况（管理后台）
+func GetDeliverySlotUsage(date string) ([]DeliverySlotUsage, error) {
+	day, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("日期格式不正确")
+	}
+	slots, err := ListDeliverySlots(false)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	list := make([]DeliverySlotUsage, 0, len(slots))
+	for i := range slots {
+		if !slots[i].appliesOn(day) {
+			continue
+		}
+		opt, err := buildDeliverySlotOption(database.DB, &slots[i], day, 0, now)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, DeliverySlotUsage{DeliverySlotOption: *opt, MaxOrders: slots[i].MaxOrders, MaxUnits: slots[i].MaxUnits})
+	}
+	return list, nil
+}
+
+type deliverySlotQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// buildDeliverySlotOption 计算时段在某天的时间、已预约量和是否可预约
+func buildDeliverySlotOption(db deliverySlotQueryer, slot *DeliverySlot, day time.Time, units float64, now time.Time) (*DeliverySlotOption, error) {
+	start, _ := parseClock(slot.StartTime)
+	end, _ := parseClock(slot.EndTime)
+	opt := &DeliverySlotOption{
+		SlotID:  slot.ID,
+		Name:    slot.Name,
+		Date:    day.Format("2006-01-02"),
+		StartAt: day.Add(start),
+		EndAt:   day.Add(end),
+	}
+	opt.CutoffAt = opt.StartAt.Add(-time.Duration(slot.CutoffMinutes) * time.Minute)
+
+	if err := db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(delivery_units), 0) FROM orders
+		WHERE delivery_slot_id = ? AND delivery_slot_start = ? AND status <> ?
+	`, slot.ID, opt.StartAt, OrderStatusCancelled).Scan(&opt.OrderCount, &opt.UnitCount); err != nil {
+		return nil, fmt.Errorf("统计配送时段预约量失败: %v", err)
+	}
+	if slot.MaxOrders > 0 {
+		remaining := slot.MaxOrders - opt.OrderCount
+		if remaining < 0 {
+			remaining = 0
+		}
+		opt.RemainingOrders = &remaining
+	}
+	if slot.MaxUnits > 0 {
+		remaining := float64(slot.MaxUnits) - opt.UnitCount
+		if remaining < 0 {
+			remaining = 0
+		}
+		opt.RemainingUnits = &remaining
+	}
+
+	switch {
+	case !slot.IsActive:
+		opt.Reason = "该时段已停用"
+	case !now.Before(opt.CutoffAt):
+		opt.Reason = "该时段已截单"
+	case slot.isFull(opt, units):
+		opt.Reason = ErrDeliverySlotFull.Error()
+	default:
+		opt.Available = true
+	}
+	return opt, nil
+}
+
+// isFull 加上本单后是否超过时段容量
+func (s *DeliverySlot) isFull(opt *DeliverySlotOption, units float64) bool {
+	if s.MaxOrders > 0 && opt.OrderCount+1 > s.MaxOrders {
+		return true
+	}
+	if s.MaxUnits > 0 && opt.UnitCount+units > float64(s.MaxUnits) {
+		return true
+	}
+	return false
+}
+
+func (s *DeliverySlot) appliesOn(day time.Time) bool {
+	if len(s.Weekdays) == 0 {
+		return true
+	}
+	for _, d := range s.Weekdays {
+		if d == int(day.Weekday()) {
+			return true
+		}
+	}
+	return false
+}
+
+// appliesToZone 时段是否服务该配送区域，zoneID 为 0 表示地址不在任何区域内（或无法定位）
+func (s *DeliverySlot) appliesToZone(zoneID int) bool {
+	if len(s.ZoneIDs) == 0 {
+		return true
+	}
+	for _, id := range s.ZoneIDs {
+		if id == zoneID {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverySlotZoneID 收货地址所在的配送区域ID，不在任何区域内或没有经纬度时为 0
+func deliverySlotZoneID(address *Address) (int, error) {
+	zone, err := FindDeliveryZoneForAddress(address)
+	if err != nil {
+		return 0, fmt.Errorf("查询收货地址所在配送区域失败: %v", err)
+	}
+	if zone == nil {
+		return 0, nil
+	}
+	return zone.ID, nil
+}
+
+// parseClock 解析 HH:MM 或 HH:MM:SS，返回距当天零点的时长
+func parseClock(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	layout := "15:04"
+	if strings.Count(v, ":") == 2 {
+		layout = "15:04:05"
+	}
+	t, err := time.Parse(layout, v)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func formatClock(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+func trimClockSeconds(v string) string {
+	if d, err := parseClock(v); err == nil {
+		return formatClock(d)
+	}
+	return v
+}
+
+func joinWeekdays(days []int) string {
+	sorted := append([]int(nil), days...)
+	sort.Ints(sorted)
+	parts := make([]string, 0, len(sorted))
+	for i, d := range sorted {
+		if i > 0 && d == sorted[i-1] {
+			continue
+		}
+		parts = append(parts, strconv.Itoa(d))
+	}
+	return strings.Join(parts, ",")
+}
+
+// splitZoneIDs 解析逗号分隔的配送区域ID，忽略无效值和重复值
+func splitZoneIDs(v string) []int {
+	ids := make([]int, 0)
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(v, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || id <= 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func joinZoneIDs(ids []int) string {
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, strconv.Itoa(id))
+	}
+	return strings.Join(parts, ",")
+}
+
+// TotalDeliveryUnits 采购单配送件数（规格配送计件数 × 数量，作为配送时段的容量单位）
+// 与配送员件数补贴的计件口径一致，计件数未设置时按 1 计
+func TotalDeliveryUnits(items []PurchaseListItem) float64 {
+	total := 0.0
+	for _, it := range items {
+		deliveryCount := it.SpecSnapshot.DeliveryCount
+		if deliveryCount <= 0 {
+			deliveryCount = 1.0
+		}
+		total += deliveryCount * float64(it.Quantity)
+	}
+	return total
+}
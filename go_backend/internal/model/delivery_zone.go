@@ -0,0 +1,396 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// ErrAddressNotServiceable 地址不在配送范围内
+var ErrAddressNotServiceable = errors.New("该地址不在配送范围内，暂不支持配送")
+
+// DeliveryZone 配送区域（多边形）
+// 坐标与地址经纬度一致，使用高德（GCJ-02）坐标系，点的格式为 [经度, 纬度]
+type DeliveryZone struct {
+	ID                    int             `json:"id"`
+	Name                  string          `json:"name"`
+	Polygons              [][][][]float64 `json:"polygons"`                // 多边形列表（同 GeoJSON MultiPolygon），每个多边形第一个环为外边界，其余为挖空区域
+	BaseFee               *float64        `json:"base_fee"`                // 区域基础配送费，为空使用全局配送费设置
+	FreeShippingThreshold *float64        `json:"free_shipping_threshold"` // 区域免配送费门槛，为空使用全局配送费设置
+	RiderBaseFee          *float64        `json:"rider_base_fee"`          // 配送员基础配送费，为空使用系统设置 delivery_base_fee
+	RiderIsolatedSubsidy  *float64        `json:"rider_isolated_subsidy"`  // 配送员孤立订单补贴，为空使用系统设置 delivery_isolated_subsidy
+	Priority              int             `json:"priority"`                // 区域重叠时优先级高的生效
+	IsActive              bool            `json:"is_active"`
+	Remark                string          `json:"remark"`
+	CreatedAt             time.Time       `json:"created_at"`
+	UpdatedAt             time.Time       `json:"updated_at"`
+}
+
+// DeliveryZoneBrief 配送区域简要信息（地址解析、配送费汇总中返回）
+type DeliveryZoneBrief struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Brief 返回区域简要信息
+func (z *DeliveryZone) Brief() *DeliveryZoneBrief {
+	if z == nil {
+		return nil
+	}
+	return &DeliveryZoneBrief{ID: z.ID, Name: z.Name}
+}
+
+const deliveryZoneColumns = `id, name, polygons, base_fee, free_shipping_threshold, rider_base_fee, rider_isolated_subsidy, priority, is_active, remark, created_at, updated_at`
+
+// ListDeliveryZones 获取配送区域列表（按优先级从高到低）
+func ListDeliveryZones(activeOnly bool) ([]DeliveryZone, error) {
+	query := `SELECT ` + deliveryZoneColumns + ` FROM delivery_zones`
+	if activeOnly {
+		query += ` WHERE is_active = 1`
+	}
+	query += ` ORDER BY priority DESC, id ASC`
+	rows, err := database.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zones := make([]DeliveryZone, 0)
+	for rows.Next() {
+		z, err := scanDeliveryZone(rows)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, *z)
+	}
+	return zones, rows.Err()
+}
+
+// GetDeliveryZoneByID 获取配送区域，不存在返回 nil
+func GetDeliveryZoneByID(id int) (*DeliveryZone, error) {
+	z, err := scanDeliveryZone(database.DB.QueryRow(`SELECT `+deliveryZoneColumns+` FROM delivery_zones WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return z, err
+}
+
+type deliveryZoneScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDeliveryZone(row deliveryZoneScanner) (*DeliveryZone, error) {
+	var z DeliveryZone
+	var polygons string
+	var baseFee, threshold, riderBaseFee, riderIsolated sql.NullFloat64
+	var isActive int
+	var remark sql.NullString
+	if err := row.Scan(&z.ID, &z.Name, &polygons, &baseFee, &threshold, &riderBaseFee, &riderIsolated,
+		&z.Priority, &isActive, &remark, &z.CreatedAt, &z.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(polygons), &z.Polygons); err != nil {
+		return nil, fmt.Errorf("配送区域 %d 多边形数据损坏: %v", z.ID, err)
+	}
+	z.BaseFee = nullFloatPtr(baseFee)
+	z.FreeShippingThreshold = nullFloatPtr(threshold)
+	z.RiderBaseFee = nullFloatPtr(riderBaseFee)
+	z.RiderIsolatedSubsidy = nullFloatPtr(riderIsolated)
+	z.IsActive = isActive == 1
+	z.Remark = remark.String
+	return &z, nil
+}
+
+func nullFloatPtr(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	f := v.Float64
+	return &f
+}
+
+// CreateDeliveryZone 创建配送区域
+func CreateDeliveryZone(z *DeliveryZone) error {
+	return insertDeliveryZone(database.DB, z)
+}
+
+type deliveryZoneExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertDeliveryZone(db deliveryZoneExecer, z *DeliveryZone) error {
+	polygons, err := normalizeDeliveryZone(z)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec(`
+		INSERT INTO delivery_zones (name, polygons, base_fee, free_shipping_threshold, rider_base_fee, rider_isolated_subsidy, priority, is_active, remark, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())
+	`, z.Name, polygons, z.BaseFee, z.FreeShippingThreshold, z.RiderBaseFee, z.RiderIsolatedSubsidy, z.Priority, boolToTinyInt(z.IsActive), z.Remark)
+	if err != nil {
+		return err
+	}
+	id, _ := res.LastInsertId()
+	z.ID = int(id)
+	return nil
+}
+
+// UpdateDeliveryZone 更新配送区域
+func UpdateDeliveryZone(z *DeliveryZone) error {
+	polygons, err := normalizeDeliveryZone(z)
+	if err != nil {
+		return err
+	}
+	res, err := database.DB.Exec(`
+		UPDATE delivery_zones
+		SET name = ?, polygons = ?, base_fee = ?, free_shipping_threshold = ?, rider_base_fee = ?, rider_isolated_subsidy = ?,
+		    priority = ?, is_active = ?, remark = ?, updated_at = NOW()
+		WHERE id = ?
+	`, z.Name, polygons, z.BaseFee, z.FreeShippingThreshold, z.RiderBaseFee, z.RiderIsolatedSubsidy, z.Priority, boolToTinyInt(z.IsActive), z.Remark, z.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if existing, err := GetDeliveryZoneByID(z.ID); err == nil && existing == nil {
+			return fmt.Errorf("配送区域不存在")
+		}
+	}
+	return nil
+}
+
+// DeleteDeliveryZone 删除配送区域
+func DeleteDeliveryZone(id int) error {
+	_, err := database.DB.Exec(`DELETE FROM delivery_zones WHERE id = ?`, id)
+	return err
+}
+
+// ImportDeliveryZonesFromGeoJSON 从 GeoJSON（FeatureCollection / Feature / Polygon / MultiPolygon）导入配送区域
+// Feature 的 properties 可包含 name、base_fee、free_shipping_threshold、rider_base_fee、rider_isolated_subsidy、priority
+// replace 为 true 时先删除全部已有区域
+func ImportDeliveryZonesFromGeoJSON(raw []byte, replace bool) ([]DeliveryZone, error) {
+	zones, err := ParseDeliveryZonesGeoJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if replace {
+		if _, err := tx.Exec(`DELETE FROM delivery_zones`); err != nil {
+			return nil, fmt.Errorf("删除已有配送区域失败: %v", err)
+		}
+	}
+	for i := range zones {
+		if err := insertDeliveryZone(tx, &zones[i]); err != nil {
+			return nil, fmt.Errorf("导入第 %d 个区域（%s）失败: %v", i+1, zones[i].Name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return zones, nil
+}
+
+type geoJSONObject struct {
+	Type        string                 `json:"type"`
+	Features    []geoJSONObject        `json:"features"`
+	Geometry    *geoJSONObject         `json:"geometry"`
+	Properties  map[string]interface{} `json:"properties"`
+	Coordinates json.RawMessage        `json:"coordinates"`
+}
+
+// ParseDeliveryZonesGeoJSON 解析 GeoJSON 为配送区域（不落库），未命名区域按序号命名
+func ParseDeliveryZonesGeoJSON(raw []byte) ([]DeliveryZone, error) {
+	var obj geoJSONObject
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, fmt.Errorf("GeoJSON 格式错误: %v", err)
+	}
+
+	var features []geoJSONObject
+	switch obj.Type {
+	case "FeatureCollection":
+		features = obj.Features
+	case "Feature":
+		features = []geoJSONObject{obj}
+	case "Polygon", "MultiPolygon":
+		features = []geoJSONObject{{Type: "Feature", Geometry: &obj}}
+	default:
+		return nil, fmt.Errorf("不支持的 GeoJSON 类型: %s", obj.Type)
+	}
+	if len(features) == 0 {
+		return nil, fmt.Errorf("GeoJSON 中没有区域")
+	}
+
+	zones := make([]DeliveryZone, 0, len(features))
+	for i, f := range features {
+		if f.Geometry == nil {
+			return nil, fmt.Errorf("第 %d 个区域缺少 geometry", i+1)
+		}
+		var polygons [][][][]float64
+		switch f.Geometry.Type {
+		case "Polygon":
+			var polygon [][][]float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &polygon); err != nil {
+				return nil, fmt.Errorf("第 %d 个区域坐标格式错误: %v", i+1, err)
+			}
+			polygons = [][][][]float64{polygon}
+		case "MultiPolygon":
+			if err := json.Unmarshal(f.Geometry.Coordinates, &polygons); err != nil {
+				return nil, fmt.Errorf("第 %d 个区域坐标格式错误: %v", i+1, err)
+			}
+		default:
+			return nil, fmt.Errorf("第 %d 个区域不是多边形（%s）", i+1, f.Geometry.Type)
+		}
+
+		z := DeliveryZone{Polygons: polygons, IsActive: true}
+		if name, ok := f.Properties["name"].(string); ok {
+			z.Name = strings.TrimSpace(name)
+		}
+		if z.Name == "" {
+			z.Name = fmt.Sprintf("配送区域%d", i+1)
+		}
+		z.BaseFee = geoJSONFloatProperty(f.Properties, "base_fee")
+		z.FreeShippingThreshold = geoJSONFloatProperty(f.Properties, "free_shipping_threshold")
+		z.RiderBaseFee = geoJSONFloatProperty(f.Properties, "rider_base_fee")
+		z.RiderIsolatedSubsidy = geoJSONFloatProperty(f.Properties, "rider_isolated_subsidy")
+		if p := geoJSONFloatProperty(f.Properties, "priority"); p != nil {
+			z.Priority = int(*p)
+		}
+		if _, err := normalizeDeliveryZone(&z); err != nil {
+			return nil, fmt.Errorf("第 %d 个区域（%s）: %v", i+1, z.Name, err)
+		}
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+func geoJSONFloatProperty(props map[string]interface{}, key string) *float64 {
+	if v, ok := props[key].(float64); ok {
+		return &v
+	}
+	return nil
+}
+
+// normalizeDeliveryZone 校验区域数据，去掉坐标中的高度值，返回多边形 JSON
+func normalizeDeliveryZone(z *DeliveryZone) (string, error) {
+	z.Name = strings.TrimSpace(z.Name)
+	if z.Name == "" {
+		return "", fmt.Errorf("请填写区域名称")
+	}
+	if len(z.Polygons) == 0 {
+		return "", fmt.Errorf("请设置区域范围")
+	}
+	for _, fee := range []*float64{z.BaseFee, z.FreeShippingThreshold, z.RiderBaseFee, z.RiderIsolatedSubsidy} {
+		if fee != nil && *fee < 0 {
+			return "", fmt.Errorf("费用不能为负数")
+		}
+	}
+	for pi, polygon := range z.Polygons {
+		if len(polygon) == 0 {
+			return "", fmt.Errorf("第 %d 个多边形为空", pi+1)
+		}
+		for ri, ring := range polygon {
+			if len(ring) < 3 {
+				return "", fmt.Errorf("第 %d 个多边形的第 %d 个环至少需要 3 个点", pi+1, ri+1)
+			}
+			for _, pt := range ring {
+				if len(pt) < 2 {
+					return "", fmt.Errorf("坐标点格式错误，应为 [经度, 纬度]")
+				}
+				if pt[0] < -180 || pt[0] > 180 || pt[1] < -90 || pt[1] > 90 {
+					return "", fmt.Errorf("坐标超出范围: [%v, %v]", pt[0], pt[1])
+				}
+			}
+			for i := range ring {
+				ring[i] = ring[i][:2]
+			}
+		}
+	}
+	data, err := json.Marshal(z.Polygons)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Contains 判断坐标点是否在区域内
+func (z *DeliveryZone) Contains(lat, lng float64) bool {
+	for _, polygon := range z.Polygons {
+		if len(polygon) == 0 || !ringContains(polygon[0], lng, lat) {
+			continue
+		}
+		inHole := false
+		for _, hole := range polygon[1:] {
+			if ringContains(hole, lng, lat) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// ringContains 射线法判断点是否在闭合环内（x 为经度，y 为纬度）
+func ringContains(ring [][]float64, x, y float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// FindDeliveryZone 查找坐标所在的启用配送区域，不在任何区域内返回 nil
+func FindDeliveryZone(lat, lng float64) (*DeliveryZone, error) {
+	zones, err := ListDeliveryZones(true)
+	if err != nil {
+		return nil, err
+	}
+	for i := range zones {
+		if zones[i].Contains(lat, lng) {
+			return &zones[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// FindDeliveryZoneForAddress 查找地址所在配送区域，地址没有经纬度时返回 nil
+func FindDeliveryZoneForAddress(address *Address) (*DeliveryZone, error) {
+	if address == nil || address.Latitude == nil || address.Longitude == nil {
+		return nil, nil
+	}
+	return FindDeliveryZone(*address.Latitude, *address.Longitude)
+}
+
+// CheckLocationServiceable 校验坐标是否在配送范围内，返回所在区域
+// 未配置任何启用区域或没有经纬度（无法判断）时视为可配送，区域为 nil
+func CheckLocationServiceable(lat, lng *float64) (*DeliveryZone, error) {
+	zones, err := ListDeliveryZones(true)
+	if err != nil {
+		return nil, err
+	}
+	if len(zones) == 0 || lat == nil || lng == nil {
+		return nil, nil
+	}
+	for i := range zones {
+		if zones[i].Contains(*lat, *lng) {
+			return &zones[i], nil
+		}
+	}
+	return nil, ErrAddressNotServiceable
+}
@@ -0,0 +1,298 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 自动派单模式（系统设置 auto_dispatch_mode）
+const (
+	AutoDispatchModeOff   = "off"   // 关闭，配送员自行接单
+	AutoDispatchModeOffer = "offer" // 逐个推送派单邀请，配送员确认后接单
+	AutoDispatchModeAuto  = "auto"  // 直接派给得分最高的配送员
+)
+
+// 派单邀请状态
+const (
+	DispatchOfferStatusPending   = "pending"   // 等待配送员响应
+	DispatchOfferStatusAccepted  = "accepted"  // 已接受
+	DispatchOfferStatusDeclined  = "declined"  // 已拒绝
+	DispatchOfferStatusExpired   = "expired"   // 超时未响应
+	DispatchOfferStatusCancelled = "cancelled" // 订单已被接走或不再可派
+)
+
+// ErrDispatchOfferUnavailable 派单邀请已处理、已过期或不属于该配送员
+var ErrDispatchOfferUnavailable = errors.New("派单邀请已失效")
+
+// DispatchOffer 派单邀请
+type DispatchOffer struct {
+	ID           int        `json:"id"`
+	OrderID      int        `json:"order_id"`
+	EmployeeCode string     `json:"employee_code"`
+	Score        float64    `json:"score"`  // 综合得分（越低越优先）
+	Detail       string     `json:"detail"` // 得分明细
+	Status       string     `json:"status"` // pending/accepted/declined/expired/cancelled
+	ExpiresAt    time.Time  `json:"expires_at"`
+	RespondedAt  *time.Time `json:"responded_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// GetAutoDispatchMode 获取自动派单模式
+func GetAutoDispatchMode() string {
+	mode, _ := GetSystemSetting("auto_dispatch_mode")
+	switch strings.TrimSpace(mode) {
+	case AutoDispatchModeOffer:
+		return AutoDispatchModeOffer
+	case AutoDispatchModeAuto:
+		return AutoDispatchModeAuto
+	}
+	return AutoDispatchModeOff
+}
+
+// CreateDispatchOffer 创建派单邀请
+func CreateDispatchOffer(offer *DispatchOffer) error {
+	result, err := database.DB.Exec(`
+		INSERT INTO dispatch_offers (order_id, employee_code, score, detail, status, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, NOW())
+	`, offer.OrderID, offer.EmployeeCode, offer.Score, offer.Detail, DispatchOfferStatusPending, offer.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("创建派单邀请失败: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	offer.ID = int(id)
+	offer.Status = DispatchOfferStatusPending
+	offer.CreatedAt = time.Now()
+	return nil
+}
+
+const dispatchOfferColumns = "id, order_id, employee_code, score, detail, status, expires_at, responded_at, created_at"
+
+func scanDispatchOffer(scanner interface{ Scan(...interface{}) error }) (*DispatchOffer, error) {
+	var offer DispatchOffer
+	var detail sql.NullString
+	var respondedAt sql.NullTime
+	if err := scanner.Scan(&offer.ID, &offer.OrderID, &offer.EmployeeCode, &offer.Score, &detail, &offer.Status,
+		&offer.ExpiresAt, &respondedAt, &offer.CreatedAt); err != nil {
+		return nil, err
+	}
+	offer.Detail = detail.String
+	if respondedAt.Valid {
+		offer.RespondedAt = &respondedAt.Time
+	}
+	return &offer, nil
+}
+
+// GetDispatchOfferByID 获取派单邀请
+func GetDispatchOfferByID(id int) (*DispatchOffer, error) {
+	offer, err := scanDispatchOffer(database.DB.QueryRow("SELECT "+dispatchOfferColumns+" FROM dispatch_offers WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return offer, err
+}
+
+// GetPendingDispatchOffersByEmployee 获取配送员待响应的派单邀请
+func GetPendingDispatchOffersByEmployee(employeeCode string) ([]DispatchOffer, error) {
+	rows, err := database.DB.Query("SELECT "+dispatchOfferColumns+` FROM dispatch_offers
+		WHERE employee_code = ? AND status = ? AND expires_at > NOW()
+		ORDER BY id ASC`, employeeCode, DispatchOfferStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	offers := make([]DispatchOffer, 0)
+	for rows.Next() {
+		offer, err := scanDispatchOffer(rows)
+		if err != nil {
+			return nil, err
+		}
+		offers = append(offers, *offer)
+	}
+	return offers, rows.Err()
+}
+
+// GetDispatchOffersByOrder 获取订单的所有派单邀请记录
+func GetDispatchOffersByOrder(orderID int) ([]DispatchOffer, error) {
+	rows, err := database.DB.Query("SELECT "+dispatchOfferColumns+" FROM dispatch_offers WHERE order_id = ? ORDER BY id ASC", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	offers := make([]DispatchOffer, 0)
+	for rows.Next() {
+		offer, err := scanDispatchOffer(rows)
+		if err != nil {
+			return nil, err
+		}
+		offers = append(offers, *offer)
+	}
+	return offers, rows.Err()
+}
+
+// ResolveDispatchOffer 将待响应的派单邀请置为指定状态，返回是否由本次调用完成变更
+// employeeCode 不为空时要求邀请属于该配送员；接受时还要求尚未过期
+func ResolveDispatchOffer(offerID int, employeeCode, status string) (bool, error) {
+	query := "UPDATE dispatch_offers SET status = ?, responded_at = NOW() WHERE id = ? AND status = ?"
+	args := []interface{}{status, offerID, DispatchOfferStatusPending}
+	if employeeCode != "" {
+		query += " AND employee_code = ?"
+		args = append(args, employeeCode)
+	}
+	if status == DispatchOfferStatusAccepted {
+		query += " AND expires_at > NOW()"
+	}
+	result, err := database.DB.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// CancelPendingDispatchOffers 订单已被接走时作废其余待响应邀请，返回被作废的邀请
+func CancelPendingDispatchOffers(orderID int) ([]DispatchOffer, error) {
+	offers, err := GetDispatchOffersByOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+	cancelled := make([]DispatchOffer, 0)
+	for _, offer := range offers {
+		if offer.Status != DispatchOfferStatusPending {
+			continue
+		}
+		ok, err := ResolveDispatchOffer(offer.ID, "", DispatchOfferStatusCancelled)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			offer.Status = DispatchOfferStatusCancelled
+			cancelled = append(cancelled, offer)
+		}
+	}
+	return cancelled, nil
+}
+
+// DispatchAcceptanceStat 配送员派单邀请响应统计
+type DispatchAcceptanceStat struct {
+	Accepted int `json:"accepted"`
+	Total    int `json:"total"` // 已接受 + 已拒绝 + 超时
+}
+
+// Rate 平滑后的接受率（无记录时为 0.5）
+func (s DispatchAcceptanceStat) Rate() float64 {
+	return (float64(s.Accepted) + 1) / (float64(s.Total) + 2)
+}
+
+// GetDispatchAcceptanceStats 统计配送员最近 days 天的派单邀请接受情况
+func GetDispatchAcceptanceStats(employeeCodes []string, days int) (map[string]DispatchAcceptanceStat, error) {
+	stats := make(map[string]DispatchAcceptanceStat, len(employeeCodes))
+	if len(employeeCodes) == 0 {
+		return stats, nil
+	}
+	placeholders := make([]string, len(employeeCodes))
+	args := make([]interface{}, 0, len(employeeCodes)+5)
+	args = append(args, DispatchOfferStatusAccepted, DispatchOfferStatusAccepted, DispatchOfferStatusDeclined, DispatchOfferStatusExpired)
+	for i, code := range employeeCodes {
+		placeholders[i] = "?"
+		args = append(args, code)
+	}
+	args = append(args, days)
+
+	rows, err := database.DB.Query(`
+		SELECT employee_code,
+		       SUM(CASE WHEN status = ? THEN 1 ELSE 0 END),
+		       SUM(CASE WHEN status IN (?, ?, ?) THEN 1 ELSE 0 END)
+		FROM dispatch_offers
+		WHERE employee_code IN (`+strings.Join(placeholders, ",")+`)
+		  AND created_at >= DATE_SUB(NOW(), INTERVAL ? DAY)
+		GROUP BY employee_code
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var code string
+		var stat DispatchAcceptanceStat
+		if err := rows.Scan(&code, &stat.Accepted, &stat.Total); err != nil {
+			return nil, err
+		}
+		stats[code] = stat
+	}
+	return stats, rows.Err()
+}
+
+// AutoAssignOrderToDeliveryEmployee 自动派单：订单转为待取货并指定配送员
+func AutoAssignOrderToDeliveryEmployee(orderID int, deliveryEmployeeCode string) error {
+	return assignOrderDeliveryEmployee(orderID, "pending_pickup", deliveryEmployeeCode, OrderActor{Type: OrderActorSystem, ID: "auto_dispatch"}, "自动派单给配送员 "+deliveryEmployeeCode)
+}
+
+// GetDispatchOrderTarget 检查订单是否仍可派单并返回收货坐标；不可派单时 reason 为原因
+func GetDispatchOrderTarget(orderID int) (lat, lng float64, reason string, err error) {
+	if reason = checkDispatchOrderStillPending(orderID); reason != "" {
+		return 0, 0, reason, nil
+	}
+	var latitude, longitude sql.NullFloat64
+	err = database.DB.QueryRow(`
+		SELECT a.latitude, a.longitude
+		FROM orders o
+		LEFT JOIN mini_app_addresses a ON a.id = o.address_id
+		WHERE o.id = ?
+	`, orderID).Scan(&latitude, &longitude)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if !latitude.Valid || !longitude.Valid {
+		return 0, 0, "收货地址缺少坐标", nil
+	}
+	return latitude.Float64, longitude.Float64, "", nil
+}
+
+// ActiveRouteStop 配送员当前批次中未完成订单的位置（按路线顺序）
+type ActiveRouteStop struct {
+	OrderID   int
+	Latitude  float64
+	Longitude float64
+}
+
+// GetActiveRouteStops 获取配送员当前批次未完成订单（待取货、配送中）及其收货坐标，按路线顺序
+func GetActiveRouteStops(employeeCode string) ([]ActiveRouteStop, error) {
+	batchID, err := GetCurrentBatchID(employeeCode)
+	if err != nil || batchID == "" {
+		return []ActiveRouteStop{}, err
+	}
+	rows, err := database.DB.Query(`
+		SELECT o.id, a.latitude, a.longitude
+		FROM delivery_route_orders dro
+		INNER JOIN orders o ON o.id = dro.order_id
+		INNER JOIN mini_app_addresses a ON a.id = o.address_id
+		WHERE dro.delivery_employee_code = ? AND dro.batch_id = ?
+		  AND o.status IN ('pending_pickup', 'delivering')
+		  AND a.latitude IS NOT NULL AND a.longitude IS NOT NULL
+		ORDER BY dro.route_sequence ASC
+	`, employeeCode, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stops := make([]ActiveRouteStop, 0)
+	for rows.Next() {
+		var stop ActiveRouteStop
+		if err := rows.Scan(&stop.OrderID, &stop.Latitude, &stop.Longitude); err != nil {
+			return nil, err
+		}
+		stops = append(stops, stop)
+	}
+	return stops, rows.Err()
+}
@@ -0,0 +1,691 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go_backend/internal/database"
+	"go_backend/internal/utils"
+)
+
+// 调度方案状态
+const (
+	DispatchPlanStatusDraft     = "draft"     // 待确认
+	DispatchPlanStatusConfirmed = "confirmed" // 已确认派单
+	DispatchPlanStatusDiscarded = "discarded" // 已作废
+)
+
+// ErrDispatchPlanNotDraft 方案已确认或已作废，不能再操作
+var ErrDispatchPlanNotDraft = errors.New("调度方案已确认或已作废")
+
+// DispatchRider 参与调度的配送员及其当前位置
+type DispatchRider struct {
+	EmployeeCode string  `json:"employee_code"`
+	Name         string  `json:"name"`
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+}
+
+// DispatchPlanOptions 生成调度方案的参数
+type DispatchPlanOptions struct {
+	Capacity       float64 `json:"capacity"`        // 每个配送员的容量（配送计件数），0 表示不限
+	SpeedKmh       float64 `json:"speed_kmh"`       // 平均速度（公里/小时）
+	ServiceMinutes float64 `json:"service_minutes"` // 每个停靠点停留时间（分钟）
+}
+
+// DispatchPlanStop 方案中的停靠点（取货点或送货点）
+type DispatchPlanStop struct {
+	Type             string     `json:"type"` // pickup-取货, delivery-送货
+	OrderID          int        `json:"order_id,omitempty"`
+	OrderNumber      string     `json:"order_number,omitempty"`
+	SupplierID       int        `json:"supplier_id,omitempty"`
+	Name             string     `json:"name"`
+	Address          string     `json:"address"`
+	Latitude         float64    `json:"latitude"`
+	Longitude        float64    `json:"longitude"`
+	Load             float64    `json:"load,omitempty"`
+	DistanceFromPrev float64    `json:"distance_from_prev"`
+	ETA              time.Time  `json:"eta"`
+	Deadline         *time.Time `json:"deadline,omitempty"`
+	LateMinutes      float64    `json:"late_minutes,omitempty"`
+}
+
+// DispatchPlanRoute 方案中单个配送员的路线
+type DispatchPlanRoute struct {
+	EmployeeCode  string             `json:"employee_code"`
+	EmployeeName  string             `json:"employee_name"`
+	Capacity      float64            `json:"capacity"`
+	ExistingLoad  float64            `json:"existing_load"` // 手上未完成订单的计件数
+	Load          float64            `json:"load"`          // 本次分配的计件数
+	OrderCount    int                `json:"order_count"`
+	TotalDistance float64            `json:"total_distance"`
+	LateStops     int                `json:"late_stops"`
+	FinishAt      time.Time          `json:"finish_at"`
+	Stops         []DispatchPlanStop `json:"stops"`
+}
+
+// DispatchPlanOrderResult 订单在方案中的分配/派单结果
+type DispatchPlanOrderResult struct {
+	OrderID      int    `json:"order_id"`
+	OrderNumber  string `json:"order_number,omitempty"`
+	EmployeeCode string `json:"employee_code,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// DispatchPlanResult 确认派单结果
+type DispatchPlanResult struct {
+	Assigned []DispatchPlanOrderResult `json:"assigned"`
+	Skipped  []DispatchPlanOrderResult `json:"skipped"`
+}
+
+// DispatchPlan 调度方案
+type DispatchPlan struct {
+	ID            int                       `json:"id"`
+	Status        string                    `json:"status"`
+	Options       DispatchPlanOptions       `json:"options"`
+	Routes        []DispatchPlanRoute       `json:"routes"`
+	Unassigned    []DispatchPlanOrderResult `json:"unassigned"`
+	OrderCount    int                       `json:"order_count"`
+	TotalDistance float64                   `json:"total_distance"`
+	LateStops     int                       `json:"late_stops"`
+	Result        *DispatchPlanResult       `json:"result,omitempty"`
+	CreatedBy     string                    `json:"created_by"`
+	ConfirmedBy   *string                   `json:"confirmed_by,omitempty"`
+	ConfirmedAt   *time.Time                `json:"confirmed_at,omitempty"`
+	CreatedAt     time.Time                 `json:"created_at"`
+	UpdatedAt     time.Time                 `json:"updated_at"`
+}
+
+// dispatchOrder 待调度订单
+type dispatchOrder struct {
+	ID          int
+	OrderNumber string
+	Name        string
+	Address     string
+	Latitude    float64
+	Longitude   float64
+	Deadline    *time.Time
+	Load        float64
+	SupplierIDs []int
+}
+
+// DefaultDispatchPlanOptions 从系统设置读取默认调度参数
+func DefaultDispatchPlanOptions() DispatchPlanOptions {
+	return DispatchPlanOptions{
+		Capacity:       GetSystemSettingFloat("dispatch_vehicle_capacity", 30),
+		SpeedKmh:       GetSystemSettingFloat("dispatch_avg_speed_kmh", 25),
+		ServiceMinutes: GetSystemSettingFloat("dispatch_service_minutes", 5),
+	}
+}
+
+// orderDeliveryLoads 计算订单配送计件数（数量 × 规格配送计件数）及涉及的供应商
+func orderDeliveryLoads(orderIDs []int) (map[int]float64, map[int][]int, error) {
+	loads := make(map[int]float64, len(orderIDs))
+	suppliers := make(map[int][]int)
+	if len(orderIDs) == 0 {
+		return loads, suppliers, nil
+	}
+
+	placeholders := make([]string, len(orderIDs))
+	args := make([]interface{}, len(orderIDs))
+	for i, id := range orderIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	rows, err := database.DB.Query(`
+		SELECT oi.order_id, oi.quantity, oi.spec_snapshot, p.supplier_id
+		FROM order_items oi
+		LEFT JOIN products p ON p.id = oi.product_id
+		WHERE oi.order_id IN (`+strings.Join(placeholders, ",")+`)
+	`, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[int]map[int]bool)
+	for rows.Next() {
+		var orderID, quantity int
+		var snapshotJSON sql.NullString
+		var supplierID sql.NullInt64
+		if err := rows.Scan(&orderID, &quantity, &snapshotJSON, &supplierID); err != nil {
+			return nil, nil, err
+		}
+		deliveryCount := 1.0
+		if snapshotJSON.Valid && snapshotJSON.String != "" {
+			var snapshot PurchaseSpecSnapshot
+			if err := json.Unmarshal([]byte(snapshotJSON.String), &snapshot); err == nil && snapshot.DeliveryCount > 0 {
+				deliveryCount = snapshot.DeliveryCount
+			}
+		}
+		loads[orderID] += float64(quantity) * deliveryCount
+
+		if supplierID.Valid && supplierID.Int64 > 0 {
+			if seen[orderID] == nil {
+				seen[orderID] = make(map[int]bool)
+			}
+			sid := int(supplierID.Int64)
+			if !seen[orderID][sid] {
+				seen[orderID][sid] = true
+				suppliers[orderID] = append(suppliers[orderID], sid)
+			}
+		}
+	}
+	return loads, suppliers, rows.Err()
+}
+
+// getDispatchCandidateOrders 获取待调度订单：待配送、未分配配送员、未锁定且地址有坐标
+func getDispatchCandidateOrders() ([]dispatchOrder, []DispatchPlanOrderResult, error) {
+	rows, err := database.DB.Query(`
+		SELECT o.id, o.order_number, o.expected_delivery_at,
+		       COALESCE(a.name, ''), COALESCE(a.address, ''), a.latitude, a.longitude
+		FROM orders o
+		LEFT JOIN mini_app_addresses a ON a.id = o.address_id
+		WHERE o.status IN ('pending_delivery', 'pending')
+		  AND (o.delivery_employee_code IS NULL OR o.delivery_employee_code = '')
+		  AND COALESCE(o.is_locked, 0) = 0
+		ORDER BY o.created_at ASC
+	`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	orders := make([]dispatchOrder, 0)
+	skipped := make([]DispatchPlanOrderResult, 0)
+	for rows.Next() {
+		var o dispatchOrder
+		var expected sql.NullTime
+		var lat, lng sql.NullFloat64
+		if err := rows.Scan(&o.ID, &o.OrderNumber, &expected, &o.Name, &o.Address, &lat, &lng); err != nil {
+			return nil, nil, err
+		}
+		if !lat.Valid || !lng.Valid {
+			skipped = append(skipped, DispatchPlanOrderResult{OrderID: o.ID, OrderNumber: o.OrderNumber, Reason: "收货地址缺少坐标"})
+			continue
+		}
+		o.Latitude, o.Longitude = lat.Float64, lng.Float64
+		if expected.Valid {
+			t := expected.Time
+			o.Deadline = &t
+		}
+		orders = append(orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]int, len(orders))
+	for i, o := range orders {
+		ids[i] = o.ID
+	}
+	loads, suppliers, err := orderDeliveryLoads(ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range orders {
+		orders[i].Load = loads[orders[i].ID]
+		orders[i].SupplierIDs = suppliers[orders[i].ID]
+	}
+	return orders, skipped, nil
+}
+
+// getRiderExistingLoads 获取配送员手上未完成订单（待取货、配送中）的计件数
+func getRiderExistingLoads(employeeCodes []string) (map[string]float64, error) {
+	result := make(map[string]float64, len(employeeCodes))
+	if len(employeeCodes) == 0 {
+		return result, nil
+	}
+	placeholders := make([]string, len(employeeCodes))
+	args := make([]interface{}, len(employeeCodes))
+	for i, code := range employeeCodes {
+		placeholders[i] = "?"
+		args[i] = code
+	}
+	rows, err := database.DB.Query(`
+		SELECT id, delivery_employee_code FROM orders
+		WHERE status IN ('pending_pickup', 'delivering')
+		  AND delivery_employee_code IN (`+strings.Join(placeholders, ",")+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owner := make(map[int]string)
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		var code string
+		if err := rows.Scan(&id, &code); err != nil {
+			return nil, err
+		}
+		owner[id] = code
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	loads, _, err := orderDeliveryLoads(ids)
+	if err != nil {
+		return nil, err
+	}
+	for id, load := range loads {
+		result[owner[id]] += load
+	}
+	return result, nil
+}
+
+// BuildDispatchPlan 为所有待调度订单和给定配送员生成调度方案并保存为待确认
+func BuildDispatchPlan(riders []DispatchRider, opts DispatchPlanOptions, createdBy string) (*DispatchPlan, error) {
+	orders, skipped, err := getDispatchCandidateOrders()
+	if err != nil {
+		return nil, fmt.Errorf("获取待调度订单失败: %w", err)
+	}
+
+	codes := make([]string, len(riders))
+	for i, r := range riders {
+		codes[i] = r.EmployeeCode
+	}
+	existingLoads, err := getRiderExistingLoads(codes)
+	if err != nil {
+		return nil, fmt.Errorf("获取配送员在途订单失败: %w", err)
+	}
+
+	vehicles := make([]utils.FleetVehicle, len(riders))
+	for i, r := range riders {
+		vehicles[i] = utils.FleetVehicle{
+			ID:       r.EmployeeCode,
+			Lat:      r.Latitude,
+			Lng:      r.Longitude,
+			Capacity: opts.Capacity,
+			Load:     existingLoads[r.EmployeeCode],
+		}
+	}
+
+	orderByKey := make(map[string]dispatchOrder, len(orders))
+	stops := make([]utils.FleetStop, 0, len(orders))
+	supplierNeeded := make(map[int]bool)
+	for _, o := range orders {
+		key := strconv.Itoa(o.ID)
+		orderByKey[key] = o
+		pickupIDs := make([]string, 0, len(o.SupplierIDs))
+		for _, sid := range o.SupplierIDs {
+			pickupIDs = append(pickupIDs, strconv.Itoa(sid))
+			supplierNeeded[sid] = true
+		}
+		stops = append(stops, utils.FleetStop{
+			ID:        key,
+			Lat:       o.Latitude,
+			Lng:       o.Longitude,
+			Load:      o.Load,
+			Deadline:  o.Deadline,
+			PickupIDs: pickupIDs,
+		})
+	}
+
+	supplierByKey := make(map[string]*Supplier)
+	pickups := make([]utils.FleetPickup, 0, len(supplierNeeded))
+	for sid := range supplierNeeded {
+		supplier, err := GetSupplierByID(database.DB, sid)
+		if err != nil || supplier == nil || supplier.Latitude == nil || supplier.Longitude == nil {
+			continue
+		}
+		key := strconv.Itoa(sid)
+		supplierByKey[key] = supplier
+		pickups = append(pickups, utils.FleetPickup{ID: key, Lat: *supplier.Latitude, Lng: *supplier.Longitude})
+	}
+
+	// 配送员、取货点、送货点两两之间的道路距离
+	points := make([]utils.Coordinate, 0, len(vehicles)+len(pickups)+len(stops))
+	for _, v := range vehicles {
+		points = append(points, utils.Coordinate{Lat: v.Lat, Lng: v.Lng})
+	}
+	for _, pk := range pickups {
+		points = append(points, utils.Coordinate{Lat: pk.Lat, Lng: pk.Lng})
+	}
+	for _, s := range stops {
+		points = append(points, utils.Coordinate{Lat: s.Lat, Lng: s.Lng})
+	}
+	matrix := BuildDistanceMatrix(points, opts.SpeedKmh)
+
+	fleet := utils.PlanFleetRoutes(vehicles, stops, pickups, utils.FleetPlanOptions{
+		StartAt:              time.Now(),
+		SpeedKmh:             opts.SpeedKmh,
+		ServiceMinutes:       opts.ServiceMinutes,
+		LatePenaltyPerMinute: GetSystemSettingFloat("dispatch_late_penalty_km", 0.5),
+		BalanceWeight:        GetSystemSettingFloat("dispatch_balance_weight", 0.5),
+		Distance:             matrix.Distance,
+		Duration:             matrix.Duration,
+	})
+
+	plan := &DispatchPlan{
+		Status:        DispatchPlanStatusDraft,
+		Options:       opts,
+		Routes:        make([]DispatchPlanRoute, 0, len(fleet.Routes)),
+		Unassigned:    skipped,
+		TotalDistance: roundMoney(fleet.TotalDistance),
+		LateStops:     fleet.LateStops,
+		CreatedBy:     createdBy,
+	}
+	for i, fr := range fleet.Routes {
+		route := DispatchPlanRoute{
+			EmployeeCode:  fr.VehicleID,
+			EmployeeName:  riders[i].Name,
+			Capacity:      fr.Capacity,
+			ExistingLoad:  fr.ExistingLoad,
+			Load:          fr.Load,
+			TotalDistance: roundMoney(fr.TotalDistance),
+			LateStops:     fr.LateStops,
+			FinishAt:      fr.FinishAt,
+			Stops:         make([]DispatchPlanStop, 0, len(fr.Stops)),
+		}
+		for _, s := range fr.Stops {
+			stop := DispatchPlanStop{
+				Type:             s.Type,
+				Latitude:         s.Lat,
+				Longitude:        s.Lng,
+				Load:             s.Load,
+				DistanceFromPrev: roundMoney(s.DistanceFromPrev),
+				ETA:              s.ETA,
+				Deadline:         s.Deadline,
+				LateMinutes:      roundMoney(s.LateMinutes),
+			}
+			if s.Type == "pickup" {
+				supplier := supplierByKey[s.ID]
+				stop.SupplierID = supplier.ID
+				stop.Name = supplier.Name
+				stop.Address = supplier.Address
+			} else {
+				o := orderByKey[s.ID]
+				stop.OrderID = o.ID
+				stop.OrderNumber = o.OrderNumber
+				stop.Name = o.Name
+				stop.Address = o.Address
+				route.OrderCount++
+			}
+			route.Stops = append(route.Stops, stop)
+		}
+		plan.OrderCount += route.OrderCount
+		plan.Routes = append(plan.Routes, route)
+	}
+	for _, u := range fleet.Unassigned {
+		o := orderByKey[u.ID]
+		plan.Unassigned = append(plan.Unassigned, DispatchPlanOrderResult{OrderID: o.ID, OrderNumber: o.OrderNumber, Reason: u.Reason})
+	}
+
+	if err := saveDispatchPlan(plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func saveDispatchPlan(plan *DispatchPlan) error {
+	optionsJSON, _ := json.Marshal(plan.Options)
+	routesJSON, _ := json.Marshal(plan.Routes)
+	unassignedJSON, _ := json.Marshal(plan.Unassigned)
+	result, err := database.DB.Exec(`
+		INSERT INTO dispatch_plans (status, options, routes, unassigned, order_count, total_distance, late_stops, created_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())
+	`, plan.Status, string(optionsJSON), string(routesJSON), string(unassignedJSON), plan.OrderCount, plan.TotalDistance, plan.LateStops, plan.CreatedBy)
+	if err != nil {
+		return fmt.Errorf("保存调度方案失败: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	plan.ID = int(id)
+	plan.CreatedAt = time.Now()
+	plan.UpdatedAt = plan.CreatedAt
+	return nil
+}
+
+const dispatchPlanColumns = `id, status, options, routes, unassigned, result, order_count, total_distance, late_stops,
+	created_by, confirmed_by, confirmed_at, created_at, updated_at`
+
+func scanDispatchPlan(scanner interface{ Scan(...interface{}) error }) (*DispatchPlan, error) {
+	var plan DispatchPlan
+	var optionsJSON, routesJSON, unassignedJSON, resultJSON, confirmedBy sql.NullString
+	var confirmedAt sql.NullTime
+	err := scanner.Scan(&plan.ID, &plan.Status, &optionsJSON, &routesJSON, &unassignedJSON, &resultJSON,
+		&plan.OrderCount, &plan.TotalDistance, &plan.LateStops, &plan.CreatedBy, &confirmedBy, &confirmedAt,
+		&plan.CreatedAt, &plan.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if optionsJSON.Valid {
+		_ = json.Unmarshal([]byte(optionsJSON.String), &plan.Options)
+	}
+	if routesJSON.Valid {
+		_ = json.Unmarshal([]byte(routesJSON.String), &plan.Routes)
+	}
+	if unassignedJSON.Valid {
+		_ = json.Unmarshal([]byte(unassignedJSON.String), &plan.Unassigned)
+	}
+	if resultJSON.Valid && resultJSON.String != "" {
+		var result DispatchPlanResult
+		if err := json.Unmarshal([]byte(resultJSON.String), &result); err == nil {
+			plan.Result = &result
+		}
+	}
+	if plan.Routes == nil {
+		plan.Routes = make([]DispatchPlanRoute, 0)
+	}
+	if plan.Unassigned == nil {
+		plan.Unassigned = make([]DispatchPlanOrderResult, 0)
+	}
+	if confirmedBy.Valid {
+		plan.ConfirmedBy = &confirmedBy.String
+	}
+	if confirmedAt.Valid {
+		plan.ConfirmedAt = &confirmedAt.Time
+	}
+	return &plan, nil
+}
+
+// GetDispatchPlanByID 获取调度方案
+func GetDispatchPlanByID(id int) (*DispatchPlan, error) {
+	row := database.DB.QueryRow("SELECT "+dispatchPlanColumns+" FROM dispatch_plans WHERE id = ?", id)
+	plan, err := scanDispatchPlan(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return plan, err
+}
+
+// GetDispatchPlans 分页获取调度方案，status 为空表示全部
+func GetDispatchPlans(status string, pageNum, pageSize int) ([]DispatchPlan, int, error) {
+	where := ""
+	args := make([]interface{}, 0)
+	if status != "" {
+		where = " WHERE status = ?"
+		args = append(args, status)
+	}
+
+	var total int
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM dispatch_plans"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	offset := (pageNum - 1) * pageSize
+	rows, err := database.DB.Query("SELECT "+dispatchPlanColumns+" FROM dispatch_plans"+where+" ORDER BY id DESC LIMIT ? OFFSET ?",
+		append(args, pageSize, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	plans := make([]DispatchPlan, 0)
+	for rows.Next() {
+		plan, err := scanDispatchPlan(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		plans = append(plans, *plan)
+	}
+	return plans, total, rows.Err()
+}
+
+// DiscardDispatchPlan 作废待确认的调度方案
+func DiscardDispatchPlan(id int, operator string) error {
+	result, err := database.DB.Exec(`
+		UPDATE dispatch_plans SET status = ?, confirmed_by = ?, updated_at = NOW()
+		WHERE id = ? AND status = ?
+	`, DispatchPlanStatusDiscarded, operator, id, DispatchPlanStatusDraft)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrDispatchPlanNotDraft
+	}
+	return nil
+}
+
+// ConfirmDispatchPlan 确认调度方案：按方案逐单派给配送员并写入配送路线排序
+// 生成方案后已被接单、取消或锁定的订单会跳过并记录原因
+func ConfirmDispatchPlan(id int, operator string) (*DispatchPlan, error) {
+	// 先抢占方案状态，防止重复确认
+	claim, err := database.DB.Exec(`
+		UPDATE dispatch_plans SET status = ?, confirmed_by = ?, confirmed_at = NOW(), updated_at = NOW()
+		WHERE id = ? AND status = ?
+	`, DispatchPlanStatusConfirmed, operator, id, DispatchPlanStatusDraft)
+	if err != nil {
+		return nil, err
+	}
+	if affected, _ := claim.RowsAffected(); affected == 0 {
+		return nil, ErrDispatchPlanNotDraft
+	}
+
+	plan, err := GetDispatchPlanByID(id)
+	if err != nil || plan == nil {
+		return nil, fmt.Errorf("获取调度方案失败: %v", err)
+	}
+
+	result := &DispatchPlanResult{
+		Assigned: make([]DispatchPlanOrderResult, 0),
+		Skipped:  make([]DispatchPlanOrderResult, 0),
+	}
+	now := time.Now()
+	for _, route := range plan.Routes {
+		type assignedStop struct {
+			orderID  int
+			distance float64
+		}
+		assigned := make([]assignedStop, 0, route.OrderCount)
+		pending := 0.0
+		for _, stop := range route.Stops {
+			// 取货点及被跳过订单的距离累加到下一个成功派单的订单上
+			pending += stop.DistanceFromPrev
+			if stop.Type != "delivery" {
+				continue
+			}
+			item := DispatchPlanOrderResult{OrderID: stop.OrderID, OrderNumber: stop.OrderNumber, EmployeeCode: route.EmployeeCode}
+			if reason := checkDispatchOrderStillPending(stop.OrderID); reason != "" {
+				item.Reason = reason
+				result.Skipped = append(result.Skipped, item)
+				continue
+			}
+			if err := AssignOrderToDeliveryEmployee(stop.OrderID, route.EmployeeCode, operator); err != nil {
+				item.Reason = err.Error()
+				result.Skipped = append(result.Skipped, item)
+				continue
+			}
+
+			remark := fmt.Sprintf("调度方案 #%d 派单", plan.ID)
+			code := route.EmployeeCode
+			_ = CreateDeliveryLog(&DeliveryLog{
+				OrderID:              stop.OrderID,
+				Action:               DeliveryLogActionAccepted,
+				DeliveryEmployeeCode: &code,
+				ActionTime:           now,
+				Remark:               &remark,
+			})
+			result.Assigned = append(result.Assigned, item)
+			assigned = append(assigned, assignedStop{orderID: stop.OrderID, distance: roundMoney(pending)})
+			pending = 0
+		}
+		if len(assigned) == 0 {
+			continue
+		}
+
+		// 写入路线排序：当前批次已有订单保持原顺序，新派订单按方案顺序追加
+		batchID, err := GetCurrentBatchID(route.EmployeeCode)
+		if err == nil && batchID == "" {
+			batchID, err = CreateNewBatch(route.EmployeeCode)
+		}
+		if err != nil {
+			fmt.Printf("[ConfirmDispatchPlan] 获取配送员 %s 批次失败: %v\n", route.EmployeeCode, err)
+			continue
+		}
+		sequences := make([]struct {
+			OrderID  int
+			Sequence int
+			Distance *float64
+		}, 0)
+		inRoute := make(map[int]bool)
+		if existing, err := GetRouteOrdersByEmployee(route.EmployeeCode); err == nil {
+			for _, ro := range existing {
+				inRoute[ro.OrderID] = true
+				sequences = append(sequences, struct {
+					OrderID  int
+					Sequence int
+					Distance *float64
+				}{ro.OrderID, len(sequences) + 1, ro.CalculatedDistance})
+			}
+		}
+		for _, a := range assigned {
+			if inRoute[a.orderID] {
+				continue
+			}
+			distance := a.distance
+			sequences = append(sequences, struct {
+				OrderID  int
+				Sequence int
+				Distance *float64
+			}{a.orderID, len(sequences) + 1, &distance})
+		}
+		if err := UpdateRouteSequence(route.EmployeeCode, batchID, sequences); err != nil {
+			fmt.Printf("[ConfirmDispatchPlan] 写入配送员 %s 路线排序失败: %v\n", route.EmployeeCode, err)
+		}
+	}
+
+	resultJSON, _ := json.Marshal(result)
+	if _, err := database.DB.Exec("UPDATE dispatch_plans SET result = ?, updated_at = NOW() WHERE id = ?", string(resultJSON), plan.ID); err != nil {
+		return nil, fmt.Errorf("保存派单结果失败: %w", err)
+	}
+	plan.Result = result
+	return plan, nil
+}
+
+// checkDispatchOrderStillPending 检查订单是否仍可派单，不可派单时返回原因
+func checkDispatchOrderStillPending(orderID int) string {
+	var status string
+	var code sql.NullString
+	var isLocked int
+	err := database.DB.QueryRow(
+		"SELECT status, delivery_employee_code, COALESCE(is_locked, 0) FROM orders WHERE id = ?", orderID,
+	).Scan(&status, &code, &isLocked)
+	if err == sql.ErrNoRows {
+		return "订单不存在"
+	}
+	if err != nil {
+		return "查询订单失败: " + err.Error()
+	}
+	if status != "pending_delivery" && status != "pending" {
+		return "订单状态已变为 " + status
+	}
+	if code.Valid && code.String != "" {
+		return "订单已被配送员 " + code.String + " 接单"
+	}
+	if isLocked == 1 {
+		return "订单正在被修改中"
+	}
+	return ""
+}
@@ -0,0 +1,271 @@
+package model
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"go_backend/internal/database"
+	"go_backend/internal/utils"
+)
+
+// 距离服务设置值
+const (
+	DistanceProviderHaversine = "haversine" // 直线距离
+	DistanceProviderAmap      = "amap"      // 高德驾车距离
+)
+
+// distanceCacheKey 坐标缓存键，保留 5 位小数（约 1 米）
+func distanceCacheKey(c utils.Coordinate) string {
+	return strconv.FormatFloat(c.Lat, 'f', 5, 64) + "," + strconv.FormatFloat(c.Lng, 'f', 5, 64)
+}
+
+// cachedDistanceProvider 在 MySQL 中缓存点对距离结果，只对未命中的点对调用实际服务
+type cachedDistanceProvider struct {
+	inner   utils.DistanceMatrixProvider
+	ttlDays int
+}
+
+// Name 服务名称
+func (p *cachedDistanceProvider) Name() string {
+	return p.inner.Name()
+}
+
+// Matrix 先查缓存，未命中的起点/终点组合再请求实际服务并写入缓存
+func (p *cachedDistanceProvider) Matrix(origins, destinations []utils.Coordinate) ([][]utils.DistanceMatrixEntry, error) {
+	result := make([][]utils.DistanceMatrixEntry, len(origins))
+	for i := range result {
+		result[i] = make([]utils.DistanceMatrixEntry, len(destinations))
+	}
+	if len(origins) == 0 || len(destinations) == 0 {
+		return result, nil
+	}
+
+	cached, err := p.load(origins, destinations)
+	if err != nil {
+		log.Printf("读取距离缓存失败: %v", err)
+		cached = map[[2]string]utils.DistanceMatrixEntry{}
+	}
+
+	// 收集有未命中点对的起点和终点
+	missOrigins := make([]int, 0)
+	missDestSet := make(map[int]bool)
+	for i, o := range origins {
+		originMissed := false
+		for j, d := range destinations {
+			if o == d {
+				continue
+			}
+			if e, ok := cached[[2]string{distanceCacheKey(o), distanceCacheKey(d)}]; ok {
+				result[i][j] = e
+				continue
+			}
+			originMissed = true
+			missDestSet[j] = true
+		}
+		if originMissed {
+			missOrigins = append(missOrigins, i)
+		}
+	}
+	if len(missOrigins) == 0 {
+		return result, nil
+	}
+
+	missDests := make([]int, 0, len(missDestSet))
+	for j := range destinations {
+		if missDestSet[j] {
+			missDests = append(missDests, j)
+		}
+	}
+	subOrigins := make([]utils.Coordinate, len(missOrigins))
+	for k, i := range missOrigins {
+		subOrigins[k] = origins[i]
+	}
+	subDests := make([]utils.Coordinate, len(missDests))
+	for k, j := range missDests {
+		subDests[k] = destinations[j]
+	}
+
+	fetched, err := p.inner.Matrix(subOrigins, subDests)
+	if err != nil {
+		return nil, err
+	}
+	for a, i := range missOrigins {
+		for b, j := range missDests {
+			if origins[i] != destinations[j] {
+				result[i][j] = fetched[a][b]
+			}
+		}
+	}
+	if err := p.store(subOrigins, subDests, fetched); err != nil {
+		log.Printf("写入距离缓存失败: %v", err)
+	}
+	return result, nil
+}
+
+func (p *cachedDistanceProvider) load(origins, destinations []utils.Coordinate) (map[[2]string]utils.DistanceMatrixEntry, error) {
+	originKeys := uniqueDistanceKeys(origins)
+	destKeys := uniqueDistanceKeys(destinations)
+	args := make([]interface{}, 0, len(originKeys)+len(destKeys)+2)
+	args = append(args, p.inner.Name())
+	for _, k := range originKeys {
+		args = append(args, k)
+	}
+	for _, k := range destKeys {
+		args = append(args, k)
+	}
+	args = append(args, p.ttlDays)
+
+	rows, err := database.DB.Query(`
+		SELECT origin, destination, distance_km, duration_minutes
+		FROM distance_matrix_cache
+		WHERE provider = ?
+		  AND origin IN (`+strings.TrimSuffix(strings.Repeat("?,", len(originKeys)), ",")+`)
+		  AND destination IN (`+strings.TrimSuffix(strings.Repeat("?,", len(destKeys)), ",")+`)
+		  AND updated_at >= DATE_SUB(NOW(), INTERVAL ? DAY)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cached := make(map[[2]string]utils.DistanceMatrixEntry)
+	for rows.Next() {
+		var origin, destination string
+		var e utils.DistanceMatrixEntry
+		if err := rows.Scan(&origin, &destination, &e.DistanceKm, &e.DurationMinutes); err != nil {
+			return nil, err
+		}
+		cached[[2]string{origin, destination}] = e
+	}
+	return cached, rows.Err()
+}
+
+func (p *cachedDistanceProvider) store(origins, destinations []utils.Coordinate, entries [][]utils.DistanceMatrixEntry) error {
+	values := make([]string, 0)
+	args := make([]interface{}, 0)
+	for i, o := range origins {
+		for j, d := range destinations {
+			if o == d {
+				continue
+			}
+			values = append(values, "(?, ?, ?, ?, ?, NOW(), NOW())")
+			args = append(args, p.inner.Name(), distanceCacheKey(o), distanceCacheKey(d), entries[i][j].DistanceKm, entries[i][j].DurationMinutes)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	_, err := database.DB.Exec(`
+		INSERT INTO distance_matrix_cache (provider, origin, destination, distance_km, duration_minutes, created_at, updated_at)
+		VALUES `+strings.Join(values, ",")+`
+		ON DUPLICATE KEY UPDATE distance_km = VALUES(distance_km), duration_minutes = VALUES(duration_minutes), updated_at = NOW()
+	`, args...)
+	return err
+}
+
+func uniqueDistanceKeys(coords []utils.Coordinate) []string {
+	seen := make(map[string]bool, len(coords))
+	keys := make([]string, 0, len(coords))
+	for _, c := range coords {
+		k := distanceCacheKey(c)
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// routeSpeedKmh 直线距离估算行驶时间使用的平均速度
+func routeSpeedKmh() float64 {
+	return GetSystemSettingFloat("dispatch_avg_speed_kmh", 25)
+}
+
+// GetDistanceProvider 按系统设置获取距离服务
+// distance_provider=amap 且配置了高德 Key 时使用高德驾车距离（带 MySQL 缓存），失败时回退直线距离；否则使用直线距离
+func GetDistanceProvider() utils.DistanceMatrixProvider {
+	return getDistanceProvider(routeSpeedKmh())
+}
+
+// getDistanceProvider speedKmh 为直线距离兜底时估算行驶时间的平均速度
+func getDistanceProvider(speedKmh float64) utils.DistanceMatrixProvider {
+	fallback := utils.HaversineProvider{SpeedKmh: speedKmh}
+	providerName, _ := GetSystemSetting("distance_provider")
+	if strings.TrimSpace(providerName) != DistanceProviderAmap {
+		return fallback
+	}
+	amapKey, _ := GetSystemSetting("map_amap_key")
+	if strings.TrimSpace(amapKey) == "" {
+		return fallback
+	}
+	return &utils.FallbackProvider{
+		Primary: &cachedDistanceProvider{
+			inner:   utils.NewAmapDrivingProvider(strings.TrimSpace(amapKey)),
+			ttlDays: GetSystemSettingInt("distance_cache_days", 30),
+		},
+		Fallback: fallback,
+		OnError: func(err error) {
+			log.Printf("道路距离服务失败，使用直线距离: %v", err)
+		},
+	}
+}
+
+// BuildDistanceMatrix 计算一组坐标两两之间的道路距离和时间，用于路线规划和预计到达时间
+// speedKmh 为使用直线距离时估算行驶时间的平均速度，0 时使用系统设置
+func BuildDistanceMatrix(points []utils.Coordinate, speedKmh float64) *utils.DistanceMatrix {
+	if speedKmh <= 0 {
+		speedKmh = routeSpeedKmh()
+	}
+	return utils.NewDistanceMatrix(getDistanceProvider(speedKmh), points, speedKmh)
+}
+
+// RouteLegs 计算依次经过 points 的各段道路距离和时间（len(points)-1 段），只请求相邻两点而不是两两矩阵
+// 固定停靠点之间的路段由距离缓存命中；speedKmh 为 0 时使用系统设置
+func RouteLegs(points []utils.Coordinate, speedKmh float64) []utils.DistanceMatrixEntry {
+	if speedKmh <= 0 {
+		speedKmh = routeSpeedKmh()
+	}
+	if len(points) < 2 {
+		return nil
+	}
+	provider := getDistanceProvider(speedKmh)
+	fallback := utils.HaversineProvider{SpeedKmh: speedKmh}
+	legs := make([]utils.DistanceMatrixEntry, 0, len(points)-1)
+	for i := 1; i < len(points); i++ {
+		from, to := []utils.Coordinate{points[i-1]}, []utils.Coordinate{points[i]}
+		result, err := provider.Matrix(from, to)
+		if err != nil || len(result) == 0 || len(result[0]) == 0 {
+			result, _ = fallback.Matrix(from, to)
+		}
+		legs = append(legs, result[0][0])
+	}
+	return legs
+}
+
+// withinRoadDistance 判断各点与 (lat, lng) 的道路距离是否不超过 limit（公里），结果与 points 一一对应
+// 直线距离是道路距离的下界，先按直线距离排除，剩余的点一次请求距离矩阵；调用方应先关闭数据库游标再调用
+func withinRoadDistance(lat, lng float64, points []utils.Coordinate, limit float64) []bool {
+	within := make([]bool, len(points))
+	candidates := make([]utils.Coordinate, 0, len(points))
+	indexes := make([]int, 0, len(points))
+	for i, p := range points {
+		if utils.CalculateDistance(lat, lng, p.Lat, p.Lng) <= limit {
+			candidates = append(candidates, p)
+			indexes = append(indexes, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return within
+	}
+
+	result, err := GetDistanceProvider().Matrix([]utils.Coordinate{{Lat: lat, Lng: lng}}, candidates)
+	for k, i := range indexes {
+		distance := utils.CalculateDistance(lat, lng, candidates[k].Lat, candidates[k].Lng)
+		if err == nil && len(result) > 0 && k < len(result[0]) {
+			distance = result[0][k].DistanceKm
+		}
+		within[i] = distance <= limit
+	}
+	return within
+}
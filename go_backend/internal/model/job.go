@@ -0,0 +1,543 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 后台任务状态
+const (
+	JobStatusPending   = "pending"   // 待执行（含失败后等待重试）
+	JobStatusRunning   = "running"   // 执行中
+	JobStatusSucceeded = "succeeded" // 执行成功
+	JobStatusDead      = "dead"      // 重试次数耗尽，需人工处理
+)
+
+// 后台任务类型
+const (
+	JobOrderProfit          = "order_profit"           // 重新计算订单配送费和利润
+	JobOrderStatusHook      = "order_status_hook"      // 订单状态钩子
+	JobOrderSettlement      = "order_settlement"       // 计算订单销售分成
+	JobReferralRewardCreate = "referral_reward_create" // 新客首单创建推荐奖励记录
+	JobWechatShippingUpload = "wechat_shipping_upload" // 录入微信小程序发货信息
+	JobFeishuOrderNew       = "feishu_order_new"       // 飞书新订单通知
+	JobFeishuOrderPaid      = "feishu_order_paid"      // 飞书收款通知（微信支付回调）
+	JobFeishuOrderShortage  = "feishu_order_shortage"  // 飞书取货缺货通知
+	JobWechatReconciliation = "wechat_reconciliation"  // 每日微信支付账单对账
+	JobPointsExpiry         = "points_expiry"          // 每日作废到期积分
+	JobCouponExpiry         = "coupon_expiry"          // 每日标记过期优惠券并生成到期提醒
+	JobCouponExpiryPush     = "coupon_expiry_push"     // 推送优惠券到期提醒订阅消息
+	JobAutoDispatch         = "auto_dispatch"          // 自动派单（为待配送订单寻找配送员）
+	JobDispatchOfferTimeout = "dispatch_offer_timeout" // 派单邀请超时检查
+	JobShortageRefund       = "shortage_refund"        // 取货缺货退还差价（微信部分退款）
+	JobDeliveryFeeLock      = "delivery_fee_lock"      // 接单后按配送员批次计算并锁定配送费
+	JobRouteRecalculate     = "route_recalculate"      // 重新规划配送员路线
+	JobAfterSalesCompleted  = "after_sales_completed"  // 售后完成后扣回奖励积分、退回抵扣积分、重算销售分成
+)
+
+const (
+	defaultJobMaxAttempts = 8
+	jobPollInterval       = time.Second
+	jobStaleTimeout       = 10 * time.Minute   // 执行超过该时长视为进程中断，重新入队（可按任务类型调整）
+	jobRetentionPeriod    = 7 * 24 * time.Hour // 成功任务保留时长
+)
+
+// Job 后台任务
+type Job struct {
+	ID             int64      `json:"id"`
+	Type           string     `json:"type"`
+	Payload        string     `json:"payload"`
+	IdempotencyKey *string    `json:"idempotency_key,omitempty"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	MaxAttempts    int        `json:"max_attempts"`
+	RunAt          time.Time  `json:"run_at"`
+	LastError      *string    `json:"last_error,omitempty"`
+	LockedBy       *string    `json:"locked_by,omitempty"`
+	LockedAt       *time.Time `json:"locked_at,omitempty"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// JobOptions 入队选项
+type JobOptions struct {
+	IdempotencyKey string        // 幂等键，相同键的任务只入队一次
+	Delay          time.Duration // 延迟执行
+	MaxAttempts    int           // 最大执行次数，默认 8
+}
+
+// JobFilter 任务列表查询条件
+type JobFilter struct {
+	Type   string
+	Status string
+}
+
+// OrderJobPayload 以订单ID为参数的任务
+type OrderJobPayload struct {
+	OrderID int `json:"order_id"`
+}
+
+// OrderProfitJobPayload 订单配送费和利润重算任务参数
+type OrderProfitJobPayload struct {
+	OrderID             int  `json:"order_id"`
+	RefreshDeliveryInfo bool `json:"refresh_delivery_info"`
+	// RecalculateDeliveryFee 已接单订单也按当前商品重新计算配送员配送费（缺货调整商品后使用），完成后已结算订单重算销售分成
+	RecalculateDeliveryFee bool `json:"recalculate_delivery_fee,omitempty"`
+}
+
+// DeliveryFeeLockJobPayload 接单锁定配送费任务参数
+type DeliveryFeeLockJobPayload struct {
+	OrderID      int    `json:"order_id"`
+	EmployeeCode string `json:"employee_code"`
+}
+
+// RouteJobPayload 路线规划任务参数
+type RouteJobPayload struct {
+	EmployeeCode string   `json:"employee_code"`
+	Latitude     *float64 `json:"latitude"`
+	Longitude    *float64 `json:"longitude"`
+	IsNewOrder   bool     `json:"is_new_order"`
+}
+
+// AfterSalesJobPayload 售后完成后续处理任务参数
+type AfterSalesJobPayload struct {
+	RequestID int `json:"request_id"`
+}
+
+// DispatchOfferJobPayload 派单邀请超时检查任务参数
+type DispatchOfferJobPayload struct {
+	OfferID int `json:"offer_id"`
+}
+
+// JobHandler 任务处理函数，返回错误时按退避策略重试
+type JobHandler func(payload []byte) error
+
+var (
+	jobHandlers      = make(map[string]JobHandler)
+	jobStaleTimeouts = make(map[string]time.Duration)
+	jobWorkersStart  sync.Once
+)
+
+func init() {
+	RegisterJobHandler(JobOrderProfit, func(payload []byte) error {
+		var p OrderProfitJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return fmt.Errorf("解析任务参数失败: %v", err)
+		}
+		if p.RefreshDeliveryInfo {
+			if err := UpdateOrderDeliveryInfo(p.OrderID); err != nil {
+				log.Printf("[Job] 更新订单 %d 配送信息失败: %v", p.OrderID, err)
+			}
+		}
+		if p.RecalculateDeliveryFee {
+			return recalculateOrderDeliveryFee(p.OrderID)
+		}
+		return CalculateAndStoreOrderProfit(p.OrderID)
+	})
+	RegisterJobHandler(JobDeliveryFeeLock, func(payload []byte) error {
+		var p DeliveryFeeLockJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return fmt.Errorf("解析任务参数失败: %v", err)
+		}
+		return lockOrderDeliveryFee(p.OrderID, p.EmployeeCode)
+	})
+	RegisterJobHandler(JobOrderSettlement, func(payload []byte) error {
+		orderID, err := DecodeOrderJobPayload(payload)
+		if err != nil {
+			return err
+		}
+		return ProcessOrderSettlement(orderID)
+	})
+	RegisterJobHandler(JobReferralRewardCreate, func(payload []byte) error {
+		orderID, err := DecodeOrderJobPayload(payload)
+		if err != nil {
+			return err
+		}
+		return createReferralRewardForFirstOrder(orderID)
+	})
+}
+
+// RegisterJobHandler 注册任务处理函数，应在 init 中调用
+func RegisterJobHandler(jobType string, handler JobHandler) {
+	jobHandlers[jobType] = handler
+}
+
+// SetJobStaleTimeout 设置任务类型的超时回收时长（执行时间可能超过默认 10 分钟的任务使用），应在 init 中调用
+func SetJobStaleTimeout(jobType string, timeout time.Duration) {
+	jobStaleTimeouts[jobType] = timeout
+}
+
+// EnqueueJob 任务入队
+func EnqueueJob(jobType string, payload interface{}, opts JobOptions) error {
+	return enqueueJob(database.DB, jobType, payload, opts)
+}
+
+// EnqueueJobInTx 在业务事务内入队，保证业务数据和任务同时提交
+func EnqueueJobInTx(tx *sql.Tx, jobType string, payload interface{}, opts JobOptions) error {
+	return enqueueJob(tx, jobType, payload, opts)
+}
+
+// EnqueueOrderSettlementJob 入队订单销售分成计算任务
+func EnqueueOrderSettlementJob(orderID int) {
+	if err := EnqueueJob(JobOrderSettlement, OrderJobPayload{OrderID: orderID}, JobOptions{}); err != nil {
+		log.Printf("[Job] 订单 %d 分成计算任务入队失败: %v", orderID, err)
+	}
+}
+
+// enqueueOrderCreatedJobsInTx 订单创建事务内入队：首单推荐奖励记录、配送信息更新及利润计算
+func enqueueOrderCreatedJobsInTx(tx *sql.Tx, orderID int) error {
+	key := fmt.Sprintf("%s:%d", JobReferralRewardCreate, orderID)
+	if err := EnqueueJobInTx(tx, JobReferralRewardCreate, OrderJobPayload{OrderID: orderID}, JobOptions{IdempotencyKey: key}); err != nil {
+		return err
+	}
+	if err := EnqueueJobInTx(tx, JobOrderProfit, OrderProfitJobPayload{OrderID: orderID, RefreshDeliveryInfo: true}, JobOptions{}); err != nil {
+		return err
+	}
+	// 自动派单任务自行判断订单是否已进入待配送（在线支付订单在支付成功后由状态钩子触发）
+	dispatchKey := fmt.Sprintf("%s:%d", JobAutoDispatch, orderID)
+	return EnqueueJobInTx(tx, JobAutoDispatch, OrderJobPayload{OrderID: orderID}, JobOptions{IdempotencyKey: dispatchKey})
+}
+
+// EnqueueOrderProfitJob 入队订单配送费和利润重算任务，refreshDeliveryInfo 为 true 时先更新孤立状态、天气等配送信息
+func EnqueueOrderProfitJob(orderID int, refreshDeliveryInfo bool) {
+	payload := OrderProfitJobPayload{OrderID: orderID, RefreshDeliveryInfo: refreshDeliveryInfo}
+	if err := EnqueueJob(JobOrderProfit, payload, JobOptions{}); err != nil {
+		log.Printf("[Job] 订单 %d 利润计算任务入队失败: %v", orderID, err)
+	}
+}
+
+// EnqueueOrderRecalculationJob 入队订单商品调整后的重算任务：重新计算配送员配送费和利润，已结算订单随后重算销售分成
+func EnqueueOrderRecalculationJob(orderID int) {
+	payload := OrderProfitJobPayload{OrderID: orderID, RecalculateDeliveryFee: true}
+	if err := EnqueueJob(JobOrderProfit, payload, JobOptions{}); err != nil {
+		log.Printf("[Job] 订单 %d 重算任务入队失败: %v", orderID, err)
+	}
+}
+
+// recalculateOrderDeliveryFee 按订单当前商品和配送员重新计算配送费和利润，已结算订单入队销售分成重算
+func recalculateOrderDeliveryFee(orderID int) error {
+	calculator, err := NewDeliveryFeeCalculator(orderID)
+	if err != nil {
+		return err
+	}
+	if err := CalculateAndStoreOrderProfitWithCalculator(calculator, orderID); err != nil {
+		return err
+	}
+	// 未结算订单的分成在结算时按调整后的金额计算
+	if calculator.order.Status == OrderStatusPaid && calculator.order.SettlementDate != nil {
+		EnqueueOrderSettlementJob(orderID)
+	}
+	return nil
+}
+
+type jobExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func enqueueJob(db jobExecer, jobType string, payload interface{}, opts JobOptions) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("序列化任务参数失败: %v", err)
+	}
+	maxAttempts := opts.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultJobMaxAttempts
+	}
+	var key interface{}
+	if opts.IdempotencyKey != "" {
+		key = opts.IdempotencyKey
+	}
+	// 时间统一使用数据库时钟，避免应用与数据库时区不一致
+	// 幂等键冲突时忽略（任务已存在）
+	_, err = db.Exec(`
+		INSERT INTO background_jobs (type, payload, idempotency_key, status, max_attempts, run_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND), NOW(), NOW())
+		ON DUPLICATE KEY UPDATE id = id
+	`, jobType, string(data), key, JobStatusPending, maxAttempts, int(opts.Delay.Seconds()))
+	if err != nil {
+		return fmt.Errorf("任务入队失败: %v", err)
+	}
+	return nil
+}
+
+// StartJobWorkers 启动后台任务执行协程（进程内只启动一次）
+func StartJobWorkers(workers int) {
+	if workers <= 0 {
+		workers = 1
+	}
+	jobWorkersStart.Do(func() {
+		host, _ := os.Hostname()
+		// 领取标识为 主机名-进程号-协程序号-时间戳，截断过长的主机名以免超出 locked_by 字段长度
+		if len(host) > 100 {
+			host = host[:100]
+		}
+		for i := 0; i < workers; i++ {
+			go runJobWorker(fmt.Sprintf("%s-%d-%d", host, os.Getpid(), i))
+		}
+		go runJobMaintenance()
+		log.Printf("[Job] 已启动 %d 个后台任务执行协程", workers)
+	})
+}
+
+func runJobWorker(workerID string) {
+	for {
+		job, err := claimJob(workerID)
+		if err != nil {
+			log.Printf("[Job] %s 领取任务失败: %v", workerID, err)
+			time.Sleep(5 * jobPollInterval)
+			continue
+		}
+		if job == nil {
+			time.Sleep(jobPollInterval)
+			continue
+		}
+		executeJob(job)
+	}
+}
+
+// runJobMaintenance 定期回收中断的任务、清理过期的成功任务
+func runJobMaintenance() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := reclaimStaleJobs(); err != nil {
+			log.Printf("[Job] 回收中断任务失败: %v", err)
+		}
+		if _, err := database.DB.Exec(`
+			DELETE FROM background_jobs WHERE status = ? AND finished_at < DATE_SUB(NOW(), INTERVAL ? SECOND)
+		`, JobStatusSucceeded, int(jobRetentionPeriod.Seconds())); err != nil {
+			log.Printf("[Job] 清理过期任务失败: %v", err)
+		}
+	}
+}
+
+// reclaimStaleJobs 将执行超时的任务重新入队，单独设置了超时时长的任务类型按各自时长回收
+// 被回收的任务若原执行仍在进行，其结果因 locked_by 不匹配而被丢弃，以重新领取的执行为准
+func reclaimStaleJobs() error {
+	const reclaimSQL = `
+		UPDATE background_jobs
+		SET status = ?, locked_by = NULL, locked_at = NULL, last_error = '执行超时或进程中断', updated_at = NOW()
+		WHERE status = ? AND locked_at < DATE_SUB(NOW(), INTERVAL ? SECOND)`
+
+	args := []interface{}{JobStatusPending, JobStatusRunning, int(jobStaleTimeout.Seconds())}
+	query := reclaimSQL
+	if len(jobStaleTimeouts) > 0 {
+		placeholders := make([]string, 0, len(jobStaleTimeouts))
+		for jobType := range jobStaleTimeouts {
+			placeholders = append(placeholders, "?")
+			args = append(args, jobType)
+		}
+		query += " AND type NOT IN (" + strings.Join(placeholders, ",") + ")"
+	}
+	if _, err := database.DB.Exec(query, args...); err != nil {
+		return err
+	}
+	for jobType, timeout := range jobStaleTimeouts {
+		if _, err := database.DB.Exec(reclaimSQL+" AND type = ?", JobStatusPending, JobStatusRunning, int(timeout.Seconds()), jobType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimJob 领取一个到期的待执行任务（用唯一的 locked_by 标识领取结果，兼容不支持 SKIP LOCKED 的 MySQL 版本）
+func claimJob(workerID string) (*Job, error) {
+	token := fmt.Sprintf("%s-%d", workerID, time.Now().UnixNano())
+	result, err := database.DB.Exec(`
+		UPDATE background_jobs
+		SET status = ?, locked_by = ?, locked_at = NOW(), attempts = attempts + 1, updated_at = NOW()
+		WHERE status = ? AND run_at <= NOW()
+		ORDER BY run_at, id
+		LIMIT 1
+	`, JobStatusRunning, token, JobStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+	jobs, _, err := queryJobs("locked_by = ? AND status = ?", []interface{}{token, JobStatusRunning}, 1, 0)
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+	return &jobs[0], nil
+}
+
+func executeJob(job *Job) {
+	handler, ok := jobHandlers[job.Type]
+	var err error
+	if !ok {
+		err = fmt.Errorf("未注册的任务类型: %s", job.Type)
+	} else {
+		err = runJobHandler(handler, job)
+	}
+
+	// 只有仍持有领取标识时才写入结果：任务执行超时被回收并重新领取后，以新的执行为准
+	lockedBy := ""
+	if job.LockedBy != nil {
+		lockedBy = *job.LockedBy
+	}
+	var result sql.Result
+	var dbErr error
+	switch {
+	case err == nil:
+		result, dbErr = database.DB.Exec(`
+			UPDATE background_jobs
+			SET status = ?, last_error = NULL, locked_by = NULL, finished_at = NOW(), updated_at = NOW()
+			WHERE id = ? AND locked_by = ?
+		`, JobStatusSucceeded, job.ID, lockedBy)
+	case job.Attempts >= job.MaxAttempts:
+		log.Printf("[Job] 任务 %d(%s) 重试耗尽: %v", job.ID, job.Type, err)
+		result, dbErr = database.DB.Exec(`
+			UPDATE background_jobs
+			SET status = ?, last_error = ?, locked_by = NULL, finished_at = NOW(), updated_at = NOW()
+			WHERE id = ? AND locked_by = ?
+		`, JobStatusDead, err.Error(), job.ID, lockedBy)
+	default:
+		backoff := jobBackoff(job.Attempts)
+		log.Printf("[Job] 任务 %d(%s) 第 %d 次执行失败，%v 后重试: %v", job.ID, job.Type, job.Attempts, backoff, err)
+		result, dbErr = database.DB.Exec(`
+			UPDATE background_jobs
+			SET status = ?, last_error = ?, locked_by = NULL, locked_at = NULL, run_at = DATE_ADD(NOW(), INTERVAL ? SECOND), updated_at = NOW()
+			WHERE id = ? AND locked_by = ?
+		`, JobStatusPending, err.Error(), int(backoff.Seconds()), job.ID, lockedBy)
+	}
+	if dbErr != nil {
+		log.Printf("[Job] 更新任务 %d 状态失败: %v", job.ID, dbErr)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		log.Printf("[Job] 任务 %d(%s) 执行超时已被回收，忽略本次执行结果", job.ID, job.Type)
+	}
+}
+
+func runJobHandler(handler JobHandler, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("任务执行 panic: %v", r)
+			log.Printf("[Job] 任务 %d panic: %v\n%s", job.ID, r, debug.Stack())
+		}
+	}()
+	return handler([]byte(job.Payload))
+}
+
+// jobBackoff 重试退避：30s、1m、2m、4m ... 最长 1 小时
+func jobBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	if attempts > 8 {
+		return time.Hour
+	}
+	d := 30 * time.Second * time.Duration(1<<uint(attempts-1))
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// GetJobs 获取后台任务列表（分页）
+func GetJobs(filter JobFilter, pageNum, pageSize int) ([]Job, int, error) {
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+	where := "1=1"
+	args := []interface{}{}
+	if filter.Type != "" {
+		where += " AND type = ?"
+		args = append(args, filter.Type)
+	}
+	if filter.Status != "" {
+		where += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+	return queryJobs(where, args, pageSize, (pageNum-1)*pageSize)
+}
+
+// RetryJob 重新执行任务（重试耗尽或等待重试的任务立即执行，执行次数清零）
+func RetryJob(id int64) error {
+	result, err := database.DB.Exec(`
+		UPDATE background_jobs
+		SET status = ?, attempts = 0, run_at = NOW(), locked_by = NULL, locked_at = NULL, finished_at = NULL, updated_at = NOW()
+		WHERE id = ? AND status IN (?, ?)
+	`, JobStatusPending, id, JobStatusDead, JobStatusPending)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("任务不存在或不可重试")
+	}
+	return nil
+}
+
+func queryJobs(where string, args []interface{}, limit, offset int) ([]Job, int, error) {
+	var total int
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM background_jobs WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT id, type, payload, idempotency_key, status, attempts, max_attempts, run_at, last_error,
+		       locked_by, locked_at, finished_at, created_at, updated_at
+		FROM background_jobs
+		WHERE `+where+` ORDER BY id DESC LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	list := make([]Job, 0)
+	for rows.Next() {
+		var j Job
+		var key, lastError, lockedBy sql.NullString
+		var lockedAt, finishedAt sql.NullTime
+		if err := rows.Scan(&j.ID, &j.Type, &j.Payload, &key, &j.Status, &j.Attempts, &j.MaxAttempts, &j.RunAt, &lastError,
+			&lockedBy, &lockedAt, &finishedAt, &j.CreatedAt, &j.UpdatedAt); err != nil {
+			return nil, 0, err
+		}
+		if key.Valid {
+			j.IdempotencyKey = &key.String
+		}
+		if lastError.Valid {
+			j.LastError = &lastError.String
+		}
+		if lockedBy.Valid {
+			j.LockedBy = &lockedBy.String
+		}
+		if lockedAt.Valid {
+			t := lockedAt.Time
+			j.LockedAt = &t
+		}
+		if finishedAt.Valid {
+			t := finishedAt.Time
+			j.FinishedAt = &t
+		}
+		list = append(list, j)
+	}
+	return list, total, rows.Err()
+}
+
+// DecodeOrderJobPayload 解析以订单ID为参数的任务
+func DecodeOrderJobPayload(payload []byte) (int, error) {
+	var p OrderJobPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return 0, fmt.Errorf("解析任务参数失败: %v", err)
+	}
+	if p.OrderID <= 0 {
+		return 0, fmt.Errorf("任务缺少订单ID")
+	}
+	return p.OrderID, nil
+}
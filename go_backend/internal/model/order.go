@@ -31,6 +31,10 @@ type Order struct {
 	TotalAmount          float64    `json:"total_amount"`                     // 实际应付金额
 	Remark               string     `json:"remark"`                           // 备注
 	OutOfStockStrategy   string     `json:"out_of_stock_strategy"`            // 缺货处理：cancel_item/ship_available/contact_me
+	ShortageHold         bool       `json:"shortage_hold"`                    // 是否因缺货挂起待联系客户
+	ShortageAmount       float64    `json:"shortage_amount"`                  // 因缺货调减的订单金额（累计）
+	AfterSalesRefundAmount float64  `json:"after_sales_refund_amount"`        // 售后已退款金额（累计）
+	AfterSalesReturnedCost float64  `json:"after_sales_returned_cost"`        // 售后退货商品成本（累计）
 	TrustReceipt         bool       `json:"trust_receipt"`                    // 是否信任签收
 	HidePrice            bool       `json:"hide_price"`                       // 是否隐藏价格
 	RequirePhoneContact  bool       `json:"require_phone_contact"`            // 是否要求配送时电话联系
@@ -85,13 +89,15 @@ type OrderCreationOptions struct {
 	HidePrice           bool
 	RequirePhoneContact bool
 	PointsDiscount      float64
+	PointsUsed          int // 抵扣使用的积分数量（在事务内扣减）
 	CouponDiscount      float64
 	IsUrgent            bool
 	UrgentFee           float64
 	PriceModifications  map[int]PriceModificationInfo // 改价映射（采购单项ID -> 改价信息）
-	DeliveryFeeCouponID int                           // 免配送费券的用户优惠券ID（在事务内处理）
-	AmountCouponID      int                           // 金额券的用户优惠券ID（在事务内处理）
+	UserCouponIDs       []int                         // 使用的用户优惠券ID（可叠加多张，在事务内核销）
+	CouponSavings       map[int]float64               // 各张用户优惠券的实际优惠金额（用户优惠券ID -> 金额），核销时按券记录
 	PaymentMethod       string                        // 支付方式: online-在线支付, cod-货到付款（默认cod兼容老流程）
+	DeliverySlot        *DeliverySlotSelection        // 预约配送时段（在事务内占用容量）
 }
 
 // GenerateOrderNumber 生成订单编号
@@ -242,26 +248,10 @@ func CreateOrderFromPurchaseList(userID, addressID int, items []PurchaseListItem
 	}()
 
 	hasPriceModification := false
+	var promotionUses []PromotionUse
 	for _, it := range items {
-		// 计算原始价格（从规格快照获取）
-		var originalPrice float64
-		if userType == "wholesale" {
-			originalPrice = it.SpecSnapshot.WholesalePrice
-			if originalPrice <= 0 {
-				originalPrice = it.SpecSnapshot.RetailPrice
-			}
-		} else {
-			originalPrice = it.SpecSnapshot.RetailPrice
-			if originalPrice <= 0 {
-				originalPrice = it.SpecSnapshot.WholesalePrice
-			}
-		}
-		if originalPrice <= 0 {
-			originalPrice = it.SpecSnapshot.Cost
-		}
-		if originalPrice < 0 {
-			originalPrice = 0
-		}
+		// 计算原始价格（从规格快照获取，批发客户达到阶梯数量时按阶梯价）
+		originalPrice := ItemUnitPrice(it, userType)
 
 		// 检查是否有改价
 		var price float64
@@ -269,6 +259,8 @@ func CreateOrderFromPurchaseList(userID, addressID int, items []PurchaseListItem
 		var priceModReason *string
 		if opts.PriceModifications != nil {
 			if mod, hasMod := opts.PriceModifications[it.ID]; hasMod {
+				// 改价商品不再按限时促销价计价
+				ClearItemPromotion(&it.SpecSnapshot)
 				price = mod.UnitPrice
 				if price < 0 {
 					price = 0
@@ -290,6 +282,10 @@ func CreateOrderFromPurchaseList(userID, addressID int, items []PurchaseListItem
 		}
 
 		subtotal := price * float64(it.Quantity)
+		// 限时促销：促销数量按促销价，超出部分按原价，单价取均价
+		if promoPrice, promoSubtotal, ok := ItemPromotionPricing(it, userType); ok && !isPriceModified {
+			price, subtotal = promoPrice, promoSubtotal
+		}
 
 		// 准备插入SQL，包含改价相关字段
 		var originalPricePtr *float64
@@ -303,7 +299,7 @@ func CreateOrderFromPurchaseList(userID, addressID int, items []PurchaseListItem
 			return nil, nil, fmt.Errorf("序列化规格快照失败: %v", err)
 		}
 
-		if _, err = itemStmt.Exec(
+		itemRes, err := itemStmt.Exec(
 			orderID,
 			it.ProductID,
 			it.ProductName,
@@ -316,11 +312,17 @@ func CreateOrderFromPurchaseList(userID, addressID int, items []PurchaseListItem
 			originalPricePtr,
 			boolToTinyInt(isPriceModified),
 			priceModReason,
-		); err != nil {
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		itemID, err := itemRes.LastInsertId()
+		if err != nil {
 			return nil, nil, err
 		}
 
 		orderItems = append(orderItems, OrderItem{
+			ID:                      int(itemID),
 			OrderID:                 orderID,
 			ProductID:               it.ProductID,
 			ProductName:             it.ProductName,
@@ -334,6 +336,9 @@ func CreateOrderFromPurchaseList(userID, addressID int, items []PurchaseListItem
 			IsPriceModified:         isPriceModified,
 			PriceModificationReason: priceModReason,
 		})
+		if use, ok := ItemPromotionUse(it, int(itemID)); ok {
+			promotionUses = append(promotionUses, use)
+		}
 	}
 
 	// 如果订单包含改价商品，更新订单表的has_price_modification字段
@@ -344,23 +349,40 @@ func CreateOrderFromPurchaseList(userID, addressID int, items []PurchaseListItem
 		}
 	}
 
+	// 在事务内占用库存，库存不足时整单回滚
+	if err = ReserveOrderItemsStockInTx(tx, orderID, orderItems, true); err != nil {
+		return nil, nil, err
+	}
+	// 在事务内占用限时促销数量，促销已结束或售罄时整单回滚
+	if err = ReservePromotionsInTx(tx, userID, orderID, promotionUses, true); err != nil {
+		return nil, nil, err
+	}
+
 	// 在事务内处理优惠券使用（确保订单创建和优惠券标记在同一事务中）
-	// 处理免配送费券
-	if opts.DeliveryFeeCouponID > 0 {
-		if err := UseCouponByUserCouponIDInTx(tx, opts.DeliveryFeeCouponID, orderID); err != nil {
-			return nil, nil, fmt.Errorf("使用免配送费券失败: %v", err)
+	for _, userCouponID := range opts.UserCouponIDs {
+		if err := UseCouponByUserCouponIDInTx(tx, userCouponID, orderID, opts.CouponSavings[userCouponID]); err != nil {
+			return nil, nil, fmt.Errorf("使用优惠券失败: %v", err)
 		}
 	}
-	// 处理金额券
-	if opts.AmountCouponID > 0 {
-		if err := UseCouponByUserCouponIDInTx(tx, opts.AmountCouponID, orderID); err != nil {
-			return nil, nil, fmt.Errorf("使用金额券失败: %v", err)
-		}
+
+	// 在事务内扣减抵扣积分，余额不足时整单回滚
+	if err = DeductOrderPointsInTx(tx, userID, orderID, orderNumber, opts.PointsUsed, pointsDiscount, true); err != nil {
+		return nil, nil, err
+	}
+
+	// 在事务内占用配送时段容量，时段已满时整单回滚
+	if err = ReserveDeliverySlotInTx(tx, orderID, opts.DeliverySlot, TotalDeliveryUnits(items), true); err != nil {
+		return nil, nil, err
 	}
 
 	// 注意：不再在创建订单时清空采购单
 	// 采购单的清空和恢复由调用方（API层）处理，以便区分用户自己添加的商品和销售员添加的商品
 
+	// 推荐奖励记录和配送费/利润计算作为后台任务与订单一起提交，避免阻塞订单创建
+	if err := enqueueOrderCreatedJobsInTx(tx, orderID); err != nil {
+		return nil, nil, err
+	}
+
 	if err = tx.Commit(); err != nil {
 		return nil, nil, err
 	}
@@ -375,35 +397,6 @@ func CreateOrderFromPurchaseList(userID, addressID int, items []PurchaseListItem
 	}
 	_ = CreateDeliveryLog(deliveryLog) // 记录日志失败不影响主流程
 
-	// 检查是否是首次下单，如果是且有referrer_id，记录推荐奖励
-	go func() {
-		// 检查是否是首次下单（排除当前订单）
-		var count int
-		checkQuery := `
-			SELECT COUNT(*) FROM orders
-			WHERE user_id = ? AND id != ? AND status != 'cancelled'
-		`
-		err := database.DB.QueryRow(checkQuery, userID, orderID).Scan(&count)
-		if err == nil && count == 0 {
-			// 这是首次下单，获取用户信息，检查是否有referrer_id
-			user, err := GetMiniAppUserByID(userID)
-			if err == nil && user != nil && user.ReferrerID != nil {
-				// 创建推荐奖励记录（待发放状态）
-				_ = CreateReferralReward(*user.ReferrerID, userID, orderID, orderNumber)
-			}
-		}
-	}()
-
-	// 计算并存储配送费计算结果和利润信息
-	// 注意：这里在事务外执行，避免阻塞订单创建
-	go func() {
-		// 先更新订单的配送相关信息（孤立状态、天气信息等）
-		_ = UpdateOrderDeliveryInfo(orderID)
-
-		// 然后计算并存储配送费计算结果和利润（带重试机制）
-		_ = CalculateAndStoreOrderProfitWithRetry(orderID, 3)
-	}()
-
 	// 查询刚插入的订单记录
 	var order Order
 	var expectedDelivery sql.NullTime
@@ -463,14 +456,56 @@ func boolToTinyInt(v bool) int {
 	return 0
 }
 
-// CreateOrderFromCachedPrepay 从预支付缓存创建订单（支付回调时调用）
+// CreateOrderFromPrepaySnapshot 消费预支付快照并创建订单（支付回调、人工补单时调用）
 // orderNumber 即 out_trade_no；transactionID 为微信支付单号；直接创建为已支付、待配送状态
-func CreateOrderFromCachedPrepay(orderNumber, transactionID string, entry *CachedPrepayEntry) (*Order, []OrderItem, error) {
+// MySQL 存储下快照在建单事务内消费，建单失败回滚后快照仍为待支付，微信重试回调可再次建单；
+// 快照不可用时原样返回 ErrPrepayNotFound / ErrPrepayExpired / ErrPrepayConsumed
+func CreateOrderFromPrepaySnapshot(orderNumber, transactionID string, includeExpired bool) (*Order, *CachedPrepayEntry, error) {
+	store := GetPrepayStore()
+	if txStore, ok := store.(txPrepayStore); ok {
+		return createOrderFromCachedPrepay(orderNumber, transactionID, func(tx *sql.Tx) (*CachedPrepayEntry, error) {
+			return txStore.ConsumeInTx(tx, orderNumber, includeExpired)
+		})
+	}
+	// 不支持事务的存储（本地开发内存存储）：先消费，建单失败时撤销
+	entry, err := store.Consume(orderNumber, includeExpired)
+	if err != nil {
+		return nil, nil, err
+	}
+	order, _, err := createOrderFromCachedPrepay(orderNumber, transactionID, func(*sql.Tx) (*CachedPrepayEntry, error) {
+		return entry, nil
+	})
+	if err != nil {
+		_ = store.Restore(orderNumber)
+		return nil, nil, err
+	}
+	return order, entry, nil
+}
+
+// createOrderFromCachedPrepay 在同一事务内消费快照并建单，consume 返回错误时不建单
+func createOrderFromCachedPrepay(orderNumber, transactionID string, consume func(tx *sql.Tx) (*CachedPrepayEntry, error)) (*Order, *CachedPrepayEntry, error) {
+	now := time.Now()
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	entry, err := consume(tx)
+	if err != nil {
+		return nil, nil, err
+	}
 	if entry == nil || len(entry.Items) == 0 {
-		return nil, nil, fmt.Errorf("缓存数据无效")
+		err = fmt.Errorf("缓存数据无效")
+		return nil, nil, err
 	}
 	if entry.Summary == nil {
-		return nil, nil, fmt.Errorf("配送费汇总为空")
+		err = fmt.Errorf("配送费汇总为空")
+		return nil, nil, err
 	}
 	userID := entry.UserID
 	addressID := entry.AddressID
@@ -513,17 +548,6 @@ func CreateOrderFromCachedPrepay(orderNumber, transactionID string, entry *Cache
 		totalAmount = 0
 	}
 
-	now := time.Now()
-	tx, err := database.DB.Begin()
-	if err != nil {
-		return nil, nil, err
-	}
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-		}
-	}()
-
 	// 使用与 CreateOrderFromPurchaseList 相同的列顺序，避免列数不匹配错误
 	// 先插入基础字段，再 UPDATE 设置 paid_at 和 wechat_transaction_id
 	res, err := tx.Exec(`
@@ -564,49 +588,61 @@ func CreateOrderFromCachedPrepay(orderNumber, transactionID string, entry *Cache
 	defer func() { _ = itemStmt.Close() }()
 
 	orderItems := make([]OrderItem, 0, len(items))
+	var promotionUses []PromotionUse
 	for _, it := range items {
-		var originalPrice float64
-		if userType == "wholesale" {
-			originalPrice = it.SpecSnapshot.WholesalePrice
-			if originalPrice <= 0 {
-				originalPrice = it.SpecSnapshot.RetailPrice
-			}
-		} else {
-			originalPrice = it.SpecSnapshot.RetailPrice
-			if originalPrice <= 0 {
-				originalPrice = it.SpecSnapshot.WholesalePrice
-			}
-		}
-		if originalPrice <= 0 {
-			originalPrice = it.SpecSnapshot.Cost
-		}
-		if originalPrice < 0 {
-			originalPrice = 0
-		}
+		originalPrice := ItemUnitPrice(it, userType)
 		price := originalPrice
 		subtotal := price * float64(it.Quantity)
+		if promoPrice, promoSubtotal, ok := ItemPromotionPricing(it, userType); ok {
+			price, subtotal = promoPrice, promoSubtotal
+		}
 		specSnapshotJSON, _ := json.Marshal(it.SpecSnapshot)
-		_, err = itemStmt.Exec(orderID, it.ProductID, it.ProductName, it.SpecName, string(specSnapshotJSON), it.Quantity, price, subtotal, it.ProductImage, &originalPrice, 0, nil)
+		var itemRes sql.Result
+		itemRes, err = itemStmt.Exec(orderID, it.ProductID, it.ProductName, it.SpecName, string(specSnapshotJSON), it.Quantity, price, subtotal, it.ProductImage, &originalPrice, 0, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		var itemID int64
+		itemID, err = itemRes.LastInsertId()
 		if err != nil {
 			return nil, nil, err
 		}
 		orderItems = append(orderItems, OrderItem{
-			OrderID: orderID, ProductID: it.ProductID, ProductName: it.ProductName, SpecName: it.SpecName,
+			ID: int(itemID), OrderID: orderID, ProductID: it.ProductID, ProductName: it.ProductName, SpecName: it.SpecName,
 			SpecSnapshot: &it.SpecSnapshot, Quantity: it.Quantity, UnitPrice: price, Subtotal: subtotal, Image: it.ProductImage,
 		})
+		if use, ok := ItemPromotionUse(it, int(itemID)); ok {
+			promotionUses = append(promotionUses, use)
+		}
 	}
 
-	if opts.DeliveryFeeCouponID > 0 {
-		if err := UseCouponByUserCouponIDInTx(tx, opts.DeliveryFeeCouponID, orderID); err != nil {
-			return nil, nil, fmt.Errorf("使用免配送费券失败: %v", err)
-		}
+	// 用户已付款，库存不足时也不能让订单创建失败，按超卖占用，取货时由缺货策略处理
+	if err = ReserveOrderItemsStockInTx(tx, orderID, orderItems, false); err != nil {
+		return nil, nil, err
+	}
+	// 用户已按促销价付款，促销变化时照常占用
+	if err = ReservePromotionsInTx(tx, userID, orderID, promotionUses, false); err != nil {
+		return nil, nil, err
 	}
-	if opts.AmountCouponID > 0 {
-		if err := UseCouponByUserCouponIDInTx(tx, opts.AmountCouponID, orderID); err != nil {
-			return nil, nil, fmt.Errorf("使用金额券失败: %v", err)
+
+	for _, userCouponID := range opts.UserCouponIDs {
+		if err = UseCouponByUserCouponIDInTx(tx, userCouponID, orderID, opts.CouponSavings[userCouponID]); err != nil {
+			return nil, nil, fmt.Errorf("使用优惠券失败: %v", err)
 		}
 	}
 
+	// 用户已付款，积分余额变化时只扣减现有余额，不让订单创建失败
+	if err = DeductOrderPointsInTx(tx, userID, orderID, orderNumber, opts.PointsUsed, pointsDiscount, false); err != nil {
+		return nil, nil, err
+	}
+	if err = ReserveDeliverySlotInTx(tx, orderID, opts.DeliverySlot, TotalDeliveryUnits(items), false); err != nil {
+		return nil, nil, err
+	}
+
+	if err = enqueueOrderCreatedJobsInTx(tx, orderID); err != nil {
+		return nil, nil, err
+	}
+
 	if err = tx.Commit(); err != nil {
 		return nil, nil, err
 	}
@@ -614,27 +650,11 @@ func CreateOrderFromCachedPrepay(orderNumber, transactionID string, entry *Cache
 	remark := "订单创建（支付成功）"
 	_ = CreateDeliveryLog(&DeliveryLog{OrderID: orderID, Action: DeliveryLogActionCreated, ActionTime: now, Remark: &remark})
 
-	go func() {
-		var count int
-		_ = database.DB.QueryRow("SELECT COUNT(*) FROM orders WHERE user_id = ? AND id != ? AND status != 'cancelled'", userID, orderID).Scan(&count)
-		if count == 0 {
-			user, _ := GetMiniAppUserByID(userID)
-			if user != nil && user.ReferrerID != nil {
-				_ = CreateReferralReward(*user.ReferrerID, userID, orderID, orderNumber)
-			}
-		}
-	}()
-
-	go func() {
-		_ = UpdateOrderDeliveryInfo(orderID)
-		_ = CalculateAndStoreOrderProfitWithRetry(orderID, 3)
-	}()
-
 	order, err := GetOrderByID(orderID)
 	if err != nil || order == nil {
-		return nil, orderItems, fmt.Errorf("订单创建成功但查询失败")
+		return nil, entry, fmt.Errorf("订单创建成功但查询失败")
 	}
-	return order, orderItems, nil
+	return order, entry, nil
 }
 
 // CachedPrepayEntry 预支付缓存条目（model 层结构，与 api.PrepayCacheEntry 对应）
@@ -827,10 +847,12 @@ func GetOrderByID(id int) (*Order, error) {
 		       coupon_discount, is_urgent, urgent_fee, total_amount, remark, out_of_stock_strategy, trust_receipt,
 		       hide_price, require_phone_contact, expected_delivery_at, weather_info, is_isolated, 
 		       is_locked, locked_by, locked_at, order_profit, settlement_date, delivery_fee_settled,
-		       payment_method, paid_at, wechat_transaction_id, refund_status, wechat_refund_id, order_source, created_at, updated_at
+		       payment_method, paid_at, wechat_transaction_id, refund_status, wechat_refund_id, order_source, created_at, updated_at,
+		       shortage_hold, shortage_amount, after_sales_refund_amount, after_sales_returned_cost
 		FROM orders WHERE id = ?
 	`
 	var isUrgentTinyInt, hidePriceTinyInt, trustReceiptTinyInt, requirePhoneContactTinyInt, isIsolatedTinyInt, isLockedTinyInt, deliveryFeeSettledTinyInt int
+	var shortageHoldTinyInt int
 	var deliveryEmployeeCode, lockedBy sql.NullString
 	var lockedAt, settlementDate sql.NullTime
 	var orderProfit sql.NullFloat64
@@ -841,6 +863,7 @@ func GetOrderByID(id int) (*Order, error) {
 		&expectedDelivery, &weatherInfo, &isIsolatedTinyInt, &isLockedTinyInt, &lockedBy, &lockedAt,
 		&orderProfit, &settlementDate, &deliveryFeeSettledTinyInt,
 		&paymentMethodVal, &paidAt, &wechatTransactionID, &refundStatus, &wechatRefundID, &orderSource, &order.CreatedAt, &order.UpdatedAt,
+		&shortageHoldTinyInt, &order.ShortageAmount, &order.AfterSalesRefundAmount, &order.AfterSalesReturnedCost,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -848,6 +871,7 @@ func GetOrderByID(id int) (*Order, error) {
 		}
 		return nil, err
 	}
+	order.ShortageHold = shortageHoldTinyInt == 1
 	order.IsUrgent = isUrgentTinyInt == 1
 	order.TrustReceipt = trustReceiptTinyInt == 1
 	order.HidePrice = hidePriceTinyInt == 1
@@ -908,6 +932,11 @@ func GetOrderByID(id int) (*Order, error) {
 	return &order, nil
 }
 
+// PaidTotal 订单原支付总额：当前订单金额 + 因缺货已调减的金额（微信退款的订单总额必须为原支付金额）
+func (o *Order) PaidTotal() float64 {
+	return roundMoney(o.TotalAmount + o.ShortageAmount)
+}
+
 // NeedWechatRefundOnCancel 判断取消订单时是否需要发起微信退款
 // 条件：已支付且为微信支付（在线支付或货到付款提前通过去付款支付）
 func (o *Order) NeedWechatRefundOnCancel() bool {
@@ -1022,7 +1051,7 @@ func GetOrderByOrderNumber(orderNumber string) (*Order, error) {
 }
 
 // MarkOrderPaidByWechatPay 微信支付回调成功后标记订单已支付
-// 更新 paid_at，若状态为 delivered/shipped 则设为 paid 并触发结算
+// 更新 paid_at，并按状态机推进订单状态：pending_payment -> pending_delivery，delivered/shipped -> paid
 func MarkOrderPaidByWechatPay(orderID int, transactionID string) error {
 	order, err := GetOrderByID(orderID)
 	if err != nil || order == nil {
@@ -1032,38 +1061,45 @@ func MarkOrderPaidByWechatPay(orderID int, transactionID string) error {
 		return nil // 已支付，幂等
 	}
 
-	now := time.Now()
-	// 更新 paid_at、wechat_transaction_id；若为待支付则进入配送流程(pending_delivery)，若已送达则设为 paid
-	_, err = database.DB.Exec(`
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 更新 paid_at、wechat_transaction_id
+	result, err := tx.Exec(`
 		UPDATE orders
-		SET paid_at = ?, wechat_transaction_id = ?, status = CASE
-			WHEN status IN ('delivered', 'shipped') THEN 'paid'
-			WHEN status = 'pending_payment' THEN 'pending_delivery'
-			ELSE status
-		END, updated_at = NOW()
+		SET paid_at = ?, wechat_transaction_id = ?, updated_at = NOW()
 		WHERE id = ? AND (paid_at IS NULL)
-	`, now, transactionID, orderID)
+	`, time.Now(), transactionID, orderID)
 	if err != nil {
 		return err
 	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil // 并发回调已处理
+	}
 
-	// 若状态变为 paid，需触发结算（与 order_admin 一致）
-	order, _ = GetOrderByID(orderID)
-	if order != nil && order.Status == "paid" {
-		// 设置 settlement_date
-		_, _ = database.DB.Exec("UPDATE orders SET settlement_date = ? WHERE id = ? AND settlement_date IS NULL", now, orderID)
-		// 异步执行结算逻辑
-		go func(oid int) {
-			time.Sleep(100 * time.Millisecond)
-			ord, _ := GetOrderByID(oid)
-			if ord == nil {
-				return
-			}
-			_ = ProcessOrderSettlement(oid)
-			_ = ProcessReferralReward(oid)
-			_ = AddPointsForOrder(ord.UserID, oid, ord.OrderNumber, ord.TotalAmount)
-		}(orderID)
+	// 若为待支付则进入配送流程(pending_delivery)，若已送达则设为 paid（进入 paid 时由状态钩子触发结算）
+	var status string
+	if err := tx.QueryRow("SELECT status FROM orders WHERE id = ? FOR UPDATE", orderID).Scan(&status); err != nil {
+		return err
 	}
+	var change *OrderStatusChange
+	actor := OrderActor{Type: OrderActorWechatPay, ID: transactionID}
+	switch status {
+	case OrderStatusPendingPayment:
+		change, err = TransitionOrderStatusInTx(tx, orderID, OrderStatusPendingDelivery, actor, "微信支付成功")
+	case OrderStatusDelivered, OrderStatusShipped:
+		change, err = TransitionOrderStatusInTx(tx, orderID, OrderStatusPaid, actor, "送达后微信支付成功")
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	AfterOrderStatusChanged(change)
 
 	return nil
 }
@@ -1790,105 +1826,101 @@ func CancelExpiredPendingPaymentOrders() (int, error) {
 		orderIDs = append(orderIDs, id)
 	}
 
+	cancelled := 0
 	for _, orderID := range orderIDs {
-		_ = UpdateOrderStatus(orderID, "cancelled")
-		// 清理分成记录
-		go func(oid int) {
-			_ = CancelOrderCommissions(oid)
-		}(orderID)
+		if err := TransitionOrderStatus(orderID, OrderStatusCancelled, OrderActor{Type: OrderActorSystem}, "支付超时自动取消"); err != nil {
+			log.Printf("[CancelExpiredPendingPaymentOrders] 取消订单 %d 失败: %v", orderID, err)
+			continue
+		}
+		cancelled++
 	}
-	return len(orderIDs), nil
+	return cancelled, nil
 }
 
-// UpdateOrderStatus 更新订单状态
-func UpdateOrderStatus(orderID int, newStatus string) error {
-	query := "UPDATE orders SET status = ?, updated_at = NOW() WHERE id = ?"
-	_, err := database.DB.Exec(query, newStatus, orderID)
-	if err != nil {
-		return err
-	}
-
-	// 如果订单被取消，更新受影响订单的孤立状态
-	if newStatus == "cancelled" {
-		go func() {
-			// 更新受影响订单的孤立状态（因为当前订单被取消）
-			_ = updateAffectedOrdersIsolatedStatus(orderID)
-		}()
-	}
-
-	// 更新订单状态后，重新计算配送费和利润（异步执行，避免阻塞）
-	go func() {
-		_ = CalculateAndStoreOrderProfitWithRetry(orderID, 3)
-	}()
+// UpdateOrderStatusWithDeliveryEmployee 更新订单状态并记录配送员信息（配送员接单）
+func UpdateOrderStatusWithDeliveryEmployee(orderID int, newStatus string, deliveryEmployeeCode string) error {
+	return assignOrderDeliveryEmployee(orderID, newStatus, deliveryEmployeeCode, OrderActor{Type: OrderActorEmployee, ID: deliveryEmployeeCode}, "配送员接单")
+}
 
-	return nil
+// AssignOrderToDeliveryEmployee 管理员调度派单：订单转为待取货并指定配送员
+func AssignOrderToDeliveryEmployee(orderID int, deliveryEmployeeCode, operator string) error {
+	return assignOrderDeliveryEmployee(orderID, "pending_pickup", deliveryEmployeeCode, OrderActor{Type: OrderActorAdmin, ID: operator}, "调度派单给配送员 "+deliveryEmployeeCode)
 }
 
-// UpdateOrderStatusWithDeliveryEmployee 更新订单状态并记录配送员信息
-func UpdateOrderStatusWithDeliveryEmployee(orderID int, newStatus string, deliveryEmployeeCode string) error {
-	// 在更新时检查订单是否被锁定，防止在修改期间被接单
-	query := `
-		UPDATE orders 
-		SET status = ?, delivery_employee_code = ?, updated_at = NOW() 
-		WHERE id = ? 
-		  AND (is_locked = 0 OR is_locked IS NULL)
-	`
-	result, err := database.DB.Exec(query, newStatus, deliveryEmployeeCode, orderID)
+func assignOrderDeliveryEmployee(orderID int, newStatus string, deliveryEmployeeCode string, actor OrderActor, reason string) error {
+	tx, err := database.DB.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
+	// 在更新时检查订单是否被锁定，防止在修改期间被接单
+	var isLockedTinyInt int
+	err = tx.QueryRow("SELECT COALESCE(is_locked, 0) FROM orders WHERE id = ? FOR UPDATE", orderID).Scan(&isLockedTinyInt)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("订单不存在")
+	}
 	if err != nil {
 		return err
 	}
+	if isLockedTinyInt == 1 {
+		return fmt.Errorf("订单已被锁定，无法接单")
+	}
 
-	if rowsAffected == 0 {
-		// 检查订单是否被锁定
-		var isLockedTinyInt int
-		err := database.DB.QueryRow("SELECT COALESCE(is_locked, 0) FROM orders WHERE id = ?", orderID).Scan(&isLockedTinyInt)
-		if err == nil && isLockedTinyInt == 1 {
-			return fmt.Errorf("订单已被锁定，无法接单")
-		}
+	change, err := TransitionOrderStatusInTx(tx, orderID, newStatus, actor, reason)
+	if err != nil {
 		return fmt.Errorf("订单不存在或已被其他配送员接单")
 	}
-
-	// 如果状态变为 pending_pickup（接单），立即计算并锁定配送费
+	if _, err := tx.Exec("UPDATE orders SET delivery_employee_code = ? WHERE id = ?", deliveryEmployeeCode, orderID); err != nil {
+		return err
+	}
+	// 如果状态变为 pending_pickup（接单），入队计算并锁定配送费（锁定配送费，确保接单前后一致）
 	// 使用基于该配送员批次的判断（与预览时一致）
 	if newStatus == "pending_pickup" {
-		// 立即计算并存储配送费（锁定配送费，确保接单前后一致）
-		go func() {
-			// 使用基于配送员批次的判断重新计算孤立状态和配送费
-			calculator, err := NewDeliveryFeeCalculatorForEmployee(orderID, deliveryEmployeeCode)
-			if err == nil {
-				// 重新计算孤立状态（基于配送员批次）
-				address, err := GetAddressByID(calculator.order.AddressID)
-				if err == nil && address != nil && address.Latitude != nil && address.Longitude != nil {
-					isolatedDistance := calculator.getConfigFloat("delivery_isolated_distance", 8.0)
-					nearbyOrders, err := calculator.getNearbyOrders(*address.Latitude, *address.Longitude, isolatedDistance)
-					if err == nil {
-						validNearby := calculator.filterNearbyOrders(nearbyOrders)
-						isIsolated := len(validNearby) == 0
-						
-						// 更新孤立状态
-						_, _ = database.DB.Exec(`
-							UPDATE orders 
-							SET is_isolated = ?, updated_at = NOW()
-							WHERE id = ?
-						`, isIsolated, orderID)
-					}
-				}
-				
-				// 计算并锁定配送费
-				_ = CalculateAndStoreOrderProfitWithCalculator(calculator, orderID)
+		key := fmt.Sprintf("%s:%d:%s", JobDeliveryFeeLock, orderID, deliveryEmployeeCode)
+		payload := DeliveryFeeLockJobPayload{OrderID: orderID, EmployeeCode: deliveryEmployeeCode}
+		if err := EnqueueJobInTx(tx, JobDeliveryFeeLock, payload, JobOptions{IdempotencyKey: key}); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	AfterOrderStatusChanged(change)
+	return nil
+}
+
+// lockOrderDeliveryFee 接单后按配送员批次重新计算孤立状态并计算、锁定配送费，同时更新受影响订单的孤立状态
+func lockOrderDeliveryFee(orderID int, deliveryEmployeeCode string) error {
+	calculator, err := NewDeliveryFeeCalculatorForEmployee(orderID, deliveryEmployeeCode)
+	if err != nil {
+		return err
+	}
+	// 重新计算孤立状态（基于配送员批次）
+	address, err := GetAddressByID(calculator.order.AddressID)
+	if err == nil && address != nil && address.Latitude != nil && address.Longitude != nil {
+		isolatedDistance := calculator.getConfigFloat("delivery_isolated_distance", 8.0)
+		nearbyOrders, err := calculator.getNearbyOrders(*address.Latitude, *address.Longitude, isolatedDistance)
+		if err == nil {
+			validNearby := calculator.filterNearbyOrders(nearbyOrders)
+			isIsolated := len(validNearby) == 0
+			if _, err := database.DB.Exec(`
+				UPDATE orders
+				SET is_isolated = ?, updated_at = NOW()
+				WHERE id = ?
+			`, isIsolated, orderID); err != nil {
+				return err
 			}
-			
-			// 更新受影响订单的孤立状态（因为当前订单从"未接单"变为"已接单"）
-			_ = updateAffectedOrdersIsolatedStatus(orderID)
-		}()
+		}
 	}
 
-	return nil
+	// 计算并锁定配送费
+	if err := CalculateAndStoreOrderProfitWithCalculator(calculator, orderID); err != nil {
+		return err
+	}
+
+	// 更新受影响订单的孤立状态（因为当前订单从"未接单"变为"已接单"）
+	return updateAffectedOrdersIsolatedStatus(orderID)
 }
 
 // LockOrder 锁定订单（防止修改时被接单）
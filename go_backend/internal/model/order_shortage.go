@@ -0,0 +1,531 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 缺货处理策略（与订单 out_of_stock_strategy 一致）
+const (
+	OutOfStockCancelItem    = "cancel_item"    // 缺货商品整项取消
+	OutOfStockShipAvailable = "ship_available" // 有多少发多少
+	OutOfStockContactMe     = "contact_me"     // 联系客户后再处理
+)
+
+// 缺货记录状态
+const (
+	ShortageStatusPending = "pending" // 待联系客户
+	ShortageStatusApplied = "applied" // 已处理
+)
+
+// ShortageReport 配送员上报的缺货明细
+type ShortageReport struct {
+	ItemID            int `json:"item_id"`            // 订单明细ID
+	AvailableQuantity int `json:"available_quantity"` // 实际可取数量（0 表示完全缺货）
+}
+
+// OrderItemShortage 订单取货缺货记录
+type OrderItemShortage struct {
+	ID                int        `json:"id"`
+	OrderID           int        `json:"order_id"`
+	OrderItemID       int        `json:"order_item_id"`
+	ProductID         int        `json:"product_id"`
+	ProductName       string     `json:"product_name"`
+	SpecName          string     `json:"spec_name"`
+	UnitPrice         float64    `json:"unit_price"`
+	OriginalQuantity  int        `json:"original_quantity"`
+	AvailableQuantity int        `json:"available_quantity"`
+	ShippedQuantity   int        `json:"shipped_quantity"`
+	ReducedAmount     float64    `json:"reduced_amount"`
+	Strategy          string     `json:"strategy"`
+	Status            string     `json:"status"`
+	ReportedBy        string     `json:"reported_by"`
+	ResolvedBy        *string    `json:"resolved_by,omitempty"`
+	ResolvedAt        *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+// ShortageResult 缺货处理结果
+type ShortageResult struct {
+	OrderID        int                 `json:"order_id"`
+	Strategy       string              `json:"strategy"`
+	Held           bool                `json:"held"`             // 是否挂起待联系客户
+	OldTotalAmount float64             `json:"old_total_amount"` // 处理前订单金额
+	NewTotalAmount float64             `json:"new_total_amount"` // 处理后订单金额
+	RemainingItems int                 `json:"remaining_items"`  // 剩余商品项数（0 表示整单缺货）
+	PickedItemIDs  []int               `json:"-"`                // 部分发货并标记已取货的明细ID（需扣减库存）
+	StatusChange   *OrderStatusChange  `json:"-"`                // 整单缺货时的取消变更，提交后需调用 AfterOrderStatusChanged
+	Shortages      []OrderItemShortage `json:"shortages"`
+}
+
+// ShortageRefundJobPayload 缺货退款任务参数，ShortageID 为本次处理的最后一条缺货记录，用作幂等键和商户退款单号
+type ShortageRefundJobPayload struct {
+	OrderID    int     `json:"order_id"`
+	ShortageID int     `json:"shortage_id"`
+	Amount     float64 `json:"amount"`
+	Reason     string  `json:"reason"`
+}
+
+// ReportOrderShortages 配送员取货时上报缺货，并按订单的缺货处理策略自动处理
+// cancel_item：缺货商品整项取消；ship_available：按可取数量发货；contact_me：订单挂起，等待客服联系客户后处理
+func ReportOrderShortages(orderID int, reports []ShortageReport, employeeCode string) (*ShortageResult, error) {
+	if len(reports) == 0 {
+		return nil, fmt.Errorf("缺货明细为空")
+	}
+	order, err := GetOrderByID(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		return nil, fmt.Errorf("订单不存在")
+	}
+	if order.Status != "pending_pickup" {
+		return nil, fmt.Errorf("订单状态不允许上报缺货（当前状态：%s）", order.Status)
+	}
+
+	strategy := order.OutOfStockStrategy
+	if strategy != OutOfStockCancelItem && strategy != OutOfStockShipAvailable {
+		strategy = OutOfStockContactMe
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 锁定订单后重新校验，避免并发上报按过期的订单金额重复计算
+	if err := lockOrderForShortageInTx(tx, order); err != nil {
+		return nil, err
+	}
+	if order.Status != "pending_pickup" {
+		return nil, fmt.Errorf("订单状态不允许上报缺货（当前状态：%s）", order.Status)
+	}
+
+	shortages := make([]OrderItemShortage, 0, len(reports))
+	for _, r := range reports {
+		s := OrderItemShortage{
+			OrderID:           orderID,
+			OrderItemID:       r.ItemID,
+			AvailableQuantity: r.AvailableQuantity,
+			Strategy:          strategy,
+			Status:            ShortageStatusPending,
+			ReportedBy:        employeeCode,
+		}
+		var isPicked int
+		err := tx.QueryRow(`
+			SELECT product_id, product_name, spec_name, unit_price, quantity, is_picked
+			FROM order_items WHERE id = ? AND order_id = ?
+			FOR UPDATE
+		`, r.ItemID, orderID).Scan(&s.ProductID, &s.ProductName, &s.SpecName, &s.UnitPrice, &s.OriginalQuantity, &isPicked)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("订单商品 %d 不存在", r.ItemID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isPicked == 1 {
+			return nil, fmt.Errorf("%s 已取货，不能上报缺货", s.ProductName)
+		}
+		if r.AvailableQuantity < 0 || r.AvailableQuantity >= s.OriginalQuantity {
+			return nil, fmt.Errorf("%s 可取数量应在 0 到 %d 之间", s.ProductName, s.OriginalQuantity-1)
+		}
+
+		// 同一商品重复上报时以最新一次为准
+		if _, err := tx.Exec(`
+			DELETE FROM order_item_shortages WHERE order_item_id = ? AND status = ?
+		`, r.ItemID, ShortageStatusPending); err != nil {
+			return nil, err
+		}
+		shortages = append(shortages, s)
+	}
+
+	result := &ShortageResult{
+		OrderID:        orderID,
+		Strategy:       strategy,
+		OldTotalAmount: order.TotalAmount,
+		NewTotalAmount: order.TotalAmount,
+	}
+
+	if strategy == OutOfStockContactMe {
+		for i := range shortages {
+			if err := insertOrderItemShortageInTx(tx, &shortages[i]); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := tx.Exec(`UPDATE orders SET shortage_hold = 1, updated_at = NOW() WHERE id = ?`, orderID); err != nil {
+			return nil, fmt.Errorf("挂起订单失败: %v", err)
+		}
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM order_items WHERE order_id = ?`, orderID).Scan(&result.RemainingItems); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		result.Held = true
+		result.Shortages = shortages
+		return result, nil
+	}
+
+	actor := OrderActor{Type: OrderActorEmployee, ID: employeeCode}
+	if err := applyOrderShortagesInTx(tx, order, shortages, strategy, nil, actor, result); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ResolveOrderShortages 处理挂起的缺货订单（客服联系客户后选择取消缺货商品或按可取数量发货）
+func ResolveOrderShortages(orderID int, strategy string, operator string) (*ShortageResult, error) {
+	if strategy != OutOfStockCancelItem && strategy != OutOfStockShipAvailable {
+		return nil, fmt.Errorf("处理方式无效")
+	}
+	order, err := GetOrderByID(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		return nil, fmt.Errorf("订单不存在")
+	}
+	if !order.ShortageHold {
+		return nil, fmt.Errorf("订单没有待处理的缺货")
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockOrderForShortageInTx(tx, order); err != nil {
+		return nil, err
+	}
+	if !order.ShortageHold {
+		return nil, fmt.Errorf("订单没有待处理的缺货")
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, order_item_id, product_id, product_name, spec_name, unit_price, original_quantity, available_quantity, reported_by, created_at
+		FROM order_item_shortages
+		WHERE order_id = ? AND status = ?
+		ORDER BY id
+		FOR UPDATE
+	`, orderID, ShortageStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	shortages := make([]OrderItemShortage, 0)
+	for rows.Next() {
+		s := OrderItemShortage{OrderID: orderID, Status: ShortageStatusPending}
+		if err := rows.Scan(&s.ID, &s.OrderItemID, &s.ProductID, &s.ProductName, &s.SpecName, &s.UnitPrice,
+			&s.OriginalQuantity, &s.AvailableQuantity, &s.ReportedBy, &s.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		shortages = append(shortages, s)
+	}
+	rows.Close()
+
+	result := &ShortageResult{
+		OrderID:        orderID,
+		Strategy:       strategy,
+		OldTotalAmount: order.TotalAmount,
+		NewTotalAmount: order.TotalAmount,
+	}
+	actor := OrderActor{Type: OrderActorAdmin, ID: operator}
+	if err := applyOrderShortagesInTx(tx, order, shortages, strategy, &operator, actor, result); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// lockOrderForShortageInTx 锁定订单行，并用最新的状态和金额覆盖事务外读取的订单
+// 缺货金额按锁定后的订单金额计算，并发上报或处理时后一个请求看到的是前一个提交后的金额
+func lockOrderForShortageInTx(tx *sql.Tx, order *Order) error {
+	var shortageHold int
+	err := tx.QueryRow(`
+		SELECT status, shortage_hold, goods_amount, delivery_fee, coupon_discount, total_amount, shortage_amount
+		FROM orders WHERE id = ? FOR UPDATE
+	`, order.ID).Scan(&order.Status, &shortageHold, &order.GoodsAmount, &order.DeliveryFee, &order.CouponDiscount,
+		&order.TotalAmount, &order.ShortageAmount)
+	if err != nil {
+		return fmt.Errorf("锁定订单失败: %v", err)
+	}
+	order.ShortageHold = shortageHold == 1
+	return nil
+}
+
+// applyOrderShortagesInTx 按策略调整订单明细、释放缺货部分的库存占用，并重新计算订单金额
+// 客户配送费保持不变（不因缺货向客户加收配送费），订单金额 = 商品金额 + 配送费 + 加急费 - 积分抵扣 - 优惠券抵扣
+// 整单缺货时在同一事务内取消订单，actor 为取消操作人
+func applyOrderShortagesInTx(tx *sql.Tx, order *Order, shortages []OrderItemShortage, strategy string, resolvedBy *string, actor OrderActor, result *ShortageResult) error {
+	now := time.Now()
+	for i := range shortages {
+		s := &shortages[i]
+		s.Strategy = strategy
+		s.ShippedQuantity = 0
+		if strategy == OutOfStockShipAvailable {
+			s.ShippedQuantity = s.AvailableQuantity
+		}
+		short := s.OriginalQuantity - s.ShippedQuantity
+		s.ReducedAmount = math.Round(s.UnitPrice*float64(short)*100) / 100
+
+		if err := ReleaseOrderItemStockInTx(tx, s.OrderItemID, short, "取货缺货释放库存"); err != nil {
+			return err
+		}
+
+		if s.ShippedQuantity == 0 {
+			if _, err := tx.Exec(`DELETE FROM order_items WHERE id = ? AND order_id = ?`, s.OrderItemID, order.ID); err != nil {
+				return fmt.Errorf("取消缺货商品失败: %v", err)
+			}
+		} else {
+			if _, err := tx.Exec(`
+				UPDATE order_items SET quantity = ?, subtotal = unit_price * ?, is_picked = 1 WHERE id = ? AND order_id = ?
+			`, s.ShippedQuantity, s.ShippedQuantity, s.OrderItemID, order.ID); err != nil {
+				return fmt.Errorf("调整缺货商品数量失败: %v", err)
+			}
+			result.PickedItemIDs = append(result.PickedItemIDs, s.OrderItemID)
+		}
+
+		s.Status = ShortageStatusApplied
+		s.ResolvedBy = resolvedBy
+		s.ResolvedAt = &now
+		if s.ID > 0 {
+			if _, err := tx.Exec(`
+				UPDATE order_item_shortages
+				SET shipped_quantity = ?, reduced_amount = ?, strategy = ?, status = ?, resolved_by = ?, resolved_at = ?, updated_at = NOW()
+				WHERE id = ?
+			`, s.ShippedQuantity, s.ReducedAmount, s.Strategy, s.Status, s.ResolvedBy, s.ResolvedAt, s.ID); err != nil {
+				return fmt.Errorf("更新缺货记录失败: %v", err)
+			}
+		} else if err := insertOrderItemShortageInTx(tx, s); err != nil {
+			return err
+		}
+	}
+
+	var goodsAmount float64
+	if err := tx.QueryRow(`
+		SELECT COALESCE(SUM(subtotal), 0), COUNT(*) FROM order_items WHERE order_id = ?
+	`, order.ID).Scan(&goodsAmount, &result.RemainingItems); err != nil {
+		return err
+	}
+	goodsAmount = math.Round(goodsAmount*100) / 100
+
+	// 剩余商品重新计算客户配送费（可能不再满足免配送费门槛）和优惠券优惠（可能不再满足使用门槛）
+	deliveryFee, couponDiscount := order.DeliveryFee, order.CouponDiscount
+	if result.RemainingItems > 0 {
+		var err error
+		deliveryFee, couponDiscount, err = recalculateShortageFeesInTx(tx, order)
+		if err != nil {
+			return fmt.Errorf("重新计算配送费和优惠券失败: %v", err)
+		}
+	}
+	totalAmount := goodsAmount + deliveryFee + order.UrgentFee - order.PointsDiscount - couponDiscount
+	if totalAmount < 0 {
+		totalAmount = 0
+	}
+	totalAmount = math.Round(totalAmount*100) / 100
+	reduced := order.TotalAmount - totalAmount
+	if reduced < 0 {
+		reduced = 0
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE orders
+		SET goods_amount = ?, delivery_fee = ?, coupon_discount = ?, total_amount = ?,
+		    shortage_amount = shortage_amount + ?, shortage_hold = 0, updated_at = NOW()
+		WHERE id = ?
+	`, goodsAmount, deliveryFee, couponDiscount, totalAmount, reduced, order.ID); err != nil {
+		return fmt.Errorf("更新订单金额失败: %v", err)
+	}
+
+	// 整单缺货：与缺货处理同一事务取消订单并释放库存和促销占用，不会留下没有商品的在途订单
+	if result.RemainingItems == 0 {
+		change, err := transitionOrderStatusInTx(tx, order.ID, OrderStatusCancelled, actor, "商品全部缺货", true)
+		if err != nil {
+			return fmt.Errorf("取消订单失败: %v", err)
+		}
+		if err := ReleaseOrderStockInTx(tx, order.ID); err != nil {
+			return err
+		}
+		if err := ReleaseOrderPromotionsInTx(tx, order.ID); err != nil {
+			return err
+		}
+		result.StatusChange = change
+	}
+
+	// 已微信支付的订单在同一事务内入队退款任务，退款失败时自动重试并可在任务管理中查看
+	refundAmount, reason := reduced, "商品缺货，退还差价"
+	if result.RemainingItems == 0 {
+		refundAmount, reason = order.TotalAmount, "商品缺货，订单取消"
+	}
+	if refundAmount >= 0.01 && order.NeedWechatRefundOnCancel() && len(shortages) > 0 {
+		shortageID := shortages[len(shortages)-1].ID
+		payload := ShortageRefundJobPayload{OrderID: order.ID, ShortageID: shortageID, Amount: refundAmount, Reason: reason}
+		key := fmt.Sprintf("%s:%d:%d", JobShortageRefund, order.ID, shortageID)
+		if err := EnqueueJobInTx(tx, JobShortageRefund, payload, JobOptions{IdempotencyKey: key}); err != nil {
+			return fmt.Errorf("缺货退款任务入队失败: %v", err)
+		}
+	}
+
+	result.NewTotalAmount = totalAmount
+	result.Shortages = shortages
+	return nil
+}
+
+// recalculateShortageFeesInTx 按缺货处理后的剩余商品（成交单价）重新计算客户配送费和订单优惠券优惠
+// 不再满足使用门槛或适用范围的优惠券不再抵扣；优惠金额不超过下单时的优惠
+func recalculateShortageFeesInTx(tx *sql.Tx, order *Order) (float64, float64, error) {
+	rows, err := tx.Query(`SELECT id, product_id, spec_name, unit_price, quantity FROM order_items WHERE order_id = ?`, order.ID)
+	if err != nil {
+		return 0, 0, err
+	}
+	items := make([]PurchaseListItem, 0)
+	prices := make(map[int]float64)
+	for rows.Next() {
+		var item PurchaseListItem
+		var unitPrice float64
+		if err := rows.Scan(&item.ID, &item.ProductID, &item.SpecName, &unitPrice, &item.Quantity); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		items = append(items, item)
+		prices[item.ID] = unitPrice
+	}
+	rows.Close()
+
+	address, err := GetAddressByID(order.AddressID)
+	if err != nil {
+		return 0, 0, err
+	}
+	summary, err := CalculateDeliveryFeeForAddress(items, "", address, prices)
+	if err != nil {
+		return 0, 0, err
+	}
+	deliveryFee := roundMoney(summary.DeliveryFee)
+	if order.CouponDiscount <= 0 {
+		return deliveryFee, 0, nil
+	}
+
+	couponRows, err := tx.Query(`
+		SELECT uc.id, c.id, c.name, c.type, c.discount_value, c.min_amount, c.category_ids, `+couponRuleColumns("c")+`
+		FROM user_coupons uc
+		INNER JOIN coupons c ON uc.coupon_id = c.id
+		WHERE uc.order_id = ? AND uc.status = 'used'
+	`, order.ID)
+	if err != nil {
+		return 0, 0, err
+	}
+	coupons := make([]AvailableCouponInfo, 0)
+	for couponRows.Next() {
+		var info AvailableCouponInfo
+		var categoryIDsJSON sql.NullString
+		var ruleScanner couponRuleScanner
+		dest := []interface{}{&info.UserCouponID, &info.CouponID, &info.Name, &info.Type, &info.DiscountValue, &info.MinAmount, &categoryIDsJSON}
+		if err := couponRows.Scan(append(dest, ruleScanner.dest()...)...); err != nil {
+			couponRows.Close()
+			return 0, 0, err
+		}
+		info.CouponRules = ruleScanner.rules()
+		info.CategoryIDs = []int{}
+		if categoryIDsJSON.Valid && categoryIDsJSON.String != "" {
+			_ = json.Unmarshal([]byte(categoryIDsJSON.String), &info.CategoryIDs)
+		}
+		coupons = append(coupons, info)
+	}
+	couponRows.Close()
+
+	couponItems, err := BuildCouponOrderItems(items, "", prices)
+	if err != nil {
+		return 0, 0, err
+	}
+	valid := make([]AvailableCouponInfo, 0, len(coupons))
+	for _, info := range coupons {
+		eligible, count := info.eligibleAmount(couponItems)
+		if count == 0 || (info.MinAmount > 0 && eligible < info.MinAmount) {
+			log.Printf("[Shortage] 订单 %d 缺货后优惠券 %s 不再满足使用条件，取消抵扣", order.ID, info.Name)
+			continue
+		}
+		valid = append(valid, info)
+	}
+	combination := applyCouponCombination(valid, couponItems, deliveryFee, summary.IsFreeShipping)
+	couponDiscount := math.Min(combination.TotalDiscount, order.CouponDiscount)
+
+	// 按券更新实际优惠金额（不再满足条件的券记为 0，总优惠被原抵扣封顶时按比例缩减）
+	ratio := 1.0
+	if combination.TotalDiscount > couponDiscount && combination.TotalDiscount > 0 {
+		ratio = couponDiscount / combination.TotalDiscount
+	}
+	saved := combination.SavedByUserCouponID()
+	for _, info := range coupons {
+		if _, err := tx.Exec(`UPDATE user_coupons SET saved_amount = ? WHERE id = ?`, roundMoney(saved[info.UserCouponID]*ratio), info.UserCouponID); err != nil {
+			return 0, 0, fmt.Errorf("更新优惠券优惠金额失败: %v", err)
+		}
+	}
+	return deliveryFee, couponDiscount, nil
+}
+
+func insertOrderItemShortageInTx(tx *sql.Tx, s *OrderItemShortage) error {
+	res, err := tx.Exec(`
+		INSERT INTO order_item_shortages (
+			order_id, order_item_id, product_id, product_name, spec_name, unit_price, original_quantity, available_quantity,
+			shipped_quantity, reduced_amount, strategy, status, reported_by, resolved_by, resolved_at, created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())
+	`, s.OrderID, s.OrderItemID, s.ProductID, s.ProductName, s.SpecName, s.UnitPrice, s.OriginalQuantity, s.AvailableQuantity,
+		s.ShippedQuantity, s.ReducedAmount, s.Strategy, s.Status, s.ReportedBy, s.ResolvedBy, s.ResolvedAt)
+	if err != nil {
+		return fmt.Errorf("记录缺货失败: %v", err)
+	}
+	id, _ := res.LastInsertId()
+	s.ID = int(id)
+	s.CreatedAt = time.Now()
+	return nil
+}
+
+// GetOrderShortages 获取订单的缺货记录
+func GetOrderShortages(orderID int) ([]OrderItemShortage, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, order_id, order_item_id, product_id, product_name, spec_name, unit_price, original_quantity, available_quantity,
+		       shipped_quantity, reduced_amount, strategy, status, reported_by, resolved_by, resolved_at, created_at
+		FROM order_item_shortages
+		WHERE order_id = ?
+		ORDER BY id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]OrderItemShortage, 0)
+	for rows.Next() {
+		var s OrderItemShortage
+		var resolvedBy sql.NullString
+		var resolvedAt sql.NullTime
+		if err := rows.Scan(&s.ID, &s.OrderID, &s.OrderItemID, &s.ProductID, &s.ProductName, &s.SpecName, &s.UnitPrice,
+			&s.OriginalQuantity, &s.AvailableQuantity, &s.ShippedQuantity, &s.ReducedAmount, &s.Strategy, &s.Status,
+			&s.ReportedBy, &resolvedBy, &resolvedAt, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		if resolvedBy.Valid {
+			v := resolvedBy.String
+			s.ResolvedBy = &v
+		}
+		if resolvedAt.Valid {
+			t := resolvedAt.Time
+			s.ResolvedAt = &t
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,298 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 订单状态
+const (
+	OrderStatusPendingPayment  = "pending_payment"  // 待支付（在线支付）
+	OrderStatusPendingDelivery = "pending_delivery" // 待配送
+	OrderStatusPendingPickup   = "pending_pickup"   // 待取货（配送员已接单）
+	OrderStatusDelivering      = "delivering"       // 配送中
+	OrderStatusDelivered       = "delivered"        // 已送达
+	OrderStatusPaid            = "paid"             // 已收款
+	OrderStatusCancelled       = "cancelled"        // 已取消
+
+	// 兼容旧状态
+	OrderStatusPending   = "pending"   // 等同 pending_delivery
+	OrderStatusShipped   = "shipped"   // 等同 delivered
+	OrderStatusCompleted = "completed" // 已完成，不再流转
+)
+
+// 订单状态变更操作人类型
+const (
+	OrderActorSystem    = "system"
+	OrderActorAdmin     = "admin"
+	OrderActorEmployee  = "employee"
+	OrderActorUser      = "user"
+	OrderActorWechatPay = "wechat_pay"
+)
+
+// orderStatusTransitions 订单状态机：当前状态 -> 允许流转到的状态
+// 流程：pending_payment -> pending_delivery -> pending_pickup -> delivering -> delivered -> paid
+// 已在线支付的订单送达即为已收款（delivering -> paid）；配送员接单前可取消
+var orderStatusTransitions = map[string][]string{
+	OrderStatusPendingPayment:  {OrderStatusPendingDelivery, OrderStatusCancelled},
+	OrderStatusPendingDelivery: {OrderStatusPendingPickup, OrderStatusCancelled},
+	OrderStatusPending:         {OrderStatusPendingPickup, OrderStatusCancelled},
+	OrderStatusPendingPickup:   {OrderStatusDelivering, OrderStatusCancelled},
+	OrderStatusDelivering:      {OrderStatusDelivered, OrderStatusPaid},
+	OrderStatusDelivered:       {OrderStatusPaid},
+	OrderStatusShipped:         {OrderStatusPaid},
+	OrderStatusPaid:            {},
+	OrderStatusCompleted:       {},
+	OrderStatusCancelled:       {},
+}
+
+// OrderActor 订单状态变更操作人
+type OrderActor struct {
+	Type string `json:"type"` // system/admin/employee/user/wechat_pay
+	ID   string `json:"id"`   // 管理员用户名、员工码、用户ID等
+}
+
+// OrderStatusChange 一次订单状态变更
+type OrderStatusChange struct {
+	OrderID int        `json:"order_id"`
+	From    string     `json:"from"`
+	To      string     `json:"to"`
+	Actor   OrderActor `json:"actor"`
+	Reason  string     `json:"reason"`
+}
+
+// OrderStatusHistory 订单状态流转历史
+type OrderStatusHistory struct {
+	ID         int       `json:"id"`
+	OrderID    int       `json:"order_id"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	ActorType  string    `json:"actor_type"`
+	ActorID    string    `json:"actor_id"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// OrderStatusHook 订单进入某状态后执行的钩子，order 为变更后的订单
+// 钩子作为后台任务在状态变更的事务内入队，返回错误时按任务退避策略重试，因此需保证可重复执行
+type OrderStatusHook func(order *Order, change OrderStatusChange) error
+
+type namedOrderStatusHook struct {
+	name string
+	hook OrderStatusHook
+}
+
+var (
+	orderStatusHooks     = make(map[string][]namedOrderStatusHook)
+	orderStatusHookByKey = make(map[string]OrderStatusHook)
+)
+
+// orderStatusHookPayload 订单状态钩子任务参数
+type orderStatusHookPayload struct {
+	Hook   string            `json:"hook"`
+	Change OrderStatusChange `json:"change"`
+}
+
+// RegisterOrderStatusHook 注册订单进入指定状态后的钩子，name 在同一状态下唯一，应在 init 中调用
+func RegisterOrderStatusHook(status, name string, hook OrderStatusHook) {
+	orderStatusHooks[status] = append(orderStatusHooks[status], namedOrderStatusHook{name: name, hook: hook})
+	orderStatusHookByKey[status+":"+name] = hook
+}
+
+func init() {
+	RegisterOrderStatusHook(OrderStatusPaid, "settlement", settleOrderOnPaid)
+	RegisterOrderStatusHook(OrderStatusPaid, "referral_reward", func(order *Order, change OrderStatusChange) error {
+		// 处理推荐奖励（订单完成付款后发放奖励给老用户）
+		return ProcessReferralReward(order.ID)
+	})
+	RegisterOrderStatusHook(OrderStatusPaid, "points_reward", func(order *Order, change OrderStatusChange) error {
+		// 处理订单积分奖励：每消费1元奖励1积分，四舍五入
+		return AddPointsForOrder(order.UserID, order.ID, order.OrderNumber, order.TotalAmount)
+	})
+	RegisterOrderStatusHook(OrderStatusCancelled, "cancel_commissions", func(order *Order, change OrderStatusChange) error {
+		// 清理分成记录（特别是新客订单记录，这样其他订单就可以重新计算新客激励了）
+		return CancelOrderCommissions(order.ID)
+	})
+	RegisterOrderStatusHook(OrderStatusCancelled, "refund_points", func(order *Order, change OrderStatusChange) error {
+		// 退回下单时抵扣的积分
+		return RefundOrderRedeemedPoints(order.ID)
+	})
+
+	RegisterJobHandler(JobOrderStatusHook, runOrderStatusHookJob)
+}
+
+// runOrderStatusHookJob 执行订单状态钩子任务
+func runOrderStatusHookJob(payload []byte) error {
+	var p orderStatusHookPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("解析任务参数失败: %v", err)
+	}
+	hook, ok := orderStatusHookByKey[p.Change.To+":"+p.Hook]
+	if !ok {
+		return fmt.Errorf("未注册的订单状态钩子: %s:%s", p.Change.To, p.Hook)
+	}
+	order, err := GetOrderByID(p.Change.OrderID)
+	if err != nil {
+		return err
+	}
+	if order == nil {
+		return fmt.Errorf("订单 %d 不存在", p.Change.OrderID)
+	}
+	return hook(order, p.Change)
+}
+
+// CanTransitionOrderStatus 判断订单状态是否允许流转
+func CanTransitionOrderStatus(from, to string) bool {
+	for _, s := range orderStatusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionOrderStatus 按状态机变更订单状态，记录流转历史并触发钩子
+func TransitionOrderStatus(orderID int, to string, actor OrderActor, reason string) error {
+	return transitionOrderStatus(orderID, to, actor, reason, false)
+}
+
+// ForceCancelOrder 强制取消订单（管理员退款等场景，允许从任意未取消状态取消），同样记录历史并触发钩子
+func ForceCancelOrder(orderID int, actor OrderActor, reason string) error {
+	return transitionOrderStatus(orderID, OrderStatusCancelled, actor, reason, true)
+}
+
+func transitionOrderStatus(orderID int, to string, actor OrderActor, reason string, force bool) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	change, err := transitionOrderStatusInTx(tx, orderID, to, actor, reason, force)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	AfterOrderStatusChanged(change)
+	return nil
+}
+
+// TransitionOrderStatusInTx 在调用方事务内变更订单状态并记录历史
+// 事务提交后调用方必须调用 AfterOrderStatusChanged 触发后续处理
+func TransitionOrderStatusInTx(tx *sql.Tx, orderID int, to string, actor OrderActor, reason string) (*OrderStatusChange, error) {
+	return transitionOrderStatusInTx(tx, orderID, to, actor, reason, false)
+}
+
+func transitionOrderStatusInTx(tx *sql.Tx, orderID int, to string, actor OrderActor, reason string, force bool) (*OrderStatusChange, error) {
+	var from string
+	err := tx.QueryRow(`SELECT status FROM orders WHERE id = ? FOR UPDATE`, orderID).Scan(&from)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("订单不存在")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := CanTransitionOrderStatus(from, to)
+	if force && to == OrderStatusCancelled && from != OrderStatusCancelled {
+		allowed = true
+	}
+	if !allowed {
+		return nil, fmt.Errorf("订单状态不允许从 %s 变更为 %s", from, to)
+	}
+
+	if _, err := tx.Exec(`UPDATE orders SET status = ?, updated_at = NOW() WHERE id = ?`, to, orderID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO order_status_history (order_id, from_status, to_status, actor_type, actor_id, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, NOW())
+	`, orderID, from, to, actor.Type, actor.ID, reason); err != nil {
+		return nil, fmt.Errorf("记录订单状态历史失败: %v", err)
+	}
+
+	// 配送员接单时生成收货确认码，客户在配送员到达前即可在订单详情查看
+	if to == OrderStatusPendingPickup {
+		if err := generateDeliveryConfirmCode(tx, orderID); err != nil {
+			return nil, fmt.Errorf("生成收货确认码失败: %v", err)
+		}
+	}
+
+	change := &OrderStatusChange{OrderID: orderID, From: from, To: to, Actor: actor, Reason: reason}
+
+	// 钩子与状态变更在同一事务内入队，进程重启也不会丢失；每个订单每个状态的钩子只执行一次
+	for _, h := range orderStatusHooks[to] {
+		key := fmt.Sprintf("%s:%s:%d:%s", JobOrderStatusHook, h.name, orderID, to)
+		if err := EnqueueJobInTx(tx, JobOrderStatusHook, orderStatusHookPayload{Hook: h.name, Change: *change}, JobOptions{IdempotencyKey: key}); err != nil {
+			return nil, err
+		}
+	}
+	// 更新订单状态后，重新计算配送费和利润
+	// 接单时由 UpdateOrderStatusWithDeliveryEmployee 按配送员批次计算并锁定配送费，此处不重复计算
+	if to != OrderStatusPendingPickup {
+		if err := EnqueueJobInTx(tx, JobOrderProfit, OrderProfitJobPayload{OrderID: orderID}, JobOptions{}); err != nil {
+			return nil, err
+		}
+	}
+	return change, nil
+}
+
+// AfterOrderStatusChanged 订单状态变更提交后的处理：取消时释放库存和促销占用并更新受影响订单的孤立状态
+// 钩子和利润重算已在变更事务内作为后台任务入队
+func AfterOrderStatusChanged(change *OrderStatusChange) {
+	if change == nil || change.To != OrderStatusCancelled {
+		return
+	}
+	orderID := change.OrderID
+	if err := ReleaseOrderStock(orderID); err != nil {
+		log.Printf("[OrderStatus] 释放订单 %d 库存占用失败: %v", orderID, err)
+	}
+	if err := ReleaseOrderPromotions(orderID); err != nil {
+		log.Printf("[OrderStatus] 释放订单 %d 促销占用失败: %v", orderID, err)
+	}
+	go func() {
+		_ = updateAffectedOrdersIsolatedStatus(orderID)
+	}()
+}
+
+// settleOrderOnPaid 订单变为已收款：设置结算日期，计算销售分成
+func settleOrderOnPaid(order *Order, change OrderStatusChange) error {
+	if order.SettlementDate == nil {
+		now := time.Now()
+		if _, err := database.DB.Exec("UPDATE orders SET settlement_date = ? WHERE id = ? AND settlement_date IS NULL", now, order.ID); err != nil {
+			return fmt.Errorf("设置订单 %d 结算日期失败: %v", order.ID, err)
+		}
+	}
+	return ProcessOrderSettlement(order.ID)
+}
+
+// GetOrderStatusHistory 获取订单状态流转历史
+func GetOrderStatusHistory(orderID int) ([]OrderStatusHistory, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, order_id, from_status, to_status, actor_type, actor_id, reason, created_at
+		FROM order_status_history
+		WHERE order_id = ?
+		ORDER BY id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]OrderStatusHistory, 0)
+	for rows.Next() {
+		var h OrderStatusHistory
+		if err := rows.Scan(&h.ID, &h.OrderID, &h.FromStatus, &h.ToStatus, &h.ActorType, &h.ActorID, &h.Reason, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, h)
+	}
+	return list, rows.Err()
+}
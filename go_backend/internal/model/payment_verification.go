@@ -306,28 +306,26 @@ func ReviewPaymentVerificationRequest(requestID int, adminID int, adminName stri
 		return err
 	}
 
-	// 如果审核通过，更新订单状态为已收款
+	// 如果审核通过，更新订单状态为已收款（进入 paid 时由状态钩子触发结算）
+	var change *OrderStatusChange
 	if approved {
-		orderUpdateQuery := `
-			UPDATE orders
-			SET status = 'paid', updated_at = NOW()
-			WHERE id = ? AND status IN ('delivered', 'shipped')
-		`
-		result, err := tx.Exec(orderUpdateQuery, req.OrderID)
-		if err != nil {
-			return err
-		}
-
-		rowsAffected, err := result.RowsAffected()
-		if err != nil {
+		var orderStatus string
+		if err := tx.QueryRow("SELECT status FROM orders WHERE id = ? FOR UPDATE", req.OrderID).Scan(&orderStatus); err != nil {
 			return err
 		}
-
-		if rowsAffected == 0 {
+		if orderStatus != OrderStatusDelivered && orderStatus != OrderStatusShipped {
 			// 订单状态已改变，回滚事务
 			return sql.ErrNoRows
 		}
+		change, err = TransitionOrderStatusInTx(tx, req.OrderID, OrderStatusPaid, OrderActor{Type: OrderActorAdmin, ID: adminName}, "收款审核通过")
+		if err != nil {
+			return err
+		}
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	AfterOrderStatusChanged(change)
+	return nil
 }
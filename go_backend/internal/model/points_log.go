@@ -33,17 +33,18 @@ func AddPointsForOrder(userID, orderID int, orderNumber string, totalAmount floa
 		return nil
 	}
 
-	// 获取用户当前积分
-	var currentPoints int
-	query := `SELECT COALESCE(points, 0) FROM mini_app_users WHERE id = ?`
-	err := database.DB.QueryRow(query, userID).Scan(&currentPoints)
-	if err != nil {
-		return fmt.Errorf("获取用户积分失败: %v", err)
+	// 该订单已发放过积分则不重复发放（由后台任务调用，可能重试）
+	var rewarded int
+	if err := database.DB.QueryRow(`
+		SELECT COUNT(*) FROM points_logs
+		WHERE type = 'order_reward' AND related_type = 'order' AND related_id = ?
+	`, orderID).Scan(&rewarded); err != nil {
+		return fmt.Errorf("查询订单积分记录失败: %v", err)
+	}
+	if rewarded > 0 {
+		return nil
 	}
 
-	// 计算变动后积分余额
-	balanceAfter := currentPoints + points
-
 	// 开始事务
 	tx, err := database.DB.Begin()
 	if err != nil {
@@ -51,28 +52,10 @@ func AddPointsForOrder(userID, orderID int, orderNumber string, totalAmount floa
 	}
 	defer tx.Rollback()
 
-	// 更新用户积分
-	updateQuery := `
-		UPDATE mini_app_users
-		SET points = points + ?, updated_at = NOW()
-		WHERE id = ?
-	`
-	_, err = tx.Exec(updateQuery, points, userID)
-	if err != nil {
-		return fmt.Errorf("更新用户积分失败: %v", err)
-	}
-
-	// 记录积分明细
-	relatedType := "order"
+	// 更新用户积分、记录积分明细和积分批次
 	description := fmt.Sprintf("订单完成奖励（订单号：%s，消费金额：%.2f元）", orderNumber, totalAmount)
-	insertQuery := `
-		INSERT INTO points_logs (
-			user_id, points, balance_after, type, related_id, related_type, description, created_at
-		) VALUES (?, ?, ?, 'order_reward', ?, ?, ?, NOW())
-	`
-	_, err = tx.Exec(insertQuery, userID, points, balanceAfter, orderID, relatedType, description)
-	if err != nil {
-		return fmt.Errorf("记录积分明细失败: %v", err)
+	if _, err = applyPointsChangeInTx(tx, userID, points, "order_reward", orderID, "order", description); err != nil {
+		return err
 	}
 
 	// 提交事务
@@ -90,17 +73,6 @@ func AddPoints(userID, points int, pointsType string, relatedID *int, relatedTyp
 		return nil
 	}
 
-	// 获取用户当前积分
-	var currentPoints int
-	query := `SELECT COALESCE(points, 0) FROM mini_app_users WHERE id = ?`
-	err := database.DB.QueryRow(query, userID).Scan(&currentPoints)
-	if err != nil {
-		return fmt.Errorf("获取用户积分失败: %v", err)
-	}
-
-	// 计算变动后积分余额
-	balanceAfter := currentPoints + points
-
 	// 开始事务
 	tx, err := database.DB.Begin()
 	if err != nil {
@@ -108,18 +80,7 @@ func AddPoints(userID, points int, pointsType string, relatedID *int, relatedTyp
 	}
 	defer tx.Rollback()
 
-	// 更新用户积分
-	updateQuery := `
-		UPDATE mini_app_users
-		SET points = points + ?, updated_at = NOW()
-		WHERE id = ?
-	`
-	_, err = tx.Exec(updateQuery, points, userID)
-	if err != nil {
-		return fmt.Errorf("更新用户积分失败: %v", err)
-	}
-
-	// 记录积分明细
+	// 更新用户积分、记录积分明细和积分批次
 	var relatedIDValue, relatedTypeValue interface{}
 	if relatedID != nil {
 		relatedIDValue = *relatedID
@@ -127,15 +88,8 @@ func AddPoints(userID, points int, pointsType string, relatedID *int, relatedTyp
 	if relatedType != nil {
 		relatedTypeValue = *relatedType
 	}
-
-	insertQuery := `
-		INSERT INTO points_logs (
-			user_id, points, balance_after, type, related_id, related_type, description, created_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, NOW())
-	`
-	_, err = tx.Exec(insertQuery, userID, points, balanceAfter, pointsType, relatedIDValue, relatedTypeValue, description)
-	if err != nil {
-		return fmt.Errorf("记录积分明细失败: %v", err)
+	if _, err = applyPointsChangeInTx(tx, userID, points, pointsType, relatedIDValue, relatedTypeValue, description); err != nil {
+		return err
 	}
 
 	// 提交事务
@@ -0,0 +1,403 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// PointsTypeExpire 积分过期
+const PointsTypeExpire = "points_expire"
+
+// pointsExpiryHour 每日积分过期任务执行时间
+const pointsExpiryHour = 1
+
+// PointsLot 积分批次：每次获得积分生成一个批次，消费时按先到期先用（FIFO）扣减
+type PointsLot struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	SourceLogID *int       `json:"source_log_id,omitempty"` // 来源积分明细ID，历史余额迁移的批次为空
+	Points      int        `json:"points"`                  // 获得积分
+	Remaining   int        `json:"remaining"`               // 剩余可用积分
+	EarnedAt    time.Time  `json:"earned_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"` // 为空表示永不过期
+}
+
+// PointsExpiring 用户即将过期的积分
+type PointsExpiring struct {
+	Points    int       `json:"points"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PointsLedgerDiscrepancy 积分余额与明细/批次不一致的用户
+type PointsLedgerDiscrepancy struct {
+	UserID       int    `json:"user_id"`
+	Name         string `json:"name"`
+	Phone        string `json:"phone"`
+	Points       int    `json:"points"`        // mini_app_users.points
+	LedgerPoints int    `json:"ledger_points"` // SUM(points_logs.points)
+	LotPoints    int    `json:"lot_points"`    // SUM(points_lots.remaining)
+	LedgerDiff   int    `json:"ledger_diff"`   // points - ledger_points
+	LotDiff      int    `json:"lot_diff"`      // points - lot_points
+}
+
+func init() {
+	RegisterJobHandler(JobPointsExpiry, runPointsExpiryJob)
+}
+
+// pointsLotExpiresAt 按系统设置计算积分批次到期时间：获得当年起第 N 年的年末，N 为 0 表示永不过期
+func pointsLotExpiresAt(earnedAt time.Time) *time.Time {
+	years := GetSystemSettingInt("points_expire_years", 1)
+	if years <= 0 {
+		return nil
+	}
+	t := time.Date(earnedAt.Year()+years, 12, 31, 23, 59, 59, 0, time.Local)
+	return &t
+}
+
+// applyPointsChangeInTx 在事务内变更用户积分：更新余额、写积分明细并维护积分批次，返回变动后余额
+// 增加积分生成新批次；扣减积分按到期时间先后消耗批次
+func applyPointsChangeInTx(tx *sql.Tx, userID, points int, pointsType string, relatedID, relatedType interface{}, description string) (int, error) {
+	balanceAfter, logID, err := recordPointsChangeInTx(tx, userID, points, pointsType, relatedID, relatedType, description)
+	if err != nil {
+		return 0, err
+	}
+	if points > 0 {
+		if err := insertPointsLotInTx(tx, userID, logID, points); err != nil {
+			return 0, err
+		}
+	} else if points < 0 {
+		if err := consumePointsLotsInTx(tx, userID, logID, -points); err != nil {
+			return 0, err
+		}
+	}
+	return balanceAfter, nil
+}
+
+// recordPointsChangeInTx 更新用户积分余额并写积分明细，返回变动后余额和明细ID（不维护积分批次）
+func recordPointsChangeInTx(tx *sql.Tx, userID, points int, pointsType string, relatedID, relatedType interface{}, description string) (int, int64, error) {
+	var balance int
+	if err := tx.QueryRow(`SELECT COALESCE(points, 0) FROM mini_app_users WHERE id = ? FOR UPDATE`, userID).Scan(&balance); err != nil {
+		return 0, 0, fmt.Errorf("获取用户积分失败: %v", err)
+	}
+	balanceAfter := balance + points
+
+	if _, err := tx.Exec(`UPDATE mini_app_users SET points = points + ?, updated_at = NOW() WHERE id = ?`, points, userID); err != nil {
+		return 0, 0, fmt.Errorf("更新用户积分失败: %v", err)
+	}
+	res, err := tx.Exec(`
+		INSERT INTO points_logs (
+			user_id, points, balance_after, type, related_id, related_type, description, created_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, NOW())
+	`, userID, points, balanceAfter, pointsType, relatedID, relatedType, description)
+	if err != nil {
+		return 0, 0, fmt.Errorf("记录积分明细失败: %v", err)
+	}
+	logID, _ := res.LastInsertId()
+	return balanceAfter, logID, nil
+}
+
+// insertPointsLotInTx 为新获得的积分生成批次，到期时间按系统设置计算
+func insertPointsLotInTx(tx *sql.Tx, userID int, logID int64, points int) error {
+	now := time.Now()
+	if _, err := tx.Exec(`
+		INSERT INTO points_lots (user_id, source_log_id, points, remaining, earned_at, expires_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, NOW(), NOW())
+	`, userID, logID, points, points, now, pointsLotExpiresAt(now)); err != nil {
+		return fmt.Errorf("记录积分批次失败: %v", err)
+	}
+	return nil
+}
+
+// restoreConsumedPointsInTx 退回积分：写积分明细，并按 consumedLogIDs 扣减时的批次消耗记录恢复原批次（保留原到期时间）
+// 后消耗的批次先恢复；没有消耗记录的部分（历史扣减）生成新批次
+func restoreConsumedPointsInTx(tx *sql.Tx, userID, points int, consumedLogIDs []int, pointsType string, relatedID, relatedType interface{}, description string) (int, error) {
+	balanceAfter, logID, err := recordPointsChangeInTx(tx, userID, points, pointsType, relatedID, relatedType, description)
+	if err != nil {
+		return 0, err
+	}
+
+	remaining := points
+	if len(consumedLogIDs) > 0 {
+		args := make([]interface{}, len(consumedLogIDs))
+		for i, id := range consumedLogIDs {
+			args[i] = id
+		}
+		rows, err := tx.Query(`
+			SELECT id, lot_id, points - restored FROM points_lot_usages
+			WHERE log_id IN (`+strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")+`) AND points > restored
+			ORDER BY id DESC
+			FOR UPDATE
+		`, args...)
+		if err != nil {
+			return 0, fmt.Errorf("查询积分批次消耗记录失败: %v", err)
+		}
+		type lotRestore struct{ usageID, lotID, points int }
+		var restores []lotRestore
+		for rows.Next() && remaining > 0 {
+			var r lotRestore
+			var available int
+			if err := rows.Scan(&r.usageID, &r.lotID, &available); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			r.points = available
+			if r.points > remaining {
+				r.points = remaining
+			}
+			restores = append(restores, r)
+			remaining -= r.points
+		}
+		rows.Close()
+
+		for _, r := range restores {
+			if _, err := tx.Exec(`UPDATE points_lots SET remaining = remaining + ?, updated_at = NOW() WHERE id = ?`, r.points, r.lotID); err != nil {
+				return 0, fmt.Errorf("恢复积分批次失败: %v", err)
+			}
+			if _, err := tx.Exec(`UPDATE points_lot_usages SET restored = restored + ? WHERE id = ?`, r.points, r.usageID); err != nil {
+				return 0, fmt.Errorf("更新积分批次消耗记录失败: %v", err)
+			}
+		}
+	}
+	if remaining > 0 {
+		if err := insertPointsLotInTx(tx, userID, logID, remaining); err != nil {
+			return 0, err
+		}
+	}
+	return balanceAfter, nil
+}
+
+// consumePointsLotsInTx 按先到期先用扣减积分批次并记录消耗明细；批次不足时（历史数据不一致）只扣减现有批次
+func consumePointsLotsInTx(tx *sql.Tx, userID int, logID int64, points int) error {
+	rows, err := tx.Query(`
+		SELECT id, remaining FROM points_lots
+		WHERE user_id = ? AND remaining > 0 AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY expires_at IS NULL, expires_at, id
+		FOR UPDATE
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("查询积分批次失败: %v", err)
+	}
+	type lotUse struct{ id, used int }
+	var uses []lotUse
+	for rows.Next() && points > 0 {
+		var id, remaining int
+		if err := rows.Scan(&id, &remaining); err != nil {
+			rows.Close()
+			return err
+		}
+		used := remaining
+		if used > points {
+			used = points
+		}
+		uses = append(uses, lotUse{id: id, used: used})
+		points -= used
+	}
+	rows.Close()
+
+	for _, u := range uses {
+		if _, err := tx.Exec(`UPDATE points_lots SET remaining = remaining - ?, updated_at = NOW() WHERE id = ?`, u.used, u.id); err != nil {
+			return fmt.Errorf("扣减积分批次失败: %v", err)
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO points_lot_usages (log_id, lot_id, points, restored, created_at, updated_at)
+			VALUES (?, ?, ?, 0, NOW(), NOW())
+		`, logID, u.id, u.used); err != nil {
+			return fmt.Errorf("记录积分批次消耗失败: %v", err)
+		}
+	}
+	if points > 0 {
+		log.Printf("[PointsLot] 用户 %d 可用积分批次不足，差额 %d 未从批次扣减", userID, points)
+	}
+	return nil
+}
+
+// ExpirePoints 将已到期批次的剩余积分作废，写入负数积分明细，返回处理的用户数
+func ExpirePoints() (int, error) {
+	rows, err := database.DB.Query(`
+		SELECT DISTINCT user_id FROM points_lots
+		WHERE remaining > 0 AND expires_at IS NOT NULL AND expires_at <= NOW()
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("查询到期积分失败: %v", err)
+	}
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			userIDs = append(userIDs, id)
+		}
+	}
+	rows.Close()
+
+	processed := 0
+	for _, userID := range userIDs {
+		if err := expireUserPoints(userID); err != nil {
+			log.Printf("[PointsLot] 用户 %d 积分过期处理失败: %v", userID, err)
+			continue
+		}
+		processed++
+	}
+	return processed, nil
+}
+
+func expireUserPoints(userID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var balance int
+	if err := tx.QueryRow(`SELECT COALESCE(points, 0) FROM mini_app_users WHERE id = ? FOR UPDATE`, userID).Scan(&balance); err != nil {
+		return fmt.Errorf("获取用户积分失败: %v", err)
+	}
+	var expired int
+	if err := tx.QueryRow(`
+		SELECT COALESCE(SUM(remaining), 0) FROM points_lots
+		WHERE user_id = ? AND remaining > 0 AND expires_at IS NOT NULL AND expires_at <= NOW()
+	`, userID).Scan(&expired); err != nil {
+		return fmt.Errorf("统计到期积分失败: %v", err)
+	}
+	if expired <= 0 {
+		return nil
+	}
+	if _, err := tx.Exec(`
+		UPDATE points_lots SET remaining = 0, updated_at = NOW()
+		WHERE user_id = ? AND remaining > 0 AND expires_at IS NOT NULL AND expires_at <= NOW()
+	`, userID); err != nil {
+		return fmt.Errorf("作废到期积分批次失败: %v", err)
+	}
+
+	// 余额已小于到期积分（历史数据不一致）时只扣到 0
+	deduct := expired
+	if deduct > balance {
+		deduct = balance
+	}
+	if deduct > 0 {
+		if _, err := tx.Exec(`UPDATE mini_app_users SET points = points - ?, updated_at = NOW() WHERE id = ?`, deduct, userID); err != nil {
+			return fmt.Errorf("扣减用户积分失败: %v", err)
+		}
+		desc := fmt.Sprintf("积分过期（%d 积分到期作废）", expired)
+		if _, err := tx.Exec(`
+			INSERT INTO points_logs (
+				user_id, points, balance_after, type, related_id, related_type, description, created_at
+			) VALUES (?, ?, ?, ?, NULL, NULL, ?, NOW())
+		`, userID, -deduct, balance-deduct, PointsTypeExpire, desc); err != nil {
+			return fmt.Errorf("记录积分明细失败: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// GetUserExpiringPoints 获取用户最近一批将要过期的积分，没有时返回 nil
+func GetUserExpiringPoints(userID int) (*PointsExpiring, error) {
+	var e PointsExpiring
+	err := database.DB.QueryRow(`
+		SELECT COALESCE(SUM(remaining), 0), expires_at FROM points_lots
+		WHERE user_id = ? AND remaining > 0 AND expires_at IS NOT NULL AND expires_at > NOW()
+		GROUP BY expires_at
+		ORDER BY expires_at
+		LIMIT 1
+	`, userID).Scan(&e.Points, &e.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// GetPointsLedgerDiscrepancies 按积分明细和批次重算用户积分，返回与 mini_app_users.points 不一致的用户
+func GetPointsLedgerDiscrepancies(pageNum, pageSize int) ([]PointsLedgerDiscrepancy, int, error) {
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+	base := `
+		FROM mini_app_users u
+		LEFT JOIN (SELECT user_id, SUM(points) AS total FROM points_logs GROUP BY user_id) l ON l.user_id = u.id
+		LEFT JOIN (SELECT user_id, SUM(remaining) AS total FROM points_lots GROUP BY user_id) t ON t.user_id = u.id
+		WHERE COALESCE(u.points, 0) <> COALESCE(l.total, 0) OR COALESCE(u.points, 0) <> COALESCE(t.total, 0)
+	`
+	var total int
+	if err := database.DB.QueryRow(`SELECT COUNT(*) ` + base).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := database.DB.Query(`
+		SELECT u.id, COALESCE(u.name, ''), COALESCE(u.phone, ''), COALESCE(u.points, 0), COALESCE(l.total, 0), COALESCE(t.total, 0)
+	`+base+`
+		ORDER BY ABS(COALESCE(u.points, 0) - COALESCE(l.total, 0)) DESC, u.id
+		LIMIT ? OFFSET ?
+	`, pageSize, (pageNum-1)*pageSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	list := make([]PointsLedgerDiscrepancy, 0)
+	for rows.Next() {
+		var d PointsLedgerDiscrepancy
+		if err := rows.Scan(&d.UserID, &d.Name, &d.Phone, &d.Points, &d.LedgerPoints, &d.LotPoints); err != nil {
+			return nil, 0, err
+		}
+		d.LedgerDiff = d.Points - d.LedgerPoints
+		d.LotDiff = d.Points - d.LotPoints
+		list = append(list, d)
+	}
+	return list, total, rows.Err()
+}
+
+// pointsExpiryPayload 积分过期任务参数
+type pointsExpiryPayload struct {
+	Date string `json:"date"`
+}
+
+// SchedulePointsExpiry 安排当日的积分过期任务，之后每日由任务自行安排下一日
+func SchedulePointsExpiry() {
+	enqueuePointsExpiry(time.Now().Format("2006-01-02"))
+}
+
+func enqueuePointsExpiry(date string) {
+	day, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		return
+	}
+	delay := time.Until(day.Add(pointsExpiryHour * time.Hour))
+	if delay < 0 {
+		delay = 0
+	}
+	opts := JobOptions{IdempotencyKey: fmt.Sprintf("%s:%s", JobPointsExpiry, date), Delay: delay}
+	if err := EnqueueJob(JobPointsExpiry, pointsExpiryPayload{Date: date}, opts); err != nil {
+		log.Printf("[PointsLot] 安排 %s 积分过期任务失败: %v", date, err)
+	}
+}
+
+func runPointsExpiryJob(payload []byte) error {
+	var p pointsExpiryPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("解析任务参数失败: %v", err)
+	}
+	day, err := time.ParseInLocation("2006-01-02", p.Date, time.Local)
+	if err != nil {
+		return fmt.Errorf("日期格式不正确: %s", p.Date)
+	}
+	enqueuePointsExpiry(day.AddDate(0, 0, 1).Format("2006-01-02"))
+
+	n, err := ExpirePoints()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("[PointsLot] %s 已处理 %d 位用户的到期积分", p.Date, n)
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+
+	"go_backend/internal/database"
+)
+
+// 积分抵扣相关积分明细类型
+const (
+	PointsTypeDiscount       = "points_discount" // 下单积分抵扣
+	PointsTypeDiscountRefund = "points_refund"   // 取消/售后退回抵扣积分
+)
+
+// ErrInsufficientPoints 积分余额不足
+var ErrInsufficientPoints = errors.New("积分余额不足")
+
+// PointsRedemptionConfig 积分抵扣规则（系统设置）
+type PointsRedemptionConfig struct {
+	PointsPerYuan  int     `json:"points_per_yuan"`  // 多少积分抵扣1元，0 表示不开启积分抵扣
+	MaxPercent     float64 `json:"max_percent"`      // 最多抵扣商品金额的百分比
+	MinOrderAmount float64 `json:"min_order_amount"` // 商品金额满多少元可使用积分
+}
+
+// PointsRedemptionQuote 结算页积分抵扣信息
+type PointsRedemptionQuote struct {
+	PointsRedemptionConfig
+	Enabled     bool    `json:"enabled"`      // 当前订单是否可使用积分
+	Balance     int     `json:"balance"`      // 用户积分余额
+	MaxPoints   int     `json:"max_points"`   // 本单最多可使用积分
+	MaxDiscount float64 `json:"max_discount"` // 本单最多可抵扣金额
+	UsePoints   int     `json:"use_points"`   // 本次使用积分
+	Discount    float64 `json:"discount"`     // 本次抵扣金额
+	Reason      string  `json:"reason,omitempty"`
+}
+
+// GetPointsRedemptionConfig 读取积分抵扣规则
+func GetPointsRedemptionConfig() PointsRedemptionConfig {
+	cfg := PointsRedemptionConfig{
+		PointsPerYuan:  GetSystemSettingInt("points_redeem_rate", 100),
+		MaxPercent:     GetSystemSettingFloat("points_redeem_max_percent", 50),
+		MinOrderAmount: GetSystemSettingFloat("points_redeem_min_order", 0),
+	}
+	if cfg.PointsPerYuan < 0 {
+		cfg.PointsPerYuan = 0
+	}
+	if cfg.MaxPercent < 0 {
+		cfg.MaxPercent = 0
+	}
+	if cfg.MaxPercent > 100 {
+		cfg.MaxPercent = 100
+	}
+	return cfg
+}
+
+// PointsToDiscount 积分折算抵扣金额（按分向下取整）
+func (cfg PointsRedemptionConfig) PointsToDiscount(points int) float64 {
+	if cfg.PointsPerYuan <= 0 || points <= 0 {
+		return 0
+	}
+	return math.Floor(float64(points)*100/float64(cfg.PointsPerYuan)) / 100
+}
+
+// QuotePointsRedemption 计算用户本单可使用的积分（usePoints 超过上限时按上限计算，用于结算页展示）
+// goodsAmount 为商品金额，couponDiscount 为优惠券抵扣，积分与优惠券合计不超过商品金额
+func QuotePointsRedemption(userID int, goodsAmount, couponDiscount float64, usePoints int) (*PointsRedemptionQuote, error) {
+	var balance int
+	if err := database.DB.QueryRow(`SELECT COALESCE(points, 0) FROM mini_app_users WHERE id = ?`, userID).Scan(&balance); err != nil {
+		return nil, fmt.Errorf("获取用户积分失败: %v", err)
+	}
+
+	cfg := GetPointsRedemptionConfig()
+	quote := &PointsRedemptionQuote{PointsRedemptionConfig: cfg, Balance: balance}
+	switch {
+	case cfg.PointsPerYuan <= 0 || cfg.MaxPercent <= 0:
+		quote.Reason = "暂未开放积分抵扣"
+		return quote, nil
+	case goodsAmount < cfg.MinOrderAmount:
+		quote.Reason = fmt.Sprintf("商品金额满%.2f元可使用积分", cfg.MinOrderAmount)
+		return quote, nil
+	case balance <= 0:
+		quote.Reason = "暂无可用积分"
+		return quote, nil
+	}
+
+	maxDiscount := math.Floor(goodsAmount*cfg.MaxPercent) / 100
+	if remaining := roundMoney(goodsAmount - couponDiscount); maxDiscount > remaining {
+		maxDiscount = remaining
+	}
+	maxPoints := int(math.Floor(maxDiscount * float64(cfg.PointsPerYuan)))
+	if maxPoints > balance {
+		maxPoints = balance
+	}
+	if maxPoints <= 0 || cfg.PointsToDiscount(maxPoints) <= 0 {
+		quote.Reason = "本单不可使用积分"
+		return quote, nil
+	}
+
+	quote.Enabled = true
+	quote.MaxPoints = maxPoints
+	quote.MaxDiscount = cfg.PointsToDiscount(maxPoints)
+	if usePoints > maxPoints {
+		usePoints = maxPoints
+	}
+	if usePoints > 0 {
+		quote.UsePoints = usePoints
+		quote.Discount = cfg.PointsToDiscount(usePoints)
+	}
+	return quote, nil
+}
+
+// ValidatePointsRedemption 下单时校验积分使用数量，返回抵扣金额；usePoints 为 0 表示不使用积分
+func ValidatePointsRedemption(userID int, goodsAmount, couponDiscount float64, usePoints int) (float64, error) {
+	if usePoints < 0 {
+		return 0, fmt.Errorf("积分数量不正确")
+	}
+	if usePoints == 0 {
+		return 0, nil
+	}
+	quote, err := QuotePointsRedemption(userID, goodsAmount, couponDiscount, 0)
+	if err != nil {
+		return 0, err
+	}
+	if !quote.Enabled {
+		return 0, errors.New(quote.Reason)
+	}
+	if usePoints > quote.MaxPoints {
+		return 0, fmt.Errorf("本单最多可使用 %d 积分", quote.MaxPoints)
+	}
+	return quote.PointsRedemptionConfig.PointsToDiscount(usePoints), nil
+}
+
+// DeductOrderPointsInTx 在下单事务内扣减抵扣积分并记录积分明细
+// strict 为 false 时（已付款订单）余额不足只扣减现有余额，不让订单创建失败，少扣的积分记录为待处理的抵扣差额
+func DeductOrderPointsInTx(tx *sql.Tx, userID, orderID int, orderNumber string, points int, discount float64, strict bool) error {
+	if points <= 0 {
+		return nil
+	}
+	var balance int
+	if err := tx.QueryRow(`SELECT COALESCE(points, 0) FROM mini_app_users WHERE id = ? FOR UPDATE`, userID).Scan(&balance); err != nil {
+		return fmt.Errorf("获取用户积分失败: %v", err)
+	}
+	deduct := points
+	if balance < points {
+		if strict {
+			return ErrInsufficientPoints
+		}
+		log.Printf("[PointsRedemption] 订单 %s 抵扣积分 %d 超过用户 %d 当前余额 %d，按余额扣减", orderNumber, points, userID, balance)
+		deduct = balance
+		if deduct < 0 {
+			deduct = 0
+		}
+		if err := recordPointsShortfallInTx(tx, &PointsShortfall{
+			OrderID:         orderID,
+			OrderNumber:     orderNumber,
+			UserID:          userID,
+			PointsRequested: points,
+			PointsDeducted:  deduct,
+			ShortfallPoints: points - deduct,
+			ShortfallAmount: roundMoney(discount * float64(points-deduct) / float64(points)),
+		}); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE orders SET points_used = ? WHERE id = ?`, deduct, orderID); err != nil {
+		return fmt.Errorf("记录订单使用积分失败: %v", err)
+	}
+	if deduct <= 0 {
+		return nil
+	}
+	desc := fmt.Sprintf("下单积分抵扣（订单号：%s，抵扣金额：%.2f元）", orderNumber, discount)
+	_, err := applyPointsChangeInTx(tx, userID, -deduct, PointsTypeDiscount, orderID, "order", desc)
+	return err
+}
+
+// RefundOrderRedeemedPoints 订单取消后退回全部未退回的抵扣积分（可重复调用）
+func RefundOrderRedeemedPoints(orderID int) error {
+	return refundRedeemedPoints(orderID, 0, "订单取消退回抵扣积分")
+}
+
+// refundAfterSalesRedeemedPoints 售后退款完成后，按退款商品金额占比退回抵扣积分
+// 与售后单的 points_refunded 标记同一事务提交，任务重试时不会重复退回
+func refundAfterSalesRedeemedPoints(req *AfterSalesRequest) error {
+	var pointsUsed int
+	var goodsAmount float64
+	if err := database.DB.QueryRow(`
+		SELECT COALESCE(points_used, 0), goods_amount FROM orders WHERE id = ?
+	`, req.OrderID).Scan(&pointsUsed, &goodsAmount); err != nil {
+		return fmt.Errorf("查询订单 %d 使用积分失败: %v", req.OrderID, err)
+	}
+	if pointsUsed <= 0 || goodsAmount <= 0 {
+		return nil
+	}
+	points := int(math.Round(float64(pointsUsed) * req.GoodsAmount / goodsAmount))
+	if points <= 0 {
+		return nil
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var refunded int
+	if err := tx.QueryRow(`SELECT points_refunded FROM after_sales_requests WHERE id = ? FOR UPDATE`, req.ID).Scan(&refunded); err != nil {
+		return err
+	}
+	if refunded > 0 {
+		return nil
+	}
+	desc := fmt.Sprintf("售后单 %s 退款退回抵扣积分", req.RequestNo)
+	refunded, err = refundRedeemedPointsInTx(tx, req.OrderID, points, desc)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE after_sales_requests SET points_refunded = ? WHERE id = ?`, refunded, req.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// refundRedeemedPoints 退回订单抵扣积分，points 为 0 表示退回全部剩余，累计退回不超过下单使用的积分
+func refundRedeemedPoints(orderID, points int, description string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := refundRedeemedPointsInTx(tx, orderID, points, description); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// refundRedeemedPointsInTx 在事务内退回订单抵扣积分，返回实际退回的积分
+func refundRedeemedPointsInTx(tx *sql.Tx, orderID, points int, description string) (int, error) {
+	var userID, pointsUsed int
+	var orderNumber sql.NullString
+	err := tx.QueryRow(`SELECT user_id, order_number, COALESCE(points_used, 0) FROM orders WHERE id = ?`, orderID).Scan(&userID, &orderNumber, &pointsUsed)
+	if err == sql.ErrNoRows || (err == nil && pointsUsed <= 0) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("查询订单使用积分失败: %v", err)
+	}
+
+	// 锁定用户积分，保证并发退回时只退一次
+	if _, err := tx.Exec(`SELECT id FROM mini_app_users WHERE id = ? FOR UPDATE`, userID); err != nil {
+		return 0, fmt.Errorf("锁定用户积分失败: %v", err)
+	}
+	var refunded int
+	if err := tx.QueryRow(`
+		SELECT COALESCE(SUM(points), 0) FROM points_logs
+		WHERE type = ? AND related_type = 'order' AND related_id = ?
+	`, PointsTypeDiscountRefund, orderID).Scan(&refunded); err != nil {
+		return 0, fmt.Errorf("查询已退回积分失败: %v", err)
+	}
+	remaining := pointsUsed - refunded
+	if points <= 0 || points > remaining {
+		points = remaining
+	}
+	if points <= 0 {
+		return 0, nil
+	}
+
+	// 恢复下单抵扣时消耗的原积分批次，保留原到期时间，避免退回的积分获得新的有效期
+	var deductLogIDs []int
+	logRows, err := tx.Query(`
+		SELECT id FROM points_logs
+		WHERE user_id = ? AND type = ? AND related_type = 'order' AND related_id = ?
+	`, userID, PointsTypeDiscount, orderID)
+	if err != nil {
+		return 0, fmt.Errorf("查询抵扣积分明细失败: %v", err)
+	}
+	for logRows.Next() {
+		var id int
+		if err := logRows.Scan(&id); err != nil {
+			logRows.Close()
+			return 0, err
+		}
+		deductLogIDs = append(deductLogIDs, id)
+	}
+	logRows.Close()
+
+	desc := fmt.Sprintf("%s（订单号：%s）", description, orderNumber.String)
+	if _, err := restoreConsumedPointsInTx(tx, userID, points, deductLogIDs, PointsTypeDiscountRefund, orderID, "order", desc); err != nil {
+		return 0, err
+	}
+	log.Printf("订单 %d 退回用户 %d 抵扣积分 %d", orderID, userID, points)
+	return points, nil
+}
@@ -0,0 +1,118 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 积分抵扣差额处理状态
+const (
+	PointsShortfallPending  = "pending"  // 待处理
+	PointsShortfallResolved = "resolved" // 已处理（已追扣、补差或确认豁免）
+)
+
+// PointsShortfall 已付款订单抵扣积分超过用户当时余额时的差额记录
+// 订单已按下单时的积分抵扣金额付款，少扣的积分对应的抵扣金额需人工追扣或确认豁免
+type PointsShortfall struct {
+	ID              int        `json:"id"`
+	OrderID         int        `json:"order_id"`
+	OrderNumber     string     `json:"order_number"`
+	UserID          int        `json:"user_id"`
+	PointsRequested int        `json:"points_requested"` // 下单时使用的积分
+	PointsDeducted  int        `json:"points_deducted"`  // 实际扣减的积分
+	ShortfallPoints int        `json:"shortfall_points"` // 少扣的积分
+	ShortfallAmount float64    `json:"shortfall_amount"` // 少扣积分对应的抵扣金额（元）
+	Status          string     `json:"status"`
+	HandledBy       *string    `json:"handled_by,omitempty"`
+	HandledAt       *time.Time `json:"handled_at,omitempty"`
+	Remark          *string    `json:"remark,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// recordPointsShortfallInTx 在下单事务内记录积分抵扣差额（同一订单只记录一次）
+func recordPointsShortfallInTx(tx *sql.Tx, s *PointsShortfall) error {
+	_, err := tx.Exec(`
+		INSERT INTO points_shortfalls (
+			order_id, order_number, user_id, points_requested, points_deducted, shortfall_points, shortfall_amount, status, created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())
+		ON DUPLICATE KEY UPDATE updated_at = updated_at
+	`, s.OrderID, s.OrderNumber, s.UserID, s.PointsRequested, s.PointsDeducted, s.ShortfallPoints, s.ShortfallAmount, PointsShortfallPending)
+	if err != nil {
+		return fmt.Errorf("记录积分抵扣差额失败: %v", err)
+	}
+	return nil
+}
+
+// GetPointsShortfalls 获取积分抵扣差额列表（分页），status 为空表示全部
+func GetPointsShortfalls(status string, pageNum, pageSize int) ([]PointsShortfall, int, error) {
+	where := "1=1"
+	args := []interface{}{}
+	if status != "" {
+		where += " AND status = ?"
+		args = append(args, status)
+	}
+
+	var total int
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM points_shortfalls WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	offset := (pageNum - 1) * pageSize
+	if offset < 0 {
+		offset = 0
+	}
+	rows, err := database.DB.Query(`
+		SELECT id, order_id, order_number, user_id, points_requested, points_deducted, shortfall_points, shortfall_amount,
+		       status, handled_by, handled_at, remark, created_at, updated_at
+		FROM points_shortfalls
+		WHERE `+where+`
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?
+	`, append(args, pageSize, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	list := make([]PointsShortfall, 0)
+	for rows.Next() {
+		var s PointsShortfall
+		var handledBy, remark sql.NullString
+		var handledAt sql.NullTime
+		if err := rows.Scan(&s.ID, &s.OrderID, &s.OrderNumber, &s.UserID, &s.PointsRequested, &s.PointsDeducted, &s.ShortfallPoints,
+			&s.ShortfallAmount, &s.Status, &handledBy, &handledAt, &remark, &s.CreatedAt, &s.UpdatedAt); err != nil {
+			return nil, 0, err
+		}
+		if handledBy.Valid {
+			s.HandledBy = &handledBy.String
+		}
+		if handledAt.Valid {
+			s.HandledAt = &handledAt.Time
+		}
+		if remark.Valid {
+			s.Remark = &remark.String
+		}
+		list = append(list, s)
+	}
+	return list, total, rows.Err()
+}
+
+// ResolvePointsShortfall 标记积分抵扣差额已处理
+func ResolvePointsShortfall(id int, operator, remark string) error {
+	result, err := database.DB.Exec(`
+		UPDATE points_shortfalls
+		SET status = ?, handled_by = ?, handled_at = NOW(), remark = ?, updated_at = NOW()
+		WHERE id = ? AND status = ?
+	`, PointsShortfallResolved, operator, remark, id, PointsShortfallPending)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("记录不存在或已处理")
+	}
+	return nil
+}
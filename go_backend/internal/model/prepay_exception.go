@@ -0,0 +1,239 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 支付回调异常原因
+const (
+	PrepayExceptionCacheMissing    = "cache_missing"     // 预支付缓存不存在
+	PrepayExceptionCacheExpired    = "cache_expired"     // 预支付缓存已过期
+	PrepayExceptionOrderFailed     = "order_failed"      // 从缓存建单失败
+	PrepayExceptionConsumedNoOrder = "consumed_no_order" // 快照已消费但没有对应订单
+)
+
+// 支付回调异常处理状态
+const (
+	PrepayExceptionPending   = "pending"   // 待处理
+	PrepayExceptionConverted = "converted" // 已补单
+	PrepayExceptionRefunded  = "refunded"  // 已退款
+	PrepayExceptionIgnored   = "ignored"   // 已忽略
+)
+
+// PrepayNotifyException 支付成功但未能自动创建订单的回调记录
+type PrepayNotifyException struct {
+	ID            int        `json:"id"`
+	OutTradeNo    string     `json:"out_trade_no"`
+	TransactionID string     `json:"transaction_id"`
+	Amount        float64    `json:"amount"`
+	PayerOpenID   string     `json:"payer_openid"`
+	Reason        string     `json:"reason"`
+	ErrorMessage  *string    `json:"error_message,omitempty"`
+	Status        string     `json:"status"`
+	OrderID       *int       `json:"order_id,omitempty"`
+	RefundID      *string    `json:"refund_id,omitempty"`
+	HandledBy     *string    `json:"handled_by,omitempty"`
+	HandledAt     *time.Time `json:"handled_at,omitempty"`
+	Remark        *string    `json:"remark,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	HasSnapshot   bool       `json:"has_snapshot"` // 是否仍保留下单快照（可补单）
+}
+
+// RecordPrepayNotifyException 记录支付回调异常（同一商户订单号重复回调只更新原因，已处理的不再变更）
+func RecordPrepayNotifyException(e *PrepayNotifyException) error {
+	_, err := database.DB.Exec(`
+		INSERT INTO prepay_notify_exceptions (out_trade_no, transaction_id, amount, payer_openid, reason, error_message, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NOW(), NOW())
+		ON DUPLICATE KEY UPDATE
+			reason = IF(status = ?, VALUES(reason), reason),
+			error_message = IF(status = ?, VALUES(error_message), error_message),
+			updated_at = NOW()
+	`, e.OutTradeNo, e.TransactionID, e.Amount, e.PayerOpenID, e.Reason, e.ErrorMessage, PrepayExceptionPending,
+		PrepayExceptionPending, PrepayExceptionPending)
+	return err
+}
+
+// ResolvePrepayNotifyExceptionByOrder 微信重试回调后自动建单成功时，关闭对应的待处理异常
+func ResolvePrepayNotifyExceptionByOrder(outTradeNo string, orderID int) error {
+	_, err := database.DB.Exec(`
+		UPDATE prepay_notify_exceptions
+		SET status = ?, order_id = ?, handled_by = 'system', handled_at = NOW(), updated_at = NOW()
+		WHERE out_trade_no = ? AND status = ?
+	`, PrepayExceptionConverted, orderID, outTradeNo, PrepayExceptionPending)
+	return err
+}
+
+// GetPrepayNotifyExceptions 获取支付回调异常列表（分页），status 为空表示全部
+func GetPrepayNotifyExceptions(status string, pageNum, pageSize int) ([]PrepayNotifyException, int, error) {
+	where := "1=1"
+	args := []interface{}{}
+	if status != "" {
+		where += " AND status = ?"
+		args = append(args, status)
+	}
+
+	var total int
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM prepay_notify_exceptions WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	offset := (pageNum - 1) * pageSize
+	if offset < 0 {
+		offset = 0
+	}
+	rows, err := database.DB.Query(`
+		SELECT `+prepayExceptionColumns+`
+		FROM prepay_notify_exceptions
+		WHERE `+where+`
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?
+	`, append(args, pageSize, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	list := make([]PrepayNotifyException, 0)
+	for rows.Next() {
+		e, err := scanPrepayNotifyException(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		list = append(list, *e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	store := GetPrepayStore()
+	for i := range list {
+		if _, err := store.Peek(list[i].OutTradeNo); err == nil {
+			list[i].HasSnapshot = true
+		}
+	}
+	return list, total, nil
+}
+
+// GetPrepayNotifyExceptionByID 获取支付回调异常详情
+func GetPrepayNotifyExceptionByID(id int) (*PrepayNotifyException, error) {
+	row := database.DB.QueryRow(`SELECT `+prepayExceptionColumns+` FROM prepay_notify_exceptions WHERE id = ?`, id)
+	e, err := scanPrepayNotifyException(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := GetPrepayStore().Peek(e.OutTradeNo); err == nil {
+		e.HasSnapshot = true
+	}
+	return e, nil
+}
+
+// ConvertPrepayNotifyException 使用保留的下单快照补建订单（已支付、待配送）
+func ConvertPrepayNotifyException(id int, operator, remark string) (*Order, error) {
+	e, err := GetPrepayNotifyExceptionByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, fmt.Errorf("异常记录不存在")
+	}
+	if e.Status != PrepayExceptionPending {
+		return nil, fmt.Errorf("该记录已处理")
+	}
+	if existing, _ := GetOrderByOrderNumber(e.OutTradeNo); existing != nil {
+		// 已有订单（如微信重试回调已建单），直接关闭异常
+		if err := markPrepayNotifyExceptionHandled(id, PrepayExceptionConverted, &existing.ID, nil, operator, remark); err != nil {
+			return nil, err
+		}
+		return existing, nil
+	}
+
+	if e.Reason == PrepayExceptionConsumedNoOrder {
+		// 快照已标记消费但确认没有订单（建单中断），撤销消费后再补单
+		if err := GetPrepayStore().Restore(e.OutTradeNo); err != nil {
+			return nil, err
+		}
+	}
+	order, _, err := CreateOrderFromPrepaySnapshot(e.OutTradeNo, e.TransactionID, true)
+	if err == ErrPrepayNotFound || err == ErrPrepayExpired || err == ErrPrepayConsumed {
+		return nil, fmt.Errorf("下单快照不可用，请改为退款: %v", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("补单失败: %v", err)
+	}
+	if err := markPrepayNotifyExceptionHandled(id, PrepayExceptionConverted, &order.ID, nil, operator, remark); err != nil {
+		return order, err
+	}
+	return order, nil
+}
+
+// MarkPrepayNotifyExceptionRefunded 标记已退款
+func MarkPrepayNotifyExceptionRefunded(id int, refundID, operator, remark string) error {
+	return markPrepayNotifyExceptionHandled(id, PrepayExceptionRefunded, nil, &refundID, operator, remark)
+}
+
+// IgnorePrepayNotifyException 标记已忽略（如已线下处理）
+func IgnorePrepayNotifyException(id int, operator, remark string) error {
+	return markPrepayNotifyExceptionHandled(id, PrepayExceptionIgnored, nil, nil, operator, remark)
+}
+
+func markPrepayNotifyExceptionHandled(id int, status string, orderID *int, refundID *string, operator, remark string) error {
+	result, err := database.DB.Exec(`
+		UPDATE prepay_notify_exceptions
+		SET status = ?, order_id = COALESCE(?, order_id), refund_id = COALESCE(?, refund_id),
+			handled_by = ?, handled_at = NOW(), remark = ?, updated_at = NOW()
+		WHERE id = ? AND status = ?
+	`, status, orderID, refundID, operator, remark, id, PrepayExceptionPending)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("该记录已处理")
+	}
+	return nil
+}
+
+const prepayExceptionColumns = `id, out_trade_no, transaction_id, amount, payer_openid, reason, error_message, status,
+	order_id, refund_id, handled_by, handled_at, remark, created_at, updated_at`
+
+type prepayExceptionScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPrepayNotifyException(row prepayExceptionScanner) (*PrepayNotifyException, error) {
+	var e PrepayNotifyException
+	var errMsg, refundID, handledBy, remark sql.NullString
+	var orderID sql.NullInt64
+	var handledAt sql.NullTime
+	if err := row.Scan(&e.ID, &e.OutTradeNo, &e.TransactionID, &e.Amount, &e.PayerOpenID, &e.Reason, &errMsg, &e.Status,
+		&orderID, &refundID, &handledBy, &handledAt, &remark, &e.CreatedAt, &e.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if errMsg.Valid {
+		e.ErrorMessage = &errMsg.String
+	}
+	if orderID.Valid {
+		v := int(orderID.Int64)
+		e.OrderID = &v
+	}
+	if refundID.Valid {
+		e.RefundID = &refundID.String
+	}
+	if handledBy.Valid {
+		e.HandledBy = &handledBy.String
+	}
+	if handledAt.Valid {
+		e.HandledAt = &handledAt.Time
+	}
+	if remark.Valid {
+		e.Remark = &remark.String
+	}
+	return &e, nil
+}
@@ -0,0 +1,261 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 预支付缓存错误
+var (
+	ErrPrepayNotFound = errors.New("预支付缓存不存在")
+	ErrPrepayExpired  = errors.New("预支付缓存已过期")
+	ErrPrepayConsumed = errors.New("预支付缓存已被消费")
+)
+
+// 预支付缓存状态
+const (
+	PrepayStatusPending  = "pending"  // 待支付
+	PrepayStatusConsumed = "consumed" // 已创建订单
+)
+
+// prepayRetention 过期或已消费的快照保留时长，便于对账时人工补单
+const prepayRetention = 7 * 24 * time.Hour
+
+// PrepayStore 预支付缓存存储：WeChatPrepayFromCheckout 写入下单快照，支付回调时一次性消费并创建订单
+type PrepayStore interface {
+	// Save 写入下单快照，ttl 后过期
+	Save(outTradeNo string, entry *CachedPrepayEntry, ttl time.Duration) error
+	// Consume 原子地取出快照并标记为已消费，同一单号只能成功一次
+	// includeExpired 为 true 时允许消费已过期但仍保留的快照（人工补单）
+	Consume(outTradeNo string, includeExpired bool) (*CachedPrepayEntry, error)
+	// Restore 建单失败时撤销消费，微信重试回调时可再次消费
+	Restore(outTradeNo string) error
+	// Peek 查看快照（不消费，忽略过期），用于对账
+	Peek(outTradeNo string) (*CachedPrepayEntry, error)
+	// SweepExpired 清理超过保留期的快照，返回清理条数
+	SweepExpired() (int, error)
+}
+
+// txPrepayStore 支持在建单事务内消费快照的存储：建单失败回滚时快照自动恢复为待支付，
+// 不会出现「已消费但无订单」的中间状态
+type txPrepayStore interface {
+	ConsumeInTx(tx *sql.Tx, outTradeNo string, includeExpired bool) (*CachedPrepayEntry, error)
+}
+
+var (
+	prepayStore     PrepayStore = NewMySQLPrepayStore()
+	prepayStoreLock sync.RWMutex
+)
+
+// SetPrepayStore 设置预支付缓存存储（启动时调用）
+func SetPrepayStore(store PrepayStore) {
+	prepayStoreLock.Lock()
+	defer prepayStoreLock.Unlock()
+	prepayStore = store
+}
+
+// GetPrepayStore 获取当前预支付缓存存储
+func GetPrepayStore() PrepayStore {
+	prepayStoreLock.RLock()
+	defer prepayStoreLock.RUnlock()
+	return prepayStore
+}
+
+// memoryPrepayStore 进程内存储，仅用于本地开发（进程重启后丢失）
+type memoryPrepayStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryPrepayEntry
+}
+
+type memoryPrepayEntry struct {
+	data      *CachedPrepayEntry
+	status    string
+	expiresAt time.Time
+}
+
+// NewMemoryPrepayStore 创建进程内预支付缓存存储
+func NewMemoryPrepayStore() PrepayStore {
+	return &memoryPrepayStore{entries: make(map[string]*memoryPrepayEntry)}
+}
+
+func (s *memoryPrepayStore) Save(outTradeNo string, entry *CachedPrepayEntry, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[outTradeNo] = &memoryPrepayEntry{data: entry, status: PrepayStatusPending, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *memoryPrepayStore) Consume(outTradeNo string, includeExpired bool) (*CachedPrepayEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[outTradeNo]
+	if !ok {
+		return nil, ErrPrepayNotFound
+	}
+	if e.status == PrepayStatusConsumed {
+		return nil, ErrPrepayConsumed
+	}
+	if !includeExpired && time.Now().After(e.expiresAt) {
+		return nil, ErrPrepayExpired
+	}
+	e.status = PrepayStatusConsumed
+	return e.data, nil
+}
+
+func (s *memoryPrepayStore) Restore(outTradeNo string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[outTradeNo]; ok {
+		e.status = PrepayStatusPending
+	}
+	return nil
+}
+
+func (s *memoryPrepayStore) Peek(outTradeNo string) (*CachedPrepayEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[outTradeNo]
+	if !ok {
+		return nil, ErrPrepayNotFound
+	}
+	return e.data, nil
+}
+
+func (s *memoryPrepayStore) SweepExpired() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deadline := time.Now().Add(-prepayRetention)
+	n := 0
+	for k, e := range s.entries {
+		if e.expiresAt.Before(deadline) {
+			delete(s.entries, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// mysqlPrepayStore 基于 prepay_cache_entries 表的存储，进程重启后快照不丢失
+type mysqlPrepayStore struct{}
+
+// NewMySQLPrepayStore 创建 MySQL 预支付缓存存储
+func NewMySQLPrepayStore() PrepayStore {
+	return mysqlPrepayStore{}
+}
+
+func (mysqlPrepayStore) Save(outTradeNo string, entry *CachedPrepayEntry, ttl time.Duration) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("序列化预支付缓存失败: %v", err)
+	}
+	_, err = database.DB.Exec(`
+		INSERT INTO prepay_cache_entries (out_trade_no, user_id, payload, status, expires_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND), NOW(), NOW())
+		ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), payload = VALUES(payload), status = VALUES(status),
+			expires_at = VALUES(expires_at), consumed_at = NULL, updated_at = NOW()
+	`, outTradeNo, entry.UserID, string(data), PrepayStatusPending, int(ttl.Seconds()))
+	return err
+}
+
+func (s mysqlPrepayStore) Consume(outTradeNo string, includeExpired bool) (*CachedPrepayEntry, error) {
+	// 条件更新保证并发回调只有一个能消费成功
+	result, err := database.DB.Exec(`
+		UPDATE prepay_cache_entries
+		SET status = ?, consumed_at = NOW(), updated_at = NOW()
+		WHERE out_trade_no = ? AND status = ? AND (? OR expires_at > NOW())
+	`, PrepayStatusConsumed, outTradeNo, PrepayStatusPending, includeExpired)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		var status string
+		var expired bool
+		err := database.DB.QueryRow(`
+			SELECT status, expires_at <= NOW() FROM prepay_cache_entries WHERE out_trade_no = ?
+		`, outTradeNo).Scan(&status, &expired)
+		if err == sql.ErrNoRows {
+			return nil, ErrPrepayNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if status == PrepayStatusConsumed {
+			return nil, ErrPrepayConsumed
+		}
+		return nil, ErrPrepayExpired
+	}
+	return s.Peek(outTradeNo)
+}
+
+// ConsumeInTx 在调用方事务内锁定并消费快照，并发回调在行锁上排队，前一个提交后再看到已消费
+func (mysqlPrepayStore) ConsumeInTx(tx *sql.Tx, outTradeNo string, includeExpired bool) (*CachedPrepayEntry, error) {
+	var status, payload string
+	var expired bool
+	err := tx.QueryRow(`
+		SELECT status, expires_at <= NOW(), payload FROM prepay_cache_entries WHERE out_trade_no = ? FOR UPDATE
+	`, outTradeNo).Scan(&status, &expired, &payload)
+	if err == sql.ErrNoRows {
+		return nil, ErrPrepayNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status == PrepayStatusConsumed {
+		return nil, ErrPrepayConsumed
+	}
+	if expired && !includeExpired {
+		return nil, ErrPrepayExpired
+	}
+	if _, err := tx.Exec(`
+		UPDATE prepay_cache_entries SET status = ?, consumed_at = NOW(), updated_at = NOW() WHERE out_trade_no = ?
+	`, PrepayStatusConsumed, outTradeNo); err != nil {
+		return nil, err
+	}
+	var entry CachedPrepayEntry
+	if err := json.Unmarshal([]byte(payload), &entry); err != nil {
+		return nil, fmt.Errorf("解析预支付缓存失败: %v", err)
+	}
+	return &entry, nil
+}
+
+func (mysqlPrepayStore) Restore(outTradeNo string) error {
+	_, err := database.DB.Exec(`
+		UPDATE prepay_cache_entries
+		SET status = ?, consumed_at = NULL, updated_at = NOW()
+		WHERE out_trade_no = ? AND status = ?
+	`, PrepayStatusPending, outTradeNo, PrepayStatusConsumed)
+	return err
+}
+
+func (mysqlPrepayStore) Peek(outTradeNo string) (*CachedPrepayEntry, error) {
+	var payload string
+	err := database.DB.QueryRow(`SELECT payload FROM prepay_cache_entries WHERE out_trade_no = ?`, outTradeNo).Scan(&payload)
+	if err == sql.ErrNoRows {
+		return nil, ErrPrepayNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry CachedPrepayEntry
+	if err := json.Unmarshal([]byte(payload), &entry); err != nil {
+		return nil, fmt.Errorf("解析预支付缓存失败: %v", err)
+	}
+	return &entry, nil
+}
+
+func (mysqlPrepayStore) SweepExpired() (int, error) {
+	result, err := database.DB.Exec(`
+		DELETE FROM prepay_cache_entries WHERE expires_at < DATE_SUB(NOW(), INTERVAL ? SECOND)
+	`, int(prepayRetention.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+	return int(n), nil
+}
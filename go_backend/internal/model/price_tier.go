@@ -0,0 +1,127 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SpecPriceTier 规格的批发阶梯价：采购数量达到 MinQuantity 时按 Price 计价（仅批发客户）
+type SpecPriceTier struct {
+	MinQuantity int     `json:"min_quantity"`
+	Price       float64 `json:"price"`
+}
+
+// PriceTierRange 阶梯价区间（商品详情展示用），MaxQuantity 为空表示不封顶
+type PriceTierRange struct {
+	MinQuantity int     `json:"min_quantity"`
+	MaxQuantity *int    `json:"max_quantity"`
+	Price       float64 `json:"price"`
+}
+
+// PriceTierHint 采购单凑单提示：再买 AddQuantity 件即可享受 NextPrice
+type PriceTierHint struct {
+	CurrentPrice    float64 `json:"current_price"`
+	NextMinQuantity int     `json:"next_min_quantity"`
+	NextPrice       float64 `json:"next_price"`
+	AddQuantity     int     `json:"add_quantity"`
+}
+
+// normalizeSpecPriceTiers 校验并按起订数量排序各规格的阶梯价
+// 起订数量须不小于2且不重复，价格须大于0、不高于批发价，且数量越多价格不升
+func normalizeSpecPriceTiers(specs []Spec) error {
+	for i := range specs {
+		tiers := specs[i].PriceTiers
+		if len(tiers) == 0 {
+			specs[i].PriceTiers = nil
+			continue
+		}
+		sort.SliceStable(tiers, func(a, b int) bool { return tiers[a].MinQuantity < tiers[b].MinQuantity })
+		prevPrice := specs[i].WholesalePrice
+		for j, t := range tiers {
+			if t.MinQuantity < 2 {
+				return fmt.Errorf("规格「%s」阶梯价起订数量必须大于1", specs[i].Name)
+			}
+			if j > 0 && t.MinQuantity == tiers[j-1].MinQuantity {
+				return fmt.Errorf("规格「%s」阶梯价起订数量 %d 重复", specs[i].Name, t.MinQuantity)
+			}
+			if t.Price <= 0 {
+				return fmt.Errorf("规格「%s」阶梯价必须大于0", specs[i].Name)
+			}
+			if prevPrice > 0 && t.Price > prevPrice {
+				return fmt.Errorf("规格「%s」阶梯价不能高于批发价或更低数量档位的价格", specs[i].Name)
+			}
+			prevPrice = t.Price
+		}
+	}
+	return nil
+}
+
+// tieredUnitPrice 按采购数量命中的阶梯价，未命中时返回 false
+func tieredUnitPrice(tiers []SpecPriceTier, quantity int) (float64, bool) {
+	price, matched := 0.0, false
+	for _, t := range tiers {
+		if t.MinQuantity > 0 && quantity >= t.MinQuantity && t.Price > 0 {
+			price, matched = t.Price, true
+		}
+	}
+	return price, matched
+}
+
+// specUnitPrice 按客户类型和采购数量取规格单价（批发客户命中阶梯价时按阶梯价，不含促销）
+func specUnitPrice(snapshot PurchaseSpecSnapshot, userType string, quantity int) float64 {
+	price := specBaseUnitPrice(snapshot, userType)
+	if userType == "wholesale" {
+		if tierPrice, ok := tieredUnitPrice(snapshot.PriceTiers, quantity); ok && tierPrice < price {
+			price = tierPrice
+		}
+	}
+	return price
+}
+
+// ItemUnitPrice 采购单项按客户类型和数量计算的单价（含阶梯价，不含促销和改价）
+func ItemUnitPrice(item PurchaseListItem, userType string) float64 {
+	return specUnitPrice(item.SpecSnapshot, userType, item.Quantity)
+}
+
+// BuildSpecPriceTierRanges 生成规格的批发价区间，如 1-9、10-49、50+；没有阶梯价时返回空
+func BuildSpecPriceTierRanges(spec Spec) []PriceTierRange {
+	if len(spec.PriceTiers) == 0 {
+		return []PriceTierRange{}
+	}
+	ranges := make([]PriceTierRange, 0, len(spec.PriceTiers)+1)
+	if spec.WholesalePrice > 0 && spec.PriceTiers[0].MinQuantity > 1 {
+		maxQty := spec.PriceTiers[0].MinQuantity - 1
+		ranges = append(ranges, PriceTierRange{MinQuantity: 1, MaxQuantity: &maxQty, Price: spec.WholesalePrice})
+	}
+	for i, t := range spec.PriceTiers {
+		r := PriceTierRange{MinQuantity: t.MinQuantity, Price: t.Price}
+		if i+1 < len(spec.PriceTiers) {
+			maxQty := spec.PriceTiers[i+1].MinQuantity - 1
+			r.MaxQuantity = &maxQty
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// fillPriceTierHints 为批发客户的采购单项计算下一档阶梯价的凑单提示
+func fillPriceTierHints(items []PurchaseListItem, userType string) {
+	for i := range items {
+		items[i].TierHint = nil
+		if userType != "wholesale" {
+			continue
+		}
+		current := specUnitPrice(items[i].SpecSnapshot, userType, items[i].Quantity)
+		for _, t := range items[i].SpecSnapshot.PriceTiers {
+			if t.MinQuantity > items[i].Quantity && t.Price > 0 && t.Price < current {
+				items[i].TierHint = &PriceTierHint{
+					CurrentPrice:    current,
+					NextMinQuantity: t.MinQuantity,
+					NextPrice:       t.Price,
+					AddQuantity:     t.MinQuantity - items[i].Quantity,
+				}
+				break
+			}
+		}
+	}
+}
@@ -19,6 +19,7 @@ type Spec struct {
 	Description    string  `json:"description"`     // 规格描述（例如：≈1.5元/瓶）
 	DeliveryCount  float64 `json:"delivery_count"`  // 配送计件数（默认1.0，用于计算件数补贴）
 	UomUnitID      *int    `json:"uom_unit_id,omitempty"` // 绑定的单位ID，为空时默认使用件
+	PriceTiers     []SpecPriceTier `json:"price_tiers,omitempty"` // 批发阶梯价（按采购数量），为空时统一按批发价
 }
 
 // Product 商品模型
@@ -308,6 +309,9 @@ func CreateProduct(product *Product) error {
 		return err
 	}
 
+	if err := normalizeSpecPriceTiers(product.Specs); err != nil {
+		return err
+	}
 	specsJSON, err := json.Marshal(product.Specs)
 	if err != nil {
 		return err
@@ -351,6 +355,9 @@ func UpdateProduct(product *Product) error {
 		return err
 	}
 
+	if err := normalizeSpecPriceTiers(product.Specs); err != nil {
+		return err
+	}
 	specsJSON, err := json.Marshal(product.Specs)
 	if err != nil {
 		return err
@@ -0,0 +1,660 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 促销适用客户类型
+const (
+	PromotionUserTypeAll       = "all"
+	PromotionUserTypeWholesale = "wholesale"
+	PromotionUserTypeRetail    = "retail"
+)
+
+// 促销占用状态
+const (
+	PromotionUsageReserved = "reserved"
+	PromotionUsageReleased = "released"
+)
+
+// 促销列表筛选状态（按当前时间计算）
+const (
+	PromotionStateActive   = "active"   // 进行中
+	PromotionStateUpcoming = "upcoming" // 未开始
+	PromotionStateEnded    = "ended"    // 已结束
+	PromotionStateDisabled = "disabled" // 已停用
+)
+
+var (
+	ErrPromotionOverlap        = errors.New("该规格在同一时段已有适用于相同客户类型的促销")
+	ErrPromotionHasSales       = errors.New("促销已有订单占用，不能删除，可停用")
+	ErrPromotionQuantityTooLow = errors.New("促销总数量不能小于已售数量")
+)
+
+// PromotionChangedError 下单时促销已结束、停用或余量不足（采购单计价后促销发生了变化）
+type PromotionChangedError struct {
+	ProductName string
+	SpecName    string
+}
+
+func (e *PromotionChangedError) Error() string {
+	name := e.ProductName
+	if e.SpecName != "" {
+		name += "（" + e.SpecName + "）"
+	}
+	return fmt.Sprintf("%s 的限时促销已结束或已售罄，请刷新采购单后重新下单", name)
+}
+
+// ProductPromotion 限时促销：指定商品规格在时段内按促销价销售
+type ProductPromotion struct {
+	ID            int       `json:"id"`
+	Name          string    `json:"name"`
+	ProductID     int       `json:"product_id"`
+	ProductName   string    `json:"product_name,omitempty"`
+	SpecName      string    `json:"spec_name"`
+	UserType      string    `json:"user_type"` // all / wholesale / retail
+	PromoPrice    float64   `json:"promo_price"`
+	StartAt       time.Time `json:"start_at"`
+	EndAt         time.Time `json:"end_at"`
+	PerUserLimit  int       `json:"per_user_limit"` // 每个客户限购数量，0表示不限
+	TotalQuantity int       `json:"total_quantity"` // 促销总数量，0表示不限
+	SoldQuantity  int       `json:"sold_quantity"`
+	Status        int       `json:"status"`
+	State         string    `json:"state"` // active / upcoming / ended / disabled
+	CreatedBy     string    `json:"created_by"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// PromotionCountdown 商品列表展示的促销倒计时信息
+type PromotionCountdown struct {
+	PromotionID       int       `json:"promotion_id"`
+	SpecName          string    `json:"spec_name"`
+	UserType          string    `json:"user_type"`
+	PromoPrice        float64   `json:"promo_price"`
+	StartAt           time.Time `json:"start_at"`
+	EndAt             time.Time `json:"end_at"`
+	Started           bool      `json:"started"`
+	SecondsToStart    int64     `json:"seconds_to_start"` // 距开始秒数（未开始时）
+	SecondsLeft       int64     `json:"seconds_left"`     // 距结束秒数
+	PerUserLimit      int       `json:"per_user_limit"`
+	RemainingQuantity *int      `json:"remaining_quantity,omitempty"` // 剩余促销数量，不限时为空
+}
+
+// PromotionUse 下单时按促销价购买的数量
+type PromotionUse struct {
+	PromotionID int
+	OrderItemID int
+	ProductName string
+	SpecName    string
+	Quantity    int
+}
+
+// PromotionFilter 促销列表查询条件
+type PromotionFilter struct {
+	ProductID int
+	State     string
+	Keyword   string
+}
+
+// promotionUserTypeFor 将客户类型归一为促销适用类型（非批发客户按零售计价）
+func promotionUserTypeFor(userType string) string {
+	if userType == "wholesale" {
+		return PromotionUserTypeWholesale
+	}
+	return PromotionUserTypeRetail
+}
+
+// promotionStateOf 按当前时间计算促销状态
+func promotionStateOf(p *ProductPromotion, now time.Time) string {
+	switch {
+	case p.Status != 1:
+		return PromotionStateDisabled
+	case now.Before(p.StartAt):
+		return PromotionStateUpcoming
+	case !now.Before(p.EndAt):
+		return PromotionStateEnded
+	}
+	return PromotionStateActive
+}
+
+// itemPromoQuantity 采购单项按促销价计价的数量
+func itemPromoQuantity(item PurchaseListItem) int {
+	if item.SpecSnapshot.PromotionID == nil || item.SpecSnapshot.PromoQuantity <= 0 {
+		return 0
+	}
+	if item.SpecSnapshot.PromoQuantity > item.Quantity {
+		return item.Quantity
+	}
+	return item.SpecSnapshot.PromoQuantity
+}
+
+// itemPromoSavedAmount 采购单项因促销节省的金额
+func itemPromoSavedAmount(item PurchaseListItem, userType string) float64 {
+	promoQty := itemPromoQuantity(item)
+	if promoQty <= 0 {
+		return 0
+	}
+	saved := (specUnitPrice(item.SpecSnapshot, userType, item.Quantity) - item.SpecSnapshot.PromoPrice) * float64(promoQty)
+	if saved < 0 {
+		return 0
+	}
+	return saved
+}
+
+// ItemPromotionPricing 采购单项按限时促销计价后的小计和均价（促销数量按促销价，超出部分按原价）
+func ItemPromotionPricing(item PurchaseListItem, userType string) (unitPrice, subtotal float64, ok bool) {
+	if itemPromoQuantity(item) <= 0 || item.Quantity <= 0 {
+		return 0, 0, false
+	}
+	subtotal = roundMoney(calculateItemAmount(item, userType))
+	return roundMoney(subtotal / float64(item.Quantity)), subtotal, true
+}
+
+// ClearItemPromotion 清除规格快照中的促销信息（如改价后不再按促销价计价）
+func ClearItemPromotion(snapshot *PurchaseSpecSnapshot) {
+	snapshot.PromotionID = nil
+	snapshot.PromoPrice = 0
+	snapshot.PromoQuantity = 0
+	snapshot.PromoEndsAt = nil
+}
+
+// ItemPromotionUse 采购单项下单时需要占用的促销数量
+func ItemPromotionUse(item PurchaseListItem, orderItemID int) (PromotionUse, bool) {
+	promoQty := itemPromoQuantity(item)
+	if promoQty <= 0 {
+		return PromotionUse{}, false
+	}
+	return PromotionUse{
+		PromotionID: *item.SpecSnapshot.PromotionID,
+		OrderItemID: orderItemID,
+		ProductName: item.ProductName,
+		SpecName:    item.SpecName,
+		Quantity:    promoQty,
+	}, true
+}
+
+// applyUserPricing 按用户的客户类型为采购单填充当前有效的促销和阶梯价凑单提示
+func applyUserPricing(userID int, items []PurchaseListItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	var userType string
+	if err := database.DB.QueryRow(`SELECT COALESCE(user_type, '') FROM mini_app_users WHERE id = ?`, userID).Scan(&userType); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	fillPriceTierHints(items, userType)
+	return ApplyProductPromotions(userID, userType, items, 0)
+}
+
+// ApplyProductPromotions 为采购单项填充当前有效的限时促销（就地修改规格快照）
+// 促销数量受客户限购（已下单未取消的数量）和促销剩余数量限制，超出部分按原价；促销价不低于原价（含阶梯价）时不生效
+// excludeOrderID 不为 0 时不计入该订单已占用的数量（修改订单时使用）
+func ApplyProductPromotions(userID int, userType string, items []PurchaseListItem, excludeOrderID int) error {
+	productIDs := make([]interface{}, 0, len(items))
+	seen := make(map[int]bool)
+	for i := range items {
+		ClearItemPromotion(&items[i].SpecSnapshot)
+		if !seen[items[i].ProductID] {
+			seen[items[i].ProductID] = true
+			productIDs = append(productIDs, items[i].ProductID)
+		}
+	}
+	if len(productIDs) == 0 {
+		return nil
+	}
+
+	args := append([]interface{}{PromotionUserTypeAll, promotionUserTypeFor(userType)}, productIDs...)
+	rows, err := database.DB.Query(`
+		SELECT id, product_id, spec_name, promo_price, end_at, per_user_limit, total_quantity, sold_quantity
+		FROM product_promotions
+		WHERE status = 1 AND start_at <= NOW() AND end_at > NOW() AND user_type IN (?, ?)
+		  AND product_id IN (`+placeholders(len(productIDs))+`)
+		ORDER BY promo_price ASC, id ASC
+	`, args...)
+	if err != nil {
+		return err
+	}
+	promos := make(map[string]*ProductPromotion)
+	var promoIDs []interface{}
+	for rows.Next() {
+		var p ProductPromotion
+		if err := rows.Scan(&p.ID, &p.ProductID, &p.SpecName, &p.PromoPrice, &p.EndAt, &p.PerUserLimit, &p.TotalQuantity, &p.SoldQuantity); err != nil {
+			rows.Close()
+			return err
+		}
+		key := CouponSpecKey(p.ProductID, p.SpecName)
+		if _, exists := promos[key]; !exists {
+			promos[key] = &p
+			promoIDs = append(promoIDs, p.ID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(promos) == 0 {
+		return nil
+	}
+
+	used, err := getUserPromotionUsedQuantities(userID, promoIDs, excludeOrderID)
+	if err != nil {
+		return err
+	}
+
+	for i := range items {
+		p, ok := promos[CouponSpecKey(items[i].ProductID, items[i].SpecName)]
+		if !ok || p.PromoPrice >= specUnitPrice(items[i].SpecSnapshot, userType, items[i].Quantity) {
+			continue
+		}
+		allowed := items[i].Quantity
+		if p.PerUserLimit > 0 && p.PerUserLimit-used[p.ID] < allowed {
+			allowed = p.PerUserLimit - used[p.ID]
+		}
+		if p.TotalQuantity > 0 && p.TotalQuantity-p.SoldQuantity < allowed {
+			allowed = p.TotalQuantity - p.SoldQuantity
+		}
+		if allowed <= 0 {
+			continue
+		}
+		id, endAt := p.ID, p.EndAt
+		items[i].SpecSnapshot.PromotionID = &id
+		items[i].SpecSnapshot.PromoPrice = p.PromoPrice
+		items[i].SpecSnapshot.PromoQuantity = allowed
+		items[i].SpecSnapshot.PromoEndsAt = &endAt
+	}
+	return nil
+}
+
+// getUserPromotionUsedQuantities 用户在各促销中已占用（未取消订单）的数量
+func getUserPromotionUsedQuantities(userID int, promoIDs []interface{}, excludeOrderID int) (map[int]int, error) {
+	args := append([]interface{}{userID, PromotionUsageReserved, excludeOrderID}, promoIDs...)
+	rows, err := database.DB.Query(`
+		SELECT promotion_id, SUM(quantity)
+		FROM product_promotion_usages
+		WHERE user_id = ? AND status = ? AND order_id <> ? AND promotion_id IN (`+placeholders(len(promoIDs))+`)
+		GROUP BY promotion_id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	used := make(map[int]int)
+	for rows.Next() {
+		var id, qty int
+		if err := rows.Scan(&id, &qty); err != nil {
+			return nil, err
+		}
+		used[id] = qty
+	}
+	return used, rows.Err()
+}
+
+// ReservePromotionsInTx 在订单事务内占用促销数量
+// strict=true 时促销已失效或余量不足返回 PromotionChangedError；strict=false 时（支付回调，用户已按促销价付款）仍然占用并记录日志
+func ReservePromotionsInTx(tx *sql.Tx, userID, orderID int, uses []PromotionUse, strict bool) error {
+	for _, u := range uses {
+		if u.Quantity <= 0 {
+			continue
+		}
+		var status, perUserLimit, totalQuantity, soldQuantity int
+		var active bool
+		err := tx.QueryRow(`
+			SELECT status, per_user_limit, total_quantity, sold_quantity, (start_at <= NOW() AND end_at > NOW())
+			FROM product_promotions WHERE id = ? FOR UPDATE
+		`, u.PromotionID).Scan(&status, &perUserLimit, &totalQuantity, &soldQuantity, &active)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("查询促销失败: %v", err)
+		}
+		if err == sql.ErrNoRows {
+			if strict {
+				return &PromotionChangedError{ProductName: u.ProductName, SpecName: u.SpecName}
+			}
+			log.Printf("[Promotion] 订单 %d 使用的促销 %d 已不存在", orderID, u.PromotionID)
+			continue
+		}
+
+		ok := status == 1 && active && (totalQuantity <= 0 || soldQuantity+u.Quantity <= totalQuantity)
+		if ok && perUserLimit > 0 {
+			var used int
+			if err := tx.QueryRow(`
+				SELECT COALESCE(SUM(quantity), 0) FROM product_promotion_usages
+				WHERE promotion_id = ? AND user_id = ? AND status = ?
+			`, u.PromotionID, userID, PromotionUsageReserved).Scan(&used); err != nil {
+				return fmt.Errorf("查询促销限购失败: %v", err)
+			}
+			ok = used+u.Quantity <= perUserLimit
+		}
+		if !ok {
+			if strict {
+				return &PromotionChangedError{ProductName: u.ProductName, SpecName: u.SpecName}
+			}
+			log.Printf("[Promotion] 订单 %d 促销 %d 已失效或超出数量，按已付款金额照常占用 %d 件", orderID, u.PromotionID, u.Quantity)
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE product_promotions SET sold_quantity = sold_quantity + ?, updated_at = NOW() WHERE id = ?
+		`, u.Quantity, u.PromotionID); err != nil {
+			return fmt.Errorf("占用促销数量失败: %v", err)
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO product_promotion_usages (promotion_id, user_id, order_id, order_item_id, quantity, status, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, NOW(), NOW())
+		`, u.PromotionID, userID, orderID, u.OrderItemID, u.Quantity, PromotionUsageReserved); err != nil {
+			return fmt.Errorf("记录促销占用失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// ReleaseOrderPromotionsInTx 在事务内释放订单占用的促销数量（取消订单、修改订单时调用）
+func ReleaseOrderPromotionsInTx(tx *sql.Tx, orderID int) error {
+	rows, err := tx.Query(`
+		SELECT id, promotion_id, quantity FROM product_promotion_usages
+		WHERE order_id = ? AND status = ?
+		FOR UPDATE
+	`, orderID, PromotionUsageReserved)
+	if err != nil {
+		return err
+	}
+	type usage struct{ id, promotionID, quantity int }
+	var list []usage
+	for rows.Next() {
+		var u usage
+		if err := rows.Scan(&u.id, &u.promotionID, &u.quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		list = append(list, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range list {
+		if _, err := tx.Exec(`
+			UPDATE product_promotions SET sold_quantity = GREATEST(sold_quantity - ?, 0), updated_at = NOW() WHERE id = ?
+		`, u.quantity, u.promotionID); err != nil {
+			return fmt.Errorf("释放促销数量失败: %v", err)
+		}
+		if _, err := tx.Exec(`
+			UPDATE product_promotion_usages SET status = ?, updated_at = NOW() WHERE id = ?
+		`, PromotionUsageReleased, u.id); err != nil {
+			return fmt.Errorf("更新促销占用状态失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// ReleaseOrderPromotions 释放订单占用的促销数量
+func ReleaseOrderPromotions(orderID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := ReleaseOrderPromotionsInTx(tx, orderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const productPromotionColumns = `
+	pp.id, pp.name, pp.product_id, COALESCE(p.name, ''), pp.spec_name, pp.user_type, pp.promo_price,
+	pp.start_at, pp.end_at, pp.per_user_limit, pp.total_quantity, pp.sold_quantity, pp.status,
+	pp.created_by, pp.created_at, pp.updated_at`
+
+func scanProductPromotion(s interface{ Scan(...interface{}) error }) (*ProductPromotion, error) {
+	var p ProductPromotion
+	if err := s.Scan(&p.ID, &p.Name, &p.ProductID, &p.ProductName, &p.SpecName, &p.UserType, &p.PromoPrice,
+		&p.StartAt, &p.EndAt, &p.PerUserLimit, &p.TotalQuantity, &p.SoldQuantity, &p.Status,
+		&p.CreatedBy, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	p.State = promotionStateOf(&p, time.Now())
+	return &p, nil
+}
+
+// GetProductPromotions 获取促销列表（分页）
+func GetProductPromotions(filter PromotionFilter, pageNum, pageSize int) ([]ProductPromotion, int, error) {
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+	where := "1=1"
+	args := []interface{}{}
+	if filter.ProductID > 0 {
+		where += " AND pp.product_id = ?"
+		args = append(args, filter.ProductID)
+	}
+	if filter.Keyword != "" {
+		where += " AND (pp.name LIKE ? OR p.name LIKE ?)"
+		kw := "%" + filter.Keyword + "%"
+		args = append(args, kw, kw)
+	}
+	switch filter.State {
+	case PromotionStateActive:
+		where += " AND pp.status = 1 AND pp.start_at <= NOW() AND pp.end_at > NOW()"
+	case PromotionStateUpcoming:
+		where += " AND pp.status = 1 AND pp.start_at > NOW()"
+	case PromotionStateEnded:
+		where += " AND pp.status = 1 AND pp.end_at <= NOW()"
+	case PromotionStateDisabled:
+		where += " AND pp.status <> 1"
+	}
+
+	from := ` FROM product_promotions pp LEFT JOIN products p ON p.id = pp.product_id WHERE ` + where
+	var total int
+	if err := database.DB.QueryRow(`SELECT COUNT(*)`+from, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := database.DB.Query(`SELECT `+productPromotionColumns+from+`
+		ORDER BY pp.start_at DESC, pp.id DESC LIMIT ? OFFSET ?`, append(args, pageSize, (pageNum-1)*pageSize)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	list := make([]ProductPromotion, 0)
+	for rows.Next() {
+		p, err := scanProductPromotion(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		list = append(list, *p)
+	}
+	return list, total, rows.Err()
+}
+
+// GetProductPromotionByID 获取促销详情，不存在时返回 nil
+func GetProductPromotionByID(id int) (*ProductPromotion, error) {
+	row := database.DB.QueryRow(`SELECT `+productPromotionColumns+`
+		FROM product_promotions pp LEFT JOIN products p ON p.id = pp.product_id
+		WHERE pp.id = ?`, id)
+	p, err := scanProductPromotion(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// checkPromotionOverlap 同一规格同一时段内适用客户类型重叠的启用促销只能有一个
+func checkPromotionOverlap(p *ProductPromotion) error {
+	if p.Status != 1 {
+		return nil
+	}
+	userTypes := []interface{}{PromotionUserTypeAll, PromotionUserTypeWholesale, PromotionUserTypeRetail}
+	if p.UserType != PromotionUserTypeAll {
+		userTypes = []interface{}{PromotionUserTypeAll, p.UserType}
+	}
+	args := append([]interface{}{p.ProductID, p.SpecName, p.ID, p.EndAt, p.StartAt}, userTypes...)
+	var count int
+	if err := database.DB.QueryRow(`
+		SELECT COUNT(*) FROM product_promotions
+		WHERE product_id = ? AND spec_name = ? AND id <> ? AND status = 1
+		  AND start_at < ? AND end_at > ?
+		  AND user_type IN (`+placeholders(len(userTypes))+`)
+	`, args...).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrPromotionOverlap
+	}
+	return nil
+}
+
+// CreateProductPromotion 创建促销
+func CreateProductPromotion(p *ProductPromotion) error {
+	if err := checkPromotionOverlap(p); err != nil {
+		return err
+	}
+	res, err := database.DB.Exec(`
+		INSERT INTO product_promotions (name, product_id, spec_name, user_type, promo_price, start_at, end_at,
+			per_user_limit, total_quantity, sold_quantity, status, created_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?, NOW(), NOW())
+	`, p.Name, p.ProductID, p.SpecName, p.UserType, p.PromoPrice, p.StartAt, p.EndAt,
+		p.PerUserLimit, p.TotalQuantity, p.Status, p.CreatedBy)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	p.ID = int(id)
+	p.State = promotionStateOf(p, time.Now())
+	return nil
+}
+
+// UpdateProductPromotion 更新促销（总数量不能小于已售数量），不存在时返回 sql.ErrNoRows
+func UpdateProductPromotion(p *ProductPromotion) error {
+	if err := checkPromotionOverlap(p); err != nil {
+		return err
+	}
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow(`SELECT sold_quantity FROM product_promotions WHERE id = ? FOR UPDATE`, p.ID).Scan(&p.SoldQuantity); err != nil {
+		return err
+	}
+	if p.TotalQuantity > 0 && p.TotalQuantity < p.SoldQuantity {
+		return ErrPromotionQuantityTooLow
+	}
+	if _, err := tx.Exec(`
+		UPDATE product_promotions
+		SET name = ?, product_id = ?, spec_name = ?, user_type = ?, promo_price = ?, start_at = ?, end_at = ?,
+		    per_user_limit = ?, total_quantity = ?, status = ?, updated_at = NOW()
+		WHERE id = ?
+	`, p.Name, p.ProductID, p.SpecName, p.UserType, p.PromoPrice, p.StartAt, p.EndAt,
+		p.PerUserLimit, p.TotalQuantity, p.Status, p.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	p.State = promotionStateOf(p, time.Now())
+	return nil
+}
+
+// SetProductPromotionStatus 启用或停用促销，不存在时返回 sql.ErrNoRows
+func SetProductPromotionStatus(id, status int) error {
+	p, err := GetProductPromotionByID(id)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return sql.ErrNoRows
+	}
+	if status == 1 {
+		p.Status = 1
+		if err := checkPromotionOverlap(p); err != nil {
+			return err
+		}
+	}
+	_, err = database.DB.Exec(`UPDATE product_promotions SET status = ?, updated_at = NOW() WHERE id = ?`, status, id)
+	return err
+}
+
+// DeleteProductPromotion 删除促销（已有订单占用记录的只能停用）
+func DeleteProductPromotion(id int) error {
+	var count int
+	if err := database.DB.QueryRow(`SELECT COUNT(*) FROM product_promotion_usages WHERE promotion_id = ?`, id).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrPromotionHasSales
+	}
+	_, err := database.DB.Exec(`DELETE FROM product_promotions WHERE id = ?`, id)
+	return err
+}
+
+// GetPromotionCountdowns 获取商品进行中及即将开始（within 内）的促销倒计时，按商品ID分组
+func GetPromotionCountdowns(productIDs []int, within time.Duration) (map[int][]PromotionCountdown, error) {
+	result := make(map[int][]PromotionCountdown)
+	if len(productIDs) == 0 {
+		return result, nil
+	}
+	args := []interface{}{int(within.Seconds())}
+	for _, id := range productIDs {
+		args = append(args, id)
+	}
+	rows, err := database.DB.Query(`
+		SELECT id, product_id, spec_name, user_type, promo_price, start_at, end_at, per_user_limit, total_quantity, sold_quantity
+		FROM product_promotions
+		WHERE status = 1 AND end_at > NOW() AND start_at <= DATE_ADD(NOW(), INTERVAL ? SECOND)
+		  AND product_id IN (`+placeholders(len(productIDs))+`)
+		ORDER BY start_at ASC, id ASC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	for rows.Next() {
+		var cd PromotionCountdown
+		var productID, totalQuantity, soldQuantity int
+		if err := rows.Scan(&cd.PromotionID, &productID, &cd.SpecName, &cd.UserType, &cd.PromoPrice, &cd.StartAt, &cd.EndAt,
+			&cd.PerUserLimit, &totalQuantity, &soldQuantity); err != nil {
+			return nil, err
+		}
+		cd.Started = !now.Before(cd.StartAt)
+		if !cd.Started {
+			cd.SecondsToStart = int64(cd.StartAt.Sub(now).Seconds())
+		}
+		cd.SecondsLeft = int64(cd.EndAt.Sub(now).Seconds())
+		if totalQuantity > 0 {
+			remaining := totalQuantity - soldQuantity
+			if remaining < 0 {
+				remaining = 0
+			}
+			cd.RemainingQuantity = &remaining
+		}
+		result[productID] = append(result[productID], cd)
+	}
+	return result, rows.Err()
+}
+
+// placeholders 生成 n 个 SQL 占位符
+func placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
@@ -0,0 +1,574 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 库存占用状态
+const (
+	StockReservationReserved = "reserved" // 占用中（已下单未取货）
+	StockReservationReleased = "released" // 已释放（订单取消）
+	StockReservationDeducted = "deducted" // 已扣减（配送员已取货）
+)
+
+// ProductStock 商品规格库存
+// 只有存在库存记录的规格才会校验库存，没有记录的规格视为不限库存（兼容老商品）
+type ProductStock struct {
+	ID                int       `json:"id"`
+	ProductID         int       `json:"product_id"`
+	SpecName          string    `json:"spec_name"`
+	SupplierID        *int      `json:"supplier_id,omitempty"`
+	Quantity          int       `json:"quantity"`           // 实际库存
+	ReservedQuantity  int       `json:"reserved_quantity"`  // 已被未取货订单占用的数量
+	AvailableQuantity int       `json:"available_quantity"` // 可售库存 = 实际库存 - 占用
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// InsufficientStockError 库存不足错误（API 层据此返回 400 而不是 500）
+type InsufficientStockError struct {
+	ProductID   int
+	ProductName string
+	SpecName    string
+	Requested   int
+	Available   int
+}
+
+func (e *InsufficientStockError) Error() string {
+	name := e.ProductName
+	if name == "" {
+		name = fmt.Sprintf("商品%d", e.ProductID)
+	}
+	if e.SpecName != "" {
+		name += "（" + e.SpecName + "）"
+	}
+	if e.Available <= 0 {
+		return fmt.Sprintf("%s 已售罄", name)
+	}
+	return fmt.Sprintf("%s 库存不足，当前可购 %d 件", name, e.Available)
+}
+
+// stockReservation 库存占用记录
+type stockReservation struct {
+	ID          int
+	OrderID     int
+	OrderItemID int
+	ProductID   int
+	SpecName    string
+	Quantity    int
+}
+
+// GetProductStocks 获取商品所有规格的库存记录
+func GetProductStocks(productID int) ([]ProductStock, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, product_id, spec_name, supplier_id, quantity, reserved_quantity, created_at, updated_at
+		FROM product_stocks
+		WHERE product_id = ?
+		ORDER BY id ASC
+	`, productID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stocks := make([]ProductStock, 0)
+	for rows.Next() {
+		stock, err := scanProductStock(rows)
+		if err != nil {
+			return nil, err
+		}
+		stocks = append(stocks, *stock)
+	}
+	return stocks, nil
+}
+
+// GetProductStockMap 获取商品库存（规格名称 -> 库存），没有记录的规格不在结果中
+func GetProductStockMap(productID int) (map[string]ProductStock, error) {
+	stocks, err := GetProductStocks(productID)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]ProductStock, len(stocks))
+	for _, s := range stocks {
+		result[s.SpecName] = s
+	}
+	return result, nil
+}
+
+// GetProductStock 获取单个规格的库存记录，不存在返回 nil
+func GetProductStock(productID int, specName string) (*ProductStock, error) {
+	row := database.DB.QueryRow(`
+		SELECT id, product_id, spec_name, supplier_id, quantity, reserved_quantity, created_at, updated_at
+		FROM product_stocks
+		WHERE product_id = ? AND spec_name = ?
+	`, productID, specName)
+	stock, err := scanProductStock(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
+
+type productStockScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanProductStock(scanner productStockScanner) (*ProductStock, error) {
+	var s ProductStock
+	var supplierID sql.NullInt64
+	if err := scanner.Scan(&s.ID, &s.ProductID, &s.SpecName, &supplierID, &s.Quantity, &s.ReservedQuantity, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if supplierID.Valid {
+		id := int(supplierID.Int64)
+		s.SupplierID = &id
+	}
+	s.AvailableQuantity = s.Quantity - s.ReservedQuantity
+	if s.AvailableQuantity < 0 {
+		s.AvailableQuantity = 0
+	}
+	return &s, nil
+}
+
+// SetProductSpecStock 设置规格库存数量（不存在则创建，开启库存跟踪），并记录手动调整流水
+// 只修改实际库存，不影响已占用数量
+func SetProductSpecStock(productID int, specName string, quantity int, operator string) error {
+	if quantity < 0 {
+		return fmt.Errorf("库存数量不能为负数")
+	}
+	product, err := GetProductByID(productID)
+	if err != nil {
+		return err
+	}
+	if product == nil {
+		return fmt.Errorf("商品不存在")
+	}
+	if !productHasSpec(product, specName) {
+		return fmt.Errorf("商品不存在规格：%s", specName)
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var before int
+	err = tx.QueryRow(`
+		SELECT quantity FROM product_stocks WHERE product_id = ? AND spec_name = ? FOR UPDATE
+	`, productID, specName).Scan(&before)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("查询库存失败: %v", err)
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO product_stocks (product_id, spec_name, supplier_id, quantity, reserved_quantity, created_at, updated_at)
+		VALUES (?, ?, ?, ?, 0, NOW(), NOW())
+		ON DUPLICATE KEY UPDATE quantity = VALUES(quantity), supplier_id = VALUES(supplier_id), updated_at = NOW()
+	`, productID, specName, product.SupplierID, quantity); err != nil {
+		return err
+	}
+
+	if quantity != before {
+		if err := recordStockMovementInTx(tx, &StockMovement{
+			ProductID:      productID,
+			SpecName:       specName,
+			Type:           StockMovementManualAdjust,
+			QuantityChange: quantity - before,
+			OperatorType:   StockOperatorAdmin,
+			Operator:       operator,
+			Reason:         fmt.Sprintf("设置库存：%d -> %d", before, quantity),
+		}); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteProductSpecStock 删除规格库存记录（关闭库存跟踪，该规格恢复为不限库存），并记录库存清零流水
+func DeleteProductSpecStock(productID int, specName string, operator string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var quantity, reserved int
+	err = tx.QueryRow(`
+		SELECT quantity, reserved_quantity FROM product_stocks WHERE product_id = ? AND spec_name = ? FOR UPDATE
+	`, productID, specName).Scan(&quantity, &reserved)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("查询库存失败: %v", err)
+	}
+	if reserved > 0 {
+		return fmt.Errorf("该规格仍有未取货订单占用库存，暂不能关闭库存跟踪")
+	}
+
+	if _, err := tx.Exec(`DELETE FROM product_stocks WHERE product_id = ? AND spec_name = ?`, productID, specName); err != nil {
+		return err
+	}
+	if err := insertStockMovementInTx(tx, &StockMovement{
+		ProductID:      productID,
+		SpecName:       specName,
+		Type:           StockMovementUntrack,
+		QuantityChange: -quantity,
+		OperatorType:   StockOperatorAdmin,
+		Operator:       operator,
+		Reason:         fmt.Sprintf("关闭库存跟踪：库存 %d 清零", quantity),
+	}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func productHasSpec(product *Product, specName string) bool {
+	for _, spec := range product.Specs {
+		if spec.Name == specName {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPurchaseItemsStock 校验采购单商品库存是否充足（不占用，用于在线支付发起前的预检查）
+func CheckPurchaseItemsStock(items []PurchaseListItem) error {
+	// 同一规格可能出现多次（不同采购单项），按规格汇总后再比较
+	type specKey struct {
+		productID int
+		specName  string
+	}
+	requested := make(map[specKey]int)
+	names := make(map[specKey]string)
+	order := make([]specKey, 0, len(items))
+	for _, it := range items {
+		key := specKey{it.ProductID, it.SpecName}
+		if _, ok := requested[key]; !ok {
+			order = append(order, key)
+		}
+		requested[key] += it.Quantity
+		names[key] = it.ProductName
+	}
+
+	for _, key := range order {
+		stock, err := GetProductStock(key.productID, key.specName)
+		if err != nil {
+			return err
+		}
+		if stock == nil {
+			continue
+		}
+		if stock.AvailableQuantity < requested[key] {
+			return &InsufficientStockError{
+				ProductID:   key.productID,
+				ProductName: names[key],
+				SpecName:    key.specName,
+				Requested:   requested[key],
+				Available:   stock.AvailableQuantity,
+			}
+		}
+	}
+	return nil
+}
+
+// ReserveOrderItemsStockInTx 在订单事务内为订单明细占用库存（明细需已落库，带有ID）
+// strict=true 时库存不足返回 InsufficientStockError；strict=false 时（如支付回调，用户已付款）仍然占用并记录日志，避免已付款订单创建失败
+func ReserveOrderItemsStockInTx(tx *sql.Tx, orderID int, items []OrderItem, strict bool) error {
+	for _, r := range items {
+		if r.Quantity <= 0 {
+			continue
+		}
+		var stockID, quantity, reserved int
+		err := tx.QueryRow(`
+			SELECT id, quantity, reserved_quantity FROM product_stocks
+			WHERE product_id = ? AND spec_name = ?
+			FOR UPDATE
+		`, r.ProductID, r.SpecName).Scan(&stockID, &quantity, &reserved)
+		if err == sql.ErrNoRows {
+			// 未开启库存跟踪的规格不占用
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("查询库存失败: %v", err)
+		}
+
+		available := quantity - reserved
+		if available < r.Quantity {
+			if strict {
+				if available < 0 {
+					available = 0
+				}
+				return &InsufficientStockError{
+					ProductID:   r.ProductID,
+					ProductName: r.ProductName,
+					SpecName:    r.SpecName,
+					Requested:   r.Quantity,
+					Available:   available,
+				}
+			}
+			log.Printf("[Stock] 订单 %d 商品 %d 规格 %s 库存不足（可用 %d，需要 %d），已超卖占用", orderID, r.ProductID, r.SpecName, available, r.Quantity)
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE product_stocks SET reserved_quantity = reserved_quantity + ?, updated_at = NOW() WHERE id = ?
+		`, r.Quantity, stockID); err != nil {
+			return fmt.Errorf("占用库存失败: %v", err)
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO stock_reservations (order_id, order_item_id, product_id, spec_name, quantity, status, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, NOW(), NOW())
+		`, orderID, r.ID, r.ProductID, r.SpecName, r.Quantity, StockReservationReserved); err != nil {
+			return fmt.Errorf("记录库存占用失败: %v", err)
+		}
+		oid := orderID
+		if err := recordStockMovementInTx(tx, &StockMovement{
+			ProductID:      r.ProductID,
+			SpecName:       r.SpecName,
+			Type:           StockMovementOrderReserve,
+			ReservedChange: r.Quantity,
+			OrderID:        &oid,
+			Reason:         "下单占用库存",
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReleaseOrderStockInTx 在事务内释放订单所有未取货的库存占用（取消订单、修改订单时调用）
+func ReleaseOrderStockInTx(tx *sql.Tx, orderID int) error {
+	list, err := queryStockReservationsInTx(tx, `
+		SELECT id, order_id, order_item_id, product_id, spec_name, quantity FROM stock_reservations
+		WHERE order_id = ? AND status = ?
+		FOR UPDATE
+	`, orderID, StockReservationReserved)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range list {
+		if _, err := tx.Exec(`
+			UPDATE product_stocks
+			SET reserved_quantity = GREATEST(reserved_quantity - ?, 0), updated_at = NOW()
+			WHERE product_id = ? AND spec_name = ?
+		`, r.Quantity, r.ProductID, r.SpecName); err != nil {
+			return fmt.Errorf("释放库存失败: %v", err)
+		}
+		if _, err := tx.Exec(`UPDATE stock_reservations SET status = ?, updated_at = NOW() WHERE id = ?`, StockReservationReleased, r.ID); err != nil {
+			return fmt.Errorf("更新库存占用状态失败: %v", err)
+		}
+		oid := r.OrderID
+		if err := recordStockMovementInTx(tx, &StockMovement{
+			ProductID:      r.ProductID,
+			SpecName:       r.SpecName,
+			Type:           StockMovementOrderRelease,
+			ReservedChange: -r.Quantity,
+			OrderID:        &oid,
+			Reason:         "订单取消/修改释放库存",
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReleaseOrderItemStockInTx 在事务内释放单个订单明细的部分库存占用（取货缺货时调用），quantity 超过占用数量时全部释放
+func ReleaseOrderItemStockInTx(tx *sql.Tx, orderItemID int, quantity int, reason string) error {
+	if quantity <= 0 {
+		return nil
+	}
+	list, err := queryStockReservationsInTx(tx, `
+		SELECT id, order_id, order_item_id, product_id, spec_name, quantity FROM stock_reservations
+		WHERE order_item_id = ? AND status = ?
+		FOR UPDATE
+	`, orderItemID, StockReservationReserved)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range list {
+		if quantity <= 0 {
+			break
+		}
+		release := quantity
+		if release > r.Quantity {
+			release = r.Quantity
+		}
+		if _, err := tx.Exec(`
+			UPDATE product_stocks
+			SET reserved_quantity = GREATEST(reserved_quantity - ?, 0), updated_at = NOW()
+			WHERE product_id = ? AND spec_name = ?
+		`, release, r.ProductID, r.SpecName); err != nil {
+			return fmt.Errorf("释放库存失败: %v", err)
+		}
+		if release == r.Quantity {
+			_, err = tx.Exec(`UPDATE stock_reservations SET status = ?, updated_at = NOW() WHERE id = ?`, StockReservationReleased, r.ID)
+		} else {
+			_, err = tx.Exec(`UPDATE stock_reservations SET quantity = quantity - ?, updated_at = NOW() WHERE id = ?`, release, r.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("更新库存占用失败: %v", err)
+		}
+		oid := r.OrderID
+		if err := recordStockMovementInTx(tx, &StockMovement{
+			ProductID:      r.ProductID,
+			SpecName:       r.SpecName,
+			Type:           StockMovementOrderRelease,
+			ReservedChange: -release,
+			OrderID:        &oid,
+			Reason:         reason,
+		}); err != nil {
+			return err
+		}
+		quantity -= release
+	}
+	return nil
+}
+
+// ReleaseOrderStock 释放订单所有未取货的库存占用
+func ReleaseOrderStock(orderID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := ReleaseOrderStockInTx(tx, orderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeductStockForPickedItems 配送员取货后扣减库存（实际库存和占用同时减少），employeeCode 记录为流水操作人
+func DeductStockForPickedItems(orderItemIDs []int, employeeCode string) error {
+	if len(orderItemIDs) == 0 {
+		return nil
+	}
+	placeholders := make([]string, len(orderItemIDs))
+	args := make([]interface{}, 0, len(orderItemIDs)+1)
+	args = append(args, StockReservationReserved)
+	for i, id := range orderItemIDs {
+		placeholders[i] = "?"
+		args = append(args, id)
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	list, err := queryStockReservationsInTx(tx, fmt.Sprintf(`
+		SELECT id, order_id, order_item_id, product_id, spec_name, quantity FROM stock_reservations
+		WHERE status = ? AND order_item_id IN (%s)
+		FOR UPDATE
+	`, strings.Join(placeholders, ",")), args...)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range list {
+		// 超卖时库存不足以扣减，库存扣到 0 为止，流水按实际扣减量记录，保证流水变动与余额一致
+		var quantityBefore, reservedBefore int
+		if err := tx.QueryRow(`
+			SELECT quantity, reserved_quantity FROM product_stocks WHERE product_id = ? AND spec_name = ? FOR UPDATE
+		`, r.ProductID, r.SpecName).Scan(&quantityBefore, &reservedBefore); err != nil {
+			return fmt.Errorf("查询库存失败: %v", err)
+		}
+		quantityAfter, reservedAfter := quantityBefore-r.Quantity, reservedBefore-r.Quantity
+		if quantityAfter < 0 {
+			quantityAfter = 0
+		}
+		if reservedAfter < 0 {
+			reservedAfter = 0
+		}
+		oid := r.OrderID
+		m := &StockMovement{
+			ProductID:     r.ProductID,
+			SpecName:      r.SpecName,
+			Type:          StockMovementPickup,
+			QuantityAfter: quantityAfter,
+			ReservedAfter: reservedAfter,
+			OrderID:       &oid,
+			OperatorType:  StockOperatorEmployee,
+			Operator:      employeeCode,
+			Reason:        "配送员取货出库",
+		}
+		m.QuantityChange = m.QuantityAfter - quantityBefore
+		m.ReservedChange = m.ReservedAfter - reservedBefore
+		if m.QuantityChange != -r.Quantity {
+			m.Reason = fmt.Sprintf("配送员取货出库（库存不足，应扣 %d，实扣 %d）", r.Quantity, -m.QuantityChange)
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE product_stocks SET quantity = ?, reserved_quantity = ?, updated_at = NOW()
+			WHERE product_id = ? AND spec_name = ?
+		`, m.QuantityAfter, m.ReservedAfter, r.ProductID, r.SpecName); err != nil {
+			return fmt.Errorf("扣减库存失败: %v", err)
+		}
+		if _, err := tx.Exec(`UPDATE stock_reservations SET status = ?, updated_at = NOW() WHERE id = ?`, StockReservationDeducted, r.ID); err != nil {
+			return fmt.Errorf("更新库存占用状态失败: %v", err)
+		}
+		if err := insertStockMovementInTx(tx, m); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ReturnStockInTx 在事务内处理售后退货入库（未开启库存跟踪的规格忽略）
+func ReturnStockInTx(tx *sql.Tx, orderID, productID int, specName string, quantity int, operatorType, operator, reason string) error {
+	if quantity <= 0 {
+		return nil
+	}
+	res, err := tx.Exec(`
+		UPDATE product_stocks SET quantity = quantity + ?, updated_at = NOW() WHERE product_id = ? AND spec_name = ?
+	`, quantity, productID, specName)
+	if err != nil {
+		return fmt.Errorf("退货入库失败: %v", err)
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return nil
+	}
+	oid := orderID
+	return recordStockMovementInTx(tx, &StockMovement{
+		ProductID:      productID,
+		SpecName:       specName,
+		Type:           StockMovementReturn,
+		QuantityChange: quantity,
+		OrderID:        &oid,
+		OperatorType:   operatorType,
+		Operator:       operator,
+		Reason:         reason,
+	})
+}
+
+// queryStockReservationsInTx 在事务内查询库存占用记录
+func queryStockReservationsInTx(tx *sql.Tx, query string, args ...interface{}) ([]stockReservation, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []stockReservation
+	for rows.Next() {
+		var r stockReservation
+		if err := rows.Scan(&r.ID, &r.OrderID, &r.OrderItemID, &r.ProductID, &r.SpecName, &r.Quantity); err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
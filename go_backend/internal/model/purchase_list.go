@@ -19,6 +19,12 @@ type PurchaseSpecSnapshot struct {
 	DeliveryCount  float64 `json:"delivery_count"`          // 配送计件数（默认1.0，用于计算件数补贴）
 	UomCategoryID  *int    `json:"uom_category_id,omitempty"` // 计量单位类别ID（下单时快照）
 	UomUnitID      *int    `json:"uom_unit_id,omitempty"`      // 绑定的计量单位ID（下单时快照）
+	PriceTiers     []SpecPriceTier `json:"price_tiers,omitempty"` // 批发阶梯价（加入采购单时快照）
+	// 限时促销（读取采购单时按当前有效促销重新填充，下单时随规格快照保存）
+	PromotionID   *int       `json:"promotion_id,omitempty"`   // 命中的促销ID
+	PromoPrice    float64    `json:"promo_price,omitempty"`    // 促销单价
+	PromoQuantity int        `json:"promo_quantity,omitempty"` // 按促销价计价的数量，超出限购或促销余量的部分按原价
+	PromoEndsAt   *time.Time `json:"promo_ends_at,omitempty"`  // 促销结束时间
 }
 
 // PurchaseListItem 采购单中的商品
@@ -32,6 +38,7 @@ type PurchaseListItem struct {
 	SpecSnapshot PurchaseSpecSnapshot `json:"spec_snapshot"`
 	Quantity     int                  `json:"quantity"`
 	IsSpecial    bool                 `json:"is_special"`
+	TierHint     *PriceTierHint       `json:"tier_hint,omitempty"` // 阶梯价凑单提示（读取采购单时计算）
 	CreatedAt    time.Time            `json:"created_at"`
 	UpdatedAt    time.Time            `json:"updated_at"`
 }
@@ -117,6 +124,11 @@ func GetPurchaseListItemsByUserID(userID int) ([]PurchaseListItem, error) {
 		items = append(items, *item)
 	}
 
+	// 按客户类型填充当前有效的限时促销和阶梯价凑单提示，促销查询失败时按原价计价
+	if err := applyUserPricing(userID, items); err != nil {
+		log.Printf("[Promotion] 用户 %d 采购单促销计算失败: %v", userID, err)
+	}
+
 	return items, nil
 }
 
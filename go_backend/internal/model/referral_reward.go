@@ -141,6 +141,34 @@ func UpdateReferralRewardConfig(config *ReferralRewardConfig) error {
 	return err
 }
 
+// createReferralRewardForFirstOrder 用户首次下单且有推荐人时，创建推荐奖励记录（待发放状态）
+func createReferralRewardForFirstOrder(orderID int) error {
+	var userID int
+	var orderNumber string
+	if err := database.DB.QueryRow(`SELECT user_id, order_number FROM orders WHERE id = ?`, orderID).Scan(&userID, &orderNumber); err != nil {
+		return err
+	}
+	// 检查是否是首次下单（排除当前订单）
+	var count int
+	if err := database.DB.QueryRow(`
+		SELECT COUNT(*) FROM orders
+		WHERE user_id = ? AND id != ? AND status != 'cancelled'
+	`, userID, orderID).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	user, err := GetMiniAppUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.ReferrerID == nil {
+		return nil
+	}
+	return CreateReferralReward(*user.ReferrerID, userID, orderID, orderNumber)
+}
+
 // CreateReferralReward 创建推荐奖励记录（待发放状态）
 func CreateReferralReward(referrerID, newUserID, orderID int, orderNumber string) error {
 	// 检查推荐人是否是销售员，如果是销售员则不给予推荐奖励
@@ -0,0 +1,533 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 配送员在岗状态
+const (
+	RiderDutyOnDuty  = "on_duty"  // 在岗，可接单
+	RiderDutyOnBreak = "on_break" // 休息中，不接新单
+	RiderDutyOffDuty = "off_duty" // 下班
+)
+
+var (
+	ErrRiderAlreadyOnDuty   = errors.New("已经是上班状态")
+	ErrRiderNotOnDuty       = errors.New("当前未上班，请先上班打卡")
+	ErrRiderNotWorking      = errors.New("当前不在在岗状态")
+	ErrRiderNotOnBreak      = errors.New("当前不在休息中")
+	ErrRiderHasActiveOrders = errors.New("仍有未完成的配送订单，请完成后再下班")
+)
+
+// RiderDutyStatus 配送员当前在岗状态
+type RiderDutyStatus struct {
+	EmployeeCode string     `json:"employee_code"`
+	EmployeeName string     `json:"employee_name,omitempty"`
+	Status       string     `json:"status"`
+	AttendanceID *int       `json:"attendance_id,omitempty"`
+	ChangedAt    *time.Time `json:"changed_at"`
+}
+
+// RiderShift 配送员排班
+type RiderShift struct {
+	ID           int       `json:"id"`
+	EmployeeCode string    `json:"employee_code"`
+	EmployeeName string    `json:"employee_name"`
+	ShiftDate    string    `json:"shift_date"`
+	StartTime    time.Time `json:"start_time"`
+	EndTime      time.Time `json:"end_time"`
+	Remark       string    `json:"remark"`
+	CreatedBy    string    `json:"created_by"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// RiderAttendance 配送员每日考勤
+type RiderAttendance struct {
+	ID                int        `json:"id"`
+	EmployeeCode      string     `json:"employee_code"`
+	EmployeeName      string     `json:"employee_name"`
+	WorkDate          string     `json:"work_date"`
+	ShiftID           *int       `json:"shift_id"`
+	ShiftStart        *time.Time `json:"shift_start"`
+	ShiftEnd          *time.Time `json:"shift_end"`
+	ClockInAt         time.Time  `json:"clock_in_at"`
+	ClockOutAt        *time.Time `json:"clock_out_at"`
+	SessionStartedAt  *time.Time `json:"session_started_at"`
+	BreakStartedAt    *time.Time `json:"break_started_at"`
+	OnDutySeconds     int        `json:"on_duty_seconds"`
+	BreakSeconds      int        `json:"break_seconds"`
+	LateMinutes       int        `json:"late_minutes"`
+	EarlyLeaveMinutes int        `json:"early_leave_minutes"`
+	WorkedMinutes     float64    `json:"worked_minutes"` // 在岗时长（扣除休息，含进行中的时段）
+	BreakMinutes      float64    `json:"break_minutes"`  // 休息时长（含进行中的休息）
+}
+
+// fillDurations 按当前时间计算在岗和休息时长
+func (a *RiderAttendance) fillDurations(now time.Time) {
+	onDuty := float64(a.OnDutySeconds)
+	breaks := float64(a.BreakSeconds)
+	if a.SessionStartedAt != nil {
+		onDuty += now.Sub(*a.SessionStartedAt).Seconds()
+	}
+	if a.BreakStartedAt != nil {
+		breaks += now.Sub(*a.BreakStartedAt).Seconds()
+	}
+	a.WorkedMinutes = (onDuty - breaks) / 60
+	if a.WorkedMinutes < 0 {
+		a.WorkedMinutes = 0
+	}
+	a.BreakMinutes = breaks / 60
+}
+
+// RiderDutyRequired 是否要求配送员上班打卡后才能查看待接订单和接单
+func RiderDutyRequired() bool {
+	return GetSystemSettingInt("rider_duty_required", 1) == 1
+}
+
+// GetRiderDutyStatus 获取配送员当前在岗状态，没有记录时为下班
+func GetRiderDutyStatus(employeeCode string) (*RiderDutyStatus, error) {
+	status := &RiderDutyStatus{EmployeeCode: employeeCode, Status: RiderDutyOffDuty}
+	var attendanceID sql.NullInt64
+	var changedAt time.Time
+	err := database.DB.QueryRow(`
+		SELECT status, attendance_id, changed_at FROM rider_duty_status WHERE employee_code = ?
+	`, employeeCode).Scan(&status.Status, &attendanceID, &changedAt)
+	if err == sql.ErrNoRows {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if attendanceID.Valid {
+		id := int(attendanceID.Int64)
+		status.AttendanceID = &id
+	}
+	status.ChangedAt = &changedAt
+	return status, nil
+}
+
+// RiderCanTakeOrders 配送员当前是否可以查看待接订单和接单（未启用打卡要求时始终可以）
+func RiderCanTakeOrders(employeeCode string) (bool, error) {
+	if !RiderDutyRequired() {
+		return true, nil
+	}
+	status, err := GetRiderDutyStatus(employeeCode)
+	if err != nil {
+		return false, err
+	}
+	return status.Status == RiderDutyOnDuty, nil
+}
+
+// GetOnDutyRiderCodes 获取当前在岗的配送员员工码
+func GetOnDutyRiderCodes() (map[string]bool, error) {
+	rows, err := database.DB.Query(`SELECT employee_code FROM rider_duty_status WHERE status = ?`, RiderDutyOnDuty)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := make(map[string]bool)
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		codes[code] = true
+	}
+	return codes, rows.Err()
+}
+
+// GetAllRiderDutyStatuses 获取所有启用中的配送员的在岗状态
+func GetAllRiderDutyStatuses() ([]RiderDutyStatus, error) {
+	rows, err := database.DB.Query(`
+		SELECT e.employee_code, COALESCE(e.name, ''), COALESCE(s.status, ?), s.attendance_id, s.changed_at
+		FROM employees e
+		LEFT JOIN rider_duty_status s ON s.employee_code = e.employee_code
+		WHERE e.is_delivery = 1 AND e.status = 1
+		ORDER BY e.employee_code ASC
+	`, RiderDutyOffDuty)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]RiderDutyStatus, 0)
+	for rows.Next() {
+		var s RiderDutyStatus
+		var attendanceID sql.NullInt64
+		var changedAt sql.NullTime
+		if err := rows.Scan(&s.EmployeeCode, &s.EmployeeName, &s.Status, &attendanceID, &changedAt); err != nil {
+			return nil, err
+		}
+		if attendanceID.Valid {
+			id := int(attendanceID.Int64)
+			s.AttendanceID = &id
+		}
+		if changedAt.Valid {
+			s.ChangedAt = &changedAt.Time
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// lockRiderDutyStatusInTx 锁定配送员在岗状态行（不存在时先插入下班状态）
+func lockRiderDutyStatusInTx(tx *sql.Tx, employeeCode string) (*RiderDutyStatus, error) {
+	if _, err := tx.Exec(`
+		INSERT IGNORE INTO rider_duty_status (employee_code, status, changed_at) VALUES (?, ?, NOW())
+	`, employeeCode, RiderDutyOffDuty); err != nil {
+		return nil, err
+	}
+	status := &RiderDutyStatus{EmployeeCode: employeeCode}
+	var attendanceID sql.NullInt64
+	var changedAt time.Time
+	if err := tx.QueryRow(`
+		SELECT status, attendance_id, changed_at FROM rider_duty_status WHERE employee_code = ? FOR UPDATE
+	`, employeeCode).Scan(&status.Status, &attendanceID, &changedAt); err != nil {
+		return nil, err
+	}
+	if attendanceID.Valid {
+		id := int(attendanceID.Int64)
+		status.AttendanceID = &id
+	}
+	status.ChangedAt = &changedAt
+	return status, nil
+}
+
+func setRiderDutyStatusInTx(tx *sql.Tx, employeeCode, status string, attendanceID int, now time.Time) error {
+	_, err := tx.Exec(`
+		UPDATE rider_duty_status SET status = ?, attendance_id = ?, changed_at = ? WHERE employee_code = ?
+	`, status, attendanceID, now, employeeCode)
+	return err
+}
+
+// RiderDutyChange 配送员在岗状态变更结果
+type RiderDutyChange struct {
+	Status     string           `json:"status"`
+	Attendance *RiderAttendance `json:"attendance"`
+}
+
+// withRiderDutyTx 在锁定配送员在岗状态的事务中执行状态变更，返回新状态和最新考勤记录
+func withRiderDutyTx(employeeCode string, fn func(tx *sql.Tx, current *RiderDutyStatus, now time.Time) (string, int, error)) (*RiderDutyChange, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := lockRiderDutyStatusInTx(tx, employeeCode)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	status, attendanceID, err := fn(tx, current, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := setRiderDutyStatusInTx(tx, employeeCode, status, attendanceID, now); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	attendance, err := GetRiderAttendanceByID(attendanceID)
+	if err != nil {
+		return nil, err
+	}
+	return &RiderDutyChange{Status: status, Attendance: attendance}, nil
+}
+
+// ClockInRider 配送员上班打卡：当天已有考勤记录时开始新的在岗时段，否则按当天排班创建考勤记录并计算迟到
+func ClockInRider(employeeCode string) (*RiderDutyChange, error) {
+	return withRiderDutyTx(employeeCode, func(tx *sql.Tx, current *RiderDutyStatus, now time.Time) (string, int, error) {
+		if current.Status != RiderDutyOffDuty {
+			return "", 0, ErrRiderAlreadyOnDuty
+		}
+		workDate := now.Format("2006-01-02")
+
+		var attendanceID int
+		err := tx.QueryRow(`
+			SELECT id FROM rider_attendance WHERE employee_code = ? AND work_date = ? FOR UPDATE
+		`, employeeCode, workDate).Scan(&attendanceID)
+		if err == nil {
+			_, err = tx.Exec(`
+				UPDATE rider_attendance SET session_started_at = ?, clock_out_at = NULL WHERE id = ?
+			`, now, attendanceID)
+			return RiderDutyOnDuty, attendanceID, err
+		}
+		if err != sql.ErrNoRows {
+			return "", 0, err
+		}
+
+		var shiftID sql.NullInt64
+		lateMinutes := 0
+		var shiftStart time.Time
+		err = tx.QueryRow(`
+			SELECT id, start_time FROM rider_shifts WHERE employee_code = ? AND shift_date = ?
+		`, employeeCode, workDate).Scan(&shiftID, &shiftStart)
+		if err != nil && err != sql.ErrNoRows {
+			return "", 0, err
+		}
+		if shiftID.Valid {
+			grace := time.Duration(GetSystemSettingInt("rider_late_grace_minutes", 5)) * time.Minute
+			if now.After(shiftStart.Add(grace)) {
+				lateMinutes = int(now.Sub(shiftStart).Minutes())
+			}
+		}
+
+		result, err := tx.Exec(`
+			INSERT INTO rider_attendance (
+				employee_code, work_date, shift_id, clock_in_at, session_started_at, late_minutes, created_at, updated_at
+			) VALUES (?, ?, ?, ?, ?, ?, NOW(), NOW())
+		`, employeeCode, workDate, shiftID, now, now, lateMinutes)
+		if err != nil {
+			return "", 0, err
+		}
+		id, err := result.LastInsertId()
+		return RiderDutyOnDuty, int(id), err
+	})
+}
+
+// StartRiderBreak 配送员开始休息（休息期间不接新单）
+func StartRiderBreak(employeeCode string) (*RiderDutyChange, error) {
+	return withRiderDutyTx(employeeCode, func(tx *sql.Tx, current *RiderDutyStatus, now time.Time) (string, int, error) {
+		if current.Status != RiderDutyOnDuty || current.AttendanceID == nil {
+			return "", 0, ErrRiderNotWorking
+		}
+		_, err := tx.Exec(`UPDATE rider_attendance SET break_started_at = ? WHERE id = ?`, now, *current.AttendanceID)
+		return RiderDutyOnBreak, *current.AttendanceID, err
+	})
+}
+
+// EndRiderBreak 配送员结束休息，恢复在岗
+func EndRiderBreak(employeeCode string) (*RiderDutyChange, error) {
+	return withRiderDutyTx(employeeCode, func(tx *sql.Tx, current *RiderDutyStatus, now time.Time) (string, int, error) {
+		if current.Status != RiderDutyOnBreak || current.AttendanceID == nil {
+			return "", 0, ErrRiderNotOnBreak
+		}
+		err := closeRiderBreakInTx(tx, *current.AttendanceID, now)
+		return RiderDutyOnDuty, *current.AttendanceID, err
+	})
+}
+
+func closeRiderBreakInTx(tx *sql.Tx, attendanceID int, now time.Time) error {
+	_, err := tx.Exec(`
+		UPDATE rider_attendance
+		SET break_seconds = break_seconds + GREATEST(TIMESTAMPDIFF(SECOND, break_started_at, ?), 0), break_started_at = NULL
+		WHERE id = ? AND break_started_at IS NOT NULL
+	`, now, attendanceID)
+	return err
+}
+
+// ClockOutRider 配送员下班打卡：结束休息和当前在岗时段，按排班计算早退
+// force 为 true 时（管理后台强制下班）不检查未完成订单
+func ClockOutRider(employeeCode string, force bool) (*RiderDutyChange, error) {
+	return withRiderDutyTx(employeeCode, func(tx *sql.Tx, current *RiderDutyStatus, now time.Time) (string, int, error) {
+		if current.Status == RiderDutyOffDuty || current.AttendanceID == nil {
+			return "", 0, ErrRiderNotOnDuty
+		}
+		if !force {
+			var active int
+			if err := tx.QueryRow(`
+				SELECT COUNT(*) FROM orders WHERE delivery_employee_code = ? AND status IN (?, ?)
+			`, employeeCode, OrderStatusPendingPickup, OrderStatusDelivering).Scan(&active); err != nil {
+				return "", 0, err
+			}
+			if active > 0 {
+				return "", 0, ErrRiderHasActiveOrders
+			}
+		}
+
+		attendanceID := *current.AttendanceID
+		if err := closeRiderBreakInTx(tx, attendanceID, now); err != nil {
+			return "", 0, err
+		}
+		_, err := tx.Exec(`
+			UPDATE rider_attendance a
+			LEFT JOIN rider_shifts s ON s.id = a.shift_id
+			SET a.on_duty_seconds = a.on_duty_seconds + GREATEST(TIMESTAMPDIFF(SECOND, a.session_started_at, ?), 0),
+			    a.session_started_at = NULL,
+			    a.clock_out_at = ?,
+			    a.early_leave_minutes = IF(s.end_time IS NOT NULL AND s.end_time > ?, TIMESTAMPDIFF(MINUTE, ?, s.end_time), 0)
+			WHERE a.id = ?
+		`, now, now, now, now, attendanceID)
+		return RiderDutyOffDuty, attendanceID, err
+	})
+}
+
+const riderAttendanceSelect = `
+	SELECT a.id, a.employee_code, COALESCE(e.name, ''), a.work_date, a.shift_id, s.start_time, s.end_time,
+	       a.clock_in_at, a.clock_out_at, a.session_started_at, a.break_started_at,
+	       a.on_duty_seconds, a.break_seconds, a.late_minutes, a.early_leave_minutes
+	FROM rider_attendance a
+	LEFT JOIN employees e ON e.employee_code = a.employee_code
+	LEFT JOIN rider_shifts s ON s.id = a.shift_id`
+
+func scanRiderAttendance(scanner interface{ Scan(...interface{}) error }, now time.Time) (*RiderAttendance, error) {
+	var a RiderAttendance
+	var workDate time.Time
+	var shiftID sql.NullInt64
+	var shiftStart, shiftEnd, clockOut, sessionStart, breakStart sql.NullTime
+	if err := scanner.Scan(&a.ID, &a.EmployeeCode, &a.EmployeeName, &workDate, &shiftID, &shiftStart, &shiftEnd,
+		&a.ClockInAt, &clockOut, &sessionStart, &breakStart,
+		&a.OnDutySeconds, &a.BreakSeconds, &a.LateMinutes, &a.EarlyLeaveMinutes); err != nil {
+		return nil, err
+	}
+	a.WorkDate = workDate.Format("2006-01-02")
+	if shiftID.Valid {
+		id := int(shiftID.Int64)
+		a.ShiftID = &id
+	}
+	a.ShiftStart = nullTimePtr(shiftStart)
+	a.ShiftEnd = nullTimePtr(shiftEnd)
+	a.ClockOutAt = nullTimePtr(clockOut)
+	a.SessionStartedAt = nullTimePtr(sessionStart)
+	a.BreakStartedAt = nullTimePtr(breakStart)
+	a.fillDurations(now)
+	return &a, nil
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// GetRiderAttendanceByID 获取考勤记录
+func GetRiderAttendanceByID(id int) (*RiderAttendance, error) {
+	a, err := scanRiderAttendance(database.DB.QueryRow(riderAttendanceSelect+" WHERE a.id = ?", id), time.Now())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return a, err
+}
+
+// GetRiderAttendances 获取日期范围内的考勤记录（end 不含），employeeCode 为空时查询全部配送员
+func GetRiderAttendances(start, end time.Time, employeeCode string) ([]RiderAttendance, error) {
+	query := riderAttendanceSelect + " WHERE a.work_date >= ? AND a.work_date < ?"
+	args := []interface{}{start.Format("2006-01-02"), end.Format("2006-01-02")}
+	if employeeCode != "" {
+		query += " AND a.employee_code = ?"
+		args = append(args, employeeCode)
+	}
+	query += " ORDER BY a.work_date ASC, a.employee_code ASC"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	list := make([]RiderAttendance, 0)
+	for rows.Next() {
+		a, err := scanRiderAttendance(rows, now)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *a)
+	}
+	return list, rows.Err()
+}
+
+// SaveRiderShifts 批量排班：为每个配送员在每个日期设置班次（已有排班时覆盖）
+// startClock、endClock 格式为 "15:04"，结束时间不晚于开始时间时视为跨夜班次
+func SaveRiderShifts(employeeCodes []string, dates []time.Time, startClock, endClock, remark, operator string) (int, error) {
+	startOffset, err := time.Parse("15:04", startClock)
+	if err != nil {
+		return 0, fmt.Errorf("班次开始时间格式错误")
+	}
+	endOffset, err := time.Parse("15:04", endClock)
+	if err != nil {
+		return 0, fmt.Errorf("班次结束时间格式错误")
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	count := 0
+	for _, code := range employeeCodes {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		for _, date := range dates {
+			day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.Local)
+			start := day.Add(time.Duration(startOffset.Hour())*time.Hour + time.Duration(startOffset.Minute())*time.Minute)
+			end := day.Add(time.Duration(endOffset.Hour())*time.Hour + time.Duration(endOffset.Minute())*time.Minute)
+			if !end.After(start) {
+				end = end.AddDate(0, 0, 1)
+			}
+			if _, err := tx.Exec(`
+				INSERT INTO rider_shifts (employee_code, shift_date, start_time, end_time, remark, created_by, created_at, updated_at)
+				VALUES (?, ?, ?, ?, ?, ?, NOW(), NOW())
+				ON DUPLICATE KEY UPDATE start_time = VALUES(start_time), end_time = VALUES(end_time),
+				    remark = VALUES(remark), created_by = VALUES(created_by), updated_at = NOW()
+			`, code, day.Format("2006-01-02"), start, end, remark, operator); err != nil {
+				return 0, err
+			}
+			count++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// GetRiderShifts 获取日期范围内的排班（end 不含），employeeCode 为空时查询全部配送员
+func GetRiderShifts(start, end time.Time, employeeCode string) ([]RiderShift, error) {
+	query := `
+		SELECT s.id, s.employee_code, COALESCE(e.name, ''), s.shift_date, s.start_time, s.end_time,
+		       COALESCE(s.remark, ''), COALESCE(s.created_by, ''), s.created_at, s.updated_at
+		FROM rider_shifts s
+		LEFT JOIN employees e ON e.employee_code = s.employee_code
+		WHERE s.shift_date >= ? AND s.shift_date < ?`
+	args := []interface{}{start.Format("2006-01-02"), end.Format("2006-01-02")}
+	if employeeCode != "" {
+		query += " AND s.employee_code = ?"
+		args = append(args, employeeCode)
+	}
+	query += " ORDER BY s.shift_date ASC, s.start_time ASC, s.employee_code ASC"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]RiderShift, 0)
+	for rows.Next() {
+		var s RiderShift
+		var shiftDate time.Time
+		if err := rows.Scan(&s.ID, &s.EmployeeCode, &s.EmployeeName, &shiftDate, &s.StartTime, &s.EndTime,
+			&s.Remark, &s.CreatedBy, &s.CreatedAt, &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		s.ShiftDate = shiftDate.Format("2006-01-02")
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// DeleteRiderShift 删除排班，返回是否存在
+func DeleteRiderShift(id int) (bool, error) {
+	result, err := database.DB.Exec(`DELETE FROM rider_shifts WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
@@ -0,0 +1,176 @@
+package model
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"go_backend/internal/database"
+	"go_backend/internal/utils"
+)
+
+// 轨迹过滤参数
+const (
+	trackMaxAccuracyMeters = 100.0 // 精度差于该值（米）的定位点不参与轨迹和里程
+	trackMaxSpeedKmh       = 120.0 // 相邻点推算速度超过该值视为定位漂移
+)
+
+// GetEmployeeTrackPoints 获取配送员在时间范围内的轨迹点（按时间升序，已过滤低精度定位）
+func GetEmployeeTrackPoints(employeeCode string, start, end time.Time) ([]utils.TrackPoint, error) {
+	rows, err := database.DB.Query(`
+		SELECT latitude, longitude, created_at
+		FROM employee_location_history
+		WHERE employee_code = ? AND created_at >= ? AND created_at < ?
+		  AND (accuracy IS NULL OR accuracy <= ?)
+		ORDER BY created_at ASC, id ASC
+	`, employeeCode, start, end, trackMaxAccuracyMeters)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := make([]utils.TrackPoint, 0)
+	for rows.Next() {
+		var p utils.TrackPoint
+		if err := rows.Scan(&p.Lat, &p.Lng, &p.Time); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// TrackDistanceKm 轨迹里程（公里），过滤定位漂移
+func TrackDistanceKm(points []utils.TrackPoint) float64 {
+	return utils.TrackDistance(points, trackMaxSpeedKmh)
+}
+
+// DeliveredOrderStop 时间范围内配送员送达的订单
+type DeliveredOrderStop struct {
+	OrderID      int        `json:"order_id"`
+	OrderNumber  string     `json:"order_number"`
+	AddressName  string     `json:"address_name"`
+	Address      string     `json:"address"`
+	Latitude     *float64   `json:"latitude"`
+	Longitude    *float64   `json:"longitude"`
+	DeliveredAt  time.Time  `json:"delivered_at"` // 配送完成日志时间
+	ArrivedAt    *time.Time `json:"arrived_at"`   // 轨迹进入收货地址范围的时间
+	DepartedAt   *time.Time `json:"departed_at"`  // 轨迹离开收货地址范围的时间
+	DwellMinutes *float64   `json:"dwell_minutes"`
+}
+
+// GetDeliveredOrdersInWindow 获取配送员在时间范围内完成配送的订单（按完成时间升序）
+func GetDeliveredOrdersInWindow(employeeCode string, start, end time.Time) ([]DeliveredOrderStop, error) {
+	rows, err := database.DB.Query(`
+		SELECT o.id, o.order_number, COALESCE(a.name, ''), COALESCE(a.address, ''), a.latitude, a.longitude, MAX(dl.action_time)
+		FROM delivery_logs dl
+		INNER JOIN orders o ON o.id = dl.order_id
+		LEFT JOIN mini_app_addresses a ON a.id = o.address_id
+		WHERE dl.action = ? AND dl.delivery_employee_code = ?
+		  AND dl.action_time >= ? AND dl.action_time < ?
+		GROUP BY o.id, o.order_number, a.name, a.address, a.latitude, a.longitude
+		ORDER BY MAX(dl.action_time) ASC
+	`, DeliveryLogActionDeliveringCompleted, employeeCode, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stops := make([]DeliveredOrderStop, 0)
+	for rows.Next() {
+		var s DeliveredOrderStop
+		var lat, lng sql.NullFloat64
+		if err := rows.Scan(&s.OrderID, &s.OrderNumber, &s.AddressName, &s.Address, &lat, &lng, &s.DeliveredAt); err != nil {
+			return nil, err
+		}
+		if lat.Valid && lng.Valid {
+			s.Latitude, s.Longitude = &lat.Float64, &lng.Float64
+		}
+		stops = append(stops, s)
+	}
+	return stops, rows.Err()
+}
+
+// MatchDeliveredStops 按轨迹计算每个送达订单在收货地址附近的到达、离开时间和停留时长
+func MatchDeliveredStops(points []utils.TrackPoint, stops []DeliveredOrderStop, radiusMeters float64) {
+	for i := range stops {
+		s := &stops[i]
+		if s.Latitude == nil || s.Longitude == nil {
+			continue
+		}
+		dwell, ok := utils.FindDwell(points, *s.Latitude, *s.Longitude, radiusMeters, s.DeliveredAt)
+		if !ok {
+			continue
+		}
+		arrive, depart, minutes := dwell.Arrive, dwell.Depart, dwell.Minutes()
+		s.ArrivedAt, s.DepartedAt, s.DwellMinutes = &arrive, &depart, &minutes
+	}
+}
+
+// RiderDailyDistance 配送员每日行驶里程
+type RiderDailyDistance struct {
+	EmployeeCode string  `json:"employee_code"`
+	EmployeeName string  `json:"employee_name"`
+	Date         string  `json:"date"`
+	DistanceKm   float64 `json:"distance_km"`
+	PointCount   int     `json:"point_count"`
+}
+
+// GetRiderDailyDistances 按轨迹统计配送员每日行驶里程，employeeCode 为空时统计全部配送员
+// 逐行累加，不在内存中保留整段轨迹
+func GetRiderDailyDistances(start, end time.Time, employeeCode string) ([]RiderDailyDistance, error) {
+	query := `
+		SELECT h.employee_code, COALESCE(e.name, ''), h.latitude, h.longitude, h.created_at
+		FROM employee_location_history h
+		LEFT JOIN employees e ON e.employee_code = h.employee_code
+		WHERE h.created_at >= ? AND h.created_at < ?
+		  AND (h.accuracy IS NULL OR h.accuracy <= ?)`
+	args := []interface{}{start, end, trackMaxAccuracyMeters}
+	if employeeCode != "" {
+		query += " AND h.employee_code = ?"
+		args = append(args, employeeCode)
+	}
+	query += " ORDER BY h.employee_code ASC, h.created_at ASC, h.id ASC"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]RiderDailyDistance, 0)
+	var current *RiderDailyDistance
+	var acc utils.TrackDistanceAccumulator
+	for rows.Next() {
+		var code, name string
+		var p utils.TrackPoint
+		if err := rows.Scan(&code, &name, &p.Lat, &p.Lng, &p.Time); err != nil {
+			return nil, err
+		}
+		date := p.Time.Format("2006-01-02")
+		if current == nil || current.EmployeeCode != code || current.Date != date {
+			if current != nil {
+				current.DistanceKm = acc.DistanceKm
+			}
+			result = append(result, RiderDailyDistance{EmployeeCode: code, EmployeeName: name, Date: date})
+			current = &result[len(result)-1]
+			acc = utils.TrackDistanceAccumulator{MaxSpeedKmh: trackMaxSpeedKmh}
+		}
+		current.PointCount++
+		acc.Add(p)
+	}
+	if current != nil {
+		current.DistanceKm = acc.DistanceKm
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Date != result[j].Date {
+			return result[i].Date < result[j].Date
+		}
+		return result[i].EmployeeCode < result[j].EmployeeCode
+	})
+	return result, nil
+}
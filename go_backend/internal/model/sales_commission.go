@@ -823,14 +823,21 @@ func ProcessOrderSettlement(orderID int) error {
 	}
 
 	// 获取订单的利润和成本信息
-	// 平台总收入 = total_amount
-	orderAmount := order.TotalAmount
+	// 平台总收入 = total_amount - 售后已退款金额
+	orderAmount := order.TotalAmount - order.AfterSalesRefundAmount
+	if orderAmount < 0 {
+		orderAmount = 0
+	}
 
-	// 商品总成本 = goods_amount - order_profit
+	// 商品总成本 = goods_amount - order_profit - 售后退货商品成本
 	goodsCost := order.GoodsAmount
 	if order.OrderProfit != nil && *order.OrderProfit > 0 {
 		goodsCost = order.GoodsAmount - *order.OrderProfit
 	}
+	goodsCost -= order.AfterSalesReturnedCost
+	if goodsCost < 0 {
+		goodsCost = 0
+	}
 
 	// 配送成本（从delivery_fee_calculation中获取total_platform_cost）
 	deliveryCost := 0.0
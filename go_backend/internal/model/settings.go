@@ -2,6 +2,9 @@ package model
 
 import (
 	"database/sql"
+	"strconv"
+	"strings"
+
 	"go_backend/internal/database"
 )
 
@@ -94,3 +97,28 @@ func GetMapSettings() (map[string]string, error) {
 	return mapSettings, nil
 }
 
+// GetSystemSettingFloat 获取数值型系统设置，未配置或格式错误时返回默认值
+func GetSystemSettingFloat(key string, defaultValue float64) float64 {
+	valueStr, err := GetSystemSetting(key)
+	if err != nil || strings.TrimSpace(valueStr) == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(valueStr), 64)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// GetSystemSettingInt 获取整数型系统设置，未配置或格式错误时返回默认值
+func GetSystemSettingInt(key string, defaultValue int) int {
+	valueStr, err := GetSystemSetting(key)
+	if err != nil || strings.TrimSpace(valueStr) == "" {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(strings.TrimSpace(valueStr))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,358 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 库存变动类型
+const (
+	StockMovementOrderReserve = "order_reserve" // 下单占用
+	StockMovementOrderRelease = "order_release" // 取消释放
+	StockMovementPickup       = "pickup"        // 取货出库
+	StockMovementManualAdjust = "manual_adjust" // 手动调整
+	StockMovementStocktake    = "stocktake"     // 盘点修正
+	StockMovementReturn       = "return"        // 退货入库
+	StockMovementUntrack      = "untrack"       // 关闭库存跟踪（库存记录删除，余额清零）
+)
+
+// 库存变动操作人类型
+const (
+	StockOperatorSystem   = "system"
+	StockOperatorAdmin    = "admin"
+	StockOperatorEmployee = "employee"
+)
+
+// StockMovement 库存变动流水（只追加，不修改）
+type StockMovement struct {
+	ID             int       `json:"id"`
+	ProductID      int       `json:"product_id"`
+	SpecName       string    `json:"spec_name"`
+	Type           string    `json:"type"`
+	QuantityChange int       `json:"quantity_change"` // 实际库存变动（正数增加，负数减少）
+	ReservedChange int       `json:"reserved_change"` // 占用数量变动
+	QuantityAfter  int       `json:"quantity_after"`  // 变动后实际库存
+	ReservedAfter  int       `json:"reserved_after"`  // 变动后占用数量
+	OrderID        *int      `json:"order_id,omitempty"`
+	OperatorType   string    `json:"operator_type"`
+	Operator       string    `json:"operator"`
+	Reason         string    `json:"reason"`
+	BatchNo        *string   `json:"batch_no,omitempty"` // 盘点批次号
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// StockMovementFilter 库存流水查询条件
+type StockMovementFilter struct {
+	ProductID int
+	SpecName  string
+	Type      string
+	OrderID   int
+	BatchNo   string
+	StartDate string // YYYY-MM-DD
+	EndDate   string // YYYY-MM-DD
+}
+
+// StocktakeItem 盘点录入项
+type StocktakeItem struct {
+	ProductID       int    `json:"product_id"`
+	SpecName        string `json:"spec_name"`
+	CountedQuantity int    `json:"counted_quantity"`
+}
+
+// StocktakeResult 盘点结果（含差异）
+type StocktakeResult struct {
+	ProductID        int    `json:"product_id"`
+	SpecName         string `json:"spec_name"`
+	BookQuantity     int    `json:"book_quantity"`    // 账面库存
+	CountedQuantity  int    `json:"counted_quantity"` // 实盘数量
+	Variance         int    `json:"variance"`         // 差异 = 实盘 - 账面
+	ReservedQuantity int    `json:"reserved_quantity"`
+}
+
+// recordStockMovementInTx 在事务内记录库存流水，变动后余额从 product_stocks 读取（调用前需已更新库存）
+func recordStockMovementInTx(tx *sql.Tx, m *StockMovement) error {
+	if err := tx.QueryRow(`
+		SELECT quantity, reserved_quantity FROM product_stocks WHERE product_id = ? AND spec_name = ?
+	`, m.ProductID, m.SpecName).Scan(&m.QuantityAfter, &m.ReservedAfter); err != nil {
+		return fmt.Errorf("读取库存余额失败: %v", err)
+	}
+	return insertStockMovementInTx(tx, m)
+}
+
+// insertStockMovementInTx 在事务内写入库存流水，变动后余额使用 m 中已填写的值
+func insertStockMovementInTx(tx *sql.Tx, m *StockMovement) error {
+	if m.OperatorType == "" {
+		m.OperatorType = StockOperatorSystem
+	}
+	_, err := tx.Exec(`
+		INSERT INTO stock_movements (
+			product_id, spec_name, type, quantity_change, reserved_change, quantity_after, reserved_after,
+			order_id, operator_type, operator, reason, batch_no, created_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())
+	`, m.ProductID, m.SpecName, m.Type, m.QuantityChange, m.ReservedChange, m.QuantityAfter, m.ReservedAfter,
+		m.OrderID, m.OperatorType, m.Operator, m.Reason, m.BatchNo)
+	if err != nil {
+		return fmt.Errorf("记录库存流水失败: %v", err)
+	}
+	return nil
+}
+
+// GetStockMovements 获取库存流水（分页，按时间倒序）
+func GetStockMovements(filter StockMovementFilter, pageNum, pageSize int) ([]StockMovement, int, error) {
+	if pageNum < 1 {
+		pageNum = 1
+	}
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+	offset := (pageNum - 1) * pageSize
+
+	where := "1=1"
+	args := []interface{}{}
+	if filter.ProductID > 0 {
+		where += " AND product_id = ?"
+		args = append(args, filter.ProductID)
+	}
+	if filter.SpecName != "" {
+		where += " AND spec_name = ?"
+		args = append(args, filter.SpecName)
+	}
+	if filter.Type != "" {
+		where += " AND type = ?"
+		args = append(args, filter.Type)
+	}
+	if filter.OrderID > 0 {
+		where += " AND order_id = ?"
+		args = append(args, filter.OrderID)
+	}
+	if filter.BatchNo != "" {
+		where += " AND batch_no = ?"
+		args = append(args, filter.BatchNo)
+	}
+	if filter.StartDate != "" {
+		where += " AND DATE(created_at) >= ?"
+		args = append(args, filter.StartDate)
+	}
+	if filter.EndDate != "" {
+		where += " AND DATE(created_at) <= ?"
+		args = append(args, filter.EndDate)
+	}
+
+	var total int
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM stock_movements WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT id, product_id, spec_name, type, quantity_change, reserved_change, quantity_after, reserved_after,
+		       order_id, operator_type, operator, reason, batch_no, created_at
+		FROM stock_movements WHERE ` + where + ` ORDER BY id DESC LIMIT ? OFFSET ?`
+	args = append(args, pageSize, offset)
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	movements := make([]StockMovement, 0)
+	for rows.Next() {
+		var m StockMovement
+		var orderID sql.NullInt64
+		var batchNo sql.NullString
+		if err := rows.Scan(&m.ID, &m.ProductID, &m.SpecName, &m.Type, &m.QuantityChange, &m.ReservedChange,
+			&m.QuantityAfter, &m.ReservedAfter, &orderID, &m.OperatorType, &m.Operator, &m.Reason, &batchNo, &m.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		if orderID.Valid {
+			id := int(orderID.Int64)
+			m.OrderID = &id
+		}
+		if batchNo.Valid && batchNo.String != "" {
+			s := batchNo.String
+			m.BatchNo = &s
+		}
+		movements = append(movements, m)
+	}
+	return movements, total, nil
+}
+
+// AdjustProductStock 手动调整库存（change 为正数入库，负数出库），库存不能调整为负数
+func AdjustProductStock(productID int, specName string, change int, reason, operator string) (*ProductStock, error) {
+	if change == 0 {
+		return nil, fmt.Errorf("调整数量不能为0")
+	}
+	product, err := GetProductByID(productID)
+	if err != nil {
+		return nil, err
+	}
+	if product == nil {
+		return nil, fmt.Errorf("商品不存在")
+	}
+	if !productHasSpec(product, specName) {
+		return nil, fmt.Errorf("商品不存在规格：%s", specName)
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 未开启库存跟踪的规格先建档（库存0），再按调整数量入库
+	if _, err := tx.Exec(`
+		INSERT IGNORE INTO product_stocks (product_id, spec_name, supplier_id, quantity, reserved_quantity, created_at, updated_at)
+		VALUES (?, ?, ?, 0, 0, NOW(), NOW())
+	`, productID, specName, product.SupplierID); err != nil {
+		return nil, fmt.Errorf("创建库存记录失败: %v", err)
+	}
+
+	var quantity int
+	if err := tx.QueryRow(`
+		SELECT quantity FROM product_stocks WHERE product_id = ? AND spec_name = ? FOR UPDATE
+	`, productID, specName).Scan(&quantity); err != nil {
+		return nil, fmt.Errorf("查询库存失败: %v", err)
+	}
+	if quantity+change < 0 {
+		return nil, fmt.Errorf("调整后库存不能为负数（当前库存 %d）", quantity)
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE product_stocks SET quantity = quantity + ?, supplier_id = ?, updated_at = NOW()
+		WHERE product_id = ? AND spec_name = ?
+	`, change, product.SupplierID, productID, specName); err != nil {
+		return nil, fmt.Errorf("调整库存失败: %v", err)
+	}
+	if err := recordStockMovementInTx(tx, &StockMovement{
+		ProductID:      productID,
+		SpecName:       specName,
+		Type:           StockMovementManualAdjust,
+		QuantityChange: change,
+		OperatorType:   StockOperatorAdmin,
+		Operator:       operator,
+		Reason:         reason,
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetProductStock(productID, specName)
+}
+
+// SubmitStocktake 提交盘点：按实盘数量重置库存并记录差异，返回批次号和各规格差异
+func SubmitStocktake(items []StocktakeItem, reason, operator string) (string, []StocktakeResult, error) {
+	if len(items) == 0 {
+		return "", nil, fmt.Errorf("盘点明细为空")
+	}
+
+	// 校验商品规格（按商品缓存，避免重复查询）
+	products := make(map[int]*Product)
+	for _, it := range items {
+		if it.CountedQuantity < 0 {
+			return "", nil, fmt.Errorf("实盘数量不能为负数")
+		}
+		product, ok := products[it.ProductID]
+		if !ok {
+			p, err := GetProductByID(it.ProductID)
+			if err != nil {
+				return "", nil, err
+			}
+			if p == nil {
+				return "", nil, fmt.Errorf("商品 %d 不存在", it.ProductID)
+			}
+			products[it.ProductID] = p
+			product = p
+		}
+		if !productHasSpec(product, it.SpecName) {
+			return "", nil, fmt.Errorf("商品 %s 不存在规格：%s", product.Name, it.SpecName)
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+
+	batchNo, err := newStocktakeBatchNo(tx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	results := make([]StocktakeResult, 0, len(items))
+	for _, it := range items {
+		product := products[it.ProductID]
+		if _, err := tx.Exec(`
+			INSERT IGNORE INTO product_stocks (product_id, spec_name, supplier_id, quantity, reserved_quantity, created_at, updated_at)
+			VALUES (?, ?, ?, 0, 0, NOW(), NOW())
+		`, it.ProductID, it.SpecName, product.SupplierID); err != nil {
+			return "", nil, fmt.Errorf("创建库存记录失败: %v", err)
+		}
+
+		var bookQuantity, reserved int
+		if err := tx.QueryRow(`
+			SELECT quantity, reserved_quantity FROM product_stocks WHERE product_id = ? AND spec_name = ? FOR UPDATE
+		`, it.ProductID, it.SpecName).Scan(&bookQuantity, &reserved); err != nil {
+			return "", nil, fmt.Errorf("查询库存失败: %v", err)
+		}
+
+		variance := it.CountedQuantity - bookQuantity
+		if _, err := tx.Exec(`
+			UPDATE product_stocks SET quantity = ?, updated_at = NOW() WHERE product_id = ? AND spec_name = ?
+		`, it.CountedQuantity, it.ProductID, it.SpecName); err != nil {
+			return "", nil, fmt.Errorf("更新库存失败: %v", err)
+		}
+
+		movementReason := fmt.Sprintf("盘点：账面 %d，实盘 %d", bookQuantity, it.CountedQuantity)
+		if strings.TrimSpace(reason) != "" {
+			movementReason += "；" + strings.TrimSpace(reason)
+		}
+		if err := recordStockMovementInTx(tx, &StockMovement{
+			ProductID:      it.ProductID,
+			SpecName:       it.SpecName,
+			Type:           StockMovementStocktake,
+			QuantityChange: variance,
+			OperatorType:   StockOperatorAdmin,
+			Operator:       operator,
+			Reason:         movementReason,
+			BatchNo:        &batchNo,
+		}); err != nil {
+			return "", nil, err
+		}
+
+		results = append(results, StocktakeResult{
+			ProductID:        it.ProductID,
+			SpecName:         it.SpecName,
+			BookQuantity:     bookQuantity,
+			CountedQuantity:  it.CountedQuantity,
+			Variance:         variance,
+			ReservedQuantity: reserved,
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", nil, err
+	}
+	return batchNo, results, nil
+}
+
+// newStocktakeBatchNo 生成盘点批次号：ST + 时间（秒）+ 4 位随机数，同一秒内多次盘点时避开已使用的批次号
+func newStocktakeBatchNo(tx *sql.Tx) (string, error) {
+	for i := 0; i < 5; i++ {
+		batchNo := fmt.Sprintf("ST%s%04d", time.Now().Format("20060102150405"), rand.Intn(10000))
+		var exists int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM stock_movements WHERE batch_no = ?`, batchNo).Scan(&exists); err != nil {
+			return "", fmt.Errorf("生成盘点批次号失败: %v", err)
+		}
+		if exists == 0 {
+			return batchNo, nil
+		}
+	}
+	return "", fmt.Errorf("生成盘点批次号失败，请重试")
+}
@@ -25,17 +25,19 @@ type SupplierPayment struct {
 
 // SupplierPaymentItem 供应商付款明细
 type SupplierPaymentItem struct {
-	ID          int       `json:"id"`
-	PaymentID   int       `json:"payment_id"`
-	OrderID     int       `json:"order_id"`
-	OrderItemID int       `json:"order_item_id"`
-	ProductID   int       `json:"product_id"`
-	ProductName string    `json:"product_name"`
-	SpecName    string    `json:"spec_name"`
-	Quantity    int       `json:"quantity"`
-	CostPrice   float64   `json:"cost_price"`
-	Subtotal    float64   `json:"subtotal"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID               int       `json:"id"`
+	PaymentID        int       `json:"payment_id"`
+	OrderID          int       `json:"order_id"`
+	OrderItemID      int       `json:"order_item_id"`
+	ProductID        int       `json:"product_id"`
+	ProductName      string    `json:"product_name"`
+	SpecName         string    `json:"spec_name"`
+	Quantity         int       `json:"quantity"`
+	CostPrice        float64   `json:"cost_price"`
+	Subtotal         float64   `json:"subtotal"`
+	ReturnedQuantity int       `json:"returned_quantity"` // 售后退货数量（付款后发生）
+	ReturnedAmount   float64   `json:"returned_amount"`   // 售后退货冲减金额（需供应商退回）
+	CreatedAt        time.Time `json:"created_at"`
 }
 
 // CreateSupplierPayment 创建供应商付款记录，返回创建的付款记录ID
@@ -216,7 +218,7 @@ func GetSupplierPayments(supplierID *int, startDate, endDate *time.Time, pageNum
 func GetSupplierPaymentItems(paymentID int) ([]SupplierPaymentItem, error) {
 	query := `
 		SELECT id, payment_id, order_id, order_item_id, product_id, product_name, spec_name, 
-		       quantity, cost_price, subtotal, created_at
+		       quantity, cost_price, subtotal, returned_quantity, returned_amount, created_at
 		FROM supplier_payment_items
 		WHERE payment_id = ?
 		ORDER BY id
@@ -241,6 +243,8 @@ func GetSupplierPaymentItems(paymentID int) ([]SupplierPaymentItem, error) {
 			&item.Quantity,
 			&item.CostPrice,
 			&item.Subtotal,
+			&item.ReturnedQuantity,
+			&item.ReturnedAmount,
 			&item.CreatedAt,
 		)
 		if err != nil {
@@ -299,6 +303,85 @@ func GetPaidOrderItemIDs(supplierID *int) (map[int]bool, error) {
 	return paidItems, nil
 }
 
+// GetUnpaidReturnedQuantities 获取供应商未付款商品中已完成售后退货的数量（订单明细ID -> 退货数量）
+// 付款前退货的商品无需向供应商付款，构建应付款和付款明细时从数量中扣除
+func GetUnpaidReturnedQuantities(supplierID int) (map[int]int, error) {
+	rows, err := database.DB.Query(`
+		SELECT asi.order_item_id, SUM(asi.quantity)
+		FROM after_sales_items asi
+		INNER JOIN after_sales_requests asr ON asi.request_id = asr.id
+		INNER JOIN products p ON asi.product_id = p.id
+		WHERE p.supplier_id = ? AND asr.status = ? AND asi.supplier_credit_amount > 0
+			AND NOT EXISTS (
+				SELECT 1 FROM supplier_payment_items spi
+				INNER JOIN supplier_payments sp ON spi.payment_id = sp.id
+				WHERE spi.order_item_id = asi.order_item_id AND sp.status = 1
+			)
+		GROUP BY asi.order_item_id
+	`, supplierID, AfterSalesCompleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	returned := make(map[int]int)
+	for rows.Next() {
+		var orderItemID, quantity int
+		if err := rows.Scan(&orderItemID, &quantity); err != nil {
+			return nil, err
+		}
+		returned[orderItemID] = quantity
+	}
+	return returned, rows.Err()
+}
+
+// GetOrderItemPayableQuantity 获取订单商品应向供应商付款的数量（下单数量扣除已完成的售后退货数量）
+func GetOrderItemPayableQuantity(orderItemID int) (int, error) {
+	var quantity, returned int
+	err := database.DB.QueryRow(`
+		SELECT oi.quantity, COALESCE((
+			SELECT SUM(asi.quantity)
+			FROM after_sales_items asi
+			INNER JOIN after_sales_requests asr ON asi.request_id = asr.id
+			WHERE asi.order_item_id = oi.id AND asr.status = ? AND asi.supplier_credit_amount > 0
+		), 0)
+		FROM order_items oi WHERE oi.id = ?
+	`, AfterSalesCompleted, orderItemID).Scan(&quantity, &returned)
+	if err != nil {
+		return 0, err
+	}
+	return quantity - returned, nil
+}
+
+// AddSupplierPaymentItemReturnInTx 售后退货时冲减已付款的供应商明细，返回是否存在已付款记录
+// 未付款的商品不在此记录，构建应付款时按 GetUnpaidReturnedQuantities 扣除退货数量
+func AddSupplierPaymentItemReturnInTx(tx *sql.Tx, orderItemID int, quantity int) (bool, error) {
+	var itemID int
+	var costPrice float64
+	err := tx.QueryRow(`
+		SELECT spi.id, spi.cost_price
+		FROM supplier_payment_items spi
+		INNER JOIN supplier_payments sp ON spi.payment_id = sp.id
+		WHERE spi.order_item_id = ? AND sp.status = 1
+		FOR UPDATE
+	`, orderItemID).Scan(&itemID, &costPrice)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`
+		UPDATE supplier_payment_items
+		SET returned_quantity = returned_quantity + ?, returned_amount = returned_amount + ?
+		WHERE id = ?
+	`, quantity, costPrice*float64(quantity), itemID)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // CancelSupplierPayment 撤销付款（软删除）
 func CancelSupplierPayment(id int) error {
 	query := "UPDATE supplier_payments SET status = 0, updated_at = NOW() WHERE id = ?"
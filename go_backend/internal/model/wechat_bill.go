@@ -0,0 +1,114 @@
+package model
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// WechatBillRow 微信支付交易账单/退款账单中的一行明细
+type WechatBillRow struct {
+	TradeTime     string  `json:"trade_time"`     // 交易时间
+	TransactionID string  `json:"transaction_id"` // 微信订单号
+	OutTradeNo    string  `json:"out_trade_no"`   // 商户订单号
+	TradeState    string  `json:"trade_state"`    // 交易状态：SUCCESS/REFUND/REVOKED
+	Amount        float64 `json:"amount"`         // 应结订单金额（元）
+	RefundID      string  `json:"refund_id"`      // 微信退款单号
+	OutRefundNo   string  `json:"out_refund_no"`  // 商户退款单号
+	RefundAmount  float64 `json:"refund_amount"`  // 退款金额（元）
+	RefundStatus  string  `json:"refund_status"`  // 退款状态：SUCCESS/PROCESSING/...
+	Fee           float64 `json:"fee"`            // 手续费（元）
+}
+
+// IsRefund 是否为退款明细
+func (r WechatBillRow) IsRefund() bool {
+	return r.TradeState == "REFUND"
+}
+
+// wechatBillColumns 账单表头 -> 字段
+var wechatBillColumns = map[string]func(r *WechatBillRow, v string){
+	"交易时间":   func(r *WechatBillRow, v string) { r.TradeTime = v },
+	"微信订单号":  func(r *WechatBillRow, v string) { r.TransactionID = v },
+	"商户订单号":  func(r *WechatBillRow, v string) { r.OutTradeNo = v },
+	"交易状态":   func(r *WechatBillRow, v string) { r.TradeState = strings.ToUpper(v) },
+	"应结订单金额": func(r *WechatBillRow, v string) { r.Amount = parseBillAmount(v) },
+	"微信退款单号": func(r *WechatBillRow, v string) { r.RefundID = v },
+	"商户退款单号": func(r *WechatBillRow, v string) { r.OutRefundNo = v },
+	"退款金额":   func(r *WechatBillRow, v string) { r.RefundAmount = parseBillAmount(v) },
+	"退款状态":   func(r *WechatBillRow, v string) { r.RefundStatus = strings.ToUpper(v) },
+	"手续费":    func(r *WechatBillRow, v string) { r.Fee = parseBillAmount(v) },
+}
+
+// ParseWechatBill 解析微信支付账单 CSV（交易账单 ALL/SUCCESS 或退款账单 REFUND）
+// 账单格式：首行为表头，明细字段以 ` 开头，明细之后为「总交易单数...」汇总行
+func ParseWechatBill(r io.Reader) ([]WechatBillRow, error) {
+	reader := csv.NewReader(bufio.NewReader(r))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("读取账单表头失败: %v", err)
+	}
+	setters := make([]func(r *WechatBillRow, v string), len(header))
+	found := 0
+	for i, name := range header {
+		name = strings.TrimPrefix(strings.TrimSpace(name), "\ufeff")
+		if setter, ok := wechatBillColumns[name]; ok {
+			setters[i] = setter
+			found++
+		}
+	}
+	if setters[0] == nil || found < 4 {
+		return nil, fmt.Errorf("账单格式不正确：缺少交易时间、商户订单号等表头")
+	}
+
+	rows := make([]WechatBillRow, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("读取账单明细失败: %v", err)
+		}
+		if len(record) == 0 {
+			continue
+		}
+		first := strings.TrimSpace(record[0])
+		// 明细结束，后面是汇总
+		if strings.HasPrefix(first, "总") {
+			break
+		}
+		if first == "" {
+			continue
+		}
+		var row WechatBillRow
+		for i, v := range record {
+			if i < len(setters) && setters[i] != nil {
+				setters[i](&row, cleanBillValue(v))
+			}
+		}
+		if row.OutTradeNo == "" && row.TransactionID == "" {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// cleanBillValue 去掉微信账单字段前的 ` 和空白
+func cleanBillValue(v string) string {
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(v), "`"))
+}
+
+func parseBillAmount(v string) float64 {
+	f, err := strconv.ParseFloat(strings.ReplaceAll(v, ",", ""), 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
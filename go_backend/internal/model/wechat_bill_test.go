@@ -0,0 +1,83 @@
+package model
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const wechatBillHeader = "交易时间,公众账号ID,商户号,设备号,微信订单号,商户订单号,用户标识,交易类型,交易状态,付款银行,货币种类,应结订单金额,代金券金额,微信退款单号,商户退款单号,退款金额,充值券退款金额,退款类型,退款状态,商品名称,商户数据包,手续费,费率\n"
+
+func TestParseWechatBill(t *testing.T) {
+	tests := []struct {
+		name    string
+		bill    string
+		want    []WechatBillRow
+		wantErr bool
+	}{
+		{
+			name: "交易账单：字段以反引号开头，汇总行之后不再解析",
+			bill: wechatBillHeader +
+				"`2024-01-02 10:00:00,`wx01,`1600000000,`,`4200000001,`P001,`oA,`JSAPI,`SUCCESS,`OTHERS,`CNY,`12.50,`0.00,`0,`0,`0.00,`0.00,`,`,`商品,`,`0.08000,`0.60%\n" +
+				"`2024-01-02 11:00:00,`wx01,`1600000000,`,`4200000002,`P002,`oB,`JSAPI,`REVOKED,`OTHERS,`CNY,`0.00,`0.00,`0,`0,`0.00,`0.00,`,`,`商品,`,`0.00000,`0.60%\n" +
+				"总交易单数,应结订单总金额,退款总金额,充值券退款总金额,手续费总金额\n" +
+				"`2,`12.50,`0.00,`0.00,`0.08\n",
+			want: []WechatBillRow{
+				{TradeTime: "2024-01-02 10:00:00", TransactionID: "4200000001", OutTradeNo: "P001", TradeState: "SUCCESS", Amount: 12.5, RefundID: "0", OutRefundNo: "0", Fee: 0.08},
+				{TradeTime: "2024-01-02 11:00:00", TransactionID: "4200000002", OutTradeNo: "P002", TradeState: "REVOKED", RefundID: "0", OutRefundNo: "0"},
+			},
+		},
+		{
+			name: "退款明细：状态转为大写，金额支持千分位",
+			bill: wechatBillHeader +
+				"`2024-01-02 12:00:00,`wx01,`1600000000,`,`4200000003,`P003,`oC,`JSAPI,`refund,`OTHERS,`CNY,\"`1,234.50\",`0.00,`50000001,`P003_refund_1,`5.00,`0.00,`ORIGINAL,`success,`商品,`,`-0.03000,`0.60%\n" +
+				"总交易单数,应结订单总金额\n",
+			want: []WechatBillRow{
+				{TradeTime: "2024-01-02 12:00:00", TransactionID: "4200000003", OutTradeNo: "P003", TradeState: "REFUND", Amount: 1234.5,
+					RefundID: "50000001", OutRefundNo: "P003_refund_1", RefundAmount: 5, RefundStatus: "SUCCESS", Fee: -0.03},
+			},
+		},
+		{
+			name: "带 BOM 的表头，跳过空行和缺少订单号的行",
+			bill: "\ufeff" + wechatBillHeader +
+				"\n" +
+				"`2024-01-02 13:00:00,`wx01,`1600000000,`,`,`,`oD,`JSAPI,`SUCCESS,`OTHERS,`CNY,`1.00,`0.00,`0,`0,`0.00,`0.00,`,`,`商品,`,`0.00000,`0.60%\n" +
+				"`2024-01-02 14:00:00,`wx01,`1600000000,`,`4200000004,`P004,`oE,`JSAPI,`SUCCESS,`OTHERS,`CNY,`3.00,`0.00,`0,`0,`0.00,`0.00,`,`,`商品,`,`0.02000,`0.60%\n",
+			want: []WechatBillRow{
+				{TradeTime: "2024-01-02 14:00:00", TransactionID: "4200000004", OutTradeNo: "P004", TradeState: "SUCCESS", Amount: 3, RefundID: "0", OutRefundNo: "0", Fee: 0.02},
+			},
+		},
+		{
+			name: "只有表头没有明细",
+			bill: wechatBillHeader + "总交易单数,应结订单总金额\n`0,`0.00\n",
+			want: []WechatBillRow{},
+		},
+		{
+			name:    "表头不是微信账单格式",
+			bill:    "日期,订单号,金额\n2024-01-02,P001,12.50\n",
+			wantErr: true,
+		},
+		{
+			name:    "空文件",
+			bill:    "",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseWechatBill(strings.NewReader(tt.bill))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseWechatBill() 期望返回错误，实际得到 %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseWechatBill() 返回错误: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseWechatBill() =\n%+v\n期望\n%+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,624 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"go_backend/internal/database"
+)
+
+// 对账差异类型
+const (
+	ReconcilePaidNoOrder    = "paid_no_order"   // 账单有支付，系统无对应已支付订单
+	ReconcileOrderMissing   = "order_missing"   // 系统订单已微信支付，账单无记录
+	ReconcileAmountMismatch = "amount_mismatch" // 支付金额不一致
+	ReconcileRefundMismatch = "refund_mismatch" // 退款金额或状态不一致
+)
+
+// 对账差异处理状态
+const (
+	ReconcileDiscrepancyOpen     = "open"
+	ReconcileDiscrepancyResolved = "resolved"
+)
+
+// 账单来源
+const (
+	ReconcileSourceUpload   = "upload"
+	ReconcileSourceDownload = "download"
+)
+
+// WechatReconciliationRun 一次对账批次
+type WechatReconciliationRun struct {
+	ID               int       `json:"id"`
+	BillDate         string    `json:"bill_date"`
+	Source           string    `json:"source"`
+	FileName         string    `json:"file_name"`
+	TradeCount       int       `json:"trade_count"`
+	TradeAmount      float64   `json:"trade_amount"`
+	RefundCount      int       `json:"refund_count"`
+	RefundAmount     float64   `json:"refund_amount"`
+	MatchedCount     int       `json:"matched_count"`
+	DiscrepancyCount int       `json:"discrepancy_count"`
+	Operator         string    `json:"operator"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// WechatReconciliationDiscrepancy 对账差异明细
+type WechatReconciliationDiscrepancy struct {
+	ID            int        `json:"id"`
+	RunID         int        `json:"run_id"`
+	BillDate      string     `json:"bill_date"`
+	Type          string     `json:"type"`
+	OutTradeNo    string     `json:"out_trade_no"`
+	TransactionID string     `json:"transaction_id"`
+	RefundID      string     `json:"refund_id"`
+	OrderID       *int       `json:"order_id,omitempty"`
+	BillAmount    *float64   `json:"bill_amount,omitempty"`
+	SystemAmount  *float64   `json:"system_amount,omitempty"`
+	Detail        string     `json:"detail"`
+	Status        string     `json:"status"`
+	ResolvedBy    *string    `json:"resolved_by,omitempty"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty"`
+	Remark        *string    `json:"remark,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// WechatReconcileInput 对账输入
+type WechatReconcileInput struct {
+	BillDate string // 账单日期 YYYY-MM-DD
+	Source   string
+	FileName string
+	Operator string
+	Rows     []WechatBillRow // 交易账单与退款账单的明细（可合并传入，退款按微信退款单号去重）
+}
+
+// WechatDiscrepancyFilter 差异查询条件
+type WechatDiscrepancyFilter struct {
+	RunID    int
+	BillDate string
+	Type     string
+	Status   string
+}
+
+// reconcileOrder 对账所需的订单信息
+type reconcileOrder struct {
+	ID            int
+	PaidAmount    float64 // 实际支付金额 = 当前实付 + 缺货已退金额
+	TransactionID string
+}
+
+// ReconcileWechatBill 将微信账单明细与系统订单、退款记录逐笔核对，生成对账批次和差异报告
+func ReconcileWechatBill(input WechatReconcileInput) (*WechatReconciliationRun, error) {
+	billDate, err := time.ParseInLocation("2006-01-02", input.BillDate, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("账单日期格式不正确")
+	}
+	run := &WechatReconciliationRun{
+		BillDate: billDate.Format("2006-01-02"),
+		Source:   input.Source,
+		FileName: input.FileName,
+		Operator: input.Operator,
+	}
+	var discrepancies []WechatReconciliationDiscrepancy
+
+	// 支付明细
+	trades, refundRows, hasRefundRows := splitWechatBillRows(input.Rows)
+	billTradeNos := make(map[string]bool)
+	for _, row := range trades {
+		billTradeNos[row.OutTradeNo] = true
+		run.TradeCount++
+		run.TradeAmount += row.Amount
+
+		d, err := reconcilePayment(row)
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			discrepancies = append(discrepancies, *d)
+		} else {
+			run.MatchedCount++
+		}
+	}
+
+	// 系统中当日微信支付的订单在账单中缺失
+	missing, err := findOrdersMissingFromBill(run.BillDate, billTradeNos)
+	if err != nil {
+		return nil, err
+	}
+	discrepancies = append(discrepancies, missing...)
+
+	// 退款明细
+	billRefundIDs := make(map[string]bool)
+	for _, row := range refundRows {
+		run.RefundCount++
+		run.RefundAmount += row.RefundAmount
+		billRefundIDs[row.RefundID] = true
+
+		d, err := reconcileRefund(row)
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			discrepancies = append(discrepancies, *d)
+		} else {
+			run.MatchedCount++
+		}
+	}
+	if hasRefundRows {
+		missingRefunds, err := findRefundsMissingFromBill(run.BillDate, billRefundIDs)
+		if err != nil {
+			return nil, err
+		}
+		discrepancies = append(discrepancies, missingRefunds...)
+	}
+
+	run.TradeAmount = roundMoney(run.TradeAmount)
+	run.RefundAmount = roundMoney(run.RefundAmount)
+	run.DiscrepancyCount = len(discrepancies)
+	if err := saveWechatReconciliationRun(run, discrepancies); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// splitWechatBillRows 拆分账单明细：成功支付按商户订单号去重，退款按微信退款单号（缺失时按商户退款单号）去重
+// hasRefundRows 表示账单包含退款明细（只有此时才核对系统退款是否缺失）
+func splitWechatBillRows(rows []WechatBillRow) (trades, refunds []WechatBillRow, hasRefundRows bool) {
+	seenTrades := make(map[string]bool)
+	seenRefunds := make(map[string]bool)
+	for _, row := range rows {
+		if row.IsRefund() {
+			hasRefundRows = true
+			key := row.RefundID
+			if key == "" {
+				key = row.OutRefundNo
+			}
+			if key == "" || seenRefunds[key] {
+				continue
+			}
+			seenRefunds[key] = true
+			refunds = append(refunds, row)
+			continue
+		}
+		if row.TradeState != "SUCCESS" || seenTrades[row.OutTradeNo] {
+			continue
+		}
+		seenTrades[row.OutTradeNo] = true
+		trades = append(trades, row)
+	}
+	return trades, refunds, hasRefundRows
+}
+
+// reconcilePayment 核对一笔支付，一致返回 nil
+func reconcilePayment(row WechatBillRow) (*WechatReconciliationDiscrepancy, error) {
+	billAmount := row.Amount
+	d := &WechatReconciliationDiscrepancy{
+		OutTradeNo:    row.OutTradeNo,
+		TransactionID: row.TransactionID,
+		BillAmount:    &billAmount,
+	}
+
+	order, err := getReconcileOrder(row.OutTradeNo)
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		// 已登记为支付回调异常并已退款的，资金去向明确，不算差异
+		var status string
+		err := database.DB.QueryRow(`SELECT status FROM prepay_notify_exceptions WHERE out_trade_no = ?`, row.OutTradeNo).Scan(&status)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if status == PrepayExceptionRefunded {
+			return nil, nil
+		}
+		d.Type = ReconcilePaidNoOrder
+		d.Detail = "账单有支付记录，系统无对应订单"
+		if status != "" {
+			d.Detail += fmt.Sprintf("（已登记支付回调异常，状态：%s）", status)
+		}
+		return d, nil
+	}
+
+	return matchPayment(d, row, order), nil
+}
+
+// matchPayment 将账单支付与系统订单比对，一致返回 nil，否则填写 d 的差异类型和说明后返回 d
+func matchPayment(d *WechatReconciliationDiscrepancy, row WechatBillRow, order *reconcileOrder) *WechatReconciliationDiscrepancy {
+	d.OrderID = &order.ID
+	paidAmount := order.PaidAmount
+	d.SystemAmount = &paidAmount
+	if order.TransactionID == "" {
+		d.Type = ReconcilePaidNoOrder
+		d.Detail = "账单有支付记录，系统订单未记录微信支付"
+		return d
+	}
+	if row.TransactionID != "" && order.TransactionID != row.TransactionID {
+		d.Type = ReconcilePaidNoOrder
+		d.Detail = fmt.Sprintf("微信支付单号不一致，系统记录为 %s", order.TransactionID)
+		return d
+	}
+	if !moneyEqual(order.PaidAmount, row.Amount) {
+		d.Type = ReconcileAmountMismatch
+		d.Detail = fmt.Sprintf("账单金额 %.2f 元，系统实付 %.2f 元", row.Amount, order.PaidAmount)
+		return d
+	}
+	return nil
+}
+
+// reconcileRefund 核对一笔退款，一致返回 nil
+func reconcileRefund(row WechatBillRow) (*WechatReconciliationDiscrepancy, error) {
+	billAmount := row.RefundAmount
+	d := &WechatReconciliationDiscrepancy{
+		Type:          ReconcileRefundMismatch,
+		OutTradeNo:    row.OutTradeNo,
+		TransactionID: row.TransactionID,
+		RefundID:      row.RefundID,
+		BillAmount:    &billAmount,
+	}
+	if order, err := getReconcileOrder(row.OutTradeNo); err != nil {
+		return nil, err
+	} else if order != nil {
+		d.OrderID = &order.ID
+	}
+
+	amount, status, found, err := lookupSystemRefund(row.RefundID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		d.Detail = "账单有退款记录，系统无对应退款"
+		return d, nil
+	}
+	return matchRefund(d, row, amount, status), nil
+}
+
+// matchRefund 将账单退款与系统退款比对，amount 为系统退款金额（未知时为 nil），status 为归一化的系统退款状态
+// 一致返回 nil，否则填写 d 的差异说明后返回 d
+func matchRefund(d *WechatReconciliationDiscrepancy, row WechatBillRow, amount *float64, status string) *WechatReconciliationDiscrepancy {
+	if amount != nil {
+		d.SystemAmount = amount
+		if !moneyEqual(*amount, row.RefundAmount) {
+			d.Detail = fmt.Sprintf("账单退款 %.2f 元，系统记录 %.2f 元", row.RefundAmount, *amount)
+			return d
+		}
+	}
+	billSuccess := row.RefundStatus == "" || row.RefundStatus == "SUCCESS"
+	if billSuccess != (status == WechatRefundSuccess) {
+		d.Detail = fmt.Sprintf("退款状态不一致：账单 %s，系统 %s", row.RefundStatus, status)
+		return d
+	}
+	return nil
+}
+
+// lookupSystemRefund 按微信退款单号查找系统中的退款，返回金额（未知时为 nil）和归一化状态
+// 优先使用退款记录表，历史退款依次回查售后申请、订单和支付回调异常
+func lookupSystemRefund(refundID string) (*float64, string, bool, error) {
+	if refundID == "" {
+		return nil, "", false, nil
+	}
+	if r, err := getWechatRefundByRefundID(refundID); err != nil {
+		return nil, "", false, err
+	} else if r != nil {
+		amount := r.Amount
+		return &amount, r.Status, true, nil
+	}
+
+	var amount float64
+	var status string
+	err := database.DB.QueryRow(`SELECT refund_amount, status FROM after_sales_requests WHERE wechat_refund_id = ? LIMIT 1`, refundID).Scan(&amount, &status)
+	if err == nil {
+		if status == AfterSalesCompleted {
+			status = WechatRefundSuccess
+		}
+		return &amount, status, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, "", false, err
+	}
+
+	var refundStatus sql.NullString
+	err = database.DB.QueryRow(`SELECT refund_status FROM orders WHERE wechat_refund_id = ? LIMIT 1`, refundID).Scan(&refundStatus)
+	if err == nil {
+		return nil, refundStatus.String, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, "", false, err
+	}
+
+	err = database.DB.QueryRow(`SELECT amount FROM prepay_notify_exceptions WHERE refund_id = ? LIMIT 1`, refundID).Scan(&amount)
+	if err == nil {
+		return &amount, WechatRefundSuccess, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, "", false, err
+	}
+	return nil, "", false, nil
+}
+
+func getReconcileOrder(orderNumber string) (*reconcileOrder, error) {
+	var o reconcileOrder
+	var txID sql.NullString
+	err := database.DB.QueryRow(`
+		SELECT id, total_amount + COALESCE(shortage_amount, 0), wechat_transaction_id
+		FROM orders WHERE order_number = ?
+	`, orderNumber).Scan(&o.ID, &o.PaidAmount, &txID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.PaidAmount = roundMoney(o.PaidAmount)
+	o.TransactionID = txID.String
+	return &o, nil
+}
+
+// findOrdersMissingFromBill 查找账单日当天微信支付、但未出现在账单中的订单
+func findOrdersMissingFromBill(billDate string, billTradeNos map[string]bool) ([]WechatReconciliationDiscrepancy, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, order_number, wechat_transaction_id, total_amount + COALESCE(shortage_amount, 0)
+		FROM orders
+		WHERE wechat_transaction_id IS NOT NULL AND wechat_transaction_id != ''
+		  AND paid_at >= ? AND paid_at < DATE_ADD(?, INTERVAL 1 DAY)
+	`, billDate, billDate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]WechatReconciliationDiscrepancy, 0)
+	for rows.Next() {
+		var orderID int
+		var orderNumber, txID string
+		var amount float64
+		if err := rows.Scan(&orderID, &orderNumber, &txID, &amount); err != nil {
+			return nil, err
+		}
+		if billTradeNos[orderNumber] {
+			continue
+		}
+		id := orderID
+		systemAmount := roundMoney(amount)
+		list = append(list, WechatReconciliationDiscrepancy{
+			Type:          ReconcileOrderMissing,
+			OutTradeNo:    orderNumber,
+			TransactionID: txID,
+			OrderID:       &id,
+			SystemAmount:  &systemAmount,
+			Detail:        "系统订单已微信支付，账单无对应记录（跨日支付请核对相邻日期账单）",
+		})
+	}
+	return list, rows.Err()
+}
+
+// findRefundsMissingFromBill 查找账单日当天退款成功、但未出现在账单中的退款
+func findRefundsMissingFromBill(billDate string, billRefundIDs map[string]bool) ([]WechatReconciliationDiscrepancy, error) {
+	rows, err := database.DB.Query(`
+		SELECT out_trade_no, refund_id, amount
+		FROM wechat_refunds
+		WHERE status = ? AND refund_id != '' AND succeeded_at >= ? AND succeeded_at < DATE_ADD(?, INTERVAL 1 DAY)
+	`, WechatRefundSuccess, billDate, billDate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]WechatReconciliationDiscrepancy, 0)
+	for rows.Next() {
+		var outTradeNo, refundID string
+		var amount float64
+		if err := rows.Scan(&outTradeNo, &refundID, &amount); err != nil {
+			return nil, err
+		}
+		if billRefundIDs[refundID] {
+			continue
+		}
+		systemAmount := amount
+		list = append(list, WechatReconciliationDiscrepancy{
+			Type:         ReconcileRefundMismatch,
+			OutTradeNo:   outTradeNo,
+			RefundID:     refundID,
+			SystemAmount: &systemAmount,
+			Detail:       "系统退款成功，账单无对应退款记录",
+		})
+	}
+	return list, rows.Err()
+}
+
+func saveWechatReconciliationRun(run *WechatReconciliationRun, discrepancies []WechatReconciliationDiscrepancy) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO wechat_reconciliation_runs (bill_date, source, file_name, trade_count, trade_amount, refund_count, refund_amount,
+			matched_count, discrepancy_count, operator, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())
+	`, run.BillDate, run.Source, run.FileName, run.TradeCount, run.TradeAmount, run.RefundCount, run.RefundAmount,
+		run.MatchedCount, run.DiscrepancyCount, run.Operator)
+	if err != nil {
+		return fmt.Errorf("保存对账批次失败: %v", err)
+	}
+	runID, _ := result.LastInsertId()
+	run.ID = int(runID)
+	run.CreatedAt = time.Now()
+
+	for _, d := range discrepancies {
+		if _, err := tx.Exec(`
+			INSERT INTO wechat_reconciliation_discrepancies (run_id, bill_date, type, out_trade_no, transaction_id, refund_id,
+				order_id, bill_amount, system_amount, detail, status, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())
+		`, run.ID, run.BillDate, d.Type, d.OutTradeNo, d.TransactionID, d.RefundID,
+			d.OrderID, d.BillAmount, d.SystemAmount, d.Detail, ReconcileDiscrepancyOpen); err != nil {
+			return fmt.Errorf("保存对账差异失败: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// GetWechatReconciliationRuns 获取对账批次列表（分页）
+func GetWechatReconciliationRuns(pageNum, pageSize int) ([]WechatReconciliationRun, int, error) {
+	var total int
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM wechat_reconciliation_runs").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	offset := (pageNum - 1) * pageSize
+	if offset < 0 {
+		offset = 0
+	}
+	rows, err := database.DB.Query(`
+		SELECT `+reconciliationRunColumns+`
+		FROM wechat_reconciliation_runs
+		ORDER BY bill_date DESC, id DESC
+		LIMIT ? OFFSET ?
+	`, pageSize, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	list := make([]WechatReconciliationRun, 0)
+	for rows.Next() {
+		run, err := scanReconciliationRun(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		list = append(list, *run)
+	}
+	return list, total, rows.Err()
+}
+
+// GetWechatReconciliationRunByID 获取对账批次，不存在返回 nil
+func GetWechatReconciliationRunByID(id int) (*WechatReconciliationRun, error) {
+	row := database.DB.QueryRow(`SELECT `+reconciliationRunColumns+` FROM wechat_reconciliation_runs WHERE id = ?`, id)
+	run, err := scanReconciliationRun(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return run, err
+}
+
+// GetWechatReconciliationDiscrepancies 获取对账差异列表（分页，pageSize <= 0 表示不分页，用于导出）
+func GetWechatReconciliationDiscrepancies(filter WechatDiscrepancyFilter, pageNum, pageSize int) ([]WechatReconciliationDiscrepancy, int, error) {
+	where := "1=1"
+	args := []interface{}{}
+	if filter.RunID > 0 {
+		where += " AND run_id = ?"
+		args = append(args, filter.RunID)
+	}
+	if filter.BillDate != "" {
+		where += " AND bill_date = ?"
+		args = append(args, filter.BillDate)
+	}
+	if filter.Type != "" {
+		where += " AND type = ?"
+		args = append(args, filter.Type)
+	}
+	if filter.Status != "" {
+		where += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+
+	var total int
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM wechat_reconciliation_discrepancies WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT id, run_id, bill_date, type, out_trade_no, transaction_id, refund_id, order_id, bill_amount, system_amount,
+			detail, status, resolved_by, resolved_at, remark, created_at
+		FROM wechat_reconciliation_discrepancies
+		WHERE ` + where + `
+		ORDER BY id`
+	if pageSize > 0 {
+		offset := (pageNum - 1) * pageSize
+		if offset < 0 {
+			offset = 0
+		}
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, pageSize, offset)
+	}
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	list := make([]WechatReconciliationDiscrepancy, 0)
+	for rows.Next() {
+		var d WechatReconciliationDiscrepancy
+		var billDate time.Time
+		var orderID sql.NullInt64
+		var billAmount, systemAmount sql.NullFloat64
+		var resolvedBy, remark sql.NullString
+		var resolvedAt sql.NullTime
+		if err := rows.Scan(&d.ID, &d.RunID, &billDate, &d.Type, &d.OutTradeNo, &d.TransactionID, &d.RefundID, &orderID,
+			&billAmount, &systemAmount, &d.Detail, &d.Status, &resolvedBy, &resolvedAt, &remark, &d.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		d.BillDate = billDate.Format("2006-01-02")
+		if orderID.Valid {
+			v := int(orderID.Int64)
+			d.OrderID = &v
+		}
+		if billAmount.Valid {
+			d.BillAmount = &billAmount.Float64
+		}
+		if systemAmount.Valid {
+			d.SystemAmount = &systemAmount.Float64
+		}
+		if resolvedBy.Valid {
+			d.ResolvedBy = &resolvedBy.String
+		}
+		if resolvedAt.Valid {
+			d.ResolvedAt = &resolvedAt.Time
+		}
+		if remark.Valid {
+			d.Remark = &remark.String
+		}
+		list = append(list, d)
+	}
+	return list, total, rows.Err()
+}
+
+// ResolveWechatReconciliationDiscrepancy 标记对账差异已处理
+func ResolveWechatReconciliationDiscrepancy(id int, operator, remark string) error {
+	result, err := database.DB.Exec(`
+		UPDATE wechat_reconciliation_discrepancies
+		SET status = ?, resolved_by = ?, resolved_at = NOW(), remark = ?
+		WHERE id = ? AND status = ?
+	`, ReconcileDiscrepancyResolved, operator, remark, id, ReconcileDiscrepancyOpen)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("差异记录不存在或已处理")
+	}
+	return nil
+}
+
+const reconciliationRunColumns = `id, bill_date, source, file_name, trade_count, trade_amount, refund_count, refund_amount,
+	matched_count, discrepancy_count, operator, created_at`
+
+func scanReconciliationRun(scanner interface {
+	Scan(dest ...interface{}) error
+}) (*WechatReconciliationRun, error) {
+	var run WechatReconciliationRun
+	var billDate time.Time
+	if err := scanner.Scan(&run.ID, &billDate, &run.Source, &run.FileName, &run.TradeCount, &run.TradeAmount, &run.RefundCount,
+		&run.RefundAmount, &run.MatchedCount, &run.DiscrepancyCount, &run.Operator, &run.CreatedAt); err != nil {
+		return nil, err
+	}
+	run.BillDate = billDate.Format("2006-01-02")
+	return &run, nil
+}
+
+// moneyEqual 金额按分比较
+func moneyEqual(a, b float64) bool {
+	return math.Abs(a-b) < 0.005
+}
@@ -0,0 +1,202 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitWechatBillRows(t *testing.T) {
+	tests := []struct {
+		name        string
+		rows        []WechatBillRow
+		wantTrades  []string // 商户订单号
+		wantRefunds []string // 微信退款单号或商户退款单号
+		wantHasRef  bool
+	}{
+		{
+			name: "只统计成功支付，同一商户订单号去重",
+			rows: []WechatBillRow{
+				{OutTradeNo: "P001", TradeState: "SUCCESS"},
+				{OutTradeNo: "P001", TradeState: "SUCCESS"},
+				{OutTradeNo: "P002", TradeState: "REVOKED"},
+				{OutTradeNo: "P003", TradeState: "SUCCESS"},
+			},
+			wantTrades: []string{"P001", "P003"},
+		},
+		{
+			name: "交易账单与退款账单合并传入时退款按退款单号去重",
+			rows: []WechatBillRow{
+				{OutTradeNo: "P001", TradeState: "SUCCESS"},
+				{OutTradeNo: "P001", TradeState: "REFUND", RefundID: "R1", OutRefundNo: "P001_refund_1"},
+				{OutTradeNo: "P001", TradeState: "REFUND", RefundID: "R1", OutRefundNo: "P001_refund_1"},
+				{OutTradeNo: "P002", TradeState: "REFUND", OutRefundNo: "P002_refund_1"},
+				{OutTradeNo: "P002", TradeState: "REFUND", OutRefundNo: "P002_refund_1"},
+			},
+			wantTrades:  []string{"P001"},
+			wantRefunds: []string{"R1", "P002_refund_1"},
+			wantHasRef:  true,
+		},
+		{
+			name: "缺少退款单号的退款明细不参与核对，但仍视为包含退款账单",
+			rows: []WechatBillRow{
+				{OutTradeNo: "P001", TradeState: "REFUND"},
+			},
+			wantHasRef: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trades, refunds, hasRefundRows := splitWechatBillRows(tt.rows)
+			var gotTrades, gotRefunds []string
+			for _, r := range trades {
+				gotTrades = append(gotTrades, r.OutTradeNo)
+			}
+			for _, r := range refunds {
+				key := r.RefundID
+				if key == "" {
+					key = r.OutRefundNo
+				}
+				gotRefunds = append(gotRefunds, key)
+			}
+			if !reflect.DeepEqual(gotTrades, tt.wantTrades) {
+				t.Errorf("trades = %v, 期望 %v", gotTrades, tt.wantTrades)
+			}
+			if !reflect.DeepEqual(gotRefunds, tt.wantRefunds) {
+				t.Errorf("refunds = %v, 期望 %v", gotRefunds, tt.wantRefunds)
+			}
+			if hasRefundRows != tt.wantHasRef {
+				t.Errorf("hasRefundRows = %v, 期望 %v", hasRefundRows, tt.wantHasRef)
+			}
+		})
+	}
+}
+
+func TestMatchPayment(t *testing.T) {
+	tests := []struct {
+		name     string
+		row      WechatBillRow
+		order    reconcileOrder
+		wantType string // 空表示一致
+	}{
+		{
+			name:  "金额和支付单号一致",
+			row:   WechatBillRow{OutTradeNo: "P001", TransactionID: "T1", Amount: 12.5},
+			order: reconcileOrder{ID: 1, PaidAmount: 12.5, TransactionID: "T1"},
+		},
+		{
+			name:  "缺货部分退款后按原支付金额核对",
+			row:   WechatBillRow{OutTradeNo: "P001", TransactionID: "T1", Amount: 30},
+			order: reconcileOrder{ID: 1, PaidAmount: 25 + 5, TransactionID: "T1"},
+		},
+		{
+			name:  "浮点误差不算差异",
+			row:   WechatBillRow{OutTradeNo: "P001", TransactionID: "T1", Amount: 0.3},
+			order: reconcileOrder{ID: 1, PaidAmount: 0.1 + 0.2, TransactionID: "T1"},
+		},
+		{
+			name:  "账单未提供支付单号时只核对金额",
+			row:   WechatBillRow{OutTradeNo: "P001", Amount: 8},
+			order: reconcileOrder{ID: 1, PaidAmount: 8, TransactionID: "T1"},
+		},
+		{
+			name:     "金额不一致",
+			row:      WechatBillRow{OutTradeNo: "P001", TransactionID: "T1", Amount: 12.5},
+			order:    reconcileOrder{ID: 1, PaidAmount: 12.49, TransactionID: "T1"},
+			wantType: ReconcileAmountMismatch,
+		},
+		{
+			name:     "系统订单未记录微信支付",
+			row:      WechatBillRow{OutTradeNo: "P001", TransactionID: "T1", Amount: 12.5},
+			order:    reconcileOrder{ID: 1, PaidAmount: 12.5},
+			wantType: ReconcilePaidNoOrder,
+		},
+		{
+			name:     "支付单号不一致（重复支付）",
+			row:      WechatBillRow{OutTradeNo: "P001", TransactionID: "T2", Amount: 12.5},
+			order:    reconcileOrder{ID: 1, PaidAmount: 12.5, TransactionID: "T1"},
+			wantType: ReconcilePaidNoOrder,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := tt.order
+			d := matchPayment(&WechatReconciliationDiscrepancy{OutTradeNo: tt.row.OutTradeNo}, tt.row, &order)
+			if tt.wantType == "" {
+				if d != nil {
+					t.Fatalf("matchPayment() = %+v, 期望一致", d)
+				}
+				return
+			}
+			if d == nil {
+				t.Fatalf("matchPayment() = nil, 期望差异 %s", tt.wantType)
+			}
+			if d.Type != tt.wantType {
+				t.Errorf("差异类型 = %s, 期望 %s", d.Type, tt.wantType)
+			}
+			if d.OrderID == nil || *d.OrderID != order.ID {
+				t.Errorf("差异未关联订单 %d", order.ID)
+			}
+		})
+	}
+}
+
+func TestMatchRefund(t *testing.T) {
+	amount := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name     string
+		row      WechatBillRow
+		amount   *float64
+		status   string
+		wantDiff bool
+	}{
+		{
+			name:   "金额和状态一致",
+			row:    WechatBillRow{RefundID: "R1", RefundAmount: 5, RefundStatus: "SUCCESS"},
+			amount: amount(5),
+			status: WechatRefundSuccess,
+		},
+		{
+			name:   "账单未填退款状态视为成功",
+			row:    WechatBillRow{RefundID: "R1", RefundAmount: 5},
+			amount: amount(5),
+			status: WechatRefundSuccess,
+		},
+		{
+			name:   "系统未记录金额时只核对状态",
+			row:    WechatBillRow{RefundID: "R1", RefundAmount: 5, RefundStatus: "SUCCESS"},
+			status: WechatRefundSuccess,
+		},
+		{
+			name:     "退款金额不一致",
+			row:      WechatBillRow{RefundID: "R1", RefundAmount: 5, RefundStatus: "SUCCESS"},
+			amount:   amount(4.5),
+			status:   WechatRefundSuccess,
+			wantDiff: true,
+		},
+		{
+			name:     "账单已成功，系统仍在处理中",
+			row:      WechatBillRow{RefundID: "R1", RefundAmount: 5, RefundStatus: "SUCCESS"},
+			amount:   amount(5),
+			status:   WechatRefundProcessing,
+			wantDiff: true,
+		},
+		{
+			name:     "账单退款关闭，系统记为成功",
+			row:      WechatBillRow{RefundID: "R1", RefundAmount: 5, RefundStatus: "CLOSED"},
+			amount:   amount(5),
+			status:   WechatRefundSuccess,
+			wantDiff: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := matchRefund(&WechatReconciliationDiscrepancy{Type: ReconcileRefundMismatch, RefundID: tt.row.RefundID}, tt.row, tt.amount, tt.status)
+			if (d != nil) != tt.wantDiff {
+				t.Fatalf("matchRefund() = %+v, 期望差异 %v", d, tt.wantDiff)
+			}
+			if d != nil && d.Detail == "" {
+				t.Errorf("差异缺少说明")
+			}
+		})
+	}
+}
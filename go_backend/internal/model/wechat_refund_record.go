@@ -0,0 +1,102 @@
+package model
+
+import (
+	"database/sql"
+	"strings"
+
+	"go_backend/internal/database"
+)
+
+// 微信退款记录状态
+const (
+	WechatRefundProcessing = "processing"
+	WechatRefundSuccess    = "success"
+	WechatRefundClosed     = "closed"
+	WechatRefundAbnormal   = "abnormal"
+)
+
+// WechatRefundRecord 发起的微信退款
+type WechatRefundRecord struct {
+	OutTradeNo  string
+	OutRefundNo string
+	RefundID    string
+	Amount      float64
+	Reason      string
+	Status      string
+}
+
+// RecordWechatRefund 记录已受理的微信退款（同一商户退款单号重复发起只更新微信退款单号）
+func RecordWechatRefund(r *WechatRefundRecord) error {
+	_, err := database.DB.Exec(`
+		INSERT INTO wechat_refunds (out_trade_no, out_refund_no, refund_id, amount, reason, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, NOW(), NOW())
+		ON DUPLICATE KEY UPDATE refund_id = VALUES(refund_id), updated_at = NOW()
+	`, r.OutTradeNo, r.OutRefundNo, r.RefundID, r.Amount, r.Reason, WechatRefundProcessing)
+	return err
+}
+
+// UpdateWechatRefundStatus 根据退款回调更新退款记录状态，wechatStatus 为微信退款状态（SUCCESS/CLOSED/ABNORMAL）
+func UpdateWechatRefundStatus(refundID, wechatStatus string) error {
+	if refundID == "" {
+		return nil
+	}
+	status := strings.ToLower(wechatStatus)
+	switch status {
+	case WechatRefundSuccess:
+		_, err := database.DB.Exec(`
+			UPDATE wechat_refunds SET status = ?, succeeded_at = COALESCE(succeeded_at, NOW()), updated_at = NOW()
+			WHERE refund_id = ?
+		`, status, refundID)
+		return err
+	case WechatRefundClosed, WechatRefundAbnormal:
+		_, err := database.DB.Exec(`UPDATE wechat_refunds SET status = ?, updated_at = NOW() WHERE refund_id = ?`, status, refundID)
+		return err
+	}
+	return nil
+}
+
+// WechatRefundExists 商户退款单号是否已发起过退款
+func WechatRefundExists(outRefundNo string) (bool, error) {
+	var count int
+	err := database.DB.QueryRow(`SELECT COUNT(*) FROM wechat_refunds WHERE out_refund_no = ?`, outRefundNo).Scan(&count)
+	return count > 0, err
+}
+
+// GetWechatRefundedAmount 支付单已发起的退款合计（不含已关闭/异常的退款），excludeOutRefundNo 不为空时排除该退款单（幂等重试时使用）
+func GetWechatRefundedAmount(outTradeNo, excludeOutRefundNo string) (float64, error) {
+	var amount float64
+	err := database.DB.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0) FROM wechat_refunds
+		WHERE out_trade_no = ? AND out_refund_no <> ? AND status NOT IN (?, ?)
+	`, outTradeNo, excludeOutRefundNo, WechatRefundClosed, WechatRefundAbnormal).Scan(&amount)
+	return amount, err
+}
+
+// GetOrderRefundableAmount 订单剩余可退金额：原支付总额 - 已发起的退款
+func GetOrderRefundableAmount(order *Order) (float64, error) {
+	refunded, err := GetWechatRefundedAmount(order.OrderNumber, "")
+	if err != nil {
+		return 0, err
+	}
+	remaining := roundMoney(order.PaidTotal() - refunded)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, nil
+}
+
+// getWechatRefundByRefundID 按微信退款单号查询退款记录，不存在返回 nil
+func getWechatRefundByRefundID(refundID string) (*WechatRefundRecord, error) {
+	var r WechatRefundRecord
+	err := database.DB.QueryRow(`
+		SELECT out_trade_no, out_refund_no, refund_id, amount, reason, status
+		FROM wechat_refunds WHERE refund_id = ? LIMIT 1
+	`, refundID).Scan(&r.OutTradeNo, &r.OutRefundNo, &r.RefundID, &r.Amount, &r.Reason, &r.Status)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -16,7 +15,7 @@ const defaultFeishuWebhook = "https://open.feishu.cn/open-apis/bot/v2/hook/6cf4c
 
 // NotifyOrderNew 新订单通知
 // isSalesOrder: true=销售员代下单, false=用户自助下单
-func NotifyOrderNew(order *model.Order, orderItems []model.OrderItem, user *model.MiniAppUser, address *model.Address, isSalesOrder bool) {
+func NotifyOrderNew(order *model.Order, orderItems []model.OrderItem, user *model.MiniAppUser, address *model.Address, isSalesOrder bool) error {
 	webhook, _ := model.GetSystemSetting("feishu_webhook_url")
 	if webhook == "" {
 		webhook = defaultFeishuWebhook
@@ -35,11 +34,11 @@ func NotifyOrderNew(order *model.Order, orderItems []model.OrderItem, user *mode
 		productList,
 		order.TotalAmount, paymentMethod,
 	)
-	sendFeishuText(webhook, text)
+	return sendFeishuTextWithError(webhook, text)
 }
 
 // NotifyOrderCancelled 订单取消通知
-func NotifyOrderCancelled(order *model.Order, user *model.MiniAppUser, address *model.Address, cancelReason string) {
+func NotifyOrderCancelled(order *model.Order, user *model.MiniAppUser, address *model.Address, cancelReason string) error {
 	webhook, _ := model.GetSystemSetting("feishu_webhook_url")
 	if webhook == "" {
 		webhook = defaultFeishuWebhook
@@ -57,11 +56,11 @@ func NotifyOrderCancelled(order *model.Order, user *model.MiniAppUser, address *
 		order.TotalAmount, paymentMethod,
 		reason,
 	)
-	sendFeishuText(webhook, text)
+	return sendFeishuTextWithError(webhook, text)
 }
 
 // NotifyOrderDelivered 订单送达通知
-func NotifyOrderDelivered(order *model.Order, orderItems []model.OrderItem, user *model.MiniAppUser, address *model.Address) {
+func NotifyOrderDelivered(order *model.Order, orderItems []model.OrderItem, user *model.MiniAppUser, address *model.Address) error {
 	webhook, _ := model.GetSystemSetting("feishu_webhook_url")
 	if webhook == "" {
 		webhook = defaultFeishuWebhook
@@ -76,11 +75,11 @@ func NotifyOrderDelivered(order *model.Order, orderItems []model.OrderItem, user
 		productList,
 		order.TotalAmount, paymentMethod,
 	)
-	sendFeishuText(webhook, text)
+	return sendFeishuTextWithError(webhook, text)
 }
 
 // NotifyOrderPaid 订单收款通知
-func NotifyOrderPaid(order *model.Order, orderItems []model.OrderItem, user *model.MiniAppUser, transactionID string) {
+func NotifyOrderPaid(order *model.Order, orderItems []model.OrderItem, user *model.MiniAppUser, transactionID string) error {
 	webhook, _ := model.GetSystemSetting("feishu_webhook_url")
 	if webhook == "" {
 		webhook = defaultFeishuWebhook
@@ -106,7 +105,39 @@ func NotifyOrderPaid(order *model.Order, orderItems []model.OrderItem, user *mod
 		productList,
 		order.TotalAmount, paymentMethod, txID,
 	)
-	sendFeishuText(webhook, text)
+	return sendFeishuTextWithError(webhook, text)
+}
+
+// NotifyOrderShortage 取货缺货通知（contact_me 订单挂起时需客服尽快联系客户）
+func NotifyOrderShortage(order *model.Order, user *model.MiniAppUser, result *model.ShortageResult) error {
+	webhook, _ := model.GetSystemSetting("feishu_webhook_url")
+	if webhook == "" {
+		webhook = defaultFeishuWebhook
+	}
+	var sb strings.Builder
+	for _, s := range result.Shortages {
+		sb.WriteString(fmt.Sprintf("• %s %s 下单%d 可取%d\n", s.ProductName, s.SpecName, s.OriginalQuantity, s.AvailableQuantity))
+	}
+	shortageList := strings.TrimSuffix(sb.String(), "\n")
+
+	title := "⚠️ 取货缺货通知"
+	handling := ""
+	switch {
+	case result.Held:
+		title = "🚨 缺货待联系客户"
+		handling = "客户选择「缺货时联系我」，订单已挂起，请尽快联系客户并在后台处理"
+	case result.Strategy == model.OutOfStockCancelItem:
+		handling = fmt.Sprintf("已按客户选择取消缺货商品，订单金额 ￥%.2f → ￥%.2f", result.OldTotalAmount, result.NewTotalAmount)
+	default:
+		handling = fmt.Sprintf("已按客户选择有货先发，订单金额 ￥%.2f → ￥%.2f", result.OldTotalAmount, result.NewTotalAmount)
+	}
+	text := fmt.Sprintf("%s\n——————————\n订单编号：%s\n上报时间：%s\n——————————\n👤 用户信息\n用户ID：%d\n昵称：%s\n联系电话：%s\n——————————\n📝 缺货明细\n%s\n——————————\n处理方式：%s",
+		title, order.OrderNumber, time.Now().Format("2006-01-02 15:04:05"),
+		user.ID, orEmpty(user.Name), orEmpty(user.Phone),
+		shortageList,
+		handling,
+	)
+	return sendFeishuTextWithError(webhook, text)
 }
 
 func formatProductList(items []model.OrderItem) string {
@@ -154,6 +185,7 @@ func SendTestNotification(webhookURL string) error {
 	return sendFeishuTextWithError(webhookURL, text)
 }
 
+// sendFeishuTextWithError 发送飞书文本消息，失败时返回错误以便后台任务重试
 func sendFeishuTextWithError(webhookURL, text string) error {
 	if webhookURL == "" {
 		return nil
@@ -175,9 +207,3 @@ func sendFeishuTextWithError(webhookURL, text string) error {
 	}
 	return nil
 }
-
-func sendFeishuText(webhookURL, text string) {
-	if err := sendFeishuTextWithError(webhookURL, text); err != nil {
-		log.Printf("[Feishu] 发送通知失败: %v", err)
-	}
-}
@@ -0,0 +1,276 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Coordinate 经纬度坐标
+type Coordinate struct {
+	Lat float64
+	Lng float64
+}
+
+// DistanceMatrixEntry 两点间的行驶距离和时间
+type DistanceMatrixEntry struct {
+	DistanceKm      float64 // 距离（公里）
+	DurationMinutes float64 // 行驶时间（分钟）
+}
+
+// DistanceMatrixProvider 距离矩阵服务
+// Matrix 返回 result[i][j] 为 origins[i] 到 destinations[j] 的距离和时间
+type DistanceMatrixProvider interface {
+	Name() string
+	Matrix(origins, destinations []Coordinate) ([][]DistanceMatrixEntry, error)
+}
+
+// HaversineProvider 球面直线距离（离线兜底，也用于测试），时间按平均速度估算
+type HaversineProvider struct {
+	SpeedKmh float64 // 平均速度（公里/小时），0 时按 25 计算
+}
+
+// Name 服务名称
+func (h HaversineProvider) Name() string {
+	return "haversine"
+}
+
+// Matrix 计算直线距离矩阵
+func (h HaversineProvider) Matrix(origins, destinations []Coordinate) ([][]DistanceMatrixEntry, error) {
+	result := make([][]DistanceMatrixEntry, len(origins))
+	for i, o := range origins {
+		result[i] = make([]DistanceMatrixEntry, len(destinations))
+		for j, d := range destinations {
+			result[i][j] = h.entry(o, d)
+		}
+	}
+	return result, nil
+}
+
+func (h HaversineProvider) entry(o, d Coordinate) DistanceMatrixEntry {
+	speed := h.SpeedKmh
+	if speed <= 0 {
+		speed = 25
+	}
+	dist := CalculateDistance(o.Lat, o.Lng, d.Lat, d.Lng)
+	return DistanceMatrixEntry{DistanceKm: dist, DurationMinutes: dist / speed * 60}
+}
+
+// amapDistanceMaxOrigins 高德距离测量接口单次最多起点数
+const amapDistanceMaxOrigins = 100
+
+// AmapDrivingProvider 高德地图驾车距离测量
+type AmapDrivingProvider struct {
+	Key    string
+	Client *http.Client
+}
+
+// NewAmapDrivingProvider 创建高德驾车距离服务
+func NewAmapDrivingProvider(key string) *AmapDrivingProvider {
+	return &AmapDrivingProvider{Key: key, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name 服务名称
+func (a *AmapDrivingProvider) Name() string {
+	return "amap_driving"
+}
+
+// Matrix 调用高德距离测量接口（每次一个终点、最多 100 个起点）
+// 终点多于起点时（如一个订单对多个候选订单）交换起终点批量请求，驾车距离按近似对称处理，
+// 使 1×N 的矩阵只需 ceil(N/100) 次请求而不是 N 次
+func (a *AmapDrivingProvider) Matrix(origins, destinations []Coordinate) ([][]DistanceMatrixEntry, error) {
+	result := make([][]DistanceMatrixEntry, len(origins))
+	for i := range result {
+		result[i] = make([]DistanceMatrixEntry, len(destinations))
+	}
+	if len(destinations) > len(origins) {
+		for i, origin := range origins {
+			if err := a.queryBatched(destinations, origin, func(j int, e DistanceMatrixEntry) {
+				result[i][j] = e
+			}); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	for j, dest := range destinations {
+		if err := a.queryBatched(origins, dest, func(i int, e DistanceMatrixEntry) {
+			result[i][j] = e
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// queryBatched 按 100 个一组请求 points 到 target 的距离，set 的下标对应 points
+func (a *AmapDrivingProvider) queryBatched(points []Coordinate, target Coordinate, set func(int, DistanceMatrixEntry)) error {
+	for start := 0; start < len(points); start += amapDistanceMaxOrigins {
+		end := start + amapDistanceMaxOrigins
+		if end > len(points) {
+			end = len(points)
+		}
+		entries, err := a.query(points[start:end], target)
+		if err != nil {
+			return err
+		}
+		for k, e := range entries {
+			set(start+k, e)
+		}
+	}
+	return nil
+}
+
+func amapCoordinate(c Coordinate) string {
+	return strconv.FormatFloat(c.Lng, 'f', 6, 64) + "," + strconv.FormatFloat(c.Lat, 'f', 6, 64)
+}
+
+// query 调用高德 /v3/distance（type=1 驾车）
+func (a *AmapDrivingProvider) query(origins []Coordinate, dest Coordinate) ([]DistanceMatrixEntry, error) {
+	parts := make([]string, len(origins))
+	for i, o := range origins {
+		parts[i] = amapCoordinate(o)
+	}
+	params := url.Values{}
+	params.Set("key", a.Key)
+	params.Set("origins", strings.Join(parts, "|"))
+	params.Set("destination", amapCoordinate(dest))
+	params.Set("type", "1")
+	params.Set("output", "json")
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get("https://restapi.amap.com/v3/distance?" + params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("请求高德距离测量失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取高德距离测量响应失败: %w", err)
+	}
+
+	var payload struct {
+		Status  string `json:"status"`
+		Info    string `json:"info"`
+		Results []struct {
+			OriginID string `json:"origin_id"`
+			Distance string `json:"distance"` // 米
+			Duration string `json:"duration"` // 秒
+			Info     string `json:"info"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("解析高德距离测量响应失败: %w", err)
+	}
+	if payload.Status != "1" {
+		return nil, fmt.Errorf("高德距离测量失败: %s", payload.Info)
+	}
+
+	entries := make([]DistanceMatrixEntry, len(origins))
+	filled := make([]bool, len(origins))
+	for _, r := range payload.Results {
+		idx, err := strconv.Atoi(r.OriginID)
+		if err != nil || idx < 1 || idx > len(origins) {
+			continue
+		}
+		meters, errD := strconv.ParseFloat(r.Distance, 64)
+		seconds, errT := strconv.ParseFloat(r.Duration, 64)
+		if errD != nil || errT != nil {
+			continue
+		}
+		entries[idx-1] = DistanceMatrixEntry{DistanceKm: meters / 1000, DurationMinutes: seconds / 60}
+		filled[idx-1] = true
+	}
+	for i, ok := range filled {
+		if !ok {
+			return nil, fmt.Errorf("高德距离测量缺少起点 %d 的结果", i+1)
+		}
+	}
+	return entries, nil
+}
+
+// FallbackProvider 主服务失败时使用备用服务
+type FallbackProvider struct {
+	Primary  DistanceMatrixProvider
+	Fallback DistanceMatrixProvider
+	OnError  func(err error) // 主服务失败回调（可为空，用于记录日志）
+}
+
+// Name 服务名称（主服务）
+func (f *FallbackProvider) Name() string {
+	return f.Primary.Name()
+}
+
+// Matrix 优先使用主服务
+func (f *FallbackProvider) Matrix(origins, destinations []Coordinate) ([][]DistanceMatrixEntry, error) {
+	result, err := f.Primary.Matrix(origins, destinations)
+	if err == nil {
+		return result, nil
+	}
+	if f.OnError != nil {
+		f.OnError(err)
+	}
+	return f.Fallback.Matrix(origins, destinations)
+}
+
+// DistanceMatrix 一组坐标两两之间的距离和时间，供路线规划查询
+// 查询不在矩阵中的坐标时按直线距离计算
+type DistanceMatrix struct {
+	index    map[Coordinate]int
+	entries  [][]DistanceMatrixEntry
+	fallback HaversineProvider
+}
+
+// NewDistanceMatrix 用 provider 计算 points 两两之间的距离矩阵；provider 失败时使用直线距离
+// speedKmh 用于直线距离兜底时估算时间
+func NewDistanceMatrix(provider DistanceMatrixProvider, points []Coordinate, speedKmh float64) *DistanceMatrix {
+	m := &DistanceMatrix{index: make(map[Coordinate]int), fallback: HaversineProvider{SpeedKmh: speedKmh}}
+	unique := make([]Coordinate, 0, len(points))
+	for _, p := range points {
+		if _, ok := m.index[p]; !ok {
+			m.index[p] = len(unique)
+			unique = append(unique, p)
+		}
+	}
+	if provider == nil {
+		provider = m.fallback
+	}
+	entries, err := provider.Matrix(unique, unique)
+	if err != nil {
+		entries, _ = m.fallback.Matrix(unique, unique)
+	}
+	m.entries = entries
+	return m
+}
+
+func (m *DistanceMatrix) lookup(lat1, lng1, lat2, lng2 float64) DistanceMatrixEntry {
+	a, b := Coordinate{Lat: lat1, Lng: lng1}, Coordinate{Lat: lat2, Lng: lng2}
+	if a == b {
+		return DistanceMatrixEntry{}
+	}
+	i, okA := m.index[a]
+	j, okB := m.index[b]
+	if okA && okB {
+		return m.entries[i][j]
+	}
+	return m.fallback.entry(a, b)
+}
+
+// Distance 两点行驶距离（公里）
+func (m *DistanceMatrix) Distance(lat1, lng1, lat2, lng2 float64) float64 {
+	return m.lookup(lat1, lng1, lat2, lng2).DistanceKm
+}
+
+// Duration 两点行驶时间（分钟）
+func (m *DistanceMatrix) Duration(lat1, lng1, lat2, lng2 float64) float64 {
+	return m.lookup(lat1, lng1, lat2, lng2).DurationMinutes
+}
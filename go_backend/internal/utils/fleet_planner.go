@@ -0,0 +1,340 @@
+package utils
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// FleetVehicle 参与调度的配送员（车辆）
+type FleetVehicle struct {
+	ID       string  // 配送员员工码
+	Lat      float64 // 当前位置纬度
+	Lng      float64 // 当前位置经度
+	Capacity float64 // 容量（配送计件数），0 表示不限
+	Load     float64 // 已有负载（手上未完成订单的计件数）
+}
+
+// FleetPickup 取货点（供应商）
+type FleetPickup struct {
+	ID  string
+	Lat float64
+	Lng float64
+}
+
+// FleetStop 配送点（订单）
+type FleetStop struct {
+	ID        string
+	Lat       float64
+	Lng       float64
+	Load      float64    // 配送计件数
+	Deadline  *time.Time // 最晚送达时间，为空表示不限
+	PickupIDs []string   // 配送前必须先去的取货点
+}
+
+// FleetPlanOptions 多车路线规划参数
+type FleetPlanOptions struct {
+	StartAt              time.Time                                    // 出发时间
+	SpeedKmh             float64                                      // 平均速度（公里/小时）
+	ServiceMinutes       float64                                      // 每个停靠点的停留时间（分钟）
+	LatePenaltyPerMinute float64                                      // 每迟到 1 分钟折算的公里数
+	BalanceWeight        float64                                      // 均衡权重：每多一单折算的公里数，越大越倾向平均分配
+	TwoOptIterations     int                                          // 单车路线 2-opt 迭代次数
+	Distance             func(lat1, lng1, lat2, lng2 float64) float64 // 距离函数（公里），为空使用球面距离
+	Duration             func(lat1, lng1, lat2, lng2 float64) float64 // 行驶时间函数（分钟），为空按平均速度估算
+}
+
+// FleetRouteStop 路线中的停靠点
+type FleetRouteStop struct {
+	Type             string     `json:"type"` // pickup-取货, delivery-送货
+	ID               string     `json:"id"`
+	Lat              float64    `json:"lat"`
+	Lng              float64    `json:"lng"`
+	Load             float64    `json:"load,omitempty"`
+	DistanceFromPrev float64    `json:"distance_from_prev"` // 距上一个点（公里）
+	ETA              time.Time  `json:"eta"`
+	Deadline         *time.Time `json:"deadline,omitempty"`
+	LateMinutes      float64    `json:"late_minutes,omitempty"`
+}
+
+// FleetRoute 单个配送员的路线
+type FleetRoute struct {
+	VehicleID     string           `json:"vehicle_id"`
+	Capacity      float64          `json:"capacity"`
+	ExistingLoad  float64          `json:"existing_load"`
+	Load          float64          `json:"load"` // 本次分配的计件数
+	TotalDistance float64          `json:"total_distance"`
+	LateStops     int              `json:"late_stops"`
+	FinishAt      time.Time        `json:"finish_at"`
+	Stops         []FleetRouteStop `json:"stops"`
+}
+
+// FleetUnassigned 未能分配的配送点
+type FleetUnassigned struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// FleetPlan 多车路线规划结果
+type FleetPlan struct {
+	Routes        []FleetRoute      `json:"routes"`
+	Unassigned    []FleetUnassigned `json:"unassigned"`
+	TotalDistance float64           `json:"total_distance"`
+	LateStops     int               `json:"late_stops"`
+}
+
+type fleetPlanner struct {
+	vehicles []FleetVehicle
+	stops    map[string]*FleetStop
+	pickups  map[string]FleetPickup
+	opts     FleetPlanOptions
+}
+
+// PlanFleetRoutes 为一批订单规划多车路线
+// 按最晚送达时间从早到晚依次做最低代价插入（距离 + 迟到惩罚 + 均衡惩罚），
+// 然后对每条路线做 2-opt 和跨车重定位改进。每条路线先去所需取货点，再按顺序送货。
+func PlanFleetRoutes(vehicles []FleetVehicle, stops []FleetStop, pickups []FleetPickup, opts FleetPlanOptions) *FleetPlan {
+	if opts.SpeedKmh <= 0 {
+		opts.SpeedKmh = 25
+	}
+	if opts.StartAt.IsZero() {
+		opts.StartAt = time.Now()
+	}
+	if opts.TwoOptIterations <= 0 {
+		opts.TwoOptIterations = 50
+	}
+	if opts.Distance == nil {
+		opts.Distance = CalculateDistance
+	}
+
+	p := &fleetPlanner{
+		vehicles: vehicles,
+		stops:    make(map[string]*FleetStop, len(stops)),
+		pickups:  make(map[string]FleetPickup, len(pickups)),
+		opts:     opts,
+	}
+	for i := range stops {
+		p.stops[stops[i].ID] = &stops[i]
+	}
+	for _, pk := range pickups {
+		p.pickups[pk.ID] = pk
+	}
+
+	plan := &FleetPlan{Routes: make([]FleetRoute, 0, len(vehicles)), Unassigned: make([]FleetUnassigned, 0)}
+	if len(vehicles) == 0 {
+		for _, s := range stops {
+			plan.Unassigned = append(plan.Unassigned, FleetUnassigned{ID: s.ID, Reason: "没有可用的配送员"})
+		}
+		return plan
+	}
+
+	// 最晚送达时间早的先分配，没有时间要求的最后分配
+	order := make([]*FleetStop, 0, len(stops))
+	for i := range stops {
+		order = append(order, &stops[i])
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i].Deadline, order[j].Deadline
+		switch {
+		case a != nil && b != nil:
+			return a.Before(*b)
+		case a != nil:
+			return true
+		case b != nil:
+			return false
+		}
+		return order[i].ID < order[j].ID
+	})
+
+	assigned := make([][]string, len(vehicles))
+	loads := make([]float64, len(vehicles))
+	for _, s := range order {
+		bestV, bestPos := -1, -1
+		bestDelta := math.MaxFloat64
+		for v := range vehicles {
+			if !p.fits(v, loads[v], s.Load) {
+				continue
+			}
+			base := p.cost(v, assigned[v])
+			for pos := 0; pos <= len(assigned[v]); pos++ {
+				candidate := insertAt(assigned[v], pos, s.ID)
+				delta := p.cost(v, candidate) - base + opts.BalanceWeight*float64(len(assigned[v]))
+				if delta < bestDelta {
+					bestDelta, bestV, bestPos = delta, v, pos
+				}
+			}
+		}
+		if bestV < 0 {
+			plan.Unassigned = append(plan.Unassigned, FleetUnassigned{ID: s.ID, Reason: "超出所有配送员的剩余容量"})
+			continue
+		}
+		assigned[bestV] = insertAt(assigned[bestV], bestPos, s.ID)
+		loads[bestV] += s.Load
+	}
+
+	for v := range vehicles {
+		assigned[v] = p.twoOpt(v, assigned[v])
+	}
+	p.relocate(assigned, loads)
+
+	for v, vehicle := range vehicles {
+		route := p.buildRoute(v, assigned[v])
+		route.Capacity = vehicle.Capacity
+		route.ExistingLoad = vehicle.Load
+		route.Load = loads[v]
+		plan.TotalDistance += route.TotalDistance
+		plan.LateStops += route.LateStops
+		plan.Routes = append(plan.Routes, route)
+	}
+	return plan
+}
+
+func (p *fleetPlanner) fits(v int, load, extra float64) bool {
+	capacity := p.vehicles[v].Capacity
+	return capacity <= 0 || p.vehicles[v].Load+load+extra <= capacity
+}
+
+func insertAt(list []string, pos int, id string) []string {
+	out := make([]string, 0, len(list)+1)
+	out = append(out, list[:pos]...)
+	out = append(out, id)
+	return append(out, list[pos:]...)
+}
+
+// cost 路线代价：总距离 + 迟到惩罚
+func (p *fleetPlanner) cost(v int, deliveries []string) float64 {
+	route := p.buildRoute(v, deliveries)
+	late := 0.0
+	for _, s := range route.Stops {
+		late += s.LateMinutes
+	}
+	return route.TotalDistance + late*p.opts.LatePenaltyPerMinute
+}
+
+// buildRoute 按送货顺序生成完整路线：先按最近邻依次去所需取货点，再依次送货
+func (p *fleetPlanner) buildRoute(v int, deliveries []string) FleetRoute {
+	vehicle := p.vehicles[v]
+	route := FleetRoute{VehicleID: vehicle.ID, Stops: make([]FleetRouteStop, 0)}
+	lat, lng := vehicle.Lat, vehicle.Lng
+	now := p.opts.StartAt
+
+	visit := func(stop FleetRouteStop) {
+		d := p.opts.Distance(lat, lng, stop.Lat, stop.Lng)
+		if p.opts.Duration != nil {
+			now = now.Add(time.Duration(p.opts.Duration(lat, lng, stop.Lat, stop.Lng) * float64(time.Minute)))
+		} else {
+			now = now.Add(time.Duration(d / p.opts.SpeedKmh * float64(time.Hour)))
+		}
+		stop.DistanceFromPrev = d
+		stop.ETA = now
+		if stop.Deadline != nil && now.After(*stop.Deadline) {
+			stop.LateMinutes = now.Sub(*stop.Deadline).Minutes()
+			route.LateStops++
+		}
+		route.TotalDistance += d
+		route.Stops = append(route.Stops, stop)
+		lat, lng = stop.Lat, stop.Lng
+		now = now.Add(time.Duration(p.opts.ServiceMinutes * float64(time.Minute)))
+	}
+
+	needed := make(map[string]bool)
+	for _, id := range deliveries {
+		for _, pk := range p.stops[id].PickupIDs {
+			if _, ok := p.pickups[pk]; ok {
+				needed[pk] = true
+			}
+		}
+	}
+	for len(needed) > 0 {
+		nearest := ""
+		nearestDist := math.MaxFloat64
+		for id := range needed {
+			pk := p.pickups[id]
+			if d := p.opts.Distance(lat, lng, pk.Lat, pk.Lng); d < nearestDist || (d == nearestDist && id < nearest) {
+				nearest, nearestDist = id, d
+			}
+		}
+		pk := p.pickups[nearest]
+		visit(FleetRouteStop{Type: "pickup", ID: pk.ID, Lat: pk.Lat, Lng: pk.Lng})
+		delete(needed, nearest)
+	}
+
+	for _, id := range deliveries {
+		s := p.stops[id]
+		visit(FleetRouteStop{Type: "delivery", ID: s.ID, Lat: s.Lat, Lng: s.Lng, Load: s.Load, Deadline: s.Deadline})
+	}
+	route.FinishAt = now
+	return route
+}
+
+// twoOpt 对单车送货顺序做 2-opt 改进
+func (p *fleetPlanner) twoOpt(v int, deliveries []string) []string {
+	best := append([]string(nil), deliveries...)
+	bestCost := p.cost(v, best)
+	n := len(best)
+	for iter := 0; iter < p.opts.TwoOptIterations; iter++ {
+		improved := false
+		for i := 0; i < n-1; i++ {
+			for j := i + 1; j < n; j++ {
+				candidate := append([]string(nil), best...)
+				for a, b := i, j; a < b; a, b = a+1, b-1 {
+					candidate[a], candidate[b] = candidate[b], candidate[a]
+				}
+				if c := p.cost(v, candidate); c < bestCost-1e-9 {
+					best, bestCost, improved = candidate, c, true
+				}
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+	return best
+}
+
+// relocate 尝试把订单移到其他配送员路线上，降低总代价（含均衡惩罚）
+func (p *fleetPlanner) relocate(assigned [][]string, loads []float64) {
+	balance := func(n int) float64 {
+		return p.opts.BalanceWeight * float64(n*(n-1)) / 2
+	}
+	for round := 0; round < 3; round++ {
+		moved := false
+		for from := range assigned {
+			for i := 0; i < len(assigned[from]); i++ {
+				id := assigned[from][i]
+				s := p.stops[id]
+				rest := append(append([]string(nil), assigned[from][:i]...), assigned[from][i+1:]...)
+				saving := p.cost(from, assigned[from]) + balance(len(assigned[from])) -
+					p.cost(from, rest) - balance(len(rest))
+
+				bestTo, bestPos := -1, -1
+				bestGain := 1e-6
+				for to := range assigned {
+					if to == from || !p.fits(to, loads[to], s.Load) {
+						continue
+					}
+					base := p.cost(to, assigned[to]) + balance(len(assigned[to]))
+					for pos := 0; pos <= len(assigned[to]); pos++ {
+						candidate := insertAt(assigned[to], pos, id)
+						added := p.cost(to, candidate) + balance(len(candidate)) - base
+						if gain := saving - added; gain > bestGain {
+							bestGain, bestTo, bestPos = gain, to, pos
+						}
+					}
+				}
+				if bestTo < 0 {
+					continue
+				}
+				assigned[from] = rest
+				assigned[bestTo] = insertAt(assigned[bestTo], bestPos, id)
+				loads[from] -= s.Load
+				loads[bestTo] += s.Load
+				moved = true
+				i--
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+}
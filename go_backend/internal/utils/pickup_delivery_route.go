@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"math"
+	"sort"
+)
+
+// 取送货路线停靠点类型
+const (
+	RouteStopPickup   = "pickup"   // 供应商取货
+	RouteStopDelivery = "delivery" // 客户送货
+)
+
+// RouteStop 取送货路线中的停靠点
+type RouteStop struct {
+	Type      string   // pickup-取货, delivery-送货
+	ID        string   // 取货点为供应商ID，送货点为订单ID
+	Lat       float64  // 纬度
+	Lng       float64  // 经度
+	PickupIDs []string // 送货点：送达前必须先到的取货点ID
+}
+
+// PlannedRouteStop 规划后的停靠点
+type PlannedRouteStop struct {
+	RouteStop
+	DistanceFromPrev   float64 // 距上一个点（公里）
+	CumulativeDistance float64 // 从起点累计距离（公里）
+}
+
+type pickupDeliveryPlanner struct {
+	startLat, startLng float64
+	stops              []RouteStop
+	pickupIndex        map[string]int
+	distance           func(lat1, lng1, lat2, lng2 float64) float64
+}
+
+// OptimizePickupDeliveryRoute 规划先取货后送货的单人路线
+// 每个送货点之前必须已经经过它所需的全部取货点；同一供应商只去一次。
+// 先用满足先后约束的最近邻生成初始路线，再用 2-opt 和单点重定位改进（只接受仍满足约束的方案）。
+// 送货点所需但不在 pickups 中的取货点视为已取货。distance 为空时使用球面距离。
+// 返回按顺序排列的停靠点和总距离（公里）
+func OptimizePickupDeliveryRoute(startLat, startLng float64, pickups, deliveries []RouteStop, iterations int,
+	distance func(lat1, lng1, lat2, lng2 float64) float64) ([]PlannedRouteStop, float64) {
+	if distance == nil {
+		distance = CalculateDistance
+	}
+	p := &pickupDeliveryPlanner{
+		startLat:    startLat,
+		startLng:    startLng,
+		pickupIndex: make(map[string]int),
+		distance:    distance,
+	}
+
+	// 只保留被送货点引用的取货点，按 ID 排序保证结果稳定
+	needed := make(map[string]bool)
+	for _, d := range deliveries {
+		for _, id := range d.PickupIDs {
+			needed[id] = true
+		}
+	}
+	sortedPickups := append([]RouteStop(nil), pickups...)
+	sort.Slice(sortedPickups, func(i, j int) bool { return sortedPickups[i].ID < sortedPickups[j].ID })
+	for _, pk := range sortedPickups {
+		if _, dup := p.pickupIndex[pk.ID]; dup || !needed[pk.ID] {
+			continue
+		}
+		pk.Type = RouteStopPickup
+		p.pickupIndex[pk.ID] = len(p.stops)
+		p.stops = append(p.stops, pk)
+	}
+	sortedDeliveries := append([]RouteStop(nil), deliveries...)
+	sort.Slice(sortedDeliveries, func(i, j int) bool { return sortedDeliveries[i].ID < sortedDeliveries[j].ID })
+	for _, d := range sortedDeliveries {
+		d.Type = RouteStopDelivery
+		p.stops = append(p.stops, d)
+	}
+
+	route := p.nearestNeighbor()
+	route = p.improve(route, iterations)
+
+	planned := make([]PlannedRouteStop, 0, len(route))
+	lat, lng := startLat, startLng
+	total := 0.0
+	for _, idx := range route {
+		s := p.stops[idx]
+		d := p.distance(lat, lng, s.Lat, s.Lng)
+		total += d
+		planned = append(planned, PlannedRouteStop{RouteStop: s, DistanceFromPrev: d, CumulativeDistance: total})
+		lat, lng = s.Lat, s.Lng
+	}
+	return planned, total
+}
+
+// ready 送货点所需取货点是否都已经过
+func (p *pickupDeliveryPlanner) ready(idx int, visited []bool) bool {
+	for _, id := range p.stops[idx].PickupIDs {
+		if pi, ok := p.pickupIndex[id]; ok && !visited[pi] {
+			return false
+		}
+	}
+	return true
+}
+
+// nearestNeighbor 满足先后约束的最近邻初始路线
+func (p *pickupDeliveryPlanner) nearestNeighbor() []int {
+	n := len(p.stops)
+	visited := make([]bool, n)
+	route := make([]int, 0, n)
+	lat, lng := p.startLat, p.startLng
+	for len(route) < n {
+		next := -1
+		nextDist := math.MaxFloat64
+		for i := 0; i < n; i++ {
+			if visited[i] || (p.stops[i].Type == RouteStopDelivery && !p.ready(i, visited)) {
+				continue
+			}
+			if d := p.distance(lat, lng, p.stops[i].Lat, p.stops[i].Lng); d < nextDist {
+				next, nextDist = i, d
+			}
+		}
+		visited[next] = true
+		route = append(route, next)
+		lat, lng = p.stops[next].Lat, p.stops[next].Lng
+	}
+	return route
+}
+
+// feasible 检查路线是否满足先取货后送货
+func (p *pickupDeliveryPlanner) feasible(route []int) bool {
+	visited := make([]bool, len(p.stops))
+	for _, idx := range route {
+		if p.stops[idx].Type == RouteStopDelivery && !p.ready(idx, visited) {
+			return false
+		}
+		visited[idx] = true
+	}
+	return true
+}
+
+func (p *pickupDeliveryPlanner) length(route []int) float64 {
+	total := 0.0
+	lat, lng := p.startLat, p.startLng
+	for _, idx := range route {
+		total += p.distance(lat, lng, p.stops[idx].Lat, p.stops[idx].Lng)
+		lat, lng = p.stops[idx].Lat, p.stops[idx].Lng
+	}
+	return total
+}
+
+// improve 2-opt 反转与单点重定位改进，起点固定为配送员位置，路线不回到起点
+func (p *pickupDeliveryPlanner) improve(route []int, iterations int) []int {
+	best := append([]int(nil), route...)
+	bestLen := p.length(best)
+	n := len(best)
+	try := func(candidate []int) bool {
+		if l := p.length(candidate); l < bestLen-1e-9 && p.feasible(candidate) {
+			best, bestLen = candidate, l
+			return true
+		}
+		return false
+	}
+
+	for iter := 0; iter < iterations; iter++ {
+		improved := false
+		for i := 0; i < n-1; i++ {
+			for j := i + 1; j < n; j++ {
+				candidate := append([]int(nil), best...)
+				for a, b := i, j; a < b; a, b = a+1, b-1 {
+					candidate[a], candidate[b] = candidate[b], candidate[a]
+				}
+				if try(candidate) {
+					improved = true
+				}
+			}
+		}
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				if i == j {
+					continue
+				}
+				candidate := append([]int(nil), best...)
+				node := candidate[i]
+				candidate = append(candidate[:i], candidate[i+1:]...)
+				candidate = append(candidate[:j], append([]int{node}, candidate[j:]...)...)
+				if try(candidate) {
+					improved = true
+				}
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+	return best
+}
@@ -19,6 +19,7 @@ type DeliveryRouteOptimizer struct {
 	locations     []Location
 	nameToIndex   map[string]int
 	distanceCache map[routeKey]float64
+	distanceFunc  func(lat1, lng1, lat2, lng2 float64) float64
 	mu            sync.RWMutex
 }
 
@@ -56,7 +57,15 @@ func (o *DeliveryRouteOptimizer) AddLocation(name string, lat, lng float64) int
 	return idx
 }
 
-// CalculateDistance 计算两点球面距离（公里），带缓存（公开方法）
+// SetDistanceFunc 设置距离函数（如道路距离矩阵），为空时使用球面距离
+func (o *DeliveryRouteOptimizer) SetDistanceFunc(f func(lat1, lng1, lat2, lng2 float64) float64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.distanceFunc = f
+	o.distanceCache = make(map[routeKey]float64)
+}
+
+// CalculateDistance 计算两点距离（公里），默认球面距离，带缓存（公开方法）
 func (o *DeliveryRouteOptimizer) CalculateDistance(idx1, idx2 int) float64 {
 	// 确保 idx1 < idx2 以统一缓存键
 	if idx1 > idx2 {
@@ -74,6 +83,14 @@ func (o *DeliveryRouteOptimizer) CalculateDistance(idx1, idx2 int) float64 {
 	// 计算距离
 	a := o.locations[idx1]
 	b := o.locations[idx2]
+	if o.distanceFunc != nil {
+		// 道路距离可能不对称，这里取两个方向的平均值以保持缓存键统一
+		dist := (o.distanceFunc(a.Lat, a.Lng, b.Lat, b.Lng) + o.distanceFunc(b.Lat, b.Lng, a.Lat, a.Lng)) / 2
+		o.mu.Lock()
+		o.distanceCache[key] = dist
+		o.mu.Unlock()
+		return dist
+	}
 	R := 6371.0 // 地球半径（公里）
 
 	lat1 := a.Lat * math.Pi / 180.0
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"math"
+	"time"
+)
+
+// TrackPoint 轨迹点
+type TrackPoint struct {
+	Lat  float64   `json:"latitude"`
+	Lng  float64   `json:"longitude"`
+	Time time.Time `json:"time"`
+}
+
+// TrackDwell 在某位置附近的停留
+type TrackDwell struct {
+	Arrive time.Time // 进入范围的第一个轨迹点时间
+	Depart time.Time // 离开范围前最后一个轨迹点时间
+}
+
+// Minutes 停留时长（分钟）
+func (d TrackDwell) Minutes() float64 {
+	return d.Depart.Sub(d.Arrive).Minutes()
+}
+
+// SimplifyTrack Douglas-Peucker 轨迹抽稀，toleranceMeters 为允许偏离的最大距离（米），保留首尾点
+func SimplifyTrack(points []TrackPoint, toleranceMeters float64) []TrackPoint {
+	if len(points) <= 2 || toleranceMeters <= 0 {
+		return append([]TrackPoint(nil), points...)
+	}
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+
+	// 用栈代替递归，避免长轨迹递归过深
+	type span struct{ start, end int }
+	stack := []span{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		maxDist, maxIdx := 0.0, -1
+		for i := s.start + 1; i < s.end; i++ {
+			if d := segmentDistanceMeters(points[i], points[s.start], points[s.end]); d > maxDist {
+				maxDist, maxIdx = d, i
+			}
+		}
+		if maxIdx >= 0 && maxDist > toleranceMeters {
+			keep[maxIdx] = true
+			stack = append(stack, span{s.start, maxIdx}, span{maxIdx, s.end})
+		}
+	}
+
+	result := make([]TrackPoint, 0)
+	for i, p := range points {
+		if keep[i] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// segmentDistanceMeters 点到线段的距离（米），短距离内按等距投影近似
+func segmentDistanceMeters(p, a, b TrackPoint) float64 {
+	const metersPerDegree = 111320.0
+	cosLat := math.Cos(a.Lat * math.Pi / 180)
+	px, py := (p.Lng-a.Lng)*metersPerDegree*cosLat, (p.Lat-a.Lat)*metersPerDegree
+	bx, by := (b.Lng-a.Lng)*metersPerDegree*cosLat, (b.Lat-a.Lat)*metersPerDegree
+
+	lenSq := bx*bx + by*by
+	if lenSq == 0 {
+		return math.Hypot(px, py)
+	}
+	t := (px*bx + py*by) / lenSq
+	if t < 0 {
+		t = 0
+	} else if t > 1 {
+		t = 1
+	}
+	return math.Hypot(px-t*bx, py-t*by)
+}
+
+// TrackDistance 轨迹累计距离（公里）
+// 相邻两点推算速度超过 maxSpeedKmh 的视为定位漂移并跳过该点；maxSpeedKmh 为 0 时不过滤
+func TrackDistance(points []TrackPoint, maxSpeedKmh float64) float64 {
+	acc := TrackDistanceAccumulator{MaxSpeedKmh: maxSpeedKmh}
+	for _, p := range points {
+		acc.Add(p)
+	}
+	return acc.DistanceKm
+}
+
+// TrackDistanceAccumulator 逐点累加轨迹距离，用于不在内存中保留整段轨迹的统计
+type TrackDistanceAccumulator struct {
+	MaxSpeedKmh float64 // 超过该速度视为定位漂移，0 为不过滤
+	DistanceKm  float64 // 已累计距离（公里）
+	last        *TrackPoint
+}
+
+// Add 追加轨迹点（需按时间升序）
+func (a *TrackDistanceAccumulator) Add(p TrackPoint) {
+	if a.last == nil {
+		a.last = &p
+		return
+	}
+	d := CalculateDistance(a.last.Lat, a.last.Lng, p.Lat, p.Lng)
+	if a.MaxSpeedKmh > 0 && d > 0 {
+		hours := p.Time.Sub(a.last.Time).Hours()
+		if hours <= 0 || d/hours > a.MaxSpeedKmh {
+			// 漂移点不作为下一段的起点
+			return
+		}
+	}
+	a.DistanceKm += d
+	a.last = &p
+}
+
+// FindDwell 查找轨迹在某位置 radiusMeters 范围内的停留，选取时间上最接近 at 的一段连续停留
+func FindDwell(points []TrackPoint, lat, lng, radiusMeters float64, at time.Time) (TrackDwell, bool) {
+	var best TrackDwell
+	found := false
+	bestGap := time.Duration(math.MaxInt64)
+
+	inRun := false
+	var run TrackDwell
+	flush := func() {
+		if !inRun {
+			return
+		}
+		inRun = false
+		var gap time.Duration
+		switch {
+		case at.Before(run.Arrive):
+			gap = run.Arrive.Sub(at)
+		case at.After(run.Depart):
+			gap = at.Sub(run.Depart)
+		}
+		if !found || gap < bestGap {
+			best, bestGap, found = run, gap, true
+		}
+	}
+
+	for _, p := range points {
+		if CalculateDistance(p.Lat, p.Lng, lat, lng)*1000 <= radiusMeters {
+			if !inRun {
+				inRun = true
+				run = TrackDwell{Arrive: p.Time}
+			}
+			run.Depart = p.Time
+			continue
+		}
+		flush()
+	}
+	flush()
+	return best, found
+}